@@ -0,0 +1,633 @@
+/*
+Package client provides a Go client for the replicated key-value store, built on the
+KVService served by every replica on its gRPC port (:500<replica_id>).
+
+A RaftKVClient is configured with the gRPC addresses of the replicas. Requests are sent
+to the replica believed to be the leader; if it turns out not to be, the client retries on the
+leader it advertises (see LeaderHint), or on the next replica if it doesn't know the leader or is
+unreachable, so that callers don't need to track the leader themselves.
+
+Retrying a write whose outcome is unknown (e.g. after a timeout) may apply it twice, unless
+Sessions is set: the writes are then numbered within a client session registered with the
+replicas, which apply each of them at most once.
+*/
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Config holds the settings of a RaftKVClient.
+type Config struct {
+	Endpoints      []string      // gRPC addresses of the replicas, e.g. "localhost:5000"
+	Token          string        // Presented to the replicas if they were started with -client-token, or the API token of a user
+	TLS            *tls.Config   // Used for connecting to the replicas if they were started with -peer-cert. nil connects in cleartext.
+	ClientID       string        // Identifies the client's writes, used by the replicas to reject duplicate writes
+	Sessions       bool          // Make the writes in a client session, applying each of them once. Writes are then made one at a time.
+	RequestTimeout time.Duration // Time allowed for a single attempt of a request. 0 means no timeout.
+	MaxRetries     int           // Attempts made after the first one failed because the leader was unavailable
+	RetryBackoff   time.Duration // Wait before retrying once every replica has been tried
+}
+
+// Return the configuration used for the given replicas when no other settings are needed.
+func DefaultConfig(endpoints ...string) Config {
+
+	return Config{
+		Endpoints:      endpoints,
+		RequestTimeout: 5 * time.Second,
+		MaxRetries:     2 * len(endpoints),
+		RetryBackoff:   200 * time.Millisecond,
+	}
+
+}
+
+// KeyValue is a pair returned by range and prefix queries.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Event is a change made to a watched key.
+type Event struct {
+	Type  string // "PUT" or "DELETE"
+	Key   string
+	Value string
+	Index int32 // Index of the log entry that made the change
+}
+
+// Returned when a write is rejected because it is identical to the latest write of the same client.
+var ErrDuplicateWrite = errors.New("client: identical write already received from this client")
+
+// RaftKVClient is safe for concurrent use.
+type RaftKVClient struct {
+	config Config
+
+	conns   []*grpc.ClientConn
+	clients []protos.KVServiceClient
+
+	mu     sync.Mutex
+	leader int // Index of the endpoint believed to be the leader
+
+	session  sync.Mutex // Held by the write being made in the session, if Sessions is set
+	id       int64      // ID of the session, 0 until registered
+	sequence int64      // Sequence number of the latest write of the session
+}
+
+// Create a client for the given replicas. Connections are established lazily, so New
+// doesn't fail if some (or all) of the replicas are not up yet.
+func New(config Config) (*RaftKVClient, error) {
+
+	if len(config.Endpoints) == 0 {
+		return nil, errors.New("client: no endpoints provided")
+	}
+
+	c := &RaftKVClient{config: config}
+
+	transport := grpc.WithInsecure()
+	if config.TLS != nil {
+		transport = grpc.WithTransportCredentials(credentials.NewTLS(config.TLS))
+	}
+
+	opts := []grpc.DialOption{transport}
+	if config.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: config.Token}))
+	}
+
+	for _, endpoint := range config.Endpoints {
+
+		conn, err := grpc.Dial(endpoint, opts...)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+
+		c.conns = append(c.conns, conn)
+		c.clients = append(c.clients, protos.NewKVServiceClient(conn))
+	}
+
+	return c, nil
+}
+
+// Close the connections to the replicas.
+func (c *RaftKVClient) Close() error {
+
+	var err error
+
+	for _, conn := range c.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Return the gRPC address of the replica currently believed to be the leader.
+func (c *RaftKVClient) Leader() string {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.config.Endpoints[c.leader]
+}
+
+// Move on to the next replica, unless another request already did so.
+func (c *RaftKVClient) nextLeader(failed int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.leader == failed {
+		c.leader = (c.leader + 1) % len(c.clients)
+	}
+}
+
+/*
+Return the index of the endpoint of the replica with the given gRPC address, or -1. Replicas advertise
+their gRPC address as seen by their peers (e.g. ":5001"), which matches an endpoint if it's the same
+or only omits the host.
+*/
+func (c *RaftKVClient) endpoint(address string) int {
+
+	for i, endpoint := range c.config.Endpoints {
+		if endpoint == address || (strings.HasPrefix(address, ":") && strings.HasSuffix(endpoint, address)) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// Switch to the replica advertised as the new leader.
+func (c *RaftKVClient) followLeader(address string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if i := c.endpoint(address); i != -1 {
+		c.leader = i
+	}
+}
+
+/*
+Switch to the leader advertised by the replica that rejected a request, unless another request
+already moved on. Return whether the advertised leader is another one of the endpoints.
+*/
+func (c *RaftKVClient) redirect(failed int, address string) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := c.endpoint(address)
+	if i == -1 || i == failed {
+		return false
+	}
+
+	if c.leader == failed {
+		c.leader = i
+	}
+
+	return true
+}
+
+/*
+Return the leader advertised by a replica that rejected a request because it isn't the leader, if
+it knows the leader. The returned LeaderInfo holds the ID, the addresses and the term of the leader.
+*/
+func LeaderHint(err error) (*protos.LeaderInfo, bool) {
+
+	for _, detail := range status.Convert(err).Details() {
+		if leader, ok := detail.(*protos.LeaderInfo); ok && leader.Id >= 0 {
+			return leader, true
+		}
+	}
+
+	return nil, false
+}
+
+// Errors after which the request is retried on another replica: the replica is not the
+// leader, or couldn't be reached.
+func retryable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+/*
+Perform the call on the leader, retrying on the next replica while the leader is unavailable.
+Each attempt is given RequestTimeout, and retries stop as soon as ctx is done.
+*/
+func (c *RaftKVClient) do(ctx context.Context, call func(ctx context.Context, kv protos.KVServiceClient) error) error {
+
+	var err error
+
+	for attempt := 0; attempt <= c.config.MaxRetries; attempt++ {
+
+		c.mu.Lock()
+		current := c.leader
+		c.mu.Unlock()
+
+		attempt_ctx, cancel := ctx, context.CancelFunc(func() {})
+		if c.config.RequestTimeout > 0 {
+			attempt_ctx, cancel = context.WithTimeout(ctx, c.config.RequestTimeout)
+		}
+
+		err = call(attempt_ctx, c.clients[current])
+		cancel()
+
+		if !retryable(err) {
+			return err
+		}
+
+		// Go straight to the leader the replica knows of, rather than trying the next one.
+		if leader, ok := LeaderHint(err); ok && c.redirect(current, leader.GrpcAddress) {
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			continue
+		}
+
+		c.nextLeader(current)
+
+		// Back off once every replica has been tried without finding the leader, e.g. during an election.
+		if (attempt+1)%len(c.clients) == 0 {
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.config.RetryBackoff):
+			}
+
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+/*
+Perform a write with do, in the client session if Sessions is set: every attempt of the write then
+carries the same sequence number, so that it is applied once. The session is registered by the
+first write, and registered again if it expired, as the write wasn't applied then.
+*/
+func (c *RaftKVClient) write(ctx context.Context, call func(ctx context.Context, kv protos.KVServiceClient, session, sequence int64) error) error {
+
+	if !c.config.Sessions {
+		return c.do(ctx, func(ctx context.Context, kv protos.KVServiceClient) error { return call(ctx, kv, 0, 0) })
+	}
+
+	c.session.Lock()
+	defer c.session.Unlock()
+
+	var err error
+
+	for registered := false; ; registered = true {
+
+		if c.id == 0 {
+
+			err = c.do(ctx, func(ctx context.Context, kv protos.KVServiceClient) error {
+				resp, err := kv.RegisterSession(ctx, &protos.RegisterSessionRequest{Client: c.config.ClientID})
+				if err == nil {
+					c.id, c.sequence = resp.Session, 0
+				}
+				return err
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		c.sequence++
+		id, sequence := c.id, c.sequence
+
+		err = c.do(ctx, func(ctx context.Context, kv protos.KVServiceClient) error { return call(ctx, kv, id, sequence) })
+
+		if status.Code(err) != codes.FailedPrecondition || registered {
+			return err
+		}
+
+		c.id = 0
+	}
+}
+
+// Return the value of the key, and whether it exists.
+func (c *RaftKVClient) Get(ctx context.Context, key string) (string, bool, error) {
+	return c.GetAt(ctx, key, 0)
+}
+
+// Return the value of the key as of the given store revision, and whether it existed then.
+func (c *RaftKVClient) GetAt(ctx context.Context, key string, revision int64) (string, bool, error) {
+
+	var resp *protos.GetResponse
+
+	err := c.do(ctx, func(ctx context.Context, kv protos.KVServiceClient) (err error) {
+		resp, err = kv.Get(ctx, &protos.GetRequest{Key: key, Revision: revision})
+		return err
+	})
+
+	if err != nil {
+		return "", false, err
+	}
+
+	return resp.Value, resp.Found, nil
+}
+
+// Set the value of the key, creating it if it doesn't exist.
+func (c *RaftKVClient) Put(ctx context.Context, key, value string) error {
+
+	err := c.write(ctx, func(ctx context.Context, kv protos.KVServiceClient, session, sequence int64) error {
+		_, err := kv.Put(ctx, &protos.PutRequest{Key: key, Value: value, Client: c.config.ClientID, Session: session, Sequence: sequence})
+		return err
+	})
+
+	// The same value was the latest one written by this client, e.g. by a retried attempt.
+	if status.Code(err) == codes.AlreadyExists {
+		return nil
+	}
+
+	return err
+}
+
+// Delete the key, returning whether it existed.
+func (c *RaftKVClient) Delete(ctx context.Context, key string) (bool, error) {
+
+	var resp *protos.DeleteResponse
+
+	err := c.write(ctx, func(ctx context.Context, kv protos.KVServiceClient, session, sequence int64) (err error) {
+		resp, err = kv.Delete(ctx, &protos.DeleteRequest{Key: key, Client: c.config.ClientID, Session: session, Sequence: sequence})
+		return err
+	})
+
+	// The key was already deleted by the latest write of this client.
+	if status.Code(err) == codes.AlreadyExists {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Deleted, nil
+}
+
+/*
+Return the keys in [start, end) in order, fetching all the pages of the range. An empty end
+means the range is unbounded. A limit of 0 returns all the keys.
+*/
+func (c *RaftKVClient) Range(ctx context.Context, start, end string, limit int) ([]KeyValue, error) {
+
+	var kvs []KeyValue
+	token := ""
+
+	for {
+
+		var resp *protos.RangeResponse
+
+		err := c.do(ctx, func(ctx context.Context, kv protos.KVServiceClient) (err error) {
+			resp, err = kv.Range(ctx, &protos.RangeRequest{Start: start, End: end, Token: token})
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, kv := range resp.Kvs {
+
+			kvs = append(kvs, KeyValue{Key: kv.Key, Value: kv.Value})
+
+			if limit > 0 && len(kvs) == limit {
+				return kvs, nil
+			}
+		}
+
+		if resp.NextToken == "" {
+			return kvs, nil
+		}
+
+		token = resp.NextToken
+	}
+}
+
+// Return the keys starting with the given prefix, in order.
+func (c *RaftKVClient) Prefix(ctx context.Context, prefix string, limit int) ([]KeyValue, error) {
+	return c.Range(ctx, prefix, prefixEnd(prefix), limit)
+}
+
+// Return the smallest key greater than all the keys starting with the prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+
+	end := []byte(prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// Atomically apply the success operations if all the comparisons hold, and the failure
+// operations otherwise. Returns whether the comparisons held.
+func (c *RaftKVClient) Txn(ctx context.Context, txn *protos.TxnRequest) (bool, error) {
+
+	if txn.Client == "" {
+		txn.Client = c.config.ClientID
+	}
+
+	var resp *protos.TxnResponse
+
+	err := c.write(ctx, func(ctx context.Context, kv protos.KVServiceClient, session, sequence int64) (err error) {
+		txn.Session, txn.Sequence = session, sequence
+		resp, err = kv.Txn(ctx, txn)
+		return err
+	})
+
+	if status.Code(err) == codes.AlreadyExists {
+		return false, ErrDuplicateWrite
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Succeeded, nil
+}
+
+// Atomically apply the operations, replicated as a single log entry (e.g. to load many keys at
+// once). Returns the number of operations that modified the store.
+func (c *RaftKVClient) BatchPut(ctx context.Context, ops []*protos.KVOp) (int, error) {
+
+	var resp *protos.BatchPutResponse
+
+	err := c.write(ctx, func(ctx context.Context, kv protos.KVServiceClient, session, sequence int64) (err error) {
+		resp, err = kv.BatchPut(ctx, &protos.BatchPutRequest{Ops: ops, Client: c.config.ClientID, Session: session, Sequence: sequence})
+		return err
+	})
+
+	if status.Code(err) == codes.AlreadyExists {
+		return 0, ErrDuplicateWrite
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(resp.Changed), nil
+}
+
+// Set the key to value only if it currently has the given value (or doesn't exist, if
+// expected is nil). Returns whether the key was set.
+func (c *RaftKVClient) CompareAndSwap(ctx context.Context, key string, expected *string, value string) (bool, error) {
+
+	cmp := &protos.Compare{Key: key, Condition: protos.Compare_NOT_EXISTS}
+	if expected != nil {
+		cmp = &protos.Compare{Key: key, Condition: protos.Compare_VALUE_EQUAL, Value: *expected}
+	}
+
+	return c.Txn(ctx, &protos.TxnRequest{
+		Compare: []*protos.Compare{cmp},
+		Success: []*protos.KVOp{{Type: protos.KVOp_PUT, Key: key, Value: value}},
+	})
+}
+
+/*
+Watch the changes made to the key (or to all the keys starting with it, if prefix is set).
+Any replica can serve watches; if the stream breaks, the client reconnects to the next
+replica, and changes made in the meantime are not delivered. While a watch is open, the
+client also follows the leader changes notified by the replica. The returned channel is
+closed once ctx is done.
+*/
+func (c *RaftKVClient) Watch(ctx context.Context, key string, prefix bool) <-chan Event {
+
+	events := make(chan Event)
+
+	go func() {
+
+		defer close(events)
+
+		// Watches are served by any replica, so they don't follow the leader.
+		c.mu.Lock()
+		current := c.leader
+		c.mu.Unlock()
+
+		for ctx.Err() == nil {
+
+			stream, err := c.clients[current].Watch(ctx, &protos.WatchRequest{Key: key, Prefix: prefix})
+
+			for err == nil {
+
+				var event *protos.WatchEvent
+				if event, err = stream.Recv(); err != nil {
+					break
+				}
+
+				// Leader change notifications are not delivered, but let the following requests go to the new leader.
+				if event.Leader != nil {
+					c.followLeader(event.Leader.GrpcAddress)
+					continue
+				}
+
+				select {
+				case events <- Event{Type: event.Type.String(), Key: event.Key, Value: event.Value, Index: event.Index}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			current = (current + 1) % len(c.clients)
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.config.RetryBackoff):
+			}
+		}
+
+	}()
+
+	return events
+}
+
+/*
+Export the keys starting with the prefix (every key if empty), calling fn with each of them in key
+order, all as of the same revision (e.g. for an analytics job). The export is read from a replica other
+than the leader when there are several, so as not to slow down the client requests, and resumes on the
+next replica if the stream breaks or the replica is busy. An empty cursor starts a new export at the
+current revision, and the cursor returned by an export that failed resumes it. Returns the cursor to
+resume from, "" once every key was exported.
+*/
+func (c *RaftKVClient) Export(ctx context.Context, prefix, cursor string, fn func(kv KeyValue) error) (string, error) {
+
+	c.mu.Lock()
+	current := (c.leader + 1) % len(c.clients)
+	c.mu.Unlock()
+
+	var err error
+
+	for attempt := 0; attempt <= c.config.MaxRetries; attempt++ {
+
+		var stream protos.KVService_ExportClient
+		stream, err = c.clients[current].Export(ctx, &protos.ExportRequest{Prefix: prefix, Cursor: cursor})
+
+		for err == nil {
+
+			var chunk *protos.ExportChunk
+			if chunk, err = stream.Recv(); err != nil {
+				break
+			}
+
+			for _, kv := range chunk.Kvs {
+				if err := fn(KeyValue{Key: kv.Key, Value: kv.Value}); err != nil {
+					return cursor, err
+				}
+			}
+
+			if cursor = chunk.Cursor; cursor == "" {
+				return "", nil
+			}
+		}
+
+		// The busy replicas, and those serving no queries, are skipped too.
+		if code := status.Code(err); code != codes.Unavailable && code != codes.ResourceExhausted && code != codes.FailedPrecondition {
+			return cursor, err
+		}
+
+		current = (current + 1) % len(c.clients)
+
+		select {
+		case <-ctx.Done():
+			return cursor, ctx.Err()
+		case <-time.After(c.config.RetryBackoff):
+		}
+	}
+
+	return cursor, err
+}
+
+// Credentials attaching the client token to every request, see the auth interceptor in raft/interceptors.go.
+type tokenCredentials struct {
+	token string
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
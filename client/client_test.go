@@ -0,0 +1,362 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A minimal in-memory KVService, which rejects every request unless it is the leader.
+type fakeReplica struct {
+	protos.UnimplementedKVServiceServer
+
+	mu     sync.Mutex
+	leader bool
+	hint   string // gRPC address of the leader advertised when rejecting a request, if any
+	calls  int
+	data   map[string]string
+}
+
+func (f *fakeReplica) check() error {
+
+	f.calls++
+
+	if !f.leader && f.hint != "" {
+		st, _ := status.New(codes.Unavailable, "not a leader").WithDetails(&protos.LeaderInfo{Id: 2, GrpcAddress: f.hint, Term: 3})
+		return st.Err()
+	}
+
+	if !f.leader {
+		return status.Error(codes.Unavailable, "not a leader")
+	}
+
+	return nil
+}
+
+func (f *fakeReplica) Get(ctx context.Context, in *protos.GetRequest) (*protos.GetResponse, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+
+	value, found := f.data[in.Key]
+	return &protos.GetResponse{Found: found, Value: value}, nil
+}
+
+func (f *fakeReplica) Range(ctx context.Context, in *protos.RangeRequest) (*protos.RangeResponse, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+
+	resp := &protos.RangeResponse{}
+	for k, v := range f.data {
+		if k >= in.Start && (in.End == "" || k < in.End) {
+			resp.Kvs = append(resp.Kvs, &protos.KeyValue{Key: k, Value: v})
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return resp.Kvs[i].Key < resp.Kvs[j].Key })
+
+	return resp, nil
+}
+
+func (f *fakeReplica) Txn(ctx context.Context, in *protos.TxnRequest) (*protos.TxnResponse, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check(); err != nil {
+		return nil, err
+	}
+
+	succeeded := true
+	for _, c := range in.Compare {
+		value, found := f.data[c.Key]
+		switch c.Condition {
+		case protos.Compare_EXISTS:
+			succeeded = succeeded && found
+		case protos.Compare_NOT_EXISTS:
+			succeeded = succeeded && !found
+		default:
+			succeeded = succeeded && found && value == c.Value
+		}
+	}
+
+	ops := in.Success
+	if !succeeded {
+		ops = in.Failure
+	}
+
+	for _, op := range ops {
+		if op.Type == protos.KVOp_DELETE {
+			delete(f.data, op.Key)
+		} else {
+			f.data[op.Key] = op.Value
+		}
+	}
+
+	return &protos.TxnResponse{Succeeded: succeeded}, nil
+}
+
+func (f *fakeReplica) Put(ctx context.Context, in *protos.PutRequest) (*protos.PutResponse, error) {
+
+	_, err := f.Txn(ctx, &protos.TxnRequest{Success: []*protos.KVOp{{Key: in.Key, Value: in.Value}}})
+	if err != nil {
+		return nil, err
+	}
+
+	return &protos.PutResponse{}, nil
+}
+
+func (f *fakeReplica) BatchPut(ctx context.Context, in *protos.BatchPutRequest) (*protos.BatchPutResponse, error) {
+
+	_, err := f.Txn(ctx, &protos.TxnRequest{Success: in.Ops})
+	if err != nil {
+		return nil, err
+	}
+
+	return &protos.BatchPutResponse{Changed: int32(len(in.Ops))}, nil
+}
+
+// Start the given fake replicas, returning their addresses along with a function stopping them.
+func startReplicas(t *testing.T, replicas ...*fakeReplica) ([]string, func()) {
+
+	var addrs []string
+	var servers []*grpc.Server
+
+	for _, replica := range replicas {
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		server := grpc.NewServer()
+		protos.RegisterKVServiceServer(server, replica)
+		go server.Serve(listener)
+
+		addrs = append(addrs, listener.Addr().String())
+		servers = append(servers, server)
+	}
+
+	return addrs, func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	}
+}
+
+/*
+ * This test case checks that the client finds the leader among the replicas,
+ * sticks to it, and moves on to the new leader once leadership changes.
+ */
+func TestLeaderDiscovery(t *testing.T) {
+
+	replicas := []*fakeReplica{
+		{data: make(map[string]string)},
+		{data: make(map[string]string)},
+		{data: make(map[string]string), leader: true},
+	}
+
+	addrs, stop := startReplicas(t, replicas...)
+	defer stop()
+
+	config := DefaultConfig(addrs...)
+	config.RetryBackoff = 10 * time.Millisecond
+
+	c, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "a", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if c.Leader() != addrs[2] {
+		t.Errorf("Expected the leader to be %v, got %v", addrs[2], c.Leader())
+	}
+
+	if value, found, err := c.Get(ctx, "a"); err != nil || !found || value != "1" {
+		t.Errorf("Get returned (%q, %v, %v)", value, found, err)
+	}
+
+	if replicas[0].calls != 1 || replicas[1].calls != 1 || replicas[2].calls != 2 {
+		t.Errorf("Unexpected number of calls to the replicas: %v, %v, %v", replicas[0].calls, replicas[1].calls, replicas[2].calls)
+	}
+
+	// Leadership moves to the first replica.
+	replicas[2].mu.Lock()
+	replicas[2].leader = false
+	replicas[2].mu.Unlock()
+
+	replicas[0].mu.Lock()
+	replicas[0].leader = true
+	replicas[0].data["a"] = "2"
+	replicas[0].mu.Unlock()
+
+	if value, found, err := c.Get(ctx, "a"); err != nil || !found || value != "2" {
+		t.Errorf("Get after the leader change returned (%q, %v, %v)", value, found, err)
+	}
+
+	// No replica is the leader, the client gives up after its retries.
+	replicas[0].mu.Lock()
+	replicas[0].leader = false
+	replicas[0].mu.Unlock()
+
+	if _, _, err := c.Get(ctx, "a"); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable without a leader, got %v", err)
+	}
+}
+
+/*
+ * This test case checks that a request rejected by a replica advertising the
+ * leader is retried on that leader directly, without trying the other replicas.
+ */
+func TestLeaderHint(t *testing.T) {
+
+	replicas := []*fakeReplica{
+		{data: make(map[string]string)},
+		{data: make(map[string]string)},
+		{data: make(map[string]string), leader: true},
+	}
+
+	addrs, stop := startReplicas(t, replicas...)
+	defer stop()
+
+	replicas[0].hint = addrs[2][strings.LastIndex(addrs[2], ":"):] // as advertised by the replicas, without the host
+
+	c, err := New(DefaultConfig(addrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Put(context.Background(), "a", "1"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	if c.Leader() != addrs[2] || replicas[0].calls != 1 || replicas[1].calls != 0 || replicas[2].calls != 1 {
+		t.Errorf("Expected a single redirection to %v, got the leader %v after %v, %v and %v calls", addrs[2], c.Leader(), replicas[0].calls, replicas[1].calls, replicas[2].calls)
+	}
+
+	_, err = replicas[0].Get(context.Background(), &protos.GetRequest{Key: "a"})
+	if leader, ok := LeaderHint(err); !ok || leader.Id != 2 || leader.Term != 3 {
+		t.Errorf("Expected the leader hint of the error, got %v (%v)", leader, err)
+	}
+
+	if _, ok := LeaderHint(status.Error(codes.Unavailable, "not a leader")); ok {
+		t.Errorf("Expected no leader hint in an error without details")
+	}
+}
+
+/*
+ * This test case checks that records are added to and removed from their
+ * RRset, and that the records of a name can be listed across types.
+ */
+func TestRecords(t *testing.T) {
+
+	leader := &fakeReplica{data: make(map[string]string), leader: true}
+
+	addrs, stop := startReplicas(t, leader)
+	defer stop()
+
+	c, err := New(DefaultConfig(addrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+
+	for _, r := range []Record{
+		{Name: "WWW.example.com", Type: "a", TTL: 60, Data: "192.0.2.1"},
+		{Name: "www.example.com.", Type: "A", TTL: 60, Data: "192.0.2.2"},
+		{Name: "www.example.com.", Type: "A", TTL: 60, Data: "192.0.2.1"},
+		{Name: "www.example.com.", Type: "TXT", TTL: 60, Data: "hello"},
+	} {
+		if err := c.AddRecord(ctx, r); err != nil {
+			t.Fatalf("AddRecord failed: %v", err)
+		}
+	}
+
+	records, err := c.GetRecords(ctx, "www.example.com", "A")
+	if err != nil || len(records) != 2 || records[0].Name != "www.example.com." || records[1].Data != "192.0.2.2" {
+		t.Errorf("GetRecords returned (%v, %v)", records, err)
+	}
+
+	if records, err := c.ListRecords(ctx, "www.example.com."); err != nil || len(records) != 3 {
+		t.Errorf("ListRecords returned (%v, %v)", records, err)
+	}
+
+	for _, data := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := c.RemoveRecord(ctx, Record{Name: "www.example.com.", Type: "A", Data: data}); err != nil {
+			t.Fatalf("RemoveRecord failed: %v", err)
+		}
+	}
+
+	if _, ok := leader.data[RecordKey("www.example.com", "A")]; ok {
+		t.Errorf("Expected the RRset to be deleted once its last record was removed")
+	}
+
+	if err := c.SetRecords(ctx, "example.com", "A", []Record{{Name: "other.com", Type: "A"}}); err == nil {
+		t.Errorf("Expected SetRecords to reject a record of another name")
+	}
+
+	// An import writes all the RRsets in a single batch.
+	calls := leader.calls
+
+	if err := c.ImportRecords(ctx, []Record{
+		{Name: "example.com", Type: "NS", TTL: 300, Data: "ns1.example.com."},
+		{Name: "ns1.example.com", Type: "A", TTL: 300, Data: "192.0.2.53"},
+		{Name: "example.com.", Type: "ns", TTL: 300, Data: "ns2.example.com."},
+	}); err != nil {
+		t.Fatalf("ImportRecords failed: %v", err)
+	}
+
+	if records, err := c.GetRecords(ctx, "example.com", "NS"); err != nil || len(records) != 2 || leader.calls != calls+2 {
+		t.Errorf("GetRecords after the import returned (%v, %v) after %v calls", records, err, leader.calls-calls)
+	}
+}
+
+/*
+ * This test case checks that leader change notifications are matched to the
+ * endpoints the client was configured with.
+ */
+func TestFollowLeader(t *testing.T) {
+
+	c := &RaftKVClient{config: Config{Endpoints: []string{"localhost:5000", "localhost:15001", "localhost:5001"}}}
+
+	c.followLeader(":5001")
+	if c.Leader() != "localhost:5001" {
+		t.Errorf("Expected the leader to be localhost:5001, got %v", c.Leader())
+	}
+
+	c.followLeader("localhost:5000")
+	if c.Leader() != "localhost:5000" {
+		t.Errorf("Expected the leader to be localhost:5000, got %v", c.Leader())
+	}
+
+	c.followLeader("otherhost:5002")
+	if c.Leader() != "localhost:5000" {
+		t.Errorf("Expected an unknown leader to be ignored, got %v", c.Leader())
+	}
+}
@@ -0,0 +1,252 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+/*
+Helpers for storing DNS resource records in the key-value store, in the layout described in
+the zone package: one JSON-encoded RRset per name and type.
+*/
+
+const (
+	maxCASAttempts  = 10   // attempts made by AddRecord and RemoveRecord before giving up on a contended RRset
+	importBatchSize = 1000 // RRsets written by each batch of ImportRecords
+)
+
+// Record is a single DNS resource record.
+type Record = zone.Record
+
+var canonicalName = zone.CanonicalName
+
+// Return the key under which the RRset of the given name and type is stored.
+func RecordKey(name, rtype string) string {
+	return zone.RecordKey(name, rtype)
+}
+
+func validateRecords(name, rtype string, records []Record) error {
+
+	if strings.Contains(name, "/") || strings.Contains(name, ":") {
+		return fmt.Errorf("client: invalid record name %q", name)
+	}
+
+	for _, r := range records {
+		if canonicalName(r.Name) != canonicalName(name) || !strings.EqualFold(r.Type, rtype) {
+			return fmt.Errorf("client: record %v %v does not belong to the RRset %v %v", r.Name, r.Type, name, rtype)
+		}
+	}
+
+	return nil
+}
+
+func encodeRecords(records []Record) string {
+
+	for i := range records {
+		records[i].Name = canonicalName(records[i].Name)
+		records[i].Type = strings.ToUpper(records[i].Type)
+	}
+
+	encoded, _ := json.Marshal(records)
+	return string(encoded)
+}
+
+func decodeRecords(value string) ([]Record, error) {
+
+	var records []Record
+
+	if err := json.Unmarshal([]byte(value), &records); err != nil {
+		return nil, fmt.Errorf("client: invalid RRset: %v", err)
+	}
+
+	return records, nil
+}
+
+// Return the records of the given name and type, or nil if there are none.
+func (c *RaftKVClient) GetRecords(ctx context.Context, name, rtype string) ([]Record, error) {
+
+	value, found, err := c.Get(ctx, RecordKey(name, rtype))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return decodeRecords(value)
+}
+
+// Return all the records of the given name, of any type.
+func (c *RaftKVClient) ListRecords(ctx context.Context, name string) ([]Record, error) {
+
+	kvs, err := c.Prefix(ctx, zone.KeyPrefix+canonicalName(name)+":", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+
+	for _, kv := range kvs {
+
+		// The response policies aren't records, see zone/policy.go
+		if zone.IsPolicyKey(kv.Key) {
+			continue
+		}
+
+		rrset, err := decodeRecords(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, rrset...)
+	}
+
+	return records, nil
+}
+
+// Replace the records of the given name and type. An empty set of records deletes the RRset.
+func (c *RaftKVClient) SetRecords(ctx context.Context, name, rtype string, records []Record) error {
+
+	if err := validateRecords(name, rtype, records); err != nil {
+		return err
+	}
+
+	if len(records) == 0 {
+		_, err := c.DeleteRecords(ctx, name, rtype)
+		return err
+	}
+
+	return c.Put(ctx, RecordKey(name, rtype), encodeRecords(records))
+}
+
+/*
+Replace the RRsets of the given records, e.g. to import a zone: the records are grouped by name and
+type, and the RRsets written in batches of importBatchSize, each committed as a single log entry.
+A batch is applied atomically, though an import of more RRsets may fail half way.
+*/
+func (c *RaftKVClient) ImportRecords(ctx context.Context, records []Record) error {
+
+	var keys []string
+	rrsets := make(map[string][]Record)
+
+	for _, r := range records {
+
+		if err := validateRecords(r.Name, r.Type, nil); err != nil {
+			return err
+		}
+
+		key := RecordKey(r.Name, r.Type)
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		rrsets[key] = append(rrsets[key], r)
+	}
+
+	for start := 0; start < len(keys); start += importBatchSize {
+
+		end := start + importBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		ops := make([]*protos.KVOp, 0, end-start)
+		for _, key := range keys[start:end] {
+			ops = append(ops, &protos.KVOp{Type: protos.KVOp_PUT, Key: key, Value: encodeRecords(rrsets[key])})
+		}
+
+		if _, err := c.BatchPut(ctx, ops); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete all the records of the given name and type, returning whether there were any.
+func (c *RaftKVClient) DeleteRecords(ctx context.Context, name, rtype string) (bool, error) {
+	return c.Delete(ctx, RecordKey(name, rtype))
+}
+
+// Add a record to its RRset, unless an identical record already exists.
+func (c *RaftKVClient) AddRecord(ctx context.Context, record Record) error {
+
+	return c.updateRecords(ctx, record.Name, record.Type, func(records []Record) []Record {
+
+		for _, r := range records {
+			if r.Data == record.Data {
+				return records
+			}
+		}
+
+		return append(records, record)
+	})
+}
+
+// Remove the records of the RRset with the given data.
+func (c *RaftKVClient) RemoveRecord(ctx context.Context, record Record) error {
+
+	return c.updateRecords(ctx, record.Name, record.Type, func(records []Record) []Record {
+
+		kept := records[:0]
+
+		for _, r := range records {
+			if r.Data != record.Data {
+				kept = append(kept, r)
+			}
+		}
+
+		return kept
+	})
+}
+
+// Read-modify-write an RRset, using a transaction so that concurrent updates are not lost.
+func (c *RaftKVClient) updateRecords(ctx context.Context, name, rtype string, update func([]Record) []Record) error {
+
+	key := RecordKey(name, rtype)
+
+	for attempt := 0; attempt < maxCASAttempts; attempt++ {
+
+		value, found, err := c.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		var records []Record
+		if found {
+			if records, err = decodeRecords(value); err != nil {
+				return err
+			}
+		}
+
+		updated := update(records)
+		if err := validateRecords(name, rtype, updated); err != nil {
+			return err
+		}
+
+		// Guard the write on the RRset being unchanged since it was read.
+		cmp := &protos.Compare{Key: key, Condition: protos.Compare_NOT_EXISTS}
+		if found {
+			cmp = &protos.Compare{Key: key, Condition: protos.Compare_VALUE_EQUAL, Value: value}
+		}
+
+		op := &protos.KVOp{Type: protos.KVOp_PUT, Key: key, Value: encodeRecords(updated)}
+		if len(updated) == 0 {
+			op = &protos.KVOp{Type: protos.KVOp_DELETE, Key: key}
+		}
+
+		succeeded, err := c.Txn(ctx, &protos.TxnRequest{
+			Compare: []*protos.Compare{cmp},
+			Success: []*protos.KVOp{op},
+		})
+
+		if err != nil || succeeded {
+			return err
+		}
+	}
+
+	return errors.New("client: RRset modified concurrently too many times, giving up")
+}
@@ -0,0 +1,545 @@
+/*
+Command generate writes the api.go of the rest package from the OpenAPI document of the HTTP API:
+the document of the raft package, or the one given with -spec (e.g. saved from the /openapi.json
+of a replica).
+
+The component schemas become structs, as do the inline objects of the bodies and responses (named
+after their operation), and the operations methods of Client.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/krithikvaidya/distributed-dns/raft"
+)
+
+// The subset of the OpenAPI document used by the generator, see openapi.go in the raft package.
+type document struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary"`
+	Parameters  []parameter          `json:"parameters"`
+	RequestBody *body                `json:"requestBody"`
+	Responses   map[string]*response `json:"responses"`
+}
+
+type parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Schema      *schema `json:"schema"`
+}
+
+type body struct {
+	Content map[string]struct {
+		Schema *schema `json:"schema"`
+	} `json:"content"`
+}
+
+type response = body
+
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	AllOf                []*schema          `json:"allOf"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Description          string             `json:"description"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	Items                *schema            `json:"items"`
+	AdditionalProperties *schema            `json:"additionalProperties"`
+	Nullable             bool               `json:"nullable"`
+}
+
+// The methods of the operations of a path, in the order of their methods in api.go.
+var methods = []string{"get", "post", "put", "delete"}
+
+// Words written upper case in the Go names.
+var initialisms = map[string]bool{"id": true, "grpc": true, "ip": true, "url": true, "ttl": true, "tsig": true, "dns": true, "http": true, "api": true, "json": true, "cpu": true, "uri": true}
+
+func main() {
+
+	spec := flag.String("spec", "", "OpenAPI document, the one of the raft package if empty")
+	output := flag.String("o", "api.go", "generated file")
+	flag.Parse()
+
+	var doc []byte
+	var err error
+
+	if *spec == "" {
+		doc, err = raft.OpenAPIDocument()
+	} else {
+		doc, err = ioutil.ReadFile(*spec)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	source, err := generate(doc)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(*output, source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Return the Go name of a snake case name, e.g. "client_address" is ClientAddress.
+func exported(name string) string {
+
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' || r == '.' }) {
+		if initialisms[strings.ToLower(word)] {
+			b.WriteString(strings.ToUpper(word))
+			continue
+		}
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+
+	return b.String()
+}
+
+// Return the name of an argument, e.g. "type" is typ.
+func unexported(name string) string {
+
+	name = exported(name)
+	runes := []rune(name)
+	for i := 0; i < len(runes) && unicode.IsUpper(runes[i]); i++ {
+		if i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+			break
+		}
+		runes[i] = unicode.ToLower(runes[i])
+	}
+
+	name = string(runes)
+	if token.IsKeyword(name) {
+		name = strings.TrimSuffix(name, "e") // e.g. typ
+	}
+
+	return name
+}
+
+type generator struct {
+	b       bytes.Buffer
+	imports map[string]bool
+	types   map[string]*schema // The inline objects named after their operations
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.b, format, args...)
+}
+
+// Return the Go type of a schema, name being the one of the type of an inline object.
+func (g *generator) goType(s *schema, name string) string {
+
+	switch {
+
+	case s.Ref != "":
+		return strings.TrimPrefix(s.Ref, "#/components/schemas/")
+
+	case len(s.AllOf) == 1:
+		return "*" + g.goType(s.AllOf[0], name)
+
+	}
+
+	t := "json.RawMessage"
+
+	switch s.Type {
+
+	case "string":
+		switch s.Format {
+		case "date-time":
+			t = "time.Time"
+		case "byte":
+			t = "[]byte"
+		default:
+			t = "string"
+		}
+
+	case "integer":
+		t = "int"
+		if s.Format != "" {
+			t = s.Format
+		}
+
+	case "number":
+		t = "float64"
+		if s.Format == "float" {
+			t = "float32"
+		}
+
+	case "boolean":
+		t = "bool"
+
+	case "array":
+		t = "[]" + g.goType(s.Items, name+"Item")
+
+	case "object":
+		if s.AdditionalProperties != nil {
+			t = "map[string]" + g.goType(s.AdditionalProperties, name+"Value")
+		} else {
+			g.types[name] = s
+			t = name
+		}
+
+	}
+
+	switch {
+
+	case t == "json.RawMessage":
+		g.imports["encoding/json"] = true
+
+	case strings.HasSuffix(t, "time.Time"):
+		g.imports["time"] = true
+
+	}
+
+	if s.Nullable && !strings.HasPrefix(t, "[]") && !strings.HasPrefix(t, "map[") {
+		t = "*" + t
+	}
+
+	return t
+}
+
+// Print the struct of an object schema.
+func (g *generator) object(name string, s *schema) {
+
+	required := make(map[string]bool)
+	for _, property := range s.Required {
+		required[property] = true
+	}
+
+	properties := make([]string, 0, len(s.Properties))
+	for property := range s.Properties {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+
+	g.printf("type %v struct {\n", name)
+	for _, property := range properties {
+
+		tag := property
+		if !required[property] {
+			tag += ",omitempty"
+		}
+
+		g.printf("%v %v `json:\"%v\"`", exported(property), g.goType(s.Properties[property], name+exported(property)), tag)
+		if description := s.Properties[property].Description; description != "" {
+			g.printf(" // %v", description)
+		}
+		g.printf("\n")
+	}
+	g.printf("}\n\n")
+}
+
+// Print the types of the inline objects met since the last call.
+func (g *generator) inline() {
+
+	for len(g.types) > 0 {
+
+		names := make([]string, 0, len(g.types))
+		for name := range g.types {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		name := names[0]
+		s := g.types[name]
+		delete(g.types, name)
+
+		g.object(name, s)
+	}
+}
+
+// Return the schema and the content type of a body or response, JSON if it can be.
+func content(b *body) (*schema, string) {
+
+	if b == nil {
+		return nil, ""
+	}
+
+	if media, ok := b.Content["application/json"]; ok {
+		return media.Schema, "application/json"
+	}
+
+	for contentType, media := range b.Content {
+		return media.Schema, contentType
+	}
+
+	return nil, ""
+}
+
+// Print the Params type and the method of an operation.
+func (g *generator) operation(method, path string, op *operation) {
+
+	var args, params []string
+
+	// The parameters of the query string and the form.
+	type field struct {
+		parameter
+		form bool
+	}
+	var fields []field
+
+	for _, p := range op.Parameters {
+		if p.In == "path" {
+			typ := "string"
+			if p.Schema.Type == "integer" {
+				typ = "int64"
+			}
+			args = append(args, unexported(p.Name)+" "+typ)
+			continue
+		}
+		fields = append(fields, field{parameter: p})
+	}
+
+	requestBody, requestContent := content(op.RequestBody)
+	if requestContent == "application/x-www-form-urlencoded" {
+		properties := make([]string, 0, len(requestBody.Properties))
+		for property := range requestBody.Properties {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+
+		for _, property := range properties {
+			fields = append(fields, field{parameter: parameter{Name: property, Description: requestBody.Properties[property].Description, Schema: requestBody.Properties[property]}, form: true})
+		}
+		requestBody, requestContent = nil, ""
+	}
+
+	if len(fields) > 0 {
+
+		g.printf("// The parameters of %v, see its method.\n", op.OperationID)
+		g.printf("type %vParams struct {\n", op.OperationID)
+		for _, f := range fields {
+			g.printf("%v %v", exported(f.Name), paramType(f.Schema))
+			if f.Description != "" {
+				g.printf(" // %v", f.Description)
+			}
+			g.printf("\n")
+		}
+		g.printf("}\n\n")
+
+		params = append(params, "params *"+op.OperationID+"Params")
+	}
+
+	switch {
+
+	case requestContent == "application/json":
+		params = append(params, "body "+g.goType(requestBody, op.OperationID+"Request"))
+
+	case requestContent != "":
+		g.imports["io"] = true
+		params = append(params, "body io.Reader")
+
+	}
+
+	// The response of the success.
+	var success *response
+	for status, r := range op.Responses {
+		if status != "default" {
+			success = r
+		}
+	}
+
+	responseSchema, responseContent := content(success)
+	result, pointer := "string", false // pointer if the method returns a pointer to out
+
+	switch {
+
+	case responseContent == "application/json":
+		result = g.goType(responseSchema, op.OperationID+"Response")
+		if !strings.HasPrefix(result, "[]") && !strings.HasPrefix(result, "map[") && !strings.HasPrefix(result, "*") {
+			pointer = true
+		}
+
+	case responseContent != "text/plain" && responseContent != "":
+		g.imports["io"] = true
+		result = "io.ReadCloser"
+
+	}
+
+	returned := result
+	if pointer {
+		returned = "*" + result
+	}
+
+	g.printf("// %v (%v %v).\n", sentence(op.Summary), strings.ToUpper(method), path)
+	g.printf("func (c *Client) %v(%v) (%v, error) {\n", op.OperationID, strings.Join(append(append([]string{"ctx context.Context"}, args...), params...), ", "), returned)
+
+	// The path, with the escaped path parameters.
+	var pathExpr []string
+	rest := path
+	for rest != "" {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			pathExpr = append(pathExpr, fmt.Sprintf("%q", rest))
+			break
+		}
+		end := strings.Index(rest, "}")
+
+		if start > 0 {
+			pathExpr = append(pathExpr, fmt.Sprintf("%q", rest[:start]))
+		}
+
+		name := unexported(rest[start+1 : end])
+		for _, p := range op.Parameters {
+			if p.In == "path" && unexported(p.Name) == name && p.Schema.Type == "integer" {
+				name = "strconv.FormatInt(" + name + ", 10)"
+				g.imports["strconv"] = true
+			}
+		}
+		pathExpr = append(pathExpr, "url.PathEscape("+name+")")
+
+		rest = rest[end+1:]
+	}
+
+	g.printf("query, form := url.Values{}, url.Values{}\n")
+	if len(fields) > 0 {
+		g.printf("if params != nil {\n")
+		for _, f := range fields {
+			values := "query"
+			if f.form {
+				values = "form"
+			}
+			g.setValue(values, f.Name, "params."+exported(f.Name), f.Schema)
+		}
+		g.printf("}\n")
+	}
+
+	bodyArg := "nil"
+	if requestContent != "" {
+		bodyArg = "body"
+	}
+
+	g.printf("var out %v\n", result)
+	call := fmt.Sprintf("c.do(ctx, %q, %v, query, form, %v, &out)", strings.ToUpper(method), strings.Join(pathExpr, "+"), bodyArg)
+
+	if pointer {
+		g.printf("if err := %v; err != nil {\nreturn nil, err\n}\n", call)
+		g.printf("return &out, nil\n")
+	} else {
+		g.printf("err := %v\n", call)
+		g.printf("return out, err\n")
+	}
+
+	g.printf("}\n\n")
+}
+
+// Return the type of a field of a Params struct.
+func paramType(s *schema) string {
+
+	switch s.Type {
+
+	case "integer":
+		return "int64"
+
+	case "boolean":
+		return "bool"
+
+	case "array":
+		return "[]string"
+
+	}
+
+	return "string"
+}
+
+// Print the statement setting the parameter, if its value isn't the zero one.
+func (g *generator) setValue(values, name, field string, s *schema) {
+
+	switch s.Type {
+
+	case "integer":
+		g.imports["strconv"] = true
+		g.printf("if %v != 0 {\n%v.Set(%q, strconv.FormatInt(%v, 10))\n}\n", field, values, name, field)
+
+	case "boolean":
+		g.printf("if %v {\n%v.Set(%q, \"true\")\n}\n", field, values, name)
+
+	case "array":
+		g.printf("for _, v := range %v {\n%v.Add(%q, v)\n}\n", field, values, name)
+
+	default:
+		g.printf("if %v != \"\" {\n%v.Set(%q, %v)\n}\n", field, values, name, field)
+
+	}
+}
+
+// Return the summary as the end of a doc comment.
+func sentence(summary string) string {
+
+	if summary == "" {
+		return "Send the request"
+	}
+
+	return strings.TrimSuffix(summary, ".")
+}
+
+// Return the formatted source of api.go for the OpenAPI document.
+func generate(spec []byte) ([]byte, error) {
+
+	var doc document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %v", err)
+	}
+
+	g := &generator{imports: map[string]bool{"context": true, "net/url": true}, types: make(map[string]*schema)}
+
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		g.object(name, doc.Components.Schemas[name])
+		g.inline()
+	}
+
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		for _, method := range methods {
+			if op, ok := doc.Paths[path][method]; ok {
+				g.operation(method, path, op)
+				g.inline()
+			}
+		}
+	}
+
+	imports := make([]string, 0, len(g.imports))
+	for pkg := range g.imports {
+		imports = append(imports, fmt.Sprintf("%q", pkg))
+	}
+	sort.Strings(imports)
+
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// Code generated by go run ./generate; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&source, "package rest\n\nimport (\n%v\n)\n\n", strings.Join(imports, "\n"))
+	source.Write(g.b.Bytes())
+
+	return format.Source(source.Bytes())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft"
+)
+
+/*
+ * This test case checks that api.go was regenerated since the last change of
+ * the HTTP API (with go generate ./client/rest).
+ */
+func TestGenerated(t *testing.T) {
+
+	doc, err := raft.OpenAPIDocument()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := generate(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := ioutil.ReadFile("../api.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(source, current) {
+		t.Errorf("api.go is out of date, run go generate ./client/rest")
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Package rest provides a typed Go client for the client HTTP API of the replicas (:400<replica_id>),
+generated from the OpenAPI document they serve at /openapi.json.
+
+Every operation of the document is a method of Client (see api.go), taking its path parameters as
+arguments, its query and form parameters as a Params struct (whose zero values are left out), and
+its JSON body if it has one. Unlike RaftKVClient, a Client talks to a single replica: the writes
+sent to a follower fail with an *Error whose Code is "not_leader" and whose Leader holds the
+address of the leader to retry on.
+
+api.go is regenerated from the API of the raft package with
+
+	go generate ./client/rest
+*/
+package rest
+
+//go:generate go run ./generate -o api.go
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft"
+)
+
+// Client sends the requests of the HTTP API to a replica. It is safe for concurrent use.
+type Client struct {
+	BaseURL    string       // e.g. "http://localhost:4000"
+	HTTPClient *http.Client // http.DefaultClient if nil
+	Token      string       // API token presented as a bearer token, if the replica requires authentication
+	Username   string       // Presented with Password instead of Token, if not empty
+	Password   string
+}
+
+// Return a client of the replica serving the HTTP API at the base URL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is returned when the replica answers a request with an error status, see errors.go in
+// the raft package.
+type Error struct {
+	StatusCode int
+	ErrorResponse
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v %v (%v): %v", e.StatusCode, http.StatusText(e.StatusCode), e.Code, e.Message)
+}
+
+/*
+Send a request to the replica, with the query parameters, and either the form or the body: a
+io.Reader is sent as is, any other value encoded as JSON. The response is decoded into out, which
+is a *string for the text responses, a *io.ReadCloser for the binary ones (that the caller closes),
+and a pointer to the JSON value otherwise.
+*/
+func (c *Client) do(ctx context.Context, method, path string, query, form url.Values, body interface{}, out interface{}) error {
+
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	contentType := ""
+
+	switch b := body.(type) {
+
+	case nil:
+		if len(form) > 0 {
+			reader, contentType = strings.NewReader(form.Encode()), "application/x-www-form-urlencoded"
+		}
+
+	case io.Reader:
+		reader, contentType = b, "application/octet-stream"
+
+	default:
+		encoded, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader, contentType = bytes.NewReader(encoded), "application/json"
+
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	// The replica gives up on the request once the caller does.
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(raft.TimeoutHeader, time.Until(deadline).String())
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		contents, _ := ioutil.ReadAll(resp.Body)
+
+		e := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(contents, &e.ErrorResponse) != nil || e.Code == "" {
+			e.Message = strings.TrimSpace(string(contents))
+		}
+
+		return e
+	}
+
+	switch v := out.(type) {
+
+	case *io.ReadCloser:
+		*v = resp.Body
+		return nil
+
+	case *string:
+		defer resp.Body.Close()
+		contents, err := ioutil.ReadAll(resp.Body)
+		*v = strings.TrimSpace(string(contents))
+		return err
+
+	}
+
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("invalid response to %v %v: %v", method, path, err)
+	}
+
+	return nil
+}
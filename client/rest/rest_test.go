@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+ * This test case checks that the parameters of an operation are sent in its
+ * path, query string and form, that its JSON response is decoded, and that the
+ * error responses are returned as an *Error.
+ */
+func TestClient(t *testing.T) {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/locks/deploy", func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "POST" || r.FormValue("holder") != "ci" || r.FormValue("ttl") != "10s" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected request %v %v %v", r.Method, r.Form, r.Header)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "deploy", "holder": "ci", "token": 7})
+	})
+
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"code": "not_leader", "message": "Not a leader.", "leader": ":4001", "retryable": true})
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	c := New(server.URL + "/")
+	c.Token = "secret"
+
+	lock, err := c.AcquireLock(context.Background(), "deploy", &AcquireLockParams{Holder: "ci", TTL: "10s"})
+	if err != nil || lock.Holder != "ci" || lock.Token != 7 {
+		t.Errorf("Expected the lock to be acquired, got %+v (%v)", lock, err)
+	}
+
+	_, err = c.UpdateKey(context.Background(), "a", &UpdateKeyParams{Value: "b"})
+
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != http.StatusServiceUnavailable || e.Code != "not_leader" || e.Leader != ":4001" || !e.Retryable {
+		t.Errorf("Expected the not_leader error, got %v", err)
+	}
+}
@@ -0,0 +1,2121 @@
+/*
+Command raftctl administers a running cluster. Keys are read and written through the
+KVService on the replicas' gRPC ports, using the client package, while the administration
+commands use the /admin endpoints of the replicas' client HTTP servers.
+
+Usage:
+
+	raftctl [flags] <command> [arguments]
+
+Commands:
+
+	status                                   show the state of every replica, and the replication
+	                                         to the other members reported by the leader
+	members                                  list the members of the cluster
+	leader [-watch]                          show the leader, and with -watch every leader change
+	put <key> <value>                        set the value of a key
+	get [-rev <revision>] <key>              print the value of a key
+	del <key>                                delete a key
+	del-prefix [-dry-run] <prefix>           delete all the keys with a prefix, as a single write
+	export [-cursor c] [prefix]              print the keys with a prefix (every key by default) as
+	                                         JSON lines, all as of the same revision, or resume an
+	                                         interrupted export (allow it time with -timeout)
+	snapshot <file>                          save a snapshot of the key-value store to a file
+	verify-snapshot [-live] <file>           check the integrity of a saved snapshot
+	backup <file>                            save a consistent backup of the cluster to a file
+	verify-backup <file>                     check the integrity of a saved backup, and describe it
+	transfer-leader [id]                     hand leadership over to another member
+	barrier                                  commit a no-op through the log of the leader, and wait
+	                                         until it is applied
+	add-member [-witness] [-consensus-only] [-domain zone/rack/host] [-force-placement] <id> [grpc-addr] [http-addr]
+	                                         add a running replica (or witness, or replica dedicated
+	                                         to consensus) to the cluster
+	update-member [-grpc-addr addr] [-http-addr addr] [-domain zone/rack/host] [-force-placement] <id>
+	                                         change the addresses or the failure domain of a member,
+	                                         e.g. after an IP change, without removing it
+	remove-member [-force] [-force-placement] <id>
+	                                         remove a replica from the cluster, if it is safe
+	decommission [-cancel] [-force-placement] <id>
+	                                         demote a replica to a learner, remove it from the
+	                                         cluster, shut it down and delete its data, following
+	                                         the progress (allow it time with -timeout), or cancel
+	                                         the decommission
+	settings                                 list the cluster-wide settings
+	set <name> <value>                       change a cluster-wide setting
+	unset <name>                             remove a cluster-wide setting
+	history [name]                           show the audit history of the settings
+	audit [-zone] <key>                      show the audit history of a key, or of the records of
+	                                         a zone
+	shards                                   show the routing table of the zones to the Raft groups
+	split <zone> <group>                     move a zone to another Raft group
+	merge <zone>                             move a zone back to the Raft group of its parent zone
+	rejections [-reason r] [-key k] [-limit n]
+	                                         show the writes recently rejected by the replicas
+	query-stats [-top n]                     merge the statistics of the DNS queries answered by
+	                                         the replicas: QPS, NXDOMAIN rate, top names and zones
+	users                                    list the users of the client HTTP API
+	set-user [-password p] [-token t] [-roles r1,r2] <name> <read|write|admin|none>
+	                                         create or update a user of the client HTTP API
+	del-user <name>                          remove a user of the client HTTP API
+	roles                                    list the roles granting access to keys and zones
+	set-role <name> [rule...]                define a role, with rules such as read:prefix:app.,
+	                                         write:zone:example.com or write:record:www.example.com/A
+	del-role <name>                          remove a role
+	record-token <name> <record>[/<type>]...
+	                                         create a user, and its role, only allowed to update
+	                                         the given records, and print its token and TSIG key
+	tsig-keys                                list the TSIG keys of the DNS updates and transfers
+	set-tsig-key [-algorithm a] [-secret s] <name> <user>
+	                                         create or replace a TSIG key signing the DNS updates
+	                                         and transfers on behalf of the user, and print its
+	                                         key clause
+	rotate-tsig-key [-grace d] [-secret s] <name>
+	                                         replace the secret of a TSIG key, the previous one
+	                                         staying valid for the grace period, and print its
+	                                         key clause
+	del-tsig-key <name>                      revoke a TSIG key
+	webhooks                                 list the webhooks the changes are delivered to, and
+	                                         the state of their deliveries
+	set-webhook [-prefix p | -zone z] [-secret s] <name> <url>
+	                                         create or replace a webhook, POSTed the changes of
+	                                         the keys with the prefix or of the records of the zone
+	del-webhook <name>                       remove a webhook
+	alarms                                   list the alarms blocking the writes adding data
+	disarm [-member id] [-type t]            disarm the alarms, all of them if neither is given
+	migrate-store -from <backend> -to <backend> <file>
+	                                         move the key-value store of a stopped replica (e.g.
+	                                         6000) between the map and bolt backends
+	replay [-index n | -time t] [-base snapshot] <raft-file> <snapshot-file>
+	                                         replay the log of a replica (e.g. 3000) up to an index
+	                                         or RFC 3339 time into a snapshot, to restore a fresh
+	                                         cluster from with -restore
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/client"
+	"github.com/krithikvaidya/distributed-dns/raft"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+var http_endpoints string
+var grpc_endpoints string
+var token string
+var timeout time.Duration
+var tls_ca string
+var tls_cert string
+var tls_key string
+var http_ca string
+var http_token string
+var http_user string
+
+var http_client = &http.Client{}
+var http_scheme = "http"
+
+// Set up the HTTP client to use HTTPS, if required.
+func setupHTTPClient() error {
+
+	if http_ca == "" {
+		return nil
+	}
+
+	ca, err := ioutil.ReadFile(http_ca)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no valid certificate found in %v", http_ca)
+	}
+
+	http_client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	http_scheme = "https"
+
+	return nil
+}
+
+func init() {
+
+	flag.StringVar(&http_endpoints, "endpoints", "localhost:4000,localhost:4001,localhost:4002", "comma separated client HTTP addresses of the replicas")
+	flag.StringVar(&grpc_endpoints, "grpc-endpoints", "localhost:5000,localhost:5001,localhost:5002", "comma separated gRPC addresses of the replicas")
+	flag.StringVar(&token, "token", "", "client token, if the replicas were started with -client-token")
+	flag.StringVar(&tls_ca, "ca", "", "PEM certificate of the CA, if the replicas were started with -peer-cert")
+	flag.StringVar(&tls_cert, "cert", "", "PEM client certificate presented to the replicas, optional with -ca")
+	flag.StringVar(&tls_key, "key", "", "PEM private key of the -cert certificate")
+	flag.StringVar(&http_ca, "http-ca", "", "PEM certificate of the CA, if the replicas serve HTTPS (-http-cert)")
+	flag.StringVar(&http_token, "http-token", "", "API token presented to the client HTTP servers if they require authentication, and to the KVService if -token isn't given")
+	flag.StringVar(&http_user, "http-user", "", "<name>:<password> presented to the client HTTP servers, instead of -http-token")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "time allowed for the command")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: raftctl [flags] <command> [arguments]\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Commands: status, members, put, get, del, export, snapshot, verify-snapshot, backup, verify-backup, backups, transfer-leader, barrier, add-member, update-member, remove-member, settings, set, unset, read-only, history, audit, shards, split, merge, rejections, query-stats, users, set-user, del-user, roles, set-role, del-role, record-token, tsig-keys, set-tsig-key, rotate-tsig-key, del-tsig-key, webhooks, set-webhook, del-webhook, alarms, disarm, migrate-store, replay\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+
+}
+
+func main() {
+
+	flag.Parse()
+
+	if err := setupHTTPClient(); err != nil {
+		fmt.Fprintf(os.Stderr, "raftctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	http_client.Timeout = timeout
+
+	commands := map[string]func(ctx context.Context, args []string) error{
+		"status":          status,
+		"members":         members,
+		"leader":          leader,
+		"put":             put,
+		"get":             get,
+		"del":             del,
+		"del-prefix":      delPrefix,
+		"export":          export,
+		"snapshot":        snapshot,
+		"verify-snapshot": verifySnapshot,
+		"backup":          backup,
+		"verify-backup":   verifyBackup,
+		"backups":         backups,
+		"transfer-leader": transferLeader,
+		"barrier":         barrier,
+		"add-member":      addMember,
+		"update-member":   updateMember,
+		"remove-member":   removeMember,
+		"decommission":    decommission,
+		"settings":        settings,
+		"set":             setSetting,
+		"unset":           unsetSetting,
+		"read-only":       readOnly,
+		"history":         history,
+		"audit":           audit,
+		"shards":          shards,
+		"split":           splitShard,
+		"merge":           mergeShard,
+		"rejections":      rejections,
+		"query-stats":     queryStats,
+		"users":           users,
+		"set-user":        setUser,
+		"del-user":        delUser,
+		"roles":           roles,
+		"set-role":        setRole,
+		"del-role":        delRole,
+		"record-token":    recordToken,
+		"tsig-keys":       tsigKeys,
+		"set-tsig-key":    setTSIGKey,
+		"rotate-tsig-key": rotateTSIGKey,
+		"del-tsig-key":    delTSIGKey,
+		"webhooks":        webhooks,
+		"set-webhook":     setWebhook,
+		"del-webhook":     delWebhook,
+		"alarms":          alarms,
+		"disarm":          disarm,
+		"migrate-store":   migrateStore,
+		"replay":          replay,
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "raftctl: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := command(ctx, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "raftctl: %v\n", err)
+		os.Exit(1)
+	}
+
+}
+
+func splitEndpoints(endpoints string) []string {
+
+	var split []string
+
+	for _, endpoint := range strings.Split(endpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			split = append(split, endpoint)
+		}
+	}
+
+	return split
+}
+
+func usageError(usage string) error {
+	return fmt.Errorf("usage: raftctl %v", usage)
+}
+
+// Send a request to the admin endpoint of a replica, decoding its JSON response into v (if not nil).
+func request(ctx context.Context, method, endpoint, path string, form url.Values, v interface{}) (*http.Response, error) {
+
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, http_scheme+"://"+endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if http_token != "" {
+		req.Header.Set("Authorization", "Bearer "+http_token)
+	} else if user := strings.SplitN(http_user, ":", 2); len(user) == 2 {
+		req.SetBasicAuth(user[0], user[1])
+	}
+
+	// The replica gives up on the request once the command times out.
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set(raft.TimeoutHeader, time.Until(deadline).String())
+	}
+
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := http_client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		contents, _ := ioutil.ReadAll(resp.Body)
+
+		// The replicas answer the errors with a raft.ErrorResponse.
+		var e raft.ErrorResponse
+		if json.Unmarshal(contents, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("%v responded with %v (%v): %v", endpoint, resp.Status, e.Code, e.Message)
+		}
+
+		return nil, fmt.Errorf("%v responded with %v: %v", endpoint, resp.Status, strings.TrimSpace(string(contents)))
+	}
+
+	if v != nil {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("invalid response from %v: %v", endpoint, err)
+		}
+	}
+
+	return resp, nil
+}
+
+// Return the HTTP endpoint of the replica reporting itself as the leader.
+func leaderEndpoint(ctx context.Context) (string, error) {
+
+	for _, endpoint := range splitEndpoints(http_endpoints) {
+
+		var s raft.Status
+		if _, err := request(ctx, "GET", endpoint, "/admin/status", nil, &s); err == nil && s.State == "Leader" {
+			return endpoint, nil
+		}
+	}
+
+	return "", errors.New("no replica is currently the leader")
+}
+
+func newClient() (*client.RaftKVClient, error) {
+
+	config := client.DefaultConfig(splitEndpoints(grpc_endpoints)...)
+	config.Token = token
+	if token == "" { // The KVService also accepts the API tokens of the users, see raft/acl.go
+		config.Token = http_token
+	}
+
+	if tls_ca != "" {
+
+		ca, err := ioutil.ReadFile(tls_ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.TLS = &tls.Config{RootCAs: x509.NewCertPool()}
+		if !config.TLS.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid certificate found in %v", tls_ca)
+		}
+
+		if tls_cert != "" {
+
+			cert, err := tls.LoadX509KeyPair(tls_cert, tls_key)
+			if err != nil {
+				return nil, err
+			}
+
+			config.TLS.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	return client.New(config)
+}
+
+func status(ctx context.Context, args []string) error {
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tID\tSTATE\tTERM\tLEADER\tCOMMIT\tAPPLIED\tLOG\tMEMORY\tDISK")
+
+	var peers []raft.PeerStatus
+	var decommissions []raft.Decommission
+	var clusters []string // IDs of the clusters the endpoints belong to
+	seen := make(map[string]bool)
+	readOnly := false
+
+	for _, endpoint := range splitEndpoints(http_endpoints) {
+
+		var s raft.Status
+		if _, err := request(ctx, "GET", endpoint, "/admin/status", nil, &s); err != nil {
+			fmt.Fprintf(w, "%v\t-\tUnreachable\t-\t-\t-\t-\t-\t-\t-\n", endpoint)
+			continue
+		}
+
+		memory, disk := "-", "-"
+		if s.Resources != nil {
+			memory, disk = strconv.FormatInt(s.Resources.MemoryBytes, 10), strconv.FormatInt(s.Resources.DiskBytes, 10)
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", endpoint, s.Id, s.State, s.Term, s.LeaderId, s.CommitIndex, s.LastApplied, s.LogLength, memory, disk)
+
+		if s.Peers != nil {
+			peers = s.Peers
+		}
+
+		readOnly = readOnly || s.ReadOnly
+
+		if s.ClusterID != "" && !seen[s.ClusterID] {
+			clusters, seen[s.ClusterID] = append(clusters, s.ClusterID), true
+		}
+
+		// As reported by the leader, the other replicas may lag behind.
+		if s.State == "Leader" {
+			for _, d := range s.Decommissions {
+				if d.Step != "complete" {
+					decommissions = append(decommissions, d)
+				}
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	switch {
+	case len(clusters) == 1:
+		fmt.Printf("\nCluster ID: %v\n", clusters[0])
+	case len(clusters) > 1:
+		fmt.Printf("\nThe endpoints belong to different clusters: %v\n", strings.Join(clusters, ", "))
+	}
+
+	if readOnly {
+		fmt.Println("\nThe cluster is read-only: the writes of the clients are rejected.")
+	}
+
+	for _, d := range decommissions {
+
+		fmt.Printf("\nReplica %v is being decommissioned since %v: %v", d.Member, d.Started.Format(time.RFC3339), d.Step)
+		if d.Error != "" {
+			fmt.Printf(" (%v)", d.Error)
+		}
+	}
+
+	if len(decommissions) > 0 {
+		fmt.Println()
+	}
+
+	if peers == nil {
+		return nil
+	}
+
+	// The replication to the other members, as tracked by the leader.
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tNEXT\tMATCH\tLAST CONTACT\tHEALTHY\tREACHABLE")
+
+	for _, p := range peers {
+
+		contact := "-"
+		if p.LastContact != nil {
+			contact = p.LastContact.Format(time.RFC3339Nano)
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", p.Id, p.NextIndex, p.MatchIndex, contact, p.Healthy, p.Reachable)
+	}
+
+	return w.Flush()
+}
+
+func members(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var members []raft.Member
+	if _, err := request(ctx, "GET", leader, "/admin/members", nil, &members); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tGRPC ADDRESS\tHTTP ADDRESS\tROLE")
+
+	for _, m := range members {
+
+		role := "replica"
+		if m.Witness {
+			role = "witness"
+		} else if m.ConsensusOnly {
+			role = "consensus-only"
+		}
+
+		if m.Learner {
+			role += " (learner)"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Id, m.Address, m.ClientAddress, role)
+	}
+
+	return w.Flush()
+}
+
+func leader(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("leader", flag.ContinueOnError)
+	watch := flags.Bool("watch", false, "keep printing the leader changes, until interrupted")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return usageError("leader [-watch]")
+	}
+
+	path := "/admin/leader"
+	if *watch {
+		// The stream outlives the timeout of the command.
+		path += "?watch=true"
+		ctx, http_client.Timeout = context.Background(), 0
+	}
+
+	err := errors.New("no replica is reachable")
+
+	for _, endpoint := range splitEndpoints(http_endpoints) {
+
+		var resp *http.Response
+		if resp, err = request(ctx, "GET", endpoint, path, nil, nil); err != nil {
+			continue
+		}
+		defer resp.Body.Close()
+
+		decoder := json.NewDecoder(resp.Body)
+
+		for {
+
+			var l raft.LeaderMetadata
+			if err := decoder.Decode(&l); err != nil {
+				return fmt.Errorf("invalid response from %v: %v", endpoint, err)
+			}
+
+			if l.Id < 0 {
+				fmt.Printf("No known leader in term %v\n", l.Term)
+			} else {
+				fmt.Printf("Leader %v in term %v, HTTP address %v, gRPC address %v\n", l.Id, l.Term, l.ClientAddress, l.GrpcAddress)
+			}
+
+			if !*watch {
+				return nil
+			}
+		}
+	}
+
+	return err
+}
+
+func put(ctx context.Context, args []string) error {
+
+	if len(args) != 2 {
+		return usageError("put <key> <value>")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return c.Put(ctx, args[0], args[1])
+}
+
+func get(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	revision := flags.Int64("rev", 0, "read the key as of this store revision")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("get [-rev <revision>] <key>")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	value, found, err := c.GetAt(ctx, flags.Arg(0), *revision)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("key %q not found", flags.Arg(0))
+	}
+
+	fmt.Println(value)
+	return nil
+}
+
+func del(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("del <key>")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	deleted, err := c.Delete(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return fmt.Errorf("key %q not found", args[0])
+	}
+
+	return nil
+}
+
+func delPrefix(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("del-prefix", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only count the keys that would be deleted")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("del-prefix [-dry-run] <prefix>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"prefix": {flags.Arg(0)}, "dry_run": {strconv.FormatBool(*dryRun)}, "client": {author()}}
+
+	var response raft.DeletePrefixResponse
+	if _, err := request(ctx, "DELETE", leader, "/kvstore?"+query.Encode(), nil, &response); err != nil {
+		return err
+	}
+
+	if response.DryRun {
+		fmt.Printf("%v keys with prefix %q would be deleted.\n", response.Deleted, response.Prefix)
+	} else {
+		fmt.Printf("Deleted %v keys with prefix %q.\n", response.Deleted, response.Prefix)
+	}
+
+	return nil
+}
+
+func export(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	cursor := flags.String("cursor", "", "cursor printed by an interrupted export, to resume it")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return usageError("export [-cursor c] [prefix]")
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	out := json.NewEncoder(os.Stdout)
+
+	next, err := c.Export(ctx, flags.Arg(0), *cursor, func(kv client.KeyValue) error {
+		return out.Encode(map[string]string{"key": kv.Key, "value": kv.Value})
+	})
+
+	// The cursor only moves once some keys were exported.
+	if err != nil && next != "" && next != *cursor {
+		return fmt.Errorf("%v, resume with -cursor %v", err, next)
+	}
+
+	return err
+}
+
+func snapshot(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("snapshot <file>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := request(ctx, "GET", leader, "/admin/snapshot", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	checksum := sha256.New()
+
+	written, err := io.Copy(io.MultiWriter(file, checksum), resp.Body)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Record what the snapshot should contain next to it, for verify-snapshot.
+	var meta snapshotMetadata
+	meta.AppliedIndex = int32(headerInt(resp.Header, "X-Raft-Applied-Index"))
+	meta.Term = int32(headerInt(resp.Header, "X-Raft-Term"))
+	meta.Revision = headerInt(resp.Header, "X-Store-Revision")
+	meta.Digest = resp.Header.Get("X-Store-Digest")
+	meta.ClusterID = resp.Header.Get("X-Cluster-Id")
+	meta.Checksum = hex.EncodeToString(checksum.Sum(nil))
+
+	contents, _ := json.MarshalIndent(meta, "", "  ")
+	if err := ioutil.WriteFile(args[0]+".meta", contents, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved snapshot of %v bytes at applied index %v (term %v) to %v\n",
+		written, meta.AppliedIndex, meta.Term, args[0])
+
+	return nil
+}
+
+// Written to <file>.meta by the snapshot command.
+type snapshotMetadata struct {
+	raft.SnapshotDigest
+	Checksum string `json:"checksum"` // Hex encoded SHA-256 hash of the snapshot file
+}
+
+func headerInt(header http.Header, name string) int64 {
+	v, _ := strconv.ParseInt(header.Get(name), 10, 64)
+	return v
+}
+
+/*
+Check a snapshot saved by the snapshot command: its checksum must match the one recorded in
+<file>.meta, and once loaded into a scratch key-value store, its digest must match the digest of
+the leader's store when the snapshot was taken. With -live, the snapshot is also compared with the
+current state of the replicas that haven't applied any write since the snapshot was taken.
+*/
+func verifySnapshot(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("verify-snapshot", flag.ContinueOnError)
+	live := flags.Bool("live", false, "also compare the snapshot with the replicas still at its revision")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("verify-snapshot [-live] <file>")
+	}
+
+	path := flags.Arg(0)
+
+	contents, err := ioutil.ReadFile(path + ".meta")
+	if err != nil {
+		return err
+	}
+
+	var meta snapshotMetadata
+	if err := json.Unmarshal(contents, &meta); err != nil {
+		return fmt.Errorf("invalid metadata in %v.meta: %v", path, err)
+	}
+
+	contents, err = ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	checksum := sha256.Sum256(contents)
+	if hex.EncodeToString(checksum[:]) != meta.Checksum {
+		return fmt.Errorf("checksum mismatch: %v is corrupted", path)
+	}
+
+	digest, err := kv_store.VerifySnapshot(bytes.NewReader(contents))
+	if err != nil {
+		return err
+	}
+
+	if digest.Digest != meta.Digest || digest.Revision != meta.Revision {
+		return fmt.Errorf("digest mismatch: the snapshot contains revision %v with digest %v, expected revision %v with digest %v",
+			digest.Revision, digest.Digest, meta.Revision, meta.Digest)
+	}
+
+	fmt.Printf("Snapshot at applied index %v (term %v, revision %v) is valid, digest %v\n",
+		meta.AppliedIndex, meta.Term, meta.Revision, meta.Digest)
+
+	if !*live {
+		return nil
+	}
+
+	mismatch := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tAPPLIED\tREVISION\tRESULT")
+
+	for _, endpoint := range splitEndpoints(http_endpoints) {
+
+		var d raft.SnapshotDigest
+		if _, err := request(ctx, "GET", endpoint, "/admin/digest", nil, &d); err != nil {
+			fmt.Fprintf(w, "%v\t-\t-\tunreachable\n", endpoint)
+			continue
+		}
+
+		// Only entries that don't write to the store may have been applied since the snapshot.
+		result := "match"
+		switch {
+		case d.Revision != meta.Revision:
+			result = "not comparable, the store has moved on"
+		case d.Digest != meta.Digest:
+			result, mismatch = "MISMATCH", true
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", endpoint, d.AppliedIndex, d.Revision, result)
+	}
+
+	w.Flush()
+
+	if mismatch {
+		return errors.New("the snapshot doesn't match the state of some replicas")
+	}
+
+	return nil
+}
+
+/*
+Save a backup of the cluster, taken by the leader once it has applied every committed entry (see
+raft/backup.go), to restore a brand-new cluster from with -restore <file>. The backup is checked
+once saved.
+*/
+func backup(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("backup <file>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	resp, err := request(ctx, "GET", leader, "/admin/backup", nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, resp.Body)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	meta, err := readBackup(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved backup at applied index %v (term %v, revision %v) to %v\n",
+		meta.AppliedIndex, meta.Term, meta.Revision, args[0])
+
+	return nil
+}
+
+// Show the schedule of the backups taken by the leader, and the backups stored.
+func backups(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var scheduled raft.BackupScheduleStatus
+	if _, err := request(ctx, "GET", leader, "/admin/backups", nil, &scheduled); err != nil {
+		return err
+	}
+
+	fmt.Printf("Schedule %q, to the %v storage\n", scheduled.Schedule, scheduled.Storage)
+	if scheduled.Next != nil {
+		fmt.Printf("Last backup due at %v, next at %v\n", scheduled.Last.Format(time.RFC3339), scheduled.Next.Format(time.RFC3339))
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCREATED")
+
+	for _, backup := range scheduled.Backups {
+		fmt.Fprintf(w, "%v\t%v\n", backup.Name, backup.Created.Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+// Check a backup saved by the backup command, and describe it.
+func verifyBackup(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("verify-backup <file>")
+	}
+
+	meta, err := readBackup(args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Backup at applied index %v (term %v, revision %v) is valid, digest %v\n",
+		meta.AppliedIndex, meta.Term, meta.Revision, meta.Digest)
+	fmt.Printf("Taken by replica %v at %v\n\n", meta.Leader, meta.Created.Format(time.RFC3339))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tGRPC ADDRESS\tHTTP ADDRESS\tROLE")
+
+	for _, m := range meta.Members {
+
+		role := "replica"
+		if m.Witness {
+			role = "witness"
+		} else if m.ConsensusOnly {
+			role = "consensus-only"
+		}
+
+		if m.Learner {
+			role += " (learner)"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", m.Id, m.Address, m.ClientAddress, role)
+	}
+
+	return w.Flush()
+}
+
+func readBackup(path string) (raft.BackupMetadata, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return raft.BackupMetadata{}, err
+	}
+	defer file.Close()
+
+	meta, _, err := raft.ReadBackup(file)
+	return meta, err
+}
+
+func transferLeader(ctx context.Context, args []string) error {
+
+	if len(args) > 1 {
+		return usageError("transfer-leader [id]")
+	}
+
+	form := url.Values{}
+	if len(args) == 1 {
+		form.Set("to", args[0])
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var result map[string]int32
+	if _, err := request(ctx, "POST", leader, "/admin/transfer-leader", form, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Replica %v is now the leader\n", result["leader_id"])
+	return nil
+}
+
+func barrier(ctx context.Context, args []string) error {
+
+	if len(args) != 0 {
+		return usageError("barrier")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var result map[string]int32
+	if _, err := request(ctx, "POST", leader, "/admin/barrier", url.Values{}, &result); err != nil {
+		return err
+	}
+
+	fmt.Printf("Barrier applied at index %v of term %v by replica %v\n", result["index"], result["term"], result["leader_id"])
+	return nil
+}
+
+func addMember(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("add-member", flag.ContinueOnError)
+	witness := flags.Bool("witness", false, "add the replica as a witness, which votes but holds no keys")
+	consensusOnly := flags.Bool("consensus-only", false, "add the replica dedicated to consensus, which serves no queries")
+	domain := flags.String("domain", "", "failure domain of the replica, as zone/rack/host")
+	forcePlacement := flags.Bool("force-placement", false, "add the replica even if a quorum of the voters would share a failure domain")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 3 {
+		return usageError("add-member [-witness] [-consensus-only] [-domain zone/rack/host] [-force-placement] <id> [grpc-addr] [http-addr]")
+	}
+
+	args = flags.Args()
+
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		return fmt.Errorf("invalid replica ID %q", args[0])
+	}
+
+	form := url.Values{"id": {args[0]}}
+	if len(args) > 1 {
+		form.Set("address", args[1])
+	}
+	if len(args) > 2 {
+		form.Set("client_address", args[2])
+	}
+	if *witness {
+		form.Set("witness", "true")
+	}
+	if *consensusOnly {
+		form.Set("consensus_only", "true")
+	}
+	if *domain != "" {
+		form.Set("domain", *domain)
+	}
+	if *forcePlacement {
+		form.Set("force_placement", "true")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var members []raft.Member
+	if _, err := request(ctx, "POST", leader, "/admin/members", form, &members); err != nil {
+		return err
+	}
+
+	fmt.Printf("Replica %v added, the cluster now has %v members\n", args[0], len(members))
+	return nil
+}
+
+// Change the addresses or the failure domain of a member without removing it, e.g. after an IP change.
+// The replica should be serving at its new addresses already.
+func updateMember(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("update-member", flag.ContinueOnError)
+	address := flags.String("grpc-addr", "", "new address of the replica's gRPC server")
+	clientAddress := flags.String("http-addr", "", "new address of the replica's client HTTP server")
+	domain := flags.String("domain", "", "new failure domain of the replica, as zone/rack/host")
+	forcePlacement := flags.Bool("force-placement", false, "change the domain even if a quorum of the voters would share one")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || (*address == "" && *clientAddress == "" && *domain == "") {
+		return usageError("update-member [-grpc-addr addr] [-http-addr addr] [-domain zone/rack/host] [-force-placement] <id>")
+	}
+
+	if _, err := strconv.Atoi(flags.Arg(0)); err != nil {
+		return fmt.Errorf("invalid replica ID %q", flags.Arg(0))
+	}
+
+	form := url.Values{}
+	if *address != "" {
+		form.Set("address", *address)
+	}
+	if *clientAddress != "" {
+		form.Set("client_address", *clientAddress)
+	}
+	if *domain != "" {
+		form.Set("domain", *domain)
+	}
+	if *forcePlacement {
+		form.Set("force_placement", "true")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var members []raft.Member
+	if _, err := request(ctx, "PUT", leader, "/admin/members/"+flags.Arg(0), form, &members); err != nil {
+		return err
+	}
+
+	for _, m := range members {
+		if strconv.Itoa(int(m.Id)) == flags.Arg(0) {
+			fmt.Printf("Replica %v is now reached at %v (HTTP: %v)\n", m.Id, m.Address, m.ClientAddress)
+		}
+	}
+
+	return nil
+}
+
+func removeMember(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("remove-member", flag.ContinueOnError)
+	force := flags.Bool("force", false, "remove the replica even if the cluster could lose data or its quorum")
+	forcePlacement := flags.Bool("force-placement", false, "remove the replica even if a quorum of the voters would share a failure domain")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("remove-member [-force] [-force-placement] <id>")
+	}
+
+	if _, err := strconv.Atoi(flags.Arg(0)); err != nil {
+		return fmt.Errorf("invalid replica ID %q", flags.Arg(0))
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *force {
+		query.Set("force", "true")
+	}
+	if *forcePlacement {
+		query.Set("force_placement", "true")
+	}
+
+	path := "/admin/members/" + flags.Arg(0)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var members []raft.Member
+	if _, err := request(ctx, "DELETE", leader, path, nil, &members); err != nil {
+		return err
+	}
+
+	fmt.Printf("Replica %v removed, the cluster now has %v members. It can now be shut down.\n", flags.Arg(0), len(members))
+	return nil
+}
+
+// Start the decommission of a replica, see raft/decommission.go, and follow its progress in the status
+// of the replicas until it completes.
+func decommission(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	cancel := flags.Bool("cancel", false, "stop the decommission, unless the replica is demoted already")
+	forcePlacement := flags.Bool("force-placement", false, "demote the replica even if a quorum of the voters would share a failure domain")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("decommission [-cancel] [-force-placement] <id>")
+	}
+
+	id, err := strconv.Atoi(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid replica ID %q", flags.Arg(0))
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	method := "POST"
+	if *cancel {
+		method = "DELETE"
+	}
+
+	form := url.Values{}
+	if *forcePlacement {
+		form.Set("force_placement", "true")
+	}
+
+	var d raft.Decommission
+	if _, err := request(ctx, method, leader, "/admin/members/"+flags.Arg(0)+"/decommission", form, &d); err != nil {
+		return err
+	}
+
+	if *cancel {
+		fmt.Printf("Decommission of replica %v cancelled while %v\n", id, d.Step)
+		return nil
+	}
+
+	fmt.Printf("Decommissioning replica %v: %v\n", id, d.Step)
+
+	// The leader may change along the way (e.g. when draining the replica), so any replica is asked.
+	for last := d; ; {
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("replica %v is still %v, follow its decommission with raftctl status", id, last.Step)
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		for _, endpoint := range splitEndpoints(http_endpoints) {
+
+			var s raft.Status
+			if _, err := request(ctx, "GET", endpoint, "/admin/status", nil, &s); err != nil || s.State != "Leader" {
+				continue
+			}
+
+			for _, d := range s.Decommissions {
+
+				if d.Member != int32(id) || (d.Step == last.Step && d.Error == last.Error) {
+					continue
+				}
+
+				if last = d; d.Error != "" {
+					fmt.Printf("Decommissioning replica %v: %v (%v, retrying)\n", id, d.Step, d.Error)
+				} else {
+					fmt.Printf("Decommissioning replica %v: %v\n", id, d.Step)
+				}
+			}
+		}
+
+		if last.Step == "complete" {
+			fmt.Printf("Replica %v decommissioned, its data deleted\n", id)
+			return nil
+		}
+	}
+}
+
+// Close the body of a response that isn't needed.
+func discard(resp *http.Response, err error) error {
+
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	return err
+}
+
+func settings(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]string
+	if _, err := request(ctx, "GET", leader, "/admin/settings", nil, &settings); err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE")
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%v\t%v\n", name, settings[name])
+	}
+
+	return w.Flush()
+}
+
+func shards(ctx context.Context, args []string) error {
+
+	if len(args) != 0 {
+		return usageError("shards")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var table struct {
+		Groups int               `json:"groups"`
+		Routes []raft.ShardRoute `json:"routes"`
+	}
+
+	if _, err := request(ctx, "GET", leader, "/admin/shards", nil, &table); err != nil {
+		return err
+	}
+
+	fmt.Printf("%v groups, the zones without a route belong to group 0\n\n", table.Groups)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tGROUP\tSTATE")
+
+	for _, route := range table.Routes {
+
+		state := "serving"
+		if route.From >= 0 {
+			state = fmt.Sprintf("moving from group %v", route.From)
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\n", route.Zone, route.Group, state)
+	}
+
+	return w.Flush()
+}
+
+func splitShard(ctx context.Context, args []string) error {
+
+	if len(args) != 2 {
+		return usageError("split <zone> <group>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"zone": {args[0]}, "group": {args[1]}, "client": {author()}}
+	return discard(request(ctx, "POST", leader, "/admin/shards/split", form, nil))
+}
+
+func mergeShard(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("merge <zone>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"zone": {args[0]}, "client": {author()}}
+	return discard(request(ctx, "POST", leader, "/admin/shards/merge", form, nil))
+}
+
+// The author recorded in the audit history of the settings.
+func author() string {
+
+	host, _ := os.Hostname()
+
+	if user := os.Getenv("USER"); user != "" {
+		return user + "@" + host
+	}
+
+	return host
+}
+
+func setSetting(ctx context.Context, args []string) error {
+
+	if len(args) != 2 {
+		return usageError("set <name> <value>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"value": {args[1]}, "client": {author()}}
+	return discard(request(ctx, "PUT", leader, "/admin/settings/"+url.PathEscape(args[0]), form, nil))
+}
+
+// Show whether the cluster is read-only, or enable or disable the read-only mode through the
+// read_only setting.
+func readOnly(ctx context.Context, args []string) error {
+
+	if len(args) > 1 || (len(args) == 1 && args[0] != "on" && args[0] != "off") {
+		return usageError("read-only [on|off]")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+
+		var s raft.Status
+		if _, err := request(ctx, "GET", leader, "/admin/status", nil, &s); err != nil {
+			return err
+		}
+
+		if s.ReadOnly {
+			fmt.Println("The cluster is read-only.")
+		} else {
+			fmt.Println("The cluster accepts writes.")
+		}
+
+		return nil
+	}
+
+	form := url.Values{"value": {strconv.FormatBool(args[0] == "on")}, "client": {author()}}
+	return discard(request(ctx, "PUT", leader, "/admin/settings/read_only", form, nil))
+}
+
+func unsetSetting(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("unset <name>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	// DELETE request bodies are not parsed by the replicas.
+	query := url.Values{"client": {author()}}
+	return discard(request(ctx, "DELETE", leader, "/admin/settings/"+url.PathEscape(args[0])+"?"+query.Encode(), nil, nil))
+}
+
+func history(ctx context.Context, args []string) error {
+
+	if len(args) > 1 {
+		return usageError("history [name]")
+	}
+
+	path := "/admin/settings/history"
+	if len(args) == 1 {
+		path += "?name=" + url.QueryEscape(args[0])
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var changes []raft.SettingChange
+	if _, err := request(ctx, "GET", leader, path, nil, &changes); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tTIME\tAUTHOR\tACTION\tNAME\tVALUE\tPREVIOUS")
+
+	for _, c := range changes {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", c.Index, c.Time.Local().Format(time.RFC3339), c.Author, c.Action, c.Name, c.Value, c.Previous)
+	}
+
+	return w.Flush()
+}
+
+// Show the audit history of a key, or with -zone of the records of a zone, read from the leader.
+func audit(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	zone := flags.Bool("zone", false, "show the history of the records of the zone named by the argument")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("audit [-zone] <key>")
+	}
+
+	path := "/audit?key=" + url.QueryEscape(flags.Arg(0))
+	if *zone {
+		path = "/zones/" + url.PathEscape(flags.Arg(0)) + "/history"
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var changes []raft.AuditRecord
+	if _, err := request(ctx, "GET", leader, path, nil, &changes); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INDEX\tTIME\tCLIENT\tUSER\tACTION\tKEY\tVALUE\tPREVIOUS")
+
+	for _, c := range changes {
+
+		previous := "-"
+		if c.Previous != nil {
+			previous = *c.Previous
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", c.Index, c.Time.Local().Format(time.RFC3339), c.Client, c.User, c.Action, c.Key, c.Value, previous)
+	}
+
+	return w.Flush()
+}
+
+// Merge the rejections journaled by every replica, newest first: a follower journals the writes
+// sent to it while it isn't the leader.
+func rejections(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("rejections", flag.ContinueOnError)
+	reason := flags.String("reason", "", "only show the rejections with this reason, e.g. not_leader or acl")
+	key := flags.String("key", "", "only show the rejections of writes to this key")
+	limit := flags.Int("limit", 20, "maximum number of rejections shown per replica")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return usageError("rejections [-reason r] [-key k] [-limit n]")
+	}
+
+	query := url.Values{"reason": {*reason}, "key": {*key}, "limit": {strconv.Itoa(*limit)}}
+
+	type rejection struct {
+		endpoint string
+		raft.Rejection
+	}
+
+	var merged []rejection
+
+	for _, endpoint := range splitEndpoints(http_endpoints) {
+
+		var list []raft.Rejection
+		if _, err := request(ctx, "GET", endpoint, "/admin/rejections?"+query.Encode(), nil, &list); err != nil {
+			fmt.Fprintf(os.Stderr, "raftctl: %v: %v\n", endpoint, err)
+			continue
+		}
+
+		for _, r := range list {
+			merged = append(merged, rejection{endpoint, r})
+		}
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Time.After(merged[j].Time) })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tENDPOINT\tREASON\tOPERATION\tKEY\tCLIENT\tERROR")
+
+	for _, r := range merged {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", r.Time.Local().Format(time.RFC3339), r.endpoint, r.Reason, r.Operation, r.Key, r.Client, strings.TrimSpace(r.Error))
+	}
+
+	return w.Flush()
+}
+
+// Merge the statistics of the DNS queries answered by every replica over the last minutes: the top
+// names are those of the top names of each replica.
+func queryStats(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("query-stats", flag.ContinueOnError)
+	top := flags.Int("top", 10, "number of names queried most shown")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 || *top < 0 {
+		return usageError("query-stats [-top n]")
+	}
+
+	query := url.Values{"top": {strconv.Itoa(*top)}}
+
+	var merged raft.QueryStats
+	names, zones := make(map[string]*raft.QueryCount), make(map[string]*raft.QueryCount)
+
+	add := func(counts map[string]*raft.QueryCount, c raft.QueryCount) {
+
+		if counts[c.Name] == nil {
+			counts[c.Name] = &raft.QueryCount{Name: c.Name}
+		}
+
+		counts[c.Name].Queries += c.Queries
+		counts[c.Name].QPS += c.QPS
+	}
+
+	for _, endpoint := range splitEndpoints(http_endpoints) {
+
+		var stats raft.QueryStats
+		if _, err := request(ctx, "GET", endpoint, "/admin/query-stats?"+query.Encode(), nil, &stats); err != nil {
+			fmt.Fprintf(os.Stderr, "raftctl: %v: %v\n", endpoint, err)
+			continue
+		}
+
+		merged.Queries += stats.Queries
+		merged.NXDomain += stats.NXDomain
+		merged.QPS += stats.QPS
+
+		if stats.Window > merged.Window {
+			merged.Window = stats.Window
+		}
+
+		for _, c := range stats.TopNames {
+			add(names, c)
+		}
+
+		for _, c := range stats.Zones {
+			add(zones, c)
+		}
+	}
+
+	if merged.Queries > 0 {
+		merged.NXDomainRate = float64(merged.NXDomain) / float64(merged.Queries)
+	}
+
+	sorted := func(counts map[string]*raft.QueryCount) []raft.QueryCount {
+
+		var list []raft.QueryCount
+		for _, c := range counts {
+			list = append(list, *c)
+		}
+
+		sort.Slice(list, func(i, j int) bool {
+			if list[i].Queries != list[j].Queries {
+				return list[i].Queries > list[j].Queries
+			}
+			return list[i].Name < list[j].Name
+		})
+
+		return list
+	}
+
+	merged.TopNames, merged.Zones = sorted(names), sorted(zones)
+	if len(merged.TopNames) > *top {
+		merged.TopNames = merged.TopNames[:*top]
+	}
+
+	fmt.Printf("queries: %v over %vs (%.2f/s), NXDOMAIN: %v (%.1f%%)\n\n", merged.Queries, merged.Window, merged.QPS, merged.NXDomain, 100*merged.NXDomainRate)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ZONE\tQUERIES\tQPS")
+	for _, c := range merged.Zones {
+		fmt.Fprintf(w, "%v\t%v\t%.2f\n", c.Name, c.Queries, c.QPS)
+	}
+
+	fmt.Fprintln(w, "\nNAME\tQUERIES\tQPS")
+	for _, c := range merged.TopNames {
+		fmt.Fprintf(w, "%v\t%v\t%.2f\n", c.Name, c.Queries, c.QPS)
+	}
+
+	return w.Flush()
+}
+
+func users(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var users []raft.User
+	if _, err := request(ctx, "GET", leader, "/admin/users", nil, &users); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPERMISSION\tROLES")
+
+	for _, user := range users {
+
+		permission := user.Permission
+		if permission == "" {
+			permission = "none"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\n", user.Name, permission, strings.Join(user.Roles, ","))
+	}
+
+	return w.Flush()
+}
+
+func setUser(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("set-user", flag.ContinueOnError)
+	password := flags.String("password", "", "password of the user, for basic auth")
+	token := flags.String("token", "", "API token of the user")
+	roles := flags.String("roles", "", "comma-separated roles of the user (unchanged if not given)")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return usageError("set-user [-password <password>] [-token <token>] [-roles <role,...>] <name> <read|write|admin|none>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	permission := flags.Arg(1)
+	if permission == "none" { // Access only through the roles of the user
+		permission = ""
+	}
+
+	form := url.Values{"permission": {permission}, "password": {*password}, "token": {*token}}
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "roles" {
+			form.Set("roles", *roles)
+		}
+	})
+	return discard(request(ctx, "PUT", leader, "/admin/users/"+url.PathEscape(flags.Arg(0)), form, nil))
+}
+
+func delUser(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("del-user <name>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	return discard(request(ctx, "DELETE", leader, "/admin/users/"+url.PathEscape(args[0]), nil, nil))
+}
+
+func roles(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var roles []raft.Role
+	if _, err := request(ctx, "GET", leader, "/admin/roles", nil, &roles); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tACCESS\tKEYS")
+
+	for _, role := range roles {
+		for _, rule := range role.Rules {
+			if rule.Record != "" {
+				fmt.Fprintf(w, "%v\t%v\trecord %v %v\n", role.Name, rule.Access, rule.Record, rule.Type)
+			} else if rule.Zone != "" {
+				fmt.Fprintf(w, "%v\t%v\tzone %v\n", role.Name, rule.Access, rule.Zone)
+			} else {
+				fmt.Fprintf(w, "%v\t%v\tprefix %q\n", role.Name, rule.Access, rule.Prefix)
+			}
+		}
+	}
+
+	return w.Flush()
+}
+
+func setRole(ctx context.Context, args []string) error {
+
+	if len(args) < 1 {
+		return usageError("set-role <name> [<read|write>:prefix:<prefix> | <read|write>:zone:<zone> | <read|write>:record:<name>[/<type>]]...")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"rule": args[1:]}
+	return discard(request(ctx, "PUT", leader, "/admin/roles/"+url.PathEscape(args[0]), form, nil))
+}
+
+func delRole(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("del-role <name>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	return discard(request(ctx, "DELETE", leader, "/admin/roles/"+url.PathEscape(args[0]), nil, nil))
+}
+
+/*
+Create (or replace) the user with the given name, with a new random token and a role of the same name
+only granting it write access to the records, e.g. for a router updating its own address through the
+HTTP API or with nsupdate, and a TSIG key of the same name with a random secret signing on its behalf.
+The token and the key clause are printed.
+*/
+func recordToken(ctx context.Context, args []string) error {
+
+	if len(args) < 2 {
+		return usageError("record-token <name> <record>[/<type>]...")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+
+	rules := make([]string, 0)
+	for _, record := range args[1:] {
+		rules = append(rules, "write:record:"+record)
+	}
+
+	if err := discard(request(ctx, "PUT", leader, "/admin/roles/"+url.PathEscape(name), url.Values{"rule": rules}, nil)); err != nil {
+		return err
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(random)
+
+	form := url.Values{"permission": {""}, "token": {token}, "roles": {name}}
+	if err := discard(request(ctx, "PUT", leader, "/admin/users/"+url.PathEscape(name), form, nil)); err != nil {
+		return err
+	}
+
+	var key raft.TSIGKey
+	if _, err := request(ctx, "PUT", leader, "/admin/tsig-keys/"+url.PathEscape(name), url.Values{"user": {name}}, &key); err != nil {
+		return err
+	}
+
+	fmt.Printf("token: %v\n\n", token)
+	fmt.Printf("key \"%v.\" {\n\talgorithm %v;\n\tsecret \"%v\";\n};\n", key.Name, strings.TrimSuffix(key.Algorithm, "."), key.Secret)
+
+	return nil
+}
+
+func tsigKeys(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var keys []raft.TSIGKey
+	if _, err := request(ctx, "GET", leader, "/admin/tsig-keys", nil, &keys); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tALGORITHM\tUSER\tPREVIOUS SECRET UNTIL")
+
+	for _, key := range keys {
+
+		until := "-"
+		if !key.PreviousUntil.IsZero() {
+			until = key.PreviousUntil.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", key.Name, key.Algorithm, key.User, until)
+	}
+
+	return w.Flush()
+}
+
+// Create (or replace) a TSIG key signing the DNS updates on behalf of the user, printing its key
+// clause, e.g. for the configuration of a DHCP server.
+func setTSIGKey(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("set-tsig-key", flag.ContinueOnError)
+	algorithm := flags.String("algorithm", "hmac-sha256", "algorithm of the key")
+	secret := flags.String("secret", "", "base64 encoded secret of the key, random if not given")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return usageError("set-tsig-key [-algorithm <algorithm>] [-secret <secret>] <name> <user>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"user": {flags.Arg(1)}, "algorithm": {*algorithm}, "secret": {*secret}}
+
+	var key raft.TSIGKey
+	if _, err := request(ctx, "PUT", leader, "/admin/tsig-keys/"+url.PathEscape(flags.Arg(0)), form, &key); err != nil {
+		return err
+	}
+
+	fmt.Printf("key \"%v.\" {\n\talgorithm %v;\n\tsecret \"%v\";\n};\n", key.Name, strings.TrimSuffix(key.Algorithm, "."), key.Secret)
+
+	return nil
+}
+
+// Replace the secret of a TSIG key, printing its new key clause, the previous secret being accepted
+// for the grace period.
+func rotateTSIGKey(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("rotate-tsig-key", flag.ContinueOnError)
+	grace := flags.Duration("grace", time.Hour, "time the previous secret stays valid for")
+	secret := flags.String("secret", "", "base64 encoded new secret of the key, random if not given")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("rotate-tsig-key [-grace <duration>] [-secret <secret>] <name>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"grace": {grace.String()}, "secret": {*secret}}
+
+	var key raft.TSIGKey
+	if _, err := request(ctx, "POST", leader, "/admin/tsig-keys/"+url.PathEscape(flags.Arg(0))+"/rotate", form, &key); err != nil {
+		return err
+	}
+
+	fmt.Printf("key \"%v.\" {\n\talgorithm %v;\n\tsecret \"%v\";\n};\n\n", key.Name, strings.TrimSuffix(key.Algorithm, "."), key.Secret)
+	fmt.Printf("previous secret valid until %v\n", key.PreviousUntil.Local().Format(time.RFC3339))
+
+	return nil
+}
+
+func delTSIGKey(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("del-tsig-key <name>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	return discard(request(ctx, "DELETE", leader, "/admin/tsig-keys/"+url.PathEscape(args[0]), nil, nil))
+}
+
+func webhooks(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var hooks []raft.WebhookStatus
+	if _, err := request(ctx, "GET", leader, "/admin/webhooks", nil, &hooks); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tURL\tFILTER\tREVISION\tFAILURES\tLAST ERROR")
+
+	for _, hook := range hooks {
+
+		filter := "prefix " + strconv.Quote(hook.Prefix)
+		if hook.Zone != "" {
+			filter = "zone " + hook.Zone
+		}
+
+		lastError := hook.LastError
+		if lastError == "" {
+			lastError = "-"
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", hook.Name, hook.URL, filter, hook.Revision, hook.Failures, lastError)
+	}
+
+	return w.Flush()
+}
+
+// Create (or replace) a webhook, POSTed the changes of the keys with the prefix, or of the records
+// of the zone, by the leader.
+func setWebhook(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("set-webhook", flag.ContinueOnError)
+	prefix := flags.String("prefix", "", "prefix of the keys whose changes are delivered")
+	zone := flags.String("zone", "", "zone whose records' changes are delivered")
+	secret := flags.String("secret", "", "key of the HMAC-SHA256 signatures of the deliveries")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return usageError("set-webhook [-prefix <prefix> | -zone <zone>] [-secret <secret>] <name> <url>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"url": {flags.Arg(1)}, "prefix": {*prefix}, "zone": {*zone}, "secret": {*secret}}
+
+	return discard(request(ctx, "PUT", leader, "/admin/webhooks/"+url.PathEscape(flags.Arg(0)), form, nil))
+}
+
+func delWebhook(ctx context.Context, args []string) error {
+
+	if len(args) != 1 {
+		return usageError("del-webhook <name>")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	return discard(request(ctx, "DELETE", leader, "/admin/webhooks/"+url.PathEscape(args[0]), nil, nil))
+}
+
+func alarms(ctx context.Context, args []string) error {
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	var alarms []raft.Alarm
+	if _, err := request(ctx, "GET", leader, "/admin/alarms", nil, &alarms); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MEMBER\tTYPE\tUSAGE\tLIMIT\tRAISED")
+
+	for _, alarm := range alarms {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", alarm.Member, alarm.Type, alarm.Usage, alarm.Limit, alarm.Time.Local().Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+func disarm(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("disarm", flag.ContinueOnError)
+	member := flags.String("member", "", "only disarm the alarms of this member")
+	kind := flags.String("type", "", "only disarm the alarms of this type, NOSPACE or NOMEMORY")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return usageError("disarm [-member id] [-type t]")
+	}
+
+	leader, err := leaderEndpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The query is given in the URL, as the body of a DELETE request isn't parsed.
+	query := url.Values{}
+	if *member != "" {
+		query.Set("member", *member)
+	}
+	if *kind != "" {
+		query.Set("type", *kind)
+	}
+
+	var disarmed []raft.Alarm
+	if _, err := request(ctx, "DELETE", leader, "/admin/alarms?"+query.Encode(), nil, &disarmed); err != nil {
+		return err
+	}
+
+	fmt.Printf("%v alarms disarmed.\n", len(disarmed))
+	return nil
+}
+
+// Migrate the store of a stopped replica between backends. The replica is then started with the
+// matching -store-backend.
+func migrateStore(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("migrate-store", flag.ContinueOnError)
+	from := flags.String("from", kv_store.BackendMap, "backend the store is held by")
+	to := flags.String("to", kv_store.BackendBolt, "backend the store is moved to")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usageError("migrate-store -from <map|bolt> -to <map|bolt> <file>")
+	}
+
+	digest, err := kv_store.MigrateStore(flags.Arg(0), *from, *to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %v from the %v to the %v backend at revision %v, digest %v\n", flags.Arg(0), *from, *to, digest.Revision, digest.Digest)
+
+	return nil
+}
+
+// Replay the log of a replica up to an index or a time into a snapshot, for point-in-time recovery
+// (see raft/replay.go). The replicas of a fresh cluster are then started with -restore <snapshot-file>.
+func replay(ctx context.Context, args []string) error {
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	index := flags.Int("index", -1, "index of the last entry to replay, the last committed one by default")
+	at := flags.String("time", "", "replay the entries appended up to this RFC 3339 time")
+	base := flags.String("base", "", "snapshot or backup the cluster was restored from, if any")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return usageError("replay [-index n | -time t] [-base snapshot] <raft-file> <snapshot-file>")
+	}
+
+	target := raft.ReplayTarget{Index: int32(*index)}
+
+	if *at != "" {
+
+		t, err := time.Parse(time.RFC3339Nano, *at)
+		if err != nil {
+			return usageError("replay -time <RFC 3339 time, e.g. 2026-01-02T15:04:05Z>")
+		}
+		target.Time = t
+	}
+
+	result, err := raft.ReplayLog(flags.Arg(0), *base, target, flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadFile(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	// Recorded as by the snapshot command, for verify-snapshot.
+	checksum := sha256.Sum256(contents)
+	meta, _ := json.MarshalIndent(snapshotMetadata{SnapshotDigest: result.SnapshotDigest, Checksum: hex.EncodeToString(checksum[:])}, "", "  ")
+
+	if err := ioutil.WriteFile(flags.Arg(1)+".meta", meta, 0644); err != nil {
+		return err
+	}
+
+	if result.AppliedIndex < 0 {
+		fmt.Printf("No entry replayed, saved the base store to %v\n", flags.Arg(1))
+	} else if result.Time.IsZero() {
+		fmt.Printf("Replayed the log up to entry %v (term %v) into %v\n", result.AppliedIndex, result.Term, flags.Arg(1))
+	} else {
+		fmt.Printf("Replayed the log up to entry %v (term %v, appended at %v) into %v\n", result.AppliedIndex, result.Term, result.Time.Format(time.RFC3339Nano), flags.Arg(1))
+	}
+
+	fmt.Printf("Revision %v, digest %v\n", result.Revision, result.Digest)
+
+	return nil
+}
@@ -6,19 +6,26 @@ require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/go-openapi/spec v0.20.3 // indirect
 	github.com/golang/protobuf v1.4.3
+	github.com/google/btree v1.0.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jawher/autoreadme v0.0.0-20200719124337-50018b9a0924 // indirect
+	github.com/klauspost/compress v1.13.6
 	github.com/mailru/easyjson v0.7.7 // indirect
+	github.com/miekg/dns v1.1.43
 	github.com/pborman/uuid v1.2.1 // indirect
 	github.com/reflect/reflect-go v0.0.0-20180214185235-25ec44d5a1bf // indirect
 	github.com/robertkrimen/godocdown v0.0.0-20130622164427-0bfa04905481 // indirect
+	github.com/rs/zerolog v1.26.1
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/swaggo/swag v1.7.0 // indirect
 	github.com/tevino/abool v1.2.0
 	github.com/trailofbits/go-mutexasserts v0.0.0-20200708152505-19999e7d3cef
-	golang.org/x/net v0.0.0-20210316092652-d523dce5a7f4 // indirect
-	golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
-	golang.org/x/tools v0.1.0 // indirect
+	go.etcd.io/bbolt v1.3.6
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/crypto v0.0.0-20211215165025-cf75a172585e
 	google.golang.org/grpc v1.34.0
 	google.golang.org/protobuf v1.25.0
 	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
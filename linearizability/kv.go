@@ -0,0 +1,154 @@
+package linearizability
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+A model of the keys of the replicated store, as written through the HTTP API of the replicas:
+
+	get     returns the value of the key, if it exists
+	create  (POST) creates the key with the value, if it doesn't exist
+	put     (PUT) sets the value of the key, if it exists
+	delete  (DELETE) removes the key, if it exists
+
+A replica rejects a put or a delete of a key it reads as missing, which is then their output. Once
+committed, they take effect if the key still exists when applied, like a create that only takes
+effect if the key is still missing; a committed write doesn't tell which. The history is partitioned
+by key.
+*/
+
+const (
+	KVGet    = "get"
+	KVCreate = "create"
+	KVPut    = "put"
+	KVDelete = "delete"
+)
+
+// The input of an operation on a key.
+type KVInput struct {
+	Op    string
+	Key   string
+	Value string // Written by a create or a put
+}
+
+// The output of an operation on a key.
+type KVOutput struct {
+	Exists bool   // Whether a get found the key, or a put or a delete was committed rather than rejected
+	Value  string // Read by a get
+}
+
+// The state of a key.
+type kvState struct {
+	exists bool
+	value  string
+}
+
+// The model of the keys, all initially missing unless they are in initial.
+func KVModel(initial map[string]string) Model {
+
+	return Model{
+		Partition: partitionByKey,
+		Init: func() interface{} {
+			return nil // The key of the partition is only known from its first operation
+		},
+		Step: func(state, input, output interface{}) (bool, interface{}) {
+
+			in := input.(KVInput)
+
+			s, ok := state.(kvState)
+			if !ok {
+				value, exists := initial[in.Key]
+				s = kvState{exists: exists, value: value}
+			}
+
+			// An operation of unknown outcome, which takes effect now.
+			if output == nil {
+				return true, applyKV(s, in)
+			}
+
+			out := output.(KVOutput)
+
+			switch in.Op {
+
+			case KVGet:
+				return out.Exists == s.exists && (!s.exists || out.Value == s.value), s
+
+			case KVPut, KVDelete:
+				if !out.Exists {
+					return !s.exists, s
+				}
+
+			}
+
+			return true, applyKV(s, in)
+		},
+	}
+}
+
+// Return the state of a key after a committed write.
+func applyKV(s kvState, in KVInput) kvState {
+
+	switch {
+
+	case in.Op == KVCreate && !s.exists, in.Op == KVPut && s.exists:
+		return kvState{exists: true, value: in.Value}
+
+	case in.Op == KVDelete:
+		return kvState{}
+
+	}
+
+	return s
+}
+
+// Split a history of KV operations by key, in key order.
+func partitionByKey(history []Operation) [][]Operation {
+
+	byKey := make(map[string][]Operation)
+	var keys []string
+
+	for _, op := range history {
+
+		key := op.Input.(KVInput).Key
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		byKey[key] = append(byKey[key], op)
+	}
+
+	sort.Strings(keys)
+
+	partitions := make([][]Operation, 0, len(keys))
+	for _, key := range keys {
+		partitions = append(partitions, byKey[key])
+	}
+
+	return partitions
+}
+
+// Describe a KV operation, e.g. for Describe.
+func DescribeKV(op Operation) string {
+
+	in := op.Input.(KVInput)
+	description := fmt.Sprintf("client %v: %v %v", op.Client, in.Op, in.Key)
+
+	if in.Op == KVCreate || in.Op == KVPut {
+		description += fmt.Sprintf(" %q", in.Value)
+	}
+
+	if out, ok := op.Output.(KVOutput); ok {
+		switch {
+		case in.Op == KVGet && out.Exists:
+			description += fmt.Sprintf(" -> %q", out.Value)
+		case in.Op == KVGet:
+			description += " -> missing"
+		case in.Op != KVCreate && !out.Exists:
+			description += " -> rejected, missing"
+		}
+	}
+
+	return description
+}
@@ -0,0 +1,232 @@
+/*
+Package linearizability checks histories of operations on a concurrent object, such as the keys of
+the replicated store, for linearizability: whether every operation can be taken to happen at a
+single point between its call and its return, in an order in which the outputs are those of a
+sequential object described by a Model.
+
+The search is the algorithm of Wing & Gong as improved by Lowe: the calls are tentatively linearized
+in order, backtracking when the return of an operation not yet linearized is reached, and the states
+already explored (the operations linearized and the state of the object) are cached. A history is
+first split into independent partitions by the model (e.g. one per key), each checked on its own.
+
+An operation whose outcome is unknown (e.g. a write that timed out) returns at Unknown: it may take
+effect at any point after its call, or never. Its output is nil.
+*/
+package linearizability
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The return time of the operations whose outcome is unknown.
+const Unknown = time.Duration(math.MaxInt64)
+
+// An operation of a history, with its times relative to the start of the history.
+type Operation struct {
+	Client int
+	Input  interface{}
+	Output interface{} // nil if the outcome is unknown
+	Call   time.Duration
+	Return time.Duration // Unknown if the outcome is unknown
+}
+
+// A sequential specification of the object the operations are made on.
+type Model struct {
+	// Split the history into partitions checked independently, the whole history if nil.
+	Partition func(history []Operation) [][]Operation
+
+	// Return the initial state of the object.
+	Init func() interface{}
+
+	// Whether the operation with the given input may return the output in the state, and the state
+	// it leaves the object in. The output is nil if the outcome of the operation is unknown.
+	Step func(state, input, output interface{}) (bool, interface{})
+
+	// Whether two states are the same, == if nil.
+	Equal func(a, b interface{}) bool
+}
+
+// The outcome of a check.
+type Result struct {
+	OK        bool
+	Partition []Operation // The first partition found not to be linearizable, if any
+}
+
+// Check the history against the model.
+func Check(model Model, history []Operation) Result {
+
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+
+	for _, partition := range partitions {
+		if !checkPartition(model, partition) {
+			return Result{OK: false, Partition: partition}
+		}
+	}
+
+	return Result{OK: true}
+}
+
+// An event of a history, in the doubly linked list searched by checkPartition.
+type event struct {
+	op         int
+	call       bool
+	match      *event // The return of a call
+	prev, next *event
+}
+
+func checkPartition(model Model, ops []Operation) bool {
+
+	equal := model.Equal
+	if equal == nil {
+		equal = func(a, b interface{}) bool { return a == b }
+	}
+
+	type timed struct {
+		at    time.Duration
+		event *event
+	}
+
+	var events []timed
+	for i, op := range ops {
+		call, ret := &event{op: i, call: true}, &event{op: i}
+		call.match = ret
+		events = append(events, timed{op.Call, call}, timed{op.Return, ret})
+	}
+
+	// Calls go first at equal times, which only allows more linearizations.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].at != events[j].at {
+			return events[i].at < events[j].at
+		}
+		return events[i].event.call && !events[j].event.call
+	})
+
+	head := &event{}
+	last := head
+	for _, e := range events {
+		e.event.prev, last.next = last, e.event
+		last = e.event
+	}
+
+	// Remove a call and its return from the list, or put them back.
+	lift := func(e *event) {
+		e.prev.next = e.next
+		e.next.prev = e.prev
+		e.match.prev.next = e.match.next
+		if e.match.next != nil {
+			e.match.next.prev = e.match.prev
+		}
+	}
+
+	unlift := func(e *event) {
+		e.match.prev.next = e.match
+		if e.match.next != nil {
+			e.match.next.prev = e.match
+		}
+		e.prev.next = e
+		e.next.prev = e
+	}
+
+	type frame struct {
+		event *event
+		state interface{}
+	}
+
+	linearized := make([]byte, len(ops))
+	for i := range linearized {
+		linearized[i] = '0'
+	}
+
+	// The states reached with each set of linearized operations.
+	cache := make(map[string][]interface{})
+
+	seen := func(state interface{}) bool {
+
+		key := string(linearized)
+
+		for _, s := range cache[key] {
+			if equal(s, state) {
+				return true
+			}
+		}
+
+		cache[key] = append(cache[key], state)
+		return false
+	}
+
+	state := model.Init()
+	var stack []frame
+
+	entry := head.next
+
+	for entry != nil {
+
+		if entry.call {
+
+			op := ops[entry.op]
+
+			if ok, next := model.Step(state, op.Input, op.Output); ok {
+
+				linearized[entry.op] = '1'
+
+				if !seen(next) {
+					stack = append(stack, frame{entry, state})
+					state = next
+					lift(entry)
+					entry = head.next
+					continue
+				}
+
+				linearized[entry.op] = '0'
+			}
+
+			entry = entry.next
+			continue
+		}
+
+		// Only operations of unknown outcome remain: they may never take effect.
+		if ops[entry.op].Return == Unknown {
+			return true
+		}
+
+		// The return of an operation not linearized yet: backtrack.
+		if len(stack) == 0 {
+			return false
+		}
+
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		entry, state = top.event, top.state
+		linearized[entry.op] = '0'
+		unlift(entry)
+		entry = entry.next
+	}
+
+	return true
+}
+
+// Describe the operations of a history, one per line, for reporting a failed check.
+func Describe(history []Operation, describe func(op Operation) string) string {
+
+	var b strings.Builder
+
+	for _, op := range history {
+
+		b.WriteString(describe(op))
+
+		if op.Return == Unknown {
+			b.WriteString(" [" + op.Call.String() + ", unknown]\n")
+		} else {
+			b.WriteString(" [" + op.Call.String() + ", " + op.Return.String() + "]\n")
+		}
+	}
+
+	return b.String()
+}
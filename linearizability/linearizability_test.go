@@ -0,0 +1,64 @@
+package linearizability
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks the checker on small histories of operations on the
+ * keys of the store: stale reads, writes of unknown outcome, and puts and
+ * deletes rejected because the key is missing.
+ */
+func TestCheckKV(t *testing.T) {
+
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	get := func(key, value string, call, ret int) Operation {
+		return Operation{Input: KVInput{Op: KVGet, Key: key}, Output: KVOutput{Exists: value != "", Value: value}, Call: ms(call), Return: ms(ret)}
+	}
+
+	write := func(op, key, value string, call, ret int) Operation {
+		o := Operation{Input: KVInput{Op: op, Key: key, Value: value}, Output: KVOutput{Exists: true}, Call: ms(call), Return: ms(ret)}
+		if ret < 0 {
+			o.Output, o.Return = nil, Unknown
+		}
+		return o
+	}
+
+	rejected := func(op, key string, call, ret int) Operation {
+		return Operation{Input: KVInput{Op: op, Key: key}, Output: KVOutput{}, Call: ms(call), Return: ms(ret)}
+	}
+
+	for _, c := range []struct {
+		name    string
+		history []Operation
+		ok      bool
+	}{
+		{"sequential write then read", []Operation{write(KVPut, "k", "a", 0, 1), get("k", "a", 2, 3)}, true},
+		{"stale read", []Operation{write(KVPut, "k", "a", 0, 1), get("k", "init", 2, 3)}, false},
+		{"concurrent reads", []Operation{write(KVPut, "k", "a", 0, 5), get("k", "init", 1, 2), get("k", "a", 3, 4)}, true},
+		{"new then old value", []Operation{write(KVPut, "k", "a", 0, 9), get("k", "a", 1, 2), get("k", "init", 3, 4)}, false},
+		{"unknown write taking effect late", []Operation{write(KVPut, "k", "a", 0, -1), get("k", "init", 1, 2), get("k", "a", 3, 4)}, true},
+		{"unknown write never taking effect", []Operation{write(KVPut, "k", "a", 0, -1), get("k", "init", 1, 2)}, true},
+		{"read before the write", []Operation{get("k", "a", 0, 1), write(KVPut, "k", "a", 2, -1)}, false},
+		{"keys are independent", []Operation{write(KVPut, "k", "a", 0, 1), get("other", "", 2, 3)}, true},
+		{"create of a missing key", []Operation{write(KVCreate, "other", "b", 0, 1), get("other", "b", 2, 3)}, true},
+		{"create of an existing key", []Operation{write(KVCreate, "k", "b", 0, 1), get("k", "init", 2, 3)}, true},
+		{"delete", []Operation{write(KVDelete, "k", "", 0, 1), get("k", "", 2, 3), rejected(KVPut, "k", 4, 5)}, true},
+		{"read after a delete", []Operation{write(KVDelete, "k", "", 0, 1), get("k", "init", 2, 3)}, false},
+		{"put rejected while the key exists", []Operation{rejected(KVPut, "k", 0, 1)}, false},
+		{"put of a deleted key", []Operation{write(KVDelete, "k", "", 0, 1), write(KVPut, "k", "a", 2, 3), get("k", "", 4, 5)}, true},
+		{"unknown create enabling a put", []Operation{write(KVCreate, "other", "b", 0, -1), write(KVPut, "other", "c", 2, 3), get("other", "c", 4, 5)}, true},
+	} {
+		if result := Check(KVModel(map[string]string{"k": "init"}), c.history); result.OK != c.ok {
+			t.Errorf("%v: expected %v, got %v for\n%v", c.name, c.ok, result.OK, Describe(c.history, DescribeKV))
+		}
+	}
+
+	// The failing partition is returned.
+	history := []Operation{write(KVPut, "k", "a", 0, 1), get("other", "", 0, 1), get("k", "init", 2, 3)}
+	if result := Check(KVModel(map[string]string{"k": "init"}), history); result.OK || len(result.Partition) != 2 {
+		t.Errorf("Expected the partition of key k to fail, got %+v", result)
+	}
+}
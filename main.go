@@ -4,16 +4,85 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"log"
 	"math/rand"
-	"strconv"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/krithikvaidya/distributed-dns/raft"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
 )
 
 var n_replica int
+var failure_domains string
+var witnesses string
+var consensus_only string
+var groups int
+var force_placement bool
+var peer_token string
+var client_token string
+var federation_token string
+var log_rpcs bool
+var max_body_bytes int64
+var client_rate_limit int64
+var client_rate_burst int64
+var global_rate_limit int64
+var global_rate_burst int64
+var max_concurrent_requests int
+var max_pending_proposals int
+var authz_webhook string
+var authz_token string
+var authz_timeout time.Duration
+var authz_fail_open bool
+var dns_update_window time.Duration
+var max_follower_lag int
+var read_route_timeout time.Duration
+var write_route_timeout time.Duration
+var election_timeout_min time.Duration
+var election_timeout_max time.Duration
+var heartbeat_interval time.Duration
+var rpc_timeout time.Duration
+var peer_keepalive_time time.Duration
+var peer_keepalive_timeout time.Duration
+var peer_failure_threshold int
+var bulk_message_bytes int
+var single_port bool
+var trace_file string
+var log_level string
+var log_format string
+var config_file string
+var peer_cert string
+var peer_key string
+var peer_ca string
+var peer_names string
+var http_cert string
+var http_key string
+var http_admin_token string
+var standby_sources string
+var standby_interval time.Duration
+var standby_file string
+var standby_token string
+var standby_ca string
+var restore_file string
+var fault_spec string
+var snapshot_max_rate int64
+var snapshot_latency_target time.Duration
+var max_memory_bytes int64
+var max_disk_bytes int64
+var follower_read_staleness int
+var readiness_max_lag int
+var compaction_threshold int
+var compaction_slack int
+var store_backend string
+var diagnostics_dir string
+var data_dir string
+var wal_dir string
+var kv_dir string
+var snapshot_dir string
 
 func init() {
 
@@ -27,42 +96,289 @@ func init() {
 
 	// Command line parameters
 	flag.IntVar(&n_replica, "n", 5, "total number of replicas (default=5)")
+	flag.StringVar(&failure_domains, "domains", "", "comma separated zone/rack/host of each replica, in order of replica id")
+	flag.StringVar(&witnesses, "witnesses", "", "comma separated IDs of the replicas that are witnesses, which vote but hold no keys")
+	flag.StringVar(&consensus_only, "consensus-only", "", "comma separated IDs of the replicas dedicated to consensus, which serve no queries")
+	flag.IntVar(&groups, "groups", 1, "number of Raft groups sharding the zones, each process hosting a replica of every group (see raft/shards.go)")
+	flag.BoolVar(&force_placement, "force-placement", false, "start even if a quorum of replicas shares a failure domain")
+	flag.StringVar(&peer_token, "peer-token", "", "shared secret used to authenticate RPCs between replicas")
+	flag.StringVar(&client_token, "client-token", "", "shared secret clients must present on KVService RPCs")
+	flag.StringVar(&federation_token, "federation-token", "", "token presented to the home clusters of the zones replicated from other clusters")
+	flag.StringVar(&peer_cert, "peer-cert", "", "PEM certificate used for mutual TLS between replicas, valid for server and client authentication")
+	flag.StringVar(&peer_key, "peer-key", "", "PEM private key of the -peer-cert certificate")
+	flag.StringVar(&peer_ca, "peer-ca", "", "PEM certificate of the CA that signs the certificates of the replicas")
+	flag.StringVar(&peer_names, "peer-names", "", "comma separated names (common name or DNS SAN) the certificates of the peers must carry one of, any certificate signed by -peer-ca if empty")
+	flag.StringVar(&http_cert, "http-cert", "", "PEM certificate of the client HTTP server, which then serves HTTPS")
+	flag.StringVar(&http_key, "http-key", "", "PEM private key of the -http-cert certificate")
+	flag.StringVar(&http_admin_token, "http-admin-token", "", "bearer token of the bootstrap admin, requires clients of the HTTP API to authenticate")
+	flag.StringVar(&standby_sources, "standby", "", "run as a cold standby, pulling snapshots from the comma separated client HTTP addresses of a cluster")
+	flag.DurationVar(&standby_interval, "standby-interval", time.Minute, "time between two snapshots pulled by a standby")
+	flag.StringVar(&standby_file, "standby-file", "standby.snapshot", "file a standby keeps the latest snapshot in, relative to -snapshot-dir")
+	flag.StringVar(&standby_token, "standby-token", "", "bearer token a standby presents to the replicas")
+	flag.StringVar(&standby_ca, "standby-ca", "", "PEM certificate of the CA of the replicas a standby pulls from over HTTPS")
+	flag.StringVar(&fault_spec, "faults", "", "faults injected for testing, e.g. drop=0.05,delay=0.2:50ms,crash=10s (requires a build with -tags faults, see raft/faults.go)")
+	flag.StringVar(&restore_file, "restore", "", "snapshot loaded into a replica without persisted state before it starts, e.g. from a standby")
+	flag.BoolVar(&log_rpcs, "log-rpcs", false, "log every RPC handled by the gRPC server")
+	flag.Int64Var(&max_body_bytes, "max-body-bytes", 1<<20, "maximum size of a client request body")
+	flag.Int64Var(&client_rate_limit, "client-rate-limit", 0, "requests per second allowed to each client IP on the client HTTP API, 0 for unlimited")
+	flag.Int64Var(&client_rate_burst, "client-rate-burst", 0, "requests a client IP may send at once, -client-rate-limit if 0")
+	flag.Int64Var(&global_rate_limit, "global-rate-limit", 0, "requests per second allowed to all the clients of the client HTTP API together, 0 for unlimited")
+	flag.Int64Var(&global_rate_burst, "global-rate-burst", 0, "requests all the clients may send at once, -global-rate-limit if 0")
+	flag.IntVar(&max_concurrent_requests, "max-concurrent-requests", 256, "number of requests served at once by the HTTP and gRPC servers, from which lower priority requests are shed")
+	flag.StringVar(&authz_webhook, "authz-webhook", "", "URL of the external authorization service consulted on the client writes, e.g. the data API of an OPA server, none if empty")
+	flag.StringVar(&authz_token, "authz-token", "", "bearer token presented to the external authorization service")
+	flag.DurationVar(&authz_timeout, "authz-timeout", time.Second, "time the external authorization service may take to decide on a write")
+	flag.BoolVar(&authz_fail_open, "authz-fail-open", false, "allow the writes when the external authorization service fails, rather than rejecting them")
+	flag.DurationVar(&dns_update_window, "dns-update-window", 30*time.Second, "time within which the retransmissions of a DNS update are answered without applying it again")
+	flag.IntVar(&max_pending_proposals, "max-pending-proposals", 1024, "writes pending on the leader at most, further writes being rejected with 429 until some commit, 0 for no limit")
+	flag.IntVar(&max_follower_lag, "max-follower-lag", 10000, "entries the quorum of followers may lag behind the leader's log before writes are rejected with 429, 0 for no limit")
+	flag.DurationVar(&read_route_timeout, "read-timeout", 5*time.Second, "time allowed for handling a client read request")
+	flag.DurationVar(&write_route_timeout, "write-timeout", 10*time.Second, "time allowed for handling a client write request")
+	flag.DurationVar(&election_timeout_min, "election-timeout-min", 500*time.Millisecond, "shortest time a follower waits for the leader before starting an election")
+	flag.DurationVar(&election_timeout_max, "election-timeout-max", 800*time.Millisecond, "longest time a follower waits for the leader before starting an election")
+	flag.DurationVar(&heartbeat_interval, "heartbeat-interval", 50*time.Millisecond, "time between two heartbeats of the leader, well below -election-timeout-min")
+	flag.DurationVar(&rpc_timeout, "rpc-timeout", 20*time.Millisecond, "deadline of the AppendEntries and RequestVote RPCs between replicas")
+	flag.DurationVar(&peer_keepalive_time, "peer-keepalive-time", 10*time.Second, "idle time after which the connection to a peer is checked with a keepalive ping, 10s at least")
+	flag.DurationVar(&peer_keepalive_timeout, "peer-keepalive-timeout", 3*time.Second, "time a keepalive ping may go unanswered before the connection to the peer is closed")
+	flag.IntVar(&peer_failure_threshold, "peer-failure-threshold", 10, "consecutive failed RPCs after which a peer is deemed unreachable, 0 to never")
+	flag.IntVar(&bulk_message_bytes, "bulk-message-bytes", 64<<10, "largest AppendEntries sent to a peer with the heartbeats rather than on the bulk connection, 0 for a single connection")
+	flag.BoolVar(&single_port, "single-port", false, "serve the gRPC, key-value and admin APIs on the client HTTP port (:400<id>), the peers being reached on theirs")
+	flag.Int64Var(&snapshot_max_rate, "snapshot-max-rate", 64<<20, "bytes per second sent to each peer by the snapshot transfers at most, 0 for unlimited")
+	flag.DurationVar(&snapshot_latency_target, "snapshot-latency-target", 50*time.Millisecond, "write latency below which the snapshot transfers aren't slowed down")
+	flag.Int64Var(&max_memory_bytes, "max-memory-bytes", 2<<30, "memory used by the log, caches and key-value store raising the NOMEMORY alarm, 0 for unlimited")
+	flag.Int64Var(&max_disk_bytes, "max-disk-bytes", 8<<30, "size of the persisted files raising the NOSPACE alarm, 0 for unlimited")
+	flag.StringVar(&trace_file, "trace-file", "", "file the OpenTelemetry spans of the client requests are written to as JSON")
+	flag.StringVar(&log_level, "log-level", "info", "minimum level of the logged messages: trace, debug, info, warn or error")
+	flag.StringVar(&log_format, "log-format", logging.FormatConsole, "format of the logged messages: console or json")
+	flag.IntVar(&follower_read_staleness, "follower-read-staleness", -1, "entries a follower may lag behind the leader's commit index and still serve reads locally, -1 to forward them to the leader")
+	flag.IntVar(&readiness_max_lag, "readiness-max-lag", 1000, "committed entries a follower may not have applied yet and still be ready, see /readyz")
+	flag.IntVar(&compaction_threshold, "compaction-threshold", 10000, "applied entries in the log past which it is compacted, 0 to keep the whole log (e.g. for raftctl replay)")
+	flag.IntVar(&compaction_slack, "compaction-slack", 1000, "entries kept by the compaction behind the last applied one, and behind the slowest connected follower")
+	flag.StringVar(&diagnostics_dir, "diagnostics-dir", "", "directory the diagnostics bundles are written to on shutdown and crashes, none if empty")
+	flag.StringVar(&data_dir, "data-dir", "", "directory of the persisted data of the replica, the working directory if empty")
+	flag.StringVar(&wal_dir, "wal-dir", "", "directory of the raft state 300<id>, synced on every change, -data-dir if empty")
+	flag.StringVar(&kv_dir, "kv-dir", "", "directory of the key-value store 600<id>, synced on every applied write, -data-dir if empty")
+	flag.StringVar(&snapshot_dir, "snapshot-dir", "", "directory of the snapshots kept by a standby, -data-dir if empty")
+	flag.StringVar(&store_backend, "store-backend", kv_store.BackendMap, "backend of the key-value store: map, held in memory, or bolt, a bbolt database in the file 600<id>.db")
+	flag.StringVar(&config_file, "config", "", "JSON config file of the replica, defining its DNS listeners (see raft/dns.go)")
 	flag.Parse()
 
-	log.SetFlags(0) // Turn off timestamps in log output.
 	rand.Seed(time.Now().UnixNano())
 
 }
 
+// Return the directories of the persisted data, see raft/layout.go
+func dataLayout() raft.DataLayout {
+
+	layout := raft.DataLayout{WAL: wal_dir, KV: kv_dir, Snapshots: snapshot_dir}
+
+	for _, dir := range []*string{&layout.WAL, &layout.KV, &layout.Snapshots} {
+		if *dir == "" {
+			*dir = data_dir
+		}
+	}
+
+	return layout
+}
+
 func main() {
 
-	log.Println("Raft-based Replicated Key Value Store")
+	raft.CheckErrorFatal(logging.Setup(os.Stderr, log_level, log_format))
+
+	logging.Logger.Info().Msg("Raft-based Replicated Key Value Store")
+
+	layout := dataLayout()
+
+	// A standby doesn't join the cluster, see raft/standby.go
+	if standby_sources != "" {
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		go func() {
+			os_sigs := make(chan os.Signal, 1)
+			signal.Notify(os_sigs, syscall.SIGTERM, syscall.SIGINT)
+			<-os_sigs
+			cancel()
+		}()
+
+		raft.CheckErrorFatal(raft.RunStandby(ctx, raft.StandbyConfig{
+			Sources:  strings.Split(standby_sources, ","),
+			Interval: standby_interval,
+			Path:     layout.SnapshotFile(standby_file),
+			Token:    standby_token,
+			CAFile:   standby_ca,
+		}))
 
-	log.Printf("Enter the replica's id: ")
+		return
+	}
+
+	// Make sure that no single declared failure domain holds a quorum of the replicas. With an even
+	// number of replicas, a domain holding half of them is accepted, although its loss leaves no quorum.
+	domains, err := raft.ParseFailureDomains(failure_domains, n_replica)
+	if err == nil && domains != nil {
+		err = raft.ValidatePlacement(domains, force_placement)
+	}
+	raft.CheckErrorFatal(err)
+
+	witness_ids, err := raft.ParseWitnesses(witnesses, n_replica)
+	raft.CheckErrorFatal(err)
+
+	consensus_ids, err := raft.ParseConsensusOnly(consensus_only, n_replica, witness_ids)
+	raft.CheckErrorFatal(err)
+
+	if groups < 1 || groups > raft.MaxGroups {
+		raft.CheckErrorFatal(fmt.Errorf("invalid number of groups %v, expected 1 to %v", groups, raft.MaxGroups))
+	}
+
+	// A replica joining a running cluster is given an id >= n, and stays out of elections
+	// until it is added with `raftctl add-member`.
+	fmt.Fprint(os.Stderr, "Enter the replica's id: ")
 	var rid int
 	fmt.Scanf("%d", &rid)
 
+	raft.CheckErrorFatal(layout.Validate(rid))
+	for _, warning := range layout.MediaWarnings() {
+		logging.Logger.Warn().Str("warning", warning).Msg("Persisted data on slow media")
+	}
+
+	// Start a fresh cluster from a snapshot, e.g. one kept by a standby.
+	if restore_file != "" {
+		raft.CheckErrorFatal(raft.RestoreSnapshot(restore_file, rid, layout))
+	}
+
+	// Export the traces of the client requests, see raft/tracing.go
+	if trace_file != "" {
+
+		file, err := os.Create(trace_file)
+		raft.CheckErrorFatal(err)
+
+		shutdown, err := raft.SetupTracing(file, rid)
+		raft.CheckErrorFatal(err)
+
+		defer func() {
+			shutdown(context.Background())
+			file.Close()
+		}()
+	}
+
 	master_context, master_cancel := context.WithCancel(context.Background())
 
-	node := raft.Setup_raft_node(master_context, rid, n_replica, false)
+	// A sharded process hosts a replica of each group, see raft/shards.go
+	nodes := make([]*raft.RaftNode, groups)
 
-	node.Meta.Master_ctx = master_context
-	node.Meta.Master_cancel = master_cancel
+	for g := range nodes {
 
-	// Store the gRPC address of other replicas
-	rep_addrs := make([]string, n_replica)
-	for i := 0; i < n_replica; i++ {
-		if i == rid {
-			continue
+		// The layout of group 0 was validated above.
+		group_layout := layout
+		group_layout.Group = g
+		if g > 0 {
+			raft.CheckErrorFatal(group_layout.Validate(rid))
 		}
 
-		rep_addrs[i] = ":500" + strconv.Itoa(i)
+		nodes[g] = raft.Setup_raft_node(master_context, rid, n_replica, store_backend, group_layout, false)
+		raft.CheckErrorFatal(configure(nodes[g], g, witness_ids, consensus_ids, domains))
+
+		nodes[g].Meta.Master_ctx = master_context
+		nodes[g].Meta.Master_cancel = master_cancel
+	}
+
+	if groups > 1 {
+		raft.NewShardHost(nodes)
 	}
 
-	// Perform steps necessary to setup the node as an active replica.
-	node.Connect_raft_node(master_context, rid, rep_addrs, false)
+	for g, node := range nodes {
+
+		// Store the gRPC address of other replicas
+		rep_addrs := make([]string, n_replica)
+		for i := 0; i < n_replica; i++ {
+			if i == rid {
+				continue
+			}
+
+			rep_addrs[i] = raft.PeerAddress(g, i)
+
+			// All the replicas serve a single port, see raft/portmux.go
+			if single_port {
+				rep_addrs[i] = raft.ClientAddress(g, i)
+			}
+		}
+
+		// Perform steps necessary to setup the node as an active replica.
+		node.Connect_raft_node(master_context, rid, rep_addrs, false)
+	}
 
-	log.Printf("Node initialization successful")
+	logging.Logger.Info().Int("replica_id", rid).Int("groups", groups).Msg("Node initialization successful")
+
+	nodes[0].ListenForShutdown(master_cancel)
+}
+
+// Apply the command line parameters to the replica of the group. The DNS listeners of the config file
+// are only started by group 0.
+func configure(node *raft.RaftNode, group int, witness_ids, consensus_ids []int32, domains []raft.FailureDomain) error {
+
+	var err error
+
+	node.Meta.Config.PeerToken = peer_token
+	node.Meta.Config.ClientToken = client_token
+	node.Meta.Config.FederationToken = federation_token
+	node.Meta.Config.PeerCertFile = peer_cert
+	node.Meta.Config.PeerKeyFile = peer_key
+	node.Meta.Config.PeerCAFile = peer_ca
+	if peer_names != "" {
+		node.Meta.Config.PeerNames = strings.Split(peer_names, ",")
+	}
+	node.Meta.Config.HTTPCertFile = http_cert
+	node.Meta.Config.HTTPKeyFile = http_key
+	node.Meta.Config.HTTPAdminToken = http_admin_token
+	node.Meta.Config.LogRPCs = log_rpcs
+	node.Meta.Config.MaxBodyBytes = max_body_bytes
+	node.Meta.Config.ClientRateLimit = client_rate_limit
+	node.Meta.Config.ClientRateBurst = client_rate_burst
+	node.Meta.Config.GlobalRateLimit = global_rate_limit
+	node.Meta.Config.GlobalRateBurst = global_rate_burst
+	node.Meta.Config.MaxConcurrentRequests = max_concurrent_requests
+	node.Meta.Config.MaxPendingProposals = max_pending_proposals
+	node.Meta.Config.AuthzTimeout = authz_timeout
+	node.Meta.Config.AuthzFailOpen = authz_fail_open
+	node.Meta.Config.DNSUpdateWindow = dns_update_window
+	if authz_webhook != "" {
+		node.SetAuthorizer(raft.NewWebhookAuthorizer(authz_webhook, authz_token))
+	}
+	node.Meta.Config.MaxFollowerLag = int32(max_follower_lag)
+	node.Meta.Config.ReadRouteTimeout = read_route_timeout
+	node.Meta.Config.WriteRouteTimeout = write_route_timeout
+	node.Meta.Config.Witnesses = witness_ids
+	node.Meta.Config.ConsensusOnly = consensus_ids
+	node.Meta.Config.FailureDomains = domains
+	node.Meta.Config.ElectionTimeoutMin = election_timeout_min
+	node.Meta.Config.ElectionTimeoutMax = election_timeout_max
+	node.Meta.Config.HeartbeatInterval = heartbeat_interval
+	node.Meta.Config.RPCTimeout = rpc_timeout
+	node.Meta.Config.PeerKeepaliveTime = peer_keepalive_time
+	node.Meta.Config.PeerKeepaliveTimeout = peer_keepalive_timeout
+	node.Meta.Config.PeerFailureThreshold = peer_failure_threshold
+	node.Meta.Config.BulkMessageBytes = bulk_message_bytes
+	node.Meta.Config.SinglePort = single_port
+	node.Meta.Config.SnapshotMaxRate = snapshot_max_rate
+	node.Meta.Config.SnapshotLatencyTarget = snapshot_latency_target
+	node.Meta.Config.MaxMemoryBytes = max_memory_bytes
+	node.Meta.Config.MaxDiskBytes = max_disk_bytes
+	node.Meta.Config.FollowerReadStaleness = int32(follower_read_staleness)
+	node.Meta.Config.ReadinessMaxLag = int32(readiness_max_lag)
+	node.Meta.Config.CompactionThreshold = int32(compaction_threshold)
+	node.Meta.Config.CompactionSlack = int32(compaction_slack)
+	node.Meta.Config.DiagnosticsDir = diagnostics_dir
+	if node.Meta.Config.Faults, err = raft.ParseFaults(fault_spec); err != nil {
+		return err
+	}
+
+	if err := node.Meta.Config.ValidateTiming(); err != nil {
+		return err
+	}
+
+	if config_file != "" && group == 0 {
+		return raft.LoadConfigFile(config_file, node.Meta.Config)
+	}
 
-	node.ListenForShutdown(master_cancel)
+	return nil
 }
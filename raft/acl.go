@@ -0,0 +1,410 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Role-based access control on the keys. On top of the permission of a user on all the keys (see
+users.go), the roles of the user grant it read or write access to the keys with a given prefix, to
+the keys of a DNS zone, or to the RRsets of a single name: the zone "example.com" covers
+"example.com" and "www.example.com", as well as their records ("dns:www.example.com.:A"), but not
+"badexample.com", while the record rule "home.example.com/A" only covers the A records of
+home.example.com, e.g. for the token of a router updating its own address (see dns_update.go).
+Write access implies read access.
+
+Roles are stored in the key-value store under the reserved RolesPrefix, and are only changed through
+"ROLE" log entries, made by the /admin/roles endpoints. The ACLs are enforced by both the HTTP API
+(see authMiddleware) and the KVService: single keys are checked before being accessed, while the keys
+a user can't read are left out of range, prefix and watch results.
+*/
+
+const RolesPrefix = "_roles:" // Keys holding the definition of each role
+
+// A grant of access to a set of keys, given either by prefix, by DNS zone or by record name.
+type Rule struct {
+	Access string `json:"access"` // PermissionRead or PermissionWrite
+	Prefix string `json:"prefix,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+	Record string `json:"record,omitempty"` // Name of the RRsets covered
+	Type   string `json:"type,omitempty"`   // Type of the RRset of the record covered, every type if empty
+}
+
+// Whether the rule grants the given access to the key.
+func (rule Rule) grants(key, access string) bool {
+
+	if permissionLevels[rule.Access] < permissionLevels[access] {
+		return false
+	}
+
+	if rule.Record != "" {
+		name, rtype, ok := zone.ParseRecordKey(key)
+		return ok && zone.CanonicalName(name) == zone.CanonicalName(rule.Record) && (rule.Type == "" || strings.EqualFold(rtype, rule.Type))
+	}
+
+	if rule.Zone != "" {
+
+		// The records of a name are covered along with the name itself.
+		if owner, _, ok := zone.ParseRecordKey(key); ok {
+			key = owner
+		}
+
+		apex := strings.ToLower(strings.TrimSuffix(rule.Zone, "."))
+		name := strings.ToLower(strings.TrimSuffix(key, "."))
+		return name == apex || strings.HasSuffix(name, "."+apex)
+	}
+
+	return strings.HasPrefix(key, rule.Prefix)
+}
+
+// Parse a rule of the form <access>:prefix:<prefix>, <access>:zone:<zone> or <access>:record:<name>[/<type>].
+func parseRule(s string) (Rule, error) {
+
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 || (parts[0] != PermissionRead && parts[0] != PermissionWrite) {
+		return Rule{}, fmt.Errorf("invalid rule %q, expected <read|write>:prefix:<prefix>, <read|write>:zone:<zone> or <read|write>:record:<name>[/<type>]", s)
+	}
+
+	switch parts[1] {
+
+	case "prefix":
+		return Rule{Access: parts[0], Prefix: parts[2]}, nil
+
+	case "zone":
+		if parts[2] == "" {
+			return Rule{}, fmt.Errorf("invalid rule %q, the zone can't be empty", s)
+		}
+		return Rule{Access: parts[0], Zone: parts[2]}, nil
+
+	case "record":
+		name, rtype := parts[2], ""
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name, rtype = name[:i], strings.ToUpper(name[i+1:])
+		}
+
+		if _, ok := dns.IsDomainName(name); !ok || name == "" || strings.Contains(name, ":") {
+			return Rule{}, fmt.Errorf("invalid rule %q, invalid record name %q", s, name)
+		}
+		if _, ok := dns.StringToType[rtype]; rtype != "" && !ok {
+			return Rule{}, fmt.Errorf("invalid rule %q, unknown record type %q", s, rtype)
+		}
+		return Rule{Access: parts[0], Record: zone.CanonicalName(name), Type: rtype}, nil
+
+	}
+
+	return Rule{}, fmt.Errorf("invalid rule %q, expected a prefix, a zone or a record", s)
+}
+
+// A named set of rules, granted to users.
+type Role struct {
+	Name  string `json:"name"`
+	Rules []Rule `json:"rules"`
+}
+
+// The roles known to a replica, safe for concurrent use.
+type Roles struct {
+	mu    sync.RWMutex
+	roles map[string]Role
+}
+
+func NewRoles() *Roles {
+	return &Roles{roles: make(map[string]Role)}
+}
+
+// Forget the roles, before they are loaded again from the store.
+func (r *Roles) reset() {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roles = make(map[string]Role)
+}
+
+// Return the role with the given name, and whether it exists.
+func (r *Roles) Get(name string) (Role, bool) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	role, ok := r.roles[name]
+	return role, ok
+}
+
+// Return the roles sorted by name.
+func (r *Roles) List() []Role {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]Role, 0, len(r.roles))
+	for _, role := range r.roles {
+		list = append(list, role)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Replace the role with the given name, or remove it if role is nil.
+func (r *Roles) apply(name string, role *Role) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if role == nil {
+		delete(r.roles, name)
+	} else {
+		r.roles[name] = *role
+	}
+}
+
+// Whether the user is allowed the given access to the key, by its permission or one of its roles.
+func (r *Roles) allows(user User, key, access string) bool {
+
+	if user.allows(access) {
+		return true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, name := range user.Roles {
+		for _, rule := range r.roles[name].Rules {
+			if rule.grants(key, access) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Whether the roles of the user grant it the given access to all the keys with the prefix, current
+// or future: only a prefix rule covering the whole prefix does.
+func (r *Roles) allowsPrefix(user User, prefix, access string) bool {
+
+	if user.allows(access) {
+		return true
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, name := range user.Roles {
+		for _, rule := range r.roles[name].Rules {
+			if rule.Record == "" && rule.Zone == "" && permissionLevels[rule.Access] >= permissionLevels[access] && strings.HasPrefix(prefix, rule.Prefix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the operation of the log entry setting (or removing, if role is nil) a role.
+func roleOperation(name string, role *Role) []string {
+
+	if role == nil {
+		return []string{"ROLE", name, "", "UNSET"}
+	}
+
+	record, _ := json.Marshal(role)
+	return []string{"ROLE", name, string(record), "SET"}
+}
+
+// Return the transaction applying the "ROLE" log entry to the key-value store, along with the
+// name and new definition (nil if removed) of the role.
+func roleTxn(entry *protos.LogEntry) (kv_store.Txn, string, *Role) {
+
+	name := entry.Operation[1]
+
+	if entry.Operation[3] == "UNSET" {
+		return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: RolesPrefix + name}}}, name, nil
+	}
+
+	var role Role
+	json.Unmarshal([]byte(entry.Operation[2]), &role)
+
+	return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: RolesPrefix + name, Value: entry.Operation[2]}}}, name, &role
+}
+
+// Load the roles persisted in the local key-value store.
+func (node *RaftNode) loadRoles() {
+
+	kvs, err := node.scanLocalStore(RolesPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the roles")
+		return
+	}
+
+	for _, kv := range kvs {
+
+		var role Role
+		if err := json.Unmarshal([]byte(kv.Value), &role); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid role record")
+			continue
+		}
+
+		node.Meta.roles.apply(role.Name, &role)
+	}
+
+	node.logger().Info().Int("count", len(kvs)).Msg("Loaded roles")
+}
+
+/*
+Whether the roles of the user allow it to make an HTTP request it lacks the permission for: the
+requests on a single key or a zone it has access to (including their audit history), range and
+prefix queries if it can read some keys (the others are then left out of the results by
+scanHandler), batches whose keys it may all write (checked by replicateTxn) and deletions of a
+prefix it may write (checked by deletePrefix), as well as the status of asynchronous writes. The
+admin endpoints always require the permission.
+*/
+func (node *RaftNode) allowedByRoles(r *http.Request, user User, required string) bool {
+
+	if required != PermissionRead && required != PermissionWrite {
+		return false
+	}
+
+	if r.URL.Path == "/range" || strings.HasPrefix(r.URL.Path, "/prefix/") || strings.HasPrefix(r.URL.Path, "/commit-status/") {
+		return len(user.Roles) > 0
+	}
+
+	if r.URL.Path == "/batch" || r.URL.Path == "/kvstore" {
+		return required == PermissionWrite && len(user.Roles) > 0
+	}
+
+	if r.URL.Path == "/audit" {
+		return node.Meta.roles.allows(user, r.FormValue("key"), required)
+	}
+
+	if zone, ok := mux.Vars(r)["zone"]; ok {
+		return node.Meta.roles.allows(user, zone, required)
+	}
+
+	key, ok := mux.Vars(r)["key"]
+	return ok && node.Meta.roles.allows(user, key, required)
+}
+
+/*
+Return the function telling whether the request (with the given context) may access a key, or nil
+if it may access all the keys: when authentication is disabled, or when the caller presented the
+shared ClientToken rather than the token of a user.
+*/
+func (node *RaftNode) keyFilter(ctx context.Context, access string) func(key string) bool {
+
+	user, ok := requestUser(ctx)
+	if !ok || user.allows(access) {
+		return nil
+	}
+
+	return func(key string) bool {
+		return node.Meta.roles.allows(user, key, access)
+	}
+}
+
+// Check that the caller of a KVService method may access the key.
+func (node *RaftNode) authorizeKey(ctx context.Context, key, access string) error {
+
+	if allowed := node.keyFilter(ctx, access); allowed != nil && !allowed(key) {
+		user, _ := requestUser(ctx)
+		return status.Errorf(codes.PermissionDenied, "user %v isn't allowed to %v key %q", user.Name, access, key)
+	}
+
+	return nil
+}
+
+// Handle requests listing the roles, as applied by this replica.
+func (node *RaftNode) RolesHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.roles.List())
+}
+
+// Handle requests defining (PUT, with one rule=<rule> per rule) and removing (DELETE) a role. The
+// response is sent once the change is applied on the leader.
+func (node *RaftNode) SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("ROLE request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !userNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "Invalid role name: %q", name)
+		return
+	}
+
+	var role *Role
+
+	if r.Method == http.MethodDelete {
+
+		if _, ok := node.Meta.roles.Get(name); !ok {
+			writeError(w, http.StatusNotFound, "Error: Role %v doesn't exist.", name)
+			return
+		}
+
+	} else {
+
+		role = &Role{Name: name, Rules: []Rule{}}
+
+		for _, s := range r.Form["rule"] {
+
+			rule, err := parseRule(s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Error: %v", err)
+				return
+			}
+
+			role.Rules = append(role.Rules, rule)
+		}
+	}
+
+	author := ""
+	if u, ok := requestUser(r.Context()); ok {
+		author = u.Name
+	}
+
+	node.GetRLock("Set Role Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Set Role Handler")
+		return
+	}
+
+	index, success, err := node.proposeCommand(r.Context(), roleOperation(name, role), author) // releases the lock
+	if !success {
+		node.logger().Error().Err(err).Str("name", name).Msg("Error occured in ROLE request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in ROLE request: %v", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: Role change committed but not applied yet: %v", err)
+		return
+	}
+
+	node.logger().Info().Str("name", name).Int32("index", index).Str("author", author).Msg("ROLE request completed successfully and committed")
+
+	updated, _ := node.Meta.roles.Get(name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "rules": updated.Rules, "index": index})
+}
@@ -0,0 +1,140 @@
+package raft
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the roles of a user grant it access to the keys
+ * matching their prefixes and zones only, through both the HTTP API and the
+ * KVService, and that the other keys are left out of its range queries.
+ */
+func TestRoleBasedAccessControl(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), users: NewUsers(), roles: NewRoles(), rejections: NewRejections(), Config: DefaultConfig()}}
+	node.Meta.Config.HTTPAdminToken = "root-token"
+
+	valid := map[string]bool{
+		"read:prefix:app.":                true,
+		"write:zone:example.com.":         true,
+		"read:prefix:":                    true,
+		"write":                           false,
+		"admin:prefix:app.":               false,
+		"read:host:a":                     false,
+		"read:zone:":                      false,
+		"write:record:home.example.com/A": true,
+		"write:record:home.example.com":   true,
+		"write:record:home.example.com/X": false,
+		"read:record:":                    false,
+	}
+
+	for s, ok := range valid {
+		if _, err := parseRule(s); (err == nil) != ok {
+			t.Errorf("Expected rule %q to be valid: %v, got error %v", s, ok, err)
+		}
+	}
+
+	rules := []Rule{{Access: PermissionRead, Prefix: "app."}, {Access: PermissionWrite, Zone: "example.com."}}
+	role := Role{Name: "dns", Rules: rules}
+
+	txn, name, record := roleTxn(&protos.LogEntry{Operation: roleOperation(role.Name, &role)})
+	if name != role.Name || len(record.Rules) != 2 || txn.Success[0].Key != RolesPrefix+role.Name {
+		t.Fatalf("Unexpected transaction %v for role %v", txn, role.Name)
+	}
+	node.Meta.roles.apply(name, record)
+
+	user := User{Name: "operator", Roles: []string{"dns"}, TokenHash: hashToken("operator-token")}
+	node.Meta.users.apply(user.Name, &user)
+
+	access := []struct {
+		key, access string
+		allowed     bool
+	}{
+		{"app.config", PermissionRead, true},
+		{"app.config", PermissionWrite, false},
+		{"example.com", PermissionWrite, true},
+		{"WWW.Example.com", PermissionRead, true},
+		{"badexample.com", PermissionRead, false},
+		{"other", PermissionRead, false},
+		{"dns:www.example.com.:A", PermissionWrite, true},
+		{"dns:badexample.com.:A", PermissionRead, false},
+	}
+
+	for _, a := range access {
+		if allowed := node.Meta.roles.allows(user, a.key, a.access); allowed != a.allowed {
+			t.Errorf("Expected %v access to %q to be allowed: %v, got %v", a.access, a.key, a.allowed, allowed)
+		}
+	}
+
+	r := mux.NewRouter()
+	r.Use(node.authMiddleware)
+	r.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	r.HandleFunc("/admin/status", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET")
+	r.HandleFunc("/{key}", func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/app.config", http.StatusOK},
+		{"PUT", "/app.config", http.StatusForbidden},
+		{"PUT", "/www.example.com", http.StatusOK},
+		{"GET", "/other", http.StatusForbidden},
+		{"GET", "/range", http.StatusOK},
+		{"GET", "/admin/status", http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+
+		req := httptest.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer operator-token")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != c.code {
+			t.Errorf("%v %v: expected status %v, got %v", c.method, c.path, c.code, w.Code)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), userContextKey{}, user)
+
+	page := `{"kvs":[{"key":"app.config","value":"1"},{"key":"other","value":"2"}]}`
+	if contents := filterPage(page, node.keyFilter(ctx, PermissionRead)); strings.Contains(contents, "other") || !strings.Contains(contents, "app.config") {
+		t.Errorf("Expected the keys the user can't read to be left out of the range, got %q", contents)
+	}
+
+	if node.keyFilter(context.Background(), PermissionWrite) != nil {
+		t.Errorf("Expected requests made without user credentials to access all the keys")
+	}
+
+	// The KVService accepts the API tokens of the users, and enforces their ACLs.
+	md := metadata.Pairs("authorization", "Bearer operator-token")
+	authorized, err := node.authorize(metadata.NewIncomingContext(context.Background(), md), "/protos.KVService/Put")
+	if err != nil {
+		t.Fatalf("Expected the API token of the user to be accepted, got %v", err)
+	}
+
+	if err := node.authorizeKey(authorized, "ns.example.com", PermissionWrite); err != nil {
+		t.Errorf("Expected the write to be allowed, got %v", err)
+	}
+
+	if err := node.authorizeKey(authorized, "app.config", PermissionWrite); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected the write to be denied, got %v", err)
+	}
+
+	md = metadata.Pairs("authorization", "Bearer wrong-token")
+	if _, err := node.authorize(metadata.NewIncomingContext(context.Background(), md), "/protos.KVService/Get"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected an invalid token to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,667 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Administration endpoints of the client HTTP server, used by cmd/raftctl:
+
+	GET  /admin/status           state of the replica, as seen by itself: its indices, the replication to
+	                             the other members (on the leader) and the statistics of its store
+	GET  /admin/diagnostics      a diagnostics bundle of the replica, see diagnostics.go
+	GET  /admin/members          members of the latest configuration known to the replica
+	POST /admin/members          add a member (id, address, client_address) to the cluster
+	DELETE /admin/members/{id}   remove a member from the cluster (force=true skips the safety checks)
+	GET  /admin/snapshot         the persisted form of the replica's key-value store, followed by the client sessions
+	GET  /admin/backup           a consistent backup of the cluster, from the leader, see backup.go
+	GET  /admin/digest           the digest of the replica's key-value store, see kv_store/digest.go
+	GET  /admin/alarms           the raised alarms, see alarms.go
+	DELETE /admin/alarms         disarm the alarms (of member, of type), see alarms.go
+	POST /admin/transfer-leader  hand leadership over to another member (to)
+*/
+
+// Time allowed for the target of a leadership transfer to catch up and win the election.
+const leaderTransferTimeout = 2 * time.Second
+
+// Response of the /admin/status endpoint.
+type Status struct {
+	Id            int32    `json:"id"`
+	State         string   `json:"state"`
+	Term          int32    `json:"term"`
+	LeaderId      int32    `json:"leader_id"`
+	LeaderAddress string   `json:"leader_address"`
+	CommitIndex   int32    `json:"commit_index"`
+	LastApplied   int32    `json:"last_applied"`
+	LogLength     int      `json:"log_length"`
+	SnapshotIndex int32    `json:"snapshot_index"` // Applied index of the latest snapshot taken of the store, -1 if none
+	Members       []Member `json:"members"`
+	ClusterID     string   `json:"cluster_id,omitempty"` // See cluster_id.go
+
+	Peers     []PeerStatus   `json:"peers,omitempty"` // Replication to the other members, only on the leader
+	Store     *StoreStatus   `json:"store,omitempty"` // Nil if the local key-value store didn't respond
+	Resources *ResourceUsage `json:"resources"`       // See resources.go
+	Alarms    []Alarm        `json:"alarms"`          // Raised alarms of all the members, see alarms.go
+	ReadOnly  bool           `json:"read_only"`       // Whether the writes of the clients are rejected, see readonly.go
+
+	Decommissions []Decommission `json:"decommissions,omitempty"` // Progress of the decommissions of members, see decommission.go
+}
+
+// The replication of the log to a member, as tracked by the leader.
+type PeerStatus struct {
+	Id          int32      `json:"id"`
+	NextIndex   int32      `json:"next_index"`             // Index of the next entry to send to the member
+	MatchIndex  int32      `json:"match_index"`            // Highest index known to be replicated on the member
+	LastContact *time.Time `json:"last_contact,omitempty"` // Time of its latest AppendEntries response, nil if none yet
+	Healthy     bool       `json:"healthy"`                // Whether it responded recently, see membership.go
+	Reachable   bool       `json:"reachable"`              // Whether the latest RPCs didn't all fail, see peers.go
+	Failures    int        `json:"failures,omitempty"`     // Consecutive failed RPCs
+	LastSuccess *time.Time `json:"last_success,omitempty"` // Time of its latest successful RPC of any kind, nil if none yet
+}
+
+// The statistics of the local key-value store.
+type StoreStatus struct {
+	Backend string `json:"backend"` // See kv_store/backend.go
+	kv_store.Usage
+}
+
+// Response of the /admin/digest endpoint, also describing the snapshots returned by /admin/snapshot.
+type SnapshotDigest struct {
+	AppliedIndex int32  `json:"applied_index"`
+	Term         int32  `json:"term"`
+	Revision     int64  `json:"revision"`             // Revision of the key-value store
+	Digest       string `json:"digest"`               // Hex encoded SHA-256 hash of the state of the key-value store
+	ClusterID    string `json:"cluster_id,omitempty"` // Cluster the state belongs to, see cluster_id.go
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(v)
+}
+
+// Handle status requests.
+func (node *RaftNode) StatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.GetRLock("Status Handler")
+	status := node.status()
+	node.ReleaseRLock("Status Handler")
+
+	store, ok := node.storeUsage()
+	if ok {
+		status.Store = &StoreStatus{Backend: node.Meta.Config.StoreBackend, Usage: store}
+	}
+
+	usage := node.resourceUsageOf(store)
+	status.Resources, status.Alarms = &usage, node.Meta.alarms.List()
+	status.ReadOnly = node.readOnly()
+	status.Decommissions, _ = node.decommissions()
+
+	writeJSON(w, http.StatusOK, status)
+
+}
+
+// Return the status of the replica, without its store, resources and alarms. Must be called with
+// the read lock held.
+func (node *RaftNode) status() Status {
+
+	status := Status{
+		Id:            node.Meta.replica_id,
+		State:         node.state.String(),
+		Term:          node.currentTerm,
+		LeaderId:      node.Meta.leader_id,
+		LeaderAddress: node.Meta.leaderAddress,
+		CommitIndex:   node.commitIndex,
+		LastApplied:   node.lastApplied,
+		LogLength:     len(node.log),
+		SnapshotIndex: atomic.LoadInt32(&node.snapshotIndex),
+		Members:       node.Meta.members,
+		ClusterID:     node.clusterID(),
+	}
+
+	if node.state != Leader {
+		return status
+	}
+
+	for _, m := range node.Meta.members {
+
+		if m.Id == node.Meta.replica_id || int(m.Id) >= len(node.matchIndex) {
+			continue
+		}
+
+		peer := PeerStatus{Id: m.Id, NextIndex: node.nextIndex[m.Id], MatchIndex: node.matchIndex[m.Id], Healthy: node.healthy(m.Id), Reachable: !node.unreachable(m.Id)}
+
+		if contact, ok := node.last_contact[m.Id]; ok {
+			peer.LastContact = &contact
+		}
+
+		failures, success := node.peerRPCs(m.Id)
+		if peer.Failures = failures; !success.IsZero() {
+			peer.LastSuccess = &success
+		}
+
+		status.Peers = append(status.Peers, peer)
+	}
+
+	return status
+}
+
+// Handle requests listing the members of the cluster.
+func (node *RaftNode) MembersHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.GetRLock("Members Handler")
+	members := node.Meta.members
+	node.ReleaseRLock("Members Handler")
+
+	writeJSON(w, http.StatusOK, members)
+
+}
+
+/*
+Handle requests adding a member to the cluster. The new replica must already be running, started
+with its own ID and the size of the current cluster (so that it doesn't consider itself a member).
+The addresses default to the ones derived from its ID. The addition is refused if it leaves a quorum
+of the voters in a single failure domain (see checkPlacement), unless forced with force_placement=true.
+*/
+func (node *RaftNode) AddMemberHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("ADD MEMBER request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil || id < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid replica ID: %v", r.FormValue("id"))
+		return
+	}
+
+	member := groupMember(node.group(), int32(id))
+
+	// The replicas of a cluster serving a single port are reached at their client address, see portmux.go
+	if node.Meta.Config.SinglePort {
+		member.Address = member.ClientAddress
+	}
+
+	if address := r.FormValue("address"); address != "" {
+		member.Address = address
+	}
+
+	if address := r.FormValue("client_address"); address != "" {
+		member.ClientAddress = address
+	}
+
+	member.Witness = r.FormValue("witness") == "true"
+	member.ConsensusOnly = r.FormValue("consensus_only") == "true"
+
+	domain, err := ParseFailureDomain(r.FormValue("domain"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+	member.Domain = domain.String()
+
+	forcePlacement, _ := strconv.ParseBool(r.FormValue("force_placement"))
+
+	if err := node.checkJoiningReplica(r.Context(), member.ClientAddress); err != nil {
+		writeError(w, http.StatusConflict, "Error: %v", err)
+		return
+	}
+
+	node.GetRLock("Add Member Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Add Member Handler")
+		return
+	}
+
+	change := func() ([]Member, error) {
+
+		members, err := node.withMember(member)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkPlacement(members, forcePlacement); err != nil {
+			return nil, fmt.Errorf("adding replica %v is unsafe: %v. Use force_placement=true to add it anyway", id, err)
+		}
+
+		return members, nil
+	}
+
+	members, err := node.proposeConfig(r.Context(), change) // releases the lock
+	if err == nil {
+		node.logger().Info().Int32("member_id", member.Id).Str("address", member.Address).Msg("Replica added to the cluster")
+		writeJSON(w, http.StatusOK, members)
+	} else {
+		node.logger().Error().Err(err).Msg("Error occured in ADD MEMBER request")
+		node.writeProposalError(w, "ADD MEMBER", err)
+	}
+
+}
+
+/*
+Handle requests changing the addresses of a member, e.g. after an IP change, or its failure domain,
+through a configuration with the same members (see membership.go). The replica is expected to serve
+at its new addresses already: the other members dial the new gRPC address once they switch to the
+configuration. A new domain is checked as in AddMemberHandler, unless forced with force_placement=true.
+*/
+func (node *RaftNode) UpdateMemberHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("UPDATE MEMBER request received")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid replica ID: %v", mux.Vars(r)["id"])
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	address, clientAddress := r.FormValue("address"), r.FormValue("client_address")
+	if address == "" && clientAddress == "" && r.FormValue("domain") == "" {
+		writeError(w, http.StatusBadRequest, "Expected an address, a client_address or a domain")
+		return
+	}
+
+	domain, err := ParseFailureDomain(r.FormValue("domain"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+
+	forcePlacement, _ := strconv.ParseBool(r.FormValue("force_placement"))
+
+	node.GetRLock("Update Member Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Update Member Handler")
+		return
+	}
+
+	members, err := node.withAddresses(int32(id), address, clientAddress, domain.String())
+	if err != nil {
+		writeError(w, http.StatusConflict, "Error: %v", err)
+		node.ReleaseRLock("Update Member Handler")
+		return
+	}
+
+	if sameMembers(members, node.Meta.members) {
+		node.ReleaseRLock("Update Member Handler")
+		writeJSON(w, http.StatusOK, members)
+		return
+	}
+
+	change := func() ([]Member, error) {
+
+		members, err := node.withAddresses(int32(id), address, clientAddress, domain.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkPlacement(members, forcePlacement); err != nil {
+			return nil, fmt.Errorf("updating replica %v is unsafe: %v. Use force_placement=true to update it anyway", id, err)
+		}
+
+		return members, nil
+	}
+
+	members, err = node.proposeConfig(r.Context(), change) // releases the lock
+	if err == nil {
+		node.logger().Info().Int("member_id", id).Str("address", address).Str("client_address", clientAddress).Str("domain", domain.String()).Msg("Replica addresses changed")
+		writeJSON(w, http.StatusOK, members)
+	} else {
+		node.logger().Error().Err(err).Msg("Error occured in UPDATE MEMBER request")
+		node.writeProposalError(w, "UPDATE MEMBER", err)
+	}
+
+}
+
+/*
+Handle requests removing a member from the cluster. The removal is refused if the remaining members
+could lose committed entries or fail to form a quorum (see checkRemoval in membership.go), unless
+forced with force=true, or if it leaves a quorum of the voters in a single failure domain (see
+checkPlacement), unless forced with force_placement=true. The leader can't be removed, its leadership
+must be transferred first.
+*/
+func (node *RaftNode) RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("REMOVE MEMBER request received")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid replica ID: %v", mux.Vars(r)["id"])
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.FormValue("force"))
+	forcePlacement, _ := strconv.ParseBool(r.FormValue("force_placement"))
+
+	node.GetRLock("Remove Member Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Remove Member Handler")
+		return
+	}
+
+	var unsafe error // Why the removal is unsafe, if forced with force=true
+
+	change := func() ([]Member, error) {
+
+		members, err := node.withoutMember(int32(id))
+		if err != nil {
+			return nil, err
+		}
+
+		if unsafe = node.checkRemoval(int32(id), members); unsafe != nil && !force {
+			return nil, fmt.Errorf("removing replica %v is unsafe: %v. Use force=true to remove it anyway", id, unsafe)
+		}
+
+		if err := checkPlacement(members, forcePlacement); err != nil {
+			return nil, fmt.Errorf("removing replica %v is unsafe: %v. Use force_placement=true to remove it anyway", id, err)
+		}
+
+		return members, nil
+	}
+
+	members, err := node.proposeConfig(r.Context(), change) // releases the lock
+	if err == nil {
+
+		if unsafe != nil {
+			node.logger().Warn().Err(unsafe).Int("member_id", id).Msg("Forced the removal of the replica")
+		}
+
+		node.logger().Info().Int("member_id", id).Msg("Replica removed from the cluster")
+		writeJSON(w, http.StatusOK, members)
+	} else {
+		node.logger().Error().Err(err).Msg("Error occured in REMOVE MEMBER request")
+		node.writeProposalError(w, "REMOVE MEMBER", err)
+	}
+
+}
+
+// Handle snapshot requests, relaying the persisted form of the local key-value store once all
+// the committed entries have been applied to it, followed by the client sessions (see sessions.go).
+// The snapshot is read under the lock, then sent at the rate the client writes allow (see throttle.go).
+func (node *RaftNode) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("SNAPSHOT request received")
+
+	node.GetRLock("Snapshot Handler")
+
+	if node.isWitness() {
+		node.ReleaseRLock("Snapshot Handler")
+		writeError(w, http.StatusConflict, "Error: %v", errWitness)
+		return
+	}
+
+	for node.commitIndex != node.lastApplied {
+		node.ReleaseRLock("Snapshot Handler")
+		time.Sleep(20 * time.Millisecond)
+		node.GetRLock("Snapshot Handler")
+	}
+
+	snapshot, digest, err := node.snapshot()
+	if err != nil {
+		node.ReleaseRLock("Snapshot Handler")
+		writeError(w, http.StatusServiceUnavailable, "Snapshot failed with error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Connection", "close")
+	w.Header().Set("X-Raft-Applied-Index", strconv.Itoa(int(node.lastApplied)))
+	w.Header().Set("X-Raft-Term", strconv.Itoa(int(node.currentTerm)))
+	w.Header().Set("X-Store-Revision", strconv.FormatInt(digest.Revision, 10))
+	w.Header().Set("X-Store-Digest", digest.Digest)
+	w.Header().Set("X-Cluster-Id", node.clusterID())
+
+	node.ReleaseRLock("Snapshot Handler")
+
+	w.WriteHeader(http.StatusOK)
+
+	throttled, done := node.Meta.snapshots.writer(r.Context(), requestHost(r), w)
+	defer done()
+
+	snapshot.WriteTo(throttled)
+
+}
+
+// Return the snapshot of the local key-value store followed by the client sessions, along with
+// the digest of the store. Must be called with the read lock held.
+func (node *RaftNode) snapshot() (*bytes.Buffer, kv_store.Digest, error) {
+
+	contents, digest, err := node.stateMachine().Snapshot()
+	if err != nil {
+		return nil, digest, err
+	}
+
+	snapshot := bytes.NewBuffer(contents)
+
+	// Reported in the status, the lock being only read held.
+	atomic.StoreInt32(&node.snapshotIndex, node.lastApplied)
+
+	// The sessions match the store, as no entry can be applied while the lock is held.
+	if err := encodeSessions(snapshot, node.sessions); err != nil {
+		node.logger().Error().Err(err).Msg("Unable to add the client sessions to the snapshot")
+	}
+
+	return snapshot, digest, nil
+}
+
+// Handle digest requests, returning the digest of the local key-value store once all the
+// committed entries have been applied to it, along with the index it was computed at.
+func (node *RaftNode) DigestHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("DIGEST request received")
+
+	node.GetRLock("Digest Handler")
+	defer node.ReleaseRLock("Digest Handler")
+
+	if node.isWitness() {
+		writeError(w, http.StatusConflict, "Error: %v", errWitness)
+		return
+	}
+
+	for node.commitIndex != node.lastApplied {
+		node.ReleaseRLock("Digest Handler")
+		time.Sleep(20 * time.Millisecond)
+		node.GetRLock("Digest Handler")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost%s/admin/digest", node.Meta.kvstore_addr))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Digest failed with error: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var digest kv_store.Digest
+	if err := json.NewDecoder(resp.Body).Decode(&digest); err != nil {
+		writeError(w, http.StatusInternalServerError, "Invalid digest from the key-value store: %v", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SnapshotDigest{
+		AppliedIndex: node.lastApplied,
+		Term:         node.currentTerm,
+		Revision:     digest.Revision,
+		Digest:       digest.Digest,
+		ClusterID:    node.clusterID(),
+	})
+
+}
+
+/*
+Handle leadership transfer requests, as described in section 3.10 of the Raft dissertation. Writes
+are rejected while the transfer is in progress; once the target has caught up with the log, it's
+told to start an election right away, which it wins before the other replicas time out. Without a
+target, the most up to date member is chosen.
+*/
+func (node *RaftNode) TransferLeaderHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("TRANSFER LEADER request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	node.GetLock("Transfer Leader Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseLock("Transfer Leader Handler")
+		return
+	}
+
+	if node.transferring {
+		writeError(w, http.StatusConflict, "Error: A leadership transfer is already in progress.")
+		node.ReleaseLock("Transfer Leader Handler")
+		return
+	}
+
+	target := int32(-1)
+
+	if to := r.FormValue("to"); to != "" {
+
+		id, err := strconv.Atoi(to)
+		if _, ok := node.member(int32(id)); err != nil || !ok || int32(id) == node.Meta.replica_id {
+			writeError(w, http.StatusBadRequest, "Invalid target: %v is not another member of the cluster", to)
+			node.ReleaseLock("Transfer Leader Handler")
+			return
+		}
+
+		if m, _ := node.member(int32(id)); m.Witness || m.Learner {
+			writeError(w, http.StatusBadRequest, "Invalid target: %v is a witness or a learner, which can't lead", to)
+			node.ReleaseLock("Transfer Leader Handler")
+			return
+		}
+
+		target = int32(id)
+
+	} else if target = node.transferTarget(); target == -1 {
+		writeError(w, http.StatusConflict, "Error: The cluster has no other member to transfer leadership to.")
+		node.ReleaseLock("Transfer Leader Handler")
+		return
+	}
+
+	node.transferring = true
+	term := node.currentTerm
+
+	node.ReleaseLock("Transfer Leader Handler")
+
+	defer func() {
+		node.GetLock("Transfer Leader Handler")
+		node.transferring = false
+		node.ReleaseLock("Transfer Leader Handler")
+	}()
+
+	if err := node.transferLeadership(r.Context(), target, term); err != nil {
+		node.logger().Error().Err(err).Int32("target", target).Msg("Error occured in TRANSFER LEADER request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in TRANSFER LEADER request: %v", err)
+		return
+	}
+
+	node.logger().Info().Int32("target", target).Msg("Leadership transferred")
+	writeJSON(w, http.StatusOK, map[string]int32{"leader_id": target})
+
+}
+
+// Return the most up to date member that can lead, other than this replica, -1 if there is none. Must be
+// called on the leader with the (read) lock held.
+func (node *RaftNode) transferTarget() int32 {
+
+	target := int32(-1)
+
+	for _, m := range node.Meta.members {
+		if m.Id != node.Meta.replica_id && !m.Witness && !m.Learner && (target == -1 || node.matchIndex[m.Id] > node.matchIndex[target]) {
+			target = m.Id
+		}
+	}
+
+	return target
+}
+
+// Wait for the target to catch up with the log, tell it to start an election, and wait for this replica to step down.
+func (node *RaftNode) transferLeadership(ctx context.Context, target int32, term int32) error {
+
+	ctx, cancel := context.WithTimeout(ctx, leaderTransferTimeout)
+	defer cancel()
+
+	var client Transport
+
+	// Wait for the target to catch up, the leader sends it heartbeats every 50ms (see send_AEs.go).
+	for {
+
+		node.GetRLock("transferLeadership1")
+		state, caught_up := node.state, node.matchIndex[target] >= node.lastLogIndex()
+		client = node.Meta.peer_replica_clients[target]
+		node.ReleaseRLock("transferLeadership1")
+
+		if state != Leader {
+			return fmt.Errorf("no longer the leader")
+		}
+
+		if caught_up && client != nil {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("replica %v did not catch up with the log: %v", target, ctx.Err())
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	response, err := client.SendTimeoutNow(ctx, &protos.TimeoutNowMessage{Term: term, LeaderId: node.Meta.replica_id})
+	node.recordPeerRPC(target, "TimeoutNow", err)
+	if err != nil {
+		return err
+	}
+
+	if !response.Success {
+		return fmt.Errorf("replica %v refused to start an election in term %v", target, response.Term)
+	}
+
+	// This replica steps down once it sees the target's higher term.
+	for {
+
+		node.GetRLock("transferLeadership2")
+		state, leader_id := node.state, node.Meta.leader_id
+		node.ReleaseRLock("transferLeadership2")
+
+		if state != Leader && leader_id == target {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("replica %v did not become the leader: %v", target, ctx.Err())
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+}
@@ -0,0 +1,89 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the status of the leader reports the replication
+ * to each of the other members, that the status of a follower doesn't, and
+ * that both report the latest snapshot and the statistics of their store.
+ */
+func TestStatus(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(`{"success": [{"type": "PUT", "key": "a", "value": "1"}, {"type": "PUT", "key": "b", "value": "2"}]}`)))
+
+	start := time.Unix(100, 0)
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), alarms: NewAlarms(), Config: DefaultConfig(), clock: NewManualClock(start)}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.raft_persistence_file = filepath.Join(dir, "raft")
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+
+	node.state, node.currentTerm, node.commitIndex, node.lastApplied, node.snapshotIndex = Leader, 2, 1, 1, -1
+	node.log = []protos.LogEntry{{Term: 2, Operation: []string{"NO-OP"}}, {Term: 2, Operation: []string{"TXN", "{}"}}}
+	node.nextIndex, node.matchIndex = []int32{2, 2, 1}, []int32{0, 1, 0}
+	node.last_contact = map[int32]time.Time{1: start.Add(-100 * time.Millisecond)}
+
+	status := func() Status {
+
+		w := httptest.NewRecorder()
+		node.StatusHandler(w, httptest.NewRequest("GET", "/admin/status", nil))
+
+		var s Status
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatalf("Invalid status %v: %v", w.Body.String(), err)
+		}
+
+		return s
+	}
+
+	s := status()
+
+	if len(s.Peers) != 2 || s.Peers[0].Id != 1 || s.Peers[0].MatchIndex != 1 || !s.Peers[0].Healthy || s.Peers[0].LastContact == nil || !s.Peers[0].LastContact.Equal(start.Add(-100*time.Millisecond)) {
+		t.Errorf("Expected the replication to member 1 to be reported, got %+v", s.Peers)
+	}
+
+	if len(s.Peers) == 2 && (s.Peers[1].Id != 2 || s.Peers[1].NextIndex != 1 || s.Peers[1].Healthy || s.Peers[1].LastContact != nil) {
+		t.Errorf("Expected member 2 to be reported without any contact, got %+v", s.Peers[1])
+	}
+
+	if s.SnapshotIndex != -1 {
+		t.Errorf("Expected no snapshot to be reported, got %v", s.SnapshotIndex)
+	}
+
+	if s.Store == nil || s.Store.Backend != kv_store.BackendMap || s.Store.Keys != 2 || s.Store.Revision != 1 {
+		t.Errorf("Expected the statistics of the store, got %+v", s.Store)
+	}
+
+	if _, _, err := node.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	node.state = Follower
+
+	if s := status(); s.Peers != nil || s.SnapshotIndex != 1 {
+		t.Errorf("Expected a follower to report its snapshot at index 1 and no peers, got %+v", s)
+	}
+}
@@ -0,0 +1,160 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Admission control of the client writes, so that a leader unable to commit as fast as it is written to
+pushes back on its clients rather than piling up goroutines and memory. The proposals of the leader
+form a bounded queue: a proposal enters it once its checks passed (see proposeSessionCommand), waiting
+for the previous writes to be applied, and leaves it once committed or failed, asynchronous writes
+included. The leader admits no new writes while:
+
+	the queue holds MaxPendingProposals proposals
+	the quorum of followers lags more than MaxFollowerLag entries behind its log, i.e. the latest
+	entry held by a majority of the members is that far behind its last entry
+
+Writes are checked on admission, after the load shedding of shedding.go: HTTP writes are rejected
+with 429 Too Many Requests and KVService writes with an UNAVAILABLE status, both with a Retry-After
+hint (the retry-after trailer for gRPC). A write admitted while the queue filled up is rejected by
+proposeSessionCommand instead. The queue is reported in the raft_pending_proposals gauge, and the
+rejections in write_backpressure_total{reason}, with the backpressure reason of /admin/rejections.
+A limit of 0 or less disables the check.
+*/
+
+const backpressureRetryAfter = time.Second // Time after which the clients are told to retry
+
+var errProposalQueueFull = errors.New("too many writes pending, retry later")
+
+// The proposals pending on the leader, safe for concurrent use. The zero value is empty.
+type proposalQueue struct {
+	pending int64 // Accessed atomically
+}
+
+// Whether the operation is a write of a client, rather than one proposed by the replicas.
+func clientWrite(operation []string) bool {
+
+	switch operation[0] {
+	case "POST", "PUT", "DELETE", "TXN", "DELETE_PREFIX":
+		return true
+	}
+
+	return false
+}
+
+// Enter the queue, unless it is full and enforce is set. The proposal must leave it with leaveQueue.
+func (node *RaftNode) enterQueue(enforce bool) error {
+
+	depth := int64(node.Meta.Config.MaxPendingProposals)
+
+	if pending := atomic.AddInt64(&node.proposals.pending, 1); enforce && depth > 0 && pending > depth {
+		atomic.AddInt64(&node.proposals.pending, -1)
+		node.Meta.metrics.Add("write_backpressure_total", 1, "reason", "queue")
+		return errProposalQueueFull
+	}
+
+	node.Meta.metrics.Add("raft_pending_proposals", 1)
+	return nil
+}
+
+func (node *RaftNode) leaveQueue() {
+	atomic.AddInt64(&node.proposals.pending, -1)
+	node.Meta.metrics.Add("raft_pending_proposals", -1)
+}
+
+// Return the number of entries of the log that a majority of the voters doesn't hold yet. Must be
+// called on the leader with the (read) lock held.
+func (node *RaftNode) quorumLag() int32 {
+
+	last := node.lastLogIndex()
+
+	var held []int32
+	for _, m := range voters(node.Meta.members) {
+
+		switch {
+		case m.Id == node.Meta.replica_id:
+			held = append(held, last)
+		case int(m.Id) < len(node.matchIndex):
+			held = append(held, node.matchIndex[m.Id])
+		default:
+			held = append(held, -1)
+		}
+	}
+
+	if len(held) == 0 {
+		return 0
+	}
+
+	// The latest entry held by a majority is the quorum-th highest match index.
+	sort.Slice(held, func(i, j int) bool { return held[i] > held[j] })
+
+	return last - held[len(held)/2]
+}
+
+// Return why a new write can't be admitted by the replica, nil if it can.
+func (node *RaftNode) checkAdmission() error {
+
+	if depth := node.Meta.Config.MaxPendingProposals; depth > 0 && atomic.LoadInt64(&node.proposals.pending) >= int64(depth) {
+		node.Meta.metrics.Add("write_backpressure_total", 1, "reason", "queue")
+		return errProposalQueueFull
+	}
+
+	max := node.Meta.Config.MaxFollowerLag
+	if max <= 0 {
+		return nil
+	}
+
+	node.GetRLock("Admission")
+	defer node.ReleaseRLock("Admission")
+
+	// The followers reject the writes anyway.
+	if node.state != Leader {
+		return nil
+	}
+
+	if lag := node.quorumLag(); lag > max {
+		node.Meta.metrics.Add("write_backpressure_total", 1, "reason", "lag")
+		return fmt.Errorf("the followers lag %v entries behind the leader, at most %v are allowed, retry later", lag, max)
+	}
+
+	return nil
+}
+
+// Reject the HTTP write with 429 Too Many Requests if it can't be admitted, returning whether it was.
+func (node *RaftNode) admitHTTPWrite(w http.ResponseWriter, r *http.Request) bool {
+
+	err := node.checkAdmission()
+	if err == nil {
+		return true
+	}
+
+	node.rejectRequest(rejectBackpressure, r, err)
+	w.Header().Set("Retry-After", strconv.Itoa(int(backpressureRetryAfter/time.Second)))
+	writeError(w, http.StatusTooManyRequests, "Error: %v.", err)
+	return false
+}
+
+// Return the UNAVAILABLE status of the KVService write if it can't be admitted, nil if it can.
+func (node *RaftNode) admitRPCWrite(ctx context.Context, method string) error {
+
+	err := node.checkAdmission()
+	if err == nil {
+		return nil
+	}
+
+	grpc.SetTrailer(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(backpressureRetryAfter/time.Second))))
+	return node.reject(rejectBackpressure, method, "", "", status.Error(codes.Unavailable, err.Error()))
+}
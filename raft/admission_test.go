@@ -0,0 +1,98 @@
+package raft
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the leader rejects new client writes with 429
+ * and a Retry-After hint once its proposal queue is full or its followers
+ * lag too far behind, that the proposals of the replicas are always queued,
+ * and that the writes are admitted again once the backlog is gone.
+ */
+func TestWriteBackpressure(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), rejections: NewRejections(), shedder: &loadShedder{}, Config: DefaultConfig(), clock: NewManualClock(time.Unix(100, 0))}}
+	node.Meta.Config.MaxPendingProposals = 2
+	node.Meta.Config.MaxFollowerLag = 5
+
+	node.state = Leader
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.log = make([]protos.LogEntry, 20)
+	node.matchIndex = []int32{0, 19, 19}
+
+	written := 0
+	handler := node.sheddingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		written++
+	}))
+
+	write := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/key", nil))
+		return w
+	}
+
+	if w := write(); w.Code != http.StatusOK || written != 1 {
+		t.Fatalf("Expected a write to be admitted by an idle leader, got %v", w.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := node.enterQueue(true); err != nil {
+			t.Fatalf("Expected proposal %v to be queued: %v", i, err)
+		}
+	}
+
+	if err := node.enterQueue(true); err != errProposalQueueFull {
+		t.Errorf("Expected a client write to be refused by a full queue, got %v", err)
+	}
+
+	if err := node.enterQueue(false); err != nil {
+		t.Errorf("Expected the proposals of the replicas to be queued regardless: %v", err)
+	}
+
+	if w := write(); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" || written != 1 {
+		t.Errorf("Expected a write to be rejected with 429 and a Retry-After hint, got %v %v", w.Code, w.Header())
+	}
+
+	if err := node.admitRPCWrite(context.Background(), "/protos.KVService/Put"); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected a KVService write to be UNAVAILABLE, got %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		node.leaveQueue()
+	}
+
+	// A majority of the members only holds the log up to index 8.
+	node.matchIndex = []int32{0, 3, 8}
+
+	if lag := node.quorumLag(); lag != 11 {
+		t.Errorf("Expected the quorum to lag 11 entries behind, got %v", lag)
+	}
+
+	if w := write(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a write to be rejected while the followers lag behind, got %v", w.Code)
+	}
+
+	// The lagging follower alone doesn't hold up the writes.
+	node.matchIndex = []int32{0, 3, 16}
+
+	if w := write(); w.Code != http.StatusOK || written != 2 {
+		t.Errorf("Expected a write to be admitted once the quorum caught up, got %v", w.Code)
+	}
+
+	if got := node.Meta.metrics.Get("write_backpressure_total", "reason", "queue"); got != 3 {
+		t.Errorf("Expected 3 writes to be rejected by the queue, got %v", got)
+	}
+
+	if got := node.Meta.metrics.Get("proposals_rejected_total", "reason", rejectBackpressure); got != 3 {
+		t.Errorf("Expected 3 backpressure rejections to be recorded, got %v", got)
+	}
+}
@@ -0,0 +1,347 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Alarms raised when a member uses more resources than its hard limits (see resources.go), like the
+NOSPACE alarm of etcd:
+
+	NOSPACE   the disk usage of the member exceeds max_disk_bytes
+	NOMEMORY  the memory usage of the member exceeds max_memory_bytes
+
+The leader checks the usage of every member (from its /admin/metrics) every alarmCheckInterval, and
+raises an alarm through an "ALARM" log entry, which stores it under the reserved AlarmsPrefix so that
+every replica agrees on the alarms and keeps them across restarts. While any alarm is raised, the
+writes adding data (POST, PUT, and transactions with a PUT) are rejected with the alarm reason;
+deletes and compactions, which free space, are still accepted. An alarm stays raised until an admin
+disarms it with DELETE /admin/alarms, and is raised again by the next check if the member still
+exceeds the limit.
+*/
+
+const (
+	AlarmsPrefix       = "_alarms:" // Keys holding the raised alarms, by member and type
+	AlarmNoSpace       = "NOSPACE"
+	AlarmNoMemory      = "NOMEMORY"
+	alarmCheckInterval = 10 * time.Second
+	alarmAuthor        = "alarms" // Client of the alarms raised by the leader
+)
+
+var errAlarmRaised = errors.New("an alarm is raised (see /admin/alarms), writes adding data are rejected until it is disarmed")
+
+// A raised alarm, as listed by /admin/alarms.
+type Alarm struct {
+	Member int32     `json:"member"` // Replica exceeding the limit
+	Type   string    `json:"type"`
+	Usage  int64     `json:"usage"` // Bytes used when the alarm was raised
+	Limit  int64     `json:"limit"`
+	Time   time.Time `json:"time"`
+}
+
+func (a Alarm) name() string {
+	return fmt.Sprintf("%v:%v", a.Member, a.Type)
+}
+
+// The alarms applied by the replica, safe for concurrent use. A nil *Alarms holds no alarm.
+type Alarms struct {
+	mu     sync.RWMutex
+	alarms map[string]Alarm
+}
+
+func NewAlarms() *Alarms {
+	return &Alarms{alarms: make(map[string]Alarm)}
+}
+
+// Forget the alarms, before they are loaded again from the store.
+func (a *Alarms) reset() {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.alarms = make(map[string]Alarm)
+}
+
+// Raise the alarm with the given name, or disarm it if alarm is nil.
+func (a *Alarms) apply(name string, alarm *Alarm) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if alarm == nil {
+		delete(a.alarms, name)
+	} else {
+		a.alarms[name] = *alarm
+	}
+}
+
+// Return the raised alarms, by member and type.
+func (a *Alarms) List() []Alarm {
+
+	if a == nil {
+		return nil
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	alarms := make([]Alarm, 0, len(a.alarms))
+	for _, alarm := range a.alarms {
+		alarms = append(alarms, alarm)
+	}
+
+	sort.Slice(alarms, func(i, j int) bool { return alarms[i].name() < alarms[j].name() })
+
+	return alarms
+}
+
+// Whether the alarm of the given type is raised for the member.
+func (a *Alarms) raised(member int32, kind string) bool {
+
+	if a == nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	_, ok := a.alarms[Alarm{Member: member, Type: kind}.name()]
+	return ok
+}
+
+// Whether any alarm is raised.
+func (a *Alarms) any() bool {
+
+	if a == nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return len(a.alarms) > 0
+}
+
+/*
+Return the operation of the log entry raising (or disarming, if raise is false) an alarm. The entry
+disarming an alarm carries it too, so that disarming it again once raised again isn't rejected as a
+duplicate write.
+*/
+func alarmOperation(alarm Alarm, raise bool) []string {
+
+	record, _ := json.Marshal(alarm)
+
+	if !raise {
+		return []string{"ALARM", alarm.name(), string(record), "UNSET"}
+	}
+
+	return []string{"ALARM", alarm.name(), string(record), "SET"}
+}
+
+// Return the transaction applying the "ALARM" log entry to the key-value store, along with the
+// name and record (nil if disarmed) of the alarm.
+func alarmTxn(entry *protos.LogEntry) (kv_store.Txn, string, *Alarm) {
+
+	name := entry.Operation[1]
+
+	if entry.Operation[3] == "UNSET" {
+		return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: AlarmsPrefix + name}}}, name, nil
+	}
+
+	var alarm Alarm
+	json.Unmarshal([]byte(entry.Operation[2]), &alarm)
+
+	return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: AlarmsPrefix + name, Value: entry.Operation[2]}}}, name, &alarm
+}
+
+// Load the alarms persisted in the local key-value store.
+func (node *RaftNode) loadAlarms() {
+
+	kvs, err := node.scanLocalStore(AlarmsPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the alarms")
+		return
+	}
+
+	for _, kv := range kvs {
+
+		var alarm Alarm
+		if err := json.Unmarshal([]byte(kv.Value), &alarm); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid alarm record")
+			continue
+		}
+
+		node.Meta.alarms.apply(alarm.name(), &alarm)
+	}
+
+	if len(kvs) > 0 {
+		node.logger().Warn().Int("count", len(kvs)).Msg("Loaded raised alarms, writes adding data are rejected")
+	}
+}
+
+// Return errAlarmRaised if the operation adds data while an alarm is raised.
+func (node *RaftNode) checkAlarms(operation []string) error {
+
+	if !node.Meta.alarms.any() {
+		return nil
+	}
+
+	switch operation[0] {
+
+	case "POST", "PUT":
+		return errAlarmRaised
+
+	case "TXN":
+
+		var txn kv_store.Txn
+		if err := json.Unmarshal([]byte(operation[1]), &txn); err != nil {
+			return nil
+		}
+
+		for _, op := range append(append([]kv_store.Op{}, txn.Success...), txn.Failure...) {
+			if op.Type == kv_store.OpPut {
+				return errAlarmRaised
+			}
+		}
+
+	}
+
+	return nil
+}
+
+// Propose raising or disarming an alarm as its author, and wait for it to be applied.
+func (node *RaftNode) proposeAlarm(ctx context.Context, alarm Alarm, raise bool, author string) error {
+
+	node.GetRLock("Propose Alarm")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Propose Alarm")
+		return errNotLeader
+	}
+
+	index, success, err := node.proposeCommand(ctx, alarmOperation(alarm, raise), author) // releases the lock
+	if !success {
+		return err
+	}
+
+	return node.waitApplied(ctx, index)
+}
+
+// Job raising the alarms of the members exceeding their limits.
+func (node *RaftNode) alarmsJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "resource_alarms",
+		Interval: alarmCheckInterval,
+		Run: func(ctx context.Context) error {
+
+			memory, disk := node.resourceLimits()
+			limits := map[string]int64{AlarmNoMemory: memory, AlarmNoSpace: disk}
+			resources := map[string]string{AlarmNoMemory: "memory", AlarmNoSpace: "disk"}
+
+			node.GetRLock("Alarms Job")
+			members := append([]Member{}, node.Meta.members...)
+			node.ReleaseRLock("Alarms Job")
+
+			for _, m := range members {
+
+				series, err := node.memberMetrics(ctx, m)
+				if err != nil {
+					node.logger().Debug().Err(err).Int32("member_id", m.Id).Msg("Unable to fetch the metrics of a member")
+					continue
+				}
+
+				for kind, limit := range limits {
+
+					usage, ok := series[metricKey("resource_usage_bytes", []string{"resource", resources[kind]})]
+					if !ok || limit <= 0 || int64(usage) <= limit || node.Meta.alarms.raised(m.Id, kind) {
+						continue
+					}
+
+					alarm := Alarm{Member: m.Id, Type: kind, Usage: int64(usage), Limit: limit, Time: node.now()}
+					node.logger().Warn().Int32("member_id", m.Id).Str("type", kind).Int64("usage", alarm.Usage).Int64("limit", limit).Msg("Raising an alarm, writes adding data are rejected")
+
+					if err := node.proposeAlarm(ctx, alarm, true, alarmAuthor); err != nil {
+						return err
+					}
+
+					node.Meta.metrics.Add("alarms_raised_total", 1, "type", kind)
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// Handle requests listing the raised alarms, as applied by this replica.
+func (node *RaftNode) AlarmsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.alarms.List())
+}
+
+/*
+Handle requests disarming the alarms, of the form /admin/alarms?member=<id>&type=<type>: all the
+alarms match if neither is given. The response, listing the disarmed alarms, is sent once they are
+disarmed on the leader.
+*/
+func (node *RaftNode) DisarmAlarmsHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("DISARM request received")
+
+	member := int64(-1)
+	if s := r.FormValue("member"); s != "" {
+
+		var err error
+		if member, err = strconv.ParseInt(s, 10, 32); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid member: %q", s)
+			return
+		}
+	}
+
+	kind := r.FormValue("type")
+
+	author := ""
+	if u, ok := requestUser(r.Context()); ok {
+		author = u.Name
+	}
+
+	node.GetRLock("Disarm Alarms Handler")
+	leader, address := node.state == Leader, node.Meta.leaderAddress
+	node.ReleaseRLock("Disarm Alarms Handler")
+
+	if !leader {
+		writeNotLeader(w, address)
+		return
+	}
+
+	disarmed := make([]Alarm, 0)
+
+	for _, alarm := range node.Meta.alarms.List() {
+
+		if (member != -1 && alarm.Member != int32(member)) || (kind != "" && alarm.Type != kind) {
+			continue
+		}
+
+		if err := node.proposeAlarm(r.Context(), alarm, false, author); err != nil {
+			node.logger().Error().Err(err).Str("alarm", alarm.name()).Msg("Error occured in DISARM request")
+			writeError(w, http.StatusServiceUnavailable, "Error occured in DISARM request: %v", err)
+			return
+		}
+
+		node.logger().Info().Int32("member_id", alarm.Member).Str("type", alarm.Type).Str("author", author).Msg("Alarm disarmed")
+		disarmed = append(disarmed, alarm)
+	}
+
+	writeJSON(w, http.StatusOK, disarmed)
+}
@@ -0,0 +1,95 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that an "ALARM" log entry is applied as a write of a
+ * reserved key, and that while an alarm is raised the writes adding data are
+ * rejected, unlike those freeing space.
+ */
+func TestAlarms(t *testing.T) {
+
+	alarm := Alarm{Member: 1, Type: AlarmNoSpace, Usage: 120, Limit: 100, Time: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+
+	txn, name, record := alarmTxn(&protos.LogEntry{Operation: alarmOperation(alarm, true)})
+	if name != "1:NOSPACE" || record == nil || *record != alarm || txn.Success[0].Key != AlarmsPrefix+name || !reservedKey(txn.Success[0].Key) {
+		t.Fatalf("Unexpected transaction %+v raising the alarm %+v", txn, record)
+	}
+
+	txn, name, record = alarmTxn(&protos.LogEntry{Operation: alarmOperation(alarm, false)})
+	if record != nil || txn.Success[0].Type != kv_store.OpDelete || txn.Success[0].Key != AlarmsPrefix+name {
+		t.Fatalf("Unexpected transaction %+v disarming the alarm", txn)
+	}
+
+	// Disarming an alarm raised again isn't the same operation.
+	again := alarm
+	again.Time = alarm.Time.Add(time.Minute)
+	if reflect.DeepEqual(alarmOperation(alarm, false), alarmOperation(again, false)) {
+		t.Errorf("Expected the disarming entries of two raises to differ")
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms()}}
+	node.state = Leader
+
+	encode := func(ops ...kv_store.Op) string {
+		encoded, _ := json.Marshal(kv_store.Txn{Success: ops})
+		return string(encoded)
+	}
+
+	operations := []struct {
+		operation []string
+		adds      bool
+	}{
+		{[]string{"POST", "a", "1"}, true},
+		{[]string{"PUT", "a", "2"}, true},
+		{[]string{"DELETE", "a"}, false},
+		{[]string{"COMPACT", "10"}, false},
+		{[]string{"TXN", encode(kv_store.Op{Type: kv_store.OpDelete, Key: "a"}, kv_store.Op{Type: kv_store.OpPut, Key: "b", Value: "1"})}, true},
+		{[]string{"TXN", encode(kv_store.Op{Type: kv_store.OpDelete, Key: "a"})}, false},
+	}
+
+	for _, o := range operations {
+		if err := node.checkAlarms(o.operation); err != nil {
+			t.Errorf("Expected %v to be accepted without alarms, got %v", o.operation[0], err)
+		}
+	}
+
+	node.Meta.alarms.apply(alarm.name(), &alarm)
+
+	if !node.Meta.alarms.raised(1, AlarmNoSpace) || node.Meta.alarms.raised(1, AlarmNoMemory) || len(node.Meta.alarms.List()) != 1 {
+		t.Fatalf("Unexpected alarms %+v", node.Meta.alarms.List())
+	}
+
+	for _, o := range operations {
+		if err := node.checkAlarms(o.operation); (err == errAlarmRaised) != o.adds {
+			t.Errorf("Unexpected outcome of %v while an alarm is raised: %v", o.operation, err)
+		}
+	}
+
+	// The KVService rejects the writes with ResourceExhausted, journaling them.
+	put := kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: "a", Value: "1"}}}
+	if _, err := node.replicateTxn(context.Background(), put, "c", 0, 0); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the write to be rejected with ResourceExhausted, got %v", err)
+	}
+
+	if rejections := node.Meta.rejections.List(rejectAlarm, "", 0); len(rejections) != 1 || rejections[0].Operation != "TXN" {
+		t.Errorf("Expected the write to be journaled, got %+v", rejections)
+	}
+
+	node.Meta.alarms.apply(alarm.name(), nil)
+
+	if node.Meta.alarms.any() || node.checkAlarms([]string{"POST", "a", "1"}) != nil {
+		t.Errorf("Expected the writes to be accepted once the alarm is disarmed")
+	}
+}
@@ -0,0 +1,219 @@
+package raft
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+The answer cache of a replica, keeping the answers of the DNS lookups (see lookup.go) by view, name
+and type, so that the hot names are answered without reading the records of the store. It is enabled
+by the "answer_cache" section of the DNS config, holding the answers cached at most:
+
+	{"dns": {"answer_cache": {"size": 10000, "max_ttl": 60}, ...}}
+
+An answer is kept for the lowest TTL of its records as clamped for its zone (see ttls.go), that of
+the negative caching for NXDOMAIN and NODATA (RFC 2308), and max_ttl seconds at most
+(answerCacheMaxTTL by default). The answers whose records depend on the region of the resolver (see
+geo.go) or on a response policy (see policies.go) aren't cached. As the answers of a name depend on
+the records of other names (its ancestors, the wildcards and the targets of the CNAME records), every
+change of the records applied by the replica, or of the settings (e.g. the delegations or the routes
+of the shards), forgets all the answers cached, along with those of the replicas of the other groups
+hosted by the process. A full cache forgets its expired answers, or else any answer, to make room
+for the next.
+
+The lookups are counted in dns_answer_cache_total{view, outcome}, the outcome being hit or miss.
+*/
+
+const answerCacheMaxTTL = 300 // Seconds an answer is cached at most, by default
+
+// The answer cache of the DNS config.
+type DNSAnswerCache struct {
+	Size   int `json:"size"`    // Answers cached at most, the cache being disabled if 0
+	MaxTTL int `json:"max_ttl"` // Seconds an answer is cached at most, answerCacheMaxTTL if 0
+}
+
+func (c DNSAnswerCache) validate() error {
+
+	if c.Size < 0 || c.MaxTTL < 0 {
+		return fmt.Errorf("dns: answer_cache: expected a non-negative size and max_ttl, got %v and %v", c.Size, c.MaxTTL)
+	}
+
+	return nil
+}
+
+// The answers cached by a replica. The zero value is empty.
+type answerCache struct {
+	mu         sync.Mutex
+	entries    map[string]cachedAnswer
+	generation uint64 // Incremented by every flush
+}
+
+type cachedAnswer struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// Return a copy of the answer cached under the key, nil if none is, and the generation of the cache.
+func (c *answerCache) get(key string, now time.Time) (*dns.Msg, uint64) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return nil, c.generation
+	}
+
+	return entry.msg.Copy(), c.generation
+}
+
+// Cache a copy of the answer under the key, unless the cache was flushed since the generation.
+func (c *answerCache) put(key string, msg *dns.Msg, generation uint64, now time.Time, config DNSAnswerCache) {
+
+	ttl, ok := answerTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	max := config.MaxTTL
+	if max == 0 {
+		max = answerCacheMaxTTL
+	}
+
+	if ttl > uint32(max) {
+		ttl = uint32(max)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[string]cachedAnswer)
+	}
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= config.Size {
+
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+
+		for k := range c.entries {
+			if len(c.entries) < config.Size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cachedAnswer{msg: msg.Copy(), expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// Forget all the answers cached.
+func (c *answerCache) flush() {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = nil
+	c.generation++
+}
+
+// Return the lowest TTL of the records of the answer, and whether it holds any.
+func answerTTL(msg *dns.Msg) (uint32, bool) {
+
+	found, lowest := false, uint32(0)
+
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < lowest {
+				found, lowest = true, rr.Header().Ttl
+			}
+		}
+	}
+
+	return lowest, found
+}
+
+/*
+Answer the query for the name, served by the view, from the answer cache if it is enabled, looking
+the name up (see lookup.go) and caching its answer otherwise.
+*/
+func (node *RaftNode) cachedLookup(view DNSView, req *dns.Msg, name string, client *geoClient) (*dns.Msg, error) {
+
+	// The TTLs of the answers are clamped as configured for their zone, see ttls.go
+	lookup := func() (*dns.Msg, bool, error) {
+
+		answer, varies, err := node.lookup(view, req, name, client)
+		if err == nil {
+			view.clampTTLs(name, answer)
+		}
+
+		return answer, varies, err
+	}
+
+	if node.Meta.Config == nil || node.Meta.Config.DNS.AnswerCache.Size == 0 {
+		answer, _, err := lookup()
+		return answer, err
+	}
+
+	config := node.Meta.Config.DNS.AnswerCache
+	key := view.Name + " " + name + " " + fmt.Sprint(req.Question[0].Qtype)
+
+	cached, generation := node.answers.get(key, node.now())
+	if cached != nil {
+
+		node.Meta.metrics.Add("dns_answer_cache_total", 1, "view", view.Name, "outcome", "hit")
+
+		cached.Id, cached.Question = req.Id, req.Question
+		cached.RecursionDesired, cached.CheckingDisabled = req.RecursionDesired, req.CheckingDisabled
+
+		return cached, nil
+	}
+
+	node.Meta.metrics.Add("dns_answer_cache_total", 1, "view", view.Name, "outcome", "miss")
+
+	answer, varies, err := lookup()
+	if err == nil && !varies {
+		node.answers.put(key, answer, generation, node.now(), config)
+	}
+
+	return answer, err
+}
+
+// Forget the answers cached by the replicas of the process if the changes applied to the store hold
+// records.
+func (node *RaftNode) invalidateAnswers(events []kv_store.Event) {
+
+	for _, event := range events {
+		if strings.HasPrefix(event.Key, zone.KeyPrefix) {
+			node.flushAnswers()
+			return
+		}
+	}
+}
+
+// Forget the answers cached by the replicas of the process.
+func (node *RaftNode) flushAnswers() {
+
+	if h := node.Meta.shards; h != nil {
+		for _, group := range h.groups {
+			group.answers.flush()
+		}
+		return
+	}
+
+	node.answers.flush()
+}
@@ -0,0 +1,156 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the answers are cached for the lowest TTL of
+ * their records, that they are forgotten once a change of the records is
+ * applied, and that the answers chosen by region or by a policy, along with
+ * those of a disabled cache, aren't cached.
+ */
+func TestAnswerCache(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "answercache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	put := func(key string, value interface{}) kv_store.Txn {
+		encoded, _ := json.Marshal(value)
+		return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: key, Value: string(encoded)}}}
+	}
+
+	// Write to the store directly, as if by another replica whose changes weren't applied yet.
+	write := func(txn kv_store.Txn) {
+		encoded, _ := json.Marshal(txn)
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(encoded))))
+	}
+
+	record := func(name, data string, ttl uint32, regions ...string) []zone.Record {
+		return []zone.Record{{Name: name, Type: "A", TTL: ttl, Data: data, Regions: regions}}
+	}
+
+	write(put(zone.RecordKey("example.com.", "SOA"), []zone.Record{{Name: "example.com.", Type: "SOA", TTL: 300, Data: "ns1.example.com. admin.example.com. 1 7200 900 1209600 60"}}))
+	write(put(zone.RecordKey("www.example.com.", "A"), record("www.example.com.", "192.0.2.1", 30)))
+	write(put(zone.RecordKey("geo.example.com.", "A"), record("geo.example.com.", "192.0.2.2", 30, "eu-west")))
+	write(put(zone.RecordKey("rr.example.com.", "A"), record("rr.example.com.", "192.0.2.3", 30)))
+	write(put(zone.PolicyKey("rr.example.com.", "A"), zone.Policy{Mode: zone.PolicyRoundRobin}))
+
+	clock := NewManualClock(time.Unix(100, 0))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig(), clock: clock}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.Config.DNS.AnswerCache = DNSAnswerCache{Size: 2}
+
+	view := DNSView{Name: "external"}
+
+	query := func(name string, client *geoClient) string {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		resp := node.answerDNS(view, req, client)
+		if resp.Id != req.Id || resp.Question[0].Name != name {
+			t.Errorf("Expected the answer of %v to match the query, got %v", name, resp)
+		}
+
+		var addresses []string
+		for _, rr := range resp.Answer {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+
+		return strings.Join(addresses, ",")
+	}
+
+	outcomes := func() (float64, float64) {
+		return node.Meta.metrics.Get("dns_answer_cache_total", "view", "external", "outcome", "hit"),
+			node.Meta.metrics.Get("dns_answer_cache_total", "view", "external", "outcome", "miss")
+	}
+
+	query("www.example.com.", nil)
+
+	write(put(zone.RecordKey("www.example.com.", "A"), record("www.example.com.", "192.0.2.10", 30)))
+
+	if got := query("WWW.example.com.", nil); got != "192.0.2.1" {
+		t.Errorf("Expected the answer to be cached, got %v", got)
+	}
+
+	// A change applied by the replica forgets the answers cached.
+	if !node.applyTxn(put(zone.RecordKey("www.example.com.", "A"), record("www.example.com.", "192.0.2.11", 30)), 1, false) {
+		t.Fatal("Unable to apply the change of the records")
+	}
+
+	if got := query("www.example.com.", nil); got != "192.0.2.11" {
+		t.Errorf("Expected the change applied to be answered, got %v", got)
+	}
+
+	if hits, misses := outcomes(); hits != 1 || misses != 2 {
+		t.Errorf("Expected 1 hit and 2 misses, got %v and %v", hits, misses)
+	}
+
+	// The answers expire after the lowest TTL of their records.
+	write(put(zone.RecordKey("www.example.com.", "A"), record("www.example.com.", "192.0.2.12", 30)))
+
+	clock.Advance(29 * time.Second)
+	if got := query("www.example.com.", nil); got != "192.0.2.11" {
+		t.Errorf("Expected the answer to be cached for its TTL, got %v", got)
+	}
+
+	clock.Advance(time.Second)
+	if got := query("www.example.com.", nil); got != "192.0.2.12" {
+		t.Errorf("Expected the answer to expire after its TTL, got %v", got)
+	}
+
+	// The answers chosen by region or by a policy vary, and the NXDOMAIN answers are cached without records.
+	client := &geoClient{regions: []string{"eu-west"}}
+	for i := 0; i < 2; i++ {
+		query("geo.example.com.", client)
+		query("rr.example.com.", nil)
+		query("missing.example.com.", nil)
+	}
+
+	if hits, misses := outcomes(); hits != 3 || misses != 8 {
+		t.Errorf("Expected 3 hits and 8 misses, got %v and %v", hits, misses)
+	}
+
+	query("www.example.com.", nil)
+	query("api.example.com.", nil)
+
+	if n := len(node.answers.entries); n > 2 {
+		t.Errorf("Expected 2 answers cached at most, got %v", n)
+	}
+
+	node.Meta.Config.DNS.AnswerCache.Size = 0
+	write(put(zone.RecordKey("www.example.com.", "A"), record("www.example.com.", "192.0.2.13", 30)))
+
+	if got := query("www.example.com.", nil); got != "192.0.2.13" {
+		t.Errorf("Expected a disabled cache to be bypassed, got %v", got)
+	}
+
+	if err := (&DNSConfig{AnswerCache: DNSAnswerCache{Size: -1}}).Validate(); err == nil {
+		t.Errorf("Expected a negative size to be refused")
+	}
+}
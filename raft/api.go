@@ -0,0 +1,214 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Programmatic API of a replica, for the code embedding it (e.g. the DNS layer, or another program
+running a replica in its own process) instead of going through the HTTP handlers or the KVService:
+
+	Propose           appends a command to the log of the leader, returning its index and term
+	                  without waiting for it to be committed (see CommitStatus in async.go)
+	ProposeAndWait    proposes a command and waits until it is applied, returning the outcome of
+	                  the transactions
+	LinearizableRead  calls a function reading the state machine once every entry committed before
+	                  the call is applied and the replica confirmed it is still the leader
+
+The commands are checked like the writes of the clients: the reserved keys, the zones homed on other
+clusters (see federation.go) or belonging to other groups (see shards.go) are refused, as are the
+writes adding data while an alarm is raised and the writes beyond the admission limits. Only the
+client commands may be proposed: POST, PUT, DELETE, TXN (with a JSON encoded kv_store.Txn) and NO-OP.
+The methods take the lock themselves, and return ErrNotLeader on a follower.
+*/
+
+// A command proposed through the log.
+type Command struct {
+	Operation []string // The operation applied by the state machine, e.g. {"POST", key, value}, see StateMachine
+	Client    string   // ID of the client proposing it, whose identical consecutive writes are refused
+}
+
+var (
+	ErrNotLeader    = errNotLeader      // The replica isn't the leader
+	ErrDuplicate    = errDuplicateWrite // The command repeats the previous write of the same client
+	ErrEntryLost    = errors.New("the entry was overwritten by the entry of a later leader")
+	errNotAProposal = errors.New("only the POST, PUT, DELETE, TXN and NO-OP commands may be proposed")
+)
+
+// Check the command, as the HTTP handlers and the KVService check the writes of the clients.
+func (node *RaftNode) checkCommand(cmd Command) error {
+
+	operation := cmd.Operation
+	if len(operation) == 0 {
+		return errNotAProposal
+	}
+
+	var keys []string
+
+	switch operation[0] {
+
+	case "POST", "PUT":
+		if len(operation) != 3 {
+			return fmt.Errorf("%v expects a key and a value", operation[0])
+		}
+		if err := validateWrittenKey(operation[1]); err != nil {
+			return err
+		}
+		keys = operation[1:2]
+
+	case "DELETE":
+		if len(operation) != 2 {
+			return fmt.Errorf("DELETE expects a key")
+		}
+		keys = operation[1:2]
+
+	case "TXN":
+		var txn kv_store.Txn
+		if len(operation) != 2 || json.Unmarshal([]byte(operation[1]), &txn) != nil {
+			return fmt.Errorf("TXN expects a JSON encoded transaction")
+		}
+
+		for _, op := range append(append([]kv_store.Op{}, txn.Success...), txn.Failure...) {
+			if op.Type == kv_store.OpPut {
+				if err := validateWrittenKey(op.Key); err != nil {
+					return err
+				}
+			}
+			keys = append(keys, op.Key)
+		}
+
+	case "NO-OP":
+
+	default:
+		return errNotAProposal
+	}
+
+	for _, key := range keys {
+
+		if err := validateKey(key); err != nil {
+			return err
+		}
+
+		if reservedKey(key) {
+			return errReservedKey
+		}
+
+		// The single key writes are checked when proposed.
+		if operation[0] != "TXN" {
+			continue
+		}
+
+		if err := node.checkFederatedWrite(key); err != nil {
+			return err
+		}
+
+		if err := node.checkShardWrite(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Propose appends the command to the log of the leader, and returns its index and the term of the
+leader as soon as it is appended. The command is then committed in the background, unless the
+leader fails first: CommitStatus(index, term) tells whether it was.
+*/
+func (node *RaftNode) Propose(ctx context.Context, cmd Command) (index, term int32, err error) {
+
+	if err := node.checkCommand(cmd); err != nil {
+		return -1, 0, err
+	}
+
+	node.GetRLock("Propose")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Propose")
+		return -1, 0, ErrNotLeader
+	}
+
+	index, term, success, err := node.proposeAsync(ctx, cmd.Operation, cmd.Client, 0, 0) // releases the lock
+	if !success {
+		return -1, 0, err
+	}
+
+	return index, term, nil
+}
+
+/*
+ProposeAndWait proposes the command, and waits until it is applied to the state machine of the
+leader. The outcome of a TXN command is returned, the result being empty for the other commands.
+If the leader fails before the command is committed, ErrEntryLost is returned once the entry of
+the later leader at its index is applied.
+*/
+func (node *RaftNode) ProposeAndWait(ctx context.Context, cmd Command) (int32, kv_store.TxnResult, error) {
+
+	index, term, err := node.Propose(ctx, cmd)
+	if err != nil {
+		return -1, kv_store.TxnResult{}, err
+	}
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		return index, kv_store.TxnResult{}, err
+	}
+
+	node.GetLock("Propose And Wait")
+	defer node.ReleaseLock("Propose And Wait")
+
+	// Once applied, the entry may no longer be in the log, nor its term known (see log.go).
+	if entry_term, known := node.termAt(index); known && entry_term != term {
+		return index, kv_store.TxnResult{}, ErrEntryLost
+	}
+
+	result := node.txn_results[index]
+	delete(node.txn_results, index)
+
+	return index, result, nil
+}
+
+/*
+LinearizableRead calls fn with the state machine of the leader once the entries committed before
+the call are applied and the replica confirmed, by exchanging heartbeats with a majority of the
+members, that it is still the leader: fn observes every write acknowledged before the call. The
+lock isn't held while fn runs.
+*/
+func (node *RaftNode) LinearizableRead(ctx context.Context, fn func(sm StateMachine) error) error {
+
+	node.GetRLock("Linearizable Read")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Linearizable Read")
+		return ErrNotLeader
+	}
+
+	read_index := node.commitIndex
+	node.ReleaseRLock("Linearizable Read")
+
+	if err := node.waitApplied(ctx, read_index); err != nil {
+		return err
+	}
+
+	node.Meta.metrics.Add("linearizable_reads_total", 1)
+
+	round := node.reads.wait()
+
+	node.GetRLock("Linearizable Read")
+	leader := node.state == Leader
+	node.ReleaseRLock("Linearizable Read")
+
+	if !round.ok || !leader {
+		return ErrNotLeader
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return fn(node.stateMachine())
+}
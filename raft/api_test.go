@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the commands proposed through the API are
+ * checked like the writes of the clients, that Propose returns once the
+ * command is appended and ProposeAndWait once it is applied, and that the
+ * linearizable reads wait for the committed entries and the confirmation of
+ * the leadership.
+ */
+func TestProgrammaticAPI(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms(), Config: DefaultConfig(), n_replicas: 3, raft_persistence_file: filepath.Join(dir, "3000"), clock: NewManualClock(time.Unix(100, 0))}}
+	node.storage = NewStorage()
+	node.commits_ready = make(chan int32, 1)
+	node.trackMessage = make(map[string][]string)
+	node.txn_results = make(map[int32]kv_store.TxnResult)
+
+	node.state, node.currentTerm = Leader, 2
+	node.log = []protos.LogEntry{{Term: 2, Operation: []string{"NO-OP"}}}
+	node.nextIndex, node.matchIndex = []int32{1, 1, 1}, []int32{0, 0, 0}
+	node.last_contact = make(map[int32]time.Time)
+	node.Meta.peer_replica_clients = []Transport{nil, &probedTransport{reachable: true}, &probedTransport{reachable: true}}
+
+	confirmed := 0
+	node.reads = newReadCoalescer(func() bool { confirmed++; return true })
+
+	// The committed entries are applied, as ApplyToStateMachine does.
+	go func() {
+		for range node.commits_ready {
+			node.GetLock("Test")
+			node.lastApplied = node.commitIndex
+			node.ReleaseLock("Test")
+		}
+	}()
+	defer close(node.commits_ready)
+
+	ctx := context.Background()
+
+	for _, cmd := range []Command{
+		{Operation: []string{"SETTING", "log_rpcs", "true", "SET", "", "0"}},
+		{Operation: []string{"POST", SettingsPrefix + "log_rpcs", "true"}},
+		{Operation: []string{"POST", "a/b", "1"}},
+		{Operation: []string{"TXN", "{"}},
+		{Operation: []string{"TXN", `{"success": [{"type": "PUT", "key": "_users:admin", "value": "x"}]}`}},
+	} {
+		if _, _, err := node.Propose(ctx, cmd); err == nil {
+			t.Errorf("Expected the command %v to be refused", cmd.Operation)
+		}
+	}
+
+	index, term, err := node.Propose(ctx, Command{Operation: []string{"POST", "app.name", "dns"}, Client: "embedder"})
+	if err != nil || index != 1 || term != 2 {
+		t.Fatalf("Expected the command to be appended at index 1 of term 2, got %v %v %v", index, term, err)
+	}
+
+	index, _, err = node.ProposeAndWait(ctx, Command{Operation: []string{"NO-OP"}, Client: "embedder"})
+	if err != nil || index != 2 {
+		t.Fatalf("Expected the command to be applied at index 2, got %v %v", index, err)
+	}
+
+	node.GetRLock("Test")
+	if node.lastApplied != 2 || node.log[1].Operation[1] != "app.name" {
+		t.Errorf("Expected both commands to be applied, got %v %v", node.lastApplied, node.log[1].Operation)
+	}
+	node.ReleaseRLock("Test")
+
+	read := false
+	if err := node.LinearizableRead(ctx, func(sm StateMachine) error { read = true; return nil }); err != nil || !read || confirmed != 1 {
+		t.Errorf("Expected the read to be served once the leadership was confirmed, got %v %v %v", err, read, confirmed)
+	}
+
+	node.GetLock("Test")
+	node.state = Follower
+	node.ReleaseLock("Test")
+
+	if _, _, err := node.Propose(ctx, Command{Operation: []string{"NO-OP"}}); err != ErrNotLeader {
+		t.Errorf("Expected a follower to refuse the proposals, got %v", err)
+	}
+
+	if err := node.LinearizableRead(ctx, func(sm StateMachine) error { return nil }); err != ErrNotLeader {
+		t.Errorf("Expected a follower to refuse the linearizable reads, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Asynchronous writes, requested with ?async=true on POST, PUT and DELETE requests. The leader
+appends the entry to its log and responds right away with the index and term assigned to it,
+replicating and applying it in the background: the client isn't told whether the write will be
+committed, which it can later find out from GET /commit-status/{index}?term=<term>. This trades
+the durability of the acknowledgement for throughput, e.g. for bulk DNS record updates.
+
+An asynchronous write may still be lost if the leader fails before replicating it, in which case
+the entry at its index ends up with another term once a later leader overwrites it.
+*/
+
+// Status of a log entry, as reported by /commit-status.
+const (
+	CommitPending   = "pending"   // In the log, not committed yet
+	CommitCommitted = "committed" // Committed, not applied to the store yet
+	CommitApplied   = "applied"   // Applied to the store of the replica
+	CommitLost      = "lost"      // Another entry was committed at its index
+	CommitUnknown   = "unknown"   // Not in the log of the replica, or overwritten but not committed
+)
+
+// Response of the /commit-status endpoint.
+type CommitStatus struct {
+	Index       int32  `json:"index"`
+	Term        int32  `json:"term"` // Term of the entry held at the index, -1 if none
+	Status      string `json:"status"`
+	CommitIndex int32  `json:"commit_index"`
+	LastApplied int32  `json:"last_applied"`
+}
+
+// The term assigned to the entry of an asynchronous write, see proposeAsync.
+type asyncProposal struct {
+	term int32
+}
+
+type asyncContextKey struct{}
+
+// Return the asynchronous proposal made with the context, if any.
+func asyncWrite(ctx context.Context) (*asyncProposal, bool) {
+	p, ok := ctx.Value(asyncContextKey{}).(*asyncProposal)
+	return p, ok
+}
+
+// Whether the write request asked to be acknowledged once appended to the log, with ?async=true.
+func asyncRequest(r *http.Request) (bool, error) {
+
+	s := r.FormValue("async")
+	if s == "" {
+		return false, nil
+	}
+
+	async, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid async option %q", s)
+	}
+
+	return async, nil
+}
+
+/*
+proposeAsync proposes the write like proposeSessionCommand, but returns as soon as the entry is
+appended to the leader's log, along with its index and term. The term is 0 if the write was
+already applied by the session, see checkSessionWrite. Like proposeSessionCommand, it must be
+called with the read lock held, and returns with no lock held.
+*/
+func (node *RaftNode) proposeAsync(ctx context.Context, operation []string, client string, session, sequence int64) (index, term int32, success bool, err error) {
+
+	p := &asyncProposal{}
+
+	index, success, err = node.proposeSessionCommand(context.WithValue(ctx, asyncContextKey{}, p), operation, client, session, sequence)
+
+	return index, p.term, success, err
+}
+
+// Perform an asynchronous write for the given HTTP handler, and respond with its index and term,
+// and the status of the handler. Must be called with the read lock held.
+func (node *RaftNode) asyncWriteHandler(w http.ResponseWriter, r *http.Request, status int, operation []string, client string, session, sequence int64) {
+
+	index, term, success, err := node.proposeAsync(r.Context(), operation, client, session, sequence)
+
+	if !success {
+		node.logger().Error().Err(err).Str("key", operation[1]).Msgf("Error occured in asynchronous %v request", operation[0])
+		node.writeProposalError(w, operation[0], err)
+		return
+	}
+
+	node.logger().Info().Str("key", operation[1]).Int32("index", index).Msgf("%v request appended, committing asynchronously", operation[0])
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "\n%v request accepted at index %v of term %v, see /commit-status/%v?term=%v.\n", operation[0], index, term, index, term)
+}
+
+/*
+Return the status of the entry at the given index. If term isn't 0, the entry is the one appended
+in that term: it is lost once another entry is committed at its index. Must be called with the
+read lock held.
+*/
+func (node *RaftNode) commitStatus(index, term int32) CommitStatus {
+
+	s := CommitStatus{Index: index, Term: -1, CommitIndex: node.commitIndex, LastApplied: node.lastApplied}
+
+	if index > node.lastLogIndex() {
+		s.Status = CommitUnknown
+		return s
+	}
+
+	entry_term, known := node.termAt(index)
+
+	// The entry was applied, and is no longer in the log, see log.go
+	if !known {
+
+		s.Status = CommitApplied
+		if term != 0 {
+			s.Status = CommitUnknown
+		}
+
+		return s
+	}
+
+	s.Term = entry_term
+
+	switch {
+
+	case term != 0 && s.Term != term && index <= node.commitIndex:
+		s.Status = CommitLost
+
+	case term != 0 && s.Term != term:
+		s.Status = CommitUnknown
+
+	case index <= node.lastApplied:
+		s.Status = CommitApplied
+
+	case index <= node.commitIndex:
+		s.Status = CommitCommitted
+
+	default:
+		s.Status = CommitPending
+
+	}
+
+	return s
+}
+
+// Handle requests of the form /commit-status/{index}?term=<term>, reporting the status of the entry
+// at the index as known by this replica.
+func (node *RaftNode) CommitStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	index, err := strconv.ParseInt(mux.Vars(r)["index"], 10, 32)
+	if err != nil || index < 0 {
+		writeError(w, http.StatusBadRequest, "Invalid index: %q", mux.Vars(r)["index"])
+		return
+	}
+
+	term := int64(0)
+	if s := r.FormValue("term"); s != "" {
+		if term, err = strconv.ParseInt(s, 10, 32); err != nil || term < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid term: %q", s)
+			return
+		}
+	}
+
+	node.GetRLock("Commit Status Handler")
+	status := node.commitStatus(int32(index), int32(term))
+	node.ReleaseRLock("Commit Status Handler")
+
+	writeJSON(w, http.StatusOK, status)
+}
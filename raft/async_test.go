@@ -0,0 +1,50 @@
+package raft
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks the status reported for the entries of asynchronous
+ * writes, depending on whether they are committed, applied or overwritten.
+ */
+func TestCommitStatus(t *testing.T) {
+
+	node := &RaftNode{}
+	node.log = []protos.LogEntry{{Term: 0}, {Term: 1}, {Term: 1}, {Term: 2}, {Term: 3}}
+	node.commitIndex = 3
+	node.lastApplied = 2
+
+	cases := []struct {
+		index, term int32
+		status      string
+	}{
+		{1, 1, CommitApplied},
+		{2, 0, CommitApplied},
+		{3, 2, CommitCommitted},
+		{4, 3, CommitPending},
+		{4, 0, CommitPending},
+		{3, 1, CommitLost},    // committed with another term
+		{4, 2, CommitUnknown}, // overwritten, but the first entry of term 2 may still be held by others
+		{5, 3, CommitUnknown},
+	}
+
+	for _, c := range cases {
+		if s := node.commitStatus(c.index, c.term); s.Status != c.status || s.CommitIndex != 3 || s.LastApplied != 2 {
+			t.Errorf("Expected the entry at %v of term %v to be %v, got %+v", c.index, c.term, c.status, s)
+		}
+	}
+
+	for query, expected := range map[string]bool{"": false, "?async=true": true, "?async=0": false} {
+		if async, err := asyncRequest(httptest.NewRequest("POST", "/a"+query, nil)); err != nil || async != expected {
+			t.Errorf("Expected async %v for %q, got %v (%v)", expected, query, async, err)
+		}
+	}
+
+	if _, err := asyncRequest(httptest.NewRequest("POST", "/a?async=maybe", nil)); err == nil {
+		t.Errorf("Expected an invalid async option to be rejected")
+	}
+}
@@ -0,0 +1,315 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+/*
+Audit history of the keys, including the records of the zones. As a data entry is applied, every
+change it makes to a key is recorded under AuditPrefix, keyed by the changed key and the index of the
+entry, along with the previous value of the key (see kv_store.TxnResult) and the metadata of the entry:
+its term, the client and the authenticated user who proposed it (the signer of a DNS update, see
+dns_update.go), and the time the leader appended it at. The records being written by every replica
+as it applies the entry, the history is the same on all of them. The keys of the reserved namespaces
+(e.g. the settings, which have their own history, see settings.go) aren't recorded.
+
+The history of a key is read with GET /audit?key=<key>, and that of the records of a zone (its RRsets,
+the response policies aside) with GET /zones/{zone}/history, from the leader. Both list the changes
+oldest first.
+
+The history is kept according to the settings:
+
+	audit_retention     age (e.g. "720h") beyond which the changes are forgotten, 0 keeping them
+	audit_max_versions  changes kept for every key, the most recent ones, auditMaxVersions by default,
+	                    0 keeping them all
+
+The leader forgets the changes through the log, by transactions deleting their records (made by the
+auditClient client, themselves not recorded), checked every auditRetentionInterval.
+*/
+
+const (
+	AuditPrefix = "_audit:" // Keys holding the audit record of each change of a key
+
+	auditMaxVersions       = 100         // Changes kept for every key, by default
+	auditRetentionInterval = time.Minute // Interval of the checks of the retention of the history
+	auditPruneBatch        = 1000        // Records deleted by a transaction at most
+	auditClient            = "audit"     // Client of the transactions forgetting the changes
+)
+
+// A change made to a key, as stored in the audit history.
+type AuditRecord struct {
+	Index    int32     `json:"index"` // Index of the log entry making the change
+	Term     int32     `json:"term"`
+	Key      string    `json:"key"`
+	Action   string    `json:"action"` // kv_store.OpPut or kv_store.OpDelete
+	Value    string    `json:"value,omitempty"`
+	Previous *string   `json:"previous,omitempty"` // Value of the key before the change, nil if it didn't exist
+	Client   string    `json:"client,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Time     time.Time `json:"time"` // Time at which the leader received the change
+}
+
+// Return the key of the record of the change, the position-th made to the key by the entry.
+func auditKey(key string, index int32, position int) string {
+	return fmt.Sprintf("%s%s#%010d.%04d", AuditPrefix, key, index, position)
+}
+
+// Return the name of the authenticated user making the request with the given context, if any.
+func proposingUser(ctx context.Context) string {
+
+	if user, ok := requestUser(ctx); ok {
+		return user.Name
+	}
+
+	if origin, ok := originOf(ctx); ok && origin.User != nil {
+		return origin.User.Name
+	}
+
+	return ""
+}
+
+/*
+Return the transaction recording the changes made by the data entry at the given index in the audit
+history, and whether there are any. Called in ApplyToStateMachine, once the entry is applied.
+*/
+func auditTxn(entry *protos.LogEntry, index int32, result kv_store.TxnResult) (kv_store.Txn, bool) {
+
+	var txn kv_store.Txn
+	positions := make(map[string]int)
+
+	for i, event := range result.Events {
+
+		if reservedKey(event.Key) {
+			continue
+		}
+
+		record := AuditRecord{
+			Index:    index,
+			Term:     entry.Term,
+			Key:      event.Key,
+			Action:   event.Type,
+			Value:    event.Value,
+			Previous: result.PreviousValue(i),
+			Client:   entry.Clientid,
+			User:     entry.User,
+		}
+
+		if entry.Timestamp != 0 {
+			record.Time = time.Unix(0, entry.Timestamp).UTC()
+		}
+
+		encoded, _ := json.Marshal(record)
+
+		txn.Success = append(txn.Success, kv_store.Op{Type: kv_store.OpPut, Key: auditKey(event.Key, index, positions[event.Key]), Value: string(encoded)})
+		positions[event.Key]++
+	}
+
+	return txn, len(txn.Success) > 0
+}
+
+/*
+Call visit with the audit records stored under the prefix, in the order of their keys (by changed key,
+and then oldest first), until it returns false. Must be called on the leader, with the read lock held.
+*/
+func (node *RaftNode) scanAudit(prefix string, visit func(key string, record AuditRecord) bool) error {
+
+	token := ""
+
+	for {
+
+		response, status, err := node.readFromStore("prefix/" + url.PathEscape(prefix) + "?limit=1000&token=" + url.QueryEscape(token))
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("status %v", status)
+		}
+		if err != nil {
+			return err
+		}
+
+		var page kv_store.RangeResponse
+		if err := json.Unmarshal([]byte(response), &page); err != nil {
+			return err
+		}
+
+		for _, kv := range page.Kvs {
+
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(kv.Value), &record); err != nil {
+				node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid audit record")
+				continue
+			}
+
+			if !visit(kv.Key, record) {
+				return nil
+			}
+		}
+
+		if page.NextToken == "" {
+			return nil
+		}
+
+		token = page.NextToken
+	}
+}
+
+// Write the audit records stored under the prefix and kept by the filter, read from the leader.
+func (node *RaftNode) writeAudit(w http.ResponseWriter, prefix string, keep func(record AuditRecord) bool) {
+
+	node.GetRLock("Audit Handler")
+	defer node.ReleaseRLock("Audit Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		return
+	}
+
+	history := make([]AuditRecord, 0)
+
+	err := node.scanAudit(prefix, func(_ string, record AuditRecord) bool {
+		if keep(record) {
+			history = append(history, record)
+		}
+		return true
+	})
+
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	// The records are in the order of the changed keys, the changes of an entry keeping theirs.
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Index < history[j].Index })
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// Handle requests of the form /audit?key=<key>, returning the audit history of the key.
+func (node *RaftNode) AuditHandler(w http.ResponseWriter, r *http.Request) {
+
+	key := r.FormValue("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "Error: Expected a key")
+		return
+	}
+
+	node.logger().Info().Str("key", key).Msg("AUDIT request received")
+
+	// The prefix also holds the records of the keys starting with key#, which are left out.
+	node.writeAudit(w, AuditPrefix+key+"#", func(record AuditRecord) bool {
+		return record.Key == key
+	})
+}
+
+// Handle requests of the form /zones/{zone}/history, returning the audit history of the records of
+// the zone, including those of its subzones.
+func (node *RaftNode) ZoneHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := zone.CanonicalName(mux.Vars(r)["zone"])
+
+	node.logger().Info().Str("zone", name).Msg("ZONE HISTORY request received")
+
+	if !validNames(w, name) {
+		return
+	}
+
+	node.writeAudit(w, AuditPrefix+zone.KeyPrefix, func(record AuditRecord) bool {
+		owner, _, ok := zone.ParseRecordKey(record.Key)
+		return ok && zone.InZone(owner, name) && !zone.IsPolicyKey(record.Key)
+	})
+}
+
+/*
+Return the keys of the audit records to delete at now: those older than the audit_retention setting,
+and those of the keys with more than audit_max_versions changes, but for the most recent ones. Must be
+called on the leader, with the read lock held.
+*/
+func (node *RaftNode) expiredAudit(now time.Time) ([]string, error) {
+
+	retention := node.Meta.settings.Duration("audit_retention", 0)
+	max := int(node.Meta.settings.Int64("audit_max_versions", auditMaxVersions))
+
+	var expired []string
+	versions := make(map[string][]string) // Records of each key within the retention, oldest first
+
+	err := node.scanAudit(AuditPrefix, func(key string, record AuditRecord) bool {
+
+		if retention > 0 && !record.Time.IsZero() && now.Sub(record.Time) > retention {
+			expired = append(expired, key)
+		} else {
+			versions[record.Key] = append(versions[record.Key], key)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, keys := range versions {
+		if max > 0 && len(keys) > max {
+			expired = append(expired, keys[:len(keys)-max]...)
+		}
+	}
+
+	sort.Strings(expired)
+
+	return expired, nil
+}
+
+// Job forgetting the changes of the audit history beyond its retention, through the log.
+func (node *RaftNode) auditRetentionJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "audit_retention",
+		Interval: auditRetentionInterval,
+		Run: func(ctx context.Context) error {
+
+			node.GetRLock("Audit Retention Job")
+
+			if node.state != Leader {
+				node.ReleaseRLock("Audit Retention Job")
+				return nil
+			}
+
+			expired, err := node.expiredAudit(node.now())
+			node.ReleaseRLock("Audit Retention Job")
+
+			if err != nil {
+				return err
+			}
+
+			for len(expired) > 0 {
+
+				batch := expired
+				if len(batch) > auditPruneBatch {
+					batch = batch[:auditPruneBatch]
+				}
+				expired = expired[len(batch):]
+
+				ops := make([]kv_store.Op, 0, len(batch))
+				for _, key := range batch {
+					ops = append(ops, kv_store.Op{Type: kv_store.OpDelete, Key: key})
+				}
+
+				if err := node.proposeRecords(ctx, auditClient, ops); err != nil {
+					return err
+				}
+
+				node.Meta.metrics.Add("audit_records_pruned_total", float64(len(batch)))
+			}
+
+			return nil
+		},
+	}
+}
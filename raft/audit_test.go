@@ -0,0 +1,180 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the changes applied to the keys are recorded in
+ * their audit history, with their previous value and the metadata of their log
+ * entry, that the history of a key and of the records of a zone are returned
+ * by the leader, and that the changes beyond the retention of the history are
+ * found and forgotten without being recorded themselves.
+ */
+func TestAuditHistory(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	base := time.Unix(1000, 0)
+	clock := NewManualClock(base.Add(100 * time.Minute))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig(), clock: clock}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.watches = NewWatchHub()
+	node.reads = newReadCoalescer(func() bool { return true })
+
+	txn := func(ops ...kv_store.Op) string {
+		encoded, _ := json.Marshal(kv_store.Txn{Success: ops})
+		return string(encoded)
+	}
+
+	record := "dns:www.example.com.:A"
+
+	node.log = []protos.LogEntry{
+		{Term: 1, Operation: []string{"NO-OP"}},
+		{Term: 1, Operation: []string{"POST", record, "v1"}, Clientid: "c1", User: "alice", Timestamp: base.UnixNano()},
+		{Term: 1, Operation: []string{"PUT", record, "v2"}, Clientid: "c2", Timestamp: base.Add(10 * time.Minute).UnixNano()},
+		{Term: 2, Operation: []string{"TXN", txn(
+			kv_store.Op{Type: kv_store.OpPut, Key: "app.name", Value: "x"},
+			kv_store.Op{Type: kv_store.OpPut, Key: "dns:www.example.org.:A", Value: "o"},
+		)}, Timestamp: base.Add(20 * time.Minute).UnixNano()},
+		{Term: 2, Operation: []string{"DELETE", record}, User: "bob", Timestamp: base.Add(90 * time.Minute).UnixNano()},
+	}
+
+	for i := 1; i < len(node.log); i++ {
+		if !node.applyEntry(int32(i)) {
+			t.Fatalf("Unable to apply the entry %v", i)
+		}
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/audit", node.AuditHandler)
+	r.HandleFunc("/zones/{zone}/history", node.ZoneHistoryHandler)
+
+	history := func(path string) []AuditRecord {
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var records []AuditRecord
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &records) != nil {
+			t.Fatalf("Expected the history of %v, got %v %v", path, w.Code, w.Body.String())
+		}
+
+		return records
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/audit?key="+record, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a follower to refuse the history, got %v", w.Code)
+	}
+
+	node.state = Leader
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/audit", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the history without a key to be refused, got %v", w.Code)
+	}
+
+	changes := history("/audit?key=" + record)
+	if len(changes) != 3 {
+		t.Fatalf("Expected the 3 changes of the record, got %+v", changes)
+	}
+
+	created, updated, deleted := changes[0], changes[1], changes[2]
+
+	if created.Index != 1 || created.Action != kv_store.OpPut || created.Value != "v1" || created.Previous != nil || created.Client != "c1" || created.User != "alice" || !created.Time.Equal(base) {
+		t.Errorf("Unexpected creation %+v", created)
+	}
+
+	if updated.Index != 2 || updated.Value != "v2" || updated.Previous == nil || *updated.Previous != "v1" || updated.Client != "c2" || updated.User != "" {
+		t.Errorf("Unexpected update %+v", updated)
+	}
+
+	if deleted.Index != 4 || deleted.Term != 2 || deleted.Action != kv_store.OpDelete || deleted.Previous == nil || *deleted.Previous != "v2" || deleted.User != "bob" {
+		t.Errorf("Unexpected deletion %+v", deleted)
+	}
+
+	if changes := history("/zones/example.com/history"); len(changes) != 3 || changes[2].Index != 4 {
+		t.Errorf("Expected the 3 changes of the records of the zone, got %+v", changes)
+	}
+
+	if changes := history("/zones/example.org/history"); len(changes) != 1 || changes[0].Key != "dns:www.example.org.:A" || changes[0].Previous != nil {
+		t.Errorf("Expected the change of the transaction to the zone, got %+v", changes)
+	}
+
+	if changes := history("/audit?key=app.name"); len(changes) != 1 || changes[0].Index != 3 || changes[0].Value != "x" {
+		t.Errorf("Expected the change of the transaction to the key, got %+v", changes)
+	}
+
+	// Read on the leader, as the job does.
+	expire := func() ([]string, error) {
+		node.GetRLock("Test")
+		defer node.ReleaseRLock("Test")
+		return node.expiredAudit(node.now())
+	}
+
+	// Only the oldest change of the record is beyond the versions kept.
+	node.Meta.settings.apply(SettingChange{Name: "audit_max_versions", Action: "SET", Value: "2"})
+
+	expired, err := expire()
+	if err != nil || len(expired) != 1 || expired[0] != auditKey(record, 1, 0) {
+		t.Errorf("Expected the oldest change of the record to expire, got %v %v", expired, err)
+	}
+
+	// The changes older than an hour expire too, but for the last one.
+	node.Meta.settings.apply(SettingChange{Name: "audit_retention", Action: "SET", Value: "1h"})
+
+	expired, err = expire()
+	if err != nil || len(expired) != 4 || expired[0] != auditKey("app.name", 3, 0) || expired[2] != auditKey(record, 2, 0) {
+		t.Fatalf("Expected the 4 changes older than the retention to expire, got %v %v", expired, err)
+	}
+
+	// The leader forgets them through the log, as the job does.
+	ops := make([]kv_store.Op, 0, len(expired))
+	for _, key := range expired {
+		ops = append(ops, kv_store.Op{Type: kv_store.OpDelete, Key: key})
+	}
+
+	node.state = Follower
+	node.log = append(node.log, protos.LogEntry{Term: 2, Operation: []string{"TXN", txn(ops...)}, Clientid: auditClient})
+	if !node.applyEntry(int32(len(node.log) - 1)) {
+		t.Fatal("Unable to apply the deletion of the expired changes")
+	}
+	node.state = Leader
+
+	if changes := history("/audit?key=" + record); len(changes) != 1 || changes[0].Index != 4 {
+		t.Errorf("Expected only the last change of the record to be kept, got %+v", changes)
+	}
+
+	if expired, err := expire(); err != nil || len(expired) != 0 {
+		t.Errorf("Expected no more changes to expire, got %v %v", expired, err)
+	}
+}
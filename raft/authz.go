@@ -0,0 +1,284 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+External authorization of the client writes, for policies the roles of acl.go can't express (e.g.
+"only the netops group may modify MX records"). Once the ACLs passed, the leader consults the
+Authorizer set with SetAuthorizer on every write of a client about to be proposed (POST, PUT, DELETE,
+transactions, batches, zone updates, dynamic DNS updates and deletions of a prefix), with the
+AuthorizationRequest describing who writes what and from where. The writes proposed by the replicas
+themselves (settings, alarms, federated zones, etc.) aren't checked.
+
+A denied write fails with a PERMISSION_DENIED status (403 Forbidden for the HTTP endpoints answering
+with the status of the error, REFUSED for DNS updates) carrying the reason given by the authorizer,
+and is recorded with the acl reason of /admin/rejections. If the authorizer fails (e.g. it can't be
+reached within AuthzTimeout), the write fails with an UNAVAILABLE status (503), unless AuthzFailOpen
+is set. The decisions are counted in authz_decisions_total{decision} (allow, deny or error).
+
+The WebhookAuthorizer posts the request to an HTTP endpoint, in the format of the Open Policy Agent
+data API: the request is sent as {"input": {...}}, and the endpoint answers {"result": true} or
+{"result": {"allow": true, "reason": "..."}}, e.g. /v1/data/dns/authz/allow of an OPA server.
+*/
+
+// Decides whether the writes of the clients are allowed.
+type Authorizer interface {
+	Authorize(ctx context.Context, req AuthorizationRequest) (AuthorizationDecision, error)
+}
+
+// A write submitted to the Authorizer.
+type AuthorizationRequest struct {
+	User       string            `json:"user,omitempty"` // Empty when authentication is disabled, or with the shared ClientToken
+	Roles      []string          `json:"roles,omitempty"`
+	Client     string            `json:"client,omitempty"` // Client ID given with the write, if any
+	Operation  string            `json:"operation"`        // POST, PUT, DELETE, TXN or DELETE_PREFIX
+	Writes     []AuthorizedWrite `json:"writes"`
+	Protocol   string            `json:"protocol"` // http, grpc or dns
+	RemoteAddr string            `json:"remote_addr,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// A key written, along with the RRset it holds for the keys of DNS records.
+type AuthorizedWrite struct {
+	Key    string `json:"key"`
+	Delete bool   `json:"delete,omitempty"`
+	Prefix bool   `json:"prefix,omitempty"` // All the keys with the prefix Key are deleted
+	Value  string `json:"value,omitempty"`
+	Name   string `json:"name,omitempty"` // Owner name of the RRset
+	Type   string `json:"type,omitempty"` // Type of the RRset
+}
+
+type AuthorizationDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Set the Authorizer consulted on the writes of the clients, none if nil.
+func (node *RaftNode) SetAuthorizer(authorizer Authorizer) {
+	node.Meta.authorizer = authorizer
+}
+
+// Where a request comes from, for the requests that don't carry a gRPC peer.
+type requestOrigin struct {
+	Protocol   string
+	RemoteAddr string
+	User       *User // Signer of a DNS update, whose ACLs are checked by updateDNS rather than along the request
+}
+
+type originContextKey struct{}
+
+func withOrigin(ctx context.Context, origin requestOrigin) context.Context {
+	return context.WithValue(ctx, originContextKey{}, origin)
+}
+
+// Return where the request with the given context comes from, if it comes from a client.
+func originOf(ctx context.Context) (requestOrigin, bool) {
+
+	if origin, ok := ctx.Value(originContextKey{}).(requestOrigin); ok {
+		return origin, true
+	}
+
+	if p, ok := peer.FromContext(ctx); ok {
+		return requestOrigin{Protocol: "grpc", RemoteAddr: p.Addr.String()}, true
+	}
+
+	return requestOrigin{}, false
+}
+
+// Middleware recording where the HTTP requests come from.
+func (node *RaftNode) originMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withOrigin(r.Context(), requestOrigin{Protocol: "http", RemoteAddr: r.RemoteAddr})))
+	})
+}
+
+// Return the keys written by the operation of a client write.
+func operationWrites(operation []string) []AuthorizedWrite {
+
+	var writes []AuthorizedWrite
+
+	switch operation[0] {
+
+	case "POST", "PUT":
+		writes = []AuthorizedWrite{{Key: operation[1], Value: operation[2]}}
+
+	case "DELETE":
+		writes = []AuthorizedWrite{{Key: operation[1], Delete: true}}
+
+	case "DELETE_PREFIX":
+		writes = []AuthorizedWrite{{Key: operation[1], Delete: true, Prefix: true}}
+
+	case "TXN":
+
+		var txn kv_store.Txn
+		json.Unmarshal([]byte(operation[1]), &txn)
+
+		for _, op := range append(append([]kv_store.Op{}, txn.Success...), txn.Failure...) {
+			writes = append(writes, AuthorizedWrite{Key: op.Key, Value: op.Value, Delete: op.Type == kv_store.OpDelete})
+		}
+
+	}
+
+	for i := range writes {
+		if name, rtype, ok := zone.ParseRecordKey(writes[i].Key); ok && !writes[i].Prefix {
+			writes[i].Name, writes[i].Type = name, rtype
+		}
+	}
+
+	return writes
+}
+
+/*
+Consult the Authorizer, if any, on the write of a client, returning a PERMISSION_DENIED status if it
+is denied, or an UNAVAILABLE one if the authorizer failed. Writes that don't come from a client
+request aren't checked. Must be called without the lock held, as the authorizer may take a while.
+*/
+func (node *RaftNode) authorizeWrite(ctx context.Context, operation []string, client string) error {
+
+	authorizer := node.Meta.authorizer
+	if authorizer == nil || !clientWrite(operation) {
+		return nil
+	}
+
+	origin, ok := originOf(ctx)
+	if !ok {
+		return nil
+	}
+
+	req := AuthorizationRequest{
+		Client:     client,
+		Operation:  operation[0],
+		Writes:     operationWrites(operation),
+		Protocol:   origin.Protocol,
+		RemoteAddr: origin.RemoteAddr,
+		Time:       node.now(),
+	}
+
+	if user, ok := requestUser(ctx); ok {
+		req.User, req.Roles = user.Name, user.Roles
+	} else if origin.User != nil {
+		req.User, req.Roles = origin.User.Name, origin.User.Roles
+	}
+
+	if timeout := node.Meta.Config.AuthzTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	decision, err := authorizer.Authorize(ctx, req)
+
+	switch {
+
+	case err != nil:
+
+		node.Meta.metrics.Add("authz_decisions_total", 1, "decision", "error")
+		node.logger().Warn().Err(err).Str("operation", req.Operation).Bool("fail_open", node.Meta.Config.AuthzFailOpen).Msg("Authorization service failed")
+
+		if node.Meta.Config.AuthzFailOpen {
+			return nil
+		}
+		return status.Errorf(codes.Unavailable, "the authorization service failed: %v", err)
+
+	case !decision.Allow:
+
+		node.Meta.metrics.Add("authz_decisions_total", 1, "decision", "deny")
+
+		if decision.Reason == "" {
+			decision.Reason = "no reason given"
+		}
+		return status.Errorf(codes.PermissionDenied, "denied by the authorization service: %v", decision.Reason)
+
+	}
+
+	node.Meta.metrics.Add("authz_decisions_total", 1, "decision", "allow")
+	return nil
+}
+
+// The Authorizer posting the requests to an HTTP endpoint, such as the data API of an OPA server.
+type WebhookAuthorizer struct {
+	URL    string
+	Token  string // Bearer token presented to the endpoint, if any
+	Client *http.Client
+}
+
+func NewWebhookAuthorizer(url, token string) *WebhookAuthorizer {
+	return &WebhookAuthorizer{URL: url, Token: token, Client: &http.Client{}}
+}
+
+func (a *WebhookAuthorizer) Authorize(ctx context.Context, req AuthorizationRequest) (AuthorizationDecision, error) {
+
+	body, err := json.Marshal(struct {
+		Input AuthorizationRequest `json:"input"`
+	}{req})
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if a.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+a.Token)
+	}
+
+	resp, err := a.Client.Do(httpReq)
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return AuthorizationDecision{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return AuthorizationDecision{}, fmt.Errorf("the authorization endpoint answered %v", resp.Status)
+	}
+
+	// The result is either a boolean, or a decision.
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+
+	if err := json.Unmarshal(contents, &answer); err != nil {
+		return AuthorizationDecision{}, fmt.Errorf("invalid answer of the authorization endpoint: %v", err)
+	}
+
+	// OPA omits the result of an undefined rule, which denies the write.
+	if len(answer.Result) == 0 {
+		return AuthorizationDecision{Reason: "undefined policy decision"}, nil
+	}
+
+	var allow bool
+	if err := json.Unmarshal(answer.Result, &allow); err == nil {
+		return AuthorizationDecision{Allow: allow}, nil
+	}
+
+	var decision AuthorizationDecision
+	if err := json.Unmarshal(answer.Result, &decision); err != nil {
+		return AuthorizationDecision{}, fmt.Errorf("invalid result of the authorization endpoint: %s", answer.Result)
+	}
+
+	return decision, nil
+}
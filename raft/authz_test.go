@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the writes of the clients are submitted to the
+ * webhook authorizer with the RRsets they change, that a denied write is
+ * rejected with the reason of the policy before being proposed, that the
+ * writes of the replicas aren't submitted, and that a failing authorizer
+ * rejects the writes unless failing open.
+ */
+func TestWebhookAuthorizer(t *testing.T) {
+
+	// A policy in the format of OPA: only the netops group may modify MX records.
+	var inputs []AuthorizationRequest
+	policy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var body struct {
+			Input AuthorizationRequest `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs = append(inputs, body.Input)
+
+		netops := false
+		for _, role := range body.Input.Roles {
+			netops = netops || role == "netops"
+		}
+
+		for _, write := range body.Input.Writes {
+			if write.Type == "MX" && !netops {
+				json.NewEncoder(w).Encode(map[string]interface{}{"result": AuthorizationDecision{Reason: "only netops may modify MX records"}})
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": true})
+	}))
+	defer policy.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms(), Config: DefaultConfig(), clock: NewManualClock(time.Unix(100, 0))}}
+	node.SetAuthorizer(NewWebhookAuthorizer(policy.URL, ""))
+
+	txn := func(keys ...string) []string {
+		var t kv_store.Txn
+		for _, key := range keys {
+			t.Success = append(t.Success, kv_store.Op{Type: kv_store.OpPut, Key: key, Value: "[]"})
+		}
+		encoded, _ := json.Marshal(t)
+		return []string{"TXN", string(encoded)}
+	}
+
+	mx, a := zone.RecordKey("example.com.", "MX"), zone.RecordKey("www.example.com.", "A")
+
+	client := withOrigin(context.Background(), requestOrigin{Protocol: "http", RemoteAddr: "192.0.2.1:4242"})
+	dev := context.WithValue(client, userContextKey{}, User{Name: "dev", Roles: []string{"developers"}})
+	netops := context.WithValue(client, userContextKey{}, User{Name: "ops", Roles: []string{"netops"}})
+
+	err := node.authorizeWrite(dev, txn(a, mx), "")
+	if status.Code(err) != codes.PermissionDenied || status.Convert(err).Message() != "denied by the authorization service: only netops may modify MX records" {
+		t.Errorf("Expected the MX records of a developer to be denied, got %v", err)
+	}
+
+	if len(inputs) != 1 || inputs[0].User != "dev" || inputs[0].Protocol != "http" || inputs[0].RemoteAddr != "192.0.2.1:4242" || len(inputs[0].Writes) != 2 || inputs[0].Writes[1].Name != "example.com." || inputs[0].Writes[1].Type != "MX" {
+		t.Errorf("Unexpected authorization requests %+v", inputs)
+	}
+
+	if err := node.authorizeWrite(netops, txn(mx), ""); err != nil {
+		t.Errorf("Expected netops to modify the MX records: %v", err)
+	}
+
+	if err := node.authorizeWrite(dev, []string{"POST", "key", "value"}, "c1"); err != nil {
+		t.Errorf("Expected a developer to write other keys: %v", err)
+	}
+
+	// Neither the writes of the replicas nor their other proposals are submitted.
+	if err := node.authorizeWrite(context.Background(), txn(mx), ""); err != nil || len(inputs) != 3 {
+		t.Errorf("Expected the writes of the replicas not to be submitted, got %v", err)
+	}
+
+	if err := node.authorizeWrite(dev, []string{"SETTING", "max_body_bytes", "1", "SET", "dev"}, ""); err != nil || len(inputs) != 3 {
+		t.Errorf("Expected the settings not to be submitted, got %v", err)
+	}
+
+	// A denied write is rejected before being proposed, with the acl reason.
+	node.GetRLock("Test")
+	if _, success, err := node.proposeSessionCommand(dev, txn(mx), "", 0, 0); success || status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected the proposal to be denied, got %v", err)
+	}
+
+	if rejections := node.Meta.rejections.List("", "", 0); len(rejections) != 1 || rejections[0].Reason != rejectACL {
+		t.Errorf("Expected the denial to be recorded, got %+v", rejections)
+	}
+
+	policy.Close()
+
+	if err := node.authorizeWrite(netops, txn(mx), ""); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the writes to be rejected while the authorizer fails, got %v", err)
+	}
+
+	node.Meta.Config.AuthzFailOpen = true
+
+	if err := node.authorizeWrite(netops, txn(mx), ""); err != nil {
+		t.Errorf("Expected the writes to be allowed by a failing authorizer failing open: %v", err)
+	}
+
+	if got := node.Meta.metrics.Get("authz_decisions_total", "decision", "deny"); got != 2 {
+		t.Errorf("Expected 2 denials to be counted, got %v", got)
+	}
+
+	if got := node.Meta.metrics.Get("authz_decisions_total", "decision", "error"); got != 2 {
+		t.Errorf("Expected 2 failures to be counted, got %v", got)
+	}
+}
@@ -0,0 +1,222 @@
+package raft
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Backups of a cluster, for disaster recovery. GET /admin/backup, served by the leader, returns a
+gzipped tar archive of:
+
+	backup.json  the BackupMetadata: the term, applied index and membership of the cluster, and the
+	             revision, digest and checksum of the snapshot
+	snapshot     the snapshot of the key-value store and the client sessions, as /admin/snapshot
+
+The backup is consistent: the leader confirms its leadership with a majority of the replicas, then
+applies all the entries committed so far before taking the snapshot, so that it holds every write
+acknowledged before the request. raftctl backup saves it, and the replicas of a brand-new cluster
+are started from it with -restore <backup> (see RestoreSnapshot), which check it first. The leader
+also takes backups on a schedule, see backup_schedule.go.
+*/
+
+const (
+	backupMetadataFile = "backup.json"
+	backupSnapshotFile = "snapshot"
+)
+
+// The metadata of a backup.
+type BackupMetadata struct {
+	SnapshotDigest
+	Members  []Member  `json:"members"`  // Latest configuration known to the leader
+	Leader   int32     `json:"leader"`   // Replica the backup was taken from
+	Created  time.Time `json:"created"`  // Time the snapshot was taken, by the leader's clock
+	Checksum string    `json:"checksum"` // Hex encoded SHA-256 hash of the snapshot
+}
+
+// Handle backup requests, returning a consistent backup of the cluster.
+func (node *RaftNode) BackupHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("BACKUP request received")
+
+	meta, snapshot, err := node.takeBackup()
+
+	if err == errNotLeader {
+		node.GetRLock("Backup Handler")
+		leaderAddress := node.Meta.leaderAddress
+		node.ReleaseRLock("Backup Handler")
+		writeNotLeader(w, leaderAddress)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Backup failed with error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusOK)
+
+	// Sent at the rate of the other snapshot transfers, see throttle.go
+	throttled, done := node.Meta.snapshots.writer(r.Context(), requestHost(r), w)
+	defer done()
+
+	if err := writeBackup(throttled, meta, snapshot); err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to send the backup")
+		return
+	}
+
+	node.logger().Info().Int32("applied_index", meta.AppliedIndex).Int64("revision", meta.Revision).Str("digest", meta.Digest).Msg("Backup sent")
+}
+
+// Take a consistent backup on the leader, returning its metadata and snapshot, or errNotLeader if
+// the replica couldn't confirm its leadership.
+func (node *RaftNode) takeBackup() (BackupMetadata, []byte, error) {
+
+	if !node.confirmLeadership() {
+		return BackupMetadata{}, nil, errNotLeader
+	}
+
+	node.GetRLock("Backup")
+	defer node.ReleaseRLock("Backup")
+
+	// The entries committed when the leadership was confirmed are applied first.
+	for node.commitIndex != node.lastApplied {
+		node.ReleaseRLock("Backup")
+		time.Sleep(20 * time.Millisecond)
+		node.GetRLock("Backup")
+	}
+
+	snapshot, digest, err := node.snapshot()
+	if err != nil {
+		return BackupMetadata{}, nil, err
+	}
+
+	checksum := sha256.Sum256(snapshot.Bytes())
+
+	meta := BackupMetadata{
+		SnapshotDigest: SnapshotDigest{
+			AppliedIndex: node.lastApplied,
+			Term:         node.currentTerm,
+			Revision:     digest.Revision,
+			Digest:       digest.Digest,
+			ClusterID:    node.clusterID(),
+		},
+		Members:  append([]Member{}, node.Meta.members...),
+		Leader:   node.Meta.replica_id,
+		Created:  node.now(),
+		Checksum: hex.EncodeToString(checksum[:]),
+	}
+
+	return meta, snapshot.Bytes(), nil
+}
+
+// Write the archive of a backup.
+func writeBackup(w io.Writer, meta BackupMetadata, snapshot []byte) error {
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	encoded, _ := json.MarshalIndent(meta, "", "  ")
+
+	for _, file := range []struct {
+		name     string
+		contents []byte
+	}{{backupMetadataFile, encoded}, {backupSnapshotFile, snapshot}} {
+
+		if err := archive.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.contents)), ModTime: meta.Created}); err != nil {
+			return err
+		}
+
+		if _, err := archive.Write(file.contents); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Whether the contents are those of a backup rather than of a snapshot, which isn't gzipped.
+func isBackup(contents []byte) bool {
+	return len(contents) >= 2 && contents[0] == 0x1f && contents[1] == 0x8b
+}
+
+// Read a backup, checking that its snapshot matches its metadata. Return the metadata and the
+// snapshot.
+func ReadBackup(r io.Reader) (BackupMetadata, []byte, error) {
+
+	var meta BackupMetadata
+	var encoded, snapshot []byte
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return meta, nil, fmt.Errorf("not a backup: %v", err)
+	}
+
+	archive := tar.NewReader(gz)
+
+	for {
+
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return meta, nil, fmt.Errorf("invalid backup: %v", err)
+		}
+
+		contents, err := ioutil.ReadAll(archive)
+		if err != nil {
+			return meta, nil, fmt.Errorf("invalid backup: %v", err)
+		}
+
+		switch header.Name {
+		case backupMetadataFile:
+			encoded = contents
+		case backupSnapshotFile:
+			snapshot = contents
+		}
+	}
+
+	if encoded == nil || snapshot == nil {
+		return meta, nil, errors.New("invalid backup: the metadata or the snapshot is missing")
+	}
+
+	if err := json.Unmarshal(encoded, &meta); err != nil {
+		return meta, nil, fmt.Errorf("invalid backup metadata: %v", err)
+	}
+
+	checksum := sha256.Sum256(snapshot)
+	if hex.EncodeToString(checksum[:]) != meta.Checksum {
+		return meta, nil, errors.New("checksum mismatch: the snapshot of the backup is corrupted")
+	}
+
+	digest, err := kv_store.VerifySnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return meta, nil, err
+	}
+
+	if digest.Digest != meta.Digest || digest.Revision != meta.Revision {
+		return meta, nil, fmt.Errorf("digest mismatch: the backup contains revision %v with digest %v, expected revision %v with digest %v",
+			digest.Revision, digest.Digest, meta.Revision, meta.Digest)
+	}
+
+	return meta, snapshot, nil
+}
@@ -0,0 +1,1035 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Scheduled backups, taken by the leader (as GET /admin/backup, see backup.go) and uploaded to a
+storage, with a retention policy. They are enabled by the "backups" section of the config file:
+
+	{"backups": {"schedule": "0 3 * * *", "storage": "local", "path": "/var/backups/dns", "retention": {"count": 7}}}
+	{"backups": {"schedule": "@every 6h", "storage": "s3", "bucket": "dns-backups", "prefix": "prod/", "region": "eu-west-1"}}
+	{"backups": {"schedule": "@daily", "storage": "gcs", "bucket": "dns-backups", "retention": {"days": 30}}}
+
+The schedule is a cron expression (minute, hour, day of the month, month and day of the week, in
+UTC), one of @hourly, @daily, @weekly and @monthly, or @every <duration> (of a minute at least). The
+storages:
+
+	local  the directory at the path
+	s3     the bucket of an S3 compatible API (the endpoint, https://s3.<region>.amazonaws.com by
+	       default), signed with the access and secret keys (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	       and AWS_SESSION_TOKEN by default)
+	gcs    the bucket of Google Cloud Storage, with the OAuth access token (the token of the service
+	       account of the instance, from its metadata server, by default)
+
+Other storages are registered with RegisterBackupStorage. The backups are named after the time they
+were taken and their applied index, e.g. backup-20260314T030000Z-5701.tar.gz, under the prefix of the
+section. After each upload, the backups beyond the "count" newest ones, and those older than "days",
+are deleted; the newest one is always kept.
+
+The schedule is cluster-wide: the time of the last backup due is recorded under BackupScheduleKey
+through the log (by the backupClient client), so that the next leader takes the next one, rather than
+taking it again or missing it. The backups missed while the cluster had no leader are replaced by a
+single one. As the upload happens before the recording, a leader stepping down in between has the
+next leader take the backup again: the backups are taken at least once. A failed backup is retried
+after backupRetry.
+
+The backups taken are counted in backups_total by outcome, and the ones deleted in
+backups_pruned_total. GET /admin/backups, on the leader, returns the schedule and the backups stored.
+*/
+
+const (
+	BackupScheduleKey = "_backups:scheduled" // Key holding the time of the last backup due, in seconds since the epoch
+
+	backupScheduleInterval = 30 * time.Second // Interval of the checks of the schedule by the leader
+	backupRetry            = 5 * time.Minute  // Time after which a failed backup is taken again
+	backupUploadTimeout    = 10 * time.Minute // Time allowed for a backup to be uploaded
+	backupStorageTimeout   = time.Minute      // Time allowed for the other requests to the storage
+	backupClient           = "backups"        // Client of the transactions recording the schedule
+)
+
+// The scheduled backups of the config file.
+type BackupScheduleConfig struct {
+	Schedule  string          `json:"schedule"`             // Cron expression or @ descriptor, disabled if empty
+	Storage   string          `json:"storage"`              // local, s3, gcs or a type registered with RegisterBackupStorage
+	Path      string          `json:"path"`                 // Directory of a local storage
+	Bucket    string          `json:"bucket"`               // Bucket of an s3 or gcs storage
+	Prefix    string          `json:"prefix"`               // Prefix of the names of the backups in the bucket
+	Endpoint  string          `json:"endpoint"`             // URL of the API of an s3 or gcs storage, if not the default one
+	Region    string          `json:"region"`               // Region of an s3 storage, us-east-1 by default
+	AccessKey string          `json:"access_key,omitempty"` // Credentials of an s3 storage, from the environment if empty
+	SecretKey string          `json:"secret_key,omitempty"`
+	Token     string          `json:"token,omitempty"` // Session token of an s3 storage, or access token of a gcs storage
+	Retention BackupRetention `json:"retention"`
+}
+
+// The retention policy of the scheduled backups.
+type BackupRetention struct {
+	Count int `json:"count"` // Backups kept at most, all of them if 0
+	Days  int `json:"days"`  // Days a backup is kept at most, forever if 0
+}
+
+// A storage of the scheduled backups. Its methods are called from a single goroutine at once.
+type BackupStorage interface {
+	Put(ctx context.Context, name string, contents []byte) error
+	List(ctx context.Context) ([]string, error) // Names of the backups stored, in any order
+	Delete(ctx context.Context, name string) error
+}
+
+// The types of the storages, opening a storage as configured.
+var backupStorageTypes = map[string]func(BackupScheduleConfig) (BackupStorage, error){
+	"local": openLocalBackupStorage,
+	"s3":    openS3BackupStorage,
+	"gcs":   openGCSBackupStorage,
+}
+
+// Register a type of backup storages for the config files loaded afterwards. Not safe to call
+// concurrently with loading a config file or starting a replica.
+func RegisterBackupStorage(name string, open func(BackupScheduleConfig) (BackupStorage, error)) error {
+
+	if name == "" || open == nil {
+		return fmt.Errorf("backup storages must have a name and an open function")
+	}
+
+	if _, ok := backupStorageTypes[name]; ok {
+		return fmt.Errorf("backup storage %v is already registered", name)
+	}
+
+	backupStorageTypes[name] = open
+
+	return nil
+}
+
+func (c BackupScheduleConfig) Validate() error {
+
+	if c.Schedule == "" {
+		return nil
+	}
+
+	if _, err := parseBackupSchedule(c.Schedule); err != nil {
+		return fmt.Errorf("backups: %v", err)
+	}
+
+	if _, ok := backupStorageTypes[c.Storage]; !ok {
+		return fmt.Errorf("backups: unknown storage %q", c.Storage)
+	}
+
+	switch {
+
+	case c.Retention.Count < 0 || c.Retention.Days < 0:
+		return fmt.Errorf("backups: expected a non-negative retention, got %+v", c.Retention)
+
+	case c.Storage == "local" && c.Path == "":
+		return fmt.Errorf("backups: a local storage requires a path")
+
+	case (c.Storage == "s3" || c.Storage == "gcs") && c.Bucket == "":
+		return fmt.Errorf("backups: the %v storage requires a bucket", c.Storage)
+
+	}
+
+	return nil
+}
+
+// The fields of the cron expressions: their names, and ranges.
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of the month", 1, 31}, {"month", 1, 12}, {"day of the week", 0, 7}}
+
+// The descriptors of the schedules, and their cron expressions.
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// A schedule of the backups, in UTC.
+type backupSchedule struct {
+	every      time.Duration // Interval of an @every schedule, or 0
+	fields     [5]uint64     // Values of each field of a cron expression, as bits
+	anyDay     bool          // Whether the day of the month is *
+	anyWeekday bool          // Whether the day of the week is *
+}
+
+// Parse a schedule, see the scheduled backups above.
+func parseBackupSchedule(spec string) (*backupSchedule, error) {
+
+	if strings.HasPrefix(spec, "@every ") {
+
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || every < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q, expected an interval of a minute at least", spec)
+		}
+
+		return &backupSchedule{every: every}, nil
+	}
+
+	if expression, ok := cronDescriptors[spec]; ok {
+		spec = expression
+	}
+
+	values := strings.Fields(spec)
+	if len(values) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q, expected 5 fields", spec)
+	}
+
+	schedule := &backupSchedule{}
+
+	for i, field := range cronFields {
+
+		for _, item := range strings.Split(values[i], ",") {
+
+			lo, hi, step := field.min, field.max, 1
+
+			if j := strings.Index(item, "/"); j != -1 {
+
+				var err error
+				if step, err = strconv.Atoi(item[j+1:]); err != nil || step <= 0 {
+					return nil, fmt.Errorf("invalid step of the %v in %q", field.name, spec)
+				}
+
+				item = item[:j]
+			}
+
+			if item != "*" {
+
+				bounds := strings.SplitN(item, "-", 2)
+
+				var err error
+				if lo, err = strconv.Atoi(bounds[0]); err != nil {
+					return nil, fmt.Errorf("invalid %v %q in %q", field.name, item, spec)
+				}
+
+				hi = lo
+				if len(bounds) == 2 {
+					if hi, err = strconv.Atoi(bounds[1]); err != nil {
+						return nil, fmt.Errorf("invalid %v %q in %q", field.name, item, spec)
+					}
+				} else if step != 1 {
+					hi = field.max
+				}
+
+				if lo < field.min || hi > field.max || lo > hi {
+					return nil, fmt.Errorf("%v %q out of range in %q, expected %v-%v", field.name, item, spec, field.min, field.max)
+				}
+			}
+
+			for value := lo; value <= hi; value += step {
+				schedule.fields[i] |= 1 << uint(value)
+			}
+		}
+	}
+
+	// Both 0 and 7 are Sunday.
+	if schedule.fields[4]&(1<<7) != 0 {
+		schedule.fields[4] |= 1
+	}
+
+	// As in cron, a day matches either of the day fields when neither is *.
+	schedule.anyDay = strings.HasPrefix(values[2], "*")
+	schedule.anyWeekday = strings.HasPrefix(values[4], "*")
+
+	if schedule.next(time.Unix(0, 0)).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q, never due", spec)
+	}
+
+	return schedule, nil
+}
+
+// Whether the day matches the schedule.
+func (s *backupSchedule) day(t time.Time) bool {
+
+	month := s.fields[2]&(1<<uint(t.Day())) != 0
+	week := s.fields[4]&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyWeekday:
+		return month
+	case s.anyDay:
+		return week
+	}
+
+	return month || week
+}
+
+// Return the first time the schedule is due after t, or the zero time if it isn't due within 5
+// years.
+func (s *backupSchedule) next(t time.Time) time.Time {
+
+	if s.every != 0 {
+		return t.Add(s.every)
+	}
+
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+
+		switch {
+
+		case s.fields[3]&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+
+		case !s.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+
+		case s.fields[1]&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+
+		case s.fields[0]&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+
+		default:
+			return t
+
+		}
+	}
+
+	return time.Time{}
+}
+
+// The names of the scheduled backups, holding the time they were taken.
+var backupNamePattern = regexp.MustCompile(`^backup-(\d{8}T\d{6}Z)-\d+\.tar\.gz$`)
+
+// Return the name of a scheduled backup.
+func backupName(meta BackupMetadata) string {
+	return fmt.Sprintf("backup-%s-%d.tar.gz", meta.Created.UTC().Format("20060102T150405Z"), meta.AppliedIndex)
+}
+
+// Return the time at which the backup of the name was taken, and whether it is that of a backup.
+func backupTime(name string) (time.Time, bool) {
+
+	match := backupNamePattern.FindStringSubmatch(name)
+	if match == nil {
+		return time.Time{}, false
+	}
+
+	t, err := time.Parse("20060102T150405Z", match[1])
+	return t, err == nil
+}
+
+// Return the backups to delete under the retention, the newest one aside. The other names are
+// ignored.
+func expiredBackups(names []string, retention BackupRetention, now time.Time) []string {
+
+	var backups []string
+	for _, name := range names {
+		if _, ok := backupTime(name); ok {
+			backups = append(backups, name)
+		}
+	}
+
+	// The names sort as the times, the newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	var expired []string
+
+	for i, name := range backups {
+
+		created, _ := backupTime(name)
+
+		if i > 0 && ((retention.Count > 0 && i >= retention.Count) || (retention.Days > 0 && now.Sub(created) > time.Duration(retention.Days)*24*time.Hour)) {
+			expired = append(expired, name)
+		}
+	}
+
+	return expired
+}
+
+// The storage of the scheduled backups, opened on first use, and the time of the next attempt
+// after a failure.
+type scheduledBackups struct {
+	mu      sync.Mutex
+	storage BackupStorage
+	retry   time.Time
+}
+
+// Return the storage of the scheduled backups.
+func (node *RaftNode) backupStorage() (BackupStorage, error) {
+
+	node.backups.mu.Lock()
+	defer node.backups.mu.Unlock()
+
+	if node.backups.storage == nil {
+
+		config := node.Meta.Config.Backups
+
+		storage, err := backupStorageTypes[config.Storage](config) // checked by Validate
+		if err != nil {
+			return nil, err
+		}
+
+		node.backups.storage = storage
+	}
+
+	return node.backups.storage, nil
+}
+
+// Return the time of the last backup due, the zero time if none was recorded. Must be called on the
+// leader, with the read lock held.
+func (node *RaftNode) lastScheduledBackup() (time.Time, error) {
+
+	contents, status, err := node.readFromStore(url.PathEscape(BackupScheduleKey))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if status != http.StatusOK || !strings.HasPrefix(contents, "Value = ") {
+		return time.Time{}, nil
+	}
+
+	seconds, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(contents, "Value = ")), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time of the last backup %q", contents)
+	}
+
+	return time.Unix(seconds, 0).UTC(), nil
+}
+
+// Take a backup, upload it and delete the ones expired.
+func (node *RaftNode) runScheduledBackup(ctx context.Context, storage BackupStorage) error {
+
+	meta, snapshot, err := node.takeBackup()
+	if err != nil {
+		return err
+	}
+
+	var archive bytes.Buffer
+	if err := writeBackup(&archive, meta, snapshot); err != nil {
+		return err
+	}
+
+	name := backupName(meta)
+
+	uploadCtx, cancel := context.WithTimeout(ctx, backupUploadTimeout)
+	defer cancel()
+
+	if err := storage.Put(uploadCtx, name, archive.Bytes()); err != nil {
+		return fmt.Errorf("unable to upload backup %v: %v", name, err)
+	}
+
+	node.logger().Info().Str("name", name).Int32("applied_index", meta.AppliedIndex).Int("bytes", archive.Len()).Msg("Scheduled backup uploaded")
+	node.Meta.metrics.Set("backup_last_success_timestamp_seconds", float64(meta.Created.Unix()))
+
+	listCtx, cancel := context.WithTimeout(ctx, backupStorageTimeout)
+	defer cancel()
+
+	names, err := storage.List(listCtx)
+	if err != nil {
+		return fmt.Errorf("unable to list the backups: %v", err)
+	}
+
+	for _, expired := range expiredBackups(names, node.Meta.Config.Backups.Retention, node.now()) {
+
+		if err := storage.Delete(listCtx, expired); err != nil {
+			return fmt.Errorf("unable to delete backup %v: %v", expired, err)
+		}
+
+		node.logger().Info().Str("name", expired).Msg("Expired backup deleted")
+		node.Meta.metrics.Add("backups_pruned_total", 1)
+	}
+
+	return nil
+}
+
+// Job taking the backups due on the leader, and recording the last one through the log.
+func (node *RaftNode) backupScheduleJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "backup_schedule",
+		Interval: backupScheduleInterval,
+		Run: func(ctx context.Context) error {
+
+			config := node.Meta.Config.Backups
+			if config.Schedule == "" {
+				return nil
+			}
+
+			schedule, _ := parseBackupSchedule(config.Schedule) // checked by Validate
+
+			node.GetRLock("Backup Schedule Job")
+
+			if node.state != Leader {
+				node.ReleaseRLock("Backup Schedule Job")
+				return nil
+			}
+
+			last, err := node.lastScheduledBackup()
+			node.ReleaseRLock("Backup Schedule Job")
+
+			if err != nil {
+				return err
+			}
+
+			now := node.now()
+
+			// The schedule starts now, the first backup being the next one due.
+			if last.IsZero() {
+				return node.proposeRecords(ctx, backupClient, []kv_store.Op{{Type: kv_store.OpPut, Key: BackupScheduleKey, Value: strconv.FormatInt(now.Unix(), 10)}})
+			}
+
+			due := schedule.next(last)
+			if due.IsZero() || due.After(now) {
+				return nil
+			}
+
+			node.backups.mu.Lock()
+			retry := node.backups.retry
+			node.backups.mu.Unlock()
+
+			if now.Before(retry) {
+				return nil
+			}
+
+			storage, err := node.backupStorage()
+			if err == nil {
+				err = node.runScheduledBackup(ctx, storage)
+			}
+
+			if err != nil {
+
+				node.backups.mu.Lock()
+				node.backups.retry = now.Add(backupRetry)
+				node.backups.mu.Unlock()
+
+				node.Meta.metrics.Add("backups_total", 1, "outcome", "failure")
+				return err
+			}
+
+			node.Meta.metrics.Add("backups_total", 1, "outcome", "success")
+
+			// The backups missed are replaced by the one just taken.
+			for next := schedule.next(due); !next.IsZero() && !next.After(now); next = schedule.next(next) {
+				due = next
+			}
+
+			return node.proposeRecords(ctx, backupClient, []kv_store.Op{{Type: kv_store.OpPut, Key: BackupScheduleKey, Value: strconv.FormatInt(due.Unix(), 10)}})
+		},
+	}
+}
+
+// The scheduled backups, as returned by GET /admin/backups.
+type BackupScheduleStatus struct {
+	Schedule string         `json:"schedule"`
+	Storage  string         `json:"storage"`
+	Last     *time.Time     `json:"last,omitempty"` // Time of the last backup due
+	Next     *time.Time     `json:"next,omitempty"`
+	Backups  []StoredBackup `json:"backups"` // The newest first
+}
+
+// A backup in the storage.
+type StoredBackup struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// Handle the requests for the scheduled backups, see above.
+func (node *RaftNode) BackupsHandler(w http.ResponseWriter, r *http.Request) {
+
+	config := node.Meta.Config.Backups
+	if config.Schedule == "" {
+		writeError(w, http.StatusNotFound, "Error: No backups are scheduled")
+		return
+	}
+
+	node.GetRLock("Backups Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Backups Handler")
+		return
+	}
+
+	last, err := node.lastScheduledBackup()
+	node.ReleaseRLock("Backups Handler")
+
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	response := BackupScheduleStatus{Schedule: config.Schedule, Storage: config.Storage, Backups: []StoredBackup{}}
+
+	if !last.IsZero() {
+		schedule, _ := parseBackupSchedule(config.Schedule) // checked by Validate
+		next := schedule.next(last)
+		response.Last, response.Next = &last, &next
+	}
+
+	storage, err := node.backupStorage()
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), backupStorageTimeout)
+	defer cancel()
+
+	names, err := storage.List(ctx)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "Unable to list the backups: %v", err)
+		return
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, name := range names {
+		if created, ok := backupTime(name); ok {
+			response.Backups = append(response.Backups, StoredBackup{Name: name, Created: created})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// A storage of the backups in a local directory.
+type localBackupStorage struct {
+	dir string
+}
+
+func openLocalBackupStorage(config BackupScheduleConfig) (BackupStorage, error) {
+
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	return &localBackupStorage{dir: config.Path}, nil
+}
+
+// Write the backup to a temporary file first, so that a partial backup is never listed.
+func (s *localBackupStorage) Put(ctx context.Context, name string, contents []byte) error {
+
+	file, err := ioutil.TempFile(s.dir, "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(contents); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(s.dir, name))
+}
+
+func (s *localBackupStorage) List(ctx context.Context) ([]string, error) {
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && backupNamePattern.MatchString(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+func (s *localBackupStorage) Delete(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// Return an error for the response of a storage, unless it succeeded.
+func storageResponseError(resp *http.Response) error {
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// A storage of the backups in a bucket of an S3 compatible API, the requests being signed with
+// version 4 of the AWS signatures.
+type s3BackupStorage struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+}
+
+func openS3BackupStorage(config BackupScheduleConfig) (BackupStorage, error) {
+
+	s := &s3BackupStorage{
+		endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		bucket:    config.Bucket,
+		prefix:    config.Prefix,
+		region:    config.Region,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		token:     config.Token,
+	}
+
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+
+	if s.accessKey == "" {
+		s.accessKey, s.secretKey, s.token = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("the s3 storage requires an access key and a secret key")
+	}
+
+	return s, nil
+}
+
+// Escape the string as in the canonical requests of the AWS signatures, keeping the slashes if
+// asked to.
+func awsEscape(s string, slashes bool) string {
+
+	var escaped strings.Builder
+
+	for i := 0; i < len(s); i++ {
+
+		c := s[i]
+
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (slashes && c == '/') {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// Send a signed request for the object (the bucket itself if empty).
+func (s *s3BackupStorage) do(ctx context.Context, method, object string, query url.Values, body []byte) (*http.Response, error) {
+
+	path := "/" + awsEscape(s.bucket, false)
+	if object != "" {
+		path += "/" + awsEscape(object, true)
+	}
+
+	// The values are sorted by key, as the canonical query requires.
+	var parameters []string
+	for key, values := range query {
+		for _, value := range values {
+			parameters = append(parameters, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(parameters)
+	canonicalQuery := strings.Join(parameters, "&")
+
+	target := s.endpoint + path
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	date, amzDate := now.Format("20060102"), now.Format("20060102T150405Z")
+	payload := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if s.token != "" {
+		req.Header.Set("X-Amz-Security-Token", s.token)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var headers strings.Builder
+	for _, name := range signed {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonical := strings.Join([]string{method, path, canonicalQuery, headers.String(), strings.Join(signed, ";"), hex.EncodeToString(payload[:])}, "\n")
+	hashed := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.accessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, toSign))))
+
+	return http.DefaultClient.Do(req)
+}
+
+func (s *s3BackupStorage) Put(ctx context.Context, name string, contents []byte) error {
+
+	resp, err := s.do(ctx, "PUT", s.prefix+name, nil, contents)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return storageResponseError(resp)
+}
+
+func (s *s3BackupStorage) List(ctx context.Context) ([]string, error) {
+
+	var names []string
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix}}
+
+	for {
+
+		resp, err := s.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+
+		err = storageResponseError(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			if name := strings.TrimPrefix(object.Key, s.prefix); backupNamePattern.MatchString(name) {
+				names = append(names, name)
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3BackupStorage) Delete(ctx context.Context, name string) error {
+
+	resp, err := s.do(ctx, "DELETE", s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return storageResponseError(resp)
+}
+
+// The metadata server of the Google Cloud instances, providing the token of their service account.
+const gcsTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// A storage of the backups in a bucket of Google Cloud Storage, through its JSON API.
+type gcsBackupStorage struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	token    string    // Access token of the config, or of the metadata server
+	expiry   time.Time // Expiry of the token of the metadata server, zero for the config's
+}
+
+func openGCSBackupStorage(config BackupScheduleConfig) (BackupStorage, error) {
+
+	s := &gcsBackupStorage{endpoint: strings.TrimSuffix(config.Endpoint, "/"), bucket: config.Bucket, prefix: config.Prefix, token: config.Token}
+
+	if s.endpoint == "" {
+		s.endpoint = "https://storage.googleapis.com"
+	}
+
+	return s, nil
+}
+
+// Return the access token, fetching a new one from the metadata server if needed.
+func (s *gcsBackupStorage) accessToken(ctx context.Context) (string, error) {
+
+	if s.token != "" && (s.expiry.IsZero() || time.Now().Before(s.expiry)) {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", gcsTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to get an access token from the metadata server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if err := storageResponseError(resp); err != nil {
+		return "", fmt.Errorf("unable to get an access token from the metadata server: %v", err)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	// Renewed a minute before it expires.
+	s.token, s.expiry = token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn)*time.Second-time.Minute)
+
+	return s.token, nil
+}
+
+// Send an authenticated request to the path of the API.
+func (s *gcsBackupStorage) do(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+
+	token, err := s.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	target := s.endpoint + path
+	if len(query) != 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/gzip")
+	}
+
+	return http.DefaultClient.Do(req)
+}
+
+func (s *gcsBackupStorage) Put(ctx context.Context, name string, contents []byte) error {
+
+	resp, err := s.do(ctx, "POST", "/upload/storage/v1/b/"+url.PathEscape(s.bucket)+"/o", url.Values{"uploadType": {"media"}, "name": {s.prefix + name}}, contents)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return storageResponseError(resp)
+}
+
+func (s *gcsBackupStorage) List(ctx context.Context) ([]string, error) {
+
+	var names []string
+	query := url.Values{"prefix": {s.prefix}, "fields": {"items(name),nextPageToken"}}
+
+	for {
+
+		resp, err := s.do(ctx, "GET", "/storage/v1/b/"+url.PathEscape(s.bucket)+"/o", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		err = storageResponseError(resp)
+		if err == nil {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Items {
+			if name := strings.TrimPrefix(object.Name, s.prefix); backupNamePattern.MatchString(name) {
+				names = append(names, name)
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return names, nil
+		}
+
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+func (s *gcsBackupStorage) Delete(ctx context.Context, name string) error {
+
+	resp, err := s.do(ctx, "DELETE", "/storage/v1/b/"+url.PathEscape(s.bucket)+"/o/"+url.PathEscape(s.prefix+name), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return storageResponseError(resp)
+}
@@ -0,0 +1,195 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that the schedules of the backups are parsed and due
+ * at the times of their cron expressions, and that the invalid ones are
+ * refused.
+ */
+func TestBackupSchedule(t *testing.T) {
+
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	for _, test := range []struct {
+		spec, after, next string
+	}{
+		{"0 3 * * *", "2026-03-14T02:59:30Z", "2026-03-14T03:00:00Z"},
+		{"0 3 * * *", "2026-03-14T03:00:00Z", "2026-03-15T03:00:00Z"},
+		{"*/15 * * * *", "2026-03-14T10:07:00Z", "2026-03-14T10:15:00Z"},
+		{"30 1-5/2 * * *", "2026-03-14T02:00:00Z", "2026-03-14T03:30:00Z"},
+		{"0 0 1 * *", "2026-12-15T00:00:00Z", "2027-01-01T00:00:00Z"},
+		{"0 0 * * 7", "2026-03-14T00:00:00Z", "2026-03-15T00:00:00Z"},  // a Sunday
+		{"0 0 13 * 5", "2026-03-01T00:00:00Z", "2026-03-06T00:00:00Z"}, // either the 13th or a Friday
+		{"0 0 29 2 *", "2026-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"@weekly", "2026-03-14T00:00:00Z", "2026-03-15T00:00:00Z"},
+		{"@every 6h", "2026-03-14T00:00:00Z", "2026-03-14T06:00:00Z"},
+	} {
+
+		schedule, err := parseBackupSchedule(test.spec)
+		if err != nil {
+			t.Errorf("Unable to parse %q: %v", test.spec, err)
+			continue
+		}
+
+		if next := schedule.next(at(test.after)); !next.Equal(at(test.next)) {
+			t.Errorf("Expected %q to be due after %v at %v, got %v", test.spec, test.after, test.next, next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "0 0 0 * *", "5-1 * * * *", "*/0 * * * *", "0 0 31 2 *", "@every 10s", "@yearly"} {
+		if _, err := parseBackupSchedule(spec); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+
+	for config, valid := range map[BackupScheduleConfig]bool{
+		{}:                   true,
+		{Schedule: "@daily"}: false,
+		{Schedule: "@daily", Storage: "local", Path: "/tmp"}:                                        true,
+		{Schedule: "@daily", Storage: "gcs"}:                                                        false,
+		{Schedule: "@daily", Storage: "local", Path: "/tmp", Retention: BackupRetention{Count: -1}}: false,
+	} {
+		if err := config.Validate(); (err == nil) != valid {
+			t.Errorf("Expected the validity of %+v to be %v, got %v", config, valid, err)
+		}
+	}
+}
+
+/*
+ * This test case checks that the retention keeps the newest backups within its
+ * count and age, always keeping the newest one, and that the local and s3
+ * storages put, list and delete the backups.
+ */
+func TestBackupStorages(t *testing.T) {
+
+	now := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+
+	names := []string{
+		"backup-20260314T030000Z-90.tar.gz",
+		"backup-20260301T030000Z-10.tar.gz",
+		"backup-20260313T030000Z-80.tar.gz",
+		"backup-20260312T030000Z-70.tar.gz",
+		"unrelated.txt",
+	}
+
+	expired := expiredBackups(names, BackupRetention{Count: 2}, now)
+	sort.Strings(expired)
+
+	if strings.Join(expired, ",") != "backup-20260301T030000Z-10.tar.gz,backup-20260312T030000Z-70.tar.gz" {
+		t.Errorf("Expected the 2 oldest backups to expire, got %v", expired)
+	}
+
+	if expired := expiredBackups(names, BackupRetention{Days: 3}, now); len(expired) != 1 || expired[0] != "backup-20260301T030000Z-10.tar.gz" {
+		t.Errorf("Expected the backup older than 3 days to expire, got %v", expired)
+	}
+
+	if expired := expiredBackups(names[1:2], BackupRetention{Days: 1}, now); len(expired) != 0 {
+		t.Errorf("Expected the newest backup to be kept, got %v", expired)
+	}
+
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	local, err := openLocalBackupStorage(BackupScheduleConfig{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names[:2] {
+		if err := local.Put(ctx, name, []byte("backup")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := local.Delete(ctx, names[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if listed, err := local.List(ctx); err != nil || len(listed) != 1 || listed[0] != names[0] {
+		t.Errorf("Expected the local storage to list %v, got %v %v", names[0], listed, err)
+	}
+
+	// An S3 API holding the objects of the bucket.
+	objects := map[string]string{}
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+			t.Errorf("Unexpected authorization %q", r.Header.Get("Authorization"))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		object := strings.TrimPrefix(r.URL.Path, "/bucket/")
+
+		switch r.Method {
+
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			objects[object] = string(body)
+
+		case "DELETE":
+			delete(objects, object)
+			w.WriteHeader(http.StatusNoContent)
+
+		case "GET":
+			if r.URL.Path != "/bucket" || r.URL.Query().Get("prefix") != "prod/" {
+				t.Errorf("Unexpected listing %v", r.URL)
+			}
+
+			var contents strings.Builder
+			for key := range objects {
+				contents.WriteString("<Contents><Key>" + key + "</Key></Contents>")
+			}
+
+			w.Write([]byte("<ListBucketResult><IsTruncated>false</IsTruncated>" + contents.String() + "</ListBucketResult>"))
+
+		}
+	}))
+	defer api.Close()
+
+	s3, err := openS3BackupStorage(BackupScheduleConfig{Endpoint: api.URL, Bucket: "bucket", Prefix: "prod/", AccessKey: "key", SecretKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names[:2] {
+		if err := s3.Put(ctx, name, []byte("backup")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if objects["prod/"+names[0]] != "backup" {
+		t.Errorf("Expected the backup to be put under the prefix, got %v", objects)
+	}
+
+	if err := s3.Delete(ctx, names[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if listed, err := s3.List(ctx); err != nil || len(listed) != 1 || listed[0] != names[0] {
+		t.Errorf("Expected the s3 storage to list %v, got %v %v", names[0], listed, err)
+	}
+}
@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+ * This test case checks that a backup is read back with its metadata, that
+ * one not matching its checksum or digest is rejected, and that a fresh
+ * replica is restored from it as from a snapshot.
+ */
+func TestBackup(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	post := httptest.NewRequest(http.MethodPost, "/a", strings.NewReader(url.Values{"value": {"1"}}.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	kv.PostHandler(httptest.NewRecorder(), post)
+
+	stored := httptest.NewRecorder()
+	kv.SnapshotHandler(stored, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+
+	snapshot := bytes.NewBuffer(stored.Body.Bytes())
+	encodeSessions(snapshot, map[int64]clientSession{3: {LastSequence: 4, LastIndex: 9}})
+
+	digest, err := kv_store.VerifySnapshot(bytes.NewReader(snapshot.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := sha256.Sum256(snapshot.Bytes())
+
+	meta := BackupMetadata{
+		SnapshotDigest: SnapshotDigest{AppliedIndex: 9, Term: 2, Revision: digest.Revision, Digest: digest.Digest},
+		Members:        []Member{defaultMember(0), defaultMember(1), defaultMember(2)},
+		Leader:         1,
+		Created:        time.Unix(100, 0).UTC(),
+		Checksum:       hex.EncodeToString(checksum[:]),
+	}
+
+	var archive bytes.Buffer
+	if err := writeBackup(&archive, meta, snapshot.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isBackup(archive.Bytes()) || isBackup(snapshot.Bytes()) {
+		t.Errorf("Expected only the archive to be recognized as a backup")
+	}
+
+	read, contents, err := ReadBackup(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatalf("Unable to read the backup: %v", err)
+	}
+
+	if read.AppliedIndex != 9 || read.Term != 2 || len(read.Members) != 3 || read.Members[2].Address != ":5002" || !read.Created.Equal(meta.Created) {
+		t.Errorf("Unexpected metadata %+v", read)
+	}
+
+	if !bytes.Equal(contents, snapshot.Bytes()) {
+		t.Errorf("Expected the snapshot of the backup to be returned")
+	}
+
+	for name, change := range map[string]func(*BackupMetadata){
+		"checksum": func(m *BackupMetadata) { m.Checksum = "tampered" },
+		"digest":   func(m *BackupMetadata) { m.Digest = "tampered" },
+	} {
+
+		tampered := meta
+		change(&tampered)
+
+		var b bytes.Buffer
+		writeBackup(&b, tampered, snapshot.Bytes())
+
+		if _, _, err := ReadBackup(&b); err == nil {
+			t.Errorf("Expected a backup not matching its %v to be rejected", name)
+		}
+	}
+
+	if _, _, err := ReadBackup(bytes.NewReader(snapshot.Bytes())); err == nil {
+		t.Errorf("Expected a snapshot not to be read as a backup")
+	}
+
+	path := filepath.Join(dir, "cluster.backup")
+	if err := ioutil.WriteFile(path, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+
+	if err := RestoreSnapshot(path, 7, DataLayout{}); err != nil {
+		t.Fatalf("Expected the backup to be restored into a fresh replica: %v", err)
+	}
+
+	restored, err := ioutil.ReadFile("6007")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := kv_store.VerifySnapshot(bytes.NewReader(restored)); err != nil || d != digest {
+		t.Errorf("Expected the restored store to have the digest %v, got %v (%v)", digest, d, err)
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{raft_persistence_file: "3007"}, storage: NewStorage()}
+	node.RestoreFromStorage(node.storage)
+
+	if s, ok := node.sessions[3]; !ok || s.LastSequence != 4 {
+		t.Errorf("Expected session 3 to be restored, got %+v", node.sessions)
+	}
+}
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+/*
+Barriers, for the clients and tests needing a point in the history of the cluster: POST /admin/barrier
+commits a NO-OP entry through the log of the leader, and answers once the entry is applied on the
+leader, with its index and term. Every write acknowledged before the barrier was sent is then applied,
+and the replica was still the leader of the term once a quorum held the entry. The NO-OP doesn't
+change the state machine, so a barrier may be retried freely.
+
+A follower answers 503 with the address of the leader, like the other writes.
+*/
+
+// Commit a NO-OP entry and wait until it is applied, returning its index and term. Must be called
+// with the read lock held, which is released.
+func (node *RaftNode) Barrier(ctx context.Context, client string) (index int32, term int32, err error) {
+
+	if node.state != Leader {
+		node.ReleaseRLock("Barrier")
+		return -1, -1, errNotLeader
+	}
+
+	term = node.currentTerm
+
+	index, success, err := node.proposeCommand(ctx, []string{"NO-OP"}, client) // releases the lock
+	if err == nil && !success {
+		err = errors.New("the barrier could not be replicated on a majority of the members")
+	}
+	if err != nil {
+		return -1, -1, err
+	}
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		return -1, -1, err
+	}
+
+	node.Meta.metrics.Add("barriers_total", 1)
+	return index, term, nil
+}
+
+// Handle barrier requests, of the form POST /admin/barrier.
+func (node *RaftNode) BarrierHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("BARRIER request received")
+
+	node.GetRLock("Barrier Handler")
+
+	index, term, err := node.Barrier(r.Context(), r.FormValue("client")) // releases the lock
+
+	switch {
+
+	case err == errNotLeader:
+		node.GetRLock("Barrier Handler")
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Barrier Handler")
+		writeNotLeader(w, leader)
+		return
+
+	case err != nil:
+		node.logger().Error().Err(err).Msg("Error occured in BARRIER request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in BARRIER request: %v", err)
+		return
+
+	}
+
+	node.logger().Info().Int32("index", index).Int32("term", term).Msg("BARRIER request completed successfully and applied")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"index": index, "term": term, "leader_id": node.Meta.replica_id})
+}
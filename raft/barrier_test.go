@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that a barrier commits a NO-OP entry and answers
+ * once it is applied with its index and term, that it may be retried, and
+ * that a follower rejects the barriers.
+ */
+func TestBarrier(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "barrier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms(), Config: DefaultConfig(), n_replicas: 3, raft_persistence_file: filepath.Join(dir, "3000"), clock: NewManualClock(time.Unix(100, 0))}}
+	node.storage = NewStorage()
+	node.commits_ready = make(chan int32, 1)
+	node.trackMessage = make(map[string][]string)
+
+	node.state, node.currentTerm = Leader, 2
+	node.log = []protos.LogEntry{{Term: 2, Operation: []string{"NO-OP"}}}
+	node.nextIndex, node.matchIndex = []int32{1, 1, 1}, []int32{0, 0, 0}
+	node.last_contact = make(map[int32]time.Time)
+	node.Meta.peer_replica_clients = []Transport{nil, &probedTransport{reachable: true}, &probedTransport{reachable: true}}
+
+	// The committed entries are applied, as ApplyToStateMachine does.
+	go func() {
+		for range node.commits_ready {
+			node.GetLock("Test")
+			node.lastApplied = node.commitIndex
+			node.ReleaseLock("Test")
+		}
+	}()
+	defer close(node.commits_ready)
+
+	server := httptest.NewServer(http.HandlerFunc(node.BarrierHandler))
+	defer server.Close()
+
+	barrier := func() (int, map[string]int32) {
+
+		resp, err := http.Post(server.URL+"/admin/barrier", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var result map[string]int32
+		json.NewDecoder(resp.Body).Decode(&result)
+
+		return resp.StatusCode, result
+	}
+
+	if code, result := barrier(); code != http.StatusOK || result["index"] != 1 || result["term"] != 2 {
+		t.Fatalf("Expected the barrier to be applied at index 1 of term 2, got %v %v", code, result)
+	}
+
+	node.GetRLock("Test")
+	if node.log[1].Operation[0] != "NO-OP" || node.lastApplied != 1 {
+		t.Errorf("Expected a NO-OP to be committed and applied, got %v", node.log[1].Operation)
+	}
+	node.ReleaseRLock("Test")
+
+	// A barrier may be retried, and commits another NO-OP.
+	if code, result := barrier(); code != http.StatusOK || result["index"] != 2 {
+		t.Errorf("Expected the retried barrier to be applied at index 2, got %v %v", code, result)
+	}
+
+	if got := node.Meta.metrics.Get("barriers_total"); got != 2 {
+		t.Errorf("Expected 2 barriers to be counted, got %v", got)
+	}
+
+	node.GetLock("Test")
+	node.state = Follower
+	node.ReleaseLock("Test")
+
+	if code, _ := barrier(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a follower to reject the barriers, got %v", code)
+	}
+}
@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Batches of writes, submitted with POST /batch or the BatchPut method of the KVService. The
+operations of a batch are replicated as a single "TXN" log entry without comparisons, so they are
+committed with one round of consensus and applied atomically: bulk loads such as zone imports then
+pay the cost of a write once per batch rather than once per key.
+*/
+
+const (
+	maxBatchOps = 10000 // operations of a batch, which is also bounded by the size of the request
+)
+
+// The body of a POST /batch request.
+type BatchRequest struct {
+	Ops []kv_store.Op `json:"ops"`
+}
+
+type BatchResponse struct {
+	Changed int `json:"changed"` // Number of operations that modified the store, deletes of missing keys don't
+}
+
+/*
+Handle requests of the form /batch?client=<client>, with the operations as JSON in the body, e.g.
+{"ops": [{"type": "PUT", "key": "a", "value": "1"}, {"type": "DELETE", "key": "b"}]}. The response
+is sent once the batch is applied on the leader.
+*/
+func (node *RaftNode) BatchHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("BATCH request received")
+
+	// The body is decoded first, as parsing the form would otherwise consume it.
+	var batch BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid batch: %v", err)
+		return
+	}
+
+	session, sequence, err := requestSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+
+	node.GetRLock("Batch Handler")
+
+	if node.state != Leader {
+		node.rejectRequest(rejectNotLeader, r, errNotLeader)
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Batch Handler")
+		writeNotLeader(w, leader)
+		return
+	}
+
+	node.ReleaseRLock("Batch Handler")
+
+	result, err := node.replicateBatch(r.Context(), batch.Ops, r.FormValue("client"), session, sequence)
+	if err != nil {
+		node.logger().Error().Err(err).Int("ops", len(batch.Ops)).Msg("Error occured in BATCH request")
+		writeError(w, httpStatus(err), "Error: %v", status.Convert(err).Message())
+		return
+	}
+
+	node.logger().Info().Int("ops", len(batch.Ops)).Msg("BATCH request completed successfully and committed")
+	writeJSON(w, http.StatusOK, BatchResponse{Changed: len(result.Events)})
+}
+
+// Replicate the operations of a batch as a single transaction, see replicateTxn.
+func (node *RaftNode) replicateBatch(ctx context.Context, ops []kv_store.Op, client string, session, sequence int64) (kv_store.TxnResult, error) {
+
+	if len(ops) == 0 {
+		return kv_store.TxnResult{}, node.reject(rejectValidation, "BATCH", "", client, status.Error(codes.InvalidArgument, "a batch needs at least one operation"))
+	}
+
+	if len(ops) > maxBatchOps {
+		return kv_store.TxnResult{}, node.reject(rejectValidation, "BATCH", "", client, status.Errorf(codes.InvalidArgument, "a batch has at most %v operations, got %v", maxBatchOps, len(ops)))
+	}
+
+	for _, op := range ops {
+		if op.Type != kv_store.OpPut && op.Type != kv_store.OpDelete {
+			return kv_store.TxnResult{}, node.reject(rejectValidation, "BATCH", op.Key, client, status.Errorf(codes.InvalidArgument, "invalid operation type %q for key %q", op.Type, op.Key))
+		}
+	}
+
+	return node.replicateTxn(ctx, kv_store.Txn{Success: ops}, client, session, sequence)
+}
+
+// The HTTP status of the response to a request that failed with the given KVService error.
+func httpStatus(err error) int {
+
+	switch status.Code(err) {
+
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return http.StatusConflict
+
+	case codes.ResourceExhausted:
+		return http.StatusInsufficientStorage
+
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return http.StatusServiceUnavailable
+
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,62 @@
+package raft
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that invalid batches are rejected before being
+ * proposed, and that followers redirect batches to the leader.
+ */
+func TestBatchValidation(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections()}}
+
+	put := func(key string) kv_store.Op { return kv_store.Op{Type: kv_store.OpPut, Key: key, Value: "v"} }
+
+	for _, c := range []struct {
+		name string
+		ops  []kv_store.Op
+		code codes.Code
+	}{
+		{"empty batch", nil, codes.InvalidArgument},
+		{"too many operations", make([]kv_store.Op, maxBatchOps+1), codes.InvalidArgument},
+		{"invalid type", []kv_store.Op{put("a"), {Type: "GET", Key: "b"}}, codes.InvalidArgument},
+		{"invalid key", []kv_store.Op{put("a"), put("b/c")}, codes.InvalidArgument},
+		{"reserved key", []kv_store.Op{put("_settings:max_body_bytes")}, codes.PermissionDenied},
+		{"not a leader", []kv_store.Op{put("a"), {Type: kv_store.OpDelete, Key: "b"}}, codes.Unavailable},
+	} {
+		if _, err := node.replicateBatch(context.Background(), c.ops, "", 0, 0); status.Code(err) != c.code {
+			t.Errorf("%v: expected %v, got %v", c.name, c.code, err)
+		}
+	}
+
+	if rejections := node.Meta.rejections.List(rejectValidation, "", 0); len(rejections) != 5 {
+		t.Errorf("Expected 5 rejected batches, got %v", rejections)
+	}
+
+	// Over HTTP, a follower responds with the address of the leader.
+	node.Meta.leaderAddress = ":4001"
+
+	w := httptest.NewRecorder()
+	node.BatchHandler(w, httptest.NewRequest("POST", "/batch?client=c", strings.NewReader(`{"ops": [{"type": "PUT", "key": "a", "value": "1"}]}`)))
+
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Last known leader's address: :4001") {
+		t.Errorf("Unexpected response %v: %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	node.BatchHandler(w, httptest.NewRequest("POST", "/batch", strings.NewReader(`{"ops": `)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid body to be rejected, got %v: %q", w.Code, w.Body.String())
+	}
+}
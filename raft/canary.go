@@ -0,0 +1,342 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Progressive delivery of settings. A new value of a setting is first staged as canary.<name>, and only
+read instead of the current value by the replica whose ID is the canary_replica setting: both are
+replicated settings like any other, so every replica agrees on the canary and the staged values.
+
+While values are staged, the leader compares the server-side error rate of the canary with the one
+of the other members, from their /admin/metrics (gRPC requests failing with Internal, Unknown,
+Unavailable, DeadlineExceeded or DataLoss, and HTTP responses with a 5xx status) since the values
+were staged. If the canary served at least canaryMinRequests requests and its error rate exceeds
+the others' by more than canaryMaxErrorIncrease, the staged values are unset, which reverts the
+canary. Otherwise, the new values are rolled out by setting them, then unsetting the staged ones.
+
+The leader reaches the members at their client address, over HTTPS trusting PeerCAFile if the
+replicas serve HTTPS, and with HTTPAdminToken if the replicas require authentication.
+*/
+
+const (
+	CanaryPrefix           = "canary."        // Prefix of the staged values of the settings
+	CanaryReplicaSetting   = "canary_replica" // Setting holding the ID of the canary replica
+	canaryAuthor           = "canary"         // Author of the reverts in the audit history
+	canaryCheckInterval    = 10 * time.Second
+	canaryMinRequests      = 20
+	canaryMaxErrorIncrease = 0.05
+)
+
+// gRPC codes counted as server errors.
+var canaryErrorCodes = map[string]bool{"Internal": true, "Unknown": true, "Unavailable": true, "DeadlineExceeded": true, "DataLoss": true}
+
+// Requests and errors counted by a replica.
+type requestCounts struct {
+	requests float64
+	errors   float64
+}
+
+func (c requestCounts) sub(base requestCounts) requestCounts {
+	return requestCounts{requests: c.requests - base.requests, errors: c.errors - base.errors}
+}
+
+func (c requestCounts) rate() float64 {
+
+	if c.requests <= 0 {
+		return 0
+	}
+
+	return c.errors / c.requests
+}
+
+// Whether the error rate of the canary regressed, compared to the one of the other members.
+func canaryRegressed(canary, others requestCounts) bool {
+	return canary.requests >= canaryMinRequests && canary.rate() > others.rate()+canaryMaxErrorIncrease
+}
+
+// Count the requests and errors in the given series, as served at /admin/metrics.
+func countRequests(series map[string]float64) requestCounts {
+
+	var counts requestCounts
+
+	for key, value := range series {
+
+		switch {
+
+		case strings.HasPrefix(key, "grpc_server_handled_total{") && strings.Contains(key, "KVService"):
+			counts.requests += value
+			if canaryErrorCodes[metricLabel(key, "code")] {
+				counts.errors += value
+			}
+
+		case strings.HasPrefix(key, "http_requests_total{"):
+			counts.requests += value
+			if strings.HasPrefix(metricLabel(key, "code"), "5") {
+				counts.errors += value
+			}
+
+		}
+	}
+
+	return counts
+}
+
+// Return the value of the label in the series name, e.g. "OK" for code in x{code="OK"}.
+func metricLabel(key, label string) string {
+
+	start := strings.Index(key, label+"=\"")
+	if start < 0 {
+		return ""
+	}
+
+	value := key[start+len(label)+2:]
+	if end := strings.Index(value, "\""); end >= 0 {
+		return value[:end]
+	}
+
+	return ""
+}
+
+// Parse the metrics served in the Prometheus text format by Metrics.
+func parseMetrics(text string) map[string]float64 {
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+
+	for scanner.Scan() {
+
+		line := scanner.Text()
+
+		i := strings.LastIndex(line, " ")
+		if i <= 0 {
+			continue
+		}
+
+		if value, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			series[line[:i]] = value
+		}
+	}
+
+	return series
+}
+
+// The state of the canary being checked by the leader.
+type canaryCheck struct {
+	mu       sync.Mutex
+	staged   string                  // The canary and staged values the baselines were taken for
+	baseline map[int32]requestCounts // Counts of each member when the values were staged
+}
+
+// Return the canary replica and its staged values, formatted so that any change is noticed.
+func (node *RaftNode) stagedSettings() (int32, []string, string) {
+
+	all := node.Meta.settings.All()
+
+	id, err := strconv.Atoi(all[CanaryReplicaSetting])
+	if err != nil {
+		return -1, nil, ""
+	}
+
+	var names []string
+	for name := range all {
+		if strings.HasPrefix(name, CanaryPrefix) {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v", id)
+
+	for _, name := range names {
+		fmt.Fprintf(&b, ";%v=%q", name, all[name])
+	}
+
+	return int32(id), names, b.String()
+}
+
+// Job checking the canary and reverting its staged values if its error rate regressed.
+func (node *RaftNode) canaryJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "settings_canary",
+		Interval: canaryCheckInterval,
+		Run: func(ctx context.Context) error {
+
+			canary, staged, signature := node.stagedSettings()
+
+			node.canary.mu.Lock()
+			defer node.canary.mu.Unlock()
+
+			if len(staged) == 0 {
+				node.canary.staged, node.canary.baseline = "", nil
+				return nil
+			}
+
+			node.GetRLock("Canary Job")
+			members := append([]Member{}, node.Meta.members...)
+			node.ReleaseRLock("Canary Job")
+
+			counts := make(map[int32]requestCounts)
+			for _, m := range members {
+
+				series, err := node.memberMetrics(ctx, m)
+				if err != nil {
+					node.logger().Debug().Err(err).Int32("member_id", m.Id).Msg("Unable to fetch the metrics of a member")
+					continue
+				}
+
+				counts[m.Id] = countRequests(series)
+			}
+
+			// The counts are compared from the first check after the values were staged.
+			if signature != node.canary.staged {
+				node.canary.staged, node.canary.baseline = signature, counts
+				return nil
+			}
+
+			var canary_counts, others requestCounts
+			found := false
+
+			for id, c := range counts {
+
+				base, ok := node.canary.baseline[id]
+				if !ok {
+					continue
+				}
+
+				if id == canary {
+					canary_counts, found = c.sub(base), true
+				} else {
+					delta := c.sub(base)
+					others.requests += delta.requests
+					others.errors += delta.errors
+				}
+			}
+
+			if !found {
+				return fmt.Errorf("no metrics of the canary replica %v", canary)
+			}
+
+			node.Meta.metrics.Set("settings_canary_error_rate", canary_counts.rate(), "replica", "canary")
+			node.Meta.metrics.Set("settings_canary_error_rate", others.rate(), "replica", "others")
+
+			if !canaryRegressed(canary_counts, others) {
+				return nil
+			}
+
+			node.logger().Warn().Int32("canary", canary).Float64("error_rate", canary_counts.rate()).Float64("baseline_error_rate", others.rate()).
+				Strs("settings", staged).Msg("Error rate of the canary regressed, reverting its settings")
+
+			for _, name := range staged {
+				if err := node.proposeSetting(ctx, name, "", "UNSET", canaryAuthor); err != nil {
+					return err
+				}
+			}
+
+			node.Meta.metrics.Add("settings_canary_reverts_total", 1)
+			node.canary.staged, node.canary.baseline = "", nil
+
+			return nil
+		},
+	}
+}
+
+// Propose a change of a setting as its author, and wait for it to be applied.
+func (node *RaftNode) proposeSetting(ctx context.Context, name, value, action, author string) error {
+
+	node.GetRLock("Propose Setting")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Propose Setting")
+		return errNotLeader
+	}
+
+	index, success, err := node.proposeCommand(ctx, settingOperation(name, value, action, author), author) // releases the lock
+	if !success {
+		return err
+	}
+
+	return node.waitApplied(ctx, index)
+}
+
+// Fetch the metrics of a member from its client HTTP server.
+func (node *RaftNode) memberMetrics(ctx context.Context, m Member) (map[string]float64, error) {
+
+	if m.Id == node.Meta.replica_id {
+		return node.Meta.metrics.snapshot(), nil
+	}
+
+	client, scheme, err := node.memberHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	address := m.ClientAddress
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/admin/metrics", scheme, address), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.Meta.Config.HTTPAdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+node.Meta.Config.HTTPAdminToken)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v", resp.Status)
+	}
+
+	return parseMetrics(string(contents)), nil
+}
+
+// Return the client used to reach the HTTP servers of the other members, and its scheme.
+func (node *RaftNode) memberHTTPClient() (*http.Client, string, error) {
+
+	if node.Meta.Config.HTTPCertFile == "" {
+		return &http.Client{Timeout: 5 * time.Second}, "http", nil
+	}
+
+	config := &tls.Config{}
+
+	if node.Meta.Config.PeerCAFile != "" {
+
+		pem, err := ioutil.ReadFile(node.Meta.Config.PeerCAFile)
+		if err != nil {
+			return nil, "", err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(pem)
+	}
+
+	return &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{TLSClientConfig: config}}, "https", nil
+}
@@ -0,0 +1,52 @@
+package raft
+
+import "testing"
+
+/*
+ * This test case checks that only the canary replica reads the staged values
+ * of the settings, and that its error rate is compared with the one of the
+ * other members from their metrics.
+ */
+func TestSettingsCanary(t *testing.T) {
+
+	canary, other := NewSettings(), NewSettings()
+	canary.setReplica(1)
+	other.setReplica(2)
+
+	for _, s := range []*Settings{canary, other} {
+		s.apply(SettingChange{Name: "dns.forwarders", Action: "SET", Value: "1.1.1.1"})
+		s.apply(SettingChange{Name: "canary.dns.forwarders", Action: "SET", Value: "8.8.8.8"})
+		s.apply(SettingChange{Name: CanaryReplicaSetting, Action: "SET", Value: "1"})
+	}
+
+	if value, _ := canary.Get("dns.forwarders"); value != "8.8.8.8" {
+		t.Errorf("Expected the canary to read the staged value, got %v", value)
+	}
+
+	if value, _ := canary.stored("dns.forwarders"); value != "1.1.1.1" {
+		t.Errorf("Expected the stored value to be left unchanged, got %v", value)
+	}
+
+	if value, _ := other.Get("dns.forwarders"); value != "1.1.1.1" {
+		t.Errorf("Expected the other replicas to read the current value, got %v", value)
+	}
+
+	series := parseMetrics(metricKey("grpc_server_handled_total", []string{"method", "/protos.KVService/Put", "code", "OK"}) + " 70\n" +
+		metricKey("grpc_server_handled_total", []string{"method", "/protos.KVService/Put", "code", "Unavailable"}) + " 20\n" +
+		metricKey("grpc_server_handled_total", []string{"method", "/protos.ConsensusService/AppendEntries", "code", "Internal"}) + " 500\n" +
+		metricKey("http_requests_total", []string{"code", "200"}) + " 8\n" +
+		metricKey("http_requests_total", []string{"code", "503"}) + " 2\n")
+
+	counts := countRequests(series)
+	if counts.requests != 100 || counts.errors != 22 {
+		t.Fatalf("Expected 22 errors out of 100 client requests, got %+v", counts)
+	}
+
+	if !canaryRegressed(counts, requestCounts{requests: 1000, errors: 10}) {
+		t.Errorf("Expected an error rate of 22%% against 1%% to be a regression")
+	}
+
+	if canaryRegressed(counts, requestCounts{requests: 1000, errors: 200}) || canaryRegressed(requestCounts{requests: 5, errors: 5}, requestCounts{}) {
+		t.Errorf("Expected a similar error rate, or too few requests, not to be a regression")
+	}
+}
@@ -0,0 +1,513 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Change stream of the store, publishing every change applied to a key, including the records of the
+zones, to a Kafka topic or a NATS subject, so that downstream systems (search indexes, analytics)
+follow the changes without polling the HTTP API. It is enabled by the "change_stream" section of
+the config file:
+
+	{"change_stream": {"type": "kafka", "address": "http://kafka-rest.example.com:8082", "topic": "dns-changes"}}
+	{"change_stream": {"type": "nats", "address": "nats.example.com:4222", "subject": "dns.changes"}}
+
+The kafka publisher produces the changes to the topic through the Kafka REST proxy at the address
+(its v2 API), keyed by their offset; the nats publisher publishes them to the subject over the NATS
+protocol, with their offset as the Nats-Msg-Id header, so that a JetStream stream discards the
+duplicates. Every change is published as a JSON ChangeEvent, whose offset is the index of the log
+entry making it along with its position in the entry, e.g. "57.0": the offsets are the same on
+every replica, and increase along the stream.
+
+Every replica keeps the changes it applied in memory, up to the "buffer" of the section
+(changeStreamBuffer by default), the keys of the reserved namespaces aside, but only the leader
+publishes them, every changeStreamInterval. The index of the last entry published is recorded
+under ChangeStreamKey through the log (by the changeStreamClient client), so that the next leader
+resumes from it: the changes are published at least once, and again if the leader changes before
+recording them. If the changes since the index published last are no longer buffered (e.g. by a
+replica restored from a snapshot after they were applied), the missing ones are skipped, and counted
+in change_stream_gaps_total.
+
+The changes published are counted in change_stream_events_total, and the failed batches in
+change_stream_errors_total, retried at the next interval.
+*/
+
+const (
+	ChangeStreamKey = "_change_stream:published" // Key holding the index of the last entry published
+
+	changeStreamBuffer   = 100000          // Changes kept in memory at most, by default
+	changeStreamBatch    = 1000            // Changes published at once at most
+	changeStreamInterval = time.Second     // Interval of the publications of the leader
+	changeStreamTimeout  = 5 * time.Second // Time allowed for a batch to be published
+	changeStreamClient   = "change-stream" // Client of the transactions recording the publications
+)
+
+// The change stream of the config file.
+type ChangeStreamConfig struct {
+	Type    string `json:"type"`    // kafka, nats or a type registered with RegisterChangePublisher, disabled if empty
+	Address string `json:"address"` // URL of the Kafka REST proxy, or host:port of the NATS server
+	Topic   string `json:"topic"`   // Topic of a kafka publisher
+	Subject string `json:"subject"` // Subject of a nats publisher
+	Token   string `json:"token"`   // Authentication token of a nats publisher, if any
+	Buffer  int    `json:"buffer"`  // Changes kept in memory at most, changeStreamBuffer if 0
+}
+
+// A change of a key, as published to the change stream.
+type ChangeEvent struct {
+	Offset   string    `json:"offset"` // Index of the log entry making the change, and position in the entry
+	Index    int32     `json:"index"`
+	Term     int32     `json:"term"`
+	Key      string    `json:"key"`
+	Action   string    `json:"action"` // kv_store.OpPut or kv_store.OpDelete
+	Value    string    `json:"value,omitempty"`
+	Previous *string   `json:"previous,omitempty"` // Value of the key before the change, nil if it didn't exist
+	Client   string    `json:"client,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Time     time.Time `json:"time"` // Time at which the leader received the change
+}
+
+// A destination of the change stream. Publish is called with the changes in batches, from a single
+// goroutine, and returns once they are acknowledged.
+type ChangePublisher interface {
+	Publish(ctx context.Context, events []ChangeEvent) error
+	Close() error
+}
+
+// The types of the publishers, opening a publisher as configured.
+var changePublisherTypes = map[string]func(ChangeStreamConfig) (ChangePublisher, error){
+	"kafka": openKafkaPublisher,
+	"nats":  openNATSPublisher,
+}
+
+// Register a type of change publishers for the config files loaded afterwards. Not safe to call
+// concurrently with loading a config file or starting a replica.
+func RegisterChangePublisher(name string, open func(ChangeStreamConfig) (ChangePublisher, error)) error {
+
+	if name == "" || open == nil {
+		return fmt.Errorf("change publishers must have a name and an open function")
+	}
+
+	if _, ok := changePublisherTypes[name]; ok {
+		return fmt.Errorf("change publisher %v is already registered", name)
+	}
+
+	changePublisherTypes[name] = open
+
+	return nil
+}
+
+func (c ChangeStreamConfig) Validate() error {
+
+	if c.Type == "" {
+		return nil
+	}
+
+	if _, ok := changePublisherTypes[c.Type]; !ok {
+		return fmt.Errorf("change_stream: unknown type %q", c.Type)
+	}
+
+	switch {
+
+	case c.Buffer < 0:
+		return fmt.Errorf("change_stream: expected a non-negative buffer, got %v", c.Buffer)
+
+	case c.Type == "kafka" && (c.Address == "" || c.Topic == ""):
+		return fmt.Errorf("change_stream: a kafka publisher requires the address of its REST proxy and a topic")
+
+	case c.Type == "nats" && (c.Address == "" || c.Subject == ""):
+		return fmt.Errorf("change_stream: a nats publisher requires the address of its server and a subject")
+
+	}
+
+	return nil
+}
+
+// The changes applied by a replica, waiting to be published. The zero value is empty.
+type changeStream struct {
+	mu        sync.Mutex
+	events    []ChangeEvent
+	recording bool            // Whether the changes of an entry were kept already
+	dropped   int32           // Index of the last entry whose changes may be missing from the buffer
+	publisher ChangePublisher // Opened by the leader on its first publication
+}
+
+/*
+Keep the changes made by the data entry at the given index, if the change stream is enabled. Called
+in ApplyToStateMachine, once the entry is applied.
+*/
+func (node *RaftNode) recordChanges(entry *protos.LogEntry, index int32, result kv_store.TxnResult) {
+
+	config := node.Meta.Config
+	if config == nil || config.ChangeStream.Type == "" {
+		return
+	}
+
+	max := config.ChangeStream.Buffer
+	if max == 0 {
+		max = changeStreamBuffer
+	}
+
+	s := &node.changes
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The changes of the entries applied before, e.g. in a snapshot, aren't known.
+	if !s.recording {
+		s.recording, s.dropped = true, index-1
+	}
+
+	for i, event := range result.Events {
+
+		if reservedKey(event.Key) {
+			continue
+		}
+
+		change := ChangeEvent{
+			Offset:   fmt.Sprintf("%d.%d", index, i),
+			Index:    index,
+			Term:     entry.Term,
+			Key:      event.Key,
+			Action:   event.Type,
+			Value:    event.Value,
+			Previous: result.PreviousValue(i),
+			Client:   entry.Clientid,
+			User:     entry.User,
+		}
+
+		if entry.Timestamp != 0 {
+			change.Time = time.Unix(0, entry.Timestamp).UTC()
+		}
+
+		s.events = append(s.events, change)
+	}
+
+	if len(s.events) > max {
+		s.dropped = s.events[len(s.events)-max-1].Index
+		s.events = append([]ChangeEvent(nil), s.events[len(s.events)-max:]...)
+	}
+}
+
+// Return the changes of the entries after the index, changeStreamBatch at most but for those of the
+// last entry, and whether some of them are no longer buffered.
+func (s *changeStream) after(index int32) ([]ChangeEvent, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The changes of the entries up to the index were published.
+	start := 0
+	for start < len(s.events) && s.events[start].Index <= index {
+		start++
+	}
+	s.events = s.events[start:]
+
+	end := len(s.events)
+	if end > changeStreamBatch {
+
+		// The changes of an entry are published together, so that its index can be recorded.
+		end = changeStreamBatch
+		for end < len(s.events) && s.events[end].Index == s.events[end-1].Index {
+			end++
+		}
+	}
+
+	return append([]ChangeEvent(nil), s.events[:end]...), s.dropped > index
+}
+
+// Return the index of the last entry published, as recorded in the store. Must be called on the
+// leader, with the read lock held.
+func (node *RaftNode) publishedIndex() (int32, error) {
+
+	contents, status, err := node.readFromStore(url.PathEscape(ChangeStreamKey))
+	if err != nil {
+		return 0, err
+	}
+
+	if status != http.StatusOK || !strings.HasPrefix(contents, "Value = ") {
+		return 0, nil
+	}
+
+	index, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(contents, "Value = ")), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid published index %q", contents)
+	}
+
+	return int32(index), nil
+}
+
+// Job publishing the changes applied by the leader to the change stream, and recording the index
+// of the last entry published through the log.
+func (node *RaftNode) changeStreamJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "change_stream",
+		Interval: changeStreamInterval,
+		Run: func(ctx context.Context) error {
+
+			config := node.Meta.Config.ChangeStream
+			if config.Type == "" {
+				return nil
+			}
+
+			node.GetRLock("Change Stream Job")
+
+			if node.state != Leader {
+				node.ReleaseRLock("Change Stream Job")
+				return nil
+			}
+
+			published, err := node.publishedIndex()
+			node.ReleaseRLock("Change Stream Job")
+
+			if err != nil {
+				return err
+			}
+
+			events, gap := node.changes.after(published)
+			if gap {
+				node.logger().Warn().Int32("published", published).Msg("Some changes to publish are no longer buffered, skipping them")
+				node.Meta.metrics.Add("change_stream_gaps_total", 1)
+			}
+
+			if len(events) == 0 {
+				return nil
+			}
+
+			if node.changes.publisher == nil {
+				publisher, err := changePublisherTypes[config.Type](config) // checked by Validate
+				if err != nil {
+					return err
+				}
+				node.changes.publisher = publisher
+			}
+
+			publishCtx, cancel := context.WithTimeout(ctx, changeStreamTimeout)
+			defer cancel()
+
+			if err := node.changes.publisher.Publish(publishCtx, events); err != nil {
+				node.Meta.metrics.Add("change_stream_errors_total", 1)
+				return err
+			}
+
+			node.Meta.metrics.Add("change_stream_events_total", float64(len(events)))
+
+			last := strconv.FormatInt(int64(events[len(events)-1].Index), 10)
+			return node.proposeRecords(ctx, changeStreamClient, []kv_store.Op{{Type: kv_store.OpPut, Key: ChangeStreamKey, Value: last}})
+		},
+	}
+}
+
+// A publisher producing the changes to a Kafka topic, through the v2 API of the Kafka REST proxy.
+type kafkaPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func openKafkaPublisher(c ChangeStreamConfig) (ChangePublisher, error) {
+	return &kafkaPublisher{url: strings.TrimSuffix(c.Address, "/") + "/topics/" + url.PathEscape(c.Topic), client: &http.Client{Timeout: changeStreamTimeout}}, nil
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, events []ChangeEvent) error {
+
+	type record struct {
+		Key   string      `json:"key"`
+		Value ChangeEvent `json:"value"`
+	}
+
+	records := make([]record, len(events))
+	for i, event := range events {
+		records[i] = record{Key: event.Offset, Value: event}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("the Kafka REST proxy answered %v: %v", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+func (p *kafkaPublisher) Close() error {
+	return nil
+}
+
+/*
+A publisher publishing the changes to a NATS subject, over the text protocol of NATS. The connection
+is opened on the first batch, and again after a failure. A batch is acknowledged once the server
+answers the PING following it, having processed the messages before it.
+*/
+type natsPublisher struct {
+	config  ChangeStreamConfig
+	conn    net.Conn
+	reader  *bufio.Reader
+	headers bool // Whether the server supports the headers, carrying the offsets of the changes
+}
+
+func openNATSPublisher(c ChangeStreamConfig) (ChangePublisher, error) {
+	return &natsPublisher{config: c}, nil
+}
+
+// Connect to the server, reading its INFO and sending CONNECT.
+func (p *natsPublisher) connect(ctx context.Context) error {
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.config.Address)
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting of the NATS server: %q", strings.TrimSpace(line))
+	}
+
+	var info struct {
+		Headers bool `json:"headers"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "distributed-dns", "lang": "go", "version": "1", "protocol": 1, "headers": info.Headers}
+	if p.config.Token != "" {
+		options["auth_token"] = p.config.Token
+	}
+
+	encoded, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", encoded); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn, p.reader, p.headers = conn, reader, info.Headers
+
+	return nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, events []ChangeEvent) error {
+
+	if p.conn == nil {
+		if err := p.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := p.publish(ctx, events); err != nil {
+		p.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (p *natsPublisher) publish(ctx context.Context, events []ChangeEvent) error {
+
+	if deadline, ok := ctx.Deadline(); ok {
+		p.conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(p.conn)
+
+	for _, event := range events {
+
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		if p.headers {
+			header := "NATS/1.0\r\nNats-Msg-Id: " + event.Offset + "\r\n\r\n"
+			fmt.Fprintf(w, "HPUB %s %d %d\r\n%s", p.config.Subject, len(header), len(header)+len(payload), header)
+		} else {
+			fmt.Fprintf(w, "PUB %s %d\r\n", p.config.Subject, len(payload))
+		}
+
+		w.Write(payload)
+		w.WriteString("\r\n")
+	}
+
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	// The server answers the pings it sends, and reports the errors of the messages, before the PONG.
+	for {
+
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch line = strings.TrimSpace(line); {
+
+		case line == "PONG":
+			return nil
+
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("the NATS server answered %v", line)
+
+		}
+	}
+}
+
+func (p *natsPublisher) Close() error {
+
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.Close()
+	p.conn, p.reader = nil, nil
+
+	return err
+}
@@ -0,0 +1,204 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the changes applied are kept for the change
+ * stream, the reserved keys aside, with the index of their entry as offset,
+ * that the leader publishes those after the index published last, reporting
+ * the ones no longer buffered, and that the kafka and nats publishers send
+ * them along with their offsets.
+ */
+func TestChangeStream(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "changestream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig(), clock: NewManualClock(time.Unix(1000, 0))}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.Config.ChangeStream = ChangeStreamConfig{Type: "kafka", Address: "http://localhost", Topic: "changes", Buffer: 3}
+	node.watches = NewWatchHub()
+	node.reads = newReadCoalescer(func() bool { return true })
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}}
+
+	apply := func(operation ...string) {
+		node.log = append(node.log, protos.LogEntry{Term: 1, Operation: operation, Clientid: "c1"})
+		if !node.applyEntry(int32(len(node.log) - 1)) {
+			t.Fatalf("Unable to apply %v", operation)
+		}
+	}
+
+	apply("POST", "dns:www.example.com.:A", "v1")
+	apply("PUT", "dns:www.example.com.:A", "v2")
+	apply("POST", SettingsPrefix+"x", "reserved")
+	apply("DELETE", "dns:www.example.com.:A")
+
+	events, gap := node.changes.after(0)
+	if gap || len(events) != 3 {
+		t.Fatalf("Expected the 3 changes of the record, got %+v %v", events, gap)
+	}
+
+	if events[0].Offset != "1.0" || events[0].Value != "v1" || events[0].Previous != nil || events[0].Client != "c1" {
+		t.Errorf("Unexpected creation %+v", events[0])
+	}
+
+	if deleted := events[2]; deleted.Offset != "4.0" || deleted.Action != kv_store.OpDelete || deleted.Previous == nil || *deleted.Previous != "v2" {
+		t.Errorf("Unexpected deletion %+v", deleted)
+	}
+
+	// The changes published are forgotten.
+	if events, gap := node.changes.after(2); gap || len(events) != 1 || events[0].Index != 4 {
+		t.Errorf("Expected only the change after the index published, got %+v %v", events, gap)
+	}
+
+	// Beyond the buffer, the oldest changes are dropped.
+	apply("POST", "app.a", "1")
+	apply("POST", "app.b", "2")
+	apply("POST", "app.c", "3")
+	apply("POST", "app.d", "4")
+
+	events, gap = node.changes.after(2)
+	if !gap || len(events) != 3 || events[0].Key != "app.b" {
+		t.Errorf("Expected the changes of app.a and before to be missing, got %+v %v", events, gap)
+	}
+
+	if _, gap := node.changes.after(6); gap {
+		t.Error("Expected no changes to be missing after the ones dropped")
+	}
+
+	// The published index, recorded by the leader as the job does.
+	encoded, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: ChangeStreamKey, Value: "7"}}})
+	apply("TXN", string(encoded))
+	node.state = Leader
+
+	node.GetRLock("Test")
+	published, err := node.publishedIndex()
+	node.ReleaseRLock("Test")
+
+	if err != nil || published != 7 {
+		t.Errorf("Expected the published index 7, got %v %v", published, err)
+	}
+
+	// A Kafka REST proxy.
+	var records []struct {
+		Key   string      `json:"key"`
+		Value ChangeEvent `json:"value"`
+	}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var body struct {
+			Records json.RawMessage `json:"records"`
+		}
+
+		if r.URL.Path != "/topics/changes" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			t.Errorf("Unexpected request of %v, of %v", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		json.NewDecoder(r.Body).Decode(&body)
+		json.Unmarshal(body.Records, &records)
+	}))
+	defer proxy.Close()
+
+	kafka, _ := openKafkaPublisher(ChangeStreamConfig{Address: proxy.URL + "/", Topic: "changes"})
+	if err := kafka.Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3 || records[0].Key != "6.0" || records[0].Value.Key != "app.b" {
+		t.Errorf("Unexpected records %+v", records)
+	}
+
+	// A NATS server supporting the headers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ids := make(chan []string, 1)
+
+	go func() {
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte("INFO {\"server_id\":\"test\",\"headers\":true}\r\n"))
+
+		reader := bufio.NewReader(conn)
+		var received []string
+
+		for {
+
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+
+			switch fields[0] {
+
+			case "HPUB":
+				size, _ := strconv.Atoi(fields[3])
+				message := make([]byte, size+2)
+				if _, err := io.ReadFull(reader, message); err != nil {
+					return
+				}
+
+				headers := strings.SplitN(string(message), "\r\n\r\n", 2)[0]
+				received = append(received, fields[1]+" "+strings.TrimPrefix(strings.Split(headers, "\r\n")[1], "Nats-Msg-Id: "))
+
+			case "PING":
+				conn.Write([]byte("PONG\r\n"))
+				ids <- received
+				received = nil
+
+			}
+		}
+	}()
+
+	nats, _ := openNATSPublisher(ChangeStreamConfig{Address: listener.Addr().String(), Subject: "dns.changes"})
+	defer nats.Close()
+
+	if err := nats.Publish(context.Background(), events[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-ids; len(got) != 2 || got[0] != "dns.changes 6.0" || got[1] != "dns.changes 7.0" {
+		t.Errorf("Unexpected messages %v", got)
+	}
+}
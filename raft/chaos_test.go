@@ -0,0 +1,74 @@
+//go:build faults
+// +build faults
+
+package raft
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/linearizability"
+)
+
+var (
+	chaosDuration = flag.Duration("chaos.duration", 15*time.Second, "duration of the workload of TestChaos")
+	chaosSeed     = flag.Int64("chaos.seed", 0, "seed of the faults and the workload of TestChaos, the current time if 0")
+)
+
+const (
+	chaosReplicas = 3
+	chaosClients  = 3
+	chaosKeys     = 3
+	chaosFaults   = "drop=0.02,delay=0.1:30ms,duplicate=0.05,crash=6s,corrupt=0.5"
+)
+
+/*
+ * This test case runs a cluster of real replica processes, built with the
+ * faults tag, under the faults listed in chaosFaults: RPCs between replicas
+ * are dropped, delayed and duplicated, and replicas crash at random (at times
+ * in the middle of writing their files), the test restarting them. Clients
+ * meanwhile create, read and overwrite a few keys, and the history of their
+ * operations is checked for linearizability (see the linearizability package).
+ * A write whose outcome is unknown (e.g. timed out) may or may not have taken
+ * effect.
+ *
+ * Run it with go test -tags faults ./raft -run TestChaos, and -chaos.seed to
+ * replay the faults and the workload of a run (though not the scheduling).
+ */
+func TestChaos(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("runs a cluster of processes")
+	}
+
+	seed := *chaosSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	cluster := startProcessCluster(t, chaosReplicas, "faults", chaosFaults, seed)
+	defer cluster.close()
+
+	history := cluster.runWorkload(chaosClients, *chaosDuration, func(random *rand.Rand, client, n int) linearizability.KVInput {
+
+		in := linearizability.KVInput{Op: linearizability.KVGet, Key: fmt.Sprintf("chaos%v", random.Intn(chaosKeys))}
+
+		switch random.Intn(4) {
+		case 0:
+			in.Op, in.Value = linearizability.KVCreate, fmt.Sprintf("c%v-%v", client, n)
+		case 1:
+			in.Op, in.Value = linearizability.KVPut, fmt.Sprintf("c%v-%v", client, n)
+		}
+
+		return in
+	})
+
+	cluster.stop()
+
+	done := checkHistory(t, seed, history)
+
+	t.Logf("seed %v: %v operations completed, %v with an unknown outcome, %v restarts of replicas", seed, done, len(history)-done, cluster.restarts)
+}
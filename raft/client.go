@@ -1,15 +1,23 @@
 package raft
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"reflect"
 	"time"
 
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Errors returned by proposeCommand that callers may need to tell apart.
+var (
+	errNotLeader      = errors.New("\nNot a leader.\n")
+	errDuplicateWrite = errors.New("Write operation failed. Already received identical write request from identical clientid.")
+	errNoValue        = errors.New("no value exists for given key in the store") // Wrapped by the errors of the PUT and DELETE of a missing key
 )
 
 /*
@@ -18,9 +26,103 @@ a write (POST/PUT/DELETE) request. It parses the command and calls LeaderSendAEs
 performing the write. If the write request is successfully persisted across a majority
 of replicas, it informs ApplyToStateMachine to perform the write operation on the key-value store.
 */
-func (node *RaftNode) WriteCommand(operation []string, client string) (bool, error) {
+func (node *RaftNode) WriteCommand(ctx context.Context, operation []string, client string) (bool, error) {
 
-	for node.commitIndex != node.lastApplied {
+	_, success, err := node.proposeCommand(ctx, operation, client)
+	return success, err
+
+}
+
+/*
+proposeCommand performs the write like WriteCommand, additionally returning the index of the
+log entry created for it. Like WriteCommand, it must be called with the read lock held, and
+returns with no lock held.
+
+If ctx is done before the write is replicated, ctx.Err() is returned right away: the write is
+abandoned if it wasn't appended to the log yet, and is otherwise still committed in the background.
+*/
+func (node *RaftNode) proposeCommand(ctx context.Context, operation []string, client string) (index int32, success bool, err error) {
+	return node.proposeSessionCommand(ctx, operation, client, 0, 0)
+}
+
+/*
+proposeSessionCommand performs the write like proposeCommand, as part of the given client session
+(see sessions.go). If the session already applied the sequence number, the write isn't proposed
+again: the index of the entry that applied it is returned right away.
+*/
+func (node *RaftNode) proposeSessionCommand(ctx context.Context, operation []string, client string, session, sequence int64) (index int32, success bool, err error) {
+
+	start := time.Now()
+
+	ctx, span := startChildSpan(ctx, "raft.propose", trace.WithAttributes(attribute.String("raft.operation", operation[0])))
+	defer func() {
+		span.SetAttributes(attribute.Int("raft.index", int(index)))
+		endSpan(span, err)
+	}()
+
+	// The settings can only be changed through "SETTING" entries.
+	if (operation[0] == "POST" || operation[0] == "PUT" || operation[0] == "DELETE") && reservedKey(operation[1]) {
+		node.ReleaseRLock("WriteCommand0")
+		return -1, false, node.rejectProposal(rejectValidation, operation, client, errReservedKey)
+	}
+
+	// The writes of a zone replicated from, or delegated to, another cluster go to that cluster, see federation.go and delegation.go
+	if operation[0] == "POST" || operation[0] == "PUT" || operation[0] == "DELETE" {
+		if err := node.checkFederatedWrite(operation[1]); err != nil {
+			node.ReleaseRLock("WriteCommand0")
+			return -1, false, node.rejectProposal(rejectFederation, operation, client, err)
+		}
+
+		// Likewise for the keys belonging to another group, see shards.go
+		if err := node.checkShardWrite(operation[1]); err != nil {
+			node.ReleaseRLock("WriteCommand0")
+			return -1, false, node.rejectProposal(rejectShard, operation, client, err)
+		}
+	}
+
+	// The writes of the clients are rejected while the cluster is read-only, see readonly.go
+	if err := node.checkReadOnly(operation); err != nil {
+		node.ReleaseRLock("WriteCommand0")
+		return -1, false, node.rejectProposal(rejectReadOnly, operation, client, err)
+	}
+
+	// Writes adding data are rejected while an alarm is raised, see alarms.go.
+	if err := node.checkAlarms(operation); err != nil {
+		node.ReleaseRLock("WriteCommand0")
+		return -1, false, node.rejectProposal(rejectAlarm, operation, client, err)
+	}
+
+	// The writes of the clients are checked by the external authorization service, if any, without
+	// holding the lock while it decides, see authz.go
+	if node.Meta.authorizer != nil && clientWrite(operation) {
+
+		node.ReleaseRLock("WriteCommand0")
+		err := node.authorizeWrite(ctx, operation, client)
+		node.GetRLock("WriteCommand0")
+
+		if err != nil {
+			node.ReleaseRLock("WriteCommand0")
+			return -1, false, node.rejectProposal(rejectACL, operation, client, err)
+		}
+	}
+
+	// The proposal is pending until committed, see admission.go. Only the writes of the clients are
+	// refused once too many are pending, not those of the replicas (e.g. raising an alarm).
+	if err := node.enterQueue(clientWrite(operation)); err != nil {
+		node.ReleaseRLock("WriteCommand0")
+		return -1, false, node.rejectProposal(rejectBackpressure, operation, client, err)
+	}
+
+	queued := true
+	defer func() {
+		if queued {
+			node.leaveQueue()
+		}
+	}()
+
+	// Nothing is proposed once the client stopped waiting for the write (e.g. its deadline passed),
+	// including while the previous writes are applied.
+	for node.commitIndex != node.lastApplied && ctx.Err() == nil {
 
 		node.ReleaseRLock("WriteCommand1") // Lock was acquired in the respective calling Handler function in raft_server.go
 		time.Sleep(20 * time.Millisecond)
@@ -28,18 +130,39 @@ func (node *RaftNode) WriteCommand(operation []string, client string) (bool, err
 
 	}
 
+	if ctx.Err() != nil {
+		node.ReleaseRLock("WriteCommand1")
+		return -1, false, ctx.Err()
+	}
+
 	// TODO: make the below upgrade of the mutex lock atomic.
 	node.ReleaseRLock("WriteCommand2")
 	node.GetLock("WriteCommand1")
 
-	if node.state != Leader {
+	// Writes are rejected while leadership is handed over, so that the target can catch up with the log.
+	if node.state != Leader || node.transferring {
 		defer node.ReleaseLock("WriteCommand1")
-		return false, errors.New("\nNot a leader.\n")
+		return -1, false, node.rejectProposal(rejectNotLeader, operation, client, errNotLeader)
 	}
 
 	var equal bool
 	var Err error
 
+	if session != 0 {
+
+		applied, err := node.checkSessionWrite(session, sequence)
+
+		if err != nil {
+			defer node.ReleaseLock("WriteCommand2")
+			return -1, false, node.rejectProposal(rejectSession, operation, client, err)
+		}
+
+		if applied != -1 {
+			defer node.ReleaseLock("WriteCommand2")
+			return applied, true, nil
+		}
+	}
+
 	lastClientOper, val := node.trackMessage[client] //lastClientOper is the operation done by the given client previously
 
 	/**
@@ -49,16 +172,17 @@ func (node *RaftNode) WriteCommand(operation []string, client string) (bool, err
 	* same, then we reject it.
 	* TODO: implement the functionality for DELETE. DELETE requests are not allowed to
 	* have a request body.
+	* Writes of a client session are deduplicated by their sequence numbers instead.
 	 */
-	if val && (operation[0] != "DELETE") && (operation[0] != "NO-OP") {
+	if val && session == 0 && (operation[0] != "DELETE") && (operation[0] != "DELETE_PREFIX") && (operation[0] != "NO-OP") {
 		equal = reflect.DeepEqual(lastClientOper, operation)
 		equal = equal && client == node.Meta.latestClient
 	}
 
 	if equal {
-		Err = errors.New("Write operation failed. Already received identical write request from identical clientid.")
+		Err = errDuplicateWrite
 		defer node.ReleaseLock("WriteCommand2")
-		return false, Err
+		return -1, false, node.rejectProposal(rejectDuplicate, operation, client, Err)
 	}
 
 	// If it's a PUT or DELETE request, ensure that the resource exists.
@@ -69,19 +193,30 @@ func (node *RaftNode) WriteCommand(operation []string, client string) (bool, err
 		response, err := node.ReadCommand(operation[1])
 
 		if err == nil && response == "Invalid key value pair\n" {
-			prnt_str := fmt.Sprintf("\nUnable to perform %v request, no value exists for given key in the store.\n", operation[0])
 			node.ReleaseRLock("WriteCommand3")
-			return false, errors.New(prnt_str)
+			return -1, false, node.rejectProposal(rejectValidation, operation, client, fmt.Errorf("\nUnable to perform %v request, %w.\n", operation[0], errNoValue))
 		}
 
 		node.ReleaseRLock("WriteCommand4")
 		node.GetLock("WriteCommand2")
 	}
 
-	node.Meta.latestClient = client
+	if ctx.Err() != nil {
+		node.ReleaseLock("WriteCommand2")
+		return -1, false, ctx.Err()
+	}
+
+	// A membership change is checked again, and built from the current configuration, as the lock was
+	// released since its handler checked it, see configChange in membership.go
+	if operation[0] == "CONFIG" {
+
+		if err := node.recheckConfig(ctx, operation); err != nil {
+			node.ReleaseLock("WriteCommand2")
+			return -1, false, node.rejectProposal(rejectConfig, operation, client, err)
+		}
+	}
 
-	var entries []*protos.LogEntry
-	entries = append(entries, &node.log[len(node.log)-1])
+	node.Meta.latestClient = client
 
 	msg := &protos.AppendEntriesMessage{
 
@@ -93,30 +228,96 @@ func (node *RaftNode) WriteCommand(operation []string, client string) (bool, err
 	}
 
 	//append to local log
-	node.log = append(node.log, protos.LogEntry{Term: node.currentTerm, Operation: operation, Clientid: client})
+	node.log = append(node.log, protos.LogEntry{Term: node.currentTerm, Operation: operation, Clientid: client, Traceparent: traceparent(ctx), Session: session, Sequence: sequence, Timestamp: node.now().UnixNano(), User: proposingUser(ctx)})
+	index = node.lastLogIndex()
+
+	// A new configuration is used as soon as it is appended to the log.
+	if operation[0] == "CONFIG" {
+		node.refreshMembership()
+	}
 
 	successful_write := make(chan bool)
 
-	node.LeaderSendAEs(operation[0], msg, int32(len(node.log)-1), successful_write)
+	node.LeaderSendAEs(ctx, operation[0], msg, index, successful_write)
+
+	p, async := asyncWrite(ctx)
+	if async {
+		p.term = msg.Term
+	}
 
 	node.ReleaseLock("WriteCommand4")
 
-	success := <-successful_write //Written to from AE when majority of nodes have replicated the write or failure occurs
+	// Once appended to the log, the entry may already be held by the peers, so it is committed
+	// even if the client stops waiting for the outcome.
+	committed := make(chan bool, 1)
 
-	if success {
+	queued = false
 
-		node.GetLock("WriteCommand3")
-		node.commitIndex++
-		node.trackMessage[client] = operation
-		node.PersistToStorage()
-		node.ReleaseLock("WriteCommand5")
-		node.commits_ready <- 1
+	go func() {
 
-	} else {
+		defer node.leaveQueue()
+
+		replicated := <-successful_write //Written to from AE when majority of nodes have replicated the write or failure occurs
+
+		if replicated {
+
+			node.GetLock("WriteCommand3")
+			node.commitReplicated(index, msg.Term)
+			node.trackMessage[client] = operation
+			node.PersistToStorage()
+			node.ReleaseLock("WriteCommand5")
+			node.notifyCommits()
+
+		}
+
+		committed <- replicated
+
+	}()
+
+	// Asynchronous writes are acknowledged once appended to the log, see async.go.
+	if async {
+		return index, true, nil
+	}
+
+	select {
+
+	case success = <-committed:
+
+	case <-ctx.Done():
+		return index, false, ctx.Err()
+
+	}
+
+	if !success {
 		Err = errors.New("Write operation failed. Write could not be replicated on majority of nodes.")
+	} else {
+		node.Meta.snapshots.observe(time.Since(start)) // see throttle.go
 	}
 
-	return success, Err
+	return index, success, Err
+
+}
+
+// Wait until the log entry at the given index has been applied to the state machine, or the context is done.
+func (node *RaftNode) waitApplied(ctx context.Context, index int32) error {
+
+	for {
+
+		node.GetRLock("waitApplied")
+		applied := node.lastApplied >= index
+		node.ReleaseRLock("waitApplied")
+
+		if applied {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(20 * time.Millisecond):
+		}
+
+	}
 
 }
 
@@ -125,49 +326,85 @@ ReadCommand is called when the client sends the replica a read request.
 Read operations do not need to be added to the log.
 */
 func (node *RaftNode) ReadCommand(key string) (string, error) {
+
+	contents, _, err := node.readFromStore(key)
+	return contents, err
+
+}
+
+/*
+readFromStore performs a linearizable read of the given path (relative to the local
+key-value store's address), and returns the response body along with its status code.
+Concurrent reads share the confirmation of the leadership, see reads.go.
+*/
+func (node *RaftNode) readFromStore(path string) (string, int, error) {
+
 	for node.commitIndex != node.lastApplied {
 		node.ReleaseRLock("ReadCommand1")
 		time.Sleep(20 * time.Millisecond)
 		node.GetRLock("ReadCommand1")
 	}
 
-	heartbeat_success := make(chan bool)
-	node.StaleReadCheck(heartbeat_success)
-	node.ReleaseRLock("ReadCommand2")
-	status := <-heartbeat_success
+	node.Meta.metrics.Add("linearizable_reads_total", 1)
 
+	node.ReleaseRLock("ReadCommand2")
+	round := node.reads.wait()
 	node.GetRLock("ReadCommand2")
 
-	if (status == true) && (node.state == Leader) {
-
-		url := fmt.Sprintf("http://localhost%s/%s", node.Meta.kvstore_addr, key)
-
-		resp, err := http.Get(url)
+	if round.ok && (node.state == Leader) {
 
+		contents, status, err := round.read(path, node.fetchFromStore)
 		if err == nil {
+			return contents, status, nil
+		}
+	}
 
-			defer resp.Body.Close()
-			contents, err2 := ioutil.ReadAll(resp.Body)
+	return "unable to perform read", 0, errors.New("read_failed")
 
-			if err2 != nil {
-				log.Printf(Red + "[Error]" + Reset + ": " + err2.Error())
-				return "unable to perform read", err2
+}
 
-			}
+// Read the given path from the local key-value store.
+func (node *RaftNode) fetchFromStore(path string) (string, int, error) {
 
-			log.Printf("\nREAD successful.\n")
+	contents, status, err := node.stateMachine().Lookup(path)
 
-			return string(contents), nil
+	if err != nil {
+		node.logger().Error().Err(err).Str("path", path).Msg("Unable to read from the key-value store")
+		return "", 0, err
+	}
 
-		} else {
+	node.logger().Debug().Str("path", path).Msg("READ successful")
 
-			log.Printf(Red + "[Error]" + Reset + ": " + err.Error())
+	// Clients can't read the records of the users, see users.go
+	if hidden := hideUsers(path, contents); hidden != contents {
 
+		if hidden == "Invalid key value pair\n" {
+			status = http.StatusNotFound
 		}
+
+		return hidden, status, nil
+	}
+
+	return contents, status, nil
+}
+
+// Confirm that the replica is still the leader, by exchanging heartbeats with a majority of the replicas.
+func (node *RaftNode) confirmLeadership() bool {
+
+	node.GetRLock("confirmLeadership")
+
+	if node.state != Leader {
+		node.ReleaseRLock("confirmLeadership1")
+		return false
 	}
 
-	return "unable to perform read", errors.New("read_failed")
+	node.Meta.metrics.Add("read_index_rounds_total", 1)
+
+	heartbeat_success := make(chan bool)
+	node.StaleReadCheck(heartbeat_success)
+	node.ReleaseRLock("confirmLeadership2")
 
+	return <-heartbeat_success
 }
 
 // StaleReadCheck sends dummy heartbeats to make sure that a new leader has not been elected.
@@ -182,5 +419,5 @@ func (node *RaftNode) StaleReadCheck(heartbeat_success chan bool) {
 		LeaderAddr:   node.Meta.nodeAddress,
 	}
 
-	node.LeaderSendAEs("HBEAT", hbeat_msg, int32(len(node.log)-1), heartbeat_success)
+	node.LeaderSendAEs(context.Background(), "HBEAT", hbeat_msg, node.lastLogIndex(), heartbeat_success)
 }
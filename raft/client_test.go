@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+)
+
+/*
+ * This test case checks that a write fails once its deadline passes while
+ * the previous writes are being applied, that the KVService writes sent
+ * without a deadline are given the write timeout, and that the outcome of
+ * the replication of an entry is always sent, even without connections to
+ * the peers.
+ */
+func TestWriteDeadlines(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms(), Config: DefaultConfig(), n_replicas: 3, members: []Member{{Id: 0}, {Id: 1}, {Id: 2}}, clock: NewManualClock(time.Unix(100, 0))}}
+
+	node.state, node.currentTerm = Leader, 1
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}, {Term: 1, Operation: []string{"NO-OP"}}}
+	node.commitIndex, node.lastApplied = 1, 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	node.GetRLock("Test")
+	if _, success, err := node.proposeSessionCommand(ctx, []string{"POST", "key", "value"}, "", 0, 0); success || err != context.DeadlineExceeded {
+		t.Errorf("Expected the write to fail with its deadline while the log isn't applied, got %v", err)
+	}
+
+	if len(node.log) != 2 || node.proposals.pending != 0 {
+		t.Errorf("Expected the write not to be proposed, got %v entries and %v pending", len(node.log), node.proposals.pending)
+	}
+
+	var deadline time.Time
+	var has_deadline bool
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		deadline, has_deadline = ctx.Deadline()
+		return nil, nil
+	}
+
+	node.deadlineUnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/protos.KVService/Put"}, handler)
+	if !has_deadline || time.Until(deadline) > node.Meta.Config.WriteRouteTimeout {
+		t.Errorf("Expected a write without a deadline to be given the write timeout")
+	}
+
+	short, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	node.deadlineUnaryInterceptor(short, nil, &grpc.UnaryServerInfo{FullMethod: "/protos.KVService/Put"}, handler)
+	if want, _ := short.Deadline(); deadline != want {
+		t.Errorf("Expected the deadline of the client to be kept, got %v", deadline)
+	}
+
+	node.deadlineUnaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/protos.KVService/Get"}, handler)
+	if has_deadline {
+		t.Errorf("Expected the reads to be left without a deadline")
+	}
+
+	replicate := func() bool {
+
+		success := make(chan bool)
+		node.LeaderSendAEs(context.Background(), "TEST", &protos.AppendEntriesMessage{Term: 1}, 1, success)
+
+		select {
+		case replicated := <-success:
+			return replicated
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the outcome of the replication to be sent")
+		}
+
+		return false
+	}
+
+	// Neither peer is connected.
+	node.Meta.peer_replica_clients = []Transport{nil, nil, nil}
+
+	if replicate() {
+		t.Errorf("Expected the entry not to be replicated without peers")
+	}
+
+	// A single replica is its own quorum.
+	node.Meta.n_replicas = 1
+	node.Meta.peer_replica_clients = []Transport{nil}
+
+	if !replicate() {
+		t.Errorf("Expected the entry to be replicated by a single replica")
+	}
+}
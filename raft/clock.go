@@ -0,0 +1,154 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+The clock used by the time-based logic of a replica, such as the health of the members (see
+membership.go). Replicas use the wall clock, unless built with the testclock tag: they then start with
+a ManualClock, which only moves when advanced through /admin/clock (see clock_testclock.go), so that
+integration tests can step over timeouts deterministically instead of sleeping. Unit tests can set a
+ManualClock on the node directly.
+
+The Raft timers (elections, heartbeats) run on the wall clock too, unless the replica is given a
+TimerClock for them, like the ManualClock of the simulation tests (see simulation_test.go), along
+with a seeded source of election timeouts. This isn't done by the testclock builds, whose replicas
+would otherwise never elect a leader. Request deadlines aren't simulated: the simulation times the
+RPCs out on the ManualClock through its MemoryNetwork instead (see transport.go).
+*/
+type Clock interface {
+	Now() time.Time
+}
+
+// A clock that timers can wait on.
+type TimerClock interface {
+	Clock
+	After(d time.Duration) <-chan time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// A clock that only moves when advanced, safe for concurrent use.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []manualTimer
+}
+
+// A timer of a ManualClock, firing once the clock reaches its deadline.
+type manualTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Move the clock forward by d, returning the new time.
+func (c *ManualClock) Advance(d time.Duration) time.Time {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			pending = append(pending, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = pending
+
+	return c.now
+}
+
+/*
+Fire the earliest timer due by the given time, moving the clock to its deadline, and return true; or
+move the clock to the given time if no timer is due by then, and return false. Unlike Advance, the
+timers due at once fire one at a time, in the order of their deadlines (then of their creation), so
+that a caller waiting for the goroutines to react to each in turn runs them in a deterministic order.
+*/
+func (c *ManualClock) Fire(until time.Time) bool {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	next := -1
+	for i, w := range c.waiters {
+		if !w.deadline.After(until) && (next < 0 || w.deadline.Before(c.waiters[next].deadline)) {
+			next = i
+		}
+	}
+
+	if next < 0 {
+		if until.After(c.now) {
+			c.now = until
+		}
+		return false
+	}
+
+	w := c.waiters[next]
+	c.waiters = append(c.waiters[:next], c.waiters[next+1:]...)
+
+	if w.deadline.After(c.now) {
+		c.now = w.deadline
+	}
+
+	w.c <- c.now
+	return true
+}
+
+// Return a channel receiving the time once the clock was advanced by d, like time.After.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+
+	if d <= 0 {
+		ch <- c.now
+	} else {
+		c.waiters = append(c.waiters, manualTimer{deadline: c.now.Add(d), c: ch})
+	}
+
+	return ch
+}
+
+// Return the current time of the replica's clock.
+func (node *RaftNode) now() time.Time {
+
+	if node.Meta.clock == nil {
+		return time.Now()
+	}
+
+	return node.Meta.clock.Now()
+}
+
+// Return a channel receiving the time after d on the clock of the Raft timers, see clock.go
+func (node *RaftNode) after(d time.Duration) <-chan time.Time {
+
+	if node.Meta.raft_clock == nil {
+		return time.After(d)
+	}
+
+	return node.Meta.raft_clock.After(d)
+}
@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that the health of the members follows the clock of
+ * the replica, so that a manual clock steps over the health timeout without
+ * waiting for it, and that the Raft timers fire as the clock is advanced.
+ */
+func TestManualClock(t *testing.T) {
+
+	clock := NewManualClock(time.Unix(1000, 0))
+
+	node := &RaftNode{Meta: &NodeMetadata{clock: clock}, last_contact: make(map[int32]time.Time)}
+	node.last_contact[1] = node.now()
+
+	if !node.healthy(1) {
+		t.Fatalf("Expected a member that just responded to be healthy")
+	}
+
+	clock.Advance(memberHealthTimeout - time.Millisecond)
+	if !node.healthy(1) {
+		t.Errorf("Expected the member to be healthy until the timeout passes")
+	}
+
+	if now := clock.Advance(time.Millisecond); !now.Equal(time.Unix(1000, 0).Add(memberHealthTimeout)) || node.healthy(1) {
+		t.Errorf("Expected the member to be unhealthy once the timeout passed, at %v", now)
+	}
+
+	if node := (&RaftNode{Meta: &NodeMetadata{}}); time.Since(node.now()) > time.Second {
+		t.Errorf("Expected nodes without a clock to use the wall clock")
+	}
+
+	node.Meta.raft_clock = clock
+	timer := node.after(time.Second)
+
+	clock.Advance(time.Second - time.Millisecond)
+	select {
+	case <-timer:
+		t.Errorf("Expected the timer not to fire before its deadline")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case <-timer:
+	default:
+		t.Errorf("Expected the timer to fire once the clock reached its deadline")
+	}
+}
+
+/*
+ * This test case checks that Fire fires the timers due one at a time, in the
+ * order of their deadlines then of their creation, and moves the clock to the
+ * given time once none is due.
+ */
+func TestManualClockFire(t *testing.T) {
+
+	start := time.Unix(1000, 0)
+	clock := NewManualClock(start)
+
+	late, first, second := clock.After(2*time.Second), clock.After(time.Second), clock.After(time.Second)
+
+	fired := func(timer <-chan time.Time) bool {
+		select {
+		case <-timer:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !clock.Fire(start.Add(3*time.Second)) || !fired(first) || fired(second) || !clock.Now().Equal(start.Add(time.Second)) {
+		t.Fatalf("Expected the first timer created to fire alone at its deadline, at %v", clock.Now())
+	}
+
+	if !clock.Fire(start.Add(3*time.Second)) || !fired(second) || fired(late) {
+		t.Fatalf("Expected the second timer to fire next")
+	}
+
+	if clock.Fire(start.Add(1500*time.Millisecond)) || fired(late) || !clock.Now().Equal(start.Add(1500*time.Millisecond)) {
+		t.Fatalf("Expected no timer to fire before its deadline, the clock moving to the given time, at %v", clock.Now())
+	}
+
+	if !clock.Fire(start.Add(3*time.Second)) || !fired(late) || clock.Fire(start.Add(3*time.Second)) || !clock.Now().Equal(start.Add(3*time.Second)) {
+		t.Errorf("Expected the last timer to fire, then the clock to move to the given time, at %v", clock.Now())
+	}
+}
@@ -0,0 +1,44 @@
+//go:build testclock
+// +build testclock
+
+package raft
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Replicas built for tests start with a manual clock, see clock.go
+func defaultClock() Clock {
+	return NewManualClock(time.Now())
+}
+
+func (node *RaftNode) registerClockRoutes(r *mux.Router) {
+	r.HandleFunc("/admin/clock", node.ClockHandler).Methods("GET", "POST")
+}
+
+// Handle requests reading (GET) and advancing (POST, with advance=<duration>) the clock of the replica.
+func (node *RaftNode) ClockHandler(w http.ResponseWriter, r *http.Request) {
+
+	clock, ok := node.Meta.clock.(*ManualClock)
+	if !ok {
+		writeError(w, http.StatusConflict, "Error: The replica doesn't use a manual clock.")
+		return
+	}
+
+	if r.Method == http.MethodPost {
+
+		d, err := time.ParseDuration(r.FormValue("advance"))
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid duration %q", r.FormValue("advance"))
+			return
+		}
+
+		node.logger().Info().Dur("by", d).Msg("Advanced the clock")
+		clock.Advance(d)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"now": clock.Now().Format(time.RFC3339Nano)})
+}
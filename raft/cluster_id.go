@@ -0,0 +1,202 @@
+package raft
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+The ID of the cluster, a random UUID generated when the cluster is bootstrapped, so that the replicas
+of two clusters started with overlapping addresses (e.g. a test cluster pointed at the production
+peers, or a data directory copied from another cluster) can't be mixed up.
+
+The first leader proposes a CLUSTER_ID entry, which every replica adopts when applying it (only the
+first such entry counts, so that the entries of two leaders racing each other agree), and persists
+along with its raft state. A replica joining the cluster has none, and adopts it from the log. The
+clusters bootstrapped before the IDs were introduced are given one by their next leader.
+
+Once known, the ID is:
+
+  - sent in the x-cluster-id metadata of the RPCs to the peers, and the consensus RPCs of a peer
+    presenting another ID are rejected with FailedPrecondition (see authorize in interceptors.go),
+    counted in cluster_id_mismatches_total. The RPCs without an ID, or received before the replica
+    knows its ID, are accepted.
+  - reported in the status of the replicas, and a member is only added (see AddMemberHandler in
+    admin.go) if the new replica doesn't report another ID.
+  - stamped on the snapshots, with the X-Cluster-Id header, and on the backups. A standby refuses the
+    snapshots of another cluster than the one of the snapshot it keeps.
+
+A cluster restored from a snapshot is a new cluster, with an ID of its own.
+*/
+
+const (
+	clusterIDMetadata = "x-cluster-id"
+	clusterIDInterval = time.Second
+)
+
+// Return the ID of the cluster, or "" if it isn't known yet.
+func (node *RaftNode) clusterID() string {
+	id, _ := node.cluster_id.Load().(string)
+	return id
+}
+
+// Generate a random (version 4) UUID.
+func newClusterID() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Apply a CLUSTER_ID entry, adopting its ID unless the cluster already has one. Must be called with
+// the lock held.
+func (node *RaftNode) applyClusterID(index int32, id string) {
+
+	if current := node.clusterID(); current != "" {
+		if current != id {
+			node.logger().Debug().Int32("index", index).Str("cluster_id", id).Msg("Cluster ID already set, ignoring the entry")
+		}
+		return
+	}
+
+	node.cluster_id.Store(id)
+	node.logger().Info().Int32("index", index).Str("cluster_id", id).Msg("Cluster ID set")
+}
+
+// The job giving the cluster its ID, see above.
+func (node *RaftNode) clusterIDJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "cluster_id",
+		Interval: clusterIDInterval,
+		Run: func(ctx context.Context) error {
+
+			if node.clusterID() != "" {
+				return nil
+			}
+
+			id, err := newClusterID()
+			if err != nil {
+				return err
+			}
+
+			node.GetRLock("Cluster ID Job")
+
+			if node.state != Leader {
+				node.ReleaseRLock("Cluster ID Job")
+				return nil
+			}
+
+			// An ID proposed earlier is still to be applied.
+			for i := node.lastApplied + 1; i <= node.lastLogIndex(); i++ {
+				if node.entry(i).Operation[0] == "CLUSTER_ID" {
+					node.ReleaseRLock("Cluster ID Job")
+					return nil
+				}
+			}
+
+			if _, err := node.WriteCommand(ctx, []string{"CLUSTER_ID", id}, ""); err != nil && err != errNotLeader { // releases the lock
+				return err
+			}
+
+			return nil
+		},
+	}
+}
+
+// Check the cluster ID presented in the metadata of a consensus RPC against the ID of the cluster.
+func (node *RaftNode) checkClusterID(ctx context.Context, method string) error {
+
+	local := node.clusterID()
+	if local == "" {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(clusterIDMetadata)
+
+	if len(values) == 0 || values[0] == local {
+		return nil
+	}
+
+	node.Meta.metrics.Add("cluster_id_mismatches_total", 1)
+	node.logger().Warn().Str("method", method).Str("cluster_id", values[0]).Str("local_cluster_id", local).Msg("RPC from another cluster rejected")
+
+	return status.Errorf(codes.FailedPrecondition, "the caller belongs to cluster %v, this replica to cluster %v", values[0], local)
+}
+
+// Attach the ID of the cluster, once known, to the outgoing RPCs.
+func (node *RaftNode) clusterIDClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	if id := node.clusterID(); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, clusterIDMetadata, id)
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// Return an error if the replica at the given client address reports another cluster ID than the
+// one of the cluster. A replica whose status can't be fetched (e.g. not serving its HTTP API yet) is
+// accepted, its RPCs being checked anyway.
+func (node *RaftNode) checkJoiningReplica(ctx context.Context, address string) error {
+
+	local := node.clusterID()
+	if local == "" {
+		return nil
+	}
+
+	client, scheme, err := node.memberHTTPClient()
+	if err != nil {
+		return nil
+	}
+
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/admin/status", scheme, address), nil)
+	if err != nil {
+		return nil
+	}
+
+	if node.Meta.Config.HTTPAdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+node.Meta.Config.HTTPAdminToken)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		node.logger().Debug().Err(err).Str("address", address).Msg("Unable to fetch the status of the joining replica")
+		return nil
+	}
+	defer resp.Body.Close()
+
+	contents, _ := ioutil.ReadAll(resp.Body)
+
+	var remote Status
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(contents, &remote) != nil {
+		return nil
+	}
+
+	if remote.ClusterID != "" && remote.ClusterID != local {
+		return fmt.Errorf("the replica at %v belongs to cluster %v, this cluster is %v", address, remote.ClusterID, local)
+	}
+
+	return nil
+}
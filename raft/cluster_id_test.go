@@ -0,0 +1,151 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the first CLUSTER_ID entry applied sets the ID
+ * of the cluster, which is persisted with the raft state, and that the
+ * consensus RPCs of the peers presenting another ID are rejected.
+ */
+func TestClusterID(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "cluster_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := newClusterID()
+	if err != nil || !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Fatalf("Expected a version 4 UUID, got %v (%v)", id, err)
+	}
+
+	if other, _ := newClusterID(); other == id {
+		t.Errorf("Expected the cluster IDs generated to differ")
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), Config: DefaultConfig(), raft_persistence_file: filepath.Join(dir, "3000")}, storage: NewStorage()}
+
+	authorize := func(ids ...string) error {
+		md := metadata.Pairs()
+		if len(ids) > 0 {
+			md = metadata.Pairs(clusterIDMetadata, ids[0])
+		}
+		_, err := node.authorize(metadata.NewIncomingContext(context.Background(), md), "/protos.ConsensusService/AppendEntries")
+		return err
+	}
+
+	// Until the replica knows its ID, the RPCs of any cluster are accepted.
+	if err := authorize("another"); err != nil {
+		t.Errorf("Expected the RPC to be accepted before the ID is known, got %v", err)
+	}
+
+	node.applyClusterID(1, id)
+	node.applyClusterID(2, "another")
+
+	if node.clusterID() != id {
+		t.Fatalf("Expected the first ID applied to be kept, got %v", node.clusterID())
+	}
+
+	if err := authorize("another"); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected the RPC of another cluster to be rejected with FailedPrecondition, got %v", err)
+	}
+
+	if node.Meta.metrics.Get("cluster_id_mismatches_total") != 1 {
+		t.Errorf("Expected the mismatch to be counted")
+	}
+
+	if err := authorize(id); err != nil {
+		t.Errorf("Expected the RPC of the cluster to be accepted, got %v", err)
+	}
+
+	if err := authorize(); err != nil {
+		t.Errorf("Expected the RPC without an ID to be accepted, got %v", err)
+	}
+
+	// The KVService isn't checked, its clients aren't replicas.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(clusterIDMetadata, "another"))
+	if _, err := node.authorize(ctx, "/protos.KVService/Txn"); err != nil {
+		t.Errorf("Expected the KVService not to check the cluster ID, got %v", err)
+	}
+
+	// The ID is attached to the outgoing RPCs.
+	var sent []string
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		sent = md.Get(clusterIDMetadata)
+		return nil
+	}
+
+	node.clusterIDClientInterceptor(context.Background(), "/protos.ConsensusService/AppendEntries", nil, nil, nil, invoker)
+	if len(sent) != 1 || sent[0] != id {
+		t.Errorf("Expected the cluster ID to be sent, got %v", sent)
+	}
+
+	// The ID survives a restart.
+	node.PersistToStorage()
+
+	restarted := &RaftNode{Meta: &NodeMetadata{raft_persistence_file: node.Meta.raft_persistence_file}, storage: NewStorage()}
+	restarted.RestoreFromStorage(restarted.storage)
+
+	if restarted.clusterID() != id {
+		t.Errorf("Expected the cluster ID to be restored, got %v", restarted.clusterID())
+	}
+}
+
+/*
+ * This test case checks that a replica reporting another cluster ID isn't
+ * added to the cluster, unlike a fresh replica.
+ */
+func TestClusterIDJoin(t *testing.T) {
+
+	joining := ""
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Status{Id: 3, ClusterID: joining})
+	}))
+	defer replica.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.applyClusterID(1, "mine")
+
+	address := strings.TrimPrefix(replica.URL, "http://")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := node.checkJoiningReplica(ctx, address); err != nil {
+		t.Errorf("Expected a fresh replica to join, got %v", err)
+	}
+
+	joining = "mine"
+	if err := node.checkJoiningReplica(ctx, address); err != nil {
+		t.Errorf("Expected a replica of the cluster to join, got %v", err)
+	}
+
+	joining = "another"
+	if err := node.checkJoiningReplica(ctx, address); err == nil {
+		t.Errorf("Expected a replica of another cluster to be refused")
+	}
+
+	w := httptest.NewRecorder()
+	node.AddMemberHandler(w, httptest.NewRequest("POST", "/admin/members?id=3&client_address="+address, nil))
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected the member to be refused with 409, got %v", w.Code)
+	}
+}
@@ -0,0 +1,346 @@
+//go:build faults || long
+// +build faults long
+
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/linearizability"
+)
+
+/*
+A cluster of real replica processes for the long-form tests (TestChaos and TestLinearizability),
+each restarted by a supervisor whenever it exits, and the client workload run against it.
+*/
+
+// A cluster of replica processes, each restarted by a supervisor whenever it crashes.
+type processCluster struct {
+	t        *testing.T
+	binary   string
+	dir      string
+	replicas int
+	faults   string // Faults injected in the replicas, see faults.go
+	seed     int64
+	client   *http.Client
+
+	mu       sync.Mutex
+	procs    []*exec.Cmd
+	restarts int
+	stopped  bool
+	wg       sync.WaitGroup
+}
+
+/*
+Build the replica with the given build tags, and start a cluster of the given size, injecting the
+faults if any. The logs of the replicas are kept if the test fails, and removed by close otherwise.
+*/
+func startProcessCluster(t *testing.T, replicas int, tags, faults string, seed int64) *processCluster {
+
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary := filepath.Join(dir, "dnsnode")
+	if output, err := exec.Command("go", "build", "-tags", tags, "-o", binary, "..").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Unable to build the replica: %v\n%s", err, output)
+	}
+
+	c := &processCluster{
+		t:        t,
+		binary:   binary,
+		dir:      dir,
+		replicas: replicas,
+		faults:   faults,
+		seed:     seed,
+		client:   &http.Client{Timeout: 2 * time.Second},
+		procs:    make([]*exec.Cmd, replicas),
+	}
+
+	for i := 0; i < replicas; i++ {
+		c.wg.Add(1)
+		go c.supervise(i)
+	}
+
+	return c
+}
+
+func (c *processCluster) endpoint(i int) string {
+	return "http://localhost:400" + strconv.Itoa(i)
+}
+
+// Run replica i until the cluster is stopped, restarting it whenever it exits.
+func (c *processCluster) supervise(i int) {
+
+	defer c.wg.Done()
+
+	log, err := os.Create(filepath.Join(c.dir, fmt.Sprintf("node%v.log", i)))
+	if err != nil {
+		c.t.Error(err)
+		return
+	}
+	defer log.Close()
+
+	for run := int64(0); ; run++ {
+
+		args := []string{"-n", strconv.Itoa(c.replicas), "-log-level", "warn"}
+		if c.faults != "" {
+			args = append(args, "-faults", fmt.Sprintf("%v,seed=%v", c.faults, c.seed+100*run+int64(i)))
+		}
+
+		cmd := exec.Command(c.binary, args...)
+		cmd.Dir = c.dir
+		cmd.Stdin = strings.NewReader(strconv.Itoa(i) + "\n")
+		cmd.Stdout, cmd.Stderr = log, log
+
+		c.mu.Lock()
+		if c.stopped {
+			c.mu.Unlock()
+			return
+		}
+		if err := cmd.Start(); err != nil {
+			c.mu.Unlock()
+			c.t.Error(err)
+			return
+		}
+		c.procs[i] = cmd
+		c.mu.Unlock()
+
+		err := cmd.Wait()
+
+		c.mu.Lock()
+		stopped := c.stopped
+		if !stopped {
+			c.restarts++
+		}
+		c.mu.Unlock()
+
+		if stopped {
+			return
+		}
+
+		fmt.Fprintf(log, "--- replica exited (%v), restarting\n", err)
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// Kill replica i, like a crash. Its supervisor restarts it.
+func (c *processCluster) kill(i int) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cmd := c.procs[i]; cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// Kill every replica and wait for the supervisors to return.
+func (c *processCluster) stop() {
+
+	c.mu.Lock()
+	c.stopped = true
+	for _, cmd := range c.procs {
+		if cmd != nil && cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	}
+	c.mu.Unlock()
+
+	c.wg.Wait()
+}
+
+// Stop the cluster, and remove its directory unless the test failed.
+func (c *processCluster) close() {
+
+	c.stop()
+
+	if c.t.Failed() {
+		c.t.Logf("seed %v: the logs of the replicas are kept in %v", c.seed, c.dir)
+	} else {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// The outcome of a request to a replica.
+type requestOutcome int
+
+const (
+	requestDone      requestOutcome = iota // The request was served
+	requestRejected                        // The request had no effect, e.g. sent to a follower
+	requestAmbiguous                       // The request may or may not take effect
+)
+
+var kvMethods = map[string]string{
+	linearizability.KVGet:    "GET",
+	linearizability.KVCreate: "POST",
+	linearizability.KVPut:    "PUT",
+	linearizability.KVDelete: "DELETE",
+}
+
+// Send the operation to replica i, classifying the response.
+func (c *processCluster) do(i int, client string, in linearizability.KVInput) (requestOutcome, linearizability.KVOutput) {
+
+	method := kvMethods[in.Op]
+	form := url.Values{"client": {client}}
+	if in.Op == linearizability.KVCreate || in.Op == linearizability.KVPut {
+		form.Set("value", in.Value)
+	}
+
+	var request *http.Request
+	var err error
+
+	if method == "GET" || method == "DELETE" {
+		request, err = http.NewRequest(method, c.endpoint(i)+"/"+in.Key+"?"+form.Encode(), nil)
+	} else {
+		request, err = http.NewRequest(method, c.endpoint(i)+"/"+in.Key, strings.NewReader(form.Encode()))
+		if request != nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return requestRejected, linearizability.KVOutput{}
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		// A connection refused means the request wasn't sent at all.
+		if strings.Contains(err.Error(), "connection refused") {
+			return requestRejected, linearizability.KVOutput{}
+		}
+		return requestAmbiguous, linearizability.KVOutput{}
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return requestAmbiguous, linearizability.KVOutput{}
+	}
+
+	text := string(body)
+
+	switch {
+
+	case strings.Contains(text, "Not a leader"):
+		return requestRejected, linearizability.KVOutput{}
+
+	case method == "GET" && strings.Contains(text, "Read operation completed"):
+		if index := strings.Index(text, "Value = "); index != -1 {
+			return requestDone, linearizability.KVOutput{Exists: true, Value: strings.TrimSpace(text[index+len("Value = "):])}
+		}
+		return requestDone, linearizability.KVOutput{}
+
+	case method == "GET" && response.StatusCode == http.StatusNotFound:
+		return requestDone, linearizability.KVOutput{}
+
+	case method == "GET":
+		return requestRejected, linearizability.KVOutput{} // Reads have no effect
+
+	case strings.Contains(text, "no value exists"):
+		return requestDone, linearizability.KVOutput{} // Rejected as the key is missing
+
+	case strings.Contains(text, "completed successfully"):
+		return requestDone, linearizability.KVOutput{Exists: true}
+
+	}
+
+	return requestAmbiguous, linearizability.KVOutput{}
+}
+
+/*
+Run the given number of clients against the cluster for the duration, each making the operations
+returned by next, and return the history of their operations. An operation is sent to the replicas
+in turn until one of them serves it; writes whose outcome is unknown are part of the history, as
+they may still take effect.
+*/
+func (c *processCluster) runWorkload(clients int, duration time.Duration, next func(random *rand.Rand, client, n int) linearizability.KVInput) []linearizability.Operation {
+
+	var mu sync.Mutex
+	var history []linearizability.Operation
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	for client := 0; client < clients; client++ {
+
+		wg.Add(1)
+
+		go func(client int) {
+
+			defer wg.Done()
+
+			random := rand.New(rand.NewSource(c.seed + int64(client)))
+			leader := 0
+
+			for n := 0; time.Since(start) < duration; n++ {
+
+				op := linearizability.Operation{Client: client, Input: next(random, client, n), Call: time.Since(start)}
+
+				outcome := requestRejected
+				for attempt := 0; attempt < 3*c.replicas && outcome == requestRejected; attempt++ {
+
+					var output linearizability.KVOutput
+					if outcome, output = c.do(leader, fmt.Sprintf("client%v", client), op.Input.(linearizability.KVInput)); outcome == requestRejected {
+						leader = (leader + 1) % c.replicas
+						time.Sleep(20 * time.Millisecond)
+					}
+
+					op.Output = output
+				}
+
+				op.Return = time.Since(start)
+
+				switch {
+				case outcome == requestAmbiguous && op.Input.(linearizability.KVInput).Op != linearizability.KVGet:
+					op.Output, op.Return = nil, linearizability.Unknown
+				case outcome != requestDone:
+					continue
+				}
+
+				mu.Lock()
+				history = append(history, op)
+				mu.Unlock()
+			}
+		}(client)
+	}
+
+	wg.Wait()
+
+	return history
+}
+
+// Check the history with the KV model, reporting the operations of the first key found not to be
+// linearizable. Returns the number of operations with a known outcome.
+func checkHistory(t *testing.T, seed int64, history []linearizability.Operation) int {
+
+	done := 0
+	for _, op := range history {
+		if op.Return != linearizability.Unknown {
+			done++
+		}
+	}
+
+	if done == 0 {
+		t.Errorf("seed %v: no operation completed", seed)
+	}
+
+	if result := linearizability.Check(linearizability.KVModel(nil), history); !result.OK {
+		t.Errorf("seed %v: the history is not linearizable, the operations on the key are:\n%v", seed, linearizability.Describe(result.Partition, linearizability.DescribeKV))
+	}
+
+	return done
+}
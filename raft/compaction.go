@@ -0,0 +1,85 @@
+package raft
+
+/*
+Compaction of the log. The entries applied to the state machine are held by the key-value store, which
+persists them on its own, so the log only keeps them for the followers that don't hold them yet. Once
+the log holds more than CompactionThreshold applied entries, a replica compacts it up to the last
+entry applied, less CompactionSlack entries.
+
+The leader also keeps the entries its connected followers (those that responded to it recently, see
+healthy in membership.go) don't hold yet: it compacts the log up to the lowest matchIndex among them
+at most, less the slack, so that a follower only briefly behind catches up from the log rather than
+being sent a snapshot (see install.go). A follower that isn't connected doesn't hold up the
+compaction, and is sent a snapshot once back if the entries it misses were compacted.
+
+The compacted entries can't be replayed (see replay.go): a replica whose log has to be kept whole is
+started with a CompactionThreshold of 0.
+*/
+
+// Return the index up to which the log may be compacted, logStart-1 if it may not. Must be called with
+// the (read) lock held.
+func (node *RaftNode) compactionIndex() int32 {
+
+	threshold, slack := node.Meta.Config.CompactionThreshold, node.Meta.Config.CompactionSlack
+
+	if threshold <= 0 || node.lastApplied-node.logStart+1 <= threshold {
+		return node.logStart - 1
+	}
+
+	if slack < 0 {
+		slack = 0
+	}
+
+	index := node.lastApplied
+
+	if node.state == Leader {
+
+		for _, m := range node.Meta.members {
+
+			if m.Id == node.Meta.replica_id || !node.healthy(m.Id) {
+				continue
+			}
+
+			if node.matchIndex[m.Id] < index {
+				index = node.matchIndex[m.Id]
+			}
+		}
+	}
+
+	if index -= slack; index < node.logStart-1 {
+		return node.logStart - 1
+	}
+
+	return index
+}
+
+// Compact the log as far as allowed (see above). Must be called with the lock held, and the state
+// persisted afterwards.
+func (node *RaftNode) compact() {
+
+	index := node.compactionIndex()
+	if index < node.logStart {
+		return
+	}
+
+	compacted := index - node.logStart + 1
+	node.compactLog(index)
+
+	node.Meta.metrics.Add("raft_log_compacted_entries_total", float64(compacted))
+	node.logger().Debug().Int32("index", index).Int32("entries", compacted).Msg("Log compacted")
+}
+
+// Compact the entries up to the given index, which must have been applied to the state machine: the
+// log then starts after it. Must be called with the lock held.
+func (node *RaftNode) compactLog(index int32) {
+
+	if index < node.logStart || index > node.lastApplied || index > node.lastLogIndex() {
+		return
+	}
+
+	node.logStartMembers = node.membersAt(index)
+	node.logStartTerm = node.entry(index).Term
+
+	node.discardEntries(index)
+	node.logStart = index + 1
+}
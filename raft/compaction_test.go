@@ -0,0 +1,108 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the log is only compacted past the threshold,
+ * up to the last applied entry less the slack, and on the leader up to the
+ * lowest matchIndex of the connected followers less the slack, a follower
+ * that isn't connected not holding it up.
+ */
+func TestCompactionIndex(t *testing.T) {
+
+	log := make([]protos.LogEntry, 30)
+	for i := range log {
+		log[i] = protos.LogEntry{Term: 1 + int32(i)/10, Operation: []string{"NO-OP"}}
+	}
+
+	node := newTestFollower(t, 3, log)
+	node.Meta.Config.CompactionThreshold, node.Meta.Config.CompactionSlack = 20, 5
+	node.commitIndex, node.lastApplied = 29, 15
+
+	if index := node.compactionIndex(); index != -1 {
+		t.Errorf("Expected the log not to be compacted below the threshold, got %v", index)
+	}
+
+	node.lastApplied = 25
+
+	if index := node.compactionIndex(); index != 20 {
+		t.Errorf("Expected a follower to compact up to the last applied entry less the slack, got %v", index)
+	}
+
+	// Replica 1 is connected, replica 2 isn't.
+	node.state = Leader
+	node.matchIndex = []int32{0, 12, 3}
+	node.last_contact = map[int32]time.Time{1: node.now(), 2: node.now().Add(-2 * memberHealthTimeout)}
+
+	if index := node.compactionIndex(); index != 7 {
+		t.Errorf("Expected the leader to keep the entries the connected followers miss, got %v", index)
+	}
+
+	// The follower catches up, the slack is kept behind the last applied entry.
+	node.matchIndex[1] = 29
+
+	if index := node.compactionIndex(); index != 20 {
+		t.Errorf("Expected the leader to compact up to the last applied entry less the slack, got %v", index)
+	}
+
+	node.compact()
+
+	if node.logStart != 21 || len(node.log) != 9 || node.lastLogIndex() != 29 || node.logStartTerm != 3 {
+		t.Fatalf("Expected the entries up to 20 to be compacted, got start %v (term %v) and %v entries", node.logStart, node.logStartTerm, len(node.log))
+	}
+
+	if term, ok := node.termAt(22); !ok || term != 3 || node.entry(22) != &node.log[1] {
+		t.Errorf("Expected the entries to be addressed from the start of the log, got %v", term)
+	}
+
+	if _, ok := node.termAt(19); ok {
+		t.Errorf("Expected the terms of the compacted entries to be unknown")
+	}
+
+	// The compaction waits for the threshold to be passed again.
+	if index := node.compactionIndex(); index != 20 {
+		t.Errorf("Expected no further compaction, got %v", index)
+	}
+
+	node.Meta.Config.CompactionThreshold = 0
+	node.lastApplied = 29
+
+	if index := node.compactionIndex(); index != 20 {
+		t.Errorf("Expected the compaction to be disabled, got %v", index)
+	}
+}
+
+/*
+ * This test case checks that the configuration of the compacted entries is
+ * kept, and that the start of the log is persisted and restored.
+ */
+func TestCompactionPersisted(t *testing.T) {
+
+	node := newTestFollower(t, 1, []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}, {Term: 1, Operation: []string{"NO-OP"}}, {Term: 1, Operation: []string{"NO-OP"}}})
+
+	members := []Member{defaultMember(0), defaultMember(1)}
+	node.log[1] = protos.LogEntry{Term: 1, Operation: []string{"CONFIG", encodeMembers(members)}}
+	node.commitIndex, node.lastApplied = 2, 2
+
+	node.compactLog(1)
+	node.refreshMembership()
+
+	if node.logStart != 2 || len(node.Meta.members) != 2 || len(node.logStartMembers) != 2 {
+		t.Fatalf("Expected the configuration of the compacted entries to be kept, got start %v and %v", node.logStart, node.Meta.members)
+	}
+
+	node.PersistToStorage()
+
+	restored := newTestFollower(t, 0, nil)
+	restored.Meta.raft_persistence_file = node.Meta.raft_persistence_file
+	restored.RestoreFromStorage(restored.storage)
+
+	if restored.logStart != 2 || restored.logStartTerm != 1 || len(restored.log) != 1 || !sameMembers(restored.membersAt(restored.lastLogIndex()), members) {
+		t.Errorf("Expected the start of the log to be restored, got start %v (term %v), %v entries and %v", restored.logStart, restored.logStartTerm, len(restored.log), restored.logStartMembers)
+	}
+}
@@ -0,0 +1,59 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Compression of the values of the key-value store (see kv_store/compress.go), configured by the
+compression_prefixes setting (the comma separated prefixes of the keys whose values are compressed,
+e.g. "dns:" for the DNS records) and compression_threshold (the minimum size of the compressed values).
+The configuration is sent to the local store once the settings are loaded and whenever they change.
+As it only changes how the values are stored, replicas may apply it at different times.
+*/
+
+const defaultCompressionThreshold = 1024
+
+// Whether the setting configures the compression of the values.
+func compressionSetting(name string) bool {
+	return name == "compression_prefixes" || name == "compression_threshold"
+}
+
+// Send the compression configured by the settings to the local key-value store.
+func (node *RaftNode) configureCompression() {
+
+	config := kv_store.CompressionConfig{
+		Prefixes:  node.Meta.settings.List("compression_prefixes"),
+		Threshold: int(node.Meta.settings.Int64("compression_threshold", defaultCompressionThreshold)),
+	}
+
+	encoded, _ := json.Marshal(config)
+
+	url := fmt.Sprintf("http://localhost%s/admin/compression", node.Meta.kvstore_addr)
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(encoded))
+	if err != nil {
+		node.logger().Error().Err(err).Msg("Unable to configure the compression of the key-value store")
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		node.logger().Error().Err(err).Msg("Unable to configure the compression of the key-value store")
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		node.logger().Error().Int("status", resp.StatusCode).Msg("Unable to configure the compression of the key-value store")
+		return
+	}
+
+	if len(config.Prefixes) > 0 {
+		node.logger().Info().Strs("prefixes", config.Prefixes).Int("threshold", config.Threshold).Msg("Configured the compression of the key-value store")
+	}
+}
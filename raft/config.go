@@ -0,0 +1,262 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+// Config holds the operational settings of a replica. A default configuration is
+// created by InitializeNode, and fields can be overridden (e.g. from command line
+// flags) before the node is connected to its peers in Connect_raft_node.
+type Config struct {
+
+	// gRPC interceptor settings, see interceptors.go
+	PeerToken        string        // Shared secret peers must present on ConsensusService RPCs. Empty disables authentication.
+	ClientToken      string        // Shared secret clients must present on KVService RPCs. Empty disables authentication.
+	LogRPCs          bool          // Log every RPC handled by the gRPC servers
+	SlowRPCThreshold time.Duration // Log RPCs taking longer than this, even if LogRPCs is unset. 0 disables it.
+
+	// Mutual TLS between replicas, see tls.go. Leaving all of them empty disables TLS.
+	PeerCertFile string   // PEM certificate presented to peers and clients, valid for server and client authentication
+	PeerKeyFile  string   // PEM private key of the certificate
+	PeerCAFile   string   // PEM certificates of the CA that signs the certificates of the replicas
+	PeerNames    []string // Names (common name or DNS SAN) the certificates of the peers must carry one of. Empty accepts any certificate signed by the CA.
+
+	// Security of the client-facing HTTP server
+	HTTPCertFile   string // PEM certificate of the server, which serves HTTPS if set (see StartRaftServer)
+	HTTPKeyFile    string // PEM private key of the certificate
+	HTTPAdminToken string // Bearer token of the bootstrap admin. Setting it requires clients to authenticate, see users.go.
+
+	// Limits on the client-facing HTTP server, see middleware.go
+	ReadHeaderTimeout     time.Duration // Time allowed for a client to send the request headers
+	ReadTimeout           time.Duration // Time allowed for a client to send the whole request, including the body
+	ReadRouteTimeout      time.Duration // Time allowed for handling a read request before responding with 504
+	WriteRouteTimeout     time.Duration // Time allowed for handling a write request before responding with 504
+	MaxBodyBytes          int64         // Maximum size of a request body
+	MaxConcurrentRequests int           // Capacity shared by the HTTP and gRPC servers, further requests are shed by priority (see shedding.go)
+
+	// Rate limits of the client HTTP API, see ratelimit.go. A limit of 0 disables it, a burst of 0 is the limit.
+	ClientRateLimit int64 // Requests per second allowed to each client IP
+	ClientRateBurst int64 // Requests a client IP may send at once
+	GlobalRateLimit int64 // Requests per second allowed to all the clients together
+	GlobalRateBurst int64 // Requests all the clients may send at once
+
+	// External authorization of the client writes, see authz.go
+	AuthzTimeout  time.Duration // Time the authorizer may take to decide, 0 or less for no limit
+	AuthzFailOpen bool          // Whether the writes are allowed when the authorizer fails, rather than rejected
+
+	DNSUpdateWindow time.Duration // Time within which the retransmissions of a DNS update aren't applied again, 0 or less to apply them
+
+	// Backpressure on the client writes, see admission.go
+	MaxPendingProposals int   // Proposals pending on the leader at most, 0 or less for no limit
+	MaxFollowerLag      int32 // Entries the quorum of followers may lag behind the leader's log, 0 or less for no limit
+
+	// Initial members of the cluster that are witnesses, see witness.go
+	Witnesses []int32
+
+	// Initial members of the cluster dedicated to consensus, which serve no queries, see serving.go
+	ConsensusOnly []int32
+
+	// Failure domains of the initial members of the cluster, by replica ID, see placement.go
+	FailureDomains []FailureDomain
+
+	// Federation of clusters, see federation.go
+	FederationToken string // Token presented to the home clusters of the replicated zones
+
+	// Raft timing, see ValidateTiming
+	ElectionTimeoutMin time.Duration // Shortest time a follower waits for the leader before starting an election
+	ElectionTimeoutMax time.Duration // Longest such time, the timeout being drawn at random in between
+	HeartbeatInterval  time.Duration // Time between two heartbeats of the leader
+	RPCTimeout         time.Duration // Deadline of the AppendEntries and RequestVote RPCs
+
+	// Directories of the raft state, the key-value store and the snapshots, see layout.go
+	Layout DataLayout
+
+	// Detection of the unreachable peers, see peers.go
+	PeerKeepaliveTime    time.Duration // Idle time after which the connection to a peer is checked with a ping
+	PeerKeepaliveTimeout time.Duration // Time the ping may go unanswered before the connection is closed
+	PeerFailureThreshold int           // Consecutive failed RPCs after which a peer is unreachable, 0 or less never
+
+	// Largest AppendEntries sent to a peer on the control connection rather than the bulk one, in
+	// bytes, 0 or less for a single connection, see priority.go
+	BulkMessageBytes int
+
+	// Snapshot transfers, see throttle.go
+	SnapshotMaxRate       int64         // Bytes per second sent to each peer at most, 0 for unlimited
+	SnapshotLatencyTarget time.Duration // Write latency below which the transfers aren't slowed down
+
+	// Hard limits on the resources used by the replica, raising an alarm when exceeded, see resources.go
+	MaxMemoryBytes int64 // Memory used by the log, the caches and the key-value store, 0 for unlimited
+	MaxDiskBytes   int64 // Size of the persisted files, 0 for unlimited
+
+	// Reads served by followers, see follower_reads.go
+	FollowerReadStaleness int32 // Entries a follower may lag behind the leader's commit index and still serve reads, -1 forwards none
+
+	// Entries a follower may lag behind the leader's commit index and still be ready, see probes.go
+	ReadinessMaxLag int32
+
+	// Compaction of the applied entries of the log, see compaction.go
+	CompactionThreshold int32 // Applied entries in the log past which it is compacted, 0 or less never
+	CompactionSlack     int32 // Entries kept behind the last applied one, and behind the slowest connected follower
+
+	// Directory the diagnostics bundles are written to on shutdown and crashes, none if empty, see diagnostics.go
+	DiagnosticsDir string
+
+	// Backend of the local key-value store, kv_store.BackendMap or kv_store.BackendBolt, see state_machine.go
+	StoreBackend string
+
+	// DNS views and listeners, from the config file, see dns.go
+	DNS DNSConfig
+
+	// Publisher of the changes applied, from the config file, see changestream.go
+	ChangeStream ChangeStreamConfig
+
+	// Backups taken on a schedule by the leader, from the config file, see backup_schedule.go
+	Backups BackupScheduleConfig
+
+	// Serve the gRPC server on the port of the client HTTP server, see portmux.go
+	SinglePort bool
+
+	// Faults injected for tests, nil in production. Requires a build with the faults tag, see faults.go
+	Faults *FaultConfig
+}
+
+// Return the configuration used when none is explicitly provided.
+func DefaultConfig() *Config {
+
+	return &Config{
+		SlowRPCThreshold: 500 * time.Millisecond,
+
+		ReadHeaderTimeout:     5 * time.Second,
+		ReadTimeout:           30 * time.Second,
+		ReadRouteTimeout:      5 * time.Second,
+		WriteRouteTimeout:     10 * time.Second,
+		MaxBodyBytes:          1 << 20,
+		MaxConcurrentRequests: 256,
+
+		AuthzTimeout: time.Second,
+
+		DNSUpdateWindow: 30 * time.Second,
+
+		MaxPendingProposals: 1024,
+		MaxFollowerLag:      10000,
+
+		ElectionTimeoutMin: 500 * time.Millisecond,
+		ElectionTimeoutMax: 800 * time.Millisecond,
+		HeartbeatInterval:  50 * time.Millisecond,
+		RPCTimeout:         20 * time.Millisecond,
+
+		PeerKeepaliveTime:    10 * time.Second,
+		PeerKeepaliveTimeout: 3 * time.Second,
+		PeerFailureThreshold: 10,
+
+		BulkMessageBytes: 64 << 10,
+
+		SnapshotMaxRate:       64 << 20,
+		SnapshotLatencyTarget: 50 * time.Millisecond,
+
+		MaxMemoryBytes: 2 << 30,
+		MaxDiskBytes:   8 << 30,
+
+		FollowerReadStaleness: -1,
+		ReadinessMaxLag:       1000,
+
+		CompactionThreshold: 10000,
+		CompactionSlack:     1000,
+
+		StoreBackend: kv_store.BackendMap,
+	}
+
+}
+
+// Minimum ratio between the election timeout and the heartbeat interval, so that a few lost
+// heartbeats don't trigger an election.
+const minElectionHeartbeatRatio = 3
+
+// The settings read from the JSON config file given with -config.
+type FileConfig struct {
+	DNS          DNSConfig            `json:"dns"`
+	ChangeStream ChangeStreamConfig   `json:"change_stream"`
+	Backups      BackupScheduleConfig `json:"backups"`
+}
+
+// Read the config file at the given path into the configuration, rejecting unknown settings.
+func LoadConfigFile(path string, c *Config) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	var fileConfig FileConfig
+	if err := decoder.Decode(&fileConfig); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	if err := fileConfig.DNS.Validate(); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	if err := fileConfig.ChangeStream.Validate(); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	if err := fileConfig.Backups.Validate(); err != nil {
+		return fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	c.DNS = fileConfig.DNS
+	c.ChangeStream = fileConfig.ChangeStream
+	c.Backups = fileConfig.Backups
+
+	return nil
+}
+
+/*
+ValidateTiming checks that the Raft timing parameters are consistent: the heartbeats must be sent
+well within the election timeout, and an RPC must time out before a follower starts an election.
+*/
+func (c *Config) ValidateTiming() error {
+
+	switch {
+
+	case c.HeartbeatInterval <= 0 || c.ElectionTimeoutMin <= 0 || c.RPCTimeout <= 0:
+		return fmt.Errorf("the election timeout, heartbeat interval and RPC timeout must be positive")
+
+	case c.ElectionTimeoutMax < c.ElectionTimeoutMin:
+		return fmt.Errorf("the maximum election timeout (%v) is below the minimum (%v)", c.ElectionTimeoutMax, c.ElectionTimeoutMin)
+
+	case c.ElectionTimeoutMin < minElectionHeartbeatRatio*c.HeartbeatInterval:
+		return fmt.Errorf("the minimum election timeout (%v) must be at least %v times the heartbeat interval (%v)", c.ElectionTimeoutMin, minElectionHeartbeatRatio, c.HeartbeatInterval)
+
+	case c.RPCTimeout >= c.ElectionTimeoutMin:
+		return fmt.Errorf("the RPC timeout (%v) must be below the minimum election timeout (%v)", c.RPCTimeout, c.ElectionTimeoutMin)
+
+	}
+
+	return nil
+}
+
+// Return a random election timeout, between the minimum and the maximum, drawn from source (the global
+// source if nil).
+func (c *Config) electionTimeout(source *rand.Rand) time.Duration {
+
+	if c.ElectionTimeoutMax <= c.ElectionTimeoutMin {
+		return c.ElectionTimeoutMin
+	}
+
+	if source == nil {
+		return c.ElectionTimeoutMin + time.Duration(rand.Int63n(int64(c.ElectionTimeoutMax-c.ElectionTimeoutMin)))
+	}
+
+	return c.ElectionTimeoutMin + time.Duration(source.Int63n(int64(c.ElectionTimeoutMax-c.ElectionTimeoutMin)))
+}
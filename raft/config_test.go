@@ -0,0 +1,43 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that inconsistent Raft timing parameters are rejected,
+ * and that the election timeouts are drawn within the configured range.
+ */
+func TestValidateTiming(t *testing.T) {
+
+	if err := DefaultConfig().ValidateTiming(); err != nil {
+		t.Fatalf("Expected the default timing to be valid, got %v", err)
+	}
+
+	for name, change := range map[string]func(c *Config){
+		"no heartbeat":       func(c *Config) { c.HeartbeatInterval = 0 },
+		"inverted range":     func(c *Config) { c.ElectionTimeoutMax = c.ElectionTimeoutMin - time.Millisecond },
+		"frequent elections": func(c *Config) { c.HeartbeatInterval = 200 * time.Millisecond },
+		"slow RPCs":          func(c *Config) { c.RPCTimeout = c.ElectionTimeoutMin },
+	} {
+		config := DefaultConfig()
+		change(config)
+
+		if err := config.ValidateTiming(); err == nil {
+			t.Errorf("Expected the timing with %v to be rejected", name)
+		}
+	}
+
+	config := DefaultConfig()
+	for i := 0; i < 100; i++ {
+		if timeout := config.electionTimeout(nil); timeout < config.ElectionTimeoutMin || timeout >= config.ElectionTimeoutMax {
+			t.Fatalf("Expected the election timeout to be within the range, got %v", timeout)
+		}
+	}
+
+	config.ElectionTimeoutMax = config.ElectionTimeoutMin
+	if timeout := config.electionTimeout(nil); timeout != config.ElectionTimeoutMin {
+		t.Errorf("Expected a fixed election timeout, got %v", timeout)
+	}
+}
@@ -0,0 +1,495 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Decommissions of members, e.g. before retiring their hosts. POST /admin/members/{id}/decommission
+(raftctl decommission <id>) starts the workflow, which the leader runs one step at a time, each step
+being resumed by the next leader after a change of leadership:
+
+	draining       the member hands its leadership over to the most up to date voter, if it is the
+	               leader: a learner can't lead, so the leadership is drained before the demotion
+	demoting       the member is demoted to a learner through a configuration change, once the
+	               remaining voters are known to hold the log and to be healthy (see checkRemoval in
+	               membership.go), and not to leave a quorum of them in a single failure domain (see
+	               checkPlacement in placement.go, unless started with force_placement=true): it
+	               still receives the log, but no longer counts towards the quorum
+	removing       the learner is removed from the configuration, which doesn't change the quorum
+	shutting_down  the replica is told to shut down and to delete its data (POST /admin/shutdown with
+	               wipe=true), until it answers
+	complete
+
+The progress of each decommission is stored under DecommissionsPrefix, and thus reported in the status
+of every replica (see admin.go). A step failing, e.g. while the remaining voters are unhealthy, is
+retried by the next runs of the job, the error being reported along with the step. DELETE
+/admin/members/{id}/decommission stops the workflow and forgets it, unless the member is demoted and
+still to be removed.
+
+A replica only accepts /admin/shutdown once it isn't a voter of its configuration (the entry removing
+it is never sent to it, so it still sees itself as a learner), so that a stray request can't take
+down a quorum. With wipe=true, its raft state and key-value store (see persistedFiles in
+resources.go) are deleted once it has shut down, those of all the Raft groups it hosts with shards.
+*/
+
+const (
+	DecommissionsPrefix = "_decommissions:" // Keys holding the progress of the decommissions, by member
+
+	decommissionInterval = time.Second
+	decommissionClient   = "decommission" // Client of the transactions recording the progress
+)
+
+// The steps of a decommission.
+const (
+	decommissionDraining     = "draining"
+	decommissionDemoting     = "demoting"
+	decommissionRemoving     = "removing"
+	decommissionShuttingDown = "shutting_down"
+	decommissionComplete     = "complete"
+)
+
+// The progress of the decommission of a member.
+type Decommission struct {
+	Member         int32     `json:"member"`
+	Address        string    `json:"address"` // Address of the client HTTP server of the member, told to shut down
+	Step           string    `json:"step"`
+	Error          string    `json:"error,omitempty"`           // Why the step last failed, retried by the leader
+	ForcePlacement bool      `json:"force_placement,omitempty"` // Whether the demotion overrides the placement check
+	Started        time.Time `json:"started"`
+	Updated        time.Time `json:"updated"`
+}
+
+// Return the decommissions stored in the local key-value store, ordered by member.
+func (node *RaftNode) decommissions() ([]Decommission, error) {
+
+	kvs, err := node.scanLocalStore(DecommissionsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Decommission
+
+	for _, kv := range kvs {
+
+		var d Decommission
+		if err := json.Unmarshal([]byte(kv.Value), &d); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid decommission record")
+			continue
+		}
+
+		list = append(list, d)
+	}
+
+	return list, nil
+}
+
+// Return the decommission of the member, and whether there is one. Must be called on the leader, with
+// the read lock held.
+func (node *RaftNode) decommission(id int32) (Decommission, bool, error) {
+
+	contents, code, err := node.readFromStore(url.PathEscape(DecommissionsPrefix + strconv.Itoa(int(id))))
+	if err != nil {
+		return Decommission{}, false, err
+	}
+
+	if code != http.StatusOK || !strings.HasPrefix(contents, "Value = ") {
+		return Decommission{}, false, nil
+	}
+
+	var d Decommission
+	if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(contents, "Value = "))), &d); err != nil {
+		return Decommission{}, false, fmt.Errorf("invalid decommission of replica %v: %v", id, err)
+	}
+
+	return d, true, nil
+}
+
+// Replicate the progress of the decommission through the log.
+func (node *RaftNode) saveDecommission(ctx context.Context, d Decommission) error {
+
+	record, _ := json.Marshal(d)
+	return node.proposeRecords(ctx, decommissionClient, []kv_store.Op{{Type: kv_store.OpPut, Key: DecommissionsPrefix + strconv.Itoa(int(d.Member)), Value: string(record)}})
+}
+
+/*
+Handle the requests starting the decommission of a member (POST), or cancelling it (DELETE), see the
+decommissions above. Both return the decommission.
+*/
+func (node *RaftNode) DecommissionHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Str("method", r.Method).Msg("DECOMMISSION request received")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid replica ID: %v", mux.Vars(r)["id"])
+		return
+	}
+
+	node.GetRLock("Decommission Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Decommission Handler")
+		return
+	}
+
+	d, found, err := node.decommission(int32(id))
+	if err != nil {
+		node.ReleaseRLock("Decommission Handler")
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	m, member := node.member(int32(id))
+	voting := len(voters(node.Meta.members))
+
+	forcePlacement, _ := strconv.ParseBool(r.FormValue("force_placement"))
+
+	// The voters left once the member is demoted, see checkPlacement
+	var remaining []Member
+	for _, other := range node.Meta.members {
+		if other.Id != int32(id) {
+			remaining = append(remaining, other)
+		}
+	}
+
+	node.ReleaseRLock("Decommission Handler")
+
+	if r.Method == http.MethodDelete {
+
+		if !found {
+			writeError(w, http.StatusNotFound, "Error: Replica %v isn't being decommissioned.", id)
+			return
+		}
+
+		if member && m.Learner {
+			writeError(w, http.StatusConflict, "Error: Replica %v is demoted already, its decommission can't be cancelled until it is removed.", id)
+			return
+		}
+
+		txn := []kv_store.Op{{Type: kv_store.OpDelete, Key: DecommissionsPrefix + strconv.Itoa(id)}}
+		if err := node.proposeRecords(r.Context(), decommissionClient, txn); err != nil {
+			writeError(w, http.StatusServiceUnavailable, "Error occured in DECOMMISSION request: %v", err)
+			return
+		}
+
+		node.logger().Info().Int("member_id", id).Str("step", d.Step).Msg("Decommission cancelled")
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+
+	switch {
+
+	case found && d.Step != decommissionComplete:
+		writeError(w, http.StatusConflict, "Error: Replica %v is already being decommissioned, currently %v.", id, d.Step)
+		return
+
+	case !member:
+		writeError(w, http.StatusConflict, "Error: Replica %v is not a member", id)
+		return
+
+	case !m.Learner && voting == 1:
+		writeError(w, http.StatusConflict, "Error: Replica %v is the only voter of the cluster.", id)
+		return
+	}
+
+	if err := checkPlacement(remaining, forcePlacement); err != nil && !m.Learner {
+		writeError(w, http.StatusConflict, "Error: Decommissioning replica %v is unsafe: %v. Use force_placement=true to decommission it anyway.", id, err)
+		return
+	}
+
+	now := node.now()
+	d = Decommission{Member: int32(id), Address: m.ClientAddress, Step: decommissionDemoting, ForcePlacement: forcePlacement, Started: now, Updated: now}
+
+	if int32(id) == node.Meta.replica_id {
+		d.Step = decommissionDraining
+	}
+
+	if err := node.saveDecommission(r.Context(), d); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error occured in DECOMMISSION request: %v", err)
+		return
+	}
+
+	node.logger().Info().Int("member_id", id).Msg("Decommission started")
+	writeJSON(w, http.StatusOK, d)
+}
+
+/*
+Run the current step of the decommission, returning it with the step to run next. The steps follow the
+configuration, rather than the step recorded, so that a step run again (e.g. by the next leader, whose
+store lags behind its log) has no effect.
+*/
+func (node *RaftNode) advanceDecommission(ctx context.Context, d Decommission) (Decommission, error) {
+
+	if d.Step == decommissionShuttingDown {
+
+		if err := node.shutdownMember(ctx, d.Address); err != nil {
+			return d, err
+		}
+
+		d.Step = decommissionComplete
+		return d, nil
+	}
+
+	node.GetRLock("Advance Decommission")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Advance Decommission")
+		return d, errNotLeader
+	}
+
+	m, member := node.member(d.Member)
+
+	switch {
+
+	// The member was removed already, e.g. by the previous leader.
+	case !member:
+		node.ReleaseRLock("Advance Decommission")
+		d.Step = decommissionShuttingDown
+		return d, nil
+
+	case d.Member == node.Meta.replica_id:
+		node.ReleaseRLock("Advance Decommission")
+		d.Step = decommissionDraining
+		return d, node.drainLeadership(ctx)
+
+	// Only one membership change may be in progress, see membership.go
+	case node.pendingConfigChange():
+		node.ReleaseRLock("Advance Decommission")
+		return d, nil
+
+	case m.Learner:
+
+		d.Step = decommissionRemoving
+
+		if _, err := node.proposeConfig(ctx, func() ([]Member, error) { return node.withoutMember(d.Member) }); err != nil {
+			return d, err
+		}
+
+		node.logger().Info().Int32("member_id", d.Member).Msg("Decommissioned replica removed from the cluster")
+		d.Step = decommissionShuttingDown
+
+	default:
+
+		d.Step = decommissionDemoting
+
+		demote := func() ([]Member, error) {
+
+			members, err := node.withLearner(d.Member)
+			if err == nil {
+				err = node.checkRemoval(d.Member, members)
+			}
+			if err == nil {
+				err = checkPlacement(members, d.ForcePlacement)
+			}
+
+			return members, err
+		}
+
+		if _, err := node.proposeConfig(ctx, demote); err != nil {
+			return d, err
+		}
+
+		node.logger().Info().Int32("member_id", d.Member).Msg("Decommissioned replica demoted to a learner")
+		d.Step = decommissionRemoving
+	}
+
+	return d, nil
+}
+
+// Hand the leadership of this replica over to the most up to date member that can lead.
+func (node *RaftNode) drainLeadership(ctx context.Context) error {
+
+	node.GetLock("Drain Leadership")
+
+	if node.state != Leader || node.transferring {
+		node.ReleaseLock("Drain Leadership")
+		return nil
+	}
+
+	target := node.transferTarget()
+	if target == -1 {
+		node.ReleaseLock("Drain Leadership")
+		return errors.New("no other member can take over the leadership")
+	}
+
+	node.transferring = true
+	term := node.currentTerm
+
+	node.ReleaseLock("Drain Leadership")
+
+	err := node.transferLeadership(ctx, target, term)
+
+	node.GetLock("Drain Leadership")
+	node.transferring = false
+	node.ReleaseLock("Drain Leadership")
+
+	if err == nil {
+		node.logger().Info().Int32("target", target).Msg("Leadership of the decommissioned replica transferred")
+	}
+
+	return err
+}
+
+// Tell the replica at the given client address to shut down and delete its data.
+func (node *RaftNode) shutdownMember(ctx context.Context, address string) error {
+
+	client, scheme, err := node.memberHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(address, ":") {
+		address = "localhost" + address
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/admin/shutdown?wipe=true", scheme, address), nil)
+	if err != nil {
+		return err
+	}
+
+	if node.Meta.Config.HTTPAdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+node.Meta.Config.HTTPAdminToken)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		contents, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(contents)))
+	}
+
+	return nil
+}
+
+// The job advancing the decommissions, see above.
+func (node *RaftNode) decommissionJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "decommission",
+		Interval: decommissionInterval,
+		Run: func(ctx context.Context) error {
+
+			list, err := node.decommissions()
+			if err != nil {
+				return err
+			}
+
+			for _, d := range list {
+
+				if d.Step == decommissionComplete {
+					continue
+				}
+
+				next, err := node.advanceDecommission(ctx, d)
+				if err == errNotLeader || ctx.Err() != nil {
+					return nil
+				}
+
+				if next.Error = ""; err != nil {
+					node.logger().Warn().Err(err).Int32("member_id", d.Member).Str("step", next.Step).Msg("Decommission step failed")
+					next.Error = err.Error()
+				}
+
+				if next.Step == d.Step && next.Error == d.Error {
+					continue
+				}
+
+				next.Updated = node.now()
+
+				if err := node.saveDecommission(ctx, next); err != nil && err != errNotLeader {
+					return err
+				}
+
+				if next.Step == decommissionComplete {
+					node.logger().Info().Int32("member_id", d.Member).Msg("Replica decommissioned")
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// Return the replicas of the Raft groups hosted by the process, see shards.go
+func (node *RaftNode) hostedGroups() []*RaftNode {
+
+	if node.Meta.shards == nil {
+		return []*RaftNode{node}
+	}
+
+	return node.Meta.shards.groups
+}
+
+/*
+Handle the requests shutting down the process, deleting its data with wipe=true, see the decommissions
+above. Refused while the replica is a voter of any of the groups hosted by the process.
+*/
+func (node *RaftNode) ShutdownHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("SHUTDOWN request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	wipe, _ := strconv.ParseBool(r.FormValue("wipe"))
+
+	groups := node.hostedGroups()
+
+	for _, group := range groups {
+
+		group.GetRLock("Shutdown Handler")
+		voter := group.voter(group.Meta.replica_id)
+		group.ReleaseRLock("Shutdown Handler")
+
+		if voter {
+			writeError(w, http.StatusConflict, "Error: Replica %v is a voter of group %v, decommission it first.", group.Meta.replica_id, group.group())
+			return
+		}
+	}
+
+	// A shutdown requested already is under way.
+	select {
+	case groups[0].Meta.shutdown_requests <- wipe:
+	default:
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"wipe": wipe})
+}
+
+// Delete the persisted state of the replicas of the groups hosted by the process, once shut down.
+func (node *RaftNode) wipeData() {
+
+	for _, group := range node.hostedGroups() {
+
+		for _, file := range group.persistedFiles() {
+
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				group.logger().Error().Err(err).Str("file", file).Msg("Unable to delete the data of the replica")
+				continue
+			}
+
+			group.logger().Info().Str("file", file).Msg("Deleted the data of the replica")
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the learners are sent the entries but don't count
+ * towards the quorum, nor do the replicas removed from the configuration, and
+ * that the demotion of a voter is checked as its removal.
+ */
+func TestLearners(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), Config: DefaultConfig(), clock: NewManualClock(time.Unix(100, 0))}}
+	node.Meta.members = []Member{{Id: 0}, {Id: 1}, {Id: 2, Learner: true}}
+	node.Meta.n_replicas = int32(len(voters(node.Meta.members)))
+
+	node.state, node.currentTerm = Leader, 1
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}}
+	node.commitIndex = 0
+	node.nextIndex, node.matchIndex = []int32{1, 0, 0}, []int32{0, 0, 0}
+	node.last_contact = map[int32]time.Time{1: node.now(), 2: node.now()}
+
+	if node.Meta.n_replicas != 2 || !node.voter(1) || node.voter(2) || node.voter(3) {
+		t.Fatalf("Expected replicas 0 and 1 to be the voters, got %v", node.Meta.n_replicas)
+	}
+
+	replicate := func(clients ...Transport) bool {
+
+		// The lock is held as by the callers of LeaderSendAEs, as the sends of the previous rounds may still be running.
+		node.GetLock("Test")
+		node.Meta.peer_replica_clients = clients
+
+		success := make(chan bool)
+		node.LeaderSendAEs(context.Background(), "TEST", &protos.AppendEntriesMessage{Term: 1}, 0, success)
+		node.ReleaseLock("Test")
+
+		select {
+		case replicated := <-success:
+			return replicated
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the outcome of the replication to be sent")
+		}
+
+		return false
+	}
+
+	learner := &probedTransport{reachable: true}
+
+	if !replicate(nil, &probedTransport{reachable: true}, learner) {
+		t.Errorf("Expected the entry to be replicated by the voters")
+	}
+
+	if replicate(nil, nil, learner) {
+		t.Errorf("Expected the learner not to make up for the voter")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if atomic.LoadInt32(&learner.sent) == 0 {
+		t.Errorf("Expected the learner to be sent the entries")
+	}
+
+	// Replica 1 is removed, the leader is a quorum of its own.
+	node.GetLock("Test")
+	node.Meta.members = []Member{{Id: 0}, {Id: 2, Learner: true}}
+	node.Meta.n_replicas = 1
+	node.ReleaseLock("Test")
+
+	if !replicate(nil, nil, learner) {
+		t.Errorf("Expected the removed replica not to count towards the quorum")
+	}
+
+	// Demoting a voter leaves two, both holding the log and healthy. The sends to the learner may still
+	// be updating its progress, so the checks are made under the lock, as on the leader.
+	node.GetLock("Test")
+	node.Meta.members = []Member{{Id: 0}, {Id: 1}, {Id: 2}}
+	node.ReleaseLock("Test")
+
+	node.GetRLock("Test")
+	members, err := node.withLearner(1)
+	removal := node.checkRemoval(1, members)
+	_, leader_err := node.withLearner(0)
+	node.ReleaseRLock("Test")
+
+	if err != nil || len(members) != 3 || !members[1].Learner {
+		t.Fatalf("Expected replica 1 to be demoted, got %v %v", members, err)
+	}
+
+	if removal != nil {
+		t.Errorf("Expected the demotion to be safe, got %v", removal)
+	}
+
+	if leader_err == nil {
+		t.Errorf("Expected the demotion of the leader to be refused")
+	}
+
+	// Replica 2 being down, demoting replica 1 leaves no healthy quorum.
+	node.GetLock("Test")
+	node.last_contact = map[int32]time.Time{1: node.now()}
+	removal = node.checkRemoval(1, members)
+	node.ReleaseLock("Test")
+
+	if removal == nil {
+		t.Errorf("Expected the demotion to be refused without a healthy quorum")
+	}
+}
+
+/*
+ * This test case checks that a decommission demotes the member, removes it
+ * and tells it to shut down and delete its data, and that a replica only
+ * accepts to shut down once it isn't a voter.
+ */
+func TestDecommission(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "decommission")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The replica being decommissioned.
+	shutdowns := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shutdowns <- r.Method + " " + r.URL.String()
+	}))
+	defer target.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms(), Config: DefaultConfig(), raft_persistence_file: filepath.Join(dir, "3000"), clock: NewManualClock(time.Unix(100, 0))}}
+	node.storage = NewStorage()
+	node.commits_ready = make(chan int32, 1)
+	node.trackMessage = make(map[string][]string)
+
+	node.Meta.members = []Member{{Id: 0, Address: "a0"}, {Id: 1, Address: "a1", ClientAddress: strings.TrimPrefix(target.URL, "http://")}, {Id: 2, Address: "a2"}}
+	node.Meta.initial_members = node.Meta.members
+	node.Meta.n_replicas = 3
+
+	node.state, node.currentTerm = Leader, 2
+	node.log = []protos.LogEntry{{Term: 2, Operation: []string{"NO-OP"}}}
+	node.nextIndex, node.matchIndex = []int32{1, 1, 1}, []int32{0, 0, 0}
+	node.last_contact = map[int32]time.Time{1: node.now(), 2: node.now()}
+	node.Meta.peer_replica_clients = []Transport{nil, &probedTransport{reachable: true}, &probedTransport{reachable: true}}
+
+	// The committed entries are applied, as ApplyToStateMachine does.
+	go func() {
+		for range node.commits_ready {
+			node.GetLock("Test")
+			node.lastApplied = node.commitIndex
+			node.ReleaseLock("Test")
+		}
+	}()
+	defer close(node.commits_ready)
+
+	d := Decommission{Member: 1, Address: node.Meta.members[1].ClientAddress, Step: decommissionDemoting}
+
+	for _, step := range []string{decommissionRemoving, decommissionShuttingDown, decommissionComplete} {
+
+		if d, err = node.advanceDecommission(context.Background(), d); err != nil || d.Step != step {
+			t.Fatalf("Expected the decommission to be %v next, got %v %v", step, d.Step, err)
+		}
+
+		node.GetRLock("Test")
+		m, member := node.member(1)
+		node.ReleaseRLock("Test")
+
+		switch step {
+		case decommissionRemoving:
+			if !member || !m.Learner || node.Meta.n_replicas != 2 {
+				t.Errorf("Expected replica 1 to be demoted to a learner, got %v", node.Meta.members)
+			}
+		case decommissionShuttingDown:
+			if member || len(node.Meta.members) != 2 || node.Meta.peer_replica_clients[1] != nil {
+				t.Errorf("Expected replica 1 to be removed, got %v", node.Meta.members)
+			}
+		}
+	}
+
+	if shutdown := <-shutdowns; shutdown != "POST /admin/shutdown?wipe=true" {
+		t.Errorf("Expected the replica to be told to shut down and delete its data, got %v", shutdown)
+	}
+
+	// A member removed already, e.g. by a previous leader, is shut down right away.
+	if d, err := node.advanceDecommission(context.Background(), Decommission{Member: 1, Step: decommissionDemoting}); err != nil || d.Step != decommissionShuttingDown {
+		t.Errorf("Expected the removed member to be shut down next, got %v %v", d.Step, err)
+	}
+
+	// The decommissioned replica only shuts down once it isn't a voter.
+	shutdown := func(replica *RaftNode) int {
+		w := httptest.NewRecorder()
+		replica.ShutdownHandler(w, httptest.NewRequest("POST", "/admin/shutdown?wipe=true", nil))
+		return w.Code
+	}
+
+	replica := &RaftNode{Meta: &NodeMetadata{replica_id: 1, Config: DefaultConfig(), shutdown_requests: make(chan bool, 1)}}
+	replica.Meta.members = []Member{{Id: 0}, {Id: 1}, {Id: 2}}
+
+	if code := shutdown(replica); code != http.StatusConflict || len(replica.Meta.shutdown_requests) != 0 {
+		t.Errorf("Expected a voter to refuse to shut down, got %v", code)
+	}
+
+	replica.Meta.members[1].Learner = true
+
+	if code := shutdown(replica); code != http.StatusOK || !<-replica.Meta.shutdown_requests {
+		t.Errorf("Expected a learner to shut down and delete its data, got %v", code)
+	}
+}
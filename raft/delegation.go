@@ -0,0 +1,256 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Delegation of zones to other clusters, mirroring the delegations of the DNS, so that clusters can be
+arranged in a hierarchy: the cluster serving a zone delegates a subzone to another cluster, which
+owns it and may delegate its own subzones further. A delegation is made of the NS records of the
+subzone and the glue (the A and AAAA records of its name servers), stored as any other record, and
+of the setting delegation.<zone>, holding the comma separated addresses of the DNS listeners of the
+child cluster, e.g. delegation.eu.example.com = "10.0.1.1:53,10.0.1.2:53". The most specific zone
+applies, and an empty value keeps a subzone served locally.
+
+The other records of a delegated zone belong to the child cluster: the client writes to them are
+rejected (as federation in the rejections), the parent only keeping the NS and DS records of the
+apex and the glue of the name servers given by the NS records. The queries for the names of a
+delegated zone, but for the DS records of its apex, are answered according to the delegation mode
+of the view (see DNSView):
+
+	refer  a referral to the child cluster (the default): an answer without authority, holding the
+	       NS records of the zone in its authority section and their glue in its additional section
+	proxy  the query is forwarded to the listeners of the child cluster and its answer relayed,
+	       falling back to a referral when none of them answers
+
+The delegated queries are counted in dns_delegations_total{view, mode, outcome}.
+*/
+
+const DelegationPrefix = "delegation." // Prefix of the settings delegating a zone to another cluster
+
+// Delegation modes of the views.
+const (
+	DelegationRefer = "refer" // Answer a referral to the child cluster
+	DelegationProxy = "proxy" // Forward the query to the child cluster
+)
+
+// Error returned for the writes of a zone delegated to another cluster.
+type delegatedZoneError struct {
+	zone    string
+	servers []string
+}
+
+func (e *delegatedZoneError) Error() string {
+	return fmt.Sprintf("zone %v is delegated to another cluster, whose DNS listeners are %v", e.zone, strings.Join(e.servers, ","))
+}
+
+// Return the delegated zone containing the name and the DNS addresses of its cluster, if it is
+// delegated to another cluster.
+func (node *RaftNode) delegatedZone(name string) (string, []string, bool) {
+
+	best, servers := "", ""
+
+	for setting, value := range node.Meta.settings.All() {
+
+		if !strings.HasPrefix(setting, DelegationPrefix) {
+			continue
+		}
+
+		z := zone.CanonicalName(strings.TrimPrefix(setting, DelegationPrefix))
+
+		if zone.InZone(name, z) && len(z) > len(best) {
+			best, servers = z, strings.TrimSpace(value)
+		}
+	}
+
+	if servers == "" {
+		return "", nil, false
+	}
+
+	return best, splitList(servers), true
+}
+
+// Split the comma separated list, dropping the empty elements.
+func splitList(list string) []string {
+
+	var elements []string
+	for _, e := range strings.Split(list, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elements = append(elements, e)
+		}
+	}
+
+	return elements
+}
+
+// Check that the key isn't a record of a zone delegated to another cluster, but for the records of the
+// delegation itself.
+func (node *RaftNode) checkDelegatedWrite(key string) error {
+
+	name, rtype, ok := zone.ParseRecordKey(key)
+	if !ok {
+		return nil
+	}
+
+	name = zone.CanonicalName(name)
+
+	z, servers, ok := node.delegatedZone(name)
+	if !ok {
+		return nil
+	}
+
+	rtype = strings.ToUpper(rtype)
+
+	if name == z && (rtype == "NS" || rtype == "DS") {
+		return nil
+	}
+
+	if rtype == "A" || rtype == "AAAA" {
+		for _, ns := range node.localRRset(z, "NS") {
+			if zone.CanonicalName(ns.(*dns.NS).Ns) == name {
+				return nil
+			}
+		}
+	}
+
+	return &delegatedZoneError{zone: z, servers: servers}
+}
+
+// Return the records of the RRset of the name from the local store (of the group owning the name,
+// see shards.go), ignoring the invalid ones.
+func (node *RaftNode) localRRset(name, rtype string) []dns.RR {
+
+	kvs, err := node.shardOf(name).scanLocalStore(zone.KeyPrefix + name + ":")
+	if err != nil {
+		node.logger().Error().Err(err).Str("name", name).Msg("Unable to read the records of the name")
+		return nil
+	}
+
+	var rrs []dns.RR
+
+	for _, kv := range kvs {
+
+		if kv.Key != zone.RecordKey(name, rtype) {
+			continue
+		}
+
+		var records []zone.Record
+		if err := json.Unmarshal([]byte(kv.Value), &records); err != nil {
+			continue
+		}
+
+		for _, r := range records {
+			if rr, err := recordRR(name, rtype, r); err == nil && rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+
+	return rrs
+}
+
+// Answer the query of a name delegated to another cluster, according to the delegation mode of the
+// view. Return nil if the name isn't delegated.
+func (node *RaftNode) delegatedAnswer(view DNSView, req *dns.Msg) *dns.Msg {
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		return nil
+	}
+
+	q := req.Question[0]
+	name := zone.CanonicalName(q.Name)
+
+	if q.Qclass != dns.ClassINET || !view.serves(name) {
+		return nil
+	}
+
+	z, servers, ok := node.delegatedZone(name)
+	if !ok || (name == z && q.Qtype == dns.TypeDS) {
+		return nil
+	}
+
+	mode := view.Delegation
+	if mode == "" {
+		mode = DelegationRefer
+	}
+
+	if mode == DelegationProxy {
+
+		if resp := node.proxyDNS(req, servers); resp != nil {
+			node.Meta.metrics.Add("dns_delegations_total", 1, "view", view.Name, "mode", mode, "outcome", "proxied")
+			return resp
+		}
+
+		node.logger().Warn().Str("zone", z).Strs("servers", servers).Msg("No DNS listener of the child cluster answered, referring the query")
+	}
+
+	node.Meta.metrics.Add("dns_delegations_total", 1, "view", view.Name, "mode", mode, "outcome", "referred")
+
+	return node.referral(req, z)
+}
+
+// Answer a referral to the name servers of the delegated zone.
+func (node *RaftNode) referral(req *dns.Msg, z string) *dns.Msg {
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	ns := node.localRRset(z, "NS")
+	if len(ns) == 0 {
+		node.logger().Warn().Str("zone", z).Msg("No NS records found for the delegated zone")
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return resp
+	}
+
+	resp.Ns = ns
+
+	for _, rr := range ns {
+
+		target := zone.CanonicalName(rr.(*dns.NS).Ns)
+
+		// Only the name servers within the zone need glue.
+		if !zone.InZone(target, z) {
+			continue
+		}
+
+		for _, rtype := range []string{"A", "AAAA"} {
+			resp.Extra = append(resp.Extra, node.localRRset(target, rtype)...)
+		}
+	}
+
+	return resp
+}
+
+// Forward the query to the DNS listeners of the child cluster, returning the first answer, or nil if
+// none answered.
+func (node *RaftNode) proxyDNS(req *dns.Msg, servers []string) *dns.Msg {
+
+	udp := &dns.Client{Net: "udp", Timeout: dnsTimeout}
+	tcp := &dns.Client{Net: "tcp", Timeout: dnsTimeout}
+
+	for _, server := range servers {
+
+		resp, _, err := udp.Exchange(req.Copy(), server)
+
+		// Answers too large for UDP are fetched again over TCP.
+		if err == nil && resp.Truncated {
+			resp, _, err = tcp.Exchange(req.Copy(), server)
+		}
+
+		if err != nil {
+			node.logger().Debug().Err(err).Str("server", server).Msg("DNS listener of the child cluster unreachable")
+			continue
+		}
+
+		resp.Id = req.Id
+		return resp
+	}
+
+	return nil
+}
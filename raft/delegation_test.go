@@ -0,0 +1,125 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks the referrals and the proxied answers of the names of
+ * a zone delegated to another cluster, the DS records answered by the parent,
+ * and the rejection of the writes of the records owned by the child cluster.
+ */
+func TestDelegation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "delegation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	r := mux.NewRouter().SkipClean(true)
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler)
+	store := httptest.NewServer(r)
+	defer store.Close()
+
+	put := func(name, rtype string, records ...zone.Record) {
+		encoded, _ := json.Marshal(records)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put("eu.example.com.", "NS", zone.Record{Name: "eu.example.com.", Type: "NS", TTL: 300, Data: "ns1.eu.example.com."}, zone.Record{Name: "eu.example.com.", Type: "NS", TTL: 300, Data: "ns.example.org."})
+	put("ns1.eu.example.com.", "A", zone.Record{Name: "ns1.eu.example.com.", Type: "A", TTL: 300, Data: "192.0.2.53"})
+
+	// The DNS listener of the child cluster.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Authoritative = true
+		rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.7")
+		resp.Answer = []dns.RR{rr}
+		w.WriteMsg(resp)
+	})}
+	go child.ActivateAndServe()
+	defer child.Shutdown()
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.settings.apply(SettingChange{Name: DelegationPrefix + "eu.example.com", Value: conn.LocalAddr().String()})
+	node.Meta.settings.apply(SettingChange{Name: DelegationPrefix + "local.eu.example.com", Value: ""})
+
+	refer, proxy := DNSView{Name: "refer"}, DNSView{Name: "proxy", Delegation: DelegationProxy}
+
+	query := func(view DNSView, name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return node.delegatedAnswer(view, req)
+	}
+
+	resp := query(refer, "www.eu.example.com.", dns.TypeA)
+	if resp == nil || resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 2 || len(resp.Extra) != 1 || resp.Extra[0].(*dns.A).A.String() != "192.0.2.53" {
+		t.Errorf("Expected a referral with the glue of the name server within the zone, got %v", resp)
+	}
+
+	if resp := query(proxy, "www.eu.example.com.", dns.TypeA); resp == nil || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.7" {
+		t.Errorf("Expected the answer of the child cluster, got %v", resp)
+	}
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"eu.example.com.", dns.TypeDS},
+		{"www.local.eu.example.com.", dns.TypeA},
+		{"www.example.com.", dns.TypeA},
+	} {
+		if resp := query(refer, q.name, q.qtype); resp != nil {
+			t.Errorf("Expected %v %v to be answered locally, got %v", q.name, dns.TypeToString[q.qtype], resp)
+		}
+	}
+
+	// The child cluster unreachable, the queries are referred.
+	node.Meta.settings.apply(SettingChange{Name: DelegationPrefix + "eu.example.com", Value: "127.0.0.1:1"})
+
+	if resp := query(proxy, "www.eu.example.com.", dns.TypeA); resp == nil || len(resp.Ns) != 2 {
+		t.Errorf("Expected a referral once the child cluster is unreachable, got %v", resp)
+	}
+
+	for key, allowed := range map[string]bool{
+		zone.RecordKey("eu.example.com", "NS"):          true,
+		zone.RecordKey("eu.example.com", "DS"):          true,
+		zone.RecordKey("ns1.eu.example.com", "A"):       true,
+		zone.RecordKey("www.eu.example.com", "A"):       false,
+		zone.RecordKey("eu.example.com", "MX"):          false,
+		zone.RecordKey("www.local.eu.example.com", "A"): true,
+		zone.RecordKey("www.example.com", "A"):          true,
+	} {
+		if err := node.checkFederatedWrite(key); (err == nil) != allowed {
+			t.Errorf("Expected the write of %v to be allowed: %v, got %v", key, allowed, err)
+		}
+	}
+
+	if err := (&DNSConfig{Views: []DNSView{{Name: "v", Delegation: "forward"}}}).Validate(); err == nil {
+		t.Errorf("Expected the unknown delegation mode to be refused")
+	}
+}
@@ -0,0 +1,181 @@
+package raft
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Deletion of all the keys with a prefix, with DELETE /kvstore?prefix=<prefix>. Rather than one write per
+key, the deletion is replicated as a single "DELETE_PREFIX" log entry, which every replica applies to
+the keys it holds with the prefix at that point of the log: the deletion is atomic, and the keys
+created under the prefix by earlier entries are deleted along with the others. With dry_run=true,
+nothing is deleted, and the leader only counts the keys the deletion would currently remove.
+
+The prefix can't be empty, nor overlap the reserved namespaces (see reservedKey). Users whose
+permission doesn't cover the writes need a role with a prefix rule granting write access to the whole
+prefix, as zone and record rules can't cover the keys that may be created under it. Since the keys of
+the zones replicated from another cluster are only written by their home cluster (see federation.go),
+the deletion is refused if any of them currently has the prefix. As the deletion is routed before
+the keys, a key named "kvstore" can only be deleted through the KVService.
+*/
+
+// The response to the deletion of a prefix.
+type DeletePrefixResponse struct {
+	Prefix  string `json:"prefix"`
+	Deleted int    `json:"deleted"` // Number of keys deleted, or that would be deleted by a dry run
+	DryRun  bool   `json:"dry_run,omitempty"`
+}
+
+/*
+Handle requests of the form /kvstore?prefix=<prefix>&dry_run=<bool>&client=<client>, along with the
+session and seq form values of a client session. The response is sent once the deletion is applied
+on the leader.
+*/
+func (node *RaftNode) DeletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("DELETE_PREFIX request received")
+
+	session, sequence, err := requestSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+
+	dryRun := false
+	if s := r.FormValue("dry_run"); s != "" {
+		if dryRun, err = strconv.ParseBool(s); err != nil {
+			writeError(w, http.StatusBadRequest, "Error: invalid dry_run %q", s)
+			return
+		}
+	}
+
+	node.GetRLock("Delete Prefix Handler")
+
+	if node.state != Leader {
+		node.rejectRequest(rejectNotLeader, r, errNotLeader)
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Delete Prefix Handler")
+		writeNotLeader(w, leader)
+		return
+	}
+
+	node.ReleaseRLock("Delete Prefix Handler")
+
+	prefix := r.FormValue("prefix")
+
+	deleted, err := node.deletePrefix(r.Context(), prefix, dryRun, r.FormValue("client"), session, sequence)
+	if err != nil {
+		node.logger().Error().Err(err).Str("prefix", prefix).Msg("Error occured in DELETE_PREFIX request")
+		writeError(w, httpStatus(err), "Error: %v", status.Convert(err).Message())
+		return
+	}
+
+	node.logger().Info().Str("prefix", prefix).Int("deleted", deleted).Bool("dry_run", dryRun).Msg("DELETE_PREFIX request completed successfully")
+	writeJSON(w, http.StatusOK, DeletePrefixResponse{Prefix: prefix, Deleted: deleted, DryRun: dryRun})
+}
+
+// Check that the caller (given by the context) may delete the keys with the prefix.
+func (node *RaftNode) checkDeletePrefix(ctx context.Context, prefix, client string) error {
+
+	if prefix == "" {
+		return node.reject(rejectValidation, "DELETE_PREFIX", prefix, client, status.Error(codes.InvalidArgument, "the prefix can't be empty"))
+	}
+
+	// Either the prefix starts with a reserved one, or a reserved key may start with it.
+	for _, reserved := range reservedPrefixes {
+		if strings.HasPrefix(prefix, reserved) || strings.HasPrefix(reserved, prefix) {
+			return node.reject(rejectValidation, "DELETE_PREFIX", prefix, client, status.Errorf(codes.PermissionDenied, "prefix %q overlaps the keys reserved for the cluster settings", prefix))
+		}
+	}
+
+	if user, ok := requestUser(ctx); ok && !node.Meta.roles.allowsPrefix(user, prefix, PermissionWrite) {
+		return node.reject(rejectACL, "DELETE_PREFIX", prefix, client, status.Errorf(codes.PermissionDenied, "user %v isn't allowed to write all the keys with prefix %q", user.Name, prefix))
+	}
+
+	return nil
+}
+
+/*
+Delete the keys with the prefix, returning how many were deleted, or only count them if dryRun is
+set. Errors are KVService errors, as for replicateTxn.
+*/
+func (node *RaftNode) deletePrefix(ctx context.Context, prefix string, dryRun bool, client string, session, sequence int64) (int, error) {
+
+	if err := node.checkDeletePrefix(ctx, prefix, client); err != nil {
+		return 0, err
+	}
+
+	kvs, err := node.scanLocalStore(prefix)
+	if err != nil {
+		return 0, status.Errorf(codes.Unavailable, "unable to read the keys with prefix %q: %v", prefix, err)
+	}
+
+	for _, kv := range kvs {
+		if err := node.checkFederatedWrite(kv.Key); err != nil {
+			return 0, node.reject(rejectFederation, "DELETE_PREFIX", kv.Key, client, status.Error(codes.FailedPrecondition, err.Error()))
+		}
+
+		if err := node.checkShardWrite(kv.Key); err != nil {
+			return 0, node.reject(rejectShard, "DELETE_PREFIX", kv.Key, client, shardStatus(err))
+		}
+	}
+
+	if dryRun {
+		return len(kvs), nil
+	}
+
+	node.GetRLock("Delete Prefix")
+
+	if node.state != Leader {
+		defer node.ReleaseRLock("Delete Prefix")
+		return 0, node.reject(rejectNotLeader, "DELETE_PREFIX", prefix, client, node.notLeaderError())
+	}
+
+	index, success, err := node.proposeSessionCommand(ctx, []string{"DELETE_PREFIX", prefix}, client, session, sequence) // releases the lock
+
+	switch {
+
+	case err == errNotLeader:
+		node.GetRLock("Delete Prefix")
+		defer node.ReleaseRLock("Delete Prefix")
+		return 0, node.notLeaderError()
+
+	case err == context.DeadlineExceeded || err == context.Canceled:
+		return 0, status.FromContextError(err).Err()
+
+	case err == errUnknownSession || err == errStaleSequence || err == errReadOnly:
+		return 0, status.Error(codes.FailedPrecondition, err.Error())
+
+	case status.Code(err) == codes.PermissionDenied:
+		return 0, err
+
+	case !success:
+		return 0, status.Errorf(codes.Unavailable, "%v", err)
+
+	}
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		return 0, status.FromContextError(err).Err()
+	}
+
+	node.GetLock("Delete Prefix")
+	defer node.ReleaseLock("Delete Prefix")
+
+	result, ok := node.txn_results[index]
+	if !ok {
+		// A retried deletion of a session isn't applied again, but its outcome is kept in the session.
+		if result, err = node.sessionResult(session, sequence); err != nil {
+			return 0, err
+		}
+	}
+
+	delete(node.txn_results, index)
+
+	return len(result.Events), nil
+}
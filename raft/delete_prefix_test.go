@@ -0,0 +1,84 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+ * This test case checks that the deletion of a prefix is refused for the
+ * prefixes overlapping the reserved keys and for the users whose roles don't
+ * grant write access to the whole prefix, and that a dry run on the leader
+ * counts the keys with the prefix without deleting them.
+ */
+func TestDeletePrefix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "delete_prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(`{"success": [{"type": "PUT", "key": "tmp-a", "value": "1"}, {"type": "PUT", "key": "tmp-b", "value": "2"}, {"type": "PUT", "key": "other", "value": "3"}]}`)))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), users: NewUsers(), roles: NewRoles(), rejections: NewRejections(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	rule, _ := parseRule("write:prefix:tmp")
+	node.Meta.roles.apply("cleaner", &Role{Name: "cleaner", Rules: []Rule{rule}})
+	cleaner := User{Name: "cleaner", Roles: []string{"cleaner"}}
+
+	deletePrefix := func(query string, user *User) (int, DeletePrefixResponse) {
+
+		r := httptest.NewRequest("DELETE", "/kvstore?"+query, nil)
+		if user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, *user))
+		}
+
+		w := httptest.NewRecorder()
+		node.DeletePrefixHandler(w, r)
+
+		var response DeletePrefixResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+
+		return w.Code, response
+	}
+
+	if code, _ := deletePrefix("prefix=tmp&dry_run=true", nil); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a follower to refuse the deletion, got %v", code)
+	}
+
+	node.state = Leader
+
+	for _, prefix := range []string{"", "_", RolesPrefix + "admin"} {
+		if code, _ := deletePrefix("prefix="+prefix, nil); code != http.StatusBadRequest && code != http.StatusForbidden {
+			t.Errorf("Expected the deletion of prefix %q to be refused, got %v", prefix, code)
+		}
+	}
+
+	if code, _ := deletePrefix("prefix=t&dry_run=true", &cleaner); code != http.StatusForbidden {
+		t.Errorf("Expected a role covering only part of the prefix not to allow the deletion, got %v", code)
+	}
+
+	if code, response := deletePrefix("prefix=tmp-&dry_run=true", &cleaner); code != http.StatusOK || response.Deleted != 2 || !response.DryRun {
+		t.Errorf("Expected a dry run to count 2 keys, got %v %+v", code, response)
+	}
+
+	if kv.Get("tmp-a") != "1" || kv.Get("tmp-b") != "2" {
+		t.Errorf("Expected a dry run not to delete any key")
+	}
+}
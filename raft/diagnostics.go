@@ -0,0 +1,203 @@
+package raft
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+/*
+Diagnostics bundles, for support requests. A bundle is a gzipped tar archive of:
+
+	report.json      why and when the bundle was written, by which replica
+	status.json      the status of the replica, as returned by /admin/status
+	entries.json     the latest diagnosticsEntries log entries, without their keys and values
+	config.json      the configuration of the replica, without its tokens
+	logs.jsonl       the latest messages logged by the replica (see logging.Recent)
+	goroutines.txt   the stacks of all the goroutines
+
+With -diagnostics-dir, a replica writes a bundle to that directory when it shuts down, and when one
+of its main goroutines panics, before crashing. GET /admin/diagnostics returns one on demand.
+*/
+
+const diagnosticsEntries = 100 // Latest log entries in a bundle
+
+// Written to report.json.
+type DiagnosticsReport struct {
+	Reason    string    `json:"reason"`
+	Time      time.Time `json:"time"`
+	ReplicaId int32     `json:"replica_id"`
+	GoVersion string    `json:"go_version"`
+}
+
+// A log entry of entries.json. Only the type of the operation is kept, as the keys and values may
+// be sensitive.
+type DiagnosticsEntry struct {
+	Index     int32  `json:"index"`
+	Term      int32  `json:"term"`
+	Operation string `json:"operation"`
+	Clientid  string `json:"clientid,omitempty"`
+	Session   int64  `json:"session,omitempty"`
+}
+
+// Write the diagnostics bundle to w. The replica's lock is only taken if lock is set, as a
+// panicking goroutine may hold it.
+func (node *RaftNode) writeDiagnostics(w io.Writer, reason string, lock bool) error {
+
+	if lock {
+		node.GetRLock("writeDiagnostics")
+	}
+
+	status := node.status()
+
+	first := node.lastLogIndex() + 1 - diagnosticsEntries
+	if first < node.logStart {
+		first = node.logStart
+	}
+
+	entries := make([]DiagnosticsEntry, 0, node.lastLogIndex()+1-first)
+	for i := first; i <= node.lastLogIndex(); i++ {
+
+		entry := DiagnosticsEntry{Index: i, Term: node.entry(i).Term, Clientid: node.entry(i).Clientid, Session: node.entry(i).Session}
+		if len(node.entry(i).Operation) > 0 {
+			entry.Operation = node.entry(i).Operation[0]
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if lock {
+		node.ReleaseRLock("writeDiagnostics")
+
+		// Measuring the resources takes the lock, see resourceUsage.
+		usage := node.resourceUsage()
+		status.Resources = &usage
+	}
+
+	status.Alarms = node.Meta.alarms.List()
+
+	report := DiagnosticsReport{Reason: reason, Time: node.now(), ReplicaId: node.Meta.replica_id, GoVersion: runtime.Version()}
+
+	var goroutines strings.Builder
+	pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+
+	add := func(name string, contents []byte) error {
+
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), ModTime: report.Time}
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		_, err := archive.Write(contents)
+		return err
+	}
+
+	addJSON := func(name string, v interface{}) error {
+		encoded, _ := json.MarshalIndent(v, "", "  ")
+		return add(name, encoded)
+	}
+
+	files := []func() error{
+		func() error { return addJSON("report.json", report) },
+		func() error { return addJSON("status.json", status) },
+		func() error { return addJSON("entries.json", entries) },
+		func() error { return addJSON("config.json", node.redactedConfig()) },
+		func() error { return add("logs.jsonl", []byte(strings.Join(logging.Recent.Lines(), ""))) },
+		func() error { return add("goroutines.txt", []byte(goroutines.String())) },
+	}
+
+	for _, file := range files {
+		if err := file(); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Return a copy of the configuration of the replica, without its secrets.
+func (node *RaftNode) redactedConfig() Config {
+
+	config := *node.Meta.Config
+
+	for _, secret := range []*string{&config.PeerToken, &config.ClientToken, &config.HTTPAdminToken, &config.FederationToken, &config.ChangeStream.Token, &config.Backups.SecretKey, &config.Backups.Token} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+
+	return config
+}
+
+// Return the name of a bundle written at the given time.
+func (node *RaftNode) diagnosticsName(t time.Time) string {
+	return fmt.Sprintf("diagnostics-%d-%s.tar.gz", node.Meta.replica_id, t.UTC().Format("20060102T150405Z"))
+}
+
+// Write a diagnostics bundle to -diagnostics-dir, if set. See writeDiagnostics for lock.
+func (node *RaftNode) WriteDiagnosticsBundle(reason string, lock bool) {
+
+	dir := node.Meta.Config.DiagnosticsDir
+	if dir == "" {
+		return
+	}
+
+	path := filepath.Join(dir, node.diagnosticsName(node.now()))
+
+	file, err := os.Create(path)
+	if err == nil {
+		err = node.writeDiagnostics(file, reason, lock)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		node.logger().Error().Err(err).Str("path", path).Msg("Unable to write the diagnostics bundle")
+		return
+	}
+
+	node.logger().Info().Str("path", path).Str("reason", reason).Msg("Diagnostics bundle written")
+}
+
+// Write a diagnostics bundle if the calling goroutine panics, before letting it crash the replica.
+// Deferred by the main goroutines of the replica.
+func (node *RaftNode) diagnoseCrash() {
+
+	if r := recover(); r != nil {
+		node.logger().Error().Interface("panic", r).Msg("Replica crashing")
+		node.WriteDiagnosticsBundle(fmt.Sprintf("panic: %v", r), false)
+		panic(r)
+	}
+}
+
+// Handle requests for a diagnostics bundle of the replica.
+func (node *RaftNode) DiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("DIAGNOSTICS request received")
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", node.diagnosticsName(node.now())))
+
+	if err := node.writeDiagnostics(w, "requested by "+r.RemoteAddr, true); err != nil {
+		node.logger().Error().Err(err).Msg("Unable to write the diagnostics bundle")
+	}
+}
@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that a diagnostics bundle holds the status, the latest log entries
+ * without their keys and values, the configuration without its secrets and the latest logs, and
+ * that one is written to the diagnostics directory when a goroutine panics.
+ */
+func TestDiagnostics(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), alarms: NewAlarms(), Config: DefaultConfig(), clock: NewManualClock(time.Unix(0, 0))}}
+	node.Meta.replica_id, node.state, node.currentTerm = 2, Follower, 3
+	node.Meta.Config.PeerToken = "secret"
+
+	for i := 0; i < diagnosticsEntries+10; i++ {
+		node.log = append(node.log, protos.LogEntry{Term: 3, Operation: []string{"POST", "key", "sensitive"}})
+	}
+
+	logging.Logger.Info().Str("marker", "diagnostics").Msg("Logged before the bundle")
+
+	w := httptest.NewRecorder()
+	node.DiagnosticsHandler(w, httptest.NewRequest("GET", "/admin/diagnostics", nil))
+
+	files := readBundle(t, w.Body)
+
+	for _, name := range []string{"report.json", "status.json", "entries.json", "config.json", "logs.jsonl", "goroutines.txt"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("Expected %v in the bundle", name)
+		}
+	}
+
+	var status Status
+	if err := json.Unmarshal([]byte(files["status.json"]), &status); err != nil || status.Id != 2 || status.Term != 3 {
+		t.Errorf("Unexpected status %v (%v)", files["status.json"], err)
+	}
+
+	var entries []DiagnosticsEntry
+	json.Unmarshal([]byte(files["entries.json"]), &entries)
+	if len(entries) != diagnosticsEntries || entries[0].Index != 10 || entries[0].Operation != "POST" || strings.Contains(files["entries.json"], "sensitive") {
+		t.Errorf("Expected the latest %v entries without their values, got %v", diagnosticsEntries, files["entries.json"])
+	}
+
+	if strings.Contains(files["config.json"], "secret") || !strings.Contains(files["config.json"], "REDACTED") {
+		t.Errorf("Expected the tokens to be redacted, got %v", files["config.json"])
+	}
+
+	if !strings.Contains(files["logs.jsonl"], `"marker":"diagnostics"`) {
+		t.Errorf("Expected the latest logs in the bundle")
+	}
+
+	if !strings.Contains(files["goroutines.txt"], "TestDiagnostics") {
+		t.Errorf("Expected the stacks of the goroutines in the bundle")
+	}
+
+	dir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node.Meta.Config.DiagnosticsDir = dir
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("Expected the panic to be raised again, got %v", r)
+			}
+		}()
+
+		defer node.diagnoseCrash()
+		panic("boom")
+	}()
+
+	bundles, _ := filepath.Glob(filepath.Join(dir, "diagnostics-2-*.tar.gz"))
+	if len(bundles) != 1 {
+		t.Fatalf("Expected a bundle written on the panic, got %v", bundles)
+	}
+
+	file, err := os.Open(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if report := readBundle(t, file)["report.json"]; !strings.Contains(report, "panic: boom") {
+		t.Errorf("Expected the panic in the report, got %v", report)
+	}
+}
+
+// Return the contents of the files of a diagnostics bundle.
+func readBundle(t *testing.T, r io.Reader) map[string]string {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	archive := tar.NewReader(gz)
+
+	for {
+
+		header, err := archive.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, _ := ioutil.ReadAll(archive)
+		files[header.Name] = string(contents)
+	}
+}
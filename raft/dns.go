@@ -0,0 +1,491 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+DNS listeners, answering queries from the records of the local key-value store (see the zone
+package). Every replica answers, followers included, so the answers may briefly lag behind the
+latest writes. The listeners are defined in the "dns" section of the config file (see
+LoadConfigFile), each with its own address, protocol and address family, and the view it answers
+for:
+
+	{"dns": {
+		"views": [{"name": "internal"}, {"name": "external", "zones": ["example.com."]}],
+		"listeners": [
+			{"address": ":53", "protocol": "udp", "family": "ipv4", "view": "internal"},
+			{"address": "[::]:853", "protocol": "tls", "family": "ipv6", "view": "external",
+			 "cert_file": "dot.pem", "key_file": "dot.key"}
+		]
+	}}
+
+A view answers for the names of its zones, or for every name if it lists none, and refuses the
+other queries, so that e.g. an external listener doesn't expose the internal zones. A listener of
+the ipv4 or ipv6 family only accepts that family, while one without a family accepts both. The
+"tls" protocol serves DNS over TLS (RFC 7858), reloading its certificate when the files change, and
+the "https" protocol DNS over HTTPS (RFC 8484, see doh.go). The listeners of a view with "updates":
+true also accept the dynamic updates (RFC 2136) of its zones signed by the users of the client HTTP
+API (see dns_update.go), and those of a view with "transfers": true the zone transfers to the
+secondary name servers signed with TSIG (see transfers.go), the other views refusing them.
+
+A view can guard the freshness of the answers of its zones, for replicas cut off from the leader:
+
+	{"name": "external", "zones": ["example.com."], "freshness": [
+		{"zone": "example.com.", "max_staleness": 10, "mode": "servfail"},
+		{"zone": "static.example.com.", "mode": "serve"}
+	]}
+
+A replica that hasn't heard from the leader for max_staleness seconds (or, for the leader, from a
+quorum of the members) then answers the queries of a zone in servfail mode with SERVFAIL, favouring
+consistency, while it keeps answering those of a zone in serve mode, favouring availability, as it
+does for the zones without a guard. The guard of the closest enclosing zone of a name applies.
+
+The queries are answered like those of an authoritative name server, with the wildcards, the
+delegations and the CNAME records of the zones, see lookup.go. The "answer_cache" section caches
+the answers of the hot names, see answercache.go.
+
+A view with a "rate_limit" limits the responses sent over UDP to each client network, see rrl.go,
+and the "ttls" of a view bound the TTLs answered for its zones, see ttls.go.
+
+The "edns" section sets the UDP payload size advertised and whether the client subnets forwarded
+by the resolvers are used, see edns.go. The "geo" section locates the resolvers in regions, to
+answer them with the records meant for their region, see geo.go. The "query_log" section logs the queries answered to files, syslog or Kafka, see
+querylog.go.
+*/
+
+const (
+	dnsTimeout = 2 * time.Second              // Time allowed for reading and writing a query over TCP or TLS
+	neverHeard = time.Duration(math.MaxInt64) // Silence of the leader when it was never heard from
+)
+
+// The DNS views and listeners of a replica.
+type DNSConfig struct {
+	Views       []DNSView      `json:"views"`
+	Listeners   []DNSListener  `json:"listeners"`
+	Geo         DNSGeo         `json:"geo"`          // Regions of the resolvers, see geo.go
+	QueryLog    DNSQueryLog    `json:"query_log"`    // Sinks of the queries answered, see querylog.go
+	EDNS        DNSEDNS        `json:"edns"`         // UDP payload size and client subnet mode, see edns.go
+	AnswerCache DNSAnswerCache `json:"answer_cache"` // Answers cached by the replica, see answercache.go
+}
+
+type DNSView struct {
+	Name       string         `json:"name"`
+	Zones      []string       `json:"zones"`      // Zones answered for, every name if empty
+	Updates    bool           `json:"updates"`    // Whether dynamic updates of the zones are accepted, see dns_update.go
+	Transfers  bool           `json:"transfers"`  // Whether zone transfers of the zones are accepted, see transfers.go
+	Freshness  []DNSFreshness `json:"freshness"`  // Freshness guards of the zones
+	Delegation string         `json:"delegation"` // DelegationRefer (the default) or DelegationProxy, see delegation.go
+	RateLimit  *DNSRateLimit  `json:"rate_limit"` // Limits of the responses over UDP, none if nil, see rrl.go
+	TTLs       []DNSTTLClamp  `json:"ttls"`       // TTL clamps of the zones, see ttls.go
+}
+
+// Freshness guard modes.
+const (
+	FreshnessServe    = "serve"    // Keep answering from the local records, however stale
+	FreshnessServfail = "servfail" // Answer SERVFAIL once the leader wasn't heard from for MaxStaleness
+)
+
+// The freshness guard of a zone of a view.
+type DNSFreshness struct {
+	Zone         string `json:"zone"`
+	MaxStaleness int    `json:"max_staleness"` // Seconds without hearing from the leader after which the mode applies
+	Mode         string `json:"mode"`          // FreshnessServe or FreshnessServfail
+}
+
+type DNSListener struct {
+	Address  string `json:"address"`  // e.g. ":53" or "[::]:853"
+	Protocol string `json:"protocol"` // udp, tcp or tls
+	Family   string `json:"family"`   // ipv4, ipv6, or empty for both
+	View     string `json:"view"`
+	CertFile string `json:"cert_file"` // PEM certificate of a tls or https listener
+	KeyFile  string `json:"key_file"`  // PEM private key of the certificate
+	Path     string `json:"path"`      // Path of the DNS messages of an https listener, dohPath if empty
+}
+
+// Return the network the listener listens on, as understood by dns.Server.
+func (l DNSListener) network() (string, error) {
+
+	network := ""
+
+	switch l.Protocol {
+	case "udp", "tcp":
+		network = l.Protocol
+	case "tls", "https":
+		network = "tcp"
+	default:
+		return "", fmt.Errorf("invalid protocol %q, expected udp, tcp, tls or https", l.Protocol)
+	}
+
+	switch l.Family {
+	case "ipv4":
+		network += "4"
+	case "ipv6":
+		network += "6"
+	case "":
+	default:
+		return "", fmt.Errorf("invalid address family %q, expected ipv4 or ipv6", l.Family)
+	}
+
+	if l.Protocol == "tls" {
+		network += "-tls"
+	}
+
+	return network, nil
+}
+
+// Whether the view answers for the name, which must be canonical.
+func (v DNSView) serves(name string) bool {
+
+	if len(v.Zones) == 0 {
+		return true
+	}
+
+	for _, z := range v.Zones {
+		if zone.InZone(name, zone.CanonicalName(z)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the freshness guard of the closest enclosing zone of the name, which must be canonical.
+func (v DNSView) freshness(name string) (DNSFreshness, bool) {
+
+	var guard DNSFreshness
+	found := false
+
+	for _, f := range v.Freshness {
+		if z := zone.CanonicalName(f.Zone); zone.InZone(name, z) && (!found || len(z) > len(zone.CanonicalName(guard.Zone))) {
+			guard, found = f, true
+		}
+	}
+
+	return guard, found
+}
+
+// Check that the listeners are valid and refer to defined views.
+func (c *DNSConfig) Validate() error {
+
+	views := make(map[string]bool)
+
+	for _, v := range c.Views {
+
+		if v.Name == "" || views[v.Name] {
+			return fmt.Errorf("dns: views must have distinct, non-empty names, got %q", v.Name)
+		}
+
+		for _, z := range v.Zones {
+			if _, ok := dns.IsDomainName(z); !ok {
+				return fmt.Errorf("dns: view %v: invalid zone %q", v.Name, z)
+			}
+		}
+
+		for _, f := range v.Freshness {
+
+			if _, ok := dns.IsDomainName(f.Zone); !ok {
+				return fmt.Errorf("dns: view %v: invalid freshness zone %q", v.Name, f.Zone)
+			}
+
+			if (f.Mode != FreshnessServe && f.Mode != FreshnessServfail) || (f.Mode == FreshnessServfail && f.MaxStaleness <= 0) {
+				return fmt.Errorf("dns: view %v: zone %v: expected the serve mode, or the servfail mode with a positive max_staleness", v.Name, f.Zone)
+			}
+		}
+
+		if v.Delegation != "" && v.Delegation != DelegationRefer && v.Delegation != DelegationProxy {
+			return fmt.Errorf("dns: view %v: expected the refer or proxy delegation mode, got %q", v.Name, v.Delegation)
+		}
+
+		if v.RateLimit != nil {
+			if err := v.RateLimit.validate(v.Name); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range v.TTLs {
+			if err := c.validate(v.Name); err != nil {
+				return err
+			}
+		}
+
+		views[v.Name] = true
+	}
+
+	for i, l := range c.Listeners {
+
+		if _, err := l.network(); err != nil {
+			return fmt.Errorf("dns: listener %v: %v", i, err)
+		}
+
+		if _, _, err := net.SplitHostPort(l.Address); err != nil {
+			return fmt.Errorf("dns: listener %v: invalid address %q: %v", i, l.Address, err)
+		}
+
+		if !views[l.View] {
+			return fmt.Errorf("dns: listener %v: undefined view %q", i, l.View)
+		}
+
+		if (l.Protocol == "tls" || l.Protocol == "https") != (l.CertFile != "" && l.KeyFile != "") {
+			return fmt.Errorf("dns: listener %v: a certificate and its key are required by, and only by, tls and https listeners", i)
+		}
+
+		if l.Path != "" && (l.Protocol != "https" || !strings.HasPrefix(l.Path, "/")) {
+			return fmt.Errorf("dns: listener %v: expected the path of an https listener to start with /, got %q", i, l.Path)
+		}
+	}
+
+	if err := c.QueryLog.validate(); err != nil {
+		return err
+	}
+
+	if err := c.EDNS.validate(); err != nil {
+		return err
+	}
+
+	if err := c.AnswerCache.validate(); err != nil {
+		return err
+	}
+
+	return c.Geo.validate()
+}
+
+// Return the view with the given name.
+func (c *DNSConfig) view(name string) DNSView {
+
+	for _, v := range c.Views {
+		if v.Name == name {
+			return v
+		}
+	}
+
+	return DNSView{Name: name}
+}
+
+// Start the configured DNS listeners, which are shut down once ctx is done.
+func (node *RaftNode) StartDNSListeners(ctx context.Context) {
+
+	config := &node.Meta.Config.DNS
+
+	if config.Geo.enabled() {
+		geo, err := loadGeoTable(config.Geo)
+		CheckErrorFatal(err)
+		node.geo = geo
+	}
+
+	node.query_log = node.startQueryLog(ctx, config.QueryLog)
+
+	for _, l := range config.Listeners {
+
+		network, _ := l.network() // checked by Validate
+		view := config.view(l.View)
+
+		updates := newRawUpdates()
+		handler := node.dnsHandler(view, updates)
+
+		// DNS over HTTPS is served by an HTTP server, see doh.go
+		if l.Protocol == "https" {
+			node.startDoHListener(ctx, l, network, view, updates, handler)
+			node.logger().Info().Str("address", l.Address).Str("network", network+"-https").Str("view", view.Name).Msg("DNS listener up")
+			continue
+		}
+
+		server := &dns.Server{
+			Addr:         l.Address,
+			Net:          network,
+			Handler:      handler,
+			UDPSize:      config.EDNS.udpSize(),
+			ReadTimeout:  dnsTimeout,
+			WriteTimeout: dnsTimeout,
+		}
+
+		if view.Updates {
+			server.MsgAcceptFunc = acceptUpdates
+		}
+
+		if view.Updates || view.Transfers {
+			server.DecorateReader = func(r dns.Reader) dns.Reader { return updateReader{Reader: r, updates: updates} }
+		}
+
+		if l.Protocol == "tls" {
+			certs, err := newCertReloader(l.CertFile, l.KeyFile, "")
+			CheckErrorFatal(err)
+			server.TLSConfig = certs.certificateConfig()
+		}
+
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+
+		go func() {
+			if err := server.ListenAndServe(); err != nil && ctx.Err() == nil {
+				CheckErrorFatal(err)
+			}
+		}()
+
+		go func() {
+			<-ctx.Done()
+			server.Shutdown()
+		}()
+
+		<-started
+		node.logger().Info().Str("address", l.Address).Str("network", network).Str("view", view.Name).Msg("DNS listener up")
+	}
+}
+
+// Return the handler answering the queries of a view, and its updates and zone transfers if it
+// accepts them.
+func (node *RaftNode) dnsHandler(view DNSView, updates *rawUpdates) dns.Handler {
+
+	// The responses sent over UDP are limited, see rrl.go
+	limiter := node.rrl.of(view)
+
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+
+		start := time.Now()
+
+		if view.Updates && req.Opcode == dns.OpcodeUpdate {
+			node.serveDNSUpdate(view, updates, w, req)
+			return
+		}
+
+		// The members dedicated to consensus still accept the updates, see serving.go
+		if node.refuseDNSQuery(view, w, req) {
+			return
+		}
+
+		if view.Transfers && transfer(req) {
+			node.serveTransfer(view, updates, w, req)
+			return
+		}
+
+		// The queries of another EDNS version, or with an invalid client subnet, see edns.go
+		resp := node.ednsError(view, req)
+
+		if resp == nil {
+
+			// The answers of the names with records by region depend on the resolver, see geo.go
+			client := node.locateClient(w, req)
+
+			// The names of the zones delegated to other clusters, see delegation.go
+			if resp = node.delegatedAnswer(view, req); resp == nil {
+				resp = node.answerDNS(view, req, client)
+				client.echo(resp, req)
+			}
+		}
+
+		if resp = node.limitResponse(view, limiter, w, req, resp); resp == nil {
+			return
+		}
+
+		size := node.Meta.Config.DNS.EDNS.respond(resp, req)
+
+		// Answers too large for the UDP payload sizes are truncated, so that the client retries over TCP.
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+
+			if resp.Truncate(size); resp.Truncated {
+				node.Meta.metrics.Add("dns_truncated_total", 1, "view", view.Name)
+			}
+		}
+
+		node.Meta.metrics.Add("dns_queries_total", 1, "view", view.Name, "rcode", dns.RcodeToString[resp.Rcode])
+		node.logQuery(view, w, req, resp, start) // see querylog.go
+		w.WriteMsg(resp)
+	})
+}
+
+/*
+Return the time since the replica last heard from the leader, or since the leader last heard from a
+quorum of the members, as the records of a replica cut off for longer may be outdated.
+*/
+func (node *RaftNode) leaderSilence() time.Duration {
+
+	node.GetRLock("Leader Silence")
+	defer node.ReleaseRLock("Leader Silence")
+
+	now := node.now()
+
+	if node.state != Leader {
+
+		if node.Meta.leader_id < 0 || node.Meta.leaderContact.IsZero() {
+			return neverHeard
+		}
+
+		return now.Sub(node.Meta.leaderContact)
+	}
+
+	contacts := make([]time.Time, 0)
+	for _, m := range node.Meta.members {
+		if m.Id != node.Meta.replica_id {
+			contacts = append(contacts, node.last_contact[m.Id])
+		}
+	}
+
+	// The leader counts towards the quorum, along with the members heard from most recently.
+	needed := len(node.Meta.members) / 2
+	if needed == 0 {
+		return 0
+	}
+
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].After(contacts[j]) })
+
+	if len(contacts) < needed || contacts[needed-1].IsZero() {
+		return neverHeard
+	}
+
+	return now.Sub(contacts[needed-1])
+}
+
+// Answer a query of the view from the records of the local key-value store (see lookup.go), choosing
+// the records meant for the region of the client if it is located (see geo.go).
+func (node *RaftNode) answerDNS(view DNSView, req *dns.Msg, client *geoClient) *dns.Msg {
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	if req.Opcode != dns.OpcodeQuery || len(req.Question) != 1 {
+		resp.SetRcode(req, dns.RcodeNotImplemented)
+		return resp
+	}
+
+	q := req.Question[0]
+	name := zone.CanonicalName(q.Name)
+
+	// The zone transfers of the views accepting them are served by serveTransfer, see transfers.go
+	if q.Qclass != dns.ClassINET || !view.serves(name) || transfer(req) {
+		resp.SetRcode(req, dns.RcodeRefused)
+		return resp
+	}
+
+	if guard, ok := view.freshness(name); ok && guard.Mode == FreshnessServfail && node.leaderSilence() > time.Duration(guard.MaxStaleness)*time.Second {
+
+		resp.SetRcode(req, dns.RcodeServerFailure)
+
+		if opt := req.IsEdns0(); opt != nil {
+			resp.SetEdns0(opt.UDPSize(), false)
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeNoReachableAuthority, ExtraText: "the replica is cut off from the leader"})
+		}
+
+		node.Meta.metrics.Add("dns_stale_refusals_total", 1, "view", view.Name)
+		return resp
+	}
+
+	// The records of a sharded replica are read from the groups owning the names (see lookup.go), and
+	// the hot names answered from the answer cache (see answercache.go).
+	answer, err := node.cachedLookup(view, req, name, client)
+	if err != nil {
+		node.logger().Error().Err(err).Str("name", name).Msg("Unable to read the records of a DNS query")
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return resp
+	}
+
+	return answer
+}
@@ -0,0 +1,234 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks the validation of the DNS listeners of the config
+ * file, and the networks they listen on.
+ */
+func TestDNSConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"dns": {
+		"views": [{"name": "internal"}, {"name": "external", "zones": ["example.com."]}],
+		"listeners": [
+			{"address": ":53", "protocol": "udp", "family": "ipv4", "view": "internal"},
+			{"address": "[::]:853", "protocol": "tls", "family": "ipv6", "view": "external", "cert_file": "dot.pem", "key_file": "dot.key"}
+		]
+	}}`), 0644)
+
+	config := DefaultConfig()
+	if err := LoadConfigFile(path, config); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"udp4", "tcp6-tls"} {
+		if network, _ := config.DNS.Listeners[i].network(); network != expected {
+			t.Errorf("Expected listener %v to listen on %v, got %v", i, expected, network)
+		}
+	}
+
+	if network, _ := (DNSListener{Protocol: "tcp"}).network(); network != "tcp" {
+		t.Errorf("Expected a listener without a family to listen on tcp, got %v", network)
+	}
+
+	views := []DNSView{{Name: "internal"}}
+
+	invalid := []DNSListener{
+		{Address: ":53", Protocol: "quic", View: "internal"},
+		{Address: ":53", Protocol: "udp", Family: "ipv5", View: "internal"},
+		{Address: "localhost", Protocol: "udp", View: "internal"},
+		{Address: ":53", Protocol: "udp", View: "external"},
+		{Address: ":853", Protocol: "tls", View: "internal"},
+		{Address: ":53", Protocol: "udp", View: "internal", CertFile: "dot.pem", KeyFile: "dot.key"},
+	}
+
+	for _, l := range invalid {
+		if err := (&DNSConfig{Views: views, Listeners: []DNSListener{l}}).Validate(); err == nil {
+			t.Errorf("Expected listener %+v to be rejected", l)
+		}
+	}
+
+	if err := (&DNSConfig{Views: append(views, DNSView{Name: "internal"})}).Validate(); err == nil {
+		t.Errorf("Expected duplicate views to be rejected")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"dns": {"listners": []}}`), 0644)
+	if err := LoadConfigFile(path, DefaultConfig()); err == nil {
+		t.Errorf("Expected an unknown setting to be rejected")
+	}
+}
+
+/*
+ * This test case checks the answers to DNS queries from the records of the
+ * store, and that a view refuses the names outside of its zones.
+ */
+func TestAnswerDNS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	r := mux.NewRouter().SkipClean(true)
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler)
+	store := httptest.NewServer(r)
+	defer store.Close()
+
+	put := func(name, rtype string, records ...zone.Record) {
+		encoded, _ := json.Marshal(records)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put("www.example.com.", "A", zone.Record{Name: "www.example.com.", Type: "A", TTL: 300, Data: "192.0.2.1"}, zone.Record{Name: "www.example.com.", Type: "A", TTL: 300, Data: "192.0.2.2"})
+	put("alias.example.com.", "CNAME", zone.Record{Name: "alias.example.com.", Type: "CNAME", TTL: 60, Data: "www.example.com."})
+	put("db.internal.", "A", zone.Record{Name: "db.internal.", Type: "A", TTL: 60, Data: "10.0.0.1"})
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	internal, external := DNSView{Name: "internal"}, DNSView{Name: "external", Zones: []string{"example.com"}}
+
+	query := func(view DNSView, name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return node.answerDNS(view, req, nil)
+	}
+
+	if resp := query(external, "WWW.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 2 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Unexpected answer %v", resp)
+	}
+
+	if resp := query(external, "alias.example.com.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME {
+		t.Errorf("Expected the CNAME of the alias, got %v", resp)
+	}
+
+	if resp := query(external, "www.example.com.", dns.TypeAAAA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("Expected no data for a missing type, got %v", resp)
+	}
+
+	if resp := query(external, "missing.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN for a missing name, got %v", resp)
+	}
+
+	if resp := query(external, "db.internal.", dns.TypeA); resp.Rcode != dns.RcodeRefused || len(resp.Answer) != 0 {
+		t.Errorf("Expected the external view to refuse internal names, got %v", resp)
+	}
+
+	if resp := query(internal, "db.internal.", dns.TypeA); len(resp.Answer) != 1 {
+		t.Errorf("Expected the internal view to answer for every name, got %v", resp)
+	}
+}
+
+/*
+ * This test case checks that the zones of a view in servfail mode answer
+ * SERVFAIL once the replica hasn't heard from the leader (or the leader from
+ * a quorum) for their max staleness, while those in serve mode keep answering.
+ */
+func TestDNSFreshness(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	for _, name := range []string{"www.example.com.", "cdn.static.example.com."} {
+		encoded, _ := json.Marshal([]zone.Record{{Name: name, Type: "A", TTL: 60, Data: "192.0.2.1"}})
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, "A"), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	start := time.Unix(100, 0)
+	clock := NewManualClock(start)
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), clock: clock}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.state, node.Meta.leader_id, node.Meta.leaderContact = Follower, 1, start
+
+	view := DNSView{Name: "external", Freshness: []DNSFreshness{
+		{Zone: "example.com.", MaxStaleness: 10, Mode: FreshnessServfail},
+		{Zone: "static.example.com.", Mode: FreshnessServe},
+	}}
+
+	if err := (&DNSConfig{Views: []DNSView{view}}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&DNSConfig{Views: []DNSView{{Name: "v", Freshness: []DNSFreshness{{Zone: "example.com.", Mode: FreshnessServfail}}}}}).Validate(); err == nil {
+		t.Errorf("Expected a servfail guard without a max staleness to be invalid")
+	}
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		return node.answerDNS(view, req, nil)
+	}
+
+	clock.Advance(5 * time.Second)
+
+	if resp := query("www.example.com."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("Expected a fresh follower to answer, got %v", resp)
+	}
+
+	clock.Advance(10 * time.Second)
+
+	resp := query("www.example.com.")
+	if resp.Rcode != dns.RcodeServerFailure || len(resp.Answer) != 0 || resp.IsEdns0() == nil || len(resp.IsEdns0().Option) != 1 {
+		t.Errorf("Expected a stale follower to answer SERVFAIL with an extended error, got %v", resp)
+	}
+
+	if resp := query("cdn.static.example.com."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("Expected a zone in serve mode to keep answering, got %v", resp)
+	}
+
+	// A leader is fresh while it hears from a quorum.
+	node.state = Leader
+	node.last_contact = map[int32]time.Time{2: clock.Now().Add(-time.Second)}
+
+	if resp := query("www.example.com."); resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the leader of a quorum to answer, got %v", resp)
+	}
+
+	clock.Advance(time.Minute)
+
+	if resp := query("www.example.com."); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expected a leader cut off from its followers to answer SERVFAIL, got %v", resp)
+	}
+
+	if got := node.Meta.metrics.Get("dns_stale_refusals_total", "view", "external"); got != 2 {
+		t.Errorf("Expected 2 stale refusals to be counted, got %v", got)
+	}
+}
@@ -0,0 +1,775 @@
+package raft
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Dynamic updates (RFC 2136) of the records, e.g. by a home router keeping its own A record up to date
+with nsupdate. They are accepted by the listeners of the views with "updates": true (see dns.go),
+and must be signed with TSIG (RFC 8945) by one of the TSIG keys of the store, which signs on behalf
+of a user of the client HTTP API (see tsig.go). An update is only applied if the user may read the
+RRsets of its prerequisites and write those it changes, by its permission or by its roles, whose
+rules can scope a key down to single records, e.g. write:record:home.example.com/A (see acl.go).
+
+Updates are applied by the leader, the other replicas refusing them, as a transaction conditioned
+on the RRsets it read, so that concurrent updates of the same names are applied one after the
+other (an update is attempted again if its RRsets changed in the meantime). The serial of the SOA
+record at the apex of the zone, if there is one, is incremented by every update changing the zone.
+
+The retransmissions of an update, e.g. by a client retrying over UDP because the response was lost,
+are answered with the response code of the first attempt rather than applied again, which would
+bump the serial once more or add back records deleted in the meantime. An update is deemed
+retransmitted when signed by the same key with the same message ID, zone, prerequisites and changes
+as one received within DNSUpdateWindow; a retransmission of an update still being applied waits
+for its outcome. The updates that failed (SERVFAIL or REFUSED, e.g. on a follower) aren't
+remembered, so that their retries are attempted again. Retransmissions are counted in
+dns_update_retransmissions_total.
+*/
+
+const (
+	rawUpdateTimeout = 10 * time.Second // Time after which the raw message of an update nobody handled is discarded
+	updateAttempts   = 3                // Transactions attempted by an update whose RRsets keep changing
+)
+
+/*
+The raw UPDATE messages, and the signed zone transfer requests (see transfers.go), read by a DNS
+listener, until they are handled: dns.Server only hands the parsed messages to the handlers, while
+the TSIG signature covers the message as sent. Messages are identified by the address of the client
+and their ID.
+*/
+type rawUpdates struct {
+	mu       sync.Mutex
+	messages map[string]rawUpdate
+}
+
+type rawUpdate struct {
+	msg  []byte
+	read time.Time
+}
+
+func newRawUpdates() *rawUpdates {
+	return &rawUpdates{messages: make(map[string]rawUpdate)}
+}
+
+func rawUpdateKey(addr net.Addr, id uint16) string {
+	return addr.String() + "/" + strconv.Itoa(int(id))
+}
+
+// Keep a copy of the message read from the address if it is an UPDATE or a signed zone transfer request.
+func (u *rawUpdates) add(addr net.Addr, msg []byte) {
+
+	// The header is 12 bytes long, the QR bit and the opcode being in the third one.
+	if addr == nil || len(msg) < 12 || msg[2]&0x80 != 0 || (int(msg[2]>>3)&0xF != dns.OpcodeUpdate && !rawTransfer(msg)) {
+		return
+	}
+
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for key, m := range u.messages {
+		if now.Sub(m.read) > rawUpdateTimeout {
+			delete(u.messages, key)
+		}
+	}
+
+	u.messages[rawUpdateKey(addr, uint16(msg[0])<<8|uint16(msg[1]))] = rawUpdate{msg: append([]byte{}, msg...), read: now}
+}
+
+// Return, and forget, the raw message with the given ID read from the address.
+func (u *rawUpdates) take(addr net.Addr, id uint16) ([]byte, bool) {
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := rawUpdateKey(addr, id)
+
+	m, ok := u.messages[key]
+	delete(u.messages, key)
+
+	return m.msg, ok
+}
+
+// The reader of a dns.Server keeping the raw UPDATE and zone transfer messages it reads.
+type updateReader struct {
+	dns.Reader
+	updates *rawUpdates
+}
+
+func (r updateReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+
+	msg, err := r.Reader.ReadTCP(conn, timeout)
+	if err == nil {
+		r.updates.add(conn.RemoteAddr(), msg)
+	}
+
+	return msg, err
+}
+
+func (r updateReader) ReadUDP(conn *net.UDPConn, timeout time.Duration) ([]byte, *dns.SessionUDP, error) {
+
+	msg, session, err := r.Reader.ReadUDP(conn, timeout)
+	if err == nil {
+		r.updates.add(session.RemoteAddr(), msg)
+	}
+
+	return msg, session, err
+}
+
+func (r updateReader) ReadPacketConn(conn net.PacketConn, timeout time.Duration) ([]byte, net.Addr, error) {
+
+	msg, addr, err := r.Reader.(dns.PacketConnReader).ReadPacketConn(conn, timeout)
+	if err == nil {
+		r.updates.add(addr, msg)
+	}
+
+	return msg, addr, err
+}
+
+// The updates recently received by the replica, by updateKey. The zero value is empty.
+type updateHistory struct {
+	mu      sync.Mutex
+	updates map[string]*recentUpdate
+}
+
+type recentUpdate struct {
+	received time.Time
+	done     chan struct{} // Closed once the update has been handled
+	rcode    int           // Response code of the update, once done
+}
+
+// Return the key identifying the retransmissions of the update signed by the key with the given name.
+func updateKey(signer string, req *dns.Msg) string {
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v\n%v\n", strings.ToLower(signer), req.Id)
+
+	for _, q := range req.Question {
+		fmt.Fprintln(hash, q.String())
+	}
+
+	for _, rr := range append(append([]dns.RR{}, req.Answer...), req.Ns...) {
+		fmt.Fprintln(hash, rr.String())
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+/*
+Return the update received with the key within the window, and whether it is a retransmission. The
+first one is recorded, and must be finished with finish.
+*/
+func (h *updateHistory) begin(key string, now time.Time, window time.Duration) (*recentUpdate, bool) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.updates == nil {
+		h.updates = make(map[string]*recentUpdate)
+	}
+
+	for k, u := range h.updates {
+		if now.Sub(u.received) > window {
+			delete(h.updates, k)
+		}
+	}
+
+	if u, ok := h.updates[key]; ok {
+		return u, true
+	}
+
+	u := &recentUpdate{received: now, done: make(chan struct{})}
+	h.updates[key] = u
+
+	return u, false
+}
+
+// Record the response code of the update, forgetting it if it failed.
+func (h *updateHistory) finish(key string, u *recentUpdate, rcode int) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused {
+		delete(h.updates, key)
+	}
+
+	u.rcode = rcode
+	close(u.done)
+}
+
+// Apply the update, unless it is a retransmission of a recent one, returning the response code.
+func (node *RaftNode) applyDNSUpdate(ctx context.Context, view DNSView, req *dns.Msg, user User) int {
+
+	window := node.Meta.Config.DNSUpdateWindow
+	if window <= 0 {
+		return node.updateDNS(ctx, view, req, user)
+	}
+
+	key := updateKey(user.Name, req)
+
+	u, retransmitted := node.dns_updates.begin(key, node.now(), window)
+	if !retransmitted {
+		rcode := node.updateDNS(ctx, view, req, user)
+		node.dns_updates.finish(key, u, rcode)
+		return rcode
+	}
+
+	node.Meta.metrics.Add("dns_update_retransmissions_total", 1, "view", view.Name)
+	node.logger().Info().Str("user", user.Name).Uint16("id", req.Id).Msg("Retransmitted DNS update answered with the outcome of the first one")
+
+	select {
+	case <-u.done:
+		return u.rcode
+	case <-ctx.Done():
+		return dns.RcodeServerFailure
+	}
+}
+
+// Accept the UPDATE requests on top of the queries accepted by default.
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+
+	if dh.Bits&(1<<15) == 0 && int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+/*
+Handle an UPDATE request of the view: check its TSIG signature against the raw message, apply it on
+behalf of the user it is signed by, and send the response, signed with the same key. Requests that
+aren't signed are refused, and those with an unknown key or an invalid signature answered with
+NOTAUTH.
+*/
+func (node *RaftNode) serveDNSUpdate(view DNSView, updates *rawUpdates, w dns.ResponseWriter, req *dns.Msg) {
+
+	raw, _ := updates.take(w.RemoteAddr(), req.Id)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	reply := func(rcode int) {
+		resp.Rcode = rcode
+		node.Meta.metrics.Add("dns_updates_total", 1, "view", view.Name, "rcode", dns.RcodeToString[rcode])
+	}
+
+	tsig := req.IsTsig()
+	if tsig == nil || raw == nil {
+		reply(dns.RcodeRefused)
+		w.WriteMsg(resp)
+		return
+	}
+
+	// The keys of their own of the clients are defined in tsig.go
+	user, secret, ok := node.verifyTSIG(raw, tsig)
+
+	if !ok {
+		node.logger().Warn().Str("key", tsig.Hdr.Name).Str("client", w.RemoteAddr().String()).Msg("DNS update with an invalid TSIG signature")
+		reply(dns.RcodeNotAuth)
+		w.WriteMsg(resp)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	// The update is submitted to the external authorization service, if any, as signed by the user.
+	ctx = withOrigin(ctx, requestOrigin{Protocol: "dns", RemoteAddr: w.RemoteAddr().String(), User: &user})
+
+	reply(node.applyDNSUpdate(ctx, view, req, user))
+
+	resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+
+	signed, _, err := dns.TsigGenerate(resp, secret, tsig.MAC, false)
+	if err != nil {
+		node.logger().Error().Err(err).Msg("Unable to sign the response of a DNS update")
+		return
+	}
+
+	w.Write(signed)
+}
+
+// Apply an update of the view on behalf of the user, returning the response code.
+func (node *RaftNode) updateDNS(ctx context.Context, view DNSView, req *dns.Msg, user User) int {
+
+	if len(req.Question) != 1 || req.Question[0].Qtype != dns.TypeSOA {
+		return dns.RcodeFormatError
+	}
+
+	apex := zone.CanonicalName(req.Question[0].Name)
+	if req.Question[0].Qclass != dns.ClassINET || !view.serves(apex) {
+		return dns.RcodeRefused
+	}
+
+	// The RRsets of the zone apex and of the names of the update are read.
+	names := map[string]bool{apex: true}
+	for _, rr := range append(append([]dns.RR{}, req.Answer...), req.Ns...) {
+		names[zone.CanonicalName(rr.Header().Name)] = true
+	}
+
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+
+		node.GetRLock("DNS Update")
+		leader := node.state == Leader
+		node.ReleaseRLock("DNS Update")
+
+		if !leader {
+			return dns.RcodeRefused
+		}
+
+		current := make(map[string]string)
+
+		for name := range names {
+
+			if strings.ContainsAny(name, ":/") {
+				return dns.RcodeRefused
+			}
+
+			kvs, err := node.scanLocalStore(zone.KeyPrefix + name + ":")
+			if err != nil {
+				node.logger().Error().Err(err).Str("name", name).Msg("Unable to read the records of a DNS update")
+				return dns.RcodeServerFailure
+			}
+
+			for _, kv := range kvs {
+				if owner, _, ok := zone.ParseRecordKey(kv.Key); ok && owner == name && !zone.IsPolicyKey(kv.Key) {
+					current[kv.Key] = kv.Value
+				}
+			}
+		}
+
+		plan, rcode := planDNSUpdate(apex, req, current)
+		if rcode != dns.RcodeSuccess {
+			return rcode
+		}
+
+		for _, key := range plan.read {
+			if !node.Meta.roles.allows(user, key, PermissionRead) {
+				return dns.RcodeRefused
+			}
+		}
+
+		for _, key := range plan.write {
+			if !node.Meta.roles.allows(user, key, PermissionWrite) {
+				node.logger().Warn().Str("user", user.Name).Str("key", key).Msg("DNS update of a record the user can't write")
+				return dns.RcodeRefused
+			}
+		}
+
+		if len(plan.txn.Success) == 0 {
+			return dns.RcodeSuccess
+		}
+
+		// The user was authorized above: unlike the RRsets it changes, it may not have access to the SOA record.
+		result, err := node.replicateTxn(ctx, plan.txn, user.Name, 0, 0)
+
+		switch {
+
+		case status.Code(err) == codes.PermissionDenied || status.Code(err) == codes.FailedPrecondition:
+			return dns.RcodeRefused
+
+		case err != nil:
+			node.logger().Error().Err(err).Str("zone", apex).Msg("Unable to apply a DNS update")
+			return dns.RcodeServerFailure
+
+		case result.Succeeded:
+			node.logger().Info().Str("zone", apex).Str("user", user.Name).Strs("keys", plan.write).Msg("DNS update applied")
+			return dns.RcodeSuccess
+
+		}
+	}
+
+	return dns.RcodeServerFailure
+}
+
+// The transaction applying an update, and the keys the user must be allowed to access.
+type dnsUpdatePlan struct {
+	txn   kv_store.Txn
+	read  []string // Keys of the RRsets of the prerequisites
+	write []string // Keys of the RRsets changed, the SOA serial aside
+}
+
+// Return the record stored for the RR.
+func rrRecord(rr dns.RR) zone.Record {
+
+	h := rr.Header()
+
+	return zone.Record{
+		Name: zone.CanonicalName(h.Name),
+		Type: dns.TypeToString[h.Rrtype],
+		TTL:  h.Ttl,
+		Data: strings.TrimSpace(strings.TrimPrefix(rr.String(), h.String())),
+	}
+}
+
+// Return the RR of a stored record of the RRset with the given name and type.
+func recordRR(name, rtype string, r zone.Record) (dns.RR, error) {
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, r.TTL, rtype, r.Data))
+}
+
+// Whether both RRsets hold the same records, regardless of their order and TTL.
+func sameRRset(a, b []dns.RR) bool {
+
+	contains := func(rrs []dns.RR, rr dns.RR) bool {
+		for _, r := range rrs {
+			if dns.IsDuplicate(r, rr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, rr := range a {
+		if !contains(b, rr) {
+			return false
+		}
+	}
+
+	for _, rr := range b {
+		if !contains(a, rr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Whether the type is a meta type, which can't be added to a zone.
+func metaType(t uint16) bool {
+	return t == dns.TypeANY || t == dns.TypeAXFR || t == dns.TypeIXFR || t == dns.TypeMAILA || t == dns.TypeMAILB
+}
+
+/*
+Check the prerequisites of an update of the zone with the given apex against the current RRsets of
+its names (by key, as stored), and return the transaction applying its changes (RFC 2136, sections
+3.2 to 3.4), conditioned on the RRsets read. Changes to the SOA and NS records of the apex that
+would leave the zone without them are ignored, as well as the additions that would make a name both
+an alias and something else. The response code tells why an update can't be applied.
+*/
+func planDNSUpdate(apex string, req *dns.Msg, current map[string]string) (dnsUpdatePlan, int) {
+
+	var plan dnsUpdatePlan
+
+	rrsets := make(map[string][]dns.RR)
+
+	// The regions of the stored records (see geo.go), which the updates keep.
+	regions := make(map[string][]string)
+	identity := func(r zone.Record) string {
+		return r.Name + " " + r.Type + " " + r.Data
+	}
+
+	for key, value := range current {
+
+		name, rtype, ok := zone.ParseRecordKey(key)
+		if !ok {
+			continue
+		}
+
+		var records []zone.Record
+		if err := json.Unmarshal([]byte(value), &records); err != nil {
+			return plan, dns.RcodeServerFailure
+		}
+
+		for _, r := range records {
+
+			rr, err := recordRR(name, rtype, r)
+			if err != nil || rr == nil {
+				return plan, dns.RcodeServerFailure
+			}
+
+			rrsets[key] = append(rrsets[key], rr)
+
+			if len(r.Regions) > 0 {
+				regions[identity(rrRecord(rr))] = r.Regions
+			}
+		}
+	}
+
+	// Return the keys of the RRsets of the name.
+	nameKeys := func(rrsets map[string][]dns.RR, name string) []string {
+
+		keys := make([]string, 0)
+		for key, rrs := range rrsets {
+			if owner, _, _ := zone.ParseRecordKey(key); owner == name && len(rrs) > 0 {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Strings(keys)
+		return keys
+	}
+
+	key := func(rr dns.RR) (string, string) {
+		name := zone.CanonicalName(rr.Header().Name)
+		return name, zone.RecordKey(name, dns.TypeToString[rr.Header().Rrtype])
+	}
+
+	// Prerequisites.
+	expected := make(map[string][]dns.RR)
+
+	for _, rr := range req.Answer {
+
+		h := rr.Header()
+		name, k := key(rr)
+
+		if !zone.InZone(name, apex) {
+			return plan, dns.RcodeNotZone
+		}
+
+		if h.Ttl != 0 {
+			return plan, dns.RcodeFormatError
+		}
+
+		switch h.Class {
+
+		case dns.ClassANY, dns.ClassNONE:
+
+			if h.Rdlength != 0 {
+				return plan, dns.RcodeFormatError
+			}
+
+			if h.Rrtype == dns.TypeANY {
+
+				inUse := len(nameKeys(rrsets, name)) > 0
+				plan.read = append(plan.read, zone.RecordKey(name, "ANY"))
+
+				if h.Class == dns.ClassANY && !inUse {
+					return plan, dns.RcodeNameError
+				}
+				if h.Class == dns.ClassNONE && inUse {
+					return plan, dns.RcodeYXDomain
+				}
+
+				continue
+			}
+
+			exists := len(rrsets[k]) > 0
+			plan.read = append(plan.read, k)
+
+			if h.Class == dns.ClassANY && !exists {
+				return plan, dns.RcodeNXRrset
+			}
+			if h.Class == dns.ClassNONE && exists {
+				return plan, dns.RcodeYXRrset
+			}
+
+		case dns.ClassINET:
+			expected[k] = append(expected[k], rr)
+			plan.read = append(plan.read, k)
+
+		default:
+			return plan, dns.RcodeFormatError
+
+		}
+	}
+
+	for k, rrs := range expected {
+		if !sameRRset(rrs, rrsets[k]) {
+			return plan, dns.RcodeNXRrset
+		}
+	}
+
+	// Prescan of the updates, before any is applied.
+	for _, rr := range req.Ns {
+
+		h := rr.Header()
+
+		if name, _ := key(rr); !zone.InZone(name, apex) {
+			return plan, dns.RcodeNotZone
+		}
+
+		switch {
+		case h.Class == dns.ClassINET && !metaType(h.Rrtype):
+		case h.Class == dns.ClassANY && h.Ttl == 0 && h.Rdlength == 0 && (h.Rrtype == dns.TypeANY || !metaType(h.Rrtype)):
+		case h.Class == dns.ClassNONE && h.Ttl == 0 && !metaType(h.Rrtype):
+		default:
+			return plan, dns.RcodeFormatError
+		}
+	}
+
+	next := make(map[string][]dns.RR)
+	for k, rrs := range rrsets {
+		next[k] = rrs
+	}
+
+	for _, rr := range req.Ns {
+
+		h := rr.Header()
+		name, k := key(rr)
+		atApex := name == apex
+
+		switch h.Class {
+
+		case dns.ClassINET:
+
+			rr.Header().Name = name
+
+			alias, others := false, false
+			for _, nk := range nameKeys(next, name) {
+				if strings.HasSuffix(nk, ":CNAME") {
+					alias = true
+				} else {
+					others = true
+				}
+			}
+
+			if (h.Rrtype == dns.TypeCNAME && others) || (h.Rrtype != dns.TypeCNAME && alias) {
+				continue
+			}
+
+			if h.Rrtype == dns.TypeSOA {
+
+				if !atApex {
+					continue
+				}
+				if old := next[k]; len(old) > 0 && old[0].(*dns.SOA).Serial >= rr.(*dns.SOA).Serial {
+					continue
+				}
+
+				next[k] = []dns.RR{rr}
+				continue
+			}
+
+			rrs := make([]dns.RR, 0, len(next[k])+1)
+			added := false
+
+			for _, r := range next[k] {
+				if dns.IsDuplicate(r, rr) {
+					r, added = rr, true // a duplicate replaces the record, e.g. to change its TTL
+				}
+				rrs = append(rrs, r)
+			}
+
+			if !added {
+				rrs = append(rrs, rr)
+			}
+
+			next[k] = rrs
+
+		case dns.ClassANY:
+
+			if h.Rrtype != dns.TypeANY {
+
+				if !atApex || (h.Rrtype != dns.TypeSOA && h.Rrtype != dns.TypeNS) {
+					delete(next, k)
+				}
+				continue
+			}
+
+			for _, nk := range nameKeys(next, name) {
+				if _, rtype, _ := zone.ParseRecordKey(nk); !atApex || (rtype != "SOA" && rtype != "NS") {
+					delete(next, nk)
+				}
+			}
+
+		case dns.ClassNONE:
+
+			if atApex && h.Rrtype == dns.TypeSOA {
+				continue
+			}
+
+			deleted := dns.Copy(rr)
+			deleted.Header().Class = dns.ClassINET
+
+			rrs := make([]dns.RR, 0, len(next[k]))
+			for _, r := range next[k] {
+				if !dns.IsDuplicate(r, deleted) {
+					rrs = append(rrs, r)
+				}
+			}
+
+			if atApex && h.Rrtype == dns.TypeNS && len(rrs) == 0 {
+				continue
+			}
+
+			next[k] = rrs
+
+		}
+	}
+
+	encode := func(rrs []dns.RR) string {
+
+		records := make([]zone.Record, 0, len(rrs))
+		for _, rr := range rrs {
+			r := rrRecord(rr)
+			r.Regions = regions[identity(r)]
+			records = append(records, r)
+		}
+
+		encoded, _ := json.Marshal(records)
+		return string(encoded)
+	}
+
+	keys := make([]string, 0)
+	for k := range rrsets {
+		keys = append(keys, k)
+	}
+	for k := range next {
+		if _, ok := rrsets[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+
+		if value, ok := current[k]; ok {
+			plan.txn.Compare = append(plan.txn.Compare, kv_store.Compare{Key: k, Condition: kv_store.CompareValueEqual, Value: value})
+		}
+
+		if len(next[k]) == len(rrsets[k]) && (len(next[k]) == 0 || encode(next[k]) == encode(rrsets[k])) {
+			continue
+		}
+
+		plan.write = append(plan.write, k)
+
+		if len(next[k]) == 0 {
+			plan.txn.Success = append(plan.txn.Success, kv_store.Op{Type: kv_store.OpDelete, Key: k})
+			continue
+		}
+
+		if _, ok := current[k]; !ok {
+			plan.txn.Compare = append(plan.txn.Compare, kv_store.Compare{Key: k, Condition: kv_store.CompareNotExists})
+		}
+
+		plan.txn.Success = append(plan.txn.Success, kv_store.Op{Type: kv_store.OpPut, Key: k, Value: encode(next[k])})
+	}
+
+	// The serial of the zone is incremented, unless the update set the SOA record itself.
+	soaKey := zone.RecordKey(apex, "SOA")
+
+	if soa := next[soaKey]; len(plan.write) > 0 && len(soa) == 1 {
+
+		changed := false
+		for _, k := range plan.write {
+			changed = changed || k == soaKey
+		}
+
+		if !changed {
+			bumped := dns.Copy(soa[0]).(*dns.SOA)
+			bumped.Serial++
+			plan.txn.Success = append(plan.txn.Success, kv_store.Op{Type: kv_store.OpPut, Key: soaKey, Value: encode([]dns.RR{bumped})})
+		}
+	}
+
+	return plan, dns.RcodeSuccess
+}
@@ -0,0 +1,267 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the prerequisites of a dynamic update are
+ * checked against the current RRsets, that its changes are turned into a
+ * transaction conditioned on them that also increments the serial of the
+ * zone, and that a record rule only lets a token write its own RRset.
+ */
+func TestPlanDNSUpdate(t *testing.T) {
+
+	encode := func(records ...zone.Record) string {
+		encoded, _ := json.Marshal(records)
+		return string(encoded)
+	}
+
+	current := map[string]string{
+		zone.RecordKey("example.com.", "SOA"):      encode(zone.Record{Name: "example.com.", Type: "SOA", TTL: 3600, Data: "ns.example.com. admin.example.com. 7 3600 600 86400 60"}),
+		zone.RecordKey("home.example.com.", "A"):   encode(zone.Record{Name: "home.example.com.", Type: "A", TTL: 60, Data: "192.0.2.1"}),
+		zone.RecordKey("home.example.com.", "TXT"): encode(zone.Record{Name: "home.example.com.", Type: "TXT", TTL: 60, Data: "\"router\""}),
+	}
+
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+
+	// The router replaces its address, provided it still has one.
+	req := new(dns.Msg)
+	req.SetUpdate("example.com.")
+	req.RRsetUsed([]dns.RR{rr("home.example.com. 0 IN A 0.0.0.0")})
+	req.RemoveRRset([]dns.RR{rr("home.example.com. 0 IN A 0.0.0.0")})
+	req.Insert([]dns.RR{rr("home.example.com. 60 IN A 198.51.100.7")})
+
+	plan, rcode := planDNSUpdate("example.com.", req, current)
+	if rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the update to be applied, got %v", dns.RcodeToString[rcode])
+	}
+
+	key := zone.RecordKey("home.example.com.", "A")
+
+	if len(plan.write) != 1 || plan.write[0] != key || len(plan.read) != 1 || plan.read[0] != key {
+		t.Errorf("Expected the update to read and write the A RRset only, got %+v", plan)
+	}
+
+	values := make(map[string]string)
+	for _, op := range plan.txn.Success {
+		values[op.Key] = op.Value
+	}
+
+	if values[key] != encode(zone.Record{Name: "home.example.com.", Type: "A", TTL: 60, Data: "198.51.100.7"}) {
+		t.Errorf("Expected the new address, got %v", values[key])
+	}
+
+	var soa []zone.Record
+	json.Unmarshal([]byte(values[zone.RecordKey("example.com.", "SOA")]), &soa)
+	if len(soa) != 1 || soa[0].Data != "ns.example.com. admin.example.com. 8 3600 600 86400 60" {
+		t.Errorf("Expected the serial of the zone to be incremented, got %v", soa)
+	}
+
+	for _, c := range plan.txn.Compare {
+		if c.Condition != kv_store.CompareValueEqual || c.Value != current[c.Key] {
+			t.Errorf("Expected the transaction to be conditioned on the RRsets read, got %+v", c)
+		}
+	}
+
+	// A record rule covers the A records of the name only.
+	roles := NewRoles()
+	rule, _ := parseRule("write:record:home.example.com/A")
+	roles.apply("router", &Role{Name: "router", Rules: []Rule{rule}})
+	router := User{Name: "router", Roles: []string{"router"}}
+
+	if !roles.allows(router, key, PermissionWrite) || roles.allows(router, zone.RecordKey("home.example.com.", "TXT"), PermissionWrite) || roles.allows(router, zone.RecordKey("www.example.com.", "A"), PermissionRead) {
+		t.Errorf("Expected the record rule to only grant access to the A records of home.example.com")
+	}
+
+	// Prerequisites that don't hold, and names outside of the zone.
+	failing := []struct {
+		prepare func(m *dns.Msg)
+		rcode   int
+	}{
+		{func(m *dns.Msg) { m.NameUsed([]dns.RR{rr("missing.example.com. 0 IN A 0.0.0.0")}) }, dns.RcodeNameError},
+		{func(m *dns.Msg) { m.NameNotUsed([]dns.RR{rr("home.example.com. 0 IN A 0.0.0.0")}) }, dns.RcodeYXDomain},
+		{func(m *dns.Msg) { m.RRsetNotUsed([]dns.RR{rr("home.example.com. 0 IN A 0.0.0.0")}) }, dns.RcodeYXRrset},
+		{func(m *dns.Msg) { m.Used([]dns.RR{rr("home.example.com. 0 IN A 192.0.2.2")}) }, dns.RcodeNXRrset},
+		{func(m *dns.Msg) { m.Insert([]dns.RR{rr("www.example.org. 60 IN A 192.0.2.3")}) }, dns.RcodeNotZone},
+	}
+
+	for i, f := range failing {
+
+		m := new(dns.Msg)
+		m.SetUpdate("example.com.")
+		f.prepare(m)
+
+		if _, rcode := planDNSUpdate("example.com.", m, current); rcode != f.rcode {
+			t.Errorf("Expected update %v to fail with %v, got %v", i, dns.RcodeToString[f.rcode], dns.RcodeToString[rcode])
+		}
+	}
+
+	// Deleting the name keeps nothing, while the SOA record of the apex can't be deleted.
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+	m.RemoveName([]dns.RR{rr("home.example.com. 0 IN A 0.0.0.0"), rr("example.com. 0 IN A 0.0.0.0")})
+
+	if plan, _ := planDNSUpdate("example.com.", m, current); len(plan.write) != 2 || plan.txn.Success[0].Type != kv_store.OpDelete || plan.txn.Success[1].Type != kv_store.OpDelete {
+		t.Errorf("Expected both RRsets of the name to be deleted, and the SOA record kept, got %+v", plan)
+	}
+}
+
+/*
+ * This test case checks that the DNS listeners of a view accepting updates
+ * refuse the unsigned ones, reject those signed with an unknown key or the
+ * wrong secret, and sign their responses to the others.
+ */
+func TestDNSUpdateSignature(t *testing.T) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.LocalAddr().String()
+	listener.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), users: NewUsers(), roles: NewRoles(), tsig_keys: NewTSIGKeys(), Config: DefaultConfig()}}
+	node.Meta.Config.DNS = DNSConfig{
+		Views:     []DNSView{{Name: "updates", Zones: []string{"example.com."}, Updates: true}},
+		Listeners: []DNSListener{{Address: address, Protocol: "udp", View: "updates"}},
+	}
+
+	router := User{Name: "router", Roles: []string{"router"}, TokenHash: hashToken("router-token")}
+	node.Meta.users.apply(router.Name, &router)
+
+	secret := "c2VjcmV0IG9mIHRoZSByb3V0ZXI="
+	node.Meta.tsig_keys.apply("router", &TSIGKey{Name: "router", Algorithm: dns.HmacSHA256, Secret: secret, User: router.Name})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.StartDNSListeners(ctx)
+
+	update := func(key, secret string) (*dns.Msg, error) {
+
+		req := new(dns.Msg)
+		req.SetUpdate("example.com.")
+		rr, _ := dns.NewRR("home.example.com. 60 IN A 198.51.100.7")
+		req.Insert([]dns.RR{rr})
+
+		client := new(dns.Client)
+
+		if key != "" {
+			req.SetTsig(key, dns.HmacSHA256, 300, 0)
+			client.TsigSecret = map[string]string{key: secret}
+		}
+
+		resp, _, err := client.Exchange(req, address)
+		return resp, err
+	}
+
+	if resp, err := update("", ""); err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected an unsigned update to be refused, got %v (%v)", resp, err)
+	}
+
+	if resp, err := update("unknown.", secret); err != nil && resp == nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected an update signed with an unknown key to be rejected, got %v (%v)", resp, err)
+	}
+
+	if resp, err := update("router.", "b3RoZXIgc2VjcmV0"); err != nil && resp == nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected an update signed with the wrong secret to be rejected, got %v (%v)", resp, err)
+	}
+
+	// The client checks the signature of the response: the replica isn't the leader, so it refuses the update.
+	if resp, err := update("router.", secret); err != nil || resp.Rcode != dns.RcodeRefused || resp.IsTsig() == nil {
+		t.Errorf("Expected a signed refusal from a follower, got %v (%v)", resp, err)
+	}
+
+	if got := node.Meta.metrics.Get("dns_updates_total", "view", "updates", "rcode", "NOTAUTH"); got != 2 {
+		t.Errorf("Expected 2 rejected updates to be counted, got %v", got)
+	}
+}
+
+/*
+ * This test case checks that the retransmissions of an update received within
+ * the window are answered with the outcome of the first one, waiting for it
+ * if needed, that other updates aren't mistaken for retransmissions, and that
+ * the updates which failed are attempted again.
+ */
+func TestDNSUpdateRetransmissions(t *testing.T) {
+
+	update := func(id uint16, record string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetUpdate("example.com.")
+		req.Id = id
+		rr, _ := dns.NewRR(record)
+		req.Insert([]dns.RR{rr})
+		return req
+	}
+
+	first := update(7, "home.example.com. 60 IN A 198.51.100.7")
+	key := updateKey("router", first)
+
+	if updateKey("Router", update(7, "home.example.com. 60 IN A 198.51.100.7")) != key {
+		t.Errorf("Expected a retransmission to have the key of the first update")
+	}
+
+	for _, other := range []string{updateKey("laptop", first), updateKey("router", update(8, "home.example.com. 60 IN A 198.51.100.7")), updateKey("router", update(7, "home.example.com. 60 IN A 198.51.100.8"))} {
+		if other == key {
+			t.Errorf("Expected the updates of another signer, ID or content to have another key")
+		}
+	}
+
+	var history updateHistory
+	start := time.Unix(100, 0)
+
+	u, retransmitted := history.begin(key, start, 30*time.Second)
+	if retransmitted {
+		t.Fatalf("Expected the first update not to be a retransmission")
+	}
+
+	// A retransmission received while the update is applied waits for its outcome.
+	outcome := make(chan int)
+	go func() {
+		retry, retransmitted := history.begin(key, start.Add(time.Second), 30*time.Second)
+		if !retransmitted {
+			outcome <- -1
+			return
+		}
+		<-retry.done
+		outcome <- retry.rcode
+	}()
+
+	history.finish(key, u, dns.RcodeSuccess)
+
+	if rcode := <-outcome; rcode != dns.RcodeSuccess {
+		t.Errorf("Expected the retransmission to get the outcome of the first update, got %v", rcode)
+	}
+
+	if _, retransmitted := history.begin(key, start.Add(31*time.Second), 30*time.Second); retransmitted {
+		t.Errorf("Expected the update to be forgotten once the window passed")
+	}
+
+	// The failed updates are attempted again, e.g. on a follower.
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), Config: DefaultConfig(), clock: NewManualClock(start)}}
+	view := DNSView{Name: "updates", Zones: []string{"example.com."}, Updates: true}
+
+	for i := 0; i < 2; i++ {
+		if rcode := node.applyDNSUpdate(context.Background(), view, first, User{Name: "router"}); rcode != dns.RcodeRefused {
+			t.Errorf("Expected a follower to refuse the update, got %v", rcode)
+		}
+	}
+
+	if got := node.Meta.metrics.Get("dns_update_retransmissions_total", "view", "updates"); got != 0 {
+		t.Errorf("Expected the retries of a refused update not to be retransmissions, got %v", got)
+	}
+}
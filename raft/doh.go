@@ -0,0 +1,222 @@
+package raft
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+DNS over HTTPS (RFC 8484). A listener of the "https" protocol serves the DNS messages of its view at
+its path ("/dns-query" by default), with its own certificate reloaded when the files change, as the
+"tls" listeners serving DNS over TLS (RFC 7858) do:
+
+	{"address": ":443", "protocol": "https", "view": "external", "path": "/dns-query",
+	 "cert_file": "doh.pem", "key_file": "doh.key"}
+
+The queries are sent as the body of a POST of type application/dns-message, or base64url-encoded in
+the dns parameter of a GET, and answered by the same handler as those of the other listeners (see
+dnsHandler), as if received over TCP: the answers aren't truncated nor rate limited. Their
+Cache-Control max-age is the lowest TTL of their records. The updates of the views accepting them
+are served alike, while the zone transfers, made of several messages, are refused.
+
+The requests are counted in dns_https_requests_total{view, status}, by HTTP status.
+*/
+
+const dohPath = "/dns-query" // Path of the DNS messages of an https listener, by default
+
+// A dns.ResponseWriter keeping the answer of a query received over HTTPS.
+type dohWriter struct {
+	local, remote net.Addr
+	msg           []byte
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+
+	w.msg = packed
+	return nil
+}
+
+func (w *dohWriter) Write(msg []byte) (int, error) {
+	w.msg = append([]byte(nil), msg...)
+	return len(msg), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// Return the HTTP handler of the DNS messages of an https listener, answered by the handler of the
+// view.
+func (node *RaftNode) dohHandler(view DNSView, local net.Addr, updates *rawUpdates, handler dns.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		status := func(code int) {
+			node.Meta.metrics.Add("dns_https_requests_total", 1, "view", view.Name, "status", strconv.Itoa(code))
+		}
+
+		fail := func(code int, reason string) {
+			status(code)
+			http.Error(w, reason, code)
+		}
+
+		var msg []byte
+
+		switch r.Method {
+
+		case "GET":
+			encoded := r.URL.Query().Get("dns")
+			if encoded == "" {
+				fail(http.StatusBadRequest, "Error: Expected a dns parameter")
+				return
+			}
+
+			// The padding is left out (RFC 8484 section 4.1), but tolerated.
+			var err error
+			if msg, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "=")); err != nil {
+				fail(http.StatusBadRequest, "Error: Invalid dns parameter")
+				return
+			}
+
+		case "POST":
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				fail(http.StatusUnsupportedMediaType, "Error: Expected a body of type application/dns-message")
+				return
+			}
+
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+			if err != nil {
+				fail(http.StatusRequestEntityTooLarge, "Error: DNS message too large")
+				return
+			}
+
+			msg = body
+
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			fail(http.StatusMethodNotAllowed, "Error: Expected a GET or POST")
+			return
+		}
+
+		req := new(dns.Msg)
+		if err := req.Unpack(msg); err != nil || req.Response {
+			fail(http.StatusBadRequest, "Error: Invalid DNS message")
+			return
+		}
+
+		remote := &net.TCPAddr{}
+		if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			remote.IP = net.ParseIP(host)
+			remote.Port, _ = strconv.Atoi(port)
+		}
+
+		dw := &dohWriter{local: local, remote: remote}
+
+		if transfer(req) {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, dns.RcodeRefused)
+			dw.WriteMsg(resp)
+		} else {
+			updates.add(remote, msg) // Kept only if an update, whose signature is checked against it
+			handler.ServeDNS(dw, req)
+		}
+
+		if dw.msg == nil {
+			fail(http.StatusInternalServerError, "Error: No answer to the DNS message")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(dohMaxAge(dw.msg))))
+
+		status(http.StatusOK)
+		w.Write(dw.msg)
+	})
+}
+
+// Return the number of seconds an answer may be cached for, the lowest TTL of its records.
+func dohMaxAge(msg []byte) uint32 {
+
+	resp := new(dns.Msg)
+	if resp.Unpack(msg) != nil {
+		return 0
+	}
+
+	found, lowest := false, uint32(0)
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+
+			if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Rrtype == dns.TypeTSIG {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < lowest {
+				found, lowest = true, rr.Header().Ttl
+			}
+		}
+	}
+
+	return lowest
+}
+
+// Start an https listener of the view, shut down once ctx is done.
+func (node *RaftNode) startDoHListener(ctx context.Context, l DNSListener, network string, view DNSView, updates *rawUpdates, handler dns.Handler) {
+
+	certs, err := newCertReloader(l.CertFile, l.KeyFile, "")
+	CheckErrorFatal(err)
+
+	listener, err := net.Listen(network, l.Address)
+	CheckErrorFatal(err)
+
+	path := l.Path
+	if path == "" {
+		path = dohPath
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, node.dohHandler(view, listener.Addr(), updates, handler))
+
+	server := &http.Server{
+		Handler:           mux,
+		TLSConfig:         certs.certificateConfig(),
+		ReadHeaderTimeout: dnsTimeout,
+		ReadTimeout:       dnsTimeout,
+		WriteTimeout:      dnsTimeout,
+	}
+
+	go func() {
+		if err := server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+			CheckErrorFatal(err)
+		}
+	}()
+
+	go func() {
+
+		<-ctx.Done()
+
+		shutdown, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+
+		if err := server.Shutdown(shutdown); err != nil {
+			server.Close()
+		}
+	}()
+}
@@ -0,0 +1,168 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the https listeners answer the DNS messages
+ * posted or sent in the dns parameter of a GET with the answers of the tls
+ * listeners of the view, cacheable for the lowest TTL of their records, and
+ * that the invalid requests and the zone transfers are refused.
+ */
+func TestDNSOverHTTPS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "doh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestCert(t, dir, "dns", 1, nil, nil)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	r := mux.NewRouter().SkipClean(true)
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler)
+	store := httptest.NewServer(r)
+	defer store.Close()
+
+	encoded, _ := json.Marshal([]zone.Record{{Name: "www.example.com.", Type: "A", TTL: 60, Data: "192.0.2.1"}})
+	txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey("www.example.com.", "A"), Value: string(encoded)}}})
+	kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+
+	// Reserve the addresses of the listeners.
+	var addresses []string
+	for i := 0; i < 2; i++ {
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		addresses = append(addresses, listener.Addr().String())
+		listener.Close()
+	}
+
+	cert, key := filepath.Join(dir, "dns.pem"), filepath.Join(dir, "dns-key.pem")
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.Config.DNS = DNSConfig{
+		Views: []DNSView{{Name: "external", Zones: []string{"example.com."}}},
+		Listeners: []DNSListener{
+			{Address: addresses[0], Protocol: "https", View: "external", CertFile: cert, KeyFile: key},
+			{Address: addresses[1], Protocol: "tls", View: "external", CertFile: cert, KeyFile: key},
+		},
+	}
+
+	if err := node.Meta.Config.DNS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.StartDNSListeners(ctx)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	url := "https://" + addresses[0] + dohPath
+
+	query := func(name string, qtype uint16) []byte {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Id = 0 // As recommended for caching (RFC 8484 section 4.1)
+		packed, _ := req.Pack()
+		return packed
+	}
+
+	// Return the answer of the response, nil if it isn't a DNS message.
+	answer := func(resp *http.Response, err error) (*dns.Msg, *http.Response) {
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		msg := new(dns.Msg)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/dns-message" || msg.Unpack(body) != nil {
+			return nil, resp
+		}
+
+		return msg, resp
+	}
+
+	msg, resp := answer(client.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(query("www.example.com.", dns.TypeA))))
+	if msg == nil || len(msg.Answer) != 1 || resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Expected the GET to be answered with the record, cacheable for its TTL, got %v (%v)", msg, resp.Status)
+	}
+
+	msg, _ = answer(client.Post(url, "application/dns-message", bytes.NewReader(query("www.example.org.", dns.TypeA))))
+	if msg == nil || msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected the POST of a name outside the view to be refused, got %v", msg)
+	}
+
+	msg, _ = answer(client.Post(url, "application/dns-message", bytes.NewReader(query("example.com.", dns.TypeAXFR))))
+	if msg == nil || msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected the zone transfers to be refused, got %v", msg)
+	}
+
+	// The DNS over TLS listener shares the answers of the view.
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	dot := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	if msg, _, err := dot.Exchange(req, addresses[1]); err != nil || len(msg.Answer) != 1 {
+		t.Errorf("Expected the query over TLS to be answered with the record, got %v (%v)", msg, err)
+	}
+
+	for _, c := range []struct {
+		method, path, contentType, body string
+		status                          int
+	}{
+		{"GET", dohPath, "", "", http.StatusBadRequest},
+		{"GET", dohPath + "?dns=not*base64", "", "", http.StatusBadRequest},
+		{"POST", dohPath, "application/json", "{}", http.StatusUnsupportedMediaType},
+		{"POST", dohPath, "application/dns-message", "garbage", http.StatusBadRequest},
+		{"PUT", dohPath, "application/dns-message", "", http.StatusMethodNotAllowed},
+		{"GET", "/elsewhere", "", "", http.StatusNotFound},
+	} {
+
+		r, _ := http.NewRequest(c.method, "https://"+addresses[0]+c.path, strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+
+		if _, resp := answer(client.Do(r)); resp.StatusCode != c.status {
+			t.Errorf("Expected %v %v to be answered %v, got %v", c.method, c.path, c.status, resp.Status)
+		}
+	}
+
+	if got := node.Meta.metrics.Get("dns_https_requests_total", "view", "external", "status", "200"); got != 3 {
+		t.Errorf("Expected 3 DNS messages to be answered over HTTPS, got %v", got)
+	}
+
+	invalid := DNSConfig{Views: []DNSView{{Name: "external"}}, Listeners: []DNSListener{{Address: ":53", Protocol: "udp", View: "external", Path: "/dns-query"}}}
+	if err := invalid.Validate(); err == nil {
+		t.Errorf("Expected the path of a udp listener to be refused")
+	}
+}
@@ -0,0 +1,190 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+/*
+EDNS (RFC 6891) of the DNS listeners. The queries with an OPT record are answered with one, copying
+their DO bit and advertising the UDP payload size of the replica, the "udp_size" of the "edns"
+section of the DNS config (ednsUDPSize by default, which suits the MTU of most paths without
+fragmenting), which is also the size of the UDP queries the listeners read:
+
+	{"dns": {"edns": {"udp_size": 1232, "client_subnet": "use"}, ...}}
+
+The answers sent over UDP are truncated to the smaller of the payload sizes of the client and of the
+replica (512 bytes for the clients without EDNS), with the TC bit set so that the client retries
+over TCP. The queries of an EDNS version other than 0 are answered BADVERS, and those with several
+OPT records FORMERR.
+
+In the "use" mode (the default), the client subnet forwarded by a resolver (RFC 7871) locates it in
+place of its own address (see geo.go) and is echoed in the answers. In the "ignore" mode the option
+is left out of both. A client subnet with a scope, or with address bits set past its source prefix,
+is answered FORMERR (RFC 7871 section 7.1.1).
+
+The queries answered with an EDNS error are counted in dns_edns_errors_total{view, rcode}, and the
+answers truncated in dns_truncated_total{view}.
+*/
+
+const ednsUDPSize = 1232 // UDP payload size advertised by default, in bytes
+
+// Client subnet modes.
+const (
+	ClientSubnetUse    = "use"    // Locate the resolvers by the client subnet they forward
+	ClientSubnetIgnore = "ignore" // Locate the resolvers by their own address
+)
+
+// The EDNS settings of the DNS listeners.
+type DNSEDNS struct {
+	UDPSize      int    `json:"udp_size"`      // UDP payload size advertised, ednsUDPSize if 0
+	ClientSubnet string `json:"client_subnet"` // ClientSubnetUse (the default) or ClientSubnetIgnore
+}
+
+func (e DNSEDNS) validate() error {
+
+	if e.UDPSize != 0 && (e.UDPSize < dns.MinMsgSize || e.UDPSize > dns.MaxMsgSize) {
+		return fmt.Errorf("dns: edns: expected a udp_size between %v and %v, got %v", dns.MinMsgSize, dns.MaxMsgSize, e.UDPSize)
+	}
+
+	if e.ClientSubnet != "" && e.ClientSubnet != ClientSubnetUse && e.ClientSubnet != ClientSubnetIgnore {
+		return fmt.Errorf("dns: edns: expected the use or ignore client_subnet mode, got %q", e.ClientSubnet)
+	}
+
+	return nil
+}
+
+// Return the UDP payload size advertised.
+func (e DNSEDNS) udpSize() int {
+
+	if e.UDPSize == 0 {
+		return ednsUDPSize
+	}
+
+	return e.UDPSize
+}
+
+// Return the client subnet forwarded with the query, nil if none or if it is ignored.
+func (e DNSEDNS) subnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+
+	opt := req.IsEdns0()
+	if opt == nil || e.ClientSubnet == ClientSubnetIgnore {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// Return the answer of a query with an invalid OPT record, nil if its OPT record is valid or if it
+// has none.
+func (node *RaftNode) ednsError(view DNSView, req *dns.Msg) *dns.Msg {
+
+	opts := 0
+	for _, rr := range req.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			opts++
+		}
+	}
+
+	if opts == 0 {
+		return nil
+	}
+
+	rcode := dns.RcodeSuccess
+
+	switch subnet := node.Meta.Config.DNS.EDNS.subnet(req); {
+
+	case opts > 1:
+		rcode = dns.RcodeFormatError
+
+	case req.IsEdns0().Version() != 0:
+		rcode = dns.RcodeBadVers
+
+	case subnet != nil && !validSubnet(subnet):
+		rcode = dns.RcodeFormatError
+
+	default:
+		return nil
+	}
+
+	name := "FORMERR"
+	if rcode == dns.RcodeBadVers {
+		name = "BADVERS"
+	}
+
+	node.Meta.metrics.Add("dns_edns_errors_total", 1, "view", view.Name, "rcode", name)
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+
+	return resp
+}
+
+// Whether the client subnet of a query has no scope, and no address bits set past its source prefix.
+func validSubnet(subnet *dns.EDNS0_SUBNET) bool {
+
+	if subnet.SourceScope != 0 {
+		return false
+	}
+
+	if subnet.Family == 0 || subnet.Address == nil {
+		return subnet.SourceNetmask == 0
+	}
+
+	ip, bits := subnet.Address.To4(), 32
+	if subnet.Family == 2 {
+		ip, bits = subnet.Address.To16(), 128
+	}
+
+	return ip != nil && ip.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits)).Equal(ip)
+}
+
+/*
+Set the OPT record of the response to the query, advertising the UDP payload size of the replica and
+keeping the options of the answer (e.g. the client subnet or the extended errors), or leave it out if
+the query has none. Return the size the response must fit in over UDP.
+*/
+func (e DNSEDNS) respond(resp, req *dns.Msg) int {
+
+	var options []dns.EDNS0
+	extra := make([]dns.RR, 0, len(resp.Extra))
+
+	for _, rr := range resp.Extra {
+
+		if opt, ok := rr.(*dns.OPT); ok {
+			options = append(options, opt.Option...)
+			continue
+		}
+
+		extra = append(extra, rr)
+	}
+
+	resp.Extra = extra
+
+	opt := req.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	resp.SetEdns0(uint16(e.udpSize()), opt.Do())
+	resp.IsEdns0().Option = options
+
+	size := int(opt.UDPSize())
+	if size > e.udpSize() {
+		size = e.udpSize()
+	}
+
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+
+	return size
+}
@@ -0,0 +1,181 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the answers advertise the UDP payload size of
+ * the replica, are truncated to the smaller of the payload sizes over UDP but
+ * not over TCP, that the queries of another EDNS version or with an invalid
+ * client subnet are answered with an error, and that the client subnets can
+ * be ignored.
+ */
+func TestEDNS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "edns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	r := mux.NewRouter().SkipClean(true)
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler)
+	store := httptest.NewServer(r)
+	defer store.Close()
+
+	put := func(name, rtype string, records ...zone.Record) {
+		encoded, _ := json.Marshal(records)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	// About 1600 bytes of answer, past the default payload size of the replica.
+	var many []zone.Record
+	for i := 0; i < 100; i++ {
+		many = append(many, zone.Record{Name: "many.example.com.", Type: "A", TTL: 60, Data: fmt.Sprintf("10.0.0.%v", i)})
+	}
+	put("many.example.com.", "A", many...)
+	put("www.example.com.", "A",
+		zone.Record{Name: "www.example.com.", Type: "A", TTL: 60, Data: "10.1.0.1", Regions: []string{"eu-west"}},
+		zone.Record{Name: "www.example.com.", Type: "A", TTL: 60, Data: "10.2.0.1"})
+
+	table, err := loadGeoTable(DNSGeo{Regions: []DNSRegion{{Name: "eu-west", Networks: []string{"192.0.2.0/24"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.geo = table
+
+	handler := node.dnsHandler(DNSView{Name: "external"}, newRawUpdates())
+
+	udp := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}
+	tcp := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}
+
+	// Return the answer of the query, with an OPT record of the payload size if it isn't 0.
+	query := func(addr net.Addr, name string, size uint16, edit func(opt *dns.OPT)) *dns.Msg {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		if size > 0 {
+			req.SetEdns0(size, true)
+			if edit != nil {
+				edit(req.IsEdns0())
+			}
+		}
+
+		w := &resolverDNS{addr: addr}
+		handler.ServeDNS(w, req)
+
+		if _, err := w.msg.Pack(); err != nil {
+			t.Fatalf("Unable to pack the answer %v: %v", w.msg, err)
+		}
+
+		return w.msg
+	}
+
+	if resp := query(udp, "www.example.com.", 0, nil); resp.IsEdns0() != nil || resp.Truncated {
+		t.Errorf("Expected the answer of a query without EDNS to have no OPT record, got %v", resp)
+	}
+
+	resp := query(udp, "www.example.com.", 4096, nil)
+	if opt := resp.IsEdns0(); opt == nil || opt.UDPSize() != ednsUDPSize || !opt.Do() || opt.Version() != 0 {
+		t.Errorf("Expected the answer to advertise the payload size of the replica and copy the DO bit, got %v", resp)
+	}
+
+	for _, c := range []struct {
+		addr      net.Addr
+		size      uint16
+		truncated bool
+	}{
+		{udp, 0, true},
+		{udp, 512, true},
+		{udp, 4096, true}, // Past the payload size of the replica
+		{tcp, 0, false},
+		{tcp, 4096, false},
+	} {
+		if resp := query(c.addr, "many.example.com.", c.size, nil); resp.Truncated != c.truncated || (!c.truncated && len(resp.Answer) != 100) {
+			t.Errorf("Expected the answer over %v with a payload size of %v to be truncated: %v, got %v records (truncated: %v)", c.addr.Network(), c.size, c.truncated, len(resp.Answer), resp.Truncated)
+		}
+	}
+
+	node.Meta.Config.DNS.EDNS.UDPSize = 4096
+	if resp := query(udp, "many.example.com.", 4096, nil); resp.Truncated || len(resp.Answer) != 100 {
+		t.Errorf("Expected the answer to fit in the larger payload size of the replica, got %v records", len(resp.Answer))
+	}
+
+	if got := node.Meta.metrics.Get("dns_truncated_total", "view", "external"); got != 3 {
+		t.Errorf("Expected 3 answers to be truncated, got %v", got)
+	}
+
+	// The queries of another EDNS version, with several OPT records or with an invalid client subnet.
+	if resp := query(udp, "www.example.com.", 1232, func(opt *dns.OPT) { opt.SetVersion(1) }); resp.Rcode != dns.RcodeBadVers || resp.IsEdns0() == nil || len(resp.Answer) != 0 {
+		t.Errorf("Expected a query of EDNS version 1 to be answered BADVERS, got %v", resp)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	req.Extra = append(req.Extra, dns.Copy(req.Extra[0]))
+
+	w := &resolverDNS{addr: udp}
+	handler.ServeDNS(w, req)
+	if w.msg.Rcode != dns.RcodeFormatError {
+		t.Errorf("Expected a query with 2 OPT records to be answered FORMERR, got %v", w.msg)
+	}
+
+	for _, subnet := range []*dns.EDNS0_SUBNET{
+		{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("192.0.2.0").To4()},
+		{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.7").To4()},
+	} {
+		if resp := query(udp, "www.example.com.", 1232, func(opt *dns.OPT) { opt.Option = append(opt.Option, subnet) }); resp.Rcode != dns.RcodeFormatError {
+			t.Errorf("Expected the client subnet %v to be answered FORMERR, got %v", subnet, resp)
+		}
+	}
+
+	// A valid client subnet locates the resolver, unless ignored.
+	subnet := func(opt *dns.OPT) {
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+	}
+
+	resp = query(udp, "www.example.com.", 1232, subnet)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.1.0.1" || len(resp.IsEdns0().Option) != 1 {
+		t.Errorf("Expected the answer of the region of the client subnet, echoing it, got %v", resp)
+	}
+
+	node.Meta.Config.DNS.EDNS.ClientSubnet = ClientSubnetIgnore
+
+	resp = query(udp, "www.example.com.", 1232, subnet)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.2.0.1" || len(resp.IsEdns0().Option) != 0 {
+		t.Errorf("Expected the client subnet to be ignored, got %v", resp)
+	}
+
+	if got := node.Meta.metrics.Get("dns_edns_errors_total", "view", "external", "rcode", "FORMERR"); got != 3 {
+		t.Errorf("Expected 3 queries to be answered FORMERR, got %v", got)
+	}
+
+	for _, edns := range []DNSEDNS{{UDPSize: 100}, {ClientSubnet: "guess"}} {
+		if err := (&DNSConfig{EDNS: edns}).Validate(); err == nil {
+			t.Errorf("Expected the EDNS settings %+v to be invalid", edns)
+		}
+	}
+}
@@ -2,10 +2,7 @@ package raft
 
 import (
 	"context"
-	"log"
-	"math/rand"
 	"sync/atomic"
-	"time"
 
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
 )
@@ -14,66 +11,108 @@ import (
 // if a heartbeat/appendentries RPC is not received within the timeout duration.
 func (node *RaftNode) RunElectionTimer(parent_ctx context.Context) {
 
-	// 150 - 300 ms random timeout was mentioned in the paper
-	duration := time.Duration(500+rand.Intn(300)) * time.Millisecond
+	defer node.diagnoseCrash() // see diagnostics.go
+
+	// A random timeout, as described in the paper (which suggests 150 - 300 ms), see Config. It is
+	// widened during election storms, see storms.go
+	duration := node.widenedElectionTimeout()
 
 	select {
 
-	case <-time.After(duration): // for timeout to call election
+	case <-node.after(duration): // for timeout to call election
+		node.electionTimeout(parent_ctx)
 
-		node.GetLock("RunElectionTimer1")
+	case <-node.timeoutNowEvent: // leadership is being transferred to this replica, see TimeoutNow in rpcs.go
+		node.electionTimeout(parent_ctx)
 
-		// by the time the lock was acquired, if either
-		// 1. context cancel has occured
-		// 2. the electionResetEvent channel has been written to
-		// 3. the stopElectionTimer channel has been written to
-		// don't transition to candidate.
+	case <-node.stopElectiontimer: //to stop timer
+		return
 
-		select {
+	case <-node.electionResetEvent: //to reset timer when heartbeat/msg received
+		go node.RunElectionTimer(parent_ctx)
+		return
 
-		// prioritize checking if context is cancelled.
-		case <-parent_ctx.Done():
-			return
+	}
+}
 
-		default:
+// Reset the election timer. The reset isn't waited for, as the timer may have run out already, and be
+// waiting for the lock held by the caller: it is kept until the timer (or the next one) takes it.
+func (node *RaftNode) resetElectionTimer() {
 
-			select {
+	select {
+	case node.electionResetEvent <- true:
+	default: // a reset is already pending
+	}
+}
 
-			case <-node.stopElectiontimer: // to stop timer
-				node.ReleaseLock("RunElectionTimer1")
-				return
+// electionTimeout is called by the election timer once it has run out, or has been told to start an election.
+func (node *RaftNode) electionTimeout(parent_ctx context.Context) {
 
-			case <-node.electionResetEvent: // to reset timer when heartbeat/msg received
+	node.GetLock("RunElectionTimer1")
 
-				node.ReleaseLock("RunElectionTimer2")
-				go node.RunElectionTimer(parent_ctx)
-				return
+	// by the time the lock was acquired, if either
+	// 1. context cancel has occured
+	// 2. the electionResetEvent channel has been written to
+	// 3. the stopElectionTimer channel has been written to
+	// don't transition to candidate.
 
-			default:
-				// break
+	select {
 
-			}
+	// prioritize checking if context is cancelled.
+	case <-parent_ctx.Done():
+		node.ReleaseLock("RunElectionTimer0")
+		return
 
-		}
+	default:
 
-		log.Printf("\nElection timer runs out.\n")
+		select {
 
-		// if node was a follower, transition to candidate and start election
-		// if node was already candidate, restart election
+		case <-node.stopElectiontimer: // to stop timer
+			node.ReleaseLock("RunElectionTimer1")
+			return
 
-		node.ToCandidate(parent_ctx)
+		case <-node.electionResetEvent: // to reset timer when heartbeat/msg received
 
-		node.ReleaseLock("RunElectionTimer3")
-		return
+			node.ReleaseLock("RunElectionTimer2")
+			go node.RunElectionTimer(parent_ctx)
+			return
 
-	case <-node.stopElectiontimer: //to stop timer
+		default:
+			// break
+
+		}
+
+	}
+
+	// The timer may run out while the replica becomes the leader, which stops it, see ToLeader.
+	if node.state == Leader {
+		node.ReleaseLock("RunElectionTimer6")
 		return
+	}
 
-	case <-node.electionResetEvent: //to reset timer when heartbeat/msg received
+	node.logger().Debug().Int32("term", node.currentTerm).Str("state", node.state.String()).Msg("Election timer runs out")
+
+	// Replicas outside of the configuration (e.g. waiting to be added) must not disrupt the cluster.
+	if _, ok := node.member(node.Meta.replica_id); !ok {
+		node.logger().Info().Msg("Not a member of the cluster, not starting an election")
+		node.ReleaseLock("RunElectionTimer4")
 		go node.RunElectionTimer(parent_ctx)
 		return
+	}
 
+	// Witnesses never lead (see witness.go), nor do learners (see decommission.go)
+	if node.isWitness() || !node.voter(node.Meta.replica_id) {
+		node.ReleaseLock("RunElectionTimer5")
+		go node.RunElectionTimer(parent_ctx)
+		return
 	}
+
+	// if node was a follower, transition to candidate and start election
+	// if node was already candidate, restart election
+
+	node.ToCandidate(parent_ctx)
+
+	node.ReleaseLock("RunElectionTimer3")
 }
 
 // StartElection is called when a node transitions to a candidate
@@ -94,18 +133,13 @@ func (node *RaftNode) StartElection(ctx context.Context) {
 			continue
 		}
 
-		go func(ctx context.Context, node *RaftNode, client_obj protos.ConsensusServiceClient, replica_id int32) {
+		go func(ctx context.Context, node *RaftNode, client_obj Transport, replica_id int32) {
 
 			node.GetRLock("StartElection")
 			// log.Printf("\nRLock in StartElection\n")
 
-			latestLogIndex := int32(-1)
-			latestLogTerm := int32(-1)
-
-			if logLen := int32(len(node.log)); logLen > 0 {
-				latestLogIndex = logLen - 1
-				latestLogTerm = node.log[latestLogIndex].Term
-			}
+			latestLogIndex := node.lastLogIndex()
+			latestLogTerm, _ := node.termAt(latestLogIndex)
 
 			args := protos.RequestVoteMessage{
 				Term:         node.currentTerm,
@@ -117,7 +151,15 @@ func (node *RaftNode) StartElection(ctx context.Context) {
 			node.ReleaseRLock("StartElection")
 
 			//request vote and get reply
-			response, err := client_obj.RequestVote(ctx, &args)
+			sent := node.now()
+			rpc_ctx, cancel := context.WithTimeout(ctx, node.Meta.Config.RPCTimeout)
+			response, err := client_obj.SendRequestVote(rpc_ctx, &args)
+			cancel()
+
+			node.recordPeerRPC(replica_id, "RequestVote", err)
+			if err == nil {
+				node.recordPeerRTT(replica_id, node.now().Sub(sent))
+			}
 
 			node.GetLock("StartElection")
 
@@ -138,14 +180,15 @@ func (node *RaftNode) StartElection(ctx context.Context) {
 
 				} else if response.Term == node.currentTerm {
 
-					if response.VoteGranted {
+					// The votes of the learners don't count, see membership.go
+					if response.VoteGranted && node.voter(replica_id) {
 
-						log.Printf("\nReplica %v received vote from %v\n", node.Meta.replica_id, replica_id)
+						node.logger().Debug().Int32("term", node.currentTerm).Int32("voter", replica_id).Msg("Received vote")
 						votes := int(atomic.AddInt32(&received_votes, 1))
 
 						if votes*2 > int(node.Meta.n_replicas) { // won the Election
 
-							log.Printf("\nReplica %v transitioning to leader\n", node.Meta.replica_id)
+							node.logger().Info().Int32("term", node.currentTerm).Int("votes", votes).Msg("Won the election, transitioning to leader")
 							node.ToLeader(ctx)
 							return
 						}
@@ -159,7 +202,7 @@ func (node *RaftNode) StartElection(ctx context.Context) {
 				}
 
 			} else {
-				log.Printf("\nError in requestvote: %v\n", err)
+				node.logger().Debug().Err(err).Int32("peer_id", replica_id).Msg("Error in RequestVote")
 			}
 
 			node.ReleaseLock("StartElection3")
@@ -0,0 +1,168 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Errors of the client HTTP API. Every endpoint answers a failed request with its HTTP status and an
+ErrorResponse, e.g.
+
+	{"code":"not_leader","message":"Not a leader. Last known leader's address: :4001","leader":":4001","retryable":true}
+
+The code is derived from the status:
+
+	invalid_argument    400, the request is malformed (e.g. an invalid key or DNS name, see validation.go)
+	unauthenticated     401
+	permission_denied   403
+	not_found           404, e.g. the key of a PUT or DELETE doesn't exist
+	conflict            409, the request conflicts with the state of the cluster (e.g. a duplicate write)
+	misdirected         421, the key belongs to another group (see shards.go)
+	too_large           413, the body exceeds the size limit
+	rate_limited        429, including the backpressure of the leader (see admission.go)
+	not_leader          503, the replica isn't the leader, whose last known address is in leader
+	unavailable         502 and 503
+	deadline_exceeded   504
+	resource_exhausted  507, an alarm is raised (see alarms.go)
+	internal            500, and the other statuses
+
+A request whose error is retryable (429, 502, 503 and 504) may succeed once retried, after the
+Retry-After delay if there is one, or on the leader. The messages are meant for the operators and
+may change, the clients should only rely on the codes.
+*/
+
+// The body of the error responses of the HTTP API.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Leader    string `json:"leader,omitempty"` // Last known leader's address, with the not_leader code
+	Retryable bool   `json:"retryable"`
+}
+
+const codeNotLeader = "not_leader"
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid_argument",
+	http.StatusUnauthorized:          "unauthenticated",
+	http.StatusForbidden:             "permission_denied",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusMisdirectedRequest:    "misdirected",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusTooManyRequests:       "rate_limited",
+	http.StatusBadGateway:            "unavailable",
+	http.StatusServiceUnavailable:    "unavailable",
+	http.StatusGatewayTimeout:        "deadline_exceeded",
+	http.StatusInsufficientStorage:   "resource_exhausted",
+}
+
+// Return the code of the errors answered with the HTTP status, see above.
+func errorCode(status int) string {
+
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+
+	return "internal"
+}
+
+// Whether a request failed with the HTTP status may succeed once retried.
+func retryableStatus(status int) bool {
+
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// Return the message of an error response, on a single line and without the "Error: " prefix of
+// the messages of the handlers.
+func errorMessage(format string, args ...interface{}) string {
+
+	var lines []string
+	for _, line := range strings.Split(fmt.Sprintf(format, args...), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.TrimPrefix(strings.Join(lines, " "), "Error: ")
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+
+	writeJSON(w, status, ErrorResponse{
+		Code:      errorCode(status),
+		Message:   errorMessage(format, args...),
+		Retryable: retryableStatus(status),
+	})
+}
+
+// Answer a request only the leader can serve, with the last known leader's address.
+func writeNotLeader(w http.ResponseWriter, leader string) {
+
+	writeJSON(w, http.StatusServiceUnavailable, ErrorResponse{
+		Code:      codeNotLeader,
+		Message:   errorMessage("Not a leader.\n\nLast known leader's address: %v", leader),
+		Leader:    leader,
+		Retryable: true,
+	})
+}
+
+// Return the HTTP status of a write that failed to be proposed or committed, as the KVService tells
+// the errors of its transactions apart (see proposeTxn in kv_service.go).
+func proposalStatus(err error) int {
+
+	switch {
+
+	case err == errNotLeader:
+		return http.StatusServiceUnavailable
+
+	case err == errProposalQueueFull:
+		return http.StatusTooManyRequests
+
+	case errors.Is(err, errNoValue):
+		return http.StatusNotFound
+
+	case err == errReservedKey:
+		return http.StatusBadRequest
+
+	case err == errDuplicateWrite || err == errReadOnly || err == errUnknownSession || err == errStaleSequence:
+		return http.StatusConflict
+
+	case err == errAlarmRaised:
+		return http.StatusInsufficientStorage
+
+	case err == errConfigChangePending || errors.As(err, &configConflict{}):
+		return http.StatusConflict
+
+	case err == context.DeadlineExceeded || err == context.Canceled:
+		return http.StatusGatewayTimeout
+
+	case status.Code(err) != codes.Unknown:
+		return httpStatus(err)
+
+	}
+
+	return http.StatusServiceUnavailable
+}
+
+// Answer a write of the given operation that failed, see proposalStatus.
+func (node *RaftNode) writeProposalError(w http.ResponseWriter, operation string, err error) {
+
+	if err == errNotLeader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		return
+	}
+
+	writeError(w, proposalStatus(err), "Error occured in %v request: %v", operation, err)
+}
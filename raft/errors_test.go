@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the errors of the HTTP API are answered with an
+ * ErrorResponse, carrying the leader's address when the replica isn't the
+ * leader, and that the invalid keys and DNS names are rejected before being
+ * proposed.
+ */
+func TestErrorResponses(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig()}}
+	node.Meta.leaderAddress = ":4001"
+
+	r := mux.NewRouter()
+	r.HandleFunc("/zones/{zone}/diff", node.ZoneDiffHandler)
+	r.HandleFunc("/{key}", node.PostHandler).Methods("POST")
+	r.HandleFunc("/{key}", node.DeleteHandler).Methods("DELETE")
+
+	send := func(method, key string) (int, ErrorResponse) {
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/"+url.PathEscape(key)+"?value=v", nil))
+
+		var e ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected a JSON error response, got %v %q (%v)", w.Code, w.Body.String(), err)
+		}
+
+		return w.Code, e
+	}
+
+	code, e := send("POST", "a")
+	if code != http.StatusServiceUnavailable || e.Code != codeNotLeader || e.Leader != ":4001" || !e.Retryable || !strings.Contains(e.Message, "Last known leader's address: :4001") {
+		t.Errorf("Expected the follower to answer with the leader's address, got %v %+v", code, e)
+	}
+
+	for _, key := range []string{"a\x00b", strings.Repeat("k", maxKeyLength+1), "range", "openapi.json", "dns:WWW.example.com.:A", "dns:-www.example.com.:A", "dns:www.example.com.:BOGUS"} {
+		if code, e := send("POST", key); code != http.StatusBadRequest || e.Code != "invalid_argument" || e.Retryable {
+			t.Errorf("Expected the key %.40q to be rejected with 400, got %v %+v", key, code, e)
+		}
+	}
+
+	if rejections := node.Meta.rejections.List(rejectValidation, "", 0); len(rejections) != 7 {
+		t.Errorf("Expected the 7 invalid writes to be journaled, got %v", rejections)
+	}
+
+	// A record stored before the names were checked can still be deleted.
+	if code, e := send("DELETE", "dns:-www.example.com.:A"); code != http.StatusServiceUnavailable || e.Code != codeNotLeader {
+		t.Errorf("Expected the delete to reach the leader check, got %v %+v", code, e)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/zones/exa_mple.com/diff?from=1", nil))
+
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"code":"invalid_argument"`) {
+		t.Errorf("Expected the invalid zone name to be rejected, got %v %q", w.Code, w.Body.String())
+	}
+
+	// The errors of the reads served by the store: a follower within the staleness bound reads its
+	// own store, see follower_reads.go.
+	dir, err := ioutil.TempDir("", "errors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv, err := kv_store.OpenStore(filepath.Join(dir, "store"), kv_store.BackendMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kv.Close()
+
+	kvRouter := mux.NewRouter().SkipClean(true)
+	kvRouter.HandleFunc("/admin/compact", kv.CompactHandler).Methods("POST")
+	kvRouter.HandleFunc("/range", kv.RangeHandler).Methods("GET")
+	kvRouter.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler).Methods("GET")
+	kvRouter.HandleFunc("/{key}", kv.PostHandler).Methods("POST")
+	kvRouter.HandleFunc("/{key}", kv.GetHandler).Methods("GET")
+	kvRouter.HandleFunc("/{key}", kv.PutHandler).Methods("PUT")
+
+	store := httptest.NewServer(kvRouter)
+	defer store.Close()
+
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.Config.FollowerReadStaleness = 10
+	node.Meta.leaderContact = node.now()
+
+	for _, operation := range [][]string{{"POST", "a", "1"}, {"PUT", "a", "2"}, {"PUT", "a", "3"}, {"COMPACT", "3"}} {
+		if _, err := node.stateMachine().Apply(operation); err != nil {
+			t.Fatalf("Unable to apply %v: %v", operation, err)
+		}
+	}
+
+	r.HandleFunc("/range", node.RangeHandler).Methods("GET")
+	r.HandleFunc("/prefix/{prefix:.*}", node.PrefixHandler).Methods("GET")
+	r.HandleFunc("/{key}", node.GetHandler).Methods("GET")
+
+	for path, code := range map[string]int{
+		"/missing":           http.StatusNotFound,
+		"/a?rev=x":           http.StatusBadRequest,
+		"/a?rev=1":           http.StatusGone,
+		"/a?rev=100":         http.StatusBadRequest,
+		"/range?limit=x":     http.StatusBadRequest,
+		"/range?token=bogus": http.StatusBadRequest,
+		"/range?rev=1":       http.StatusGone,
+		"/prefix/a?limit=-1": http.StatusBadRequest,
+	} {
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		var e ErrorResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != code || e.Code != errorCode(code) || e.Message == "" {
+			t.Errorf("Expected GET %v to be answered with %v, got %v %q", path, code, w.Code, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/a", nil))
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Value = 3") {
+		t.Errorf("Expected the key to be read, got %v %q", w.Code, w.Body.String())
+	}
+
+	// Every fixed route of a single segment is reserved, as /{key} would never reach it.
+	for _, router := range []*mux.Router{node.routes(), kv.Router()} {
+
+		router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+
+			path, err := route.GetPathTemplate()
+			if err == nil && path != "/{key}" && strings.Count(path, "/") == 1 && !reservedKeys[path[1:]] {
+				t.Errorf("Expected the key %q of the route %v to be reserved", path[1:], path)
+			}
+
+			return nil
+		})
+	}
+
+	// The messages of the handlers are kept on a single line.
+	if message := errorMessage("Error: %v\n\nRecords imported by the upload: %v", "the zone is full", 3); message != "the zone is full Records imported by the upload: 3" {
+		t.Errorf("Unexpected message %q", message)
+	}
+
+	for err, code := range map[error]int{
+		fmt.Errorf("\nUnable to perform PUT request, %w.\n", errNoValue): http.StatusNotFound,
+		errDuplicateWrite:    http.StatusConflict,
+		errAlarmRaised:       http.StatusInsufficientStorage,
+		errProposalQueueFull: http.StatusTooManyRequests,
+		status.Error(codes.PermissionDenied, "denied"):            http.StatusForbidden,
+		errors.New("the entry was overwritten by a later leader"): http.StatusServiceUnavailable,
+	} {
+		if got := proposalStatus(err); got != code {
+			t.Errorf("Expected %q to be answered with %v, got %v", err, code, got)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Exports of the keyspace, for the nightly analytics and ETL jobs. The Export RPC of the KVService
+streams the keys (starting with a prefix) in key order, as chunks of at most limit keys, all read at
+the same store revision: the revision requested, or else the current revision of the replica when
+the export starts. Every replica applies the same entries in the same order, so a revision denotes
+the same state on each of them, and any replica can serve an export. The jobs should use the
+followers, leaving the leader to the client requests.
+
+Each chunk carries a cursor, naming the revision and the last key exported: passing it back resumes
+an interrupted export from the next key, on any replica. A replica whose store is behind the revision
+waits up to exportCatchUp for it to apply the entries. As with the Range continuation tokens (see
+kv_store/range.go), an export fails with OutOfRange once its revision is compacted, or once a key it
+reaches was overwritten too many times since, and must then be restarted.
+
+The exports don't slow down the client writes:
+
+- a replica runs at most maxExports exports at once, refusing the others with ResourceExhausted
+- the chunks are sent at the rate of the snapshot transfers (see throttle.go), which backs off when
+  the latency of the writes committed by the replica rises
+- the stream is flow controlled by HTTP/2: a slow reader pauses the export, which then holds no more
+  than a chunk of the keyspace
+
+The exported keys are filtered by the ACLs of the caller, and counted in exported_keys_total.
+
+The whole store is also exported over HTTP, for migrations and offline copies, by GET /admin/export,
+streaming the keys (starting with the prefix form value) read at the same store revision, returned in
+the X-Export-Revision header, in one of the bulk formats (the format form value):
+
+	json      JSON lines ({"key": ..., "value": ...}, application/x-ndjson), the default
+	protobuf  KeyValue messages, each prefixed by its length as a varint (application/x-protobuf)
+
+The keys of the reserved namespaces (e.g. the users) aren't exported. These exports share the limits
+of the Export RPC, and are aborted, rather than ended, if the replica fails to read the keys, so that
+a truncated export isn't mistaken for a complete one. They are imported by POST /admin/import, see
+import.go.
+*/
+
+const (
+	maxExports     = 2                      // Exports served at once by a replica
+	exportCatchUp  = 5 * time.Second        // Time a replica behind the revision of an export waits for it
+	exportRetry    = 100 * time.Millisecond // Interval between the reads of a replica catching up
+	exportPeerName = "export:"              // Prefix of the names of the exports in the snapshot throttle
+	exportPageKeys = 1000                   // Keys read at once by the HTTP exports
+)
+
+// The bulk formats of the HTTP exports and imports.
+const (
+	FormatJSON     = "json"     // JSON lines of {"key": ..., "value": ...}
+	FormatProtobuf = "protobuf" // KeyValue messages, each prefixed by its length as a varint
+)
+
+// Return the bulk format named by the form value, "" if it is unknown, and its content type.
+func bulkFormat(name string) (string, string) {
+
+	switch name {
+
+	case "", FormatJSON:
+		return FormatJSON, "application/x-ndjson"
+
+	case FormatProtobuf:
+		return FormatProtobuf, "application/x-protobuf"
+
+	}
+
+	return "", ""
+}
+
+// Write the key-value pair in the bulk format.
+func writeBulkRecord(w *bufio.Writer, format string, kv kv_store.KeyValue) error {
+
+	if format == FormatJSON {
+
+		encoded, err := json.Marshal(kv)
+		if err != nil {
+			return err
+		}
+
+		w.Write(encoded)
+		return w.WriteByte('\n')
+	}
+
+	encoded, err := proto.Marshal(&protos.KeyValue{Key: kv.Key, Value: kv.Value})
+	if err != nil {
+		return err
+	}
+
+	var size [binary.MaxVarintLen64]byte
+	w.Write(size[:binary.PutUvarint(size[:], uint64(len(encoded)))])
+	_, err = w.Write(encoded)
+
+	return err
+}
+
+// Read the next key-value pair in the bulk format, returning io.EOF after the last one.
+func readBulkRecord(r *bufio.Reader, format string) (kv_store.KeyValue, error) {
+
+	var kv kv_store.KeyValue
+
+	if format == FormatJSON {
+
+		for {
+
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF && len(bytes.TrimSpace(line)) != 0 {
+				err = nil
+			}
+			if err != nil {
+				return kv, err
+			}
+
+			// Blank lines are skipped.
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			if err := json.Unmarshal(line, &kv); err != nil {
+				return kv, fmt.Errorf("invalid record: %v", err)
+			}
+
+			return kv, nil
+		}
+	}
+
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return kv, err
+	}
+
+	if size > math.MaxInt32 {
+		return kv, fmt.Errorf("invalid record size %v", size)
+	}
+
+	encoded := make([]byte, size)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return kv, err
+	}
+
+	var record protos.KeyValue
+	if err := proto.Unmarshal(encoded, &record); err != nil {
+		return kv, fmt.Errorf("invalid record: %v", err)
+	}
+
+	return kv_store.KeyValue{Key: record.Key, Value: record.Value}, nil
+}
+
+func (s *kvServer) Export(in *protos.ExportRequest, stream protos.KVService_ExportServer) error {
+
+	ctx := stream.Context()
+	node := s.node
+
+	node.GetRLock("KVService Export")
+	witness, serves := node.isWitness(), node.servesQueries()
+	node.ReleaseRLock("KVService Export")
+
+	if witness {
+		return status.Error(codes.FailedPrecondition, errWitness.Error())
+	}
+
+	if !serves {
+		node.Meta.metrics.Add("client_queries_refused_total", 1, "protocol", "grpc")
+		return status.Error(codes.FailedPrecondition, errConsensusOnly.Error())
+	}
+
+	if in.Revision < 0 || in.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "the revision and the limit can't be negative")
+	}
+
+	if atomic.AddInt32(&node.exports, 1) > maxExports {
+		atomic.AddInt32(&node.exports, -1)
+		return status.Errorf(codes.ResourceExhausted, "%v exports are already in progress, retry later", maxExports)
+	}
+	defer atomic.AddInt32(&node.exports, -1)
+
+	allowed := node.keyFilter(ctx, PermissionRead)
+
+	query := url.Values{}
+	if in.Limit != 0 {
+		query.Set("limit", strconv.Itoa(int(in.Limit)))
+	}
+	if in.Cursor != "" {
+		query.Set("token", in.Cursor)
+	} else if in.Revision != 0 {
+		query.Set("rev", strconv.FormatInt(in.Revision, 10))
+	}
+
+	// Shares the bandwidth of the snapshot transfers, see throttle.go
+	name := exportPeerName
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			name += host
+		}
+	}
+
+	throttle := node.Meta.snapshots
+	if throttle != nil {
+		throttle.begin(name)
+		defer throttle.end(name)
+	}
+
+	for {
+
+		page, err := node.exportPage(ctx, in.Prefix, query)
+		if err != nil {
+			return err
+		}
+
+		chunk := &protos.ExportChunk{Revision: page.Revision, Cursor: page.NextToken}
+		size := 0
+
+		for _, kv := range page.Kvs {
+
+			if allowed != nil && !allowed(kv.Key) {
+				continue
+			}
+
+			chunk.Kvs = append(chunk.Kvs, &protos.KeyValue{Key: kv.Key, Value: kv.Value})
+			size += len(kv.Key) + len(kv.Value)
+		}
+
+		if throttle != nil {
+			if err := throttle.wait(ctx, name, size); err != nil {
+				return status.FromContextError(err).Err()
+			}
+		}
+
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+
+		node.Meta.metrics.Add("exported_keys_total", float64(len(chunk.Kvs)))
+
+		if page.NextToken == "" {
+			return nil
+		}
+
+		query.Del("rev")
+		query.Set("token", page.NextToken)
+	}
+}
+
+// Read the next page of the export from the local store, waiting for the store to reach the revision
+// of the export if it is behind.
+func (node *RaftNode) exportPage(ctx context.Context, prefix string, query url.Values) (kv_store.RangeResponse, error) {
+
+	var page kv_store.RangeResponse
+	deadline := time.Now().Add(exportCatchUp)
+
+	for {
+
+		response, code, err := node.stateMachine().Lookup("prefix/" + url.PathEscape(prefix) + "?" + query.Encode())
+		if err != nil {
+			return page, status.Errorf(codes.Unavailable, "read failed: %v", err)
+		}
+
+		switch {
+
+		case code == http.StatusOK:
+			if err := json.Unmarshal([]byte(response), &page); err != nil {
+				return page, status.Errorf(codes.Internal, "invalid range response: %v", err)
+			}
+			return page, nil
+
+		case code == http.StatusGone && strings.Contains(response, "is newer than the current revision") && time.Now().Before(deadline):
+			// The replica hasn't applied the revision yet.
+
+		case code == http.StatusGone:
+			return page, status.Error(codes.OutOfRange, strings.TrimSpace(response))
+
+		default:
+			return page, status.Error(codes.InvalidArgument, strings.TrimSpace(response))
+
+		}
+
+		select {
+		case <-ctx.Done():
+			return page, status.FromContextError(ctx.Err()).Err()
+		case <-time.After(exportRetry):
+		}
+	}
+}
+
+// Handle the requests exporting the keys of the store, see the HTTP exports above.
+func (node *RaftNode) ExportHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("EXPORT request received")
+
+	format, contentType := bulkFormat(r.FormValue("format"))
+	if format == "" {
+		writeError(w, http.StatusBadRequest, "Invalid format %q, expected json or protobuf", r.FormValue("format"))
+		return
+	}
+
+	query := url.Values{"limit": {strconv.Itoa(exportPageKeys)}}
+	if value := r.FormValue("revision"); value != "" {
+
+		if revision, err := strconv.ParseInt(value, 10, 64); err != nil || revision < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid revision %q", value)
+			return
+		}
+
+		query.Set("rev", value)
+	}
+
+	node.GetRLock("Export Handler")
+	witness, serves := node.isWitness(), node.servesQueries()
+	node.ReleaseRLock("Export Handler")
+
+	if witness {
+		writeError(w, http.StatusConflict, "Error: %v", errWitness)
+		return
+	}
+
+	if !serves {
+		node.Meta.metrics.Add("client_queries_refused_total", 1, "protocol", "http")
+		writeError(w, http.StatusServiceUnavailable, "Error: %v", errConsensusOnly)
+		return
+	}
+
+	if atomic.AddInt32(&node.exports, 1) > maxExports {
+		atomic.AddInt32(&node.exports, -1)
+		writeError(w, http.StatusTooManyRequests, "Error: %v exports are already in progress, retry later", maxExports)
+		return
+	}
+	defer atomic.AddInt32(&node.exports, -1)
+
+	allowed := node.keyFilter(r.Context(), PermissionRead)
+	prefix := r.FormValue("prefix")
+
+	page, err := node.exportPage(r.Context(), prefix, query)
+	if err != nil {
+		writeError(w, httpStatus(err), "Export failed with error: %v", status.Convert(err).Message())
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Export-Revision", strconv.FormatInt(page.Revision, 10))
+	w.WriteHeader(http.StatusOK)
+
+	// Sent at the rate of the snapshot transfers, see throttle.go
+	throttled, done := node.Meta.snapshots.writer(r.Context(), exportPeerName+requestHost(r), w)
+	defer done()
+
+	out := bufio.NewWriter(throttled)
+	exported := 0
+
+	for {
+
+		sent := exported
+
+		for _, kv := range page.Kvs {
+
+			if reservedKey(kv.Key) || (allowed != nil && !allowed(kv.Key)) {
+				continue
+			}
+
+			if err := writeBulkRecord(out, format, kv); err != nil {
+				node.logger().Warn().Err(err).Msg("Unable to send the export")
+				return
+			}
+
+			exported++
+		}
+
+		if err := out.Flush(); err != nil {
+			node.logger().Warn().Err(err).Msg("Unable to send the export")
+			return
+		}
+
+		node.Meta.metrics.Add("exported_keys_total", float64(exported-sent))
+
+		if page.NextToken == "" {
+			break
+		}
+
+		query.Del("rev")
+		query.Set("token", page.NextToken)
+
+		if page, err = node.exportPage(r.Context(), prefix, query); err != nil {
+
+			// The connection is closed without ending the response, see net/http.
+			node.logger().Warn().Err(err).Int("exported", exported).Msg("Export aborted")
+			panic(http.ErrAbortHandler)
+		}
+	}
+
+	node.logger().Info().Int64("revision", page.Revision).Int("exported", exported).Str("format", format).Msg("Export sent")
+}
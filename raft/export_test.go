@@ -0,0 +1,234 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A stream of export chunks, failing after max chunks if max is positive.
+type exportStream struct {
+	grpc.ServerStream
+
+	ctx    context.Context
+	max    int
+	chunks []*protos.ExportChunk
+}
+
+func (s *exportStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *exportStream) Send(chunk *protos.ExportChunk) error {
+
+	if s.max > 0 && len(s.chunks) == s.max {
+		return errors.New("stream broken")
+	}
+
+	s.chunks = append(s.chunks, chunk)
+	return nil
+}
+
+/*
+ * This test case checks that an export lists the keys with its prefix in
+ * chunks read at the same revision, that an interrupted export resumes from
+ * its cursor without seeing the later writes, and that the exports beyond the
+ * limit of a replica, the invalid cursors and the revisions the replica doesn't
+ * reach are refused.
+ */
+func TestExport(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	txn := func(body string) {
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(body)))
+	}
+
+	txn(`{"success": [{"type": "PUT", "key": "a1", "value": "1"}, {"type": "PUT", "key": "a2", "value": "2"}, {"type": "PUT", "key": "a3", "value": "3"}, {"type": "PUT", "key": "a4", "value": "4"}, {"type": "PUT", "key": "a5", "value": "5"}, {"type": "PUT", "key": "b", "value": "6"}]}`)
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	s := &kvServer{node: node}
+	ctx := context.Background()
+
+	first := &exportStream{ctx: ctx, max: 1}
+	if err := s.Export(&protos.ExportRequest{Prefix: "a", Limit: 2}, first); err == nil || len(first.chunks) != 1 || first.chunks[0].Cursor == "" {
+		t.Fatalf("Expected the export to fail after its first chunk, got %v %v", err, first.chunks)
+	}
+
+	// Written after the export started, so not exported.
+	txn(`{"success": [{"type": "DELETE", "key": "a3"}, {"type": "PUT", "key": "a4", "value": "x"}, {"type": "PUT", "key": "a6", "value": "7"}]}`)
+
+	resumed := &exportStream{ctx: ctx}
+	if err := s.Export(&protos.ExportRequest{Prefix: "a", Limit: 2, Cursor: first.chunks[0].Cursor}, resumed); err != nil {
+		t.Fatalf("Expected the export to resume, got %v", err)
+	}
+
+	var keys []string
+	for _, chunk := range append(first.chunks, resumed.chunks...) {
+
+		if chunk.Revision != first.chunks[0].Revision {
+			t.Errorf("Expected every chunk to be read at revision %v, got %v", first.chunks[0].Revision, chunk.Revision)
+		}
+
+		for _, kv := range chunk.Kvs {
+			keys = append(keys, kv.Key+"="+kv.Value)
+		}
+	}
+
+	if strings.Join(keys, ",") != "a1=1,a2=2,a3=3,a4=4,a5=5" || resumed.chunks[len(resumed.chunks)-1].Cursor != "" {
+		t.Errorf("Expected the keys as of the revision of the export, got %v", keys)
+	}
+
+	// A replica behind the revision waits for it until the caller gives up.
+	behind, cancel := context.WithTimeout(ctx, 3*exportRetry)
+	defer cancel()
+
+	if err := s.Export(&protos.ExportRequest{Revision: 1000}, &exportStream{ctx: behind}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected the export of a revision not reached to wait, got %v", err)
+	}
+
+	if err := s.Export(&protos.ExportRequest{Cursor: "invalid"}, &exportStream{ctx: ctx}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected the invalid cursor to be refused, got %v", err)
+	}
+
+	s.node.exports = maxExports
+	if err := s.Export(&protos.ExportRequest{}, &exportStream{ctx: ctx}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the export beyond the limit to be refused, got %v", err)
+	}
+
+	// The exports don't leave the limit taken.
+	s.node.exports = 0
+	for i := 0; i < maxExports+1; i++ {
+		if err := s.Export(&protos.ExportRequest{Prefix: "b"}, &exportStream{ctx: ctx}); err != nil {
+			t.Errorf("Expected export %v to succeed, got %v", i, err)
+		}
+	}
+}
+
+/*
+ * This test case checks that the HTTP exports stream the keys with their prefix
+ * in both bulk formats, along with the revision read, the reserved keys aside,
+ * that the records read back are those exported, and that the imports refuse
+ * the invalid requests and the followers.
+ */
+func TestBulkExport(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bulkexport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(`{"success": [{"type": "PUT", "key": "a1", "value": "1"}, {"type": "PUT", "key": "a2", "value": "line\nbreak"}, {"type": "PUT", "key": "b", "value": "3"}, {"type": "PUT", "key": "_settings:x", "value": "reserved"}]}`)))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	export := func(query string) (*httptest.ResponseRecorder, []string) {
+
+		w := httptest.NewRecorder()
+		node.ExportHandler(w, httptest.NewRequest("GET", "/admin/export"+query, nil))
+
+		format, _ := bulkFormat(httptest.NewRequest("GET", "/"+query, nil).FormValue("format"))
+		reader := bufio.NewReader(w.Body)
+
+		var keys []string
+		for w.Code == http.StatusOK {
+
+			record, err := readBulkRecord(reader, format)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Unable to read the export of %q: %v", query, err)
+			}
+
+			keys = append(keys, record.Key+"="+record.Value)
+		}
+
+		return w, keys
+	}
+
+	for _, format := range []string{FormatJSON, FormatProtobuf} {
+
+		w, keys := export("?format=" + format)
+		if w.Code != http.StatusOK || w.Header().Get("X-Export-Revision") == "" {
+			t.Fatalf("Expected the %v export to succeed, got %v %v", format, w.Code, w.Body.String())
+		}
+
+		if strings.Join(keys, ",") != "a1=1,a2=line\nbreak,b=3" {
+			t.Errorf("Expected the %v export of the keys but the reserved ones, got %q", format, keys)
+		}
+	}
+
+	if _, keys := export("?prefix=a&format=protobuf"); strings.Join(keys, ",") != "a1=1,a2=line\nbreak" {
+		t.Errorf("Expected the export of the keys with the prefix, got %q", keys)
+	}
+
+	if w, _ := export("?format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected the unknown format to be refused, got %v", w.Code)
+	}
+
+	// A record cut short isn't mistaken for the end of the export.
+	var buffer bytes.Buffer
+	out := bufio.NewWriter(&buffer)
+	writeBulkRecord(out, FormatProtobuf, kv_store.KeyValue{Key: "a1", Value: "1"})
+	out.Flush()
+
+	if _, err := readBulkRecord(bufio.NewReader(bytes.NewReader(buffer.Bytes()[:buffer.Len()-1])), FormatProtobuf); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected the truncated record to fail, got %v", err)
+	}
+
+	if _, err := readBulkRecord(bufio.NewReader(strings.NewReader("{\"key\": \"a\"\n")), FormatJSON); err == nil || err == io.EOF {
+		t.Errorf("Expected the invalid JSON record to fail, got %v", err)
+	}
+
+	// The imports.
+	for query, code := range map[string]int{
+		"?format=xml":          http.StatusBadRequest,
+		"?upload=a/b":          http.StatusBadRequest,
+		"?offset=5":            http.StatusBadRequest,
+		"?upload=u1&offset=-1": http.StatusBadRequest,
+		"?upload=u1&offset=0":  http.StatusServiceUnavailable,
+		"?format=protobuf":     http.StatusServiceUnavailable,
+	} {
+
+		w := httptest.NewRecorder()
+		node.ImportHandler(w, httptest.NewRequest("POST", "/admin/import"+query, strings.NewReader(`{"key": "c", "value": "4"}`)))
+
+		if w.Code != code {
+			t.Errorf("Expected the import of %q to fail with %v, got %v %v", query, code, w.Code, w.Body.String())
+		}
+	}
+}
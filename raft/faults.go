@@ -0,0 +1,335 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Fault injection, for testing a cluster of real processes under faults (see chaos_test.go). It is
+only available in binaries built with the faults build tag (go build -tags faults), and enabled by
+Config.Faults, parsed from a specification such as
+
+	drop=0.05,delay=0.2:50ms,duplicate=0.05,crash=10s,corrupt=0.5,seed=1
+
+	drop=<p>            each RPC sent to a peer is lost with probability p, either the request or
+	                    the response. The RPC then fails once its deadline passes.
+	delay=<p>:<max>     each RPC is delayed with probability p, by up to max
+	duplicate=<p>       each RPC is sent twice with probability p, the response to the copy being
+	                    ignored
+	crash=<mean>        the replica crashes (exits with faultCrashExitCode, without any cleanup)
+	                    after an exponentially distributed time of the given mean. Restarting it is
+	                    left to a supervisor, such as the chaos test.
+	corrupt=<p>         a crash is taken in the middle of writing the persisted files of the
+	                    replica with probability p, leaving torn copies of them behind
+	seed=<n>            seed of the faults, the current time if unset
+
+The faults of the RPCs are injected around the Transport of each peer (see transport.go), so they
+apply to the messages sent by the replica. The persisted files are expected to survive a crash in
+the middle of a write: they are written to a temporary file renamed over the previous version.
+*/
+
+const faultCrashExitCode = 113
+
+// The faults injected in a replica, see ParseFaults.
+type FaultConfig struct {
+	Seed      int64
+	Drop      float64       // Probability of an RPC being lost
+	Delay     float64       // Probability of an RPC being delayed
+	MaxDelay  time.Duration // Maximum delay of an RPC
+	Duplicate float64       // Probability of an RPC being sent twice
+	Crash     time.Duration // Mean time before the replica crashes, 0 if it doesn't
+	Corrupt   float64       // Probability of a crash tearing the writes of the persisted files
+}
+
+// Parse a specification of the faults to inject, returning nil if it is empty. Fails unless the
+// binary was built with the faults build tag.
+func ParseFaults(spec string) (*FaultConfig, error) {
+
+	if spec == "" {
+		return nil, nil
+	}
+
+	if !faultInjection {
+		return nil, errors.New("fault injection requires a build with -tags faults")
+	}
+
+	config := &FaultConfig{Seed: time.Now().UnixNano()}
+
+	for _, field := range strings.Split(spec, ",") {
+
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid fault %q, expected <fault>=<value>", field)
+		}
+
+		var err error
+
+		switch kv[0] {
+
+		case "drop":
+			config.Drop, err = parseProbability(kv[1])
+
+		case "delay":
+			values := strings.SplitN(kv[1], ":", 2)
+			if len(values) != 2 {
+				return nil, fmt.Errorf("invalid fault %q, expected delay=<probability>:<max delay>", field)
+			}
+			if config.Delay, err = parseProbability(values[0]); err == nil {
+				config.MaxDelay, err = time.ParseDuration(values[1])
+			}
+
+		case "duplicate":
+			config.Duplicate, err = parseProbability(kv[1])
+
+		case "crash":
+			config.Crash, err = time.ParseDuration(kv[1])
+
+		case "corrupt":
+			config.Corrupt, err = parseProbability(kv[1])
+
+		case "seed":
+			config.Seed, err = strconv.ParseInt(kv[1], 10, 64)
+
+		default:
+			return nil, fmt.Errorf("unknown fault %q", kv[0])
+
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %v", field, err)
+		}
+	}
+
+	return config, nil
+}
+
+func parseProbability(s string) (float64, error) {
+
+	p, err := strconv.ParseFloat(s, 64)
+	if err == nil && (p < 0 || p > 1) {
+		err = errors.New("probabilities must be between 0 and 1")
+	}
+
+	return p, err
+}
+
+// Draws the faults injected in a replica from the seed of its configuration, safe for concurrent use.
+type faultInjector struct {
+	config  *FaultConfig
+	metrics *Metrics
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// The faults injected in an RPC.
+type rpcFaults struct {
+	dropRequest  bool
+	dropResponse bool
+	delay        time.Duration
+	duplicate    bool
+}
+
+func newFaultInjector(config *FaultConfig, metrics *Metrics) *faultInjector {
+	return &faultInjector{config: config, metrics: metrics, rand: rand.New(rand.NewSource(config.Seed))}
+}
+
+func (f *faultInjector) draw() rpcFaults {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var faults rpcFaults
+
+	if f.rand.Float64() < f.config.Drop {
+		faults.dropRequest = f.rand.Intn(2) == 0
+		faults.dropResponse = !faults.dropRequest
+		f.metrics.Add("faults_injected_total", 1, "fault", "drop")
+	}
+
+	if f.config.MaxDelay > 0 && f.rand.Float64() < f.config.Delay {
+		faults.delay = time.Duration(f.rand.Int63n(int64(f.config.MaxDelay)))
+		f.metrics.Add("faults_injected_total", 1, "fault", "delay")
+	}
+
+	if f.rand.Float64() < f.config.Duplicate {
+		faults.duplicate = true
+		f.metrics.Add("faults_injected_total", 1, "fault", "duplicate")
+	}
+
+	return faults
+}
+
+// Return a uniform float in [0, 1) drawn from the seed.
+func (f *faultInjector) float() float64 {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.rand.Float64()
+}
+
+// The Transport to a peer, wrapped so that faults are injected in the RPCs sent through it.
+type faultyTransport struct {
+	next   Transport
+	faults *faultInjector
+}
+
+// Return the transport used to reach a peer, injecting faults if enabled.
+func (node *RaftNode) peerTransport(transport Transport) Transport {
+
+	if node.Meta.faults == nil {
+		return transport
+	}
+
+	return &faultyTransport{next: transport, faults: node.Meta.faults}
+}
+
+// Send an RPC through the wrapped transport, with the faults drawn for it.
+func (t *faultyTransport) send(ctx context.Context, rpc func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+
+	faults := t.faults.draw()
+
+	lost := func() (interface{}, error) {
+		<-ctx.Done()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	if faults.delay > 0 {
+		select {
+		case <-time.After(faults.delay):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+
+	if faults.dropRequest {
+		return lost()
+	}
+
+	// The copy outlives the RPC if needed, until the same deadline.
+	if faults.duplicate {
+
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadline = time.Now().Add(time.Minute)
+		}
+
+		copy_ctx, cancel := context.WithDeadline(context.Background(), deadline)
+
+		go func() {
+			defer cancel()
+			rpc(copy_ctx)
+		}()
+	}
+
+	response, err := rpc(ctx)
+
+	if err == nil && faults.dropResponse {
+		return lost()
+	}
+
+	return response, err
+}
+
+func (t *faultyTransport) SendRequestVote(ctx context.Context, msg *protos.RequestVoteMessage) (*protos.RequestVoteResponse, error) {
+
+	response, err := t.send(ctx, func(ctx context.Context) (interface{}, error) {
+		return t.next.SendRequestVote(ctx, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.RequestVoteResponse), nil
+}
+
+func (t *faultyTransport) SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+
+	response, err := t.send(ctx, func(ctx context.Context) (interface{}, error) {
+		return t.next.SendAppendEntries(ctx, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.AppendEntriesResponse), nil
+}
+
+func (t *faultyTransport) SendTimeoutNow(ctx context.Context, msg *protos.TimeoutNowMessage) (*protos.TimeoutNowResponse, error) {
+
+	response, err := t.send(ctx, func(ctx context.Context) (interface{}, error) {
+		return t.next.SendTimeoutNow(ctx, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.TimeoutNowResponse), nil
+}
+
+func (t *faultyTransport) SendInstallSnapshot(ctx context.Context, msg *protos.InstallSnapshotMessage) (*protos.InstallSnapshotResponse, error) {
+
+	response, err := t.send(ctx, func(ctx context.Context) (interface{}, error) {
+		return t.next.SendInstallSnapshot(ctx, msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.InstallSnapshotResponse), nil
+}
+
+// Crash the replica after a random time, if configured, unless ctx is done first.
+func (node *RaftNode) injectCrash(ctx context.Context) {
+
+	faults := node.Meta.faults
+	if faults == nil || faults.config.Crash <= 0 {
+		return
+	}
+
+	// Exponentially distributed, with the configured mean.
+	after := time.Duration(-float64(faults.config.Crash) * math.Log(1-faults.float()))
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(after):
+	}
+
+	torn := faults.float() < faults.config.Corrupt
+	if torn {
+		node.tearPersistedFiles(faults)
+	}
+
+	node.logger().Warn().Dur("after", after).Bool("torn_writes", torn).Msg("Injecting a crash")
+	os.Exit(faultCrashExitCode)
+}
+
+// Leave torn copies of the persisted files next to them, as a crash while writing them would.
+func (node *RaftNode) tearPersistedFiles(faults *faultInjector) {
+
+	for _, file := range []string{node.Meta.raft_persistence_file, node.Meta.Config.Layout.StoreFile(int(node.Meta.replica_id))} {
+
+		contents, err := ioutil.ReadFile(file)
+		if err != nil || len(contents) == 0 {
+			continue
+		}
+
+		torn := contents[:int(faults.float()*float64(len(contents)))]
+		ioutil.WriteFile(file+".tmp", torn, 0644)
+	}
+}
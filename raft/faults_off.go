@@ -0,0 +1,7 @@
+//go:build !faults
+// +build !faults
+
+package raft
+
+// Fault injection is left out of regular builds, see faults.go
+const faultInjection = false
@@ -0,0 +1,7 @@
+//go:build faults
+// +build faults
+
+package raft
+
+// Binaries built with the faults tag can inject faults, see faults.go
+const faultInjection = true
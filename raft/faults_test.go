@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A Transport counting the AppendEntries it is asked to send.
+type countingTransport struct {
+	Transport
+	sent int32
+}
+
+func (t *countingTransport) SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+	atomic.AddInt32(&t.sent, 1)
+	return &protos.AppendEntriesResponse{Term: msg.Term, Success: true}, nil
+}
+
+/*
+ * This test case checks that fault specifications are only accepted by
+ * binaries built with the faults tag, and that the faults configured are
+ * injected in the RPCs sent through the transport of a peer: lost RPCs fail
+ * once their deadline passes, and duplicated ones are sent twice.
+ */
+func TestFaultInjection(t *testing.T) {
+
+	config, err := ParseFaults("drop=0.05,delay=0.2:50ms,duplicate=0.1,crash=10s,corrupt=0.5,seed=7")
+
+	if !faultInjection {
+		if err == nil {
+			t.Errorf("Expected faults to be refused without the faults build tag")
+		}
+	} else if err != nil || config.Drop != 0.05 || config.Delay != 0.2 || config.MaxDelay != 50*time.Millisecond || config.Duplicate != 0.1 || config.Crash != 10*time.Second || config.Corrupt != 0.5 || config.Seed != 7 {
+		t.Errorf("Unexpected faults %+v (%v)", config, err)
+	}
+
+	if config, err := ParseFaults(""); config != nil || err != nil {
+		t.Errorf("Expected no faults for an empty specification, got %+v (%v)", config, err)
+	}
+
+	if faultInjection {
+		for _, spec := range []string{"drop=2", "delay=0.1", "crash=often", "flood=1"} {
+			if _, err := ParseFaults(spec); err == nil {
+				t.Errorf("Expected %q to be rejected", spec)
+			}
+		}
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{}}
+	if transport := node.peerTransport(&countingTransport{}); transport == nil {
+		t.Fatal("Expected a transport")
+	} else if _, ok := transport.(*faultyTransport); ok {
+		t.Errorf("Expected no fault to be injected when disabled")
+	}
+
+	send := func(config FaultConfig) (*countingTransport, error) {
+
+		peer := &countingTransport{}
+		node.Meta.faults = newFaultInjector(&config, NewMetrics())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := node.peerTransport(peer).SendAppendEntries(ctx, &protos.AppendEntriesMessage{Term: 1})
+		time.Sleep(10 * time.Millisecond) // for the duplicate to be sent
+
+		return peer, err
+	}
+
+	if peer, err := send(FaultConfig{Seed: 1}); err != nil || atomic.LoadInt32(&peer.sent) != 1 {
+		t.Errorf("Expected the RPC to be sent once, got %v sent (%v)", peer.sent, err)
+	}
+
+	if peer, err := send(FaultConfig{Seed: 1, Duplicate: 1}); err != nil || atomic.LoadInt32(&peer.sent) != 2 {
+		t.Errorf("Expected the RPC to be sent twice, got %v sent (%v)", peer.sent, err)
+	}
+
+	for seed := int64(0); seed < 10; seed++ {
+		if _, err := send(FaultConfig{Seed: seed, Drop: 1}); status.Code(err) != codes.DeadlineExceeded {
+			t.Errorf("Expected a dropped RPC to fail at its deadline, got %v", err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := send(FaultConfig{Seed: 1, Delay: 1, MaxDelay: time.Second}); status.Code(err) != codes.DeadlineExceeded && time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Expected the RPC to be delayed, got %v after %v", err, time.Since(start))
+	}
+}
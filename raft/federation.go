@@ -0,0 +1,300 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/client"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+/*
+Federation of independent clusters (e.g. one per region) serving the same zones. Each zone has a home
+cluster, which takes its writes; the other clusters replicate the records of the zone from the change
+feed of the home cluster (the Watch of the KVService), and serve them locally with eventual consistency.
+
+A cluster replicates a zone from another one when its setting federation.<zone> holds the gRPC
+addresses of the replicas of the home cluster, e.g. federation.example.com = "eu1:5000,eu2:5000".
+The most specific zone applies, and an empty value keeps a subzone homed locally. Client writes to the
+records of a replicated zone are rejected with the addresses of its home cluster.
+
+The leader runs the replication as a leader job (see jobs.go): for each zone, it first copies the
+records of the home cluster, then applies the changes it is notified of, through the log. As changes
+made while the watch is broken aren't delivered, the zone is copied again every federationResync.
+*/
+
+const (
+	FederationPrefix  = "federation."  // Prefix of the settings naming the home cluster of a zone
+	federationClient  = "_federation:" // Client ID of the writes made by the replication, followed by the zone
+	federationResync  = time.Minute
+	federationRefresh = time.Second // Interval at which the leader checks the settings for new or removed zones
+)
+
+// Error returned for the writes of a zone homed in another cluster.
+type foreignZoneError struct {
+	zone string
+	home string
+}
+
+func (e *foreignZoneError) Error() string {
+	return fmt.Sprintf("zone %v is replicated from another cluster, send its writes to %v", e.zone, e.home)
+}
+
+// Return the zone containing the key and the addresses of its home cluster, if it is replicated from
+// another cluster.
+func (node *RaftNode) federatedZone(key string) (string, string, bool) {
+
+	name, _, ok := zone.ParseRecordKey(key)
+	if !ok {
+		return "", "", false
+	}
+
+	best, home := "", ""
+
+	for setting, value := range node.Meta.settings.All() {
+
+		if !strings.HasPrefix(setting, FederationPrefix) {
+			continue
+		}
+
+		z := zone.CanonicalName(strings.TrimPrefix(setting, FederationPrefix))
+
+		if zone.InZone(zone.CanonicalName(name), z) && len(z) > len(best) {
+			best, home = z, strings.TrimSpace(value)
+		}
+	}
+
+	return best, home, home != ""
+}
+
+// Check that the key may be written by clients of this cluster.
+func (node *RaftNode) checkFederatedWrite(key string) error {
+
+	if z, home, ok := node.federatedZone(key); ok {
+		return &foreignZoneError{zone: z, home: home}
+	}
+
+	return node.checkDelegatedWrite(key)
+}
+
+// The zones being replicated by the leader, by zone.
+type federation struct {
+	mu    sync.Mutex
+	zones map[string]*zoneReplication
+}
+
+type zoneReplication struct {
+	home   string // Addresses of the home cluster, as given by the setting
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Job starting the replication of the zones added to the settings, and stopping the removed ones.
+func (node *RaftNode) federationJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "federation",
+		Interval: federationRefresh,
+		Run: func(ctx context.Context) error {
+
+			wanted := make(map[string]string)
+
+			for setting, value := range node.Meta.settings.All() {
+				if strings.HasPrefix(setting, FederationPrefix) && strings.TrimSpace(value) != "" {
+					wanted[zone.CanonicalName(strings.TrimPrefix(setting, FederationPrefix))] = strings.TrimSpace(value)
+				}
+			}
+
+			node.federation.mu.Lock()
+			defer node.federation.mu.Unlock()
+
+			if node.federation.zones == nil {
+				node.federation.zones = make(map[string]*zoneReplication)
+			}
+
+			for z, r := range node.federation.zones {
+
+				// Replications of an earlier leadership were stopped along with the job.
+				if home, ok := wanted[z]; !ok || home != r.home || r.ctx.Err() != nil {
+					r.cancel()
+					delete(node.federation.zones, z)
+				}
+			}
+
+			for z, home := range wanted {
+
+				if _, ok := node.federation.zones[z]; ok {
+					continue
+				}
+
+				r := &zoneReplication{home: home}
+				r.ctx, r.cancel = context.WithCancel(ctx)
+				node.federation.zones[z] = r
+
+				go node.replicateZone(r.ctx, z, home)
+			}
+
+			return nil
+		},
+	}
+}
+
+// Replicate the records of the zone from its home cluster until the context is cancelled.
+func (node *RaftNode) replicateZone(ctx context.Context, name, home string) {
+
+	config := client.DefaultConfig(strings.Split(home, ",")...)
+	config.Token = node.Meta.Config.FederationToken
+
+	c, err := client.New(config)
+	if err != nil {
+		node.logger().Error().Err(err).Str("zone", name).Msg("Unable to connect to the home cluster of the zone")
+		return
+	}
+	defer c.Close()
+
+	node.logger().Info().Str("zone", name).Str("home", home).Msg("Replicating zone from its home cluster")
+
+	for ctx.Err() == nil {
+
+		// The watch is opened before copying the zone, so that no change is missed in between.
+		watch_ctx, cancel := context.WithCancel(ctx)
+		events := c.Watch(watch_ctx, zone.KeyPrefix, true)
+
+		if err := node.copyZone(ctx, c, name); err != nil {
+			node.Meta.metrics.Add("federation_syncs_total", 1, "zone", name, "outcome", "error")
+			node.logger().Warn().Err(err).Str("zone", name).Msg("Unable to copy the zone from its home cluster")
+		} else {
+			node.Meta.metrics.Add("federation_syncs_total", 1, "zone", name, "outcome", "success")
+		}
+
+		node.followZone(ctx, name, events)
+		cancel()
+	}
+
+	node.logger().Info().Str("zone", name).Msg("Stopped replicating zone")
+}
+
+// Apply the changes made to the zone by its home cluster, until the next resync.
+func (node *RaftNode) followZone(ctx context.Context, name string, events <-chan client.Event) {
+
+	resync := time.After(federationResync)
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return
+
+		case <-resync:
+			return
+
+		case event, ok := <-events:
+
+			if !ok {
+				return
+			}
+
+			if n, _, ok := zone.ParseRecordKey(event.Key); !ok || !zone.InZone(zone.CanonicalName(n), name) {
+				continue
+			}
+
+			op := kv_store.Op{Type: kv_store.OpPut, Key: event.Key, Value: event.Value}
+			if event.Type == kv_store.OpDelete {
+				op = kv_store.Op{Type: kv_store.OpDelete, Key: event.Key}
+			}
+
+			if err := node.proposeFederated(ctx, name, []kv_store.Op{op}); err != nil {
+				node.logger().Warn().Err(err).Str("zone", name).Str("key", event.Key).Msg("Unable to apply a change of the home cluster")
+				continue
+			}
+
+			node.Meta.metrics.Add("federation_changes_total", 1, "zone", name)
+		}
+	}
+}
+
+// Make the records of the zone in the local store match those of the home cluster.
+func (node *RaftNode) copyZone(ctx context.Context, c *client.RaftKVClient, name string) error {
+
+	in_zone := func(key string) bool {
+		n, _, ok := zone.ParseRecordKey(key)
+		return ok && zone.InZone(zone.CanonicalName(n), name)
+	}
+
+	return node.syncRecords(ctx, c, name, in_zone, federationClient+name)
+}
+
+// Make the records of the local store the filter selects match those of the remote cluster (or group,
+// see shards.go), through the log with the given client ID.
+func (node *RaftNode) syncRecords(ctx context.Context, c *client.RaftKVClient, name string, selected func(key string) bool, client_id string) error {
+
+	remote, err := c.Prefix(ctx, zone.KeyPrefix, 0)
+	if err != nil {
+		return err
+	}
+
+	current, err := node.localRecords(selected)
+	if err != nil {
+		return err
+	}
+
+	var ops []kv_store.Op
+
+	for _, kv := range remote {
+
+		if !selected(kv.Key) {
+			continue
+		}
+
+		if value, ok := current[kv.Key]; !ok || value != kv.Value {
+			ops = append(ops, kv_store.Op{Type: kv_store.OpPut, Key: kv.Key, Value: kv.Value})
+		}
+
+		delete(current, kv.Key)
+	}
+
+	for key := range current {
+		ops = append(ops, kv_store.Op{Type: kv_store.OpDelete, Key: key})
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+
+	node.logger().Info().Str("zone", name).Int("changes", len(ops)).Msg("Copying the records of the zone")
+
+	return node.proposeRecords(ctx, client_id, ops)
+}
+
+// Replicate the changes made to a zone by its home cluster through the log.
+func (node *RaftNode) proposeFederated(ctx context.Context, name string, ops []kv_store.Op) error {
+	return node.proposeRecords(ctx, federationClient+name, ops)
+}
+
+// Replicate the changes made to the records by the leader itself through the log, as a transaction of
+// the given client.
+func (node *RaftNode) proposeRecords(ctx context.Context, client_id string, ops []kv_store.Op) error {
+
+	encoded, _ := json.Marshal(kv_store.Txn{Success: ops})
+
+	node.GetRLock("Federation")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Federation")
+		return errNotLeader
+	}
+
+	_, success, err := node.proposeCommand(ctx, []string{"TXN", string(encoded)}, client_id) // releases the lock
+
+	// An identical change was just replicated, e.g. a change received again after a resync.
+	if !success && err != errDuplicateWrite {
+		return err
+	}
+
+	return nil
+}
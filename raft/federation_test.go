@@ -0,0 +1,43 @@
+package raft
+
+import (
+	"context"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the most specific federated zone decides the
+ * home cluster of a record, and that client writes to the records of a zone
+ * replicated from another cluster are rejected.
+ */
+func TestFederatedZones(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections()}}
+
+	node.Meta.settings.apply(SettingChange{Name: "federation.example.com", Action: "SET", Value: "eu1:5000, eu2:5000"})
+	node.Meta.settings.apply(SettingChange{Name: "federation.local.example.com", Action: "SET", Value: ""})
+
+	if z, home, ok := node.federatedZone(zone.RecordKey("www.example.com", "A")); !ok || z != "example.com." || home != "eu1:5000, eu2:5000" {
+		t.Errorf("Expected www.example.com to be homed in eu1 and eu2, got %v %v %v", z, home, ok)
+	}
+
+	for _, key := range []string{zone.RecordKey("a.local.example.com", "A"), zone.RecordKey("example.org", "A"), "example.com"} {
+		if err := node.checkFederatedWrite(key); err != nil {
+			t.Errorf("Expected %v to be written locally, got %v", key, err)
+		}
+	}
+
+	txn := kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey("example.com", "MX"), Value: "[]"}}}
+	if _, err := node.replicateTxn(context.Background(), txn, "", 0, 0); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected a write of a replicated zone to be rejected, got %v", err)
+	}
+
+	if name, rtype, ok := zone.ParseRecordKey(zone.RecordKey("www.example.com", "AAAA")); !ok || name != "www.example.com." || rtype != "AAAA" {
+		t.Errorf("Expected the key to be parsed back, got %v %v %v", name, rtype, ok)
+	}
+}
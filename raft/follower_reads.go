@@ -0,0 +1,149 @@
+package raft
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+)
+
+/*
+Reads served by followers. With -follower-read-staleness <n> (or the follower_read_staleness
+setting), a follower serves the GET, range and prefix requests from its local store as long as its
+lastApplied is at most n entries behind the leader's commit index, as learned from the latest
+AppendEntries of the leader. Otherwise, e.g. while it catches up or once it lost contact with the
+leader for an election timeout, it forwards the request to the leader. These reads are not
+linearizable: a client may not see its latest writes, or may go back in time when switching
+replicas.
+
+Every read response carries the StalenessHeader, the number of committed entries the read may have
+missed: 0 on the leader, whose reads are linearizable.
+*/
+
+const (
+	StalenessHeader = "X-Raft-Staleness" // Entries the response may lag behind the leader's commit index
+	ForwardedHeader = "X-Raft-Forwarded" // Set on the reads forwarded to the leader, which doesn't forward them again
+)
+
+// How a replica serves a read, see readMode.
+const (
+	readLinearizable = iota // The leader confirms its leadership before reading, see readFromStore
+	readLocal               // A follower within the staleness bound reads its local store
+	readForward             // A follower beyond the staleness bound forwards the request to the leader
+	readRefused             // The replica isn't the leader, and follower reads are disabled or the leader is unknown
+)
+
+// Return how the replica serves the read request, and the staleness of a local read. Must be called
+// with the read lock held.
+func (node *RaftNode) readMode(r *http.Request) (int, int32) {
+
+	if node.state == Leader {
+		return readLinearizable, 0
+	}
+
+	bound := node.Meta.settings.Int64("follower_read_staleness", int64(node.Meta.Config.FollowerReadStaleness))
+
+	if node.state != Follower || node.Meta.leader_id < 0 || r.Header.Get(ForwardedHeader) != "" {
+		return readRefused, 0
+	}
+
+	// The reads refused by a leader dedicated to consensus are forwarded to it, see serving.go
+	if bound < 0 {
+		if node.consensusOnlyLeader() {
+			return readForward, 0
+		}
+		return readRefused, 0
+	}
+
+	staleness := node.Meta.leaderCommit - node.lastApplied
+	if staleness < 0 {
+		staleness = 0
+	}
+
+	// Witnesses hold no keys, and the commit index of a leader not heard from for an election
+	// timeout may be long outdated.
+	if node.isWitness() || int64(staleness) > bound || node.now().Sub(node.Meta.leaderContact) > node.Meta.Config.ElectionTimeoutMax {
+		return readForward, 0
+	}
+
+	return readLocal, staleness
+}
+
+// Set the staleness header of a read served by this replica.
+func setStaleness(w http.ResponseWriter, staleness int32) {
+	w.Header().Set(StalenessHeader, strconv.Itoa(int(staleness)))
+}
+
+// Read the given path from the local store for a follower read, counting it. Must be called with
+// the read lock held.
+func (node *RaftNode) readLocally(path string) (string, int, error) {
+
+	node.Meta.metrics.Add("follower_reads_total", 1, "mode", "local")
+	return node.fetchFromStore(path)
+}
+
+// Forward the read request to the leader, relaying its response. Must be called without the lock
+// held, as the leader may take a while to respond.
+func (node *RaftNode) forwardToLeader(w http.ResponseWriter, r *http.Request, leaderAddress string) {
+
+	node.Meta.metrics.Add("follower_reads_total", 1, "mode", "forwarded")
+
+	target := &url.URL{Scheme: "http", Host: "localhost" + leaderAddress}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	if node.Meta.Config.HTTPCertFile != "" {
+		target.Scheme = "https"
+		proxy.Transport = &http.Transport{TLSClientConfig: node.forwardTLSConfig()}
+	}
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(ForwardedHeader, strconv.Itoa(int(node.Meta.replica_id)))
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		node.logger().Warn().Err(err).Str("leader_address", leaderAddress).Msg("Unable to forward a read to the leader")
+		writeError(w, http.StatusBadGateway, "Error: unable to forward the read to the leader at %v: %v", leaderAddress, err)
+	}
+
+	// The leader sets its own headers.
+	w.Header().Del(LeaderHeader)
+	w.Header().Del(LeaderIdHeader)
+
+	proxy.ServeHTTP(w, r)
+}
+
+/*
+Return the TLS configuration of the reads forwarded to the leader over HTTPS. As the certificate of
+the client HTTP server needn't be valid for localhost, the leader is only trusted if it presents
+the certificate of this replica's own server, shared by the replicas (see -http-cert).
+*/
+func (node *RaftNode) forwardTLSConfig() *tls.Config {
+
+	return &tls.Config{
+		InsecureSkipVerify: true, // verified below
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+
+			contents, err := ioutil.ReadFile(node.Meta.Config.HTTPCertFile)
+			if err != nil {
+				return err
+			}
+
+			for block, rest := pem.Decode(contents); block != nil; block, rest = pem.Decode(rest) {
+				if len(rawCerts) > 0 && block.Type == "CERTIFICATE" && bytes.Equal(block.Bytes, rawCerts[0]) {
+					return nil
+				}
+			}
+
+			return errors.New("the leader doesn't present the certificate of the client HTTP server")
+		},
+	}
+}
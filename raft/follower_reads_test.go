@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A state machine answering the lookups with their query.
+type echoStateMachine struct {
+	localStateMachine
+}
+
+func (echoStateMachine) Lookup(query string) (string, int, error) {
+	return "local /" + query, http.StatusOK, nil
+}
+
+/*
+ * This test case checks that followers serve the reads within the staleness bound from their local
+ * store, and forward the others to the leader.
+ */
+func TestFollowerReads(t *testing.T) {
+
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "leader %v, forwarded by %v", r.URL.Path, r.Header.Get(ForwardedHeader))
+	}))
+	defer leader.Close()
+
+	clock := NewManualClock(time.Unix(0, 0))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig(), clock: clock}}
+	node.Meta.state_machine = echoStateMachine{}
+	node.Meta.leaderAddress = leader.URL[strings.LastIndex(leader.URL, ":"):]
+	node.Meta.replica_id, node.Meta.leader_id = 1, 0
+	node.Meta.leaderCommit, node.Meta.leaderContact = 10, clock.Now()
+	node.state, node.lastApplied = Follower, 7
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{key}", node.GetHandler)
+
+	get := func(header http.Header) (string, http.Header) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/a", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		r.ServeHTTP(w, req)
+		return w.Body.String(), w.Header()
+	}
+
+	if body, _ := get(nil); !strings.Contains(body, "Not a leader") {
+		t.Errorf("Expected the reads to be refused without a staleness bound, got %q", body)
+	}
+
+	node.Meta.Config.FollowerReadStaleness = 3
+
+	if body, header := get(nil); !strings.Contains(body, "Result: local /a") || header.Get(StalenessHeader) != "3" {
+		t.Errorf("Expected a local read 3 entries behind, got %q with staleness %q", body, header.Get(StalenessHeader))
+	}
+
+	node.Meta.leaderCommit = 11
+
+	if body, _ := get(nil); body != "leader /a, forwarded by 1" {
+		t.Errorf("Expected the read to be forwarded beyond the bound, got %q", body)
+	}
+
+	if body, _ := get(http.Header{ForwardedHeader: {"2"}}); !strings.Contains(body, "Not a leader") {
+		t.Errorf("Expected a forwarded read not to be forwarded again, got %q", body)
+	}
+
+	node.Meta.settings.values = map[string]string{"follower_read_staleness": "5"}
+
+	if mode, staleness := node.readMode(httptest.NewRequest("GET", "/a", nil)); mode != readLocal || staleness != 4 {
+		t.Errorf("Expected the setting to override the bound, got mode %v and staleness %v", mode, staleness)
+	}
+
+	clock.Advance(node.Meta.Config.ElectionTimeoutMax + time.Millisecond)
+
+	if mode, _ := node.readMode(httptest.NewRequest("GET", "/a", nil)); mode != readForward {
+		t.Errorf("Expected the reads to be forwarded once the leader isn't heard from, got mode %v", mode)
+	}
+
+	node.state = Leader
+
+	if mode, staleness := node.readMode(httptest.NewRequest("GET", "/a", nil)); mode != readLinearizable || staleness != 0 {
+		t.Errorf("Expected the leader to read linearizably, got mode %v and staleness %v", mode, staleness)
+	}
+}
@@ -0,0 +1,304 @@
+package raft
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Geo-aware DNS answers. The A and AAAA records of a name can be annotated with the regions they
+serve ("regions": ["eu-west"], see zone.Record), and the DNS listeners then answer each resolver with
+the records meant for its region. The resolvers are located by the networks of the "geo" section of
+the DNS config, and by those of the CSV file it names, of "<network>,<region>" lines (as exported from
+a GeoIP database, a header line being ignored):
+
+	{"dns": {"geo": {
+		"file": "geoip.csv",
+		"regions": [
+			{"name": "eu-west", "networks": ["192.0.2.0/24"], "fallback": ["eu-central", "us-east"]},
+			{"name": "us-east", "networks": ["198.51.100.0/24", "2001:db8::/32"]}
+		],
+		"default": ["us-east"]
+	}, ...}}
+
+A resolver is located by the client subnet it forwards (RFC 7871, unless ignored, see edns.go), or
+else by its own address, the most specific network applying. An RRset whose records have regions is
+answered with the records of the first region served among that of the resolver then its fallback
+regions, in order (the default regions for the resolvers outside every network); failing that, with
+its records without regions, and failing that, with all its records. The other RRsets are answered
+unchanged. The client subnet option is echoed in the answers, with the prefix length of the network
+that applied as its scope if the answer depends on it.
+
+The answers chosen by region are counted in dns_geo_answers_total{view, region}, the region being
+"none" for the records without regions.
+*/
+
+// The regions of the DNS resolvers, in the config file.
+type DNSGeo struct {
+	File    string      `json:"file"`    // CSV file of "<network>,<region>" lines
+	Regions []DNSRegion `json:"regions"` // Regions and their networks, adding to those of the file
+	Default []string    `json:"default"` // Regions tried, in order, for the resolvers outside every network
+}
+
+type DNSRegion struct {
+	Name     string   `json:"name"`
+	Networks []string `json:"networks"` // Networks of the region, e.g. "192.0.2.0/24"
+	Fallback []string `json:"fallback"` // Regions tried next, in order, when no record serves the region
+}
+
+// Whether the answers depend on the regions of the resolvers.
+func (g DNSGeo) enabled() bool {
+	return g.File != "" || len(g.Regions) > 0
+}
+
+func (g DNSGeo) validate() error {
+
+	for _, r := range g.Regions {
+
+		if r.Name == "" {
+			return fmt.Errorf("dns: geo: regions must have a name")
+		}
+
+		for _, network := range r.Networks {
+			if _, _, err := net.ParseCIDR(network); err != nil {
+				return fmt.Errorf("dns: geo: region %v: invalid network %q", r.Name, network)
+			}
+		}
+	}
+
+	return nil
+}
+
+// A network located in a region.
+type geoNetwork struct {
+	region string
+	ones   int // Prefix length of the network, within its address family
+}
+
+// The networks located in regions, and the fallback regions.
+type geoTable struct {
+	networks map[int]map[string]geoNetwork // By prefix length in the 16 byte form, and masked address
+	lengths  []int                         // Prefix lengths of the networks, longest first
+	fallback map[string][]string
+	defaults []string
+}
+
+// Build the table of the regions, reading the networks of the file.
+func loadGeoTable(g DNSGeo) (*geoTable, error) {
+
+	t := &geoTable{networks: make(map[int]map[string]geoNetwork), fallback: make(map[string][]string), defaults: g.Default}
+
+	for _, r := range g.Regions {
+
+		t.fallback[r.Name] = r.Fallback
+
+		for _, network := range r.Networks {
+			if err := t.add(network, r.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if g.File == "" {
+		return t, nil
+	}
+
+	file, err := os.Open(g.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := csv.NewReader(file)
+	lines.FieldsPerRecord = -1
+
+	for line := 1; ; line++ {
+
+		fields, err := lines.Read()
+		if err == io.EOF {
+			return t, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", g.File, err)
+		}
+
+		if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("%v: line %v: expected <network>,<region>", g.File, line)
+		}
+
+		if err := t.add(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])); err != nil && line > 1 {
+			return nil, fmt.Errorf("%v: line %v: %v", g.File, line, err)
+		}
+	}
+}
+
+// Add the network of the region. Among identical networks, the first one added applies.
+func (t *geoTable) add(network, region string) error {
+
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		return fmt.Errorf("invalid network %q", network)
+	}
+
+	ones, _ := n.Mask.Size()
+	length := ones
+	if n.IP.To4() != nil {
+		length += 96
+	}
+
+	if t.networks[length] == nil {
+		t.networks[length] = make(map[string]geoNetwork)
+
+		i := 0
+		for i < len(t.lengths) && t.lengths[i] > length {
+			i++
+		}
+		t.lengths = append(t.lengths[:i], append([]int{length}, t.lengths[i:]...)...)
+	}
+
+	key := string(n.IP.To16())
+	if _, ok := t.networks[length][key]; !ok {
+		t.networks[length][key] = geoNetwork{region: region, ones: ones}
+	}
+
+	return nil
+}
+
+// Return the most specific network containing the address, if any.
+func (t *geoTable) locate(ip net.IP) (geoNetwork, bool) {
+
+	ip = ip.To16()
+	if ip == nil {
+		return geoNetwork{}, false
+	}
+
+	for _, length := range t.lengths {
+		if n, ok := t.networks[length][string(ip.Mask(net.CIDRMask(length, 128)))]; ok {
+			return n, true
+		}
+	}
+
+	return geoNetwork{}, false
+}
+
+// The resolver of a query, as located by the geo table.
+type geoClient struct {
+	regions []string          // Regions whose records are preferred, in order
+	scope   int               // Prefix length of the network that located the resolver, 0 if none did
+	subnet  *dns.EDNS0_SUBNET // Client subnet forwarded by the resolver, if any
+	chosen  bool              // Whether an answer was chosen by region
+}
+
+// Locate the resolver of the query. Return nil if the answers don't depend on the regions.
+func (node *RaftNode) locateClient(w dns.ResponseWriter, req *dns.Msg) *geoClient {
+
+	t := node.geo
+	if t == nil {
+		return nil
+	}
+
+	client := &geoClient{regions: t.defaults}
+
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(w.RemoteAddr().String()); err == nil {
+		ip = net.ParseIP(host)
+	}
+
+	// The client subnet is left out in the ignore mode, see edns.go
+	if subnet := node.Meta.Config.DNS.EDNS.subnet(req); subnet != nil {
+
+		client.subnet = subnet
+
+		// A source prefix of 0 asks not to use the address of the client (RFC 7871 section 7.1.2).
+		if subnet.SourceNetmask > 0 {
+			ip = subnet.Address
+		}
+	}
+
+	if n, ok := t.locate(ip); ok {
+		client.regions = append([]string{n.region}, t.fallback[n.region]...)
+		client.scope = n.ones
+	}
+
+	return client
+}
+
+// Return the records of the RRset meant for the resolver, and the region they serve ("none" for the
+// records without regions, "" if the RRset has no regions).
+func (client *geoClient) choose(records []zone.Record) ([]zone.Record, string) {
+
+	regional := false
+	for _, r := range records {
+		regional = regional || len(r.Regions) > 0
+	}
+
+	if !regional {
+		return records, ""
+	}
+
+	client.chosen = true
+
+	serving := func(region string) []zone.Record {
+
+		var chosen []zone.Record
+		for _, r := range records {
+
+			if region == "" && len(r.Regions) == 0 {
+				chosen = append(chosen, r)
+			}
+
+			for _, served := range r.Regions {
+				if served == region && region != "" {
+					chosen = append(chosen, r)
+					break
+				}
+			}
+		}
+
+		return chosen
+	}
+
+	for _, region := range client.regions {
+		if chosen := serving(region); len(chosen) > 0 {
+			return chosen, region
+		}
+	}
+
+	if chosen := serving(""); len(chosen) > 0 {
+		return chosen, "none"
+	}
+
+	return records, "none"
+}
+
+// Echo the client subnet forwarded by the resolver in the answer, with the scope the answer applies to.
+func (client *geoClient) echo(resp *dns.Msg, req *dns.Msg) {
+
+	if client == nil || client.subnet == nil {
+		return
+	}
+
+	if resp.IsEdns0() == nil {
+		resp.SetEdns0(req.IsEdns0().UDPSize(), req.IsEdns0().Do())
+	}
+
+	subnet := *client.subnet
+	subnet.SourceScope = 0
+
+	if client.chosen {
+		subnet.SourceScope = uint8(client.scope)
+		if client.scope > int(subnet.SourceNetmask) {
+			subnet.SourceScope = subnet.SourceNetmask
+		}
+	}
+
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &subnet)
+}
@@ -0,0 +1,161 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+// A recorded DNS exchange with a resolver at the given address.
+type resolverDNS struct {
+	recordedDNS
+	addr net.Addr
+}
+
+func (w *resolverDNS) RemoteAddr() net.Addr {
+	return w.addr
+}
+
+/*
+ * This test case checks the location of the resolvers by the most specific
+ * network of the config or of the CSV file, the choice of the records of the
+ * region of the resolver, of its fallback regions or without regions, and the
+ * client subnet echoed with the scope of the network that applied.
+ */
+func TestGeoAnswers(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "geo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "geoip.csv")
+	ioutil.WriteFile(file, []byte("network,region\n203.0.113.0/24,ap-south\n2001:db8:1::/48,eu-west\n"), 0644)
+
+	geo := DNSGeo{
+		File: file,
+		Regions: []DNSRegion{
+			{Name: "eu-west", Networks: []string{"192.0.2.0/24"}, Fallback: []string{"us-east"}},
+			{Name: "us-east", Networks: []string{"192.0.0.0/16", "2001:db8::/32"}},
+			{Name: "sa-east", Networks: []string{"198.51.100.0/24"}},
+		},
+		Default: []string{"us-east"},
+	}
+
+	if err := (&DNSConfig{Geo: DNSGeo{Regions: []DNSRegion{{Name: "eu", Networks: []string{"192.0.2.0"}}}}}).Validate(); err == nil {
+		t.Errorf("Expected the invalid network to be refused")
+	}
+
+	table, err := loadGeoTable(geo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, region := range map[string]string{"192.0.2.7": "eu-west", "192.0.3.1": "us-east", "2001:db8:1::1": "eu-west", "2001:db8:2::1": "us-east", "203.0.113.9": "ap-south", "10.0.0.1": ""} {
+		if n, _ := table.locate(net.ParseIP(ip)); n.region != region {
+			t.Errorf("Expected %v to be located in %q, got %q", ip, region, n.region)
+		}
+	}
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	r := mux.NewRouter().SkipClean(true)
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler)
+	store := httptest.NewServer(r)
+	defer store.Close()
+
+	put := func(name, rtype string, records ...zone.Record) {
+		encoded, _ := json.Marshal(records)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put("www.example.com.", "A",
+		zone.Record{Name: "www.example.com.", Type: "A", TTL: 60, Data: "10.1.0.1", Regions: []string{"eu-west"}},
+		zone.Record{Name: "www.example.com.", Type: "A", TTL: 60, Data: "10.2.0.1", Regions: []string{"us-east", "ap-south"}},
+		zone.Record{Name: "www.example.com.", Type: "A", TTL: 60, Data: "10.3.0.1"})
+	put("api.example.com.", "A",
+		zone.Record{Name: "api.example.com.", Type: "A", TTL: 60, Data: "10.1.0.2", Regions: []string{"eu-west"}})
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.geo = table
+
+	handler := node.dnsHandler(DNSView{Name: "external"}, newRawUpdates())
+
+	query := func(resolver, name string, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		if subnet != nil {
+			req.SetEdns0(4096, false)
+			req.IsEdns0().Option = append(req.IsEdns0().Option, subnet)
+		}
+
+		w := &resolverDNS{addr: &net.TCPAddr{IP: net.ParseIP(resolver), Port: 53}}
+		handler.ServeDNS(w, req)
+		return w.msg
+	}
+
+	answer := func(resp *dns.Msg) string {
+
+		var addresses []string
+		for _, rr := range resp.Answer {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+
+		sort.Strings(addresses)
+		return strings.Join(addresses, ",")
+	}
+
+	cases := []struct {
+		resolver, name, answer string
+	}{
+		{"192.0.2.7", "www.example.com.", "10.1.0.1"},
+		{"192.0.99.1", "www.example.com.", "10.2.0.1"},
+		{"203.0.113.9", "www.example.com.", "10.2.0.1"},
+		{"198.51.100.1", "www.example.com.", "10.3.0.1"}, // No record for sa-east, nor fallback
+		{"10.0.0.1", "www.example.com.", "10.2.0.1"},     // Outside every network, the default region
+		{"198.51.100.1", "api.example.com.", "10.1.0.2"}, // No record for the region nor without regions
+	}
+
+	for _, c := range cases {
+		if resp := query(c.resolver, c.name, nil); answer(resp) != c.answer {
+			t.Errorf("Expected %v to be answered %v for %v, got %v", c.name, c.answer, c.resolver, resp)
+		}
+	}
+
+	// The client subnet forwarded by the resolver locates the client.
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()}
+
+	resp := query("198.51.100.1", "www.example.com.", subnet)
+	if answer(resp) != "10.1.0.1" {
+		t.Errorf("Expected the client subnet to locate the client in eu-west, got %v", resp)
+	}
+
+	if opt := resp.IsEdns0(); opt == nil || len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_SUBNET).SourceScope != 24 {
+		t.Errorf("Expected the client subnet to be echoed with a scope of 24, got %v", resp)
+	}
+
+	if got := node.Meta.metrics.Get("dns_geo_answers_total", "view", "external", "region", "eu-west"); got != 2 {
+		t.Errorf("Expected 2 answers chosen for eu-west, got %v", got)
+	}
+
+	if diagnostics := zone.Validate("example.com", []zone.Record{{Name: "example.com.", Type: "TXT", TTL: 60, Data: `"x"`, Regions: []string{"eu-west"}}}); len(diagnostics) != 1 || diagnostics[0].Code != "regions" {
+		t.Errorf("Expected only the A and AAAA records to have regions, got %v", diagnostics)
+	}
+}
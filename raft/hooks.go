@@ -0,0 +1,51 @@
+package raft
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Hooks run as the committed entries are applied, maintaining data derived from the keys (e.g. an
+index of the DNS names, secondary indexes or counters) in the local key-value store, within the same
+update as the write they derive from, see kv_store/hooks.go. They are registered with
+RegisterApplyHook by the program embedding the replicas, before starting them (see Setup_raft_node),
+and every replica of the cluster must register the same hooks: the derived keys are then identical on
+every replica, as checked by the digests (see kv_store/digest.go).
+
+The Derived prefix of a hook is reserved like those of the settings: the clients can read the derived
+keys, but not write them, nor delete a prefix overlapping them.
+*/
+
+var applyHooks []kv_store.Hook // Hooks registered on the stores of the replicas started afterwards
+
+// Register the hook on the local key-value stores of the replicas started afterwards. Not safe to call
+// concurrently with starting a replica.
+func RegisterApplyHook(hook kv_store.Hook) error {
+
+	if hook.Name == "" || hook.Apply == nil {
+		return fmt.Errorf("apply hooks must have a name and an Apply function")
+	}
+
+	if hook.Derived == "" {
+		return fmt.Errorf("apply hook %v: the prefix of the derived keys can't be empty", hook.Name)
+	}
+
+	// The hooks aren't called with the changes of the derived keys, see kv_store/hooks.go
+	if strings.HasPrefix(hook.Prefix, hook.Derived) {
+		return fmt.Errorf("apply hook %v: the keys passed to the hook can't be derived by it", hook.Name)
+	}
+
+	for _, reserved := range reservedPrefixes {
+		if strings.HasPrefix(hook.Derived, reserved) || strings.HasPrefix(reserved, hook.Derived) {
+			return fmt.Errorf("apply hook %v: the derived keys overlap the reserved prefix %q", hook.Name, reserved)
+		}
+	}
+
+	applyHooks = append(applyHooks, hook)
+	reservedPrefixes = append(reservedPrefixes, hook.Derived)
+
+	return nil
+}
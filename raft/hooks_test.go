@@ -0,0 +1,40 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+ * This test case checks that the apply hooks are refused unless their derived
+ * keys are apart from the keys they are passed and from the reserved keys,
+ * and that the derived keys of a registered hook are reserved.
+ */
+func TestRegisterApplyHook(t *testing.T) {
+
+	hooks, reserved := applyHooks, reservedPrefixes
+	defer func() { applyHooks, reservedPrefixes = hooks, reserved }()
+
+	apply := func(view kv_store.View, events []kv_store.Event) []kv_store.Op { return nil }
+
+	for _, hook := range []kv_store.Hook{
+		{Name: "empty", Apply: apply},
+		{Name: "recursive", Prefix: "index:a", Derived: "index:", Apply: apply},
+		{Name: "settings", Derived: SettingsPrefix + "index:", Apply: apply},
+		{Name: "overlapping", Derived: "_", Apply: apply},
+		{Derived: "index:", Apply: apply},
+	} {
+		if err := RegisterApplyHook(hook); err == nil {
+			t.Errorf("Expected the hook %+v to be refused", hook)
+		}
+	}
+
+	if err := RegisterApplyHook(kv_store.Hook{Name: "names", Prefix: "dns:", Derived: "index:", Apply: apply}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reservedKey("index:www") || reservedKey("dns:www") || len(applyHooks) != len(hooks)+1 {
+		t.Errorf("Expected the derived keys to be reserved")
+	}
+}
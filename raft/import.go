@@ -0,0 +1,282 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Bulk imports of keys, e.g. of an export of another cluster (see export.go). POST /admin/import takes
+the key-value pairs in the body, in one of the bulk formats (the format form value, json by
+default), and writes them through the log on the leader, as transactions of importBatch pairs at
+most. A pair puts its key, creating it if it doesn't exist; the keys of the reserved namespaces are
+refused, as are those the caller may not write.
+
+The bodies being bounded (see middleware.go), large imports are uploaded in chunks: each request
+names the upload (the upload form value, chosen by the client) and the offset of its first pair
+among those of the upload. The pairs imported by an upload are counted under ImportsPrefix, by the
+transactions writing them: a chunk interrupted (e.g. by a change of leader) is sent again from the
+same offset, and its pairs imported already are skipped, so that the upload resumes without
+importing a pair twice. A chunk starting after the pairs imported is refused with 409, as is a chunk
+racing with another one of the same upload. The endpoints:
+
+	POST   /admin/import?upload=<id>&offset=<n>  imports a chunk, returning the pairs imported by the
+	                                             upload and by the chunk
+	GET    /admin/import?upload=<id>             returns the pairs imported by the upload, from which
+	                                             to resume it
+	DELETE /admin/import?upload=<id>             forgets the upload, once complete
+
+The pairs imported are counted in imported_keys_total.
+*/
+
+const (
+	ImportsPrefix = "_imports:" // Keys holding the pairs imported by each upload
+
+	importBatch  = 1000     // Pairs written by a transaction at most
+	importClient = "import" // Client of the transactions of the imports
+)
+
+// The progress of an import.
+type ImportStatus struct {
+	Upload   string `json:"upload,omitempty"`
+	Records  int64  `json:"records"`            // Pairs imported by the upload, or by the request without one
+	Imported int64  `json:"imported,omitempty"` // Pairs imported by the request
+}
+
+// Return the upload named by the request, "" if none is, and whether its name is valid.
+func importUpload(r *http.Request) (string, bool) {
+
+	upload := r.URL.Query().Get("upload")
+	return upload, upload == "" || userNamePattern.MatchString(upload)
+}
+
+// Return the pairs imported by the upload. Must be called on the leader, with the read lock held.
+func (node *RaftNode) importedRecords(upload string) (int64, error) {
+
+	contents, code, err := node.readFromStore(url.PathEscape(ImportsPrefix + upload))
+	if err != nil {
+		return 0, err
+	}
+
+	if code != http.StatusOK || !strings.HasPrefix(contents, "Value = ") {
+		return 0, nil
+	}
+
+	records, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(contents, "Value = ")), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid progress of upload %v: %q", upload, contents)
+	}
+
+	return records, nil
+}
+
+/*
+Replicate the transaction putting the pairs, along with the progress of the upload (if any) from the
+pairs imported before to after them, failing if another request of the upload changed it meanwhile.
+*/
+func (node *RaftNode) importRecords(ctx context.Context, upload string, before int64, ops []kv_store.Op) error {
+
+	txn := kv_store.Txn{Success: ops}
+
+	if err := node.checkTxn(ctx, txn, importClient); err != nil {
+		return err
+	}
+
+	if upload != "" {
+
+		key := ImportsPrefix + upload
+
+		if before == 0 {
+			txn.Compare = []kv_store.Compare{{Key: key, Condition: kv_store.CompareNotExists}}
+		} else {
+			txn.Compare = []kv_store.Compare{{Key: key, Condition: kv_store.CompareValueEqual, Value: strconv.FormatInt(before, 10)}}
+		}
+
+		txn.Success = append(txn.Success, kv_store.Op{Type: kv_store.OpPut, Key: key, Value: strconv.FormatInt(before+int64(len(ops)), 10)})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	result, err := node.proposeTxn(ctx, txn, importClient, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if !result.Succeeded {
+		return status.Errorf(codes.FailedPrecondition, "upload %v was changed by another request", upload)
+	}
+
+	node.Meta.metrics.Add("imported_keys_total", float64(len(ops)))
+
+	return nil
+}
+
+// Handle the requests importing a chunk of pairs, see the imports above.
+func (node *RaftNode) ImportHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("IMPORT request received")
+
+	// The body holds the pairs, so the form values are read from the URL only.
+	query := r.URL.Query()
+
+	format, _ := bulkFormat(query.Get("format"))
+	if format == "" {
+		writeError(w, http.StatusBadRequest, "Invalid format %q, expected json or protobuf", query.Get("format"))
+		return
+	}
+
+	upload, ok := importUpload(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid upload name: %q", upload)
+		return
+	}
+
+	var offset int64
+	if value := query.Get("offset"); value != "" {
+
+		var err error
+		if offset, err = strconv.ParseInt(value, 10, 64); err != nil || offset < 0 || (upload == "" && offset != 0) {
+			writeError(w, http.StatusBadRequest, "Invalid offset %q, expected a non-negative number along with an upload", value)
+			return
+		}
+	}
+
+	node.GetRLock("Import Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Import Handler")
+		return
+	}
+
+	records := offset
+	if upload != "" {
+
+		var err error
+		if records, err = node.importedRecords(upload); err != nil {
+			node.ReleaseRLock("Import Handler")
+			writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+			return
+		}
+	}
+
+	node.ReleaseRLock("Import Handler")
+
+	if offset > records {
+		writeError(w, http.StatusConflict, "Error: Upload %v imported %v records so far, expected a chunk starting at that offset", upload, records)
+		return
+	}
+
+	reader := bufio.NewReader(r.Body)
+	position, imported := offset, int64(0)
+	var ops []kv_store.Op
+
+	failed := func(code int, err error) {
+		node.logger().Warn().Err(err).Str("upload", upload).Int64("records", records).Msg("Import failed")
+		writeError(w, code, "Error: %v\n\nRecords imported by the upload: %v", err, records)
+	}
+
+	flush := func() bool {
+
+		if len(ops) == 0 {
+			return true
+		}
+
+		if err := node.importRecords(r.Context(), upload, records, ops); err != nil {
+			failed(httpStatus(err), errors.New(status.Convert(err).Message()))
+			return false
+		}
+
+		records += int64(len(ops))
+		imported += int64(len(ops))
+		ops = ops[:0]
+
+		return true
+	}
+
+	for {
+
+		kv, err := readBulkRecord(reader, format)
+		if err == io.EOF {
+			break
+		}
+
+		// The pairs before the failure are imported still, so that the upload can resume after them.
+		if err != nil {
+			if flush() {
+				failed(http.StatusBadRequest, fmt.Errorf("record %v: %v", position, err))
+			}
+			return
+		}
+
+		// Imported already by an interrupted request.
+		if position++; position <= records {
+			continue
+		}
+
+		if ops = append(ops, kv_store.Op{Type: kv_store.OpPut, Key: kv.Key, Value: kv.Value}); len(ops) == importBatch && !flush() {
+			return
+		}
+	}
+
+	if !flush() {
+		return
+	}
+
+	node.logger().Info().Str("upload", upload).Int64("records", records).Int64("imported", imported).Str("format", format).Msg("IMPORT request completed successfully and committed")
+
+	writeJSON(w, http.StatusOK, ImportStatus{Upload: upload, Records: records, Imported: imported})
+}
+
+// Handle the requests returning the progress of an upload (GET), or forgetting it (DELETE).
+func (node *RaftNode) ImportStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	upload, ok := importUpload(r)
+	if !ok || upload == "" {
+		writeError(w, http.StatusBadRequest, "Invalid upload name: %q", upload)
+		return
+	}
+
+	node.GetRLock("Import Status Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Import Status Handler")
+		return
+	}
+
+	records, err := node.importedRecords(upload)
+	node.ReleaseRLock("Import Status Handler")
+
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+
+		// The progress is reserved, so the transaction isn't checked as those of the clients.
+		txn := kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: ImportsPrefix + upload}}}
+
+		if _, err := node.proposeTxn(r.Context(), txn, importClient, 0, 0); err != nil {
+			writeError(w, httpStatus(err), "Error: %v", status.Convert(err).Message())
+			return
+		}
+
+		node.logger().Info().Str("upload", upload).Int64("records", records).Msg("Upload forgotten")
+	}
+
+	writeJSON(w, http.StatusOK, ImportStatus{Upload: upload, Records: records})
+}
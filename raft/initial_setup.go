@@ -2,37 +2,38 @@ package raft
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
 
-	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
 )
 
-// Start the local key-value store and the HTTP server it listens for requests on.
-func (node *RaftNode) StartKVStore(ctx context.Context, addr string, num int, testing bool) {
+// Open the local key-value store of the replica with the backend of its configuration, as its state
+// machine (see state_machine.go).
+func (node *RaftNode) OpenKVStore(num int) {
 
-	filename := "600" + strconv.Itoa(num)
+	filename := node.Meta.Config.Layout.StoreFile(num)
 
-	// InitializeStore is defined in kv_store/restaccess_key_value.go
-	kv := kv_store.InitializeStore(filename)
+	sm, err := openStateMachine(node.Meta.Config.StoreBackend, filename)
+	CheckErrorFatal(err)
+
+	node.Meta.state_machine = sm
+}
 
-	r := mux.NewRouter()
+// Start the HTTP server the local key-value store listens for requests on, closing the store once
+// the context is cancelled.
+func (node *RaftNode) StartKVStore(ctx context.Context, addr string, testing bool) {
 
-	r.HandleFunc("/kvstore", kv.KvstoreHandler).Methods("GET")
-	r.HandleFunc("/{key}", kv.PostHandler).Methods("POST")
-	r.HandleFunc("/{key}", kv.GetHandler).Methods("GET")
-	r.HandleFunc("/{key}", kv.PutHandler).Methods("PUT")
-	r.HandleFunc("/{key}", kv.DeleteHandler).Methods("DELETE")
+	// The routes of the store are defined in kv_store/restaccess_key_value.go
+	r := node.Meta.state_machine.Router()
 
 	// Create a server struct
 	srv := &http.Server{
@@ -56,11 +57,15 @@ func (node *RaftNode) StartKVStore(ctx context.Context, addr string, num int, te
 
 		if err_kv := node.Meta.kv_store_server.Shutdown(ctx); err_kv != nil {
 
-			log.Printf("HTTP server Shutdown error: %v\n", err_kv)
+			node.logger().Error().Err(err_kv).Msg("Key-value store HTTP server Shutdown error")
 			node.Meta.kv_store_server.Close()
 
 		}
 
+		if err := node.Meta.state_machine.Close(); err != nil {
+			node.logger().Error().Err(err).Msg("Unable to close the key-value store")
+		}
+
 	}()
 
 	err := node.Meta.kv_store_server.ListenAndServe()
@@ -76,23 +81,97 @@ func (node *RaftNode) StartKVStore(ctx context.Context, addr string, num int, te
 
 }
 
-// HTTP server to listen for client requests
-func (node *RaftNode) StartRaftServer(ctx context.Context, addr string, testing bool) {
+// Return the router of the client HTTP server. Every route is described in apiOperations (see
+// openapi.go).
+func (node *RaftNode) routes() *mux.Router {
 
-	node.Meta.nodeAddress = addr // store address of the node
+	r := mux.NewRouter().SkipClean(true) // prefixes may end with a '/'
 
-	r := mux.NewRouter()
+	// The middleware is defined in middleware.go, tracingMiddleware in tracing.go, rateLimitMiddleware
+	// in ratelimit.go, sheddingMiddleware in shedding.go, authMiddleware in users.go (with the ACLs of acl.go), originMiddleware in authz.go
+	// servingMiddleware in serving.go and shardMiddleware in shards.go
+	r.Use(node.tracingMiddleware, node.deadlineMiddleware, node.rateLimitMiddleware, node.sheddingMiddleware, node.bodyLimitMiddleware, node.authMiddleware, node.originMiddleware, node.servingMiddleware, node.shardMiddleware, node.leaderHeaderMiddleware)
 
 	r.HandleFunc("/test", node.TestHandler).Methods("GET")
-	r.HandleFunc("/{key}", node.PostHandler).Methods("POST")
-	r.HandleFunc("/{key}", node.GetHandler).Methods("GET")
-	r.HandleFunc("/{key}", node.PutHandler).Methods("PUT")
-	r.HandleFunc("/{key}", node.DeleteHandler).Methods("DELETE")
+	r.HandleFunc("/healthz", node.HealthHandler).Methods("GET") // probes, see probes.go
+	r.HandleFunc("/readyz", node.ReadinessHandler).Methods("GET")
+	r.HandleFunc("/openapi.json", node.OpenAPIHandler).Methods("GET") // description of the routes below, see openapi.go
+	r.Handle("/range", node.readRoute(node.RangeHandler)).Methods("GET")
+	r.Handle("/audit", node.readRoute(node.AuditHandler)).Methods("GET") // audit history of a key, see audit.go
+	r.Handle("/prefix/{prefix:.*}", node.readRoute(node.PrefixHandler)).Methods("GET")
+	r.Handle("/admin/compact", node.writeRoute(node.CompactHandler)).Methods("POST")
+	r.Handle("/admin/sessions", node.writeRoute(node.RegisterSessionHandler)).Methods("POST")
+	r.Handle("/admin/barrier", node.writeRoute(node.BarrierHandler)).Methods("POST")
+	r.HandleFunc("/admin/shards", node.ShardsHandler).Methods("GET")
+	r.Handle("/admin/shards/split", node.writeRoute(node.SplitShardHandler)).Methods("POST")
+	r.Handle("/admin/shards/merge", node.writeRoute(node.MergeShardHandler)).Methods("POST")
+	r.Handle("/admin/metrics", node.Meta.metrics).Methods("GET")
+	r.HandleFunc("/admin/status", node.StatusHandler).Methods("GET")
+	r.HandleFunc("/admin/diagnostics", node.DiagnosticsHandler).Methods("GET")
+	r.HandleFunc("/admin/members", node.MembersHandler).Methods("GET")
+	r.HandleFunc("/admin/leader", node.LeaderHandler).Methods("GET") // streamed with watch=true, so without a timeout
+	r.HandleFunc("/admin/rejections", node.RejectionsHandler).Methods("GET")
+	r.HandleFunc("/admin/query-stats", node.QueryStatsHandler).Methods("GET") // statistics of the DNS queries, see querylog.go
+	r.HandleFunc("/admin/alarms", node.AlarmsHandler).Methods("GET")
+	r.Handle("/admin/alarms", node.writeRoute(node.DisarmAlarmsHandler)).Methods("DELETE")
+	r.Handle("/admin/members", node.writeRoute(node.AddMemberHandler)).Methods("POST")
+	r.Handle("/admin/members/{id}", node.writeRoute(node.UpdateMemberHandler)).Methods("PUT")
+	r.Handle("/admin/members/{id}", node.writeRoute(node.RemoveMemberHandler)).Methods("DELETE")
+	r.Handle("/admin/members/{id}/decommission", node.writeRoute(node.DecommissionHandler)).Methods("POST", "DELETE") // see decommission.go
+	r.Handle("/admin/shutdown", node.writeRoute(node.ShutdownHandler)).Methods("POST")
+	r.HandleFunc("/admin/snapshot", node.SnapshotHandler).Methods("GET") // streamed at a throttled rate, see throttle.go
+	r.HandleFunc("/admin/backup", node.BackupHandler).Methods("GET")     // likewise
+	r.HandleFunc("/admin/export", node.ExportHandler).Methods("GET")     // likewise, see export.go
+	r.HandleFunc("/admin/import", node.ImportHandler).Methods("POST")    // several transactions, each with its own timeout, see import.go
+	r.Handle("/admin/import", node.writeRoute(node.ImportStatusHandler)).Methods("GET", "DELETE")
+	r.Handle("/admin/backups", node.readRoute(node.BackupsHandler)).Methods("GET") // scheduled backups, see backup_schedule.go
+	r.Handle("/admin/digest", node.readRoute(node.DigestHandler)).Methods("GET")
+	r.Handle("/admin/transfer-leader", node.writeRoute(node.TransferLeaderHandler)).Methods("POST")
+	r.HandleFunc("/admin/settings", node.SettingsHandler).Methods("GET")
+	r.Handle("/admin/settings/history", node.readRoute(node.SettingsHistoryHandler)).Methods("GET")
+	r.Handle("/admin/settings/{name}", node.writeRoute(node.SetSettingHandler)).Methods("PUT", "DELETE")
+	node.registerClockRoutes(r) // only with the testclock build tag, see clock.go
+	r.HandleFunc("/admin/users", node.UsersHandler).Methods("GET")
+	r.Handle("/admin/users/{name}", node.writeRoute(node.SetUserHandler)).Methods("PUT", "DELETE")
+	r.HandleFunc("/admin/roles", node.RolesHandler).Methods("GET")
+	r.Handle("/admin/roles/{name}", node.writeRoute(node.SetRoleHandler)).Methods("PUT", "DELETE")
+	r.HandleFunc("/admin/tsig-keys", node.TSIGKeysHandler).Methods("GET")
+	r.Handle("/admin/tsig-keys/{name}", node.writeRoute(node.SetTSIGKeyHandler)).Methods("PUT", "DELETE")
+	r.Handle("/admin/tsig-keys/{name}/rotate", node.writeRoute(node.RotateTSIGKeyHandler)).Methods("POST")
+	r.HandleFunc("/admin/webhooks", node.WebhooksHandler).Methods("GET")
+	r.Handle("/admin/webhooks/{name}", node.writeRoute(node.SetWebhookHandler)).Methods("PUT", "DELETE")
+	r.Handle("/zones/{zone}/validate", node.readRoute(node.ValidateZoneHandler)).Methods("POST")
+	r.Handle("/zones/{zone}/diff", node.readRoute(node.ZoneDiffHandler)).Methods("GET")
+	r.Handle("/zones/{zone}/history", node.readRoute(node.ZoneHistoryHandler)).Methods("GET")
+	r.Handle("/zones/{zone}/policies", node.readRoute(node.PoliciesHandler)).Methods("GET")
+	r.Handle("/zones/{zone}/policies/{name}/{type}", node.writeRoute(node.SetPolicyHandler)).Methods("PUT", "DELETE")
+	r.Handle("/batch", node.writeRoute(node.BatchHandler)).Methods("POST")
+	r.Handle("/kvstore", node.writeRoute(node.DeletePrefixHandler)).Methods("DELETE")
+	r.HandleFunc("/locks", node.LocksHandler).Methods("GET")
+	r.Handle("/locks/{name}", node.writeRoute(node.LockHandler)).Methods("POST", "DELETE")
+	r.Handle("/locks/{name}/validate", node.readRoute(node.ValidateLockHandler)).Methods("GET")
+	r.Handle("/commit-status/{index}", node.readRoute(node.CommitStatusHandler)).Methods("GET")
+	r.Handle("/{key}", node.writeRoute(node.PostHandler)).Methods("POST")
+	r.Handle("/{key}", node.readRoute(node.GetHandler)).Methods("GET")
+	r.Handle("/{key}", node.writeRoute(node.PutHandler)).Methods("PUT")
+	r.Handle("/{key}", node.writeRoute(node.DeleteHandler)).Methods("DELETE")
+
+	return r
+}
+
+// HTTP server to listen for client requests, on the given listener if not nil (see portmux.go).
+func (node *RaftNode) StartRaftServer(ctx context.Context, addr string, listener net.Listener, testing bool) {
+
+	node.Meta.nodeAddress = addr // store address of the node
+
+	r := node.routes()
 
 	// Create a server struct
 	raft_server := &http.Server{
-		Handler: r,
-		Addr:    addr,
+		Handler:           r,
+		Addr:              addr,
+		ReadHeaderTimeout: node.Meta.Config.ReadHeaderTimeout,
+		ReadTimeout:       node.Meta.Config.ReadTimeout,
 	}
 
 	raft_server.SetKeepAlivesEnabled(false)
@@ -110,13 +189,34 @@ func (node *RaftNode) StartRaftServer(ctx context.Context, addr string, testing
 		ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
 
 		if err_kv := node.Meta.raft_server.Shutdown(ctx); err_kv != nil {
-			log.Printf("HTTP server Shutdown error: %v\n", err_kv)
+			node.logger().Error().Err(err_kv).Msg("Raft replica HTTP server Shutdown error")
 			node.Meta.raft_server.Close()
 		}
 
 	}()
 
-	err := node.Meta.raft_server.ListenAndServe()
+	var err error
+
+	// Serve HTTPS if a certificate is configured, reloading it when the files change (see tls.go).
+	if node.Meta.Config.HTTPCertFile != "" {
+
+		var certs *certReloader
+		certs, err = newCertReloader(node.Meta.Config.HTTPCertFile, node.Meta.Config.HTTPKeyFile, "")
+		CheckErrorFatal(err)
+
+		raft_server.TLSConfig = certs.certificateConfig()
+
+		if listener != nil {
+			err = node.Meta.raft_server.ServeTLS(listener, "", "")
+		} else {
+			err = node.Meta.raft_server.ListenAndServeTLS("", "")
+		}
+
+	} else if listener != nil {
+		err = node.Meta.raft_server.Serve(listener)
+	} else {
+		err = node.Meta.raft_server.ListenAndServe()
+	}
 
 	// Handling code for when the server is unexpectedly closed.
 	if (err != nil) && (err != http.ErrServerClosed) {
@@ -133,7 +233,7 @@ func (node *RaftNode) StartRaftServer(ctx context.Context, addr string, testing
 This function starts the gRPC server for the raft node and shuts it down when
 context is cancelled.
 */
-func (node *RaftNode) StartGRPCServer(ctx context.Context, grpc_address string, listener *net.TCPListener, testing bool) {
+func (node *RaftNode) StartGRPCServer(ctx context.Context, grpc_address string, listener net.Listener, testing bool) {
 
 	// Shut down the gRPC server if the context is cancelled
 	go func() {
@@ -151,7 +251,7 @@ func (node *RaftNode) StartGRPCServer(ctx context.Context, grpc_address string,
 	}()
 
 	// Start the server
-	log.Printf("\nStarting gRPC server at address %v...\n", grpc_address)
+	node.logger().Info().Str("address", grpc_address).Msg("Starting gRPC server")
 	err := node.Meta.grpc_server.Serve(listener) // Serve will return a non-nil error unless Stop or GracefulStop is called.
 
 	CheckErrorFatal(err)
@@ -159,22 +259,28 @@ func (node *RaftNode) StartGRPCServer(ctx context.Context, grpc_address string,
 
 /*
 This function initializes the node and imports the persistent
-state information to the node.
+state information to the node. The local key-value store is
+opened with the given backend (see kv_store/backend.go), the
+persistent files being kept in the given layout (see layout.go).
 */
-func Setup_raft_node(ctx context.Context, id int, n_replicas int, testing bool) *RaftNode {
+func Setup_raft_node(ctx context.Context, id int, n_replicas int, store_backend string, layout DataLayout, testing bool) *RaftNode {
 
 	// Key value store address of the current node
-	kv_addr := ":300" + strconv.Itoa(id)
+	kv_addr := ":" + groupPort(3, layout.Group, id)
 
 	// InitializeNode is defined in raft_node.go
-	node := InitializeNode(int32(n_replicas), id, kv_addr)
+	node := InitializeNode(int32(n_replicas), id, kv_addr, layout)
+	node.Meta.Config.StoreBackend = store_backend
+
+	// Before the entries are applied to it
+	node.OpenKVStore(id)
 
 	// ApplyToStateMachine() is defined in raft_node.go
 	go node.ApplyToStateMachine(ctx, testing)
 
 	// Starting KV store
-	log.Println("Starting local key-value store...")
-	go node.StartKVStore(ctx, kv_addr, id, testing)
+	node.logger().Info().Msg("Starting local key-value store")
+	go node.StartKVStore(ctx, kv_addr, testing)
 
 	/*
 	 * Make a HTTP request to the test endpoint until a reply is obtained, indicating that
@@ -187,15 +293,38 @@ func Setup_raft_node(ctx context.Context, id int, n_replicas int, testing bool)
 		_, err := http.Get(test_addr)
 
 		if err == nil {
-			log.Printf("\nKey-value store up and listening at port %s\n", kv_addr)
+			node.logger().Info().Str("address", kv_addr).Msg("Key-value store up and listening")
 			break
 		}
 
 	}
 
+	node.loadTables()
+
 	return node
 }
 
+// Load the tables kept in memory from the local key-value store.
+func (node *RaftNode) loadTables() {
+
+	// The settings are defined in settings.go
+	node.loadSettings()
+	node.configureCompression() // see compression.go
+
+	// The users of the client HTTP API are defined in users.go, their roles in acl.go, and the TSIG
+	// keys of the DNS updates in tsig.go
+	node.loadUsers()
+	node.loadRoles()
+	node.loadTSIGKeys()
+	node.loadWebhooks()
+
+	// The alarms raised by the members exceeding their limits are defined in alarms.go
+	node.loadAlarms()
+
+	// The locks of the external clients are defined in locks.go
+	node.loadLocks()
+}
+
 /*
 It connects the current node to the other nodes. This mechanism includes the
 initiation of their various services, like the
@@ -211,19 +340,56 @@ func (node *RaftNode) Connect_raft_node(ctx context.Context, id int, rep_addrs [
 	 * Attempt to gRPC dial to other replicas and obtain corresponding client stubs.
 	 * ConnectToPeerReplicas is defined in raft_node.go.
 	 */
-	log.Println("Obtaining client stubs of gRPC servers running at peer replicas...")
+	// Load the certificates used for mutual TLS, if configured. setupPeerTLS is defined in tls.go.
+	CheckErrorFatal(node.setupPeerTLS())
+
+	// Inject the configured faults in the RPCs sent to the peers and crash at random, see faults.go
+	if node.Meta.Config.Faults != nil {
+		node.Meta.faults = newFaultInjector(node.Meta.Config.Faults, node.Meta.metrics)
+		go node.injectCrash(ctx)
+	}
+
+	// Measure the resources used by the replica, see resources.go
+	go node.monitorResources(ctx)
+
+	node.logger().Info().Msg("Obtaining client stubs of gRPC servers running at peer replicas")
 	node.ConnectToPeerReplicas(ctx, rep_addrs)
 
 	// Setting up and running the gRPC server
-	grpc_address := ":500" + strconv.Itoa(id)
+	grpc_address := PeerAddress(node.group(), id)
+	server_address := ClientAddress(node.group(), id)
+
+	// With a single port, the gRPC server shares the port of the client HTTP server (see portmux.go).
+	if node.Meta.Config.SinglePort {
+		grpc_address = server_address
+	}
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp4", grpc_address)
 	CheckErrorFatal(err)
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+	var listener, http_listener net.Listener
+
+	listener, err = net.ListenTCP("tcp", tcpAddr)
 	CheckErrorFatal(err)
 
-	node.Meta.grpc_server = grpc.NewServer()
+	if node.Meta.Config.SinglePort {
+
+		mux, err := newPortMux(listener, node.Meta.peer_tls != nil, node.Meta.Config.HTTPCertFile != "")
+		CheckErrorFatal(err)
+
+		go mux.serve()
+
+		go func() {
+			<-ctx.Done()
+			mux.Close()
+		}()
+
+		listener, http_listener = mux.grpc, mux.http
+		node.logger().Info().Str("address", server_address).Msg("Serving gRPC and HTTP on a single port")
+	}
+
+	// The interceptor stack is defined in interceptors.go
+	node.Meta.grpc_server = grpc.NewServer(node.grpcServerOptions()...)
 
 	/*
 	 * ConsensusService is defined in protos/replica.proto
@@ -231,15 +397,18 @@ func (node *RaftNode) Connect_raft_node(ctx context.Context, id int, rep_addrs [
 	 */
 	protos.RegisterConsensusServiceServer(node.Meta.grpc_server, node)
 
+	// The client-facing KVService is defined in kv_service.go
+	protos.RegisterKVServiceServer(node.Meta.grpc_server, &kvServer{node: node})
+
 	// Running the gRPC server
 	go node.StartGRPCServer(ctx, grpc_address, listener, testing)
 
 	// wait till grpc server is up
-	connxn, err := grpc.Dial(grpc_address, grpc.WithInsecure())
+	connxn, err := grpc.Dial(grpc_address, node.transportDialOption())
 
 	// below block may not be needed
 	for err != nil {
-		connxn, err = grpc.Dial(grpc_address, grpc.WithInsecure())
+		connxn, err = grpc.Dial(grpc_address, node.transportDialOption())
 	}
 
 	for {
@@ -255,22 +424,32 @@ func (node *RaftNode) Connect_raft_node(ctx context.Context, id int, rep_addrs [
 	// Now we can start listening to client requests
 
 	// Set up the server that listens for client requests.
-	server_address := ":400" + strconv.Itoa(id)
-	log.Println("Starting raft replica server...")
-	go node.StartRaftServer(ctx, server_address, testing)
+	node.logger().Info().Msg("Starting raft replica server")
+	go node.StartRaftServer(ctx, server_address, http_listener, testing)
 
 	test_addr := fmt.Sprintf("http://localhost%s/test", server_address)
+	test_client := http.DefaultClient
+
+	if node.Meta.Config.HTTPCertFile != "" {
+
+		// The certificate doesn't need to be valid for localhost.
+		test_addr = fmt.Sprintf("https://localhost%s/test", server_address)
+		test_client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	}
 
 	// Check whether the server is active
 	for {
 
-		_, err = http.Get(test_addr)
+		_, err = test_client.Get(test_addr)
 
 		if err == nil {
-			log.Printf("\nRaft replica server up and listening at port %s\n", server_address)
+			node.logger().Info().Str("address", server_address).Msg("Raft replica server up and listening")
 			break
 		}
 
 	}
 
+	// Answer DNS queries from the local key-value store, see dns.go
+	node.StartDNSListeners(ctx)
+
 }
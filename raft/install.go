@@ -0,0 +1,324 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Installation of snapshots on the followers, as described in section 7 of the Raft paper. A follower
+whose nextIndex is behind the start of the leader's log misses entries the leader compacted (see
+log.go), which AppendEntries can't send it anymore: the leader sends it a snapshot of its state
+machine instead, along with the index and term of the last entry applied to it and the configuration
+as of that entry. The snapshot is sent in chunks of installChunkBytes, the gRPC messages being
+limited to 4MB by default, on the bulk connection of the follower (see priority.go), at the rate the
+snapshot transfers of the leader are throttled to (see throttle.go) so that a follower catching up
+doesn't hold up the replication of the client writes to the others.
+
+The follower replaces its key-value store, client sessions and the tables loaded from the store (e.g.
+the settings and the users) by those of the snapshot, and its log by the entries following the
+snapshot if it holds them, or an empty log otherwise. The changes made by the entries the snapshot
+covers are not published to the watchers of the follower nor recorded in its change stream, which
+see the keys jump to their values in the snapshot.
+*/
+
+// Size of the chunks the snapshots are sent in.
+const installChunkBytes = 1 << 20
+
+// Time allowed for a chunk of a snapshot to be received, the last one restoring the store of the follower.
+const installChunkTimeout = 30 * time.Second
+
+// The snapshots sent by the leader, and received by a follower.
+type snapshotInstalls struct {
+	mu      sync.Mutex
+	sending map[int32]bool // Followers being sent a snapshot
+
+	received receivedSnapshot // Accessed with the lock of the replica held
+}
+
+// The chunks of a snapshot received so far.
+type receivedSnapshot struct {
+	term  int32
+	index int32 // Index of the last entry the snapshot covers
+	data  []byte
+}
+
+// Start sending a snapshot to the given follower, returning false if one is being sent already.
+func (s *snapshotInstalls) begin(id int32) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sending == nil {
+		s.sending = make(map[int32]bool)
+	}
+
+	if s.sending[id] {
+		return false
+	}
+
+	s.sending[id] = true
+	return true
+}
+
+func (s *snapshotInstalls) end(id int32) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sending, id)
+}
+
+/*
+Send a snapshot of the state machine to a follower missing entries compacted from the log, for the
+given term, returning whether the follower installed it. Its nextIndex and matchIndex then follow the
+snapshot. A single snapshot is sent to each follower at a time, the concurrent sends failing.
+*/
+func (node *RaftNode) sendSnapshot(replica_id int32, client_obj Transport, term int32) bool {
+
+	if !node.installs.begin(replica_id) {
+		return false
+	}
+	defer node.installs.end(replica_id)
+
+	node.GetRLock("sendSnapshot")
+
+	if node.state != Leader || node.currentTerm != term {
+		node.ReleaseRLock("sendSnapshot1")
+		return false
+	}
+
+	index := node.lastApplied
+	last_term, _ := node.termAt(index)
+
+	// The configuration isn't sorted in place, as it may be the current one.
+	members := encodeMembers(append([]Member(nil), node.membersAt(index)...))
+
+	snapshot, _, err := node.snapshot()
+
+	node.ReleaseRLock("sendSnapshot2")
+
+	if err != nil {
+		node.logger().Error().Err(err).Int32("peer", replica_id).Msg("Unable to take the snapshot to send to the follower")
+		return false
+	}
+
+	data := snapshot.Bytes()
+
+	node.logger().Info().Int32("peer", replica_id).Int32("index", index).Int("bytes", len(data)).Msg("Sending a snapshot to the follower")
+
+	// Writing a chunk to the throttled writer waits until the throttle lets it be sent.
+	throttled, done := node.Meta.snapshots.writer(context.Background(), strconv.Itoa(int(replica_id)), ioutil.Discard)
+	defer done()
+
+	for offset := 0; ; {
+
+		end := offset + installChunkBytes
+		if end > len(data) {
+			end = len(data)
+		}
+
+		msg := &protos.InstallSnapshotMessage{
+			Term:              term,
+			LeaderId:          node.Meta.replica_id,
+			LastIncludedIndex: index,
+			LastIncludedTerm:  last_term,
+			Offset:            int64(offset),
+			Data:              data[offset:end],
+			Done:              end == len(data),
+			Members:           members,
+			LeaderAddr:        node.Meta.nodeAddress,
+			ClusterId:         node.clusterID(),
+		}
+
+		if _, err := throttled.Write(msg.Data); err != nil {
+			return false
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), installChunkTimeout)
+		response, err := client_obj.SendInstallSnapshot(ctx, msg)
+		cancel()
+
+		node.recordPeerRPC(replica_id, "InstallSnapshot", err)
+
+		if err != nil {
+			node.logger().Warn().Err(err).Int32("peer", replica_id).Int32("index", index).Int("offset", offset).Msg("Unable to send the snapshot to the follower")
+			return false
+		}
+
+		if response.Term > term {
+
+			node.GetLock("sendSnapshot")
+			if response.Term > node.currentTerm {
+				node.ToFollower(node.Meta.Master_ctx, response.Term)
+			}
+			node.ReleaseLock("sendSnapshot")
+
+			return false
+		}
+
+		if msg.Done {
+			break
+		}
+
+		offset = end
+	}
+
+	node.GetLock("sendSnapshot")
+
+	node.last_contact[replica_id] = node.now()
+
+	// The AppendEntries sent meanwhile may have advanced the follower further.
+	if node.state == Leader && node.currentTerm == term {
+
+		if index >= node.nextIndex[replica_id] {
+			node.nextIndex[replica_id] = index + 1
+		}
+
+		if index > node.matchIndex[replica_id] {
+			node.matchIndex[replica_id] = index
+		}
+	}
+
+	node.ReleaseLock("sendSnapshot")
+
+	node.logger().Info().Int32("peer", replica_id).Int32("index", index).Msg("Snapshot installed on the follower")
+
+	return true
+}
+
+// Implements the InstallSnapshot RPC, receiving the chunks of a snapshot sent by the leader (see above).
+func (node *RaftNode) InstallSnapshot(ctx context.Context, in *protos.InstallSnapshotMessage) (*protos.InstallSnapshotResponse, error) {
+
+	node.GetLock("InstallSnapshot")
+	defer node.ReleaseLock("InstallSnapshot")
+
+	if node.currentTerm > in.Term {
+		return &protos.InstallSnapshotResponse{Term: node.currentTerm}, nil
+	}
+
+	if node.currentTerm < in.Term || node.state == Candidate {
+		node.ToFollower(node.Meta.Master_ctx, in.Term)
+	}
+
+	node.resetElectionTimer()
+
+	node.setLeader(in.LeaderId, in.LeaderAddr)
+	node.Meta.leaderContact = node.now()
+
+	received := &node.installs.received
+
+	if in.Offset == 0 {
+		*received = receivedSnapshot{term: in.Term, index: in.LastIncludedIndex}
+	}
+
+	// The chunks of a snapshot are sent in order, a failed one aborting it.
+	if received.term != in.Term || received.index != in.LastIncludedIndex || int64(len(received.data)) != in.Offset {
+		return nil, status.Errorf(codes.FailedPrecondition, "the chunk at offset %v of the snapshot of entry %v doesn't follow the chunks received", in.Offset, in.LastIncludedIndex)
+	}
+
+	received.data = append(received.data, in.Data...)
+
+	if !in.Done {
+		return &protos.InstallSnapshotResponse{Term: in.Term}, nil
+	}
+
+	data := received.data
+	*received = receivedSnapshot{}
+
+	// The entries the snapshot covers are committed in the log already, and applied in order.
+	if in.LastIncludedIndex <= node.commitIndex {
+		return &protos.InstallSnapshotResponse{Term: in.Term}, nil
+	}
+
+	if err := node.installSnapshot(in, data); err != nil {
+		node.logger().Error().Err(err).Int32("index", in.LastIncludedIndex).Msg("Unable to install the snapshot sent by the leader")
+		return nil, status.Errorf(codes.Internal, "unable to install the snapshot: %v", err)
+	}
+
+	node.logger().Info().Int32("index", in.LastIncludedIndex).Int32("term", in.LastIncludedTerm).Int("bytes", len(data)).Msg("Snapshot installed")
+
+	return &protos.InstallSnapshotResponse{Term: in.Term}, nil
+}
+
+// Replace the state of the replica by the snapshot of the leader. Must be called with the lock held.
+func (node *RaftNode) installSnapshot(in *protos.InstallSnapshotMessage, data []byte) error {
+
+	// The client sessions follow the store, see snapshot in admin.go
+	r := bytes.NewReader(data)
+
+	if _, err := kv_store.VerifySnapshot(r); err != nil {
+		return err
+	}
+
+	store := data[:len(data)-r.Len()]
+
+	sessions := make(map[int64]clientSession)
+	if r.Len() > 0 {
+		if err := gob.NewDecoder(r).Decode(&sessions); err != nil {
+			return fmt.Errorf("invalid sessions in snapshot: %v", err)
+		}
+	}
+
+	members, err := decodeMembers(in.Members)
+	if err != nil {
+		return fmt.Errorf("invalid configuration in snapshot: %v", err)
+	}
+
+	// Witnesses hold no keys, see witness.go
+	if !node.isWitness() {
+		if _, err := node.stateMachine().Restore(store); err != nil {
+			return err
+		}
+	}
+
+	// The entries following the snapshot are kept if the log holds its last entry, and thus them.
+	if node.hasEntry(in.LastIncludedIndex) && node.entry(in.LastIncludedIndex).Term == in.LastIncludedTerm {
+		node.discardEntries(in.LastIncludedIndex)
+	} else {
+		node.log = nil
+	}
+
+	node.logStart, node.logStartTerm, node.logStartMembers = in.LastIncludedIndex+1, in.LastIncludedTerm, members
+	node.commitIndex, node.lastApplied = in.LastIncludedIndex, in.LastIncludedIndex
+	node.sessions = sessions
+
+	node.refreshMembership()
+
+	// The entry setting the ID of the cluster may be part of the snapshot, see cluster_id.go
+	if node.clusterID() == "" && in.ClusterId != "" {
+		node.cluster_id.Store(in.ClusterId)
+	}
+
+	node.reloadTables()
+	node.flushAnswers()
+
+	node.PersistToStorage()
+
+	return nil
+}
+
+// Load the tables kept in memory from the local key-value store again, once replaced.
+func (node *RaftNode) reloadTables() {
+
+	node.Meta.settings.reset()
+	node.Meta.users.reset()
+	node.Meta.roles.reset()
+	node.Meta.tsig_keys.reset()
+	node.Meta.webhooks.reset()
+	node.Meta.alarms.reset()
+	node.Meta.locks.reset()
+
+	node.loadTables()
+}
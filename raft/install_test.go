@@ -0,0 +1,247 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Serve a fresh key-value store to the given replica.
+func serveTestStore(t *testing.T, node *RaftNode) {
+
+	kv := kv_store.InitializeStore(filepath.Join(t.TempDir(), "store"))
+
+	store := httptest.NewServer(kv.Router())
+	t.Cleanup(store.Close)
+
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+}
+
+// Return the state machine of a store opened by a test, which registers the hooks it needs itself.
+func testStateMachine(kv localStore) localStateMachine {
+	return &mapStateMachine{&storeStateMachine{kv: kv, router: kv.Router()}}
+}
+
+// Apply the operations to the state machine of the replica, as committed entries would be.
+func applyTestOperations(t *testing.T, node *RaftNode, operations ...[]string) {
+
+	for _, operation := range operations {
+		if _, err := node.stateMachine().Apply(operation); err != nil {
+			t.Fatalf("Unable to apply %v: %v", operation[0], err)
+		}
+	}
+}
+
+/*
+ * This test case checks that the leader sends a snapshot, in chunks, to a
+ * follower whose nextIndex is behind the start of its log, and that the
+ * follower replaces its store, client sessions, tables and conflicting log
+ * with those of the snapshot, and persists its new log start.
+ */
+func TestInstallSnapshot(t *testing.T) {
+
+	// The entries up to 4 were replaced by a snapshot, entry 5 is applied.
+	leader := newTestFollower(t, 2, []protos.LogEntry{{Term: 2, Operation: []string{"NO-OP"}}})
+	leader.logStart, leader.logStartTerm = 5, 1
+	leader.commitIndex, leader.lastApplied = 5, 5
+	leader.state = Leader
+	leader.sessions = map[int64]clientSession{3: {LastSequence: 4, LastIndex: 2}}
+
+	serveTestStore(t, leader)
+
+	// Larger than a chunk, even if compressed.
+	source := rand.New(rand.NewSource(1))
+	large := make([]byte, 2*installChunkBytes)
+	for i := range large {
+		large[i] = byte('a' + source.Intn(26))
+	}
+
+	setting, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: SettingsPrefix + "snapshot_max_rate", Value: "1000"}}})
+	applyTestOperations(t, leader, []string{"POST", "a", "1"}, []string{"POST", "large", string(large)}, []string{"TXN", string(setting)})
+
+	// The follower holds entries of an earlier term, conflicting with the snapshot.
+	follower := newTestFollower(t, 1, []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}, {Term: 1, Operation: []string{"POST", "b", "2"}}})
+	follower.Meta.replica_id = 1
+	follower.commitIndex, follower.lastApplied = 0, 0
+	follower.Meta.settings.apply(SettingChange{Name: "stale", Action: "SET", Value: "1"})
+
+	serveTestStore(t, follower)
+	applyTestOperations(t, follower, []string{"POST", "b", "2"})
+
+	network := NewMemoryNetwork(1)
+	network.Register(1, follower)
+	leader.Meta.peer_replica_clients = network.Transports(0, 3)
+
+	leader.nextIndex, leader.matchIndex = []int32{6, 0, 6}, []int32{5, -1, 5}
+
+	success := make(chan bool)
+	leader.LeaderSendAEs(context.Background(), "TEST", &protos.AppendEntriesMessage{Term: 2, LeaderId: 0, LeaderCommit: 5}, 5, success)
+
+	select {
+	case replicated := <-success:
+		if !replicated {
+			t.Fatalf("Expected the entries to be replicated once the snapshot is installed")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Expected the outcome of the replication to be sent")
+	}
+
+	leader.GetRLock("Test")
+	next, match := leader.nextIndex[1], leader.matchIndex[1]
+	leader.ReleaseRLock("Test")
+
+	if next != 6 || match != 5 {
+		t.Errorf("Expected the follower to hold the entries up to 5, got next index %v and match index %v", next, match)
+	}
+
+	follower.GetRLock("Test")
+	defer follower.ReleaseRLock("Test")
+
+	if follower.logStart != 6 || follower.logStartTerm != 2 || len(follower.log) != 0 || follower.commitIndex != 5 || follower.lastApplied != 5 || follower.currentTerm != 2 {
+		t.Errorf("Expected the log to start after the snapshot, got start %v (term %v), %v entries, commit index %v, applied %v", follower.logStart, follower.logStartTerm, len(follower.log), follower.commitIndex, follower.lastApplied)
+	}
+
+	if value, _, _ := follower.stateMachine().Lookup("a"); !strings.Contains(value, "1") {
+		t.Errorf("Expected the key of the snapshot to be restored, got %q", value)
+	}
+
+	if _, code, _ := follower.stateMachine().Lookup("b"); code != http.StatusNotFound {
+		t.Errorf("Expected the keys of the follower to be replaced, got %v", code)
+	}
+
+	if s, ok := follower.sessions[3]; !ok || s.LastSequence != 4 {
+		t.Errorf("Expected the client sessions of the snapshot, got %v", follower.sessions)
+	}
+
+	if settings := follower.Meta.settings.All(); settings["snapshot_max_rate"] != "1000" || settings["stale"] != "" {
+		t.Errorf("Expected the settings to be loaded from the snapshot, got %v", settings)
+	}
+
+	if start, ok := NewStorage().Get("logStart", follower.Meta.raft_persistence_file); !ok || start.(int32) != 6 {
+		t.Errorf("Expected the start of the log to be persisted, got %v", start)
+	}
+}
+
+/*
+ * This test case checks that a follower keeps the entries following a
+ * snapshot if it holds its last entry, ignores a snapshot of entries it
+ * committed already, and rejects chunks out of order.
+ */
+func TestInstallSnapshotKeepsLog(t *testing.T) {
+
+	leader := newTestFollower(t, 1, nil)
+	serveTestStore(t, leader)
+	applyTestOperations(t, leader, []string{"POST", "a", "1"})
+
+	snapshot, _, err := leader.snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	follower := newTestFollower(t, 1, []protos.LogEntry{{Term: 1}, {Term: 1}, {Term: 1}, {Term: 1}})
+	follower.Meta.replica_id = 1
+	follower.commitIndex = 0
+
+	serveTestStore(t, follower)
+
+	members := encodeMembers(follower.Meta.initial_members)
+
+	install := func(offset int64, data []byte, done bool) error {
+		_, err := follower.InstallSnapshot(context.Background(), &protos.InstallSnapshotMessage{Term: 1, LastIncludedIndex: 1, LastIncludedTerm: 1, Offset: offset, Data: data, Done: done, Members: members})
+		return err
+	}
+
+	data := snapshot.Bytes()
+
+	if err := install(0, data[:10], false); err != nil {
+		t.Fatalf("Expected the first chunk to be accepted, got %v", err)
+	}
+
+	if err := install(20, data[20:], true); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected a chunk out of order to be rejected, got %v", err)
+	}
+
+	if follower.logStart != 0 || len(follower.log) != 4 {
+		t.Fatalf("Expected the log to be left as is, got start %v and %v entries", follower.logStart, len(follower.log))
+	}
+
+	if err := install(0, data[:10], false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := install(10, data[10:], true); err != nil {
+		t.Fatalf("Expected the snapshot to be installed, got %v", err)
+	}
+
+	if follower.logStart != 2 || len(follower.log) != 2 || follower.lastLogIndex() != 3 || follower.lastApplied != 1 {
+		t.Errorf("Expected the entries following the snapshot to be kept, got start %v and %v entries", follower.logStart, len(follower.log))
+	}
+
+	if value, _, _ := follower.stateMachine().Lookup("a"); !strings.Contains(value, "1") {
+		t.Errorf("Expected the key of the snapshot to be restored, got %q", value)
+	}
+
+	// A snapshot of the entries committed is ignored, they being applied in order.
+	follower.commitIndex = 3
+
+	if err := install(0, data, true); err != nil || follower.logStart != 2 || follower.lastApplied != 1 {
+		t.Errorf("Expected the snapshot to be ignored, got %v, start %v and applied %v", err, follower.logStart, follower.lastApplied)
+	}
+}
+
+/*
+ * This test case checks that the snapshot sent to a follower catching up is
+ * throttled to the rate of the snapshot transfers of the leader.
+ */
+func TestInstallSnapshotRate(t *testing.T) {
+
+	const rate = 4 << 20
+
+	leader := newTestFollower(t, 1, []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}})
+	leader.Meta.Config.SnapshotMaxRate = rate
+	leader.commitIndex, leader.lastApplied = 0, 0
+	leader.state = Leader
+
+	serveTestStore(t, leader)
+
+	source := rand.New(rand.NewSource(1))
+	large := make([]byte, 2*installChunkBytes)
+	for i := range large {
+		large[i] = byte('a' + source.Intn(26))
+	}
+
+	applyTestOperations(t, leader, []string{"POST", "large", string(large)})
+
+	follower := newTestFollower(t, 1, nil)
+	follower.Meta.replica_id = 1
+	serveTestStore(t, follower)
+
+	network := NewMemoryNetwork(1)
+	network.Register(1, follower)
+
+	start := time.Now()
+	if !leader.sendSnapshot(1, network.Transports(0, 3)[1], 1) {
+		t.Fatalf("Expected the snapshot to be installed on the follower")
+	}
+	elapsed := time.Since(start)
+
+	// The first chunk of the throttle is sent right away.
+	sent := leader.Meta.metrics.Get("snapshot_sent_bytes_total", "peer", "1")
+	measured := (sent - snapshotChunkBytes) / elapsed.Seconds()
+
+	if sent < float64(len(large))/2 || measured > 1.1*rate || measured < 0.5*rate {
+		t.Errorf("Expected the snapshot to be sent at about %v bytes per second, sent %v bytes in %v (%.0f bytes per second)", rate, sent, elapsed, measured)
+	}
+}
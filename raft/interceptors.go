@@ -0,0 +1,375 @@
+package raft
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+The interceptor stack installed on every gRPC server of the replica. Requests pass through
+the interceptors in the following order:
+
+ 1. recovery: converts a panic in a handler into an Internal error instead of crashing the replica.
+ 2. metrics:  counts requests by method and status code, and accumulates their latency.
+ 3. shedding: rejects requests of lower priority than the Raft RPCs first under overload, see shedding.go.
+ 4. deadline: gives the KVService writes sent without a deadline WriteRouteTimeout to complete, as
+    the writes of the HTTP API, so that none waits forever for its proposal to be committed.
+ 5. logging:  logs handled requests (all of them if LogRPCs is set, otherwise only slow ones, or
+    all of them at the trace level).
+ 6. auth:     checks the bearer token presented in the request metadata against the token
+    required for the service being called, that peers presented a certificate if TLS is enabled,
+    and that they belong to the same cluster (see cluster_id.go).
+
+Handlers themselves should not need to implement any of the above. The RPCs sent to the peers pass
+through client interceptors as well (see peerDialOptions): tracing, logging, metrics (counted by
+method, code and peer, with their latency) and the cluster ID.
+*/
+func (node *RaftNode) grpcServerOptions() []grpc.ServerOption {
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			node.recoveryUnaryInterceptor,
+			node.tracingUnaryInterceptor,
+			node.metricsUnaryInterceptor,
+			node.sheddingUnaryInterceptor,
+			node.deadlineUnaryInterceptor,
+			node.loggingUnaryInterceptor,
+			node.authUnaryInterceptor,
+		),
+		grpc.ChainStreamInterceptor(
+			node.recoveryStreamInterceptor,
+			node.tracingStreamInterceptor,
+			node.metricsStreamInterceptor,
+			node.sheddingStreamInterceptor,
+			node.loggingStreamInterceptor,
+			node.authStreamInterceptor,
+		),
+		peerKeepaliveEnforcement(), // see peers.go
+	}
+
+	if node.Meta.peer_tls != nil { // see tls.go
+		opts = append(opts, grpc.Creds(credentials.NewTLS(node.Meta.peer_tls.serverConfig())))
+	}
+
+	return opts
+}
+
+// Return the token that callers need to present to call the given method, or "" if
+// the method doesn't require authentication.
+func (node *RaftNode) requiredToken(method string) string {
+
+	switch {
+
+	case strings.HasPrefix(method, "/protos.ConsensusService/"):
+		return node.Meta.Config.PeerToken
+
+	case strings.HasPrefix(method, "/protos.KVService/"):
+		return node.Meta.Config.ClientToken
+
+	}
+
+	return ""
+}
+
+/*
+Check that the incoming request carries the token required for the method. When the users of the
+client API are enabled (see users.go), the KVService also accepts the API token of a user, who is
+then stored in the returned context so that its ACLs can be enforced (see acl.go).
+*/
+func (node *RaftNode) authorize(ctx context.Context, method string) (context.Context, error) {
+
+	if node.Meta.peer_tls != nil && strings.HasPrefix(method, "/protos.ConsensusService/") {
+
+		cert := verifiedPeer(ctx)
+		if cert == nil {
+			return ctx, status.Errorf(codes.Unauthenticated, "a certificate signed by the cluster CA is required for %v", method)
+		}
+
+		if !namedCertificate(cert, node.Meta.peer_tls.names) {
+			return ctx, status.Errorf(codes.PermissionDenied, "the certificate of the caller isn't issued to any of the peer names, as required for %v", method)
+		}
+	}
+
+	if strings.HasPrefix(method, "/protos.ConsensusService/") {
+		if err := node.checkClusterID(ctx, method); err != nil {
+			return ctx, err
+		}
+	}
+
+	required := node.requiredToken(method)
+	users := node.Meta.Config.HTTPAdminToken != "" && strings.HasPrefix(method, "/protos.KVService/")
+
+	if required == "" && !users {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+
+	if len(values) == 0 {
+		return ctx, status.Errorf(codes.Unauthenticated, "missing credentials for %v", method)
+	}
+
+	token := strings.TrimPrefix(values[0], "Bearer ")
+
+	if required != "" && subtle.ConstantTimeCompare([]byte(token), []byte(required)) == 1 {
+		return ctx, nil
+	}
+
+	if users {
+		if user, err := node.tokenUser(token); err == nil {
+			return context.WithValue(ctx, userContextKey{}, user), nil
+		}
+	}
+
+	return ctx, status.Errorf(codes.PermissionDenied, "invalid credentials for %v", method)
+}
+
+// Return the certificate the caller presented if it is signed by the CA of the cluster, nil otherwise.
+func verifiedPeer(ctx context.Context) *x509.Certificate {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return info.State.VerifiedChains[0][0]
+}
+
+func (node *RaftNode) authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	ctx, err := node.authorize(ctx, info.FullMethod)
+	if err != nil {
+		if grpcTrafficClass(info.FullMethod) == classWrite {
+			node.reject(rejectACL, info.FullMethod, "", "", err)
+		}
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (node *RaftNode) deadlineUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	if _, ok := ctx.Deadline(); ok || grpcTrafficClass(info.FullMethod) != classWrite || node.Meta.Config.WriteRouteTimeout <= 0 {
+		return handler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	return handler(ctx, req)
+}
+
+func (node *RaftNode) authStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	ctx, err := node.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// Log a handled request: as a warning if it was slow, at the info level if required by the
+// configuration, and at the trace level otherwise.
+func (node *RaftNode) logRPC(ctx context.Context, method string, start time.Time, err error) {
+
+	elapsed := time.Since(start)
+	// The cluster settings take precedence over the replica's own configuration, see settings.go
+	threshold := node.Meta.settings.Duration("slow_rpc_threshold", node.Meta.Config.SlowRPCThreshold)
+
+	event := node.logger().Trace()
+	if threshold > 0 && elapsed > threshold {
+		event = node.logger().Warn()
+	} else if node.Meta.settings.Bool("log_rpcs", node.Meta.Config.LogRPCs) {
+		event = node.logger().Info()
+	}
+
+	if event == nil { // The level is disabled
+		return
+	}
+
+	caller := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		caller = p.Addr.String()
+	}
+
+	event.Str("method", method).Str("caller", caller).Dur("elapsed", elapsed).Str("code", status.Code(err).String()).Msg("Received RPC")
+}
+
+// Client interceptor logging the RPCs sent to the peers at the trace level.
+func (node *RaftNode) loggingClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	node.logger().Trace().Str("method", method).Str("target", cc.Target()).Dur("elapsed", time.Since(start)).Str("code", status.Code(err).String()).Msg("Sent RPC")
+
+	return err
+}
+
+func (node *RaftNode) loggingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	node.logRPC(ctx, info.FullMethod, start, err)
+
+	return resp, err
+}
+
+func (node *RaftNode) loggingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	start := time.Now()
+	err := handler(srv, ss)
+	node.logRPC(ss.Context(), info.FullMethod, start, err)
+
+	return err
+}
+
+// Record the outcome and latency of a handled request.
+func (node *RaftNode) recordRPC(method string, start time.Time, err error) {
+
+	code := status.Code(err).String()
+
+	node.Meta.metrics.Add("grpc_server_handled_total", 1, "method", method, "code", code)
+	node.Meta.metrics.Add("grpc_server_handling_seconds_sum", time.Since(start).Seconds(), "method", method)
+	node.Meta.metrics.Add("grpc_server_handling_seconds_count", 1, "method", method)
+}
+
+// Record a request whose handler panicked as failed with Internal, which is what the
+// recovery interceptor answers, and let the panic carry on up to it.
+func (node *RaftNode) recordPanic(method string, start time.Time) {
+
+	if r := recover(); r != nil {
+		node.recordRPC(method, start, status.Error(codes.Internal, "panic"))
+		panic(r)
+	}
+}
+
+func (node *RaftNode) metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	start := time.Now()
+	defer node.recordPanic(info.FullMethod, start)
+
+	resp, err := handler(ctx, req)
+	node.recordRPC(info.FullMethod, start, err)
+
+	return resp, err
+}
+
+func (node *RaftNode) metricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	start := time.Now()
+	defer node.recordPanic(info.FullMethod, start)
+
+	err := handler(srv, ss)
+	node.recordRPC(info.FullMethod, start, err)
+
+	return err
+}
+
+// Client interceptor recording the outcome and latency of the RPCs sent to the peers.
+func (node *RaftNode) metricsClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+
+	target, code := cc.Target(), status.Code(err).String()
+
+	node.Meta.metrics.Add("grpc_client_handled_total", 1, "method", method, "code", code, "target", target)
+	node.Meta.metrics.Add("grpc_client_handling_seconds_sum", time.Since(start).Seconds(), "method", method, "target", target)
+	node.Meta.metrics.Add("grpc_client_handling_seconds_count", 1, "method", method, "target", target)
+
+	return err
+}
+
+// Convert a recovered panic into an error, so that a bug in one handler doesn't bring down the replica.
+func (node *RaftNode) recoveredError(method string, r interface{}) error {
+
+	node.logger().Error().Str("method", method).Interface("panic", r).Bytes("stack", debug.Stack()).Msg("Panic while handling RPC")
+	node.Meta.metrics.Add("grpc_server_panics_total", 1, "method", method)
+
+	return status.Errorf(codes.Internal, "internal error while handling %v", method)
+}
+
+func (node *RaftNode) recoveryUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = node.recoveredError(info.FullMethod, r)
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+func (node *RaftNode) recoveryStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = node.recoveredError(info.FullMethod, r)
+		}
+	}()
+
+	return handler(srv, ss)
+}
+
+// tokenCredentials attaches a bearer token to every outgoing RPC made on a connection.
+type tokenCredentials struct {
+	token string
+}
+
+func (c tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.token}, nil
+}
+
+func (c tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// Return the dial options used for connecting to the gRPC servers of peer replicas.
+func (node *RaftNode) peerDialOptions() []grpc.DialOption {
+
+	// Cap the reconnection backoff, so that a restarted replica starts receiving AppendEntries
+	// quickly instead of timing out and disrupting the cluster with elections.
+	reconnect := grpc.ConnectParams{
+		Backoff: backoff.Config{
+			BaseDelay:  100 * time.Millisecond,
+			Multiplier: 1.6,
+			Jitter:     0.2,
+			MaxDelay:   time.Second,
+		},
+		MinConnectTimeout: time.Second,
+	}
+
+	opts := []grpc.DialOption{
+		node.transportDialOption(), // see tls.go
+		grpc.WithConnectParams(reconnect),
+		node.peerKeepalive(), // see peers.go
+		grpc.WithChainUnaryInterceptor(tracingClientInterceptor, node.loggingClientInterceptor, node.metricsClientInterceptor, node.clusterIDClientInterceptor), // see tracing.go and cluster_id.go
+	}
+
+	if node.Meta.Config.PeerToken != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: node.Meta.Config.PeerToken}))
+	}
+
+	return opts
+}
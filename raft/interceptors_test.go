@@ -0,0 +1,110 @@
+package raft
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks the interceptor chain of the gRPC servers: a panic in
+ * a handler is answered with an Internal error and the server keeps serving,
+ * the KVService requires the client token, and every RPC is counted by method
+ * and code along with its latency.
+ */
+func TestInterceptors(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig(), shedder: &loadShedder{}}}
+	node.Meta.Config.ClientToken = "secret"
+
+	const method = "/protos.KVService/Get"
+
+	// A KVService whose Get panics when asked for the key "panic".
+	service := grpc.ServiceDesc{
+		ServiceName: "protos.KVService",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Get",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+
+				in := new(protos.GetRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					if req.(*protos.GetRequest).Key == "panic" {
+						panic("the handler failed")
+					}
+					return &protos.GetResponse{Found: true}, nil
+				}
+
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: method}, handler)
+			},
+		}},
+	}
+
+	server := grpc.NewServer(node.grpcServerOptions()...)
+	server.RegisterService(&service, struct{}{})
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	get := func(key string, token string) error {
+
+		ctx := context.Background()
+		if token != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+		}
+
+		return conn.Invoke(ctx, method, &protos.GetRequest{Key: key}, new(protos.GetResponse))
+	}
+
+	for _, call := range []struct {
+		key, token string
+		code       codes.Code
+	}{
+		{"panic", "secret", codes.Internal},
+		{"a", "secret", codes.OK}, // still serving after the panic
+		{"a", "", codes.Unauthenticated},
+		{"a", "wrong", codes.PermissionDenied},
+		{"a", "secret", codes.OK},
+	} {
+		if err := get(call.key, call.token); status.Code(err) != call.code {
+			t.Errorf("Expected Get %q with the token %q to fail with %v, got %v", call.key, call.token, call.code, err)
+		}
+	}
+
+	metrics := node.Meta.metrics
+
+	for code, count := range map[codes.Code]float64{codes.OK: 2, codes.Internal: 1, codes.Unauthenticated: 1, codes.PermissionDenied: 1} {
+		if got := metrics.Get("grpc_server_handled_total", "method", method, "code", code.String()); got != count {
+			t.Errorf("Expected %v RPCs handled with %v, got %v", count, code, got)
+		}
+	}
+
+	if count, sum := metrics.Get("grpc_server_handling_seconds_count", "method", method), metrics.Get("grpc_server_handling_seconds_sum", "method", method); count != 5 || sum <= 0 {
+		t.Errorf("Expected the latency of the 5 RPCs to be recorded, got %v seconds over %v", sum, count)
+	}
+
+	if panics := metrics.Get("grpc_server_panics_total", "method", method); panics != 1 {
+		t.Errorf("Expected the panic to be counted, got %v", panics)
+	}
+}
@@ -0,0 +1,168 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+/*
+Periodic jobs that only run on the leader, such as expiring records or health checks. The jobs are
+started once the replica becomes the leader and has committed the NO-OP entry of its term, and are
+cancelled (through the context given to each run) as soon as it steps down. A job is never run by two
+replicas of the same term, but may briefly overlap with the job of the next leader while its run
+notices the cancellation: jobs have to go through the log for anything that must not happen twice.
+
+Each job runs in its own goroutine, one run at a time. A panic in a run is recovered and counted as a
+failure, so that it neither brings down the replica nor stops the next runs.
+*/
+
+// A job run periodically by the leader.
+type LeaderJob struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error // The context is cancelled once the replica steps down
+}
+
+// The jobs registered on a replica, and the cancellation of their current runs.
+type leaderJobs struct {
+	mu     sync.Mutex
+	jobs   []LeaderJob
+	ctx    context.Context    // Context of the running jobs, nil when not the leader
+	cancel context.CancelFunc // Stops the running jobs
+}
+
+// Register a job, started right away if the replica is the leader.
+func (node *RaftNode) RegisterLeaderJob(job LeaderJob) {
+
+	node.jobs.mu.Lock()
+	defer node.jobs.mu.Unlock()
+
+	node.jobs.jobs = append(node.jobs.jobs, job)
+
+	if node.jobs.ctx != nil {
+		go node.runLeaderJob(node.jobs.ctx, job)
+		node.Meta.metrics.Set("raft_leader_jobs_running", float64(len(node.jobs.jobs)))
+	}
+}
+
+// Start the registered jobs once the replica became the leader of the given term, unless it already
+// stepped down.
+func (node *RaftNode) startLeaderJobs(ctx context.Context, term int32) {
+
+	// The lock orders the start with the transition to follower, which stops the jobs.
+	node.GetRLock("Start Leader Jobs")
+	defer node.ReleaseRLock("Start Leader Jobs")
+
+	if node.state != Leader || node.currentTerm != term {
+		return
+	}
+
+	node.jobs.mu.Lock()
+	defer node.jobs.mu.Unlock()
+
+	if node.jobs.ctx != nil {
+		node.jobs.cancel()
+	}
+
+	node.jobs.ctx, node.jobs.cancel = context.WithCancel(ctx)
+
+	for _, job := range node.jobs.jobs {
+		go node.runLeaderJob(node.jobs.ctx, job)
+	}
+
+	node.Meta.metrics.Set("raft_leader_jobs_running", float64(len(node.jobs.jobs)))
+	node.logger().Info().Int("jobs", len(node.jobs.jobs)).Msg("Started leader jobs")
+}
+
+// Stop the jobs of the leader. Doesn't wait for the current runs to notice the cancellation.
+func (node *RaftNode) stopLeaderJobs() {
+
+	node.jobs.mu.Lock()
+	defer node.jobs.mu.Unlock()
+
+	if node.jobs.ctx == nil {
+		return
+	}
+
+	node.jobs.cancel()
+	node.jobs.ctx, node.jobs.cancel = nil, nil
+
+	node.Meta.metrics.Set("raft_leader_jobs_running", 0)
+	node.logger().Info().Msg("Stopped leader jobs")
+}
+
+// Run the job at its interval until the context is cancelled.
+func (node *RaftNode) runLeaderJob(ctx context.Context, job LeaderJob) {
+
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			node.runLeaderJobOnce(ctx, job)
+		}
+	}
+}
+
+// Run the job once, recording its outcome and duration.
+func (node *RaftNode) runLeaderJobOnce(ctx context.Context, job LeaderJob) (err error) {
+
+	start := time.Now()
+
+	defer func() {
+
+		outcome := "success"
+
+		if r := recover(); r != nil {
+			node.logger().Error().Str("job", job.Name).Interface("panic", r).Bytes("stack", debug.Stack()).Msg("Panic while running leader job")
+			err, outcome = fmt.Errorf("panic: %v", r), "panic"
+		} else if err != nil && ctx.Err() == nil {
+			node.logger().Warn().Str("job", job.Name).Err(err).Msg("Leader job failed")
+			outcome = "error"
+		} else if err != nil {
+			outcome = "cancelled"
+		}
+
+		node.Meta.metrics.Add("raft_leader_job_runs_total", 1, "job", job.Name, "outcome", outcome)
+		node.Meta.metrics.Add("raft_leader_job_seconds_sum", time.Since(start).Seconds(), "job", job.Name)
+		node.Meta.metrics.Add("raft_leader_job_seconds_count", 1, "job", job.Name)
+	}()
+
+	return job.Run(ctx)
+}
+
+// Job publishing the number of healthy members, as seen by the leader.
+func (node *RaftNode) memberHealthJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "member_health",
+		Interval: memberHealthTimeout,
+		Run: func(ctx context.Context) error {
+
+			node.GetRLock("Member Health Job")
+			defer node.ReleaseRLock("Member Health Job")
+
+			if node.state != Leader {
+				return nil
+			}
+
+			healthy := 0
+			for _, m := range node.Meta.members {
+				if m.Id == node.Meta.replica_id || node.healthy(m.Id) {
+					healthy++
+				}
+			}
+
+			node.Meta.metrics.Set("raft_healthy_members", float64(healthy))
+			node.Meta.metrics.Set("raft_members", float64(len(node.Meta.members)))
+
+			return nil
+		},
+	}
+}
@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that leader jobs only run while the replica is the
+ * leader of the term they were started for, and that a panicking job neither
+ * stops its next runs nor the other jobs.
+ */
+func TestLeaderJobs(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics()}, state: Leader, currentTerm: 3}
+
+	var runs, panics int32
+
+	node.RegisterLeaderJob(LeaderJob{Name: "count", Interval: 5 * time.Millisecond, Run: func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}})
+
+	node.RegisterLeaderJob(LeaderJob{Name: "panic", Interval: 5 * time.Millisecond, Run: func(ctx context.Context) error {
+		if atomic.AddInt32(&panics, 1)%2 == 0 {
+			return errors.New("failed")
+		}
+		panic("job bug")
+	}})
+
+	// A stale transition, from an earlier term, doesn't start the jobs.
+	node.startLeaderJobs(context.Background(), 2)
+	time.Sleep(30 * time.Millisecond)
+
+	if atomic.LoadInt32(&runs) != 0 {
+		t.Fatalf("Expected no run before the replica became the leader of the term")
+	}
+
+	node.startLeaderJobs(context.Background(), 3)
+	time.Sleep(50 * time.Millisecond)
+
+	node.GetLock("TestLeaderJobs")
+	node.state = Follower
+	node.stopLeaderJobs()
+	node.ReleaseLock("TestLeaderJobs")
+
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&runs)
+	time.Sleep(30 * time.Millisecond)
+
+	if stopped < 3 || atomic.LoadInt32(&runs) != stopped {
+		t.Errorf("Expected the job to run while leader only, got %v runs then %v", stopped, atomic.LoadInt32(&runs))
+	}
+
+	if node.Meta.metrics.Get("raft_leader_job_runs_total", "job", "panic", "outcome", "panic") < 2 ||
+		node.Meta.metrics.Get("raft_leader_job_runs_total", "job", "panic", "outcome", "error") < 1 {
+		t.Errorf("Expected the panics and failures of the job to be counted")
+	}
+
+	if node.Meta.metrics.Get("raft_leader_jobs_running") != 0 {
+		t.Errorf("Expected no job running after stepping down")
+	}
+}
@@ -0,0 +1,447 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+The client-facing KVService, served on the same gRPC server as the ConsensusService. It
+offers the operations of the HTTP API (implemented in raft_server.go) to typed clients:
+
+- Get and Range perform linearizable reads through the leader, like their HTTP counterparts.
+- Put, Delete, Txn and BatchPut are replicated as a single "TXN" log entry, so that their outcome
+  (e.g. whether a key was deleted) can be reported once the entry has been applied.
+- Watch streams the changes applied to the local state machine, and can be served by any replica.
+  Watchers are also notified of the current leader, and of every leader change.
+- Export streams the keys at a pinned revision, and can be served by any replica (see export.go).
+
+Followers reject the other calls right away with Unavailable, carrying the last known leader as a
+LeaderInfo detail (see notLeaderError), which client.LeaderHint returns.
+
+The ACLs of the caller, if it authenticated as a user, are enforced the same way as by the HTTP
+API (see acl.go).
+*/
+
+const (
+	maxPendingTxnResults = 1024 // outcomes of transactions retained for the clients waiting on them
+)
+
+type kvServer struct {
+	protos.UnimplementedKVServiceServer
+
+	node *RaftNode
+}
+
+/*
+The error returned by replicas that are not the leader, so that clients can redirect their requests.
+Its details hold a LeaderInfo with the ID, addresses and term of the last known leader (ID -1 if it
+isn't known), so that clients can dial the leader right away rather than trying every replica. Must
+be called with the (read) lock held.
+*/
+func (node *RaftNode) notLeaderError() error {
+
+	st := status.Newf(codes.Unavailable, "not a leader, last known leader's address: %v", node.Meta.leaderAddress)
+
+	leader := node.leaderInfo()
+	if leader == nil {
+		leader = &protos.LeaderInfo{Id: -1, Term: node.currentTerm}
+	}
+
+	if detailed, err := st.WithDetails(leader); err == nil {
+		st = detailed
+	}
+
+	return st.Err()
+}
+
+func (s *kvServer) Get(ctx context.Context, in *protos.GetRequest) (*protos.GetResponse, error) {
+
+	if err := validateKey(in.Key); err != nil {
+		return nil, err
+	}
+
+	if err := s.node.authorizeKey(ctx, in.Key, PermissionRead); err != nil {
+		return nil, err
+	}
+
+	path := url.PathEscape(in.Key)
+	if in.Revision != 0 {
+		path += "?rev=" + strconv.FormatInt(in.Revision, 10)
+	}
+
+	s.node.GetRLock("KVService Get")
+	defer s.node.ReleaseRLock("KVService Get")
+
+	if s.node.state != Leader {
+		return nil, s.node.notLeaderError()
+	}
+
+	response, _, err := s.node.readFromStore(path)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "read failed: %v", err)
+	}
+
+	switch {
+
+	case strings.HasPrefix(response, "Value = "):
+		return &protos.GetResponse{Found: true, Value: strings.TrimSuffix(strings.TrimPrefix(response, "Value = "), "\n")}, nil
+
+	case strings.HasPrefix(response, "Invalid key value pair"):
+		return &protos.GetResponse{Found: false}, nil
+
+	case strings.HasPrefix(response, "Historical read failed"):
+		return nil, status.Error(codes.OutOfRange, strings.TrimSpace(response))
+
+	}
+
+	return nil, status.Error(codes.InvalidArgument, strings.TrimSpace(response))
+}
+
+func (s *kvServer) Put(ctx context.Context, in *protos.PutRequest) (*protos.PutResponse, error) {
+
+	_, err := s.Txn(ctx, &protos.TxnRequest{
+		Success:  []*protos.KVOp{{Type: protos.KVOp_PUT, Key: in.Key, Value: in.Value}},
+		Client:   in.Client,
+		Session:  in.Session,
+		Sequence: in.Sequence,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &protos.PutResponse{}, nil
+}
+
+func (s *kvServer) Delete(ctx context.Context, in *protos.DeleteRequest) (*protos.DeleteResponse, error) {
+
+	result, err := s.node.replicateTxn(ctx, kv_store.Txn{
+		Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: in.Key}},
+	}, in.Client, in.Session, in.Sequence)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &protos.DeleteResponse{Deleted: len(result.Events) > 0}, nil
+}
+
+func (s *kvServer) Range(ctx context.Context, in *protos.RangeRequest) (*protos.RangeResponse, error) {
+
+	query := url.Values{
+		"start": {in.Start},
+		"end":   {in.End},
+	}
+	if in.Limit != 0 {
+		query.Set("limit", strconv.Itoa(int(in.Limit)))
+	}
+	if in.Token != "" {
+		query.Set("token", in.Token)
+	}
+
+	s.node.GetRLock("KVService Range")
+	defer s.node.ReleaseRLock("KVService Range")
+
+	if s.node.state != Leader {
+		return nil, s.node.notLeaderError()
+	}
+
+	response, code, err := s.node.readFromStore("range?" + query.Encode())
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "read failed: %v", err)
+	}
+
+	if code == http.StatusGone {
+		return nil, status.Error(codes.OutOfRange, strings.TrimSpace(response))
+	}
+
+	if code != http.StatusOK {
+		return nil, status.Error(codes.InvalidArgument, strings.TrimSpace(response))
+	}
+
+	var page kv_store.RangeResponse
+	if err := json.Unmarshal([]byte(response), &page); err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid range response: %v", err)
+	}
+
+	allowed := s.node.keyFilter(ctx, PermissionRead)
+
+	out := &protos.RangeResponse{NextToken: page.NextToken}
+	for _, kv := range page.Kvs {
+		if allowed != nil && !allowed(kv.Key) {
+			continue
+		}
+		out.Kvs = append(out.Kvs, &protos.KeyValue{Key: kv.Key, Value: kv.Value})
+	}
+
+	return out, nil
+}
+
+func (s *kvServer) Txn(ctx context.Context, in *protos.TxnRequest) (*protos.TxnResponse, error) {
+
+	txn := kv_store.Txn{}
+
+	for _, c := range in.Compare {
+
+		if err := validateKey(c.Key); err != nil {
+			return nil, err
+		}
+
+		txn.Compare = append(txn.Compare, kv_store.Compare{Key: c.Key, Condition: c.Condition.String(), Value: c.Value})
+	}
+
+	for _, op := range in.Success {
+		txn.Success = append(txn.Success, kv_store.Op{Type: op.Type.String(), Key: op.Key, Value: op.Value})
+	}
+
+	for _, op := range in.Failure {
+		txn.Failure = append(txn.Failure, kv_store.Op{Type: op.Type.String(), Key: op.Key, Value: op.Value})
+	}
+
+	result, err := s.node.replicateTxn(ctx, txn, in.Client, in.Session, in.Sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protos.TxnResponse{Succeeded: result.Succeeded}, nil
+}
+
+func (s *kvServer) BatchPut(ctx context.Context, in *protos.BatchPutRequest) (*protos.BatchPutResponse, error) {
+
+	ops := make([]kv_store.Op, 0, len(in.Ops))
+	for _, op := range in.Ops {
+		ops = append(ops, kv_store.Op{Type: op.Type.String(), Key: op.Key, Value: op.Value})
+	}
+
+	result, err := s.node.replicateBatch(ctx, ops, in.Client, in.Session, in.Sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protos.BatchPutResponse{Changed: int32(len(result.Events))}, nil
+}
+
+func (s *kvServer) Watch(in *protos.WatchRequest, stream protos.KVService_WatchServer) error {
+
+	if in.Key == "" && !in.Prefix {
+		return status.Error(codes.InvalidArgument, "a key is required, unless watching a prefix")
+	}
+
+	if !in.Prefix {
+		if err := s.node.authorizeKey(stream.Context(), in.Key, PermissionRead); err != nil {
+			return err
+		}
+	}
+
+	allowed := s.node.keyFilter(stream.Context(), PermissionRead)
+
+	id, events := s.node.watches.Subscribe(in.Key, in.Prefix)
+	defer s.node.watches.Unsubscribe(id)
+
+	// Let the client know where to send its writes right away, further leader changes are
+	// then notified as they happen.
+	s.node.GetRLock("KVService Watch")
+	leader, witness, serves := s.node.leaderInfo(), s.node.isWitness(), s.node.servesQueries()
+	s.node.ReleaseRLock("KVService Watch")
+
+	if witness {
+		return status.Error(codes.FailedPrecondition, errWitness.Error())
+	}
+
+	if !serves {
+		s.node.Meta.metrics.Add("client_queries_refused_total", 1, "protocol", "grpc")
+		return status.Error(codes.FailedPrecondition, errConsensusOnly.Error())
+	}
+
+	if leader != nil {
+		if err := stream.Send(&protos.WatchEvent{Leader: leader}); err != nil {
+			return err
+		}
+	}
+
+	for {
+
+		select {
+
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+
+		case event, ok := <-events:
+
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "watcher fell behind and was cancelled")
+			}
+
+			if event.Leader == nil && allowed != nil && !allowed(event.Key) {
+				continue
+			}
+
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+
+		}
+	}
+}
+
+/*
+Replicate a transaction through the log, and wait for it to be applied to the state machine
+so that its outcome can be returned. Transactions retried within a client session are applied
+once, and get the outcome of the first attempt (see sessions.go).
+*/
+func (node *RaftNode) replicateTxn(ctx context.Context, txn kv_store.Txn, client string, session, sequence int64) (kv_store.TxnResult, error) {
+
+	if err := node.checkTxn(ctx, txn, client); err != nil {
+		return kv_store.TxnResult{}, err
+	}
+
+	return node.proposeTxn(ctx, txn, client, session, sequence)
+}
+
+// Check that the client may make the transaction: its keys must be valid, outside of the reserved
+// namespaces, and allowed by the ACLs of the caller.
+func (node *RaftNode) checkTxn(ctx context.Context, txn kv_store.Txn, client string) error {
+
+	for _, op := range append(append([]kv_store.Op{}, txn.Success...), txn.Failure...) {
+
+		validate := validateKey
+		if op.Type == kv_store.OpPut {
+			validate = validateWrittenKey
+		}
+
+		if err := validate(op.Key); err != nil {
+			return node.reject(rejectValidation, "TXN", op.Key, client, err)
+		}
+
+		if reservedKey(op.Key) {
+			return node.reject(rejectValidation, "TXN", op.Key, client, status.Errorf(codes.PermissionDenied, "key %q is reserved for the cluster settings", op.Key))
+		}
+
+		if err := node.checkFederatedWrite(op.Key); err != nil {
+			return node.reject(rejectFederation, "TXN", op.Key, client, status.Error(codes.FailedPrecondition, err.Error()))
+		}
+
+		if err := node.checkShardWrite(op.Key); err != nil {
+			return node.reject(rejectShard, "TXN", op.Key, client, shardStatus(err))
+		}
+	}
+
+	for _, c := range txn.Compare {
+		if hiddenKey(c.Key) {
+			return node.reject(rejectValidation, "TXN", c.Key, client, status.Errorf(codes.PermissionDenied, "key %q is reserved for the users", c.Key))
+		}
+
+		if err := node.authorizeKey(ctx, c.Key, PermissionRead); err != nil {
+			return node.reject(rejectACL, "TXN", c.Key, client, err)
+		}
+	}
+
+	for _, op := range append(append([]kv_store.Op{}, txn.Success...), txn.Failure...) {
+		if err := node.authorizeKey(ctx, op.Key, PermissionWrite); err != nil {
+			return node.reject(rejectACL, "TXN", op.Key, client, err)
+		}
+	}
+
+	return nil
+}
+
+// Replicate a checked transaction, see replicateTxn.
+func (node *RaftNode) proposeTxn(ctx context.Context, txn kv_store.Txn, client string, session, sequence int64) (kv_store.TxnResult, error) {
+
+	encoded, err := json.Marshal(txn)
+	if err != nil {
+		return kv_store.TxnResult{}, status.Errorf(codes.Internal, "unable to encode transaction: %v", err)
+	}
+
+	node.GetRLock("KVService Txn")
+
+	if node.state != Leader {
+		defer node.ReleaseRLock("KVService Txn")
+		return kv_store.TxnResult{}, node.reject(rejectNotLeader, "TXN", "", client, node.notLeaderError())
+	}
+
+	index, success, err := node.proposeSessionCommand(ctx, []string{"TXN", string(encoded)}, client, session, sequence) // releases the lock
+
+	switch {
+
+	case err == errNotLeader:
+		node.GetRLock("KVService Txn")
+		defer node.ReleaseRLock("KVService Txn")
+		return kv_store.TxnResult{}, node.notLeaderError()
+
+	case err == context.DeadlineExceeded || err == context.Canceled:
+		return kv_store.TxnResult{}, status.FromContextError(err).Err()
+
+	case err == errDuplicateWrite:
+		return kv_store.TxnResult{}, status.Error(codes.AlreadyExists, err.Error())
+
+	case err == errAlarmRaised:
+		return kv_store.TxnResult{}, status.Error(codes.ResourceExhausted, err.Error())
+
+	case err == errReadOnly:
+		return kv_store.TxnResult{}, status.Error(codes.FailedPrecondition, err.Error())
+
+	case status.Code(err) == codes.PermissionDenied:
+		return kv_store.TxnResult{}, err
+
+	case err == errUnknownSession || err == errStaleSequence:
+		return kv_store.TxnResult{}, status.Error(codes.FailedPrecondition, err.Error())
+
+	case !success:
+		return kv_store.TxnResult{}, status.Errorf(codes.Unavailable, "%v", err)
+
+	}
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		return kv_store.TxnResult{}, status.FromContextError(err).Err()
+	}
+
+	node.GetLock("KVService Txn")
+	defer node.ReleaseLock("KVService Txn")
+
+	result, ok := node.txn_results[index]
+	if !ok {
+		// A retried write of a session isn't applied again, but its outcome is kept in the session.
+		return node.sessionResult(session, sequence)
+	}
+
+	delete(node.txn_results, index)
+
+	return result, nil
+}
+
+// Record the outcome of an applied transaction. Must be called with the lock held.
+func (node *RaftNode) storeTxnResult(index int32, result kv_store.TxnResult) {
+
+	node.txn_results[index] = result
+
+	// Outcomes nobody waited for (e.g. the client gave up) are eventually discarded.
+	if len(node.txn_results) > maxPendingTxnResults {
+		for i := range node.txn_results {
+			if i <= index-maxPendingTxnResults {
+				delete(node.txn_results, i)
+			}
+		}
+	}
+}
+
+// Convert a change made by a transaction to the event delivered to watchers.
+func txnEventToProto(event kv_store.Event, index int32) *protos.WatchEvent {
+
+	return &protos.WatchEvent{
+		Type:  protos.KVOp_Type(protos.KVOp_Type_value[event.Type]),
+		Key:   event.Key,
+		Value: event.Value,
+		Index: index,
+	}
+}
@@ -0,0 +1,39 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the error returned by a follower carries the
+ * last known leader, with its gRPC address, and its term.
+ */
+func TestNotLeaderError(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig(), clock: NewManualClock(time.Unix(0, 0))}}
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1)}
+	node.Meta.leader_id, node.currentTerm = -1, 4
+
+	details := func() []interface{} {
+		st := status.Convert(node.notLeaderError())
+		if st.Code() != codes.Unavailable {
+			t.Errorf("Expected Unavailable, got %v", st.Code())
+		}
+		return st.Details()
+	}
+
+	if d := details(); len(d) != 1 || d[0].(*protos.LeaderInfo).Id != -1 || d[0].(*protos.LeaderInfo).Term != 4 {
+		t.Errorf("Expected an unknown leader in term 4, got %v", d)
+	}
+
+	node.Meta.leader_id, node.Meta.leaderAddress = 1, ":4001"
+
+	if d := details(); len(d) != 1 || d[0].(*protos.LeaderInfo).GrpcAddress != ":5001" || d[0].(*protos.LeaderInfo).Address != ":4001" {
+		t.Errorf("Expected leader 1 at :5001, got %v", d)
+	}
+}
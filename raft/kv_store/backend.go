@@ -0,0 +1,195 @@
+package kv_store
+
+import (
+	"fmt"
+
+	"github.com/google/btree"
+)
+
+/*
+Storage backends of the store. The keys, their current values (in their stored form, see
+compress.go) and their history are held by a backend, chosen when the store is opened:
+
+	map   the keys are held in memory, in a hash map and an ordered index, and the whole store is
+	      rewritten to its file on every change. This is the default.
+	bolt  the keys are held in a bbolt database, in the file "<filename>.db", to which each change
+	      is committed as a single transaction (see bolt.go). The store then needn't fit in memory,
+	      and a change doesn't rewrite the whole store.
+
+Both backends hold the same state, so the digests and snapshots of a store don't depend on its
+backend, and the replicas of a cluster may use different ones.
+*/
+
+const (
+	BackendMap  = "map"
+	BackendBolt = "bolt"
+)
+
+// The storage of the keys and their history. The methods are called with kv.mu held, exclusively
+// for the ones making changes, which are only made durable by persist.
+type backend interface {
+	lookup(key string) (string, bool)                          // Stored value of the key, if it exists
+	set(key, stored string)                                    // Create or overwrite the key
+	remove(key string) bool                                    // Delete the key, returning whether it existed
+	ascend(start string, fn func(key, stored string) bool)     // Visit the keys >= start in order, while fn returns true
+	versions(key string) []version                             // History of the key, oldest first
+	setVersions(key string, versions []version)                // Replace the history of the key, removing it if empty
+	eachVersions(fn func(key string, versions []version) bool) // Visit the history of every key, in no particular order
+	hasHistory(key string) bool                                // Whether the key has a history
+	reset()                                                    // Remove all the keys and their history
+	load() (revision, compacted int64, ok bool)                // The persisted revisions, if the backend persists them
+	dump(revision, compacted int64) *persistedStore            // The state of the store, as persisted by the map backend
+	persist(revision, compacted int64) error                   // Make the changes durable
+	close() error
+}
+
+// Open the backend of the store with the given name.
+func openBackend(name, filename string) (backend, error) {
+
+	switch name {
+
+	case "", BackendMap:
+		return newMapBackend(filename), nil
+
+	case BackendBolt:
+		return openBoltBackend(filename + ".db")
+
+	}
+
+	return nil, fmt.Errorf("unknown store backend %q, expected %v or %v", name, BackendMap, BackendBolt)
+}
+
+// The in-memory backend: a chained hash map of the keys (see hashmap.go), along with an ordered
+// index for the range queries.
+type mapBackend struct {
+	filename string
+	db       [length]*Linkedlist
+	db_temp  map[string]string    // Current values, as persisted ("" for the deleted keys)
+	index    *btree.BTree         // Ordered index of the keys present in db, used for range queries
+	history  map[string][]version // Recent versions of each key, oldest first
+}
+
+func newMapBackend(filename string) *mapBackend {
+
+	return &mapBackend{
+		filename: filename,
+		db_temp:  make(map[string]string),
+		index:    btree.New(32),
+		history:  make(map[string][]version),
+	}
+}
+
+func (b *mapBackend) set(key, stored string) {
+
+	if !b.update(key, stored) {
+		b.push(key, stored)
+	}
+
+	b.db_temp[key] = stored
+}
+
+func (b *mapBackend) remove(key string) bool {
+
+	if !b.delete(key) {
+		return false
+	}
+
+	b.db_temp[key] = ""
+	return true
+}
+
+func (b *mapBackend) ascend(start string, fn func(key, stored string) bool) {
+
+	b.index.AscendGreaterOrEqual(indexKey(start), func(item btree.Item) bool {
+		key := string(item.(indexKey))
+		stored, _ := b.lookup(key)
+		return fn(key, stored)
+	})
+}
+
+func (b *mapBackend) versions(key string) []version {
+	return b.history[key]
+}
+
+func (b *mapBackend) setVersions(key string, versions []version) {
+
+	if len(versions) == 0 {
+		delete(b.history, key)
+		return
+	}
+
+	b.history[key] = versions
+}
+
+func (b *mapBackend) eachVersions(fn func(key string, versions []version) bool) {
+
+	for key, versions := range b.history {
+		if !fn(key, versions) {
+			return
+		}
+	}
+}
+
+func (b *mapBackend) hasHistory(key string) bool {
+	_, ok := b.history[key]
+	return ok
+}
+
+func (b *mapBackend) reset() {
+	*b = *newMapBackend(b.filename)
+}
+
+func (b *mapBackend) dump(revision, compacted int64) *persistedStore {
+
+	return &persistedStore{
+		Data:      b.db_temp,
+		Revision:  revision,
+		Compacted: compacted,
+		History:   b.history,
+	}
+}
+
+func (b *mapBackend) persist(revision, compacted int64) error {
+	return writeFile(b.filename, b.dump(revision, compacted))
+}
+
+// The map backend is loaded from its file by the store, see readFile.
+func (b *mapBackend) load() (int64, int64, bool) {
+	return 0, 0, false
+}
+
+func (b *mapBackend) close() error {
+	return nil
+}
+
+//Push is to create new key, or overwrite it
+func (kv *store) Push(key, value string) {
+	kv.data.set(key, value)
+}
+
+//Get is to return key
+func (kv *store) Get(key string) string {
+	return decodeValue(kv.lookup(key))
+}
+
+//lookup is to return the stored form of the value of key, see compress.go
+func (kv *store) lookup(key string) string {
+	if stored, ok := kv.data.lookup(key); ok {
+		return stored
+	}
+	return "Invalid"
+}
+
+//Put is to update key
+func (kv *store) Put(key, value string) bool {
+	if _, ok := kv.data.lookup(key); !ok {
+		return false
+	}
+	kv.data.set(key, value)
+	return true
+}
+
+//Delete the key
+func (kv *store) Delete(key string) bool {
+	return kv.data.remove(key)
+}
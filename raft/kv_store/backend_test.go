@@ -0,0 +1,168 @@
+package kv_store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * This test case checks that the bolt backend holds the same state as the map
+ * backend, that its changes survive reopening the store and that the pending
+ * ones are discarded if not persisted, and that a bolt store imports the file
+ * of the map backend it replaces.
+ */
+func TestBoltBackend(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "6000")
+
+	ops := []Op{
+		{Type: OpPut, Key: "a", Value: "1"},
+		{Type: OpPut, Key: "b", Value: "2"},
+		{Type: OpPut, Key: "c", Value: "3"},
+		{Type: OpDelete, Key: "a"},
+		{Type: OpPut, Key: "b", Value: "\x00binary"},
+	}
+
+	kv, err := OpenStore(filename, BackendMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bolt, err := OpenStore(filepath.Join(dir, "6001"), BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range ops {
+		kv.applyEntry([]Op{op})
+		bolt.applyEntry([]Op{op})
+	}
+	kv.Persist()
+	bolt.Persist()
+
+	if bolt.digest() != kv.digest() {
+		t.Fatalf("Expected the digest %v of the map backend, got %v", kv.digest(), bolt.digest())
+	}
+
+	kvs, _ := bolt.Range("", "", 10)
+	if len(kvs) != 2 || kvs[0].Key != "b" || kvs[0].Value != "\x00binary" || kvs[1].Key != "c" {
+		t.Errorf("Unexpected range %v", kvs)
+	}
+
+	if value, ok, _ := bolt.getAt("a", 1); !ok || value != "1" {
+		t.Errorf("Expected a = 1 at revision 1, got %q (%v)", value, ok)
+	}
+
+	// Changes not persisted are lost when the store is closed.
+	bolt.applyEntry([]Op{{Type: OpPut, Key: "d", Value: "4"}})
+	if err := bolt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenStore(filepath.Join(dir, "6001"), BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reopened.digest() != kv.digest() {
+		t.Errorf("Expected the digest %v after reopening, got %v", kv.digest(), reopened.digest())
+	}
+
+	if reopened.Get("d") != "Invalid" {
+		t.Errorf("Expected the unpersisted key d to be discarded, got %q", reopened.Get("d"))
+	}
+
+	reopened.compact(3)
+	reopened.Persist()
+
+	if _, _, err := reopened.getAt("a", 2); err == nil {
+		t.Errorf("Expected a read below the compaction revision to fail")
+	}
+	reopened.Close()
+
+	// A bolt store opened over the file of a map store imports it.
+	imported, err := OpenStore(filename, BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer imported.Close()
+
+	if imported.digest() != kv.digest() {
+		t.Errorf("Expected the digest %v of the imported store, got %v", kv.digest(), imported.digest())
+	}
+
+	if _, err := os.Stat(filename + ".db"); err != nil {
+		t.Errorf("Expected the database of the bolt store: %v", err)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Expected the imported file to be removed, got %v", err)
+	}
+}
+
+/*
+ * This test case checks that migrating a store between the backends keeps its
+ * state, and removes the files of the backend it is migrated from.
+ */
+func TestMigrateStore(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "6000")
+
+	kv, err := OpenStore(filename, BackendMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv.applyEntry([]Op{{Type: OpPut, Key: "a", Value: "1"}})
+	kv.applyEntry([]Op{{Type: OpPut, Key: "a", Value: "2"}})
+	kv.applyEntry([]Op{{Type: OpPut, Key: "b", Value: "3"}})
+	kv.Persist()
+
+	if _, err := MigrateStore(filename, BackendBolt, BackendMap); err == nil {
+		t.Errorf("Expected the migration of a missing bolt store to fail")
+	}
+
+	if _, err := MigrateStore(filename, BackendMap, BackendMap); err == nil {
+		t.Errorf("Expected a migration to the same backend to fail")
+	}
+
+	for _, backends := range [][2]string{{BackendMap, BackendBolt}, {BackendBolt, BackendMap}, {BackendMap, BackendBolt}} {
+
+		digest, err := MigrateStore(filename, backends[0], backends[1])
+		if err != nil {
+			t.Fatalf("Unable to migrate from %v to %v: %v", backends[0], backends[1], err)
+		}
+
+		if digest != kv.digest() {
+			t.Errorf("Expected the digest %v after migrating to %v, got %v", kv.digest(), backends[1], digest)
+		}
+
+		if _, err := os.Stat(backendFile(filename, backends[0])); !os.IsNotExist(err) {
+			t.Errorf("Expected the %v store to be removed, got %v", backends[0], err)
+		}
+	}
+
+	migrated, err := OpenStore(filename, BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrated.Close()
+
+	if value, ok, _ := migrated.getAt("a", 1); migrated.digest() != kv.digest() || !ok || value != "1" {
+		t.Errorf("Expected the migrated store to keep the history, got a = %q (%v) at revision 1", value, ok)
+	}
+}
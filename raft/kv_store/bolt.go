@@ -0,0 +1,320 @@
+package kv_store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+The bolt backend, holding the store in a bbolt database. The current values are held in the "keys"
+bucket, in their stored form, and the history of each key in the "history" bucket, encoded by
+encodeVersions. The revisions of the store are held in the "meta" bucket.
+
+The changes made between two calls to persist are made in a single write transaction, opened by the
+first of them, so that a change is durable once persisted, and an interrupted one leaves the
+database as it was.
+*/
+
+var (
+	keysBucket    = []byte("keys")
+	historyBucket = []byte("history")
+	metaBucket    = []byte("meta")
+
+	revisionKey  = []byte("revision")
+	compactedKey = []byte("compacted")
+)
+
+type boltBackend struct {
+	db *bolt.DB
+	tx *bolt.Tx // Write transaction of the changes not yet persisted, if any
+}
+
+func openBoltBackend(path string) (*boltBackend, error) {
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{keysBucket, historyBucket, metaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltBackend{db: db}, nil
+}
+
+// Return the write transaction of the pending changes, opening it if needed.
+func (b *boltBackend) writeTx() *bolt.Tx {
+
+	if b.tx == nil {
+
+		tx, err := b.db.Begin(true)
+		if err != nil {
+			panic(err) // the database was closed
+		}
+
+		b.tx = tx
+	}
+
+	return b.tx
+}
+
+// Run fn in a read transaction, seeing the pending changes.
+func (b *boltBackend) view(fn func(tx *bolt.Tx)) {
+
+	if b.tx != nil {
+		fn(b.tx)
+		return
+	}
+
+	b.db.View(func(tx *bolt.Tx) error {
+		fn(tx)
+		return nil
+	})
+}
+
+func (b *boltBackend) lookup(key string) (stored string, ok bool) {
+
+	b.view(func(tx *bolt.Tx) {
+		if v := tx.Bucket(keysBucket).Get([]byte(key)); v != nil {
+			stored, ok = string(v), true
+		}
+	})
+
+	return stored, ok
+}
+
+func (b *boltBackend) set(key, stored string) {
+	b.writeTx().Bucket(keysBucket).Put([]byte(key), []byte(stored))
+}
+
+func (b *boltBackend) remove(key string) bool {
+
+	bucket := b.writeTx().Bucket(keysBucket)
+
+	if bucket.Get([]byte(key)) == nil {
+		return false
+	}
+
+	bucket.Delete([]byte(key))
+	return true
+}
+
+func (b *boltBackend) ascend(start string, fn func(key, stored string) bool) {
+
+	b.view(func(tx *bolt.Tx) {
+
+		c := tx.Bucket(keysBucket).Cursor()
+
+		for k, v := c.Seek([]byte(start)); k != nil; k, v = c.Next() {
+			if !fn(string(k), string(v)) {
+				return
+			}
+		}
+	})
+}
+
+func (b *boltBackend) versions(key string) (versions []version) {
+
+	b.view(func(tx *bolt.Tx) {
+		versions = decodeVersions(tx.Bucket(historyBucket).Get([]byte(key)))
+	})
+
+	return versions
+}
+
+func (b *boltBackend) setVersions(key string, versions []version) {
+
+	bucket := b.writeTx().Bucket(historyBucket)
+
+	if len(versions) == 0 {
+		bucket.Delete([]byte(key))
+		return
+	}
+
+	bucket.Put([]byte(key), encodeVersions(versions))
+}
+
+func (b *boltBackend) eachVersions(fn func(key string, versions []version) bool) {
+
+	b.view(func(tx *bolt.Tx) {
+
+		c := tx.Bucket(historyBucket).Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !fn(string(k), decodeVersions(v)) {
+				return
+			}
+		}
+	})
+}
+
+func (b *boltBackend) hasHistory(key string) (ok bool) {
+
+	b.view(func(tx *bolt.Tx) {
+		ok = tx.Bucket(historyBucket).Get([]byte(key)) != nil
+	})
+
+	return ok
+}
+
+func (b *boltBackend) reset() {
+
+	tx := b.writeTx()
+
+	for _, name := range [][]byte{keysBucket, historyBucket} {
+		tx.DeleteBucket(name)
+		tx.CreateBucket(name)
+	}
+}
+
+func (b *boltBackend) load() (revision, compacted int64, ok bool) {
+
+	b.view(func(tx *bolt.Tx) {
+
+		meta := tx.Bucket(metaBucket)
+
+		if v := meta.Get(revisionKey); len(v) == 8 {
+			revision, ok = int64(binary.BigEndian.Uint64(v)), true
+		}
+
+		if v := meta.Get(compactedKey); len(v) == 8 {
+			compacted = int64(binary.BigEndian.Uint64(v))
+		}
+	})
+
+	return revision, compacted, ok
+}
+
+func (b *boltBackend) dump(revision, compacted int64) *persistedStore {
+
+	persisted := &persistedStore{
+		Data:      make(map[string]string),
+		Revision:  revision,
+		Compacted: compacted,
+		History:   make(map[string][]version),
+	}
+
+	b.ascend("", func(key, stored string) bool {
+		persisted.Data[key] = stored
+		return true
+	})
+
+	b.eachVersions(func(key string, versions []version) bool {
+		persisted.History[key] = versions
+		return true
+	})
+
+	return persisted
+}
+
+func (b *boltBackend) persist(revision, compacted int64) error {
+
+	tx := b.writeTx()
+	b.tx = nil
+
+	meta := tx.Bucket(metaBucket)
+
+	// The values must remain valid until the transaction is committed.
+	for key, value := range map[string]int64{string(revisionKey): revision, string(compactedKey): compacted} {
+
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(value))
+
+		if err := meta.Put([]byte(key), buf); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (b *boltBackend) close() error {
+
+	if b.tx != nil {
+		b.tx.Rollback()
+		b.tx = nil
+	}
+
+	return b.db.Close()
+}
+
+// Encode the history of a key: for each version, its revision as a uvarint, a byte set if it is a
+// deletion, then the length of its value as a uvarint and the value.
+func encodeVersions(versions []version) []byte {
+
+	var buf bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+
+	for _, v := range versions {
+
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(v.Revision))])
+
+		if v.Deleted {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(v.Value)))])
+		buf.WriteString(v.Value)
+	}
+
+	return buf.Bytes()
+}
+
+var errCorruptHistory = errors.New("corrupt history")
+
+// Decode the history of a key encoded by encodeVersions, nil if empty.
+func decodeVersions(data []byte) []version {
+
+	var versions []version
+
+	for len(data) > 0 {
+
+		v, err := decodeVersion(&data)
+		if err != nil {
+			panic(err) // only written by encodeVersions
+		}
+
+		versions = append(versions, v)
+	}
+
+	return versions
+}
+
+func decodeVersion(data *[]byte) (version, error) {
+
+	revision, n := binary.Uvarint(*data)
+	if n <= 0 || n >= len(*data) {
+		return version{}, errCorruptHistory
+	}
+
+	deleted := (*data)[n] == 1
+	*data = (*data)[n+1:]
+
+	length, n := binary.Uvarint(*data)
+	if n <= 0 || uint64(len(*data)-n) < length {
+		return version{}, errCorruptHistory
+	}
+
+	value := string((*data)[n : n+int(length)])
+	*data = (*data)[n+int(length):]
+
+	return version{Revision: int64(revision), Value: value, Deleted: deleted}, nil
+}
@@ -0,0 +1,201 @@
+package kv_store
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+/*
+Compression of the values of the store. The values of the keys with one of the configured prefixes,
+at least Threshold bytes long, are compressed with zstd when written, and decompressed when read:
+the current values, their history and the persisted file (and so the snapshots) hold the compressed
+form, while clients, transactions, watches and the digest only see the values themselves. A value
+is only kept compressed if that makes it smaller.
+
+A stored value starting with a NUL byte is encoded: compressedMarker is followed by the length of
+the value and its zstd frame, and rawMarker by the value itself, so that values starting with a
+NUL byte are told apart. Changing the configuration only affects the values written afterwards.
+The values compressed with DEFLATE by earlier versions (deflateMarker) are still read.
+*/
+
+const (
+	compressedMarker = "\x00s"
+	deflateMarker    = "\x00z"
+	rawMarker        = "\x00r"
+)
+
+// The values compressed by the store, as configured by the replica (see CompressionHandler).
+type CompressionConfig struct {
+	Prefixes  []string `json:"prefixes"`  // Keys whose values are compressed, none if empty
+	Threshold int      `json:"threshold"` // Minimum size of the compressed values
+}
+
+// The compressed values of the keys with a given prefix, as reported in the usage of the store.
+type CompressionStats struct {
+	Prefix      string `json:"prefix"` // Longest configured prefix of the keys, empty if none (e.g. no longer configured)
+	Values      int    `json:"values"`
+	RawBytes    int64  `json:"raw_bytes"`
+	StoredBytes int64  `json:"stored_bytes"`
+}
+
+// The zstd encoder and decoder are shared, as EncodeAll and DecodeAll may be called concurrently.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// Return the longest configured prefix of the key, and whether there is one. Must be called with kv.mu held.
+func (kv *store) compressionPrefix(key string) (string, bool) {
+
+	longest, found := "", false
+
+	for _, prefix := range kv.compression.Prefixes {
+		if strings.HasPrefix(key, prefix) && (!found || len(prefix) > len(longest)) {
+			longest, found = prefix, true
+		}
+	}
+
+	return longest, found
+}
+
+// Return the stored form of a value written to the key. Must be called with kv.mu held.
+func (kv *store) encodeValue(key, value string) string {
+
+	if _, ok := kv.compressionPrefix(key); !ok || len(value) < kv.compression.Threshold || value == "" {
+		return escapeValue(value)
+	}
+
+	buf := make([]byte, len(compressedMarker), len(compressedMarker)+binary.MaxVarintLen64+len(value)/2)
+	copy(buf, compressedMarker)
+
+	var length [binary.MaxVarintLen64]byte
+	buf = append(buf, length[:binary.PutUvarint(length[:], uint64(len(value)))]...)
+	buf = zstdEncoder.EncodeAll([]byte(value), buf)
+
+	if len(buf) >= len(value) {
+		return escapeValue(value)
+	}
+
+	return string(buf)
+}
+
+// Return the stored form of an uncompressed value.
+func escapeValue(value string) string {
+
+	if strings.HasPrefix(value, "\x00") {
+		return rawMarker + value
+	}
+
+	return value
+}
+
+// Return the value of its stored form.
+func decodeValue(stored string) string {
+
+	switch {
+
+	case strings.HasPrefix(stored, compressedMarker):
+
+		length, n := binary.Uvarint([]byte(stored[len(compressedMarker):]))
+
+		value, err := zstdDecoder.DecodeAll([]byte(stored[len(compressedMarker)+n:]), make([]byte, 0, length))
+		if err != nil || uint64(len(value)) != length {
+			logging.Logger.Error().Str("component", "kv_store").Err(err).Msg("Unable to decompress a value")
+		}
+
+		return string(value)
+
+	case strings.HasPrefix(stored, deflateMarker):
+
+		length, n := binary.Uvarint([]byte(stored[len(deflateMarker):]))
+		r := flate.NewReader(strings.NewReader(stored[len(deflateMarker)+n:]))
+		defer r.Close()
+
+		value, err := ioutil.ReadAll(r)
+		if err != nil || uint64(len(value)) != length {
+			logging.Logger.Error().Str("component", "kv_store").Err(err).Msg("Unable to decompress a value")
+		}
+
+		return string(value)
+
+	case strings.HasPrefix(stored, rawMarker):
+		return stored[len(rawMarker):]
+
+	}
+
+	return stored
+}
+
+// Return the length of the value compressed in its stored form, and whether it is compressed.
+func compressedLength(stored string) (int64, bool) {
+
+	if !strings.HasPrefix(stored, compressedMarker) && !strings.HasPrefix(stored, deflateMarker) {
+		return 0, false
+	}
+
+	// Both markers are as long.
+	length, _ := binary.Uvarint([]byte(stored[len(compressedMarker):]))
+	return int64(length), true
+}
+
+// Compute the compression of the current values, by configured prefix. Must be called with kv.mu held.
+func (kv *store) compressionStats() []CompressionStats {
+
+	stats := make(map[string]*CompressionStats)
+
+	kv.data.ascend("", func(key, stored string) bool {
+
+		length, ok := compressedLength(stored)
+		if !ok {
+			return true
+		}
+
+		prefix, _ := kv.compressionPrefix(key)
+		if stats[prefix] == nil {
+			stats[prefix] = &CompressionStats{Prefix: prefix}
+		}
+
+		stats[prefix].Values++
+		stats[prefix].RawBytes += length
+		stats[prefix].StoredBytes += int64(len(stored))
+
+		return true
+	})
+
+	list := make([]CompressionStats, 0, len(stats))
+	for _, s := range stats {
+		list = append(list, *s)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Prefix < list[j].Prefix })
+
+	return list
+}
+
+// handles requests changing the compression of the values, with the CompressionConfig as JSON in the body
+func (kv *store) CompressionHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("COMPRESSION request received")
+
+	var config CompressionConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid compression configuration: %v\n", err)
+		return
+	}
+
+	kv.mu.Lock()
+	kv.compression = config
+	kv.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,116 @@
+package kv_store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+/*
+ * This test case checks that the values of the configured prefixes are stored
+ * compressed, that reads, historical reads and snapshots see the values
+ * themselves, and that the digest doesn't depend on the compression.
+ */
+func TestCompression(t *testing.T) {
+
+	large := strings.Repeat("www.example.com. 300 IN A 192.0.2.1\n", 50)
+
+	ops := []Op{
+		{Type: OpPut, Key: "dns:a", Value: large},
+		{Type: OpPut, Key: "dns:b", Value: "short"},
+		{Type: OpPut, Key: "app.c", Value: large},
+		{Type: OpPut, Key: "dns:d", Value: "\x00z not compressed"},
+		{Type: OpPut, Key: "dns:a", Value: large + "v2"},
+	}
+
+	kv, plain := newStore(""), newStore("")
+	kv.compression = CompressionConfig{Prefixes: []string{"dns:"}, Threshold: 64}
+
+	for _, op := range ops {
+		kv.applyEntry([]Op{op})
+		plain.applyEntry([]Op{op})
+	}
+
+	if _, compressed := compressedLength(kv.lookup("dns:a")); !compressed || len(kv.lookup("dns:a")) >= len(large) {
+		t.Errorf("Expected the value of dns:a to be stored compressed, got %v bytes", len(kv.lookup("dns:a")))
+	}
+
+	for key, stored := range map[string]string{"dns:b": "short", "app.c": large, "dns:d": rawMarker + "\x00z not compressed"} {
+		if kv.lookup(key) != stored {
+			t.Errorf("Expected the value of %v to be stored as %q, got %q", key, stored, kv.lookup(key))
+		}
+	}
+
+	for _, key := range []string{"dns:a", "dns:b", "app.c", "dns:d"} {
+		if kv.Get(key) != plain.Get(key) {
+			t.Errorf("Expected %v to read %q, got %q", key, plain.Get(key), kv.Get(key))
+		}
+	}
+
+	if value, exists, err := kv.getAt("dns:a", 1); err != nil || !exists || value != large {
+		t.Errorf("Expected the first version of dns:a at revision 1, got %v bytes (%v, %v)", len(value), exists, err)
+	}
+
+	if kv.digest() != plain.digest() {
+		t.Errorf("Expected the digest not to depend on the compression")
+	}
+
+	u := kv.usage()
+	if len(u.Compression) != 1 || u.Compression[0].Prefix != "dns:" || u.Compression[0].Values != 1 || u.Compression[0].RawBytes != int64(len(large)+2) || u.Compression[0].StoredBytes != int64(len(kv.lookup("dns:a"))) {
+		t.Errorf("Unexpected compression stats %+v", u.Compression)
+	}
+
+	if u.Bytes >= plain.usage().Bytes {
+		t.Errorf("Expected the compressed store to be smaller, got %v bytes against %v", u.Bytes, plain.usage().Bytes)
+	}
+
+	// Snapshots hold the compressed values, which are read back by stores without compression.
+	var snapshot bytes.Buffer
+	if err := kv.encode(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := VerifySnapshot(bytes.NewReader(snapshot.Bytes()))
+	if err != nil || digest != plain.digest() {
+		t.Errorf("Expected the snapshot to have the digest of the store, got %v (%v)", digest, err)
+	}
+
+	var restored persistedStore
+	if err := gob.NewDecoder(&snapshot).Decode(&restored); err != nil {
+		t.Fatal(err)
+	}
+
+	scratch := newStore("")
+	scratch.restore(&restored)
+
+	if scratch.Get("dns:a") != large+"v2" || scratch.Get("dns:d") != "\x00z not compressed" {
+		t.Errorf("Expected the restored store to read the values")
+	}
+}
+
+// This test case checks that the values compressed with DEFLATE by earlier versions are still read.
+func TestDeflateValues(t *testing.T) {
+
+	value := strings.Repeat("www.example.com. 300 IN A 192.0.2.1\n", 50)
+
+	var buf bytes.Buffer
+	buf.WriteString(deflateMarker)
+
+	var length [binary.MaxVarintLen64]byte
+	buf.Write(length[:binary.PutUvarint(length[:], uint64(len(value)))])
+
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write([]byte(value))
+	w.Close()
+
+	if decoded := decodeValue(buf.String()); decoded != value {
+		t.Errorf("Expected the DEFLATE value to be read, got %q", decoded)
+	}
+
+	if raw, ok := compressedLength(buf.String()); !ok || raw != int64(len(value)) {
+		t.Errorf("Expected the DEFLATE value to count as compressed, got %v %v", raw, ok)
+	}
+}
@@ -0,0 +1,135 @@
+package kv_store
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+/*
+Digests of the state of the store, used for checking the integrity of snapshots. The digest is a
+SHA-256 hash of the keys and (decompressed) values present in the store, in key order, followed by the revision,
+the compaction revision and the retained history. Unlike a hash of the persisted form (whose map
+encoding isn't deterministic), it's the same on every replica that applied the same entries, whether
+or not they compress the values.
+*/
+
+// The digest of the store at a given revision.
+type Digest struct {
+	Revision int64  `json:"revision"`
+	Digest   string `json:"digest"` // Hex encoded SHA-256 hash of the state
+}
+
+// Write a length prefixed string, so that distinct sequences of strings don't hash the same.
+func writeString(w io.Writer, s string) {
+	binary.Write(w, binary.BigEndian, int64(len(s)))
+	io.WriteString(w, s)
+}
+
+// Compute the digest of the store. Must be called with kv.mu held.
+func (kv *store) digest() Digest {
+
+	h := sha256.New()
+
+	kv.data.ascend("", func(key, stored string) bool {
+		writeString(h, key)
+		writeString(h, decodeValue(stored))
+		return true
+	})
+
+	binary.Write(h, binary.BigEndian, kv.revision)
+	binary.Write(h, binary.BigEndian, kv.compacted)
+
+	keys := make([]string, 0)
+	kv.data.eachVersions(func(key string, _ []version) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		writeString(h, key)
+
+		for _, v := range kv.data.versions(key) {
+			binary.Write(h, binary.BigEndian, v.Revision)
+			writeString(h, decodeValue(v.Value))
+			binary.Write(h, binary.BigEndian, v.Deleted)
+		}
+	}
+
+	return Digest{Revision: kv.revision, Digest: hex.EncodeToString(h.Sum(nil))}
+}
+
+// Check that the persisted state is consistent: revisions only increase, and the latest
+// version of each key agrees with its current value.
+func (persisted *persistedStore) check() error {
+
+	if persisted.Compacted > persisted.Revision {
+		return fmt.Errorf("compaction revision %v is newer than the revision %v", persisted.Compacted, persisted.Revision)
+	}
+
+	for key, versions := range persisted.History {
+
+		for i, v := range versions {
+
+			if v.Revision > persisted.Revision || (i > 0 && v.Revision <= versions[i-1].Revision) {
+				return fmt.Errorf("invalid revision %v in the history of key %q", v.Revision, key)
+			}
+		}
+
+		if len(versions) == 0 {
+			continue
+		}
+
+		latest := versions[len(versions)-1]
+		value := persisted.Data[key]
+
+		if (latest.Deleted && value != "") || (!latest.Deleted && value != latest.Value) {
+			return fmt.Errorf("value of key %q doesn't match its latest version %v", key, latest.Revision)
+		}
+	}
+
+	return nil
+}
+
+// Load a snapshot (as returned by SnapshotHandler) into a scratch store, check its consistency
+// and return its digest.
+func VerifySnapshot(r io.Reader) (Digest, error) {
+
+	var persisted persistedStore
+	if err := gob.NewDecoder(r).Decode(&persisted); err != nil {
+		return Digest{}, fmt.Errorf("invalid snapshot: %v", err)
+	}
+
+	if err := persisted.check(); err != nil {
+		return Digest{}, fmt.Errorf("inconsistent snapshot: %v", err)
+	}
+
+	kv := newStore("")
+	kv.restore(&persisted)
+
+	return kv.digest(), nil
+}
+
+// handles digest requests, returning the digest of the current state of the store
+func (kv *store) DigestHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("DIGEST request received")
+
+	kv.mu.RLock()
+	digest := kv.digest()
+	kv.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	json.NewEncoder(w).Encode(digest)
+}
@@ -0,0 +1,63 @@
+package kv_store
+
+import (
+	"bytes"
+	"testing"
+)
+
+/*
+ * This test case checks that a snapshot loaded into a scratch store has the
+ * digest of the store it was taken from, that the digest covers the history of
+ * the store and not only its current values, and that inconsistent snapshots
+ * are rejected.
+ */
+func TestVerifySnapshot(t *testing.T) {
+
+	apply := func(kv *store, ops ...Op) {
+		for _, op := range ops {
+			kv.applyEntry([]Op{op})
+		}
+	}
+
+	kv := newStore("")
+	apply(kv, Op{Type: OpPut, Key: "a", Value: "1"}, Op{Type: OpPut, Key: "b", Value: "2"}, Op{Type: OpDelete, Key: "a"})
+
+	var snapshot bytes.Buffer
+	if err := kv.encode(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := VerifySnapshot(&snapshot)
+	if err != nil {
+		t.Fatalf("Valid snapshot rejected: %v", err)
+	}
+
+	if digest != kv.digest() {
+		t.Errorf("Expected the digest %v of the store, got %v", kv.digest(), digest)
+	}
+
+	other := newStore("")
+	apply(other, Op{Type: OpPut, Key: "b", Value: "2"}, Op{Type: OpPut, Key: "a", Value: "1"}, Op{Type: OpDelete, Key: "a"})
+
+	if other.digest() == kv.digest() {
+		t.Errorf("Expected stores with different histories to have different digests")
+	}
+
+	apply(other, Op{Type: OpPut, Key: "c", Value: "3"})
+	if other.digest().Revision != 4 {
+		t.Errorf("Expected the digest to carry revision 4, got %v", other.digest().Revision)
+	}
+
+	// The latest version of a key disagrees with its value.
+	kv.data.(*mapBackend).db_temp["b"] = "tampered"
+	snapshot.Reset()
+	kv.encode(&snapshot)
+
+	if _, err := VerifySnapshot(&snapshot); err == nil {
+		t.Errorf("Expected an inconsistent snapshot to be rejected")
+	}
+
+	if _, err := VerifySnapshot(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Errorf("Expected an invalid snapshot to be rejected")
+	}
+}
@@ -19,40 +19,41 @@ func hash(str string) int {
 	return res
 }
 
-//Push is to create new key
-func (kv *store) Push(key, value string) {
+//push is to create new key
+func (b *mapBackend) push(key, value string) {
 	id := hash(key)
-	if kv.db[id] == nil {
-		kv.db[id] = newLinkedList()
+	if b.db[id] == nil {
+		b.db[id] = newLinkedList()
 	}
-	kv.db[id].add(key, value)
+	b.db[id].add(key, value)
+	b.index.ReplaceOrInsert(indexKey(key))
 }
 
-//Get is to return key
-func (kv *store) Get(key string) string {
+//lookup is to return the stored form of the value of key, see compress.go
+func (b *mapBackend) lookup(key string) (string, bool) {
 	id := hash(key)
-	if kv.db[id] == nil {
-		return "Invalid"
+	if b.db[id] == nil {
+		return "", false
 	}
-	newNode := kv.db[id].Head
+	newNode := b.db[id].Head
 	for {
 		if newNode == nil {
 			break
 		} else if newNode.Key == key {
-			return newNode.Data
+			return newNode.Data, true
 		}
 		newNode = newNode.Next
 	}
-	return "Invalid"
+	return "", false
 }
 
-//Put is to update key
-func (kv *store) Put(key, value string) bool {
+//update is to update key
+func (b *mapBackend) update(key, value string) bool {
 	id := hash(key)
-	if kv.db[id] == nil {
+	if b.db[id] == nil {
 		return false
 	}
-	newNode := kv.db[id].Head
+	newNode := b.db[id].Head
 	for {
 		if newNode == nil {
 			break
@@ -65,12 +66,15 @@ func (kv *store) Put(key, value string) bool {
 	return false
 }
 
-//Delete the key
-func (kv *store) Delete(key string) bool {
+//delete the key
+func (b *mapBackend) delete(key string) bool {
 	id := hash(key)
-	if kv.db[id] == nil {
+	if b.db[id] == nil {
 		return false
 	}
-	check := kv.db[id].remove(key)
+	check := b.db[id].remove(key)
+	if check {
+		b.index.Delete(indexKey(key))
+	}
 	return check
 }
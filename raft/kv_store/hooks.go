@@ -0,0 +1,116 @@
+package kv_store
+
+import (
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+/*
+Hooks maintaining data derived from the keys of the store, e.g. an index of the DNS names, secondary
+indexes or counters. A hook is called with the changes made by each write (a POST, PUT, DELETE,
+transaction or prefix deletion) to the keys with its Prefix, and returns the writes updating the keys
+it derives from them. They are applied while the store is still locked, with the same persist as the
+write itself: a reader never sees the write without its derived writes, and since the derived keys
+are held by the store, they are part of its history, snapshots and digests like any other key.
+Derived data thus can't drift from the data it is derived from, whether a replica applies the log,
+restarts or is restored from a snapshot.
+
+Every replica applies the writes of the hooks, so the hooks must be deterministic, only depending on
+the changes and the view of the store they are passed, and every replica must register the same
+hooks. A hook only writes the keys with its Derived prefix, its other writes being ignored, and isn't
+called with the changes made by the hooks. The derived writes aren't reported in the result of the
+write. The hooks only see the writes applied after they are registered: the keys written before are
+indexed once they are written again. As for the other keys, the snapshots drop the derived keys with
+empty values, so they should hold one.
+*/
+
+// A hook called with the changes of the writes to the store.
+type Hook struct {
+	Name    string                               // Name of the hook, in the logs
+	Prefix  string                               // Keys whose changes are passed to the hook, all of them if empty
+	Derived string                               // Prefix of the keys written by the hook, which can't be empty
+	Apply   func(view View, events []Event) []Op // Return the writes to the derived keys
+}
+
+// The state of the store seen by the hooks, including the changes they are called with.
+type View interface {
+
+	// Return the current value of the key, and whether it exists.
+	Get(key string) (string, bool)
+
+	// Call fn with the keys with the prefix and their values, in key order, until it returns false.
+	Ascend(prefix string, fn func(key, value string) bool)
+}
+
+// The view of the store, used with kv.mu held.
+type storeView struct {
+	kv *store
+}
+
+func (v storeView) Get(key string) (string, bool) {
+
+	stored, ok := v.kv.data.lookup(key)
+	if !ok {
+		return "", false
+	}
+
+	return decodeValue(stored), true
+}
+
+func (v storeView) Ascend(prefix string, fn func(key, value string) bool) {
+
+	v.kv.data.ascend(prefix, func(key, stored string) bool {
+		return strings.HasPrefix(key, prefix) && fn(key, decodeValue(stored))
+	})
+}
+
+// Register the hook, called with the changes of the later writes.
+func (kv *store) RegisterHook(hook Hook) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.hooks = append(kv.hooks, hook)
+}
+
+// Call the hooks with the changes of a write, and apply their writes. Must be called with kv.mu held.
+func (kv *store) runHooks(events []Event) {
+
+	for _, hook := range kv.hooks {
+
+		var matched []Event
+		for _, event := range events {
+			if strings.HasPrefix(event.Key, hook.Prefix) && !kv.derivedKey(event.Key) {
+				matched = append(matched, event)
+			}
+		}
+
+		if len(matched) == 0 {
+			continue
+		}
+
+		// The backend can't be changed while it is visited, so the writes are applied once the hook returns.
+		for _, op := range hook.Apply(storeView{kv}, matched) {
+
+			if hook.Derived == "" || !strings.HasPrefix(op.Key, hook.Derived) {
+				logging.Logger.Error().Str("component", "kv_store").Str("hook", hook.Name).Str("key", op.Key).Msg("Hook writing a key outside of its derived keys, ignored")
+				continue
+			}
+
+			kv.applyOp(op)
+		}
+	}
+}
+
+// Whether the key is derived by one of the hooks. Must be called with kv.mu held.
+func (kv *store) derivedKey(key string) bool {
+
+	for _, hook := range kv.hooks {
+		if hook.Derived != "" && strings.HasPrefix(key, hook.Derived) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,115 @@
+package kv_store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+ * This test case checks that a hook is called with the changes of every kind
+ * of write to the keys with its prefix, that its writes are applied within the
+ * same write, that the writes outside of its derived keys are ignored, and that
+ * the derived keys take part in the snapshots.
+ */
+func TestHooks(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := newStore(filepath.Join(dir, "6000"))
+
+	// An index of the keys of "rec:" by value, along with their count.
+	kv.RegisterHook(Hook{Name: "by-value", Prefix: "rec:", Derived: "idx:", Apply: func(view View, events []Event) []Op {
+
+		count, _ := view.Get("idx:count")
+		n, _ := strconv.Atoi(count)
+
+		var ops []Op
+		for _, event := range events {
+
+			if previous, ok := view.Get("idx:key/" + event.Key); ok {
+				ops = append(ops, Op{Type: OpDelete, Key: "idx:value/" + previous + "/" + event.Key})
+				n--
+			}
+
+			if event.Type == OpDelete {
+				ops = append(ops, Op{Type: OpDelete, Key: "idx:key/" + event.Key})
+				continue
+			}
+
+			ops = append(ops, Op{Type: OpPut, Key: "idx:key/" + event.Key, Value: event.Value}, Op{Type: OpPut, Key: "idx:value/" + event.Value + "/" + event.Key, Value: "1"})
+			n++
+		}
+
+		return append(ops, Op{Type: OpPut, Key: "idx:count", Value: strconv.Itoa(n)}, Op{Type: OpPut, Key: "outside", Value: "x"})
+	}})
+
+	do := func(method, path, body, contentType string) *httptest.ResponseRecorder {
+
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+
+		w := httptest.NewRecorder()
+		kv.Router().ServeHTTP(w, req)
+		return w
+	}
+
+	form := "application/x-www-form-urlencoded"
+
+	do(http.MethodPost, "/rec:a", url.Values{"value": {"1"}}.Encode(), form)
+	do(http.MethodPost, "/rec:b", url.Values{"value": {"1"}}.Encode(), form)
+	do(http.MethodPost, "/other", url.Values{"value": {"1"}}.Encode(), form)
+	do(http.MethodPut, "/rec:a", url.Values{"value": {"2"}}.Encode(), form)
+
+	txn, _ := json.Marshal(Txn{Success: []Op{{Type: OpPut, Key: "rec:c", Value: "2"}, {Type: OpDelete, Key: "rec:b"}}})
+	w := do(http.MethodPost, "/admin/txn", string(txn), "application/json")
+
+	var result TxnResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil || len(result.Events) != 2 {
+		t.Errorf("Expected only the events of the transaction itself, got %+v: %v", result, err)
+	}
+
+	var index []string
+	storeView{kv}.Ascend("idx:value/", func(key, _ string) bool {
+		index = append(index, strings.TrimPrefix(key, "idx:value/"))
+		return true
+	})
+
+	if strings.Join(index, ",") != "2/rec:a,2/rec:c" || kv.Get("idx:count") != "2" {
+		t.Errorf("Expected the index of rec:a and rec:c and a count of 2, got %v and %v", index, kv.Get("idx:count"))
+	}
+
+	if kv.Get("outside") != "Invalid" {
+		t.Errorf("Expected the write outside of the derived keys to be ignored")
+	}
+
+	do(http.MethodPost, "/admin/delete-prefix", url.Values{"prefix": {"rec:"}}.Encode(), form)
+	do(http.MethodDelete, "/other", "", "")
+
+	if kv.Get("idx:count") != "0" || kv.Get("idx:key/rec:a") != "Invalid" || kv.Get("idx:value/2/rec:c") != "Invalid" {
+		t.Errorf("Expected the index to be emptied along with its keys, got a count of %v", kv.Get("idx:count"))
+	}
+
+	// The derived keys are restored along with the others.
+	do(http.MethodPost, "/rec:d", url.Values{"value": {"3"}}.Encode(), form)
+	snapshot := do(http.MethodGet, "/admin/snapshot", "", "").Body.String()
+
+	restored := newStore(filepath.Join(dir, "6001"))
+	req := httptest.NewRequest(http.MethodPut, "/admin/snapshot", strings.NewReader(snapshot))
+	restored.Router().ServeHTTP(httptest.NewRecorder(), req)
+
+	if restored.Get("idx:value/3/rec:d") != "1" || restored.Get("idx:count") != "1" {
+		t.Errorf("Expected the derived keys to be restored, got a count of %v", restored.Get("idx:count"))
+	}
+}
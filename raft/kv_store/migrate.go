@@ -0,0 +1,89 @@
+package kv_store
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+MigrateStore moves the store persisted to the given file from one backend to the other (see
+backend.go), e.g. to switch a replica to the bolt backend once its keys no longer fit in memory, or
+back. The replica must be stopped. The state is copied as is, so the store keeps its revisions, its
+history and its digest, which is checked before the source is removed: the files of the source
+backend are only removed once the destination is durable, so that an interrupted migration can be
+run again.
+*/
+func MigrateStore(filename, from, to string) (Digest, error) {
+
+	if from == to {
+		return Digest{}, fmt.Errorf("the store already uses the %v backend", to)
+	}
+
+	source, destination := backendFile(filename, from), backendFile(filename, to)
+
+	if source == "" || destination == "" {
+		return Digest{}, fmt.Errorf("unknown store backend, expected %v or %v", BackendMap, BackendBolt)
+	}
+
+	if _, err := os.Stat(source); err != nil {
+		return Digest{}, fmt.Errorf("no %v store in %v: %v", from, source, err)
+	}
+
+	src, err := OpenStore(filename, from)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	persisted := src.data.dump(src.revision, src.compacted)
+	digest := src.digest()
+
+	if err := src.Close(); err != nil {
+		return Digest{}, err
+	}
+
+	// A database left by an earlier use of the bolt backend is outdated.
+	if err := os.Remove(destination); err != nil && !os.IsNotExist(err) {
+		return Digest{}, err
+	}
+
+	data, err := openBackend(to, filename)
+	if err != nil {
+		return Digest{}, err
+	}
+
+	dst := &store{filename: filename, data: data}
+	dst.restore(persisted)
+
+	if err := dst.data.persist(dst.revision, dst.compacted); err != nil {
+		dst.Close()
+		return Digest{}, err
+	}
+
+	migrated := dst.digest()
+
+	if err := dst.Close(); err != nil {
+		return Digest{}, err
+	}
+
+	if migrated != digest {
+		return Digest{}, fmt.Errorf("the migrated store has the digest %v, expected %v", migrated, digest)
+	}
+
+	return digest, os.Remove(source)
+}
+
+// Return the file a backend persists the store of the given file to, empty for an unknown backend.
+func backendFile(filename, name string) string {
+
+	switch name {
+
+	case BackendMap:
+		return filename
+
+	case BackendBolt:
+		return filename + ".db"
+
+	}
+
+	return ""
+}
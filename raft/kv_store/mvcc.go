@@ -0,0 +1,264 @@
+package kv_store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+const (
+	historyLimit = 100 // maximum number of historical versions retained per key
+)
+
+// A single historical version of a key.
+type version struct {
+	Revision int64  // The store revision at which this version was written
+	Value    string // The value of the key at this version, in its stored form (see compress.go)
+	Deleted  bool   // Whether this version marks the deletion of the key
+}
+
+// Record a mutation of the given key at the revision following the current one. All the mutations of
+// an applied entry (e.g. the operations of a transaction, and the writes of the hooks) are recorded at
+// the same revision, which the store moves to once the entry is applied: a key mutated twice by an
+// entry only keeps its last version. Must be called with kv.mu held.
+func (kv *store) record(key, value string, deleted bool) {
+
+	v := version{Revision: kv.revision + 1, Value: value, Deleted: deleted}
+
+	versions := kv.data.versions(key)
+	if n := len(versions); n > 0 && versions[n-1].Revision == v.Revision {
+		versions = append(versions[:n-1:n-1], v)
+	} else {
+		versions = append(versions, v)
+	}
+
+	if len(versions) > historyLimit {
+		versions = versions[len(versions)-historyLimit:]
+	}
+
+	kv.data.setVersions(key, versions)
+}
+
+// Return the value of the key as of the given revision, and whether it existed at that revision.
+// Must be called with kv.mu held.
+func (kv *store) getAt(key string, rev int64) (string, bool, error) {
+
+	if rev > kv.revision {
+		return "", false, fmt.Errorf("revision %v is newer than the current revision %v", rev, kv.revision)
+	}
+
+	if rev < kv.compacted {
+		return "", false, fmt.Errorf("revision %v has been compacted, oldest available revision is %v", rev, kv.compacted)
+	}
+
+	versions := kv.data.versions(key)
+
+	for i := len(versions) - 1; i >= 0; i-- {
+
+		if versions[i].Revision > rev {
+			continue
+		}
+
+		return decodeValue(versions[i].Value), !versions[i].Deleted, nil
+	}
+
+	// The versions of this key older than the retained history are no longer available.
+	if len(versions) == historyLimit {
+		return "", false, fmt.Errorf("revision %v is older than the retained history of the key", rev)
+	}
+
+	return "", false, nil
+}
+
+// A key whose value differs between two revisions. Before or After is nil if the key didn't exist.
+type Change struct {
+	Key    string  `json:"key"`
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// Response to the changes queries, listing the keys changed between From and To in key order.
+type ChangesResponse struct {
+	From    int64    `json:"from"`
+	To      int64    `json:"to"`
+	Changes []Change `json:"changes"`
+}
+
+// Return the keys with the given prefix whose value differs between the revisions from and to,
+// in key order. Both revisions must be retained. Must be called with kv.mu held.
+func (kv *store) changes(prefix string, from, to int64) ([]Change, error) {
+
+	if from > to {
+		return nil, fmt.Errorf("revision %v is newer than revision %v", from, to)
+	}
+
+	// The history holds every key changed since the compaction revision, deleted ones included.
+	keys := make([]string, 0)
+	kv.data.eachVersions(func(key string, _ []version) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+
+	changes := make([]Change, 0)
+
+	for _, key := range keys {
+
+		before, existed, err := kv.getAt(key, from)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", key, err)
+		}
+
+		after, exists, err := kv.getAt(key, to)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", key, err)
+		}
+
+		if existed == exists && before == after {
+			continue
+		}
+
+		change := Change{Key: key}
+		if existed {
+			change.Before = &before
+		}
+		if exists {
+			change.After = &after
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, nil
+}
+
+// Discard all versions older than the given revision, keeping the latest version of each
+// key at or below it so that reads at the compaction revision still succeed.
+// Must be called with kv.mu held.
+func (kv *store) compact(rev int64) {
+
+	if rev <= kv.compacted {
+		return
+	}
+
+	// The histories are replaced once visited, as the backend can't be changed while visiting them.
+	compacted := make(map[string][]version)
+
+	kv.data.eachVersions(func(key string, versions []version) bool {
+
+		i := 0
+		for i+1 < len(versions) && versions[i+1].Revision <= rev {
+			i++
+		}
+
+		// If the latest version at or below the compaction revision is a deletion, it is not needed anymore.
+		if versions[i].Revision <= rev && versions[i].Deleted {
+			i++
+		}
+
+		if i > 0 {
+			compacted[key] = versions[i:]
+		}
+
+		return true
+	})
+
+	for key, versions := range compacted {
+		kv.data.setVersions(key, versions)
+	}
+
+	kv.compacted = rev
+}
+
+//handles compaction requests, discarding all revisions older than the given one
+func (kv *store) CompactHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("COMPACT request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "ParseForm() err: %v", err)
+		return
+	}
+
+	rev, err := strconv.ParseInt(r.FormValue("rev"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid revision: %v\n", r.FormValue("rev"))
+		return
+	}
+
+	compacted := kv.Compact(rev)
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "Compacted revision = %v\n", compacted)
+}
+
+// Discard the revisions older than the given one (see compact), returning the revision up to which
+// the history is then compacted.
+func (kv *store) Compact(rev int64) int64 {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	// Compacting beyond the current revision would discard versions that are still the latest.
+	if rev > kv.revision {
+		rev = kv.revision
+	}
+
+	kv.compact(rev)
+	kv.Persist()
+
+	return kv.compacted
+}
+
+// handles requests of the form /changes/{prefix}?from=<rev>&to=<rev>, listing the keys with the prefix
+// changed between the two revisions. Without to, the changes upto the current revision are listed.
+func (kv *store) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("CHANGES request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	from, err := strconv.ParseInt(r.FormValue("from"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid revision: %v\n", r.FormValue("from"))
+		return
+	}
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	to := kv.revision
+
+	if rev := r.FormValue("to"); rev != "" {
+		if to, err = strconv.ParseInt(rev, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid revision: %v\n", rev)
+			return
+		}
+	}
+
+	changes, err := kv.changes(mux.Vars(r)["prefix"], from, to)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Changes query failed: %v\n", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ChangesResponse{From: from, To: to, Changes: changes})
+}
@@ -0,0 +1,129 @@
+package kv_store
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+ * This test case checks that historical reads return the value of a key as of
+ * the requested revision, and that compaction discards old revisions while
+ * still allowing reads at (and after) the compaction revision.
+ */
+func TestHistoricalReads(t *testing.T) {
+
+	kv := newStore("")
+
+	recordEntry(kv, "a", "1", false) // rev 1
+	recordEntry(kv, "b", "1", false) // rev 2
+	recordEntry(kv, "a", "2", false) // rev 3
+	recordEntry(kv, "b", "", true)   // rev 4
+
+	expect := func(key string, rev int64, value string, exists bool) {
+
+		v, ok, err := kv.getAt(key, rev)
+
+		if err != nil || v != value || ok != exists {
+			t.Errorf("getAt(%q, %v) = (%q, %v, %v), expected (%q, %v)", key, rev, v, ok, err, value, exists)
+		}
+	}
+
+	expect("a", 0, "", false)
+	expect("a", 2, "1", true)
+	expect("a", 4, "2", true)
+	expect("b", 3, "1", true)
+	expect("b", 4, "", false)
+
+	if _, _, err := kv.getAt("a", 5); err == nil {
+		t.Errorf("Expected an error when reading a future revision")
+	}
+
+	kv.compact(3)
+
+	expect("a", 3, "2", true)
+	expect("b", 3, "1", true)
+	expect("b", 4, "", false)
+
+	if _, _, err := kv.getAt("a", 2); err == nil {
+		t.Errorf("Expected an error when reading a compacted revision")
+	}
+
+	kv.compact(4)
+
+	if kv.data.hasHistory("b") {
+		t.Errorf("Expected the history of a deleted key to be discarded")
+	}
+
+	expect("a", 4, "2", true)
+}
+
+/*
+ * This test case checks that the changes between two revisions list the keys
+ * with the prefix whose value differs, created and deleted keys included, and
+ * that revisions outside of the retained history are refused.
+ */
+func TestChanges(t *testing.T) {
+
+	kv := newStore("")
+
+	recordEntry(kv, "a:1", "1", false) // rev 1
+	recordEntry(kv, "a:2", "1", false) // rev 2
+	recordEntry(kv, "b:1", "1", false) // rev 3
+	recordEntry(kv, "a:1", "2", false) // rev 4
+	recordEntry(kv, "a:2", "", true)   // rev 5
+	recordEntry(kv, "a:3", "1", false) // rev 6
+	recordEntry(kv, "a:3", "", true)   // rev 7
+	recordEntry(kv, "a:1", "1", false) // rev 8
+
+	value := func(s *string) string {
+		if s == nil {
+			return "<nil>"
+		}
+		return *s
+	}
+
+	expect := func(from, to int64, expected ...string) {
+
+		changes, err := kv.changes("a:", from, to)
+		if err != nil {
+			t.Fatalf("changes(%v, %v) failed: %v", from, to, err)
+		}
+
+		got := make([]string, 0)
+		for _, change := range changes {
+			got = append(got, change.Key+"="+value(change.Before)+">"+value(change.After))
+		}
+
+		if strings.Join(got, " ") != strings.Join(expected, " ") {
+			t.Errorf("changes(%v, %v) = %v, expected %v", from, to, got, expected)
+		}
+	}
+
+	expect(2, 5, "a:1=1>2", "a:2=1><nil>")
+	expect(0, 2, "a:1=<nil>>1", "a:2=<nil>>1")
+	expect(5, 7)                // a:3 was created and deleted in between
+	expect(2, 8, "a:2=1><nil>") // a:1 is back to its value
+	expect(4, 4)
+
+	if _, err := kv.changes("a:", 5, 4); err == nil {
+		t.Errorf("Expected an error when the revisions are reversed")
+	}
+
+	if _, err := kv.changes("a:", 1, 9); err == nil {
+		t.Errorf("Expected an error when reading a future revision")
+	}
+
+	kv.compact(4)
+
+	if _, err := kv.changes("a:", 2, 8); err == nil {
+		t.Errorf("Expected an error when reading a compacted revision")
+	}
+
+	expect(4, 8, "a:1=2>1", "a:2=1><nil>")
+}
+
+// Record the mutation of the key as the only one of an applied entry.
+func recordEntry(kv *store, key, value string, deleted bool) {
+	kv.record(key, value, deleted)
+	kv.revision++
+}
@@ -0,0 +1,321 @@
+package kv_store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/btree"
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// indexKey is the item type stored in the ordered key index.
+type indexKey string
+
+func (a indexKey) Less(b btree.Item) bool {
+	return a < b.(indexKey)
+}
+
+// A single key value pair returned by the range and prefix queries.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Response to the range and prefix queries. If NextToken is non-empty, more keys
+// are available and can be fetched by passing it as the token of the next query.
+// All the pages of a listing are read at the Revision of its first page, see pageToken.
+type RangeResponse struct {
+	Kvs       []KeyValue `json:"kvs"`
+	NextToken string     `json:"next_token,omitempty"`
+	Revision  int64      `json:"revision"`
+}
+
+/*
+The continuation token of a listing, encoded as "<revision>:<key>" in base64. The revision is the
+one the first page was read at, so that the following pages list the keys as of that revision:
+keys written or deleted in the meantime are neither skipped nor listed twice. A listing thus fails
+once its revision is compacted, or once a key it reaches has been overwritten more than
+historyLimit times since, and must be restarted.
+*/
+type pageToken struct {
+	revision int64
+	key      string
+}
+
+func (t pageToken) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(t.revision, 10) + ":" + t.key))
+}
+
+func decodePageToken(s string) (pageToken, error) {
+
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageToken{}, fmt.Errorf("invalid continuation token")
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return pageToken{}, fmt.Errorf("invalid continuation token")
+	}
+
+	revision, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || revision < 0 {
+		return pageToken{}, fmt.Errorf("invalid continuation token")
+	}
+
+	return pageToken{revision: revision, key: parts[1]}, nil
+}
+
+// Range returns upto limit key value pairs with start <= key < end, in key order.
+// An empty end means that the range is unbounded. The returned string is the key the
+// next page starts from, or "" if there are no more keys in the range.
+func (kv *store) Range(start, end string, limit int) ([]KeyValue, string) {
+
+	kvs := make([]KeyValue, 0)
+	next := ""
+
+	kv.data.ascend(start, func(key, stored string) bool {
+
+		if end != "" && key >= end {
+			return false
+		}
+
+		if len(kvs) == limit {
+			next = key
+			return false
+		}
+
+		kvs = append(kvs, KeyValue{Key: key, Value: decodeValue(stored)})
+		return true
+	})
+
+	return kvs, next
+}
+
+// RangeAt returns the page of Range as of the given revision, which must be retained. Keys deleted
+// since the revision are listed, and keys created since then are not. Must be called with kv.mu held.
+func (kv *store) RangeAt(start, end string, limit int, rev int64) ([]KeyValue, string, error) {
+
+	if rev > kv.revision {
+		return nil, "", fmt.Errorf("revision %v is newer than the current revision %v", rev, kv.revision)
+	}
+
+	if rev < kv.compacted {
+		return nil, "", fmt.Errorf("revision %v has been compacted, oldest available revision is %v", rev, kv.compacted)
+	}
+
+	if rev == kv.revision {
+		kvs, next := kv.Range(start, end, limit)
+		return kvs, next, nil
+	}
+
+	// The keys deleted since, which are only left in the history.
+	deleted := make([]string, 0)
+	kv.data.eachVersions(func(key string, _ []version) bool {
+		if key >= start && (end == "" || key < end) {
+			if _, exists := kv.data.lookup(key); !exists {
+				deleted = append(deleted, key)
+			}
+		}
+		return true
+	})
+	sort.Strings(deleted)
+
+	kvs := make([]KeyValue, 0)
+	next := ""
+	var err error
+
+	// Add the key to the page if it existed at the revision, returning whether to continue.
+	visit := func(key string) bool {
+
+		if len(kvs) == limit {
+			next = key
+			return false
+		}
+
+		value, exists := "", false
+
+		if !kv.data.hasHistory(key) { // unchanged since it was loaded
+			value, exists = kv.Get(key), true
+		} else if value, exists, err = kv.getAt(key, rev); err != nil {
+			err = fmt.Errorf("key %q: %v", key, err)
+			return false
+		}
+
+		if exists {
+			kvs = append(kvs, KeyValue{Key: key, Value: value})
+		}
+
+		return true
+	}
+
+	// Merge the current keys with the deleted ones, in key order.
+	kv.data.ascend(start, func(key, _ string) bool {
+
+		if end != "" && key >= end {
+			return false
+		}
+
+		for len(deleted) > 0 && deleted[0] < key {
+			if !visit(deleted[0]) {
+				return false
+			}
+			deleted = deleted[1:]
+		}
+
+		return visit(key)
+	})
+
+	for ; err == nil && next == "" && len(deleted) > 0; deleted = deleted[1:] {
+		if !visit(deleted[0]) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return kvs, next, nil
+}
+
+// prefixEnd returns the smallest key greater than all keys having the given prefix,
+// or "" if there is no such key.
+func prefixEnd(prefix string) string {
+
+	end := []byte(prefix)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// Parse the limit, continuation token and revision query parameters of a paginated request. Without
+// a token, the listing is read at ?rev=<rev> if given, or else at the current revision.
+func parsePage(r *http.Request, current int64) (int, pageToken, error) {
+
+	limit := defaultPageLimit
+
+	if l := r.FormValue("limit"); l != "" {
+
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return 0, pageToken{}, fmt.Errorf("invalid limit %q", l)
+		}
+
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	if t := r.FormValue("token"); t != "" {
+		token, err := decodePageToken(t)
+		return limit, token, err
+	}
+
+	token := pageToken{revision: current}
+
+	if rev := r.FormValue("rev"); rev != "" {
+
+		var err error
+		if token.revision, err = strconv.ParseInt(rev, 10, 64); err != nil || token.revision < 0 {
+			return 0, pageToken{}, fmt.Errorf("invalid revision %q", rev)
+		}
+	}
+
+	return limit, token, nil
+}
+
+// Query the store at the revision of the token and write the page as JSON, resuming from the key of
+// the token. Must be called with kv.mu read locked, which it releases.
+func writeRange(w http.ResponseWriter, kv *store, start, end string, limit int, token pageToken) {
+
+	if token.key > start {
+		start = token.key
+	}
+
+	kvs, next, err := kv.RangeAt(start, end, limit, token.revision)
+	kv.mu.RUnlock()
+
+	if err != nil {
+		w.WriteHeader(http.StatusGone)
+		fmt.Fprintf(w, "Unable to list the keys at revision %v, restart the listing: %v\n", token.revision, err)
+		return
+	}
+
+	resp := RangeResponse{Kvs: kvs, Revision: token.revision}
+	if next != "" {
+		resp.NextToken = pageToken{revision: token.revision, key: next}.encode()
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+//handles range requests of the form /range?start=<key>&end=<key>&limit=<n>&token=<token>&rev=<rev>
+func (kv *store) RangeHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("RANGE request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	kv.mu.RLock()
+
+	limit, token, err := parsePage(r, kv.revision)
+	if err != nil {
+		kv.mu.RUnlock()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid range request: %v\n", err)
+		return
+	}
+
+	writeRange(w, kv, r.FormValue("start"), r.FormValue("end"), limit, token)
+}
+
+//handles prefix listing requests of the form /prefix/{prefix}?limit=<n>&token=<token>&rev=<rev>
+func (kv *store) PrefixHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("PREFIX request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	kv.mu.RLock()
+
+	limit, token, err := parsePage(r, kv.revision)
+	if err != nil {
+		kv.mu.RUnlock()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid prefix request: %v\n", err)
+		return
+	}
+
+	prefix := mux.Vars(r)["prefix"]
+
+	// Guard against tokens pointing outside of the prefix.
+	if token.key != "" && !strings.HasPrefix(token.key, prefix) {
+		kv.mu.RUnlock()
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid prefix request: continuation token does not belong to prefix\n")
+		return
+	}
+
+	writeRange(w, kv, prefix, prefixEnd(prefix), limit, token)
+}
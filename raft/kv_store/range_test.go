@@ -0,0 +1,103 @@
+package kv_store
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * This test case checks that range queries return keys in order, stop at the
+ * end of the range, and paginate correctly using the returned next key.
+ * It also checks that the prefix listing bounds are computed correctly.
+ */
+func TestRange(t *testing.T) {
+
+	kv := newStore("")
+
+	for _, key := range []string{"b", "a/2", "a/1", "c", "a/3", "a0"} {
+		kv.Push(key, "v-"+key)
+	}
+
+	kvs, next := kv.Range("a/", prefixEnd("a/"), 2)
+	if len(kvs) != 2 || kvs[0].Key != "a/1" || kvs[1].Key != "a/2" || next != "a/3" {
+		t.Errorf("Unexpected first page %v, next %q", kvs, next)
+	}
+
+	kvs, next = kv.Range(next, prefixEnd("a/"), 2)
+	if len(kvs) != 1 || kvs[0].Key != "a/3" || kvs[0].Value != "v-a/3" || next != "" {
+		t.Errorf("Unexpected second page %v, next %q", kvs, next)
+	}
+
+	kv.Delete("b")
+
+	kvs, _ = kv.Range("a0", "", 10)
+	if len(kvs) != 2 || kvs[0].Key != "a0" || kvs[1].Key != "c" {
+		t.Errorf("Unexpected unbounded range %v", kvs)
+	}
+
+	if end := prefixEnd("a\xff"); end != "b" {
+		t.Errorf("Unexpected prefix end %q", end)
+	}
+}
+
+/*
+ * This test case checks that the pages of a listing are read at the revision
+ * of its first page, so that concurrent writes and deletes don't make it skip
+ * or repeat keys, and that a listing fails once its revision is compacted.
+ */
+func TestPaginationAtRevision(t *testing.T) {
+
+	kv := newStore("")
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "a/4"} {
+		kv.applyEntry([]Op{{Type: OpPut, Key: key, Value: "v1"}})
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler)
+
+	list := func(query string) (RangeResponse, int) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/prefix/a/?"+query, nil))
+		var page RangeResponse
+		json.Unmarshal(w.Body.Bytes(), &page)
+		return page, w.Code
+	}
+
+	first, _ := list("limit=2")
+	if len(first.Kvs) != 2 || first.Kvs[1].Key != "a/2" || first.Revision != 4 || first.NextToken == "" {
+		t.Fatalf("Unexpected first page %+v", first)
+	}
+
+	// Keys are created before and after the token, deleted and overwritten.
+	kv.applyEntry([]Op{{Type: OpPut, Key: "a/0", Value: "v1"}})
+	kv.applyEntry([]Op{{Type: OpPut, Key: "a/25", Value: "v1"}})
+	kv.applyEntry([]Op{{Type: OpDelete, Key: "a/3"}})
+	kv.applyEntry([]Op{{Type: OpPut, Key: "a/4", Value: "v2"}})
+
+	second, _ := list("limit=2&token=" + first.NextToken)
+	if len(second.Kvs) != 2 || second.Kvs[0].Key != "a/3" || second.Kvs[1].Key != "a/4" || second.Kvs[1].Value != "v1" || second.Revision != 4 {
+		t.Errorf("Expected the second page at revision 4, got %+v", second)
+	}
+
+	if current, _ := list("limit=10"); len(current.Kvs) != 5 || current.Revision != 8 {
+		t.Errorf("Expected a new listing at the current revision, got %+v", current)
+	}
+
+	if past, _ := list("limit=10&rev=5"); len(past.Kvs) != 5 || past.Kvs[0].Key != "a/0" {
+		t.Errorf("Expected the listing at revision 5, got %+v", past)
+	}
+
+	kv.compact(6)
+
+	if _, code := list("limit=2&token=" + first.NextToken); code != 410 {
+		t.Errorf("Expected the listing to fail once its revision is compacted, got status %v", code)
+	}
+
+	if _, code := list("token=bm90IGEgdG9rZW4"); code != 400 {
+		t.Errorf("Expected an invalid token to be rejected, got status %v", code)
+	}
+}
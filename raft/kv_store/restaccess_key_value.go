@@ -2,11 +2,13 @@ package kv_store
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 
 	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
 )
 
 const (
@@ -14,25 +16,103 @@ const (
 )
 
 type store struct {
-	db       [length]*Linkedlist
 	mu       sync.RWMutex
 	filename string
-	db_temp  map[string]string
+	data     backend // keys, values and history of the store, see backend.go
+
+	revision  int64 // incremented for every applied entry that changed the store, see record in mvcc.go
+	compacted int64 // revision upto which the history has been compacted
+
+	compression CompressionConfig // values compressed when written, see compress.go
+	hooks       []Hook            // maintaining the derived keys, see hooks.go
 }
 
-//creates a new instance of key value store
+//creates a new instance of key value store, held in memory
 func InitializeStore(text string) *store {
 
-	kv := &store{
-		filename: text,
-		db_temp:  make(map[string]string),
+	kv, _ := OpenStore(text, BackendMap) // never fails for the map backend
+	return kv
+}
+
+/*
+OpenStore opens the store persisted to the given file with the given backend (see backend.go),
+loading its state. A bolt store without a database imports the file of the map backend, if any,
+e.g. when a replica is restored from a snapshot (see raft.RestoreSnapshot), and removes it once
+imported. See MigrateStore to switch the backend of an existing store.
+*/
+func OpenStore(filename, name string) (*store, error) {
+
+	// Starting afresh would lose the keys held by the other backend.
+	if name != BackendBolt {
+		if _, err := os.Stat(backendFile(filename, BackendBolt)); err == nil {
+			return nil, fmt.Errorf("the store %v is held by the %v backend, migrate it first with raftctl migrate-store", filename, BackendBolt)
+		}
+	}
+
+	data, err := openBackend(name, filename)
+	if err != nil {
+		return nil, err
 	}
 
-	if kv.HasData() {
+	kv := &store{filename: filename, data: data}
+
+	if revision, compacted, ok := data.load(); ok {
+		kv.revision, kv.compacted = revision, compacted
+	} else if kv.HasData() {
+
 		kv.Recover()
+
+		if err := data.persist(kv.revision, kv.compacted); err != nil {
+			data.close()
+			return nil, err
+		}
+
+		if name == BackendBolt {
+			os.Remove(filename)
+		}
 	}
 
-	return kv
+	return kv, nil
+}
+
+// creates an empty store held in memory, persisted to the given file
+func newStore(filename string) *store {
+	return &store{filename: filename, data: newMapBackend(filename)}
+}
+
+// Close the backend of the store.
+func (kv *store) Close() error {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.data.close()
+}
+
+// Router returns the routes of the store's HTTP API, served on the address of the store by
+// raft.StartKVStore.
+func (kv *store) Router() *mux.Router {
+
+	r := mux.NewRouter().SkipClean(true) // prefixes may end with a '/'
+
+	r.HandleFunc("/kvstore", kv.KvstoreHandler).Methods("GET")
+	r.HandleFunc("/range", kv.RangeHandler).Methods("GET")
+	r.HandleFunc("/prefix/{prefix:.*}", kv.PrefixHandler).Methods("GET")
+	r.HandleFunc("/admin/compact", kv.CompactHandler).Methods("POST")
+	r.HandleFunc("/admin/txn", kv.TxnHandler).Methods("POST")
+	r.HandleFunc("/admin/delete-prefix", kv.DeletePrefixHandler).Methods("POST")
+	r.HandleFunc("/admin/snapshot", kv.SnapshotHandler).Methods("GET")
+	r.HandleFunc("/admin/snapshot", kv.RestoreHandler).Methods("PUT")
+	r.HandleFunc("/admin/digest", kv.DigestHandler).Methods("GET")
+	r.HandleFunc("/admin/usage", kv.UsageHandler).Methods("GET")
+	r.HandleFunc("/admin/compression", kv.CompressionHandler).Methods("PUT")
+	r.HandleFunc("/changes/{prefix:.*}", kv.ChangesHandler).Methods("GET")
+	r.HandleFunc("/{key}", kv.PostHandler).Methods("POST")
+	r.HandleFunc("/{key}", kv.GetHandler).Methods("GET")
+	r.HandleFunc("/{key}", kv.PutHandler).Methods("PUT")
+	r.HandleFunc("/{key}", kv.DeleteHandler).Methods("DELETE")
+
+	return r
 }
 
 //test handler
@@ -44,57 +124,102 @@ func (kv *store) KvstoreHandler(w http.ResponseWriter, r *http.Request) {
 //handles all post requests
 func (kv *store) PostHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nPOST request received\n")
+	logging.Logger.Debug().Str("component", "kv_store").Msg("POST request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusCreated)
-
 	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "ParseForm() err: %v", err)
 		return
 	}
 
-	kv.mu.Lock()
-
 	value := r.FormValue("value")
 	params := mux.Vars(r)
 	key := params["key"]
 
-	duplicate := kv.Get(key)
-	if duplicate == "Invalid" {
+	if kv.Create(key, value).Succeeded {
+		w.WriteHeader(http.StatusCreated)
 		fmt.Fprintf(w, "Key = %s\n", key)
 		fmt.Fprintf(w, "Value = %s\n", value)
-		kv.Push(key, value)
-		kv.db_temp[key] = value
 	} else {
+		w.WriteHeader(http.StatusConflict)
 		fmt.Fprintf(w, "This key already exists")
 	}
+}
+
+// Create the key with the given value, unless it already exists, returning the change made.
+func (kv *store) Create(key, value string) TxnResult {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var result TxnResult
+
+	if kv.Get(key) == "Invalid" {
+		stored := kv.encodeValue(key, value)
+		kv.Push(key, stored)
+		kv.record(key, stored, false)
+		result.Succeeded = true
+		result.add(Event{Type: OpPut, Key: key, Value: value}, nil)
+		kv.runHooks(result.Events)
+		kv.revision++ // see record in mvcc.go
+	}
 
 	kv.Persist()
-	kv.mu.Unlock()
+	return result
 }
 
 //handles all get requests
 func (kv *store) GetHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nGET request received\n")
+	logging.Logger.Debug().Str("component", "kv_store").Msg("GET request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusOK)
-
 	kv.mu.RLock()
 
 	params := mux.Vars(r)
 	key := params["key"]
 	value := kv.Get(key)
 
+	// Serve historical reads from the retained versions of the key.
+	if rev := r.FormValue("rev"); rev != "" {
+
+		revision, err := strconv.ParseInt(rev, 10, 64)
+		if err != nil {
+			kv.mu.RUnlock()
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Invalid revision: %v\n", rev)
+			return
+		}
+
+		historical, exists, err := kv.getAt(key, revision)
+		if err != nil {
+			// Revisions older than the history are gone, while later ones don't exist yet.
+			status := http.StatusGone
+			if revision > kv.revision {
+				status = http.StatusBadRequest
+			}
+			kv.mu.RUnlock()
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "Historical read failed: %v\n", err)
+			return
+		}
+
+		value = historical
+		if !exists {
+			value = "Invalid"
+		}
+	}
+
 	if value == "Invalid" {
+		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Invalid key value pair\n")
 	} else {
+		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Value = %s\n", value)
 	}
 
@@ -104,60 +229,93 @@ func (kv *store) GetHandler(w http.ResponseWriter, r *http.Request) {
 //handles all put requests
 func (kv *store) PutHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nPUT request received\n")
+	logging.Logger.Debug().Str("component", "kv_store").Msg("PUT request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusAccepted)
-
 	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "ParseForm() err: %v", err)
 		return
 	}
 
-	kv.mu.Lock()
-
 	value := r.FormValue("value")
 	params := mux.Vars(r)
 	key := params["key"]
-	ok := kv.Put(key, value)
 
-	if ok == true {
+	if kv.Update(key, value).Succeeded {
+		w.WriteHeader(http.StatusAccepted)
 		fmt.Fprintf(w, "Key = %s\n", key)
 		fmt.Fprintf(w, "Value = %s\n", value)
-		kv.db_temp[key] = value
 	} else {
+		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Invalid key value pair\n")
 	}
+}
+
+// Update the key to the given value, if it exists, returning the change made along with the
+// previous value of the key.
+func (kv *store) Update(key, value string) TxnResult {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var result TxnResult
+
+	previous := kv.previous(key)
+	stored := kv.encodeValue(key, value)
+
+	if kv.Put(key, stored) {
+		kv.record(key, stored, false)
+		result.Succeeded = true
+		result.add(Event{Type: OpPut, Key: key, Value: value}, previous)
+		kv.runHooks(result.Events)
+		kv.revision++ // see record in mvcc.go
+	}
 
 	kv.Persist()
-	kv.mu.Unlock()
+	return result
 }
 
 //handles all delete requests
 func (kv *store) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nDELETE request received\n")
+	logging.Logger.Debug().Str("component", "kv_store").Msg("DELETE request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusOK)
-
-	kv.mu.Lock()
-
 	params := mux.Vars(r)
 	key := params["key"]
-	ok := kv.Delete(key)
 
-	if ok == true {
+	if kv.Remove(key).Succeeded {
+		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "Removed Key = %s\n", key)
-		kv.db_temp[key] = ""
 	} else {
+		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Invalid key value pair\n")
 	}
+}
+
+// Delete the key, if it exists, returning the change made along with the previous value of the key.
+func (kv *store) Remove(key string) TxnResult {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var result TxnResult
+
+	previous := kv.previous(key)
+
+	if kv.Delete(key) {
+		kv.record(key, "", true)
+		result.Succeeded = true
+		result.add(Event{Type: OpDelete, Key: key}, previous)
+		kv.runHooks(result.Events)
+		kv.revision++ // see record in mvcc.go
+	}
 
 	kv.Persist()
-	kv.mu.Unlock()
+	return result
 }
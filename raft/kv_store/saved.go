@@ -1,31 +1,102 @@
 package kv_store
 
 import (
+	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strconv"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
 )
 
-func (kv *store) writeFile() {
+// The state of the store that is persisted to disk.
+type persistedStore struct {
+	Data      map[string]string
+	Revision  int64
+	Compacted int64
+	History   map[string][]version
+}
+
+// Persist the state of a store to the given file, as done by the map backend. Like the state of
+// the Raft node (see raft/storage.go), it is written to a temporary file, synced and renamed over
+// the previous one, so that a crash can't leave it torn.
+func writeFile(filename string, persisted *persistedStore) error {
 
-	dataFile, err := os.Create(kv.filename)
+	dataFile, err := os.Create(filename + ".tmp")
 
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	err = gob.NewEncoder(dataFile).Encode(persisted)
+
+	if err == nil {
+		err = dataFile.Sync()
+	}
+
+	dataFile.Close()
+
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+
+	return err
+}
+
+// Serialize the state of the store as gob. Must be called with kv.mu held.
+func (kv *store) encode(w io.Writer) error {
+
 	// serialize the data
-	dataEncoder := gob.NewEncoder(dataFile)
+	dataEncoder := gob.NewEncoder(w)
 
 	// CHECK: why is "runtime error: invalid memory address or nil pointer dereference"
 	// happening here everytime the Encode happens, even though the write actually succeeds
 	// err = dataEncoder.Encode(kv.db_temp)
 	// log.Printf("Error in encoding data: %v", err.Error())
 
-	dataEncoder.Encode(kv.db_temp)
+	return dataEncoder.Encode(kv.data.dump(kv.revision, kv.compacted))
+}
 
-	dataFile.Close()
+// handles snapshot requests, returning the persisted form of the whole store
+func (kv *store) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("SNAPSHOT request received")
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Connection", "close")
+
+	snapshot, digest, err := kv.Snapshot()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Snapshot failed: %v\n", err)
+		return
+	}
+
+	w.Header().Set("X-Store-Revision", strconv.FormatInt(digest.Revision, 10))
+	w.Header().Set("X-Store-Digest", digest.Digest)
+	w.WriteHeader(http.StatusOK)
+	w.Write(snapshot)
+}
+
+// Return the persisted form of the whole store, along with its digest (see digest.go).
+func (kv *store) Snapshot() ([]byte, Digest, error) {
+
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	var buf bytes.Buffer
+
+	if err := kv.encode(&buf); err != nil {
+		return nil, Digest{}, err
+	}
+
+	return buf.Bytes(), kv.digest(), nil
 }
 
 func (kv *store) readFile() {
@@ -39,7 +110,8 @@ func (kv *store) readFile() {
 
 	dataDecoder := gob.NewDecoder(dataFile)
 
-	err = dataDecoder.Decode(&kv.db_temp)
+	var persisted persistedStore
+	err = dataDecoder.Decode(&persisted)
 
 	if err != nil {
 		fmt.Println(err)
@@ -48,13 +120,73 @@ func (kv *store) readFile() {
 
 	dataFile.Close()
 
-	for key, value := range kv.db_temp {
+	kv.restore(&persisted)
+}
+
+// Replace the contents of the store by the persisted state.
+func (kv *store) restore(persisted *persistedStore) {
+
+	kv.data.reset()
+
+	for key, value := range persisted.Data {
 
 		if value != "" {
-			kv.Push(key, value)
+			kv.data.set(key, value)
 		}
 
 	}
+
+	for key, versions := range persisted.History {
+		kv.data.setVersions(key, versions)
+	}
+
+	kv.revision = persisted.Revision
+	kv.compacted = persisted.Compacted
+}
+
+// handles restore requests, replacing the whole store by the snapshot in the request body.
+func (kv *store) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("RESTORE request received")
+
+	snapshot, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid snapshot: %v\n", err)
+		return
+	}
+
+	digest, err := kv.Restore(snapshot)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	json.NewEncoder(w).Encode(digest)
+}
+
+// Replace the whole store by the snapshot (as returned by Snapshot), returning its digest.
+func (kv *store) Restore(snapshot []byte) (Digest, error) {
+
+	var persisted persistedStore
+	if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&persisted); err != nil {
+		return Digest{}, fmt.Errorf("invalid snapshot: %v", err)
+	}
+
+	if err := persisted.check(); err != nil {
+		return Digest{}, fmt.Errorf("inconsistent snapshot: %v", err)
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.restore(&persisted)
+	kv.Persist()
+
+	return kv.digest(), nil
 }
 
 func (kv *store) Recover() {
@@ -65,8 +197,12 @@ func (kv *store) Recover() {
 
 }
 
+// Make the changes to the store durable. Must be called with kv.mu held.
 func (kv *store) Persist() {
-	kv.writeFile()
+
+	if err := kv.data.persist(kv.revision, kv.compacted); err != nil {
+		logging.Logger.Error().Str("component", "kv_store").Err(err).Msg("Error in Persist")
+	}
 }
 
 func (kv *store) HasData() bool {
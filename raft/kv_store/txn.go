@@ -0,0 +1,256 @@
+package kv_store
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+// Conditions that can be checked by the comparisons of a transaction.
+const (
+	CompareValueEqual = "VALUE_EQUAL"
+	CompareExists     = "EXISTS"
+	CompareNotExists  = "NOT_EXISTS"
+)
+
+// Operations that can be performed by a transaction.
+const (
+	OpPut    = "PUT"
+	OpDelete = "DELETE"
+)
+
+// A condition on the current state of a key.
+type Compare struct {
+	Key       string `json:"key"`
+	Condition string `json:"condition"`
+	Value     string `json:"value,omitempty"`
+}
+
+// A single write performed by a transaction. A PUT creates the key if it doesn't exist.
+type Op struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// A transaction applies the Success operations atomically if all of the comparisons
+// hold, and the Failure operations otherwise.
+type Txn struct {
+	Compare []Compare `json:"compare"`
+	Success []Op      `json:"success"`
+	Failure []Op      `json:"failure"`
+}
+
+// A change to a key made by a transaction.
+type Event struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// The outcome of a transaction, along with the changes it made to the store.
+type TxnResult struct {
+	Succeeded bool      `json:"succeeded"`
+	Events    []Event   `json:"events"`
+	Previous  []*string `json:"previous,omitempty"` // Values of the keys of the events before them, nil for the keys that didn't exist
+}
+
+// Return the value of the key of the i-th event before it, nil if the key didn't exist or if it isn't
+// known.
+func (r TxnResult) PreviousValue(i int) *string {
+
+	if i >= len(r.Previous) {
+		return nil
+	}
+
+	return r.Previous[i]
+}
+
+// Record the change made to the store, and the value of its key before it.
+func (r *TxnResult) add(event Event, previous *string) {
+	r.Events = append(r.Events, event)
+	r.Previous = append(r.Previous, previous)
+}
+
+// Check whether the comparison holds. Must be called with kv.mu held.
+func (kv *store) compare(c Compare) bool {
+
+	value := kv.Get(c.Key)
+
+	switch c.Condition {
+
+	case CompareExists:
+		return value != "Invalid"
+
+	case CompareNotExists:
+		return value == "Invalid"
+
+	default:
+		return value != "Invalid" && value == c.Value
+
+	}
+}
+
+// Return the current value of the key, nil if it doesn't exist. Must be called with kv.mu held.
+func (kv *store) previous(key string) *string {
+
+	value := kv.Get(key)
+	if value == "Invalid" {
+		return nil
+	}
+
+	return &value
+}
+
+// Perform the operation, returning the corresponding change if the store was modified.
+// Must be called with kv.mu held.
+func (kv *store) applyOp(op Op) (Event, bool) {
+
+	switch op.Type {
+
+	case OpPut:
+
+		stored := kv.encodeValue(op.Key, op.Value)
+
+		kv.Push(op.Key, stored)
+		kv.record(op.Key, stored, false)
+
+		return Event{Type: OpPut, Key: op.Key, Value: op.Value}, true
+
+	case OpDelete:
+
+		if !kv.Delete(op.Key) {
+			return Event{}, false
+		}
+
+		kv.record(op.Key, "", true)
+
+		return Event{Type: OpDelete, Key: op.Key}, true
+
+	}
+
+	return Event{}, false
+}
+
+// Apply the operations of an applied entry, and the writes of the hooks they trigger (see hooks.go),
+// returning the changes made to the store. The changes share a revision, which the store moves to if
+// there are any (see record in mvcc.go). Must be called with kv.mu held.
+func (kv *store) applyEntry(ops []Op) TxnResult {
+
+	result := TxnResult{Succeeded: true, Events: make([]Event, 0, len(ops))}
+
+	for _, op := range ops {
+		previous := kv.previous(op.Key)
+		if event, changed := kv.applyOp(op); changed {
+			result.add(event, previous)
+		}
+	}
+
+	kv.runHooks(result.Events)
+
+	if len(result.Events) > 0 {
+		kv.revision++
+	}
+
+	return result
+}
+
+// handles transactions, which are sent as JSON in the request body
+func (kv *store) TxnHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("TXN request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	var txn Txn
+
+	if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid transaction: %v\n", err)
+		return
+	}
+
+	result := kv.Txn(txn)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Apply the transaction, returning its outcome and the changes it made.
+func (kv *store) Txn(txn Txn) TxnResult {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	succeeded := true
+
+	for _, c := range txn.Compare {
+		if !kv.compare(c) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+
+	result := kv.applyEntry(ops)
+	result.Succeeded = succeeded
+
+	kv.Persist()
+	return result
+}
+
+// handles requests deleting all the keys with a prefix, given as the prefix form value, atomically.
+// The response is the result of the deletes, as for a transaction.
+func (kv *store) DeletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("DELETE_PREFIX request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "ParseForm() err: %v", err)
+		return
+	}
+
+	result := kv.DeletePrefix(r.FormValue("prefix"))
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// Delete all the keys with the prefix, atomically, returning the changes made.
+func (kv *store) DeletePrefix(prefix string) TxnResult {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	// The keys are collected first, as the backend can't be changed while it is visited.
+	var keys []string
+	kv.data.ascend(prefix, func(key, _ string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+
+	ops := make([]Op, 0, len(keys))
+	for _, key := range keys {
+		ops = append(ops, Op{Type: OpDelete, Key: key})
+	}
+
+	result := kv.applyEntry(ops)
+
+	kv.Persist()
+	return result
+}
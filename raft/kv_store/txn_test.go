@@ -0,0 +1,128 @@
+package kv_store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+ * This test case checks that a transaction applies its success operations
+ * when all of its comparisons hold and its failure operations otherwise, at
+ * a single revision, and that only the operations that modified the store are
+ * reported as events.
+ */
+func TestTxn(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := newStore(filepath.Join(dir, "6000"))
+
+	kv.Push("a", "1")
+
+	txn := func(txn Txn) TxnResult {
+
+		body, _ := json.Marshal(txn)
+		w := httptest.NewRecorder()
+		kv.TxnHandler(w, httptest.NewRequest(http.MethodPost, "/admin/txn", bytes.NewReader(body)))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Transaction failed with status %v: %v", w.Code, w.Body.String())
+		}
+
+		var result TxnResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		return result
+	}
+
+	result := txn(Txn{
+		Compare: []Compare{{Key: "a", Condition: CompareValueEqual, Value: "1"}, {Key: "b", Condition: CompareNotExists}},
+		Success: []Op{{Type: OpPut, Key: "b", Value: "2"}, {Type: OpDelete, Key: "a"}, {Type: OpDelete, Key: "c"}},
+		Failure: []Op{{Type: OpPut, Key: "c", Value: "3"}},
+	})
+
+	if !result.Succeeded || len(result.Events) != 2 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	if kv.Get("a") != "Invalid" || kv.Get("b") != "2" || kv.Get("c") != "Invalid" {
+		t.Errorf("Success operations were not applied correctly")
+	}
+
+	result = txn(Txn{
+		Compare: []Compare{{Key: "a", Condition: CompareExists}},
+		Success: []Op{{Type: OpPut, Key: "b", Value: "4"}},
+		Failure: []Op{{Type: OpPut, Key: "b", Value: "5"}},
+	})
+
+	if result.Succeeded || len(result.Events) != 1 || result.Events[0] != (Event{Type: OpPut, Key: "b", Value: "5"}) {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	// Each transaction is a single revision, whatever the number of keys it changed.
+	if kv.Get("b") != "5" || kv.revision != 2 {
+		t.Errorf("Failure operations were not applied correctly, b = %q at revision %v", kv.Get("b"), kv.revision)
+	}
+}
+
+/*
+ * This test case checks that deleting a prefix removes exactly the keys
+ * starting with it, reports each of them as an event, and keeps their
+ * history like any other delete.
+ */
+func TestDeletePrefix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "kv_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := newStore(filepath.Join(dir, "6000"))
+
+	for _, key := range []string{"foo", "foo/a", "foo/b", "foo0", "fop"} {
+		kv.applyEntry([]Op{{Type: OpPut, Key: key, Value: "1"}})
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/delete-prefix", strings.NewReader("prefix=foo/"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	kv.DeletePrefixHandler(w, req)
+
+	var result TxnResult
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+
+	if !result.Succeeded || len(result.Events) != 2 || result.Events[0] != (Event{Type: OpDelete, Key: "foo/a"}) || result.Events[1] != (Event{Type: OpDelete, Key: "foo/b"}) {
+		t.Errorf("Unexpected result %+v", result)
+	}
+
+	if kv.Get("foo/a") != "Invalid" || kv.Get("foo/b") != "Invalid" || kv.Get("foo") != "1" || kv.Get("foo0") != "1" || kv.Get("fop") != "1" {
+		t.Errorf("Expected only the keys with the prefix to be deleted")
+	}
+
+	if value, exists, err := kv.getAt("foo/a", 5); err != nil || !exists || value != "1" || kv.revision != 6 {
+		t.Errorf("Expected the deleted keys to be kept in the history, got %q %v %v at revision %v", value, exists, err, kv.revision)
+	}
+
+	// The keys are deleted at the same revision.
+	for _, key := range []string{"foo/a", "foo/b"} {
+		if _, exists, err := kv.getAt(key, 6); err != nil || exists {
+			t.Errorf("Expected %v to be deleted at revision 6, got %v %v", key, exists, err)
+		}
+	}
+}
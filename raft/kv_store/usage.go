@@ -0,0 +1,63 @@
+package kv_store
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+// The approximate memory used by the store, as reported in the status of the replica.
+type Usage struct {
+	Keys         int   `json:"keys"`
+	Bytes        int64 `json:"bytes"`         // Keys and current values, as stored (see compress.go)
+	HistoryBytes int64 `json:"history_bytes"` // Versions retained for historical reads, see mvcc.go
+	Revision     int64 `json:"revision"`      // Revision of the latest mutation
+	Compacted    int64 `json:"compacted"`     // Revision the history is compacted up to
+
+	Compression []CompressionStats `json:"compression,omitempty"` // Compressed values, by prefix
+}
+
+// Size of the bookkeeping of a version (its revision and deletion flag), besides its value.
+const versionOverhead = 16
+
+// Compute the usage of the store. Must be called with kv.mu held.
+func (kv *store) usage() Usage {
+
+	u := Usage{Revision: kv.revision, Compacted: kv.compacted}
+
+	kv.data.ascend("", func(key, stored string) bool {
+		u.Keys++
+		u.Bytes += int64(len(key) + len(stored))
+		return true
+	})
+
+	kv.data.eachVersions(func(key string, versions []version) bool {
+
+		u.HistoryBytes += int64(len(key))
+
+		for _, v := range versions {
+			u.HistoryBytes += int64(len(v.Value)) + versionOverhead
+		}
+
+		return true
+	})
+
+	u.Compression = kv.compressionStats()
+
+	return u
+}
+
+// handles usage requests, returning the memory used by the store
+func (kv *store) UsageHandler(w http.ResponseWriter, r *http.Request) {
+
+	logging.Logger.Debug().Str("component", "kv_store").Msg("USAGE request received")
+
+	kv.mu.RLock()
+	usage := kv.usage()
+	kv.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	json.NewEncoder(w).Encode(usage)
+}
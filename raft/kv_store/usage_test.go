@@ -0,0 +1,33 @@
+package kv_store
+
+import "testing"
+
+/*
+ * This test case checks that the usage of the store counts its current keys
+ * and values, and the versions retained in its history until compacted.
+ */
+func TestUsage(t *testing.T) {
+
+	kv := newStore("")
+
+	for _, op := range []Op{{Type: OpPut, Key: "a", Value: "123"}, {Type: OpPut, Key: "bb", Value: "4"}, {Type: OpDelete, Key: "a"}} {
+		kv.applyEntry([]Op{op})
+	}
+
+	u := kv.usage()
+	if u.Keys != 1 || u.Bytes != 3 {
+		t.Errorf("Expected a single key of 3 bytes, got %+v", u)
+	}
+
+	// a, its 2 versions, bb and its version.
+	if expected := int64(1+3+2*versionOverhead) + int64(2+1+versionOverhead); u.HistoryBytes != expected {
+		t.Errorf("Expected %v bytes of history, got %+v", expected, u)
+	}
+
+	kv.compact(kv.revision)
+
+	// Only the version of bb is left.
+	if u := kv.usage(); u.HistoryBytes != int64(2+1+versionOverhead) {
+		t.Errorf("Expected the compaction to drop the history of a, got %+v", u)
+	}
+}
@@ -0,0 +1,130 @@
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+Layout of the data of a replica, each component in its own directory (the working directory by
+default), e.g. the raft state on a fast NVMe drive and the snapshots on a bulk disk:
+
+	WAL        300<id>, the raft state: the log, currentTerm, votedFor, the client sessions and the
+	           cluster ID (see cluster_id.go), synced on every change
+	KV         600<id>, the key-value store (and 600<id>.db, the database of the bolt backend),
+	           synced on every applied write
+	Snapshots  the snapshots kept by a standby, when -standby-file is a relative path
+
+The layout is checked at startup by Validate: the directories must exist and be writable, and a key-
+value store with data but no raft state next to it (e.g. the WAL directory changed without moving
+300<id> along) is refused, as the replica would otherwise start again from an empty log. MediaWarnings
+warns about the components synced on every change that sit on slow media (rotational disks, network
+file systems), which slow down every write of the cluster.
+*/
+
+// The directories of the components of the data of a replica, the working directory if empty.
+type DataLayout struct {
+	WAL       string
+	KV        string
+	Snapshots string
+	Group     int // Raft group of the replica, whose files are named after it unless 0, see shards.go
+}
+
+// Return the file of the raft state of the replica.
+func (l DataLayout) RaftFile(id int) string {
+	return filepath.Join(l.WAL, groupPort(3, l.Group, id))
+}
+
+// Return the file of the key-value store of the replica.
+func (l DataLayout) StoreFile(id int) string {
+	return filepath.Join(l.KV, groupPort(6, l.Group, id))
+}
+
+// Return the path of the snapshot file with the given name, kept as is if absolute.
+func (l DataLayout) SnapshotFile(name string) string {
+
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	return filepath.Join(l.Snapshots, name)
+}
+
+// The directories of the layout by component.
+func (l DataLayout) components() []struct{ name, dir string } {
+	return []struct{ name, dir string }{{"WAL", l.WAL}, {"KV", l.KV}, {"snapshot", l.Snapshots}}
+}
+
+// Check that the directories of the layout can hold the data of the replica, and that its persisted
+// files are consistent with each other.
+func (l DataLayout) Validate(id int) error {
+
+	for _, c := range l.components() {
+
+		dir := c.dir
+		if dir == "" {
+			dir = "."
+		}
+
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("the %v directory %v is unusable: %v", c.name, dir, err)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("the %v directory %v isn't a directory", c.name, dir)
+		}
+
+		probe, err := ioutil.TempFile(dir, ".layout")
+		if err != nil {
+			return fmt.Errorf("the %v directory %v isn't writable: %v", c.name, dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+	}
+
+	// The store only holds entries already persisted in the raft state.
+	storeFile, raftFile := l.StoreFile(id), l.RaftFile(id)
+
+	if info, err := os.Stat(storeFile); err == nil && info.Size() > 0 {
+		if _, err := os.Stat(raftFile); os.IsNotExist(err) {
+			return fmt.Errorf("the key-value store %v has data but the raft state %v is missing, check the WAL directory", storeFile, raftFile)
+		}
+	}
+
+	return nil
+}
+
+// Return a warning for each component synced on every change whose directory is on slow media.
+func (l DataLayout) MediaWarnings() []string {
+
+	var warnings []string
+
+	for _, c := range l.components()[:2] {
+
+		dir := c.dir
+		if dir == "" {
+			dir = "."
+		}
+
+		if media := diskMedia(dir); slowMedia[media] {
+			warnings = append(warnings, fmt.Sprintf("the %v directory %v is on %v, its syncs will slow down the writes", c.name, dir, mediaNames[media]))
+		}
+	}
+
+	return warnings
+}
+
+// The kinds of media detected by diskMedia, "" being unknown.
+const (
+	mediaSSD  = "ssd"
+	mediaHDD  = "hdd"
+	mediaNFS  = "nfs"
+	mediaCIFS = "cifs"
+)
+
+var slowMedia = map[string]bool{mediaHDD: true, mediaNFS: true, mediaCIFS: true}
+
+var mediaNames = map[string]string{mediaHDD: "a rotational disk", mediaNFS: "an NFS mount", mediaCIFS: "a CIFS mount"}
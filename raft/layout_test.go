@@ -0,0 +1,75 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * This test case checks that the files of a replica are placed in the
+ * directory of their component, and that missing or unusable directories
+ * are refused at startup, as is a key-value store whose raft state isn't in
+ * the WAL directory.
+ */
+func TestDataLayout(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	layout := DataLayout{WAL: filepath.Join(dir, "wal"), KV: filepath.Join(dir, "kv"), Snapshots: filepath.Join(dir, "snapshots")}
+
+	if layout.RaftFile(2) != filepath.Join(dir, "wal", "3002") || layout.StoreFile(2) != filepath.Join(dir, "kv", "6002") {
+		t.Errorf("Unexpected files %v and %v", layout.RaftFile(2), layout.StoreFile(2))
+	}
+
+	if layout.SnapshotFile("standby.snapshot") != filepath.Join(dir, "snapshots", "standby.snapshot") || layout.SnapshotFile("/backups/latest") != "/backups/latest" {
+		t.Errorf("Expected the relative snapshot files to be in the snapshot directory")
+	}
+
+	if (DataLayout{}).RaftFile(0) != "3000" {
+		t.Errorf("Expected the default layout to be the working directory, got %v", (DataLayout{}).RaftFile(0))
+	}
+
+	if err := layout.Validate(2); err == nil {
+		t.Errorf("Expected missing directories to be refused")
+	}
+
+	for _, d := range []string{layout.WAL, layout.KV} {
+		os.Mkdir(d, 0755)
+	}
+	ioutil.WriteFile(layout.Snapshots, nil, 0644)
+
+	if err := layout.Validate(2); err == nil {
+		t.Errorf("Expected a file in place of a directory to be refused")
+	}
+
+	os.Remove(layout.Snapshots)
+	os.Mkdir(layout.Snapshots, 0755)
+
+	if err := layout.Validate(2); err != nil {
+		t.Errorf("Expected the layout to be valid: %v", err)
+	}
+
+	// The store was left behind by a replica whose WAL directory moved.
+	ioutil.WriteFile(layout.StoreFile(2), []byte("data"), 0644)
+
+	if err := layout.Validate(2); err == nil {
+		t.Errorf("Expected a store without its raft state to be refused")
+	}
+
+	storage := NewStorage()
+	storage.Set("currentTerm", int32(1))
+	storage.WriteFile(layout.RaftFile(2))
+
+	if err := layout.Validate(2); err != nil {
+		t.Errorf("Expected a store along with its raft state to be valid: %v", err)
+	}
+
+	// The detection is best effort, the media of a temporary directory may be unknown.
+	layout.MediaWarnings()
+}
@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+The leader metadata, for the load balancers and clients routing the writes to the leader:
+
+	GET /admin/leader             the last known leader of the replica
+	GET /admin/leader?watch=true  a stream of newline-delimited JSON objects, the last known leader
+	                              first and then every leader change seen by the replica
+
+Both only need the read permission. An ID of -1 means that the replica doesn't know the leader (e.g.
+during an election). A stream ends if the client falls behind, and is then to be reopened; as for the
+watches of the KVService, open streams aren't counted towards the load (see shedding.go).
+*/
+
+// The leader of the cluster, as known by a replica.
+type LeaderMetadata struct {
+	Id            int32  `json:"id"`                       // -1 if the leader isn't known
+	ClientAddress string `json:"client_address,omitempty"` // Address of the leader's client HTTP server
+	GrpcAddress   string `json:"grpc_address,omitempty"`
+	Term          int32  `json:"term"`
+}
+
+// Return the metadata of the given leader, or of an unknown one in the term if it is nil.
+func leaderMetadata(info *protos.LeaderInfo, term int32) LeaderMetadata {
+
+	if info == nil {
+		return LeaderMetadata{Id: -1, Term: term}
+	}
+
+	return LeaderMetadata{Id: info.Id, ClientAddress: info.Address, GrpcAddress: info.GrpcAddress, Term: info.Term}
+}
+
+// Whether the request opens a stream of leader changes.
+func leaderWatch(r *http.Request) bool {
+	return r.URL.Path == "/admin/leader" && r.URL.Query().Get("watch") == "true"
+}
+
+// Handle requests for the leader metadata, streaming the leader changes with watch=true.
+func (node *RaftNode) LeaderHandler(w http.ResponseWriter, r *http.Request) {
+
+	// Subscribing before reading the leader ensures no change is missed in between. No key is
+	// empty, so only the leader changes are delivered.
+	var events <-chan *protos.WatchEvent
+	if leaderWatch(r) {
+		var id int
+		id, events = node.watches.Subscribe("", false)
+		defer node.watches.Unsubscribe(id)
+	}
+
+	node.GetRLock("Leader Handler")
+	leader := leaderMetadata(node.leaderInfo(), node.currentTerm)
+	node.ReleaseRLock("Leader Handler")
+
+	if events == nil {
+		writeJSON(w, http.StatusOK, leader)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "Error: streaming is not supported.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+
+	for {
+
+		if err := encoder.Encode(leader); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-events:
+
+			if !ok {
+				return
+			}
+
+			node.GetRLock("Leader Handler")
+			leader = leaderMetadata(event.Leader, node.currentTerm)
+			node.ReleaseRLock("Leader Handler")
+
+		}
+	}
+}
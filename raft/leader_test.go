@@ -0,0 +1,92 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+ * This test case checks that the leader metadata reports the last known
+ * leader, or an ID of -1 if it isn't known, and that its stream starts with
+ * the current leader and then delivers every leader change.
+ */
+func TestLeaderMetadata(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), leader_id: -1, Config: DefaultConfig()}, watches: NewWatchHub()}
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.currentTerm = 3
+
+	server := httptest.NewServer(http.HandlerFunc(node.LeaderHandler))
+	defer server.Close()
+
+	get := func() LeaderMetadata {
+
+		resp, err := http.Get(server.URL + "/admin/leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var l LeaderMetadata
+		if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+			t.Fatal(err)
+		}
+
+		return l
+	}
+
+	if l := get(); l.Id != -1 || l.Term != 3 || l.ClientAddress != "" {
+		t.Errorf("Expected an unknown leader in term 3, got %+v", l)
+	}
+
+	node.GetLock("Test")
+	node.setLeader(1, ":4001")
+	node.ReleaseLock("Test")
+
+	if l := get(); l != (LeaderMetadata{Id: 1, ClientAddress: ":4001", GrpcAddress: ":5001", Term: 3}) {
+		t.Errorf("Expected replica 1 to be reported as the leader, got %+v", l)
+	}
+
+	resp, err := http.Get(server.URL + "/admin/leader?watch=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	stream := bufio.NewScanner(resp.Body)
+
+	next := func() LeaderMetadata {
+
+		if !stream.Scan() {
+			t.Fatalf("The stream ended: %v", stream.Err())
+		}
+
+		var l LeaderMetadata
+		if err := json.Unmarshal(stream.Bytes(), &l); err != nil {
+			t.Fatalf("Invalid leader %q: %v", stream.Text(), err)
+		}
+
+		return l
+	}
+
+	if l := next(); l.Id != 1 {
+		t.Errorf("Expected the stream to start with the current leader, got %+v", l)
+	}
+
+	node.GetLock("Test")
+	node.currentTerm = 4
+	node.setLeader(-1, "")
+	node.setLeader(2, ":4002")
+	node.ReleaseLock("Test")
+
+	if l := next(); l.Id != -1 || l.Term != 4 {
+		t.Errorf("Expected the leader to be reported unknown, got %+v", l)
+	}
+
+	if l := next(); l != (LeaderMetadata{Id: 2, ClientAddress: ":4002", GrpcAddress: ":5002", Term: 4}) {
+		t.Errorf("Expected replica 2 to be reported as the new leader, got %+v", l)
+	}
+}
@@ -0,0 +1,381 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Locks with leases, and their fencing tokens, so that external systems can coordinate through the
+cluster and reject the operations of stale lock holders:
+
+	POST   /locks/{name}?holder=<id>&ttl=<duration>  acquire the lock, or renew the lease of its holder
+	DELETE /locks/{name}?holder=<id>&token=<token>   release the lock
+	GET    /locks/{name}/validate?token=<token>      whether the token is that of the current holder
+	GET    /locks                                    the locks held, as applied by the replica
+
+Locks are acquired and released through "LOCK" log entries, which store them under the reserved
+LocksPrefix so that every replica agrees on them and keeps them across restarts and snapshots. An
+entry carries the time the leader proposed it at, and a lock is held until that time plus its ttl,
+so applying the entries doesn't depend on the clock of each replica.
+
+The fencing token of an acquisition is derived from the index of its entry (see sessionID, to remain
+unique in a restored cluster), and is always higher than the previous token of the lock. A holder
+renewing its lease before it expires keeps its token, while a lock acquired after its lease expired
+gets a new one, so a holder paused past its lease can't use its token anymore: an external system
+keeps the highest token it has seen, or asks /locks/{name}/validate, and rejects the lower ones.
+*/
+
+const (
+	LocksPrefix    = "_locks:" // Keys holding the state of each lock
+	defaultLockTTL = 10 * time.Second
+	maxLockTTL     = time.Hour
+)
+
+var (
+	lockNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+	errLockHeld     = errors.New("the lock is held by another holder")
+	errNotHolder    = errors.New("the lock isn't held with this token by this holder")
+)
+
+// The state of a lock, as stored under LocksPrefix.
+type Lock struct {
+	Name    string    `json:"name"`
+	Holder  string    `json:"holder"`  // Empty once released
+	Token   int64     `json:"token"`   // Fencing token of the latest acquisition
+	Expires time.Time `json:"expires"` // End of the lease of the holder
+	Index   int64     `json:"index"`   // ID of the log entry of the latest change, see sessionID
+}
+
+// Whether the lock is held at the given time.
+func (l Lock) heldAt(t time.Time) bool {
+	return l.Holder != "" && t.Before(l.Expires)
+}
+
+// A request carried by a "LOCK" log entry.
+type lockRequest struct {
+	Holder string        `json:"holder"`
+	TTL    time.Duration `json:"ttl,omitempty"`   // Lease of an acquisition
+	Token  int64         `json:"token,omitempty"` // Token of a release
+	Time   time.Time     `json:"time"`            // Time the leader proposed the entry at
+}
+
+// The locks applied by the replica, safe for concurrent use. A nil *Locks holds no lock.
+type Locks struct {
+	mu    sync.RWMutex
+	locks map[string]Lock
+}
+
+func NewLocks() *Locks {
+	return &Locks{locks: make(map[string]Lock)}
+}
+
+// Forget the locks, before they are loaded again from the store.
+func (l *Locks) reset() {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.locks = make(map[string]Lock)
+}
+
+func (l *Locks) apply(lock Lock) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.locks[lock.Name] = lock
+}
+
+// Return the state of the lock with the given name, if it was ever acquired.
+func (l *Locks) Get(name string) (Lock, bool) {
+
+	if l == nil {
+		return Lock{}, false
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	lock, ok := l.locks[name]
+	return lock, ok
+}
+
+// Return the locks held at the given time, by name.
+func (l *Locks) Held(t time.Time) []Lock {
+
+	if l == nil {
+		return nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	locks := make([]Lock, 0)
+	for _, lock := range l.locks {
+		if lock.heldAt(t) {
+			locks = append(locks, lock)
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+
+	return locks
+}
+
+// Return the operation of the log entry acquiring ("ACQUIRE") or releasing ("RELEASE") a lock.
+func lockOperation(name string, request lockRequest, action string) []string {
+
+	encoded, _ := json.Marshal(request)
+	return []string{"LOCK", name, string(encoded), action}
+}
+
+/*
+Return the transaction applying the "LOCK" log entry at the given index to the key-value store,
+along with the new state of the lock, or nil if the request is refused: an acquisition of a lock
+held by another holder, or a release by a holder that doesn't hold it with its token. Must be called
+with the lock held.
+*/
+func (node *RaftNode) lockTxn(entry *protos.LogEntry, index int32) (kv_store.Txn, *Lock) {
+
+	name, action := entry.Operation[1], entry.Operation[3]
+
+	var request lockRequest
+	if err := json.Unmarshal([]byte(entry.Operation[2]), &request); err != nil {
+		node.logger().Error().Err(err).Int32("index", index).Msg("Invalid lock request")
+		return kv_store.Txn{}, nil
+	}
+
+	current, _ := node.Meta.locks.Get(name)
+	lock := Lock{Name: name, Token: current.Token, Index: node.sessionID(index)}
+
+	switch action {
+
+	case "ACQUIRE":
+
+		if current.heldAt(request.Time) && current.Holder != request.Holder {
+			return kv_store.Txn{}, nil
+		}
+
+		lock.Holder, lock.Expires = request.Holder, request.Time.Add(request.TTL)
+
+		// A lease renewed before it expires keeps its token.
+		if !current.heldAt(request.Time) {
+
+			lock.Token = node.sessionID(index)
+			if lock.Token <= current.Token {
+				lock.Token = current.Token + 1
+			}
+		}
+
+	case "RELEASE":
+
+		if current.Holder == "" || current.Holder != request.Holder || current.Token != request.Token {
+			return kv_store.Txn{}, nil
+		}
+
+	}
+
+	record, _ := json.Marshal(lock)
+
+	return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: LocksPrefix + name, Value: string(record)}}}, &lock
+}
+
+// Load the locks persisted in the local key-value store.
+func (node *RaftNode) loadLocks() {
+
+	kvs, err := node.scanLocalStore(LocksPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the locks")
+		return
+	}
+
+	for _, kv := range kvs {
+
+		var lock Lock
+		if err := json.Unmarshal([]byte(kv.Value), &lock); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid lock record")
+			continue
+		}
+
+		node.Meta.locks.apply(lock)
+	}
+}
+
+/*
+Propose acquiring or releasing a lock, and wait for the entry to be applied. Return the state of
+the lock, along with whether the request was granted.
+*/
+func (node *RaftNode) proposeLock(ctx context.Context, name string, request lockRequest, action string) (Lock, bool, error) {
+
+	node.GetRLock("Propose Lock")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Propose Lock")
+		return Lock{}, false, errNotLeader
+	}
+
+	request.Time = node.now()
+
+	index, success, err := node.proposeCommand(ctx, lockOperation(name, request, action), request.Holder) // releases the lock
+	if !success {
+		return Lock{}, false, err
+	}
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		return Lock{}, false, err
+	}
+
+	node.GetRLock("Propose Lock")
+	id := node.sessionID(index)
+	node.ReleaseRLock("Propose Lock")
+
+	lock, _ := node.Meta.locks.Get(name)
+
+	return lock, lock.Index == id, nil
+}
+
+/*
+Handle requests acquiring a lock (POST), or renewing the lease of its holder, and releasing it
+(DELETE). The response, holding the state of the lock and the fencing token of the holder, is sent once
+the request is applied on the leader. A request that isn't granted is answered with 409 Conflict.
+*/
+func (node *RaftNode) LockHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Str("method", r.Method).Msg("LOCK request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !lockNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "Invalid lock name: %q", name)
+		return
+	}
+
+	request := lockRequest{Holder: r.FormValue("holder")}
+	if request.Holder == "" {
+		writeError(w, http.StatusBadRequest, "Error: the holder of the lock is required")
+		return
+	}
+
+	action := "ACQUIRE"
+
+	if r.Method == http.MethodDelete {
+
+		action = "RELEASE"
+
+		token, err := strconv.ParseInt(r.FormValue("token"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid token: %q", r.FormValue("token"))
+			return
+		}
+		request.Token = token
+
+	} else {
+
+		request.TTL = defaultLockTTL
+
+		if s := r.FormValue("ttl"); s != "" {
+
+			ttl, err := time.ParseDuration(s)
+			if err != nil || ttl <= 0 || ttl > maxLockTTL {
+				writeError(w, http.StatusBadRequest, "Invalid ttl: %q, expected a duration up to %v", s, maxLockTTL)
+				return
+			}
+			request.TTL = ttl
+		}
+	}
+
+	lock, granted, err := node.proposeLock(r.Context(), name, request, action)
+
+	switch {
+
+	case err == errNotLeader:
+		node.GetRLock("Lock Handler")
+		address := node.Meta.leaderAddress
+		node.ReleaseRLock("Lock Handler")
+		writeNotLeader(w, address)
+
+	case err != nil:
+		node.logger().Error().Err(err).Str("name", name).Msg("Error occured in LOCK request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in LOCK request: %v", err)
+
+	case !granted && action == "ACQUIRE":
+		writeError(w, http.StatusConflict, "Error: %v, %v, until %v", errLockHeld, lock.Holder, lock.Expires.Format(time.RFC3339Nano))
+
+	case !granted:
+		writeError(w, http.StatusConflict, "Error: %v", errNotHolder)
+
+	default:
+		node.logger().Info().Str("name", name).Str("holder", request.Holder).Str("action", action).Int64("token", lock.Token).Msg("LOCK request completed successfully")
+		writeJSON(w, http.StatusOK, lock)
+
+	}
+}
+
+// Handle requests listing the locks held, as applied by this replica.
+func (node *RaftNode) LocksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.locks.Held(node.now()))
+}
+
+// The response of /locks/{name}/validate.
+type LockValidation struct {
+	Valid bool  `json:"valid"` // Whether the token is that of the current holder, within its lease
+	Token int64 `json:"token"` // Latest token of the lock, operations with a lower one are stale
+}
+
+/*
+Handle requests validating a fencing token, of the form /locks/{name}/validate?token=<token>. The
+leader confirms its leadership and applies the entries committed so far first, so that the answer
+reflects every acquisition acknowledged before the request.
+*/
+func (node *RaftNode) ValidateLockHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("VALIDATE LOCK request received")
+
+	name := mux.Vars(r)["name"]
+
+	token, err := strconv.ParseInt(r.FormValue("token"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid token: %q", r.FormValue("token"))
+		return
+	}
+
+	if !node.confirmLeadership() {
+		node.GetRLock("Validate Lock Handler")
+		address := node.Meta.leaderAddress
+		node.ReleaseRLock("Validate Lock Handler")
+		writeNotLeader(w, address)
+		return
+	}
+
+	node.GetRLock("Validate Lock Handler")
+	commitIndex := node.commitIndex
+	node.ReleaseRLock("Validate Lock Handler")
+
+	if err := node.waitApplied(r.Context(), commitIndex); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: the committed entries weren't applied in time: %v", err)
+		return
+	}
+
+	lock, _ := node.Meta.locks.Get(name)
+
+	writeJSON(w, http.StatusOK, LockValidation{
+		Valid: lock.Token == token && lock.heldAt(node.now()),
+		Token: lock.Token,
+	})
+}
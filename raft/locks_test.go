@@ -0,0 +1,86 @@
+package raft
+
+import (
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that a lock is only granted to one holder at a time,
+ * that renewing its lease keeps the fencing token while acquiring it after
+ * the lease expired raises it, and that only the holder can release it, with
+ * its token.
+ */
+func TestLocks(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{locks: NewLocks()}}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	index := int32(0)
+
+	// Apply a "LOCK" entry as the state machine does, returning the lock if the request was granted.
+	apply := func(action, holder string, token int64, at time.Duration) *Lock {
+
+		index++
+
+		request := lockRequest{Holder: holder, TTL: 10 * time.Second, Token: token, Time: start.Add(at)}
+		txn, lock := node.lockTxn(&protos.LogEntry{Operation: lockOperation("job", request, action)}, index)
+
+		if lock != nil {
+
+			if len(txn.Success) != 1 || txn.Success[0].Key != LocksPrefix+"job" || !reservedKey(txn.Success[0].Key) {
+				t.Fatalf("Unexpected transaction %+v", txn)
+			}
+
+			node.Meta.locks.apply(*lock)
+		}
+
+		return lock
+	}
+
+	first := apply("ACQUIRE", "a", 0, 0)
+	if first == nil || first.Holder != "a" || first.Token != 1 || !first.Expires.Equal(start.Add(10*time.Second)) {
+		t.Fatalf("Expected the free lock to be granted with token 1, got %+v", first)
+	}
+
+	if lock := apply("ACQUIRE", "b", 0, time.Second); lock != nil {
+		t.Errorf("Expected the held lock to be refused to another holder, got %+v", lock)
+	}
+
+	renewed := apply("ACQUIRE", "a", 0, 5*time.Second)
+	if renewed == nil || renewed.Token != first.Token || !renewed.Expires.Equal(start.Add(15*time.Second)) {
+		t.Errorf("Expected the renewal to extend the lease with the same token, got %+v", renewed)
+	}
+
+	// Once the lease of a expired, b gets a higher token.
+	second := apply("ACQUIRE", "b", 0, 20*time.Second)
+	if second == nil || second.Holder != "b" || second.Token <= first.Token {
+		t.Fatalf("Expected the expired lock to be granted to b with a higher token, got %+v", second)
+	}
+
+	if lock := apply("RELEASE", "a", first.Token, 21*time.Second); lock != nil {
+		t.Errorf("Expected the stale holder not to release the lock, got %+v", lock)
+	}
+
+	if lock := apply("RELEASE", "b", first.Token, 21*time.Second); lock != nil {
+		t.Errorf("Expected a release with a stale token to be refused, got %+v", lock)
+	}
+
+	released := apply("RELEASE", "b", second.Token, 22*time.Second)
+	if released == nil || released.Holder != "" || released.heldAt(start.Add(22*time.Second)) || released.Token != second.Token {
+		t.Fatalf("Expected the holder to release the lock, keeping its token, got %+v", released)
+	}
+
+	if len(node.Meta.locks.Held(start.Add(22*time.Second))) != 0 {
+		t.Errorf("Expected no lock held once released")
+	}
+
+	// In a restored cluster, whose log starts over, the tokens keep increasing.
+	index = 0
+	third := apply("ACQUIRE", "c", 0, 30*time.Second)
+	if third == nil || third.Token <= second.Token {
+		t.Errorf("Expected a token higher than %v, got %+v", second.Token, third)
+	}
+}
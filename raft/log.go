@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+The log of a replica. Its entries are addressed by their index in the whole history of the cluster,
+but only those from logStart on are kept in node.log (node.log[0] being the entry at logStart): the
+previous ones were compacted once applied to the state machine (see compaction.go), or replaced by a
+snapshot of the state machine installed by the leader (see install.go). Of the entries compacted, the
+log only keeps the term of the last one, to check that the following entries match, and the
+configuration they lead to, see membership.go.
+
+All the functions below must be called with the (read) lock held.
+*/
+
+// Return the index of the last entry of the log, logStart-1 if it holds none.
+func (node *RaftNode) lastLogIndex() int32 {
+	return node.logStart + int32(len(node.log)) - 1
+}
+
+// Return the entry at the given index, which must be held by the log.
+func (node *RaftNode) entry(index int32) *protos.LogEntry {
+	return &node.log[index-node.logStart]
+}
+
+// Whether the entry at the given index is held by the log, rather than compacted or missing.
+func (node *RaftNode) hasEntry(index int32) bool {
+	return index >= node.logStart && index <= node.lastLogIndex()
+}
+
+// Return the term of the entry at the given index, -1 for the index -1 (before the first entry), and
+// whether it is known: the terms of the entries compacted before the last one are not.
+func (node *RaftNode) termAt(index int32) (int32, bool) {
+
+	switch {
+
+	case index == -1:
+		return -1, true
+
+	case index == node.logStart-1:
+		return node.logStartTerm, true
+
+	case node.hasEntry(index):
+		return node.entry(index).Term, true
+
+	}
+
+	return 0, false
+}
+
+// Delete the entries from the given index on, which must not be compacted.
+func (node *RaftNode) truncateLog(index int32) {
+	node.log = node.log[:index-node.logStart]
+}
+
+// Delete the entries up to the given index, which must be held by the log, leaving logStart as is.
+func (node *RaftNode) discardEntries(index int32) {
+
+	// The entries are copied, so that the deleted ones can be freed.
+	remaining := make([]protos.LogEntry, node.lastLogIndex()-index)
+	copy(remaining, node.log[index+1-node.logStart:])
+
+	node.log = remaining
+}
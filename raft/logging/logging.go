@@ -0,0 +1,122 @@
+/*
+Package logging provides the structured, leveled logger shared by the replicas and their key-value
+stores. Messages are written as human readable lines by default, or as one JSON object per line,
+carrying fields such as replica_id, term, state and index.
+
+The levels, from the most to the least verbose, are:
+
+	trace  every RPC sent and received by the replica, for debugging the consensus protocol
+	debug  the details of elections, replication and the application of entries
+	info   changes of state, membership and client requests (the default)
+	warn   recoverable problems
+	error  failed operations
+
+The most recent messages are also kept in memory, as JSON lines, for the diagnostics bundles of
+the replicas (see Recent).
+*/
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// Output formats accepted by Setup.
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+// Messages kept by Recent.
+const recentMessages = 1000
+
+// The most recent messages logged by the loggers returned by New, whatever their output.
+var Recent = NewRing(recentMessages)
+
+// The logger used by the replica, writing to stderr in the console format until Setup is called.
+var Logger = New(os.Stderr, FormatConsole)
+
+func init() {
+
+	// Elections and heartbeats happen within milliseconds of each other.
+	zerolog.TimeFieldFormat = "2006-01-02T15:04:05.000Z07:00"
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+}
+
+// Return a logger writing to w in the given format, and to Recent.
+func New(w io.Writer, format string) zerolog.Logger {
+
+	if format != FormatJSON {
+		w = zerolog.ConsoleWriter{Out: w, TimeFormat: "15:04:05.000", NoColor: runtime.GOOS == "windows"}
+	}
+
+	return zerolog.New(zerolog.MultiLevelWriter(w, Recent)).With().Timestamp().Logger()
+}
+
+// Replace Logger by one writing to w in the given format, and only log messages of the given level and above.
+func Setup(w io.Writer, level, format string) error {
+
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || lvl == zerolog.NoLevel {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	if format != FormatConsole && format != FormatJSON {
+		return fmt.Errorf("invalid log format %q, expected %v or %v", format, FormatConsole, FormatJSON)
+	}
+
+	Logger = New(w, format)
+	zerolog.SetGlobalLevel(lvl)
+
+	return nil
+}
+
+// A fixed number of the latest messages written to it, older ones being dropped.
+type Ring struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int // Index of the oldest message, overwritten by the next one once the ring is full
+}
+
+func NewRing(size int) *Ring {
+	return &Ring{lines: make([][]byte, 0, size)}
+}
+
+// Write a message, which is copied as the loggers reuse their buffers.
+func (r *Ring) Write(p []byte) (int, error) {
+
+	line := append([]byte(nil), p...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.lines) < cap(r.lines) {
+		r.lines = append(r.lines, line)
+		return len(p), nil
+	}
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+
+	return len(p), nil
+}
+
+// Return the messages, oldest first.
+func (r *Ring) Lines() []string {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lines := make([]string, 0, len(r.lines))
+
+	for i := range r.lines {
+		lines = append(lines, string(r.lines[(r.next+i)%len(r.lines)]))
+	}
+
+	return lines
+}
@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+/*
+ * This test case checks that the JSON output carries the fields of the messages,
+ * and that messages below the configured level are left out.
+ */
+func TestSetup(t *testing.T) {
+
+	var buf bytes.Buffer
+
+	if err := Setup(&buf, "debug", FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer Setup(&bytes.Buffer{}, "info", FormatConsole)
+
+	Logger.Trace().Msg("left out")
+	Logger.Debug().Int32("replica_id", 2).Int32("term", 5).Msg("kept")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected a single message, got %q", buf.String())
+	}
+
+	var message map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &message); err != nil {
+		t.Fatalf("Invalid JSON message %q: %v", lines[0], err)
+	}
+
+	if message["message"] != "kept" || message["level"] != "debug" || message["replica_id"] != 2.0 || message["term"] != 5.0 {
+		t.Errorf("Unexpected message %v", message)
+	}
+
+	if err := Setup(&buf, "verbose", FormatJSON); err == nil {
+		t.Errorf("Expected an invalid level to be rejected")
+	}
+
+	if err := Setup(&buf, "info", "xml"); err == nil {
+		t.Errorf("Expected an invalid format to be rejected")
+	}
+}
+
+/*
+ * This test case checks that the latest messages are kept, as JSON lines, whatever
+ * the format of the logger, and that the older ones are dropped.
+ */
+func TestRecent(t *testing.T) {
+
+	ring := NewRing(2)
+	ring.Write([]byte("1"))
+
+	if lines := ring.Lines(); len(lines) != 1 || lines[0] != "1" {
+		t.Errorf("Expected a single message, got %q", lines)
+	}
+
+	ring.Write([]byte("2"))
+	ring.Write([]byte("3"))
+	ring.Write([]byte("4"))
+
+	if lines := ring.Lines(); len(lines) != 2 || lines[0] != "3" || lines[1] != "4" {
+		t.Errorf("Expected the latest 2 messages, got %q", lines)
+	}
+
+	logger := New(&bytes.Buffer{}, FormatConsole)
+	logger.Info().Str("marker", "recent").Msg("kept in memory")
+
+	lines := Recent.Lines()
+
+	var message map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &message); err != nil || message["marker"] != "recent" {
+		t.Errorf("Expected the latest message as JSON, got %q (%v)", lines[len(lines)-1], err)
+	}
+}
@@ -0,0 +1,454 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Authoritative lookups of the DNS listeners (RFC 1034 section 4.3.2). The zone of a name is given by
+the closest enclosing name holding an SOA record, its apex, and within it:
+
+  - the NS records of a name below the apex cut off a subzone delegated to other name servers: the
+    queries for its names, but for the DS records of the cut itself, are answered with a referral,
+    without authority, holding the NS records in the authority section and the A and AAAA records
+    of the name servers within the subzone (the glue) in the additional section
+  - a name without records but with descendants (an empty non-terminal) exists, and is answered
+    NODATA like the names holding records of other types: NOERROR, without answers
+  - a name that doesn't exist is answered from the wildcard "*.<closest encloser>" (RFC 4592), the
+    records of the closest existing ancestor of the name, owned by the name queried
+  - the CNAME records are chased to their targets within the zones of the replica (those whose apex
+    it holds), at most maxCNAMEChain times, the answer holding the whole chain
+  - the negative answers, NXDOMAIN and NODATA, hold the SOA record of the zone in their authority
+    section, with the TTL of the negative caching (RFC 2308)
+
+The names without an enclosing SOA record are answered from their own records alone. The empty
+non-terminals are found through an index of the names, maintained by an apply hook (see hooks.go)
+under NamesPrefix, keyed by the labels of the names in reverse (e.g. "com.example.www." for
+www.example.com.) so that the descendants of a name are found by a prefix lookup. Like those of any
+hook, it only indexes the names whose records were written since the replica registered it.
+
+The answers are counted in dns_lookups_total{view, outcome}, the outcome being answer, wildcard,
+nodata, nxdomain or referral.
+*/
+
+const (
+	NamesPrefix   = "_dns_names:" // Prefix of the index of the DNS names
+	maxCNAMEChain = 8             // CNAME records chased at most by an answer
+)
+
+func init() {
+
+	if err := RegisterApplyHook(kv_store.Hook{Name: "dns-names", Prefix: zone.KeyPrefix, Derived: NamesPrefix, Apply: indexNames}); err != nil {
+		panic(err)
+	}
+}
+
+// Return the key of the name in the index of the names.
+func nameIndexKey(name string) string {
+
+	labels := dns.SplitDomainName(name)
+
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	if len(labels) == 0 {
+		return NamesPrefix
+	}
+
+	return NamesPrefix + strings.Join(labels, ".") + "."
+}
+
+// Update the index of the names whose RRsets changed, indexing those left with records.
+func indexNames(view kv_store.View, events []kv_store.Event) []kv_store.Op {
+
+	var ops []kv_store.Op
+	seen := make(map[string]bool)
+
+	for _, event := range events {
+
+		name, _, ok := zone.ParseRecordKey(event.Key)
+		if !ok || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+
+		exists := false
+		view.Ascend(zone.KeyPrefix+name+":", func(key, _ string) bool {
+			exists = !zone.IsPolicyKey(key)
+			return !exists
+		})
+
+		key := nameIndexKey(name)
+		_, indexed := view.Get(key)
+
+		switch {
+		case exists && !indexed:
+			ops = append(ops, kv_store.Op{Type: kv_store.OpPut, Key: key, Value: "1"})
+		case !exists && indexed:
+			ops = append(ops, kv_store.Op{Type: kv_store.OpDelete, Key: key})
+		}
+	}
+
+	return ops
+}
+
+// The RRsets of a name as stored, by type, along with their response policies.
+type storedName struct {
+	records  map[string][]zone.Record
+	policies map[string]zone.Policy
+}
+
+func (s storedName) exists() bool {
+	return len(s.records) > 0
+}
+
+// Read the RRsets of the name, which must be canonical, from the group owning it (see shards.go).
+func (node *RaftNode) readName(name string) (storedName, error) {
+
+	stored := storedName{records: make(map[string][]zone.Record), policies: make(map[string]zone.Policy)}
+
+	kvs, err := node.shardOf(name).scanLocalStore(zone.KeyPrefix + name + ":")
+	if err != nil {
+		return stored, err
+	}
+
+	for _, kv := range kvs {
+
+		_, rtype, ok := zone.ParseRecordKey(kv.Key)
+		if !ok {
+			continue
+		}
+
+		if zone.IsPolicyKey(kv.Key) {
+
+			var policy zone.Policy
+			if json.Unmarshal([]byte(kv.Value), &policy) == nil {
+				stored.policies[rtype] = policy
+			}
+
+			continue
+		}
+
+		var records []zone.Record
+		if err := json.Unmarshal([]byte(kv.Value), &records); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid RRset")
+			continue
+		}
+
+		if len(records) > 0 {
+			stored.records[rtype] = records
+		}
+	}
+
+	// The SOA record is answered with the serial served, see serials.go
+	if soa := stored.records["SOA"]; len(soa) == 1 {
+		if serial, ok := node.servedSerial(name); ok {
+			soa[0].Data = withSerial(soa[0].Data, serial)
+		}
+	}
+
+	return stored, nil
+}
+
+// Whether the name, which must be canonical, has descendants holding records.
+func (node *RaftNode) hasDescendants(name string) (bool, error) {
+
+	key := nameIndexKey(name)
+
+	contents, _, err := node.shardOf(name).stateMachine().Lookup(fmt.Sprintf("prefix/%s?limit=2", url.PathEscape(key)))
+	if err != nil {
+		return false, err
+	}
+
+	var page kv_store.RangeResponse
+	if err := json.Unmarshal([]byte(contents), &page); err != nil {
+		return false, err
+	}
+
+	for _, kv := range page.Kvs {
+		if kv.Key != key {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Return the records of the RRset, which must be canonical, as resource records owned by owner.
+func (node *RaftNode) storedRRs(owner, rtype string, records []zone.Record) []dns.RR {
+
+	var rrs []dns.RR
+
+	for _, r := range records {
+
+		rr, err := recordRR(owner, rtype, r)
+		if err != nil || rr == nil {
+			node.logger().Warn().Err(err).Str("name", owner).Str("type", rtype).Msg("Invalid record")
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// Return the RRset of the name as answered to the client, owned by owner: the records meant for the
+// region of the client (see geo.go), chosen by the policy of the RRset (see policies.go). Also return
+// whether the records were chosen by either, and so may vary between the answers.
+func (node *RaftNode) answerRRset(view DNSView, client *geoClient, name, owner, rtype string, stored storedName) ([]dns.RR, bool) {
+
+	records := stored.records[rtype]
+	varies := false
+
+	if client != nil && (rtype == "A" || rtype == "AAAA") {
+
+		var region string
+		if records, region = client.choose(records); region != "" {
+			node.Meta.metrics.Add("dns_geo_answers_total", 1, "view", view.Name, "region", region)
+			varies = true
+		}
+	}
+
+	if policy, ok := stored.policies[rtype]; ok {
+		records = node.applyPolicy(zone.RecordKey(name, rtype), policy, records)
+		node.Meta.metrics.Add("dns_policy_answers_total", 1, "view", view.Name, "mode", policy.Mode)
+		varies = true
+	}
+
+	return node.storedRRs(owner, rtype, records), varies
+}
+
+// The outcome of the lookup of a name within the records of the replica.
+type lookupResult struct {
+	stored   storedName // RRsets of the name, or of the wildcard answering it
+	source   string     // Name holding the RRsets, the wildcard if the name doesn't exist
+	apex     string     // Apex of the zone of the name, "" if it has none
+	soa      []dns.RR   // SOA record of the apex
+	cut      string     // Delegated subzone containing the name, "" if none
+	existing bool       // Whether the name exists, records or descendants
+}
+
+// Look the name up, which must be canonical and served by the view.
+func (node *RaftNode) lookupName(view DNSView, name string, qtype uint16) (lookupResult, error) {
+
+	result := lookupResult{source: name}
+
+	// The name and its ancestors served by the view, up to the apex of its zone.
+	var names []string
+	var stored []storedName
+
+	for i := 0; ; {
+
+		ancestor := dns.Fqdn(name[i:])
+		if !view.serves(ancestor) {
+			break
+		}
+
+		s, err := node.readName(ancestor)
+		if err != nil {
+			return result, err
+		}
+
+		names, stored = append(names, ancestor), append(stored, s)
+
+		if soa, ok := s.records["SOA"]; ok {
+			result.apex, result.soa = ancestor, node.storedRRs(ancestor, "SOA", soa)
+			break
+		}
+
+		var end bool
+		if i, end = dns.NextLabel(name, i); end {
+			break
+		}
+	}
+
+	if len(names) == 0 {
+		return result, nil
+	}
+
+	// The highest cut below the apex delegates the name, a cut itself keeping its DS records.
+	if result.apex != "" {
+
+		for i := len(names) - 2; i >= 0; i-- {
+
+			if _, ok := stored[i].records["NS"]; ok && (i > 0 || qtype != dns.TypeDS) {
+				result.cut = names[i]
+				return result, nil
+			}
+		}
+	}
+
+	if result.stored = stored[0]; result.stored.exists() {
+		result.existing = true
+		return result, nil
+	}
+
+	existing, err := node.hasDescendants(name)
+	if err != nil || existing {
+		result.existing = existing
+		return result, err
+	}
+
+	// The wildcard of the closest encloser answers for the names that don't exist.
+	for i := 1; i < len(names); i++ {
+
+		encloser := stored[i].exists() || names[i] == result.apex
+		if !encloser {
+			if encloser, err = node.hasDescendants(names[i]); err != nil {
+				return result, err
+			}
+		}
+
+		if !encloser {
+			continue
+		}
+
+		wildcard := "*." + names[i]
+
+		s, err := node.readName(wildcard)
+		if err != nil {
+			return result, err
+		}
+
+		if s.exists() {
+			result.stored, result.source = s, wildcard
+		}
+
+		return result, nil
+	}
+
+	return result, nil
+}
+
+// Answer the query for the name, served by the view, chasing the CNAME records within the zones of
+// the replica. Also return whether records of the answer were chosen by region or by a policy, see
+// answerRRset.
+func (node *RaftNode) lookup(view DNSView, req *dns.Msg, name string, client *geoClient) (*dns.Msg, bool, error) {
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	qtype := req.Question[0].Qtype
+	chased := make(map[string]bool)
+	varies := false
+
+	// Add the RRset as answered to the answer section, returning its records.
+	answer := func(result lookupResult, owner, rtype string) []dns.RR {
+
+		rrs, v := node.answerRRset(view, client, result.source, owner, rtype, result.stored)
+		resp.Answer = append(resp.Answer, rrs...)
+		varies = varies || v
+
+		return rrs
+	}
+
+	for owner := name; ; {
+
+		result, err := node.lookupName(view, owner, qtype)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// A CNAME leading out of the zones of the replica is left for the resolver to follow.
+		if owner != name {
+
+			if result.apex == "" || result.cut != "" {
+				return resp, varies, nil
+			}
+
+			if _, _, delegated := node.delegatedZone(owner); delegated {
+				return resp, varies, nil
+			}
+		}
+
+		if result.cut != "" {
+			node.Meta.metrics.Add("dns_lookups_total", 1, "view", view.Name, "outcome", "referral")
+			return node.referral(req, result.cut), false, nil
+		}
+
+		resp.Authoritative = true
+
+		outcome := "answer"
+		if result.source != owner {
+			outcome = "wildcard"
+		}
+
+		stored := result.stored
+		rtype := strings.ToUpper(dns.TypeToString[qtype])
+
+		switch {
+
+		case !stored.exists():
+
+			if result.existing {
+				outcome = "nodata"
+			} else {
+				outcome = "nxdomain"
+				resp.Rcode = dns.RcodeNameError
+			}
+
+			resp.Ns = negativeSOA(result.soa)
+
+		case qtype == dns.TypeANY:
+
+			for t := range stored.records {
+				answer(result, owner, t)
+			}
+
+		case len(stored.records[rtype]) > 0:
+			answer(result, owner, rtype)
+
+		case len(stored.records["CNAME"]) > 0:
+
+			cname := answer(result, owner, "CNAME")
+
+			chased[owner] = true
+
+			if len(cname) == 0 || len(chased) > maxCNAMEChain {
+				return resp, varies, nil
+			}
+
+			target := zone.CanonicalName(cname[0].(*dns.CNAME).Target)
+			if chased[target] || !view.serves(target) {
+				return resp, varies, nil
+			}
+
+			owner = target
+			continue
+
+		default:
+			outcome = "nodata"
+			resp.Ns = negativeSOA(result.soa)
+
+		}
+
+		node.Meta.metrics.Add("dns_lookups_total", 1, "view", view.Name, "outcome", outcome)
+		return resp, varies, nil
+	}
+}
+
+// Return the SOA record of the authority section of a negative answer, whose TTL is that of the
+// negative caching: the lesser of its own and of its minimum field.
+func negativeSOA(soa []dns.RR) []dns.RR {
+
+	if len(soa) == 0 {
+		return nil
+	}
+
+	rr := dns.Copy(soa[0]).(*dns.SOA)
+	if rr.Minttl < rr.Hdr.Ttl {
+		rr.Hdr.Ttl = rr.Minttl
+	}
+
+	return []dns.RR{rr}
+}
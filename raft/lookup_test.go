@@ -0,0 +1,144 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks the authoritative lookups: the wildcards, NXDOMAIN
+ * and NODATA with the SOA record of the zone, the empty non-terminals, the
+ * chasing of the CNAME records within the zone, and the referrals to the
+ * delegated subzones along with their glue.
+ */
+func TestLookups(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lookup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	put := func(name, rtype string, ttl uint32, data ...string) {
+
+		var records []zone.Record
+		for _, d := range data {
+			records = append(records, zone.Record{Name: name, Type: rtype, TTL: ttl, Data: d})
+		}
+
+		encoded, _ := json.Marshal(records)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put("example.com.", "SOA", 3600, "ns1.example.com. admin.example.com. 1 7200 900 1209600 300")
+	put("example.com.", "NS", 3600, "ns1.example.com.")
+	put("www.example.com.", "A", 60, "192.0.2.1")
+	put("*.apps.example.com.", "A", 60, "192.0.2.10")
+	put("host.deep.example.com.", "A", 60, "192.0.2.20")
+	put("alias.example.com.", "CNAME", 60, "www.example.com.")
+	put("chain.example.com.", "CNAME", 60, "alias.example.com.")
+	put("dangling.example.com.", "CNAME", 60, "gone.example.com.")
+	put("outside.example.com.", "CNAME", 60, "www.example.org.")
+	put("loop1.example.com.", "CNAME", 60, "loop2.example.com.")
+	put("loop2.example.com.", "CNAME", 60, "loop1.example.com.")
+	put("sub.example.com.", "NS", 3600, "ns.sub.example.com.", "ns.example.net.")
+	put("sub.example.com.", "DS", 3600, "12345 13 2 49FD46E6C4B45C55D4AC69CBD3CD34AC1AFE51DE")
+	put("ns.sub.example.com.", "A", 3600, "192.0.2.53")
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	view := DNSView{Name: "external", Zones: []string{"example.com."}}
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		return node.answerDNS(view, req, nil)
+	}
+
+	negative := func(resp *dns.Msg) bool {
+		return len(resp.Answer) == 0 && len(resp.Ns) == 1 && resp.Ns[0].Header().Rrtype == dns.TypeSOA && resp.Ns[0].Header().Ttl == 300
+	}
+
+	if resp := query("db.apps.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || !resp.Authoritative || len(resp.Answer) != 1 || resp.Answer[0].Header().Name != "db.apps.example.com." {
+		t.Errorf("Expected the wildcard to answer for the name, got %v", resp)
+	}
+
+	if resp := query("db.apps.example.com.", dns.TypeAAAA); resp.Rcode != dns.RcodeSuccess || !negative(resp) {
+		t.Errorf("Expected NODATA from the wildcard, got %v", resp)
+	}
+
+	if resp := query("missing.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError || !negative(resp) {
+		t.Errorf("Expected NXDOMAIN with the SOA record, got %v", resp)
+	}
+
+	if resp := query("www.example.com.", dns.TypeMX); resp.Rcode != dns.RcodeSuccess || !negative(resp) {
+		t.Errorf("Expected NODATA with the SOA record, got %v", resp)
+	}
+
+	// deep.example.com. only has descendants, and the wildcard of apps.example.com. doesn't cover it.
+	if resp := query("deep.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || !negative(resp) {
+		t.Errorf("Expected NODATA for an empty non-terminal, got %v", resp)
+	}
+
+	if resp := query("apps.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || !negative(resp) {
+		t.Errorf("Expected NODATA for the parent of a wildcard, got %v", resp)
+	}
+
+	if resp := query("chain.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 || resp.Answer[2].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Expected the CNAME chain and its address, got %v", resp)
+	}
+
+	if resp := query("dangling.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 1 || !negative(&dns.Msg{Ns: resp.Ns}) {
+		t.Errorf("Expected NXDOMAIN for the target of the CNAME, got %v", resp)
+	}
+
+	if resp := query("outside.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || len(resp.Ns) != 0 {
+		t.Errorf("Expected the CNAME leading out of the zone alone, got %v", resp)
+	}
+
+	if resp := query("loop1.example.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 2 {
+		t.Errorf("Expected the CNAME loop to be answered once, got %v", resp)
+	}
+
+	for _, name := range []string{"sub.example.com.", "www.sub.example.com."} {
+		if resp := query(name, dns.TypeA); resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 2 || len(resp.Extra) != 1 || resp.Extra[0].(*dns.A).A.String() != "192.0.2.53" {
+			t.Errorf("Expected a referral to the subzone along with its glue for %v, got %v", name, resp)
+		}
+	}
+
+	if resp := query("sub.example.com.", dns.TypeDS); !resp.Authoritative || len(resp.Answer) != 1 {
+		t.Errorf("Expected the DS record of the cut to be answered, got %v", resp)
+	}
+
+	if got := node.Meta.metrics.Get("dns_lookups_total", "view", "external", "outcome", "referral"); got != 2 {
+		t.Errorf("Expected 2 referrals, got %v", got)
+	}
+
+	// Deleting the last record of a name removes it from the index.
+	txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: zone.RecordKey("host.deep.example.com.", "A")}}})
+	kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+
+	if resp := query("deep.example.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected NXDOMAIN once the descendants are deleted, got %v", resp)
+	}
+}
@@ -0,0 +1,57 @@
+package raft
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+)
+
+// Magic numbers of the network file systems, see statfs(2).
+const (
+	nfsMagic  = 0x6969
+	cifsMagic = 0xff534d42
+	smb2Magic = 0xfe534d42
+)
+
+// Detect the kind of media the given path is on, from its file system and the rotational flag of
+// its block device in sysfs. Return "" if unknown (e.g. an overlay or a device-mapper volume).
+func diskMedia(path string) string {
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return ""
+	}
+
+	switch uint32(fs.Type) {
+	case nfsMagic:
+		return mediaNFS
+	case cifsMagic, smb2Magic:
+		return mediaCIFS
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return ""
+	}
+
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+
+	// A partition has no queue of its own, its disk being its parent in sysfs.
+	for _, queue := range []string{"queue", "../queue"} {
+
+		contents, err := ioutil.ReadFile(fmt.Sprintf("/sys/dev/block/%d:%d/%s/rotational", major, minor, queue))
+		if err != nil {
+			continue
+		}
+
+		if strings.TrimSpace(string(contents)) == "1" {
+			return mediaHDD
+		}
+		return mediaSSD
+	}
+
+	return ""
+}
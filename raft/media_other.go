@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package raft
+
+// The media can only be detected on Linux, see media_linux.go
+func diskMedia(path string) string {
+	return ""
+}
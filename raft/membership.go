@@ -0,0 +1,508 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Cluster membership. The initial members of the cluster are the replicas 0 to n-1 given on startup.
+Afterwards, the membership is changed one replica at a time by replicating a "CONFIG" log entry,
+holding the complete list of members of the new configuration.
+
+As with single-server membership changes in the Raft dissertation, a replica always uses the latest
+configuration present in its log, whether it is committed or not. Only one change may be in progress
+at a time, so that the majorities of the old and new configurations always overlap.
+
+Replicas that are not members of their current configuration (e.g. a new replica waiting to be
+added) never start elections, and their vote requests are ignored by the members, so that a
+removed replica can't disrupt the cluster.
+
+A member is only removed once the cluster is known to survive without it: the entries it holds
+must be replicated on a majority of the remaining members, and a majority of the remaining
+members must have responded to the leader recently.
+
+The members may declare their failure domain, and a change leaving a quorum of the voters in a
+single zone, rack or host (see placement.go) is refused, unless forced with force_placement=true.
+
+The addresses of a member may also change (e.g. after its host was given another IP) through a
+configuration with the same members: the other replicas dial the new address when they switch to it,
+and the leader resumes the replication where it was.
+
+Learners (e.g. the members being decommissioned, see decommission.go) are sent the log like the
+other members, but never start elections, and neither their votes nor their acknowledgements count
+towards the quorum: the majorities are those of the voters only.
+*/
+
+// A member is considered healthy by the leader if it responded to an AppendEntries within this duration.
+const memberHealthTimeout = time.Second
+
+var errConfigChangePending = errors.New("another membership change is in progress")
+
+// A replica of the cluster.
+type Member struct {
+	Id            int32  `json:"id"`
+	Address       string `json:"address"`                  // Address of the replica's gRPC server
+	ClientAddress string `json:"client_address"`           // Address of the replica's client HTTP server
+	Witness       bool   `json:"witness,omitempty"`        // Whether the replica only votes, see witness.go
+	ConsensusOnly bool   `json:"consensus_only,omitempty"` // Whether the replica serves no queries, see serving.go
+	Learner       bool   `json:"learner,omitempty"`        // Whether the replica doesn't vote, see decommission.go
+	Domain        string `json:"domain,omitempty"`         // Failure domain of the replica, as zone/rack/host, see placement.go
+}
+
+// The member using the default addresses for the given replica ID.
+func defaultMember(id int32) Member {
+	return groupMember(0, id)
+}
+
+// The member using the default addresses of the group for the given replica ID, see shards.go
+func groupMember(group int, id int32) Member {
+
+	return Member{
+		Id:            id,
+		Address:       PeerAddress(group, int(id)),
+		ClientAddress: ClientAddress(group, int(id)),
+	}
+
+}
+
+func isConfigEntry(entry *protos.LogEntry) bool {
+	return len(entry.Operation) == 2 && entry.Operation[0] == "CONFIG"
+}
+
+func encodeMembers(members []Member) string {
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Id < members[j].Id })
+
+	encoded, _ := json.Marshal(members)
+	return string(encoded)
+}
+
+func sameMembers(a, b []Member) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	found := make(map[Member]bool)
+	for _, m := range a {
+		found[m] = true
+	}
+
+	for _, m := range b {
+		if !found[m] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func decodeMembers(encoded string) ([]Member, error) {
+
+	var members []Member
+
+	if err := json.Unmarshal([]byte(encoded), &members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// Return the member with the given ID in the current configuration. Must be called with the (read) lock held.
+func (node *RaftNode) member(id int32) (Member, bool) {
+
+	for _, m := range node.Meta.members {
+		if m.Id == id {
+			return m, true
+		}
+	}
+
+	return Member{}, false
+}
+
+// Return the voting members of the configuration, those that aren't learners.
+func voters(members []Member) []Member {
+
+	var voting []Member
+	for _, m := range members {
+		if !m.Learner {
+			voting = append(voting, m)
+		}
+	}
+
+	return voting
+}
+
+// Whether the replica with the given ID is a voting member of the current configuration. Must be
+// called with the (read) lock held.
+func (node *RaftNode) voter(id int32) bool {
+
+	m, ok := node.member(id)
+	return ok && !m.Learner
+}
+
+// Whether a membership change is appended to the log but not committed yet. Must be called with the (read) lock held.
+func (node *RaftNode) pendingConfigChange() bool {
+
+	for i := node.commitIndex + 1; i <= node.lastLogIndex(); i++ {
+		if isConfigEntry(node.entry(i)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+A membership change, returning the configuration to propose built from the current one, once checked
+(e.g. by checkPlacement). The lock is released between the checks of the handlers and the appending of
+the "CONFIG" entry (see proposeSessionCommand), so the change is run again under the lock right before
+the entry is appended: two concurrent changes can't both be appended, and a change is never built from
+a configuration that another one replaced in between. Called with the (read) lock held.
+*/
+type configChange func() ([]Member, error)
+
+// A membership change refused in the current configuration, answered with 409 like errConfigChangePending.
+type configConflict struct {
+	error
+}
+
+// The change proposed with a context, and the configuration appended for it, see proposeConfig.
+type configProposal struct {
+	change  configChange
+	members []Member
+}
+
+type configContextKey struct{}
+
+// Return the membership change proposed with the context, if any.
+func configWrite(ctx context.Context) (*configProposal, bool) {
+	p, ok := ctx.Value(configContextKey{}).(*configProposal)
+	return p, ok
+}
+
+// Return the configuration the change leads to, refusing it while another change is in progress. Must
+// be called with the (read) lock held.
+func (node *RaftNode) nextConfig(change configChange) ([]Member, error) {
+
+	if node.pendingConfigChange() {
+		return nil, errConfigChangePending
+	}
+
+	members, err := change()
+	if err != nil {
+		return nil, configConflict{err}
+	}
+
+	return members, nil
+}
+
+/*
+Propose the membership change, returning the configuration appended for it, which is built again from
+the configuration current when the entry is appended. Must be called on the leader with the read lock
+held, returns with no lock held.
+*/
+func (node *RaftNode) proposeConfig(ctx context.Context, change configChange) ([]Member, error) {
+
+	members, err := node.nextConfig(change)
+	if err != nil {
+		node.ReleaseRLock("Propose Config")
+		return nil, err
+	}
+
+	p := &configProposal{change: change, members: members}
+
+	success, err := node.WriteCommand(context.WithValue(ctx, configContextKey{}, p), []string{"CONFIG", encodeMembers(members)}, "") // releases the lock
+	if !success {
+		return nil, err
+	}
+
+	return p.members, nil
+}
+
+// Check the "CONFIG" operation again right before it is appended, replacing its configuration with the
+// one its change builds from the current configuration. Must be called with the lock held.
+func (node *RaftNode) recheckConfig(ctx context.Context, operation []string) error {
+
+	p, ok := configWrite(ctx)
+	if !ok {
+
+		if node.pendingConfigChange() {
+			return errConfigChangePending
+		}
+		return nil
+	}
+
+	members, err := node.nextConfig(p.change)
+	if err != nil {
+		return err
+	}
+
+	p.members = members
+	operation[1] = encodeMembers(members)
+	return nil
+}
+
+// Switch to the latest configuration in the log, or to the initial one if the log has none.
+// Must be called with the lock held, whenever entries are added to or overwritten in the log.
+func (node *RaftNode) refreshMembership() {
+	node.setMembers(node.membersAt(node.lastLogIndex()))
+}
+
+// Return the configuration as of the entry at the given index: that of the latest "CONFIG" entry up to
+// it, or the one as of the start of the log (see log.go), or the initial one. Must be called with the
+// (read) lock held.
+func (node *RaftNode) membersAt(index int32) []Member {
+
+	for i := index; i >= node.logStart; i-- {
+
+		if !isConfigEntry(node.entry(i)) {
+			continue
+		}
+
+		decoded, err := decodeMembers(node.entry(i).Operation[1])
+		if err != nil {
+			node.logger().Error().Err(err).Int32("index", i).Msg("Invalid configuration")
+			continue
+		}
+
+		return decoded
+	}
+
+	if node.logStartMembers != nil {
+		return node.logStartMembers
+	}
+
+	return node.Meta.initial_members
+}
+
+// Start using the given configuration: connect to the new members, and stop replicating to
+// the removed ones. Must be called with the lock held.
+func (node *RaftNode) setMembers(members []Member) {
+
+	previous := make(map[int32]Member)
+	for _, m := range node.Meta.members {
+		previous[m.Id] = m
+	}
+
+	// The peer clients, nextIndex and matchIndex are indexed by replica ID.
+	size := len(node.Meta.peer_replica_clients)
+	for _, m := range members {
+		if int(m.Id) >= size {
+			size = int(m.Id) + 1
+		}
+	}
+
+	for len(node.Meta.peer_replica_clients) < size {
+		node.Meta.peer_replica_clients = append(node.Meta.peer_replica_clients, nil)
+	}
+
+	for len(node.nextIndex) < size {
+		node.nextIndex = append(node.nextIndex, 0)
+		node.matchIndex = append(node.matchIndex, 0)
+	}
+
+	current := make(map[int32]bool)
+
+	for _, m := range members {
+
+		current[m.Id] = true
+
+		if m.Id == node.Meta.replica_id {
+			continue
+		}
+
+		// Peers that were already members keep their client, which may have been
+		// deliberately disconnected (e.g. by the tests).
+		old, ok := previous[m.Id]
+		if ok && old.Address == m.Address {
+			continue
+		}
+
+		transport, err := node.dialPeer(m.Id, m.Address)
+		if err != nil {
+			node.logger().Error().Err(err).Int32("peer_id", m.Id).Str("address", m.Address).Msg("Unable to dial replica")
+			continue
+		}
+
+		node.Meta.peer_replica_clients[m.Id] = transport
+
+		// A member whose address changed still holds its log, and keeps its indices.
+		if ok {
+			node.logger().Info().Int32("peer_id", m.Id).Str("previous_address", old.Address).Str("address", m.Address).Msg("Peer address changed, redialed")
+			continue
+		}
+
+		// A new replica is sent the whole log, rather than probing backwards from the end of it.
+		node.nextIndex[m.Id] = 0
+		node.matchIndex[m.Id] = 0
+	}
+
+	for id := range node.Meta.peer_replica_clients {
+		if !current[int32(id)] {
+			node.Meta.peer_replica_clients[id] = nil
+		}
+	}
+
+	if !sameMembers(node.Meta.members, members) {
+		node.logger().Info().Interface("members", members).Msg("Switching to configuration")
+	}
+
+	node.Meta.members = members
+	node.Meta.n_replicas = int32(len(voters(members)))
+}
+
+// Return the configuration with the given member added. Must be called with the (read) lock held.
+func (node *RaftNode) withMember(m Member) ([]Member, error) {
+
+	if _, ok := node.member(m.Id); ok {
+		return nil, fmt.Errorf("replica %v is already a member", m.Id)
+	}
+
+	for _, existing := range node.Meta.members {
+		if existing.Address == m.Address {
+			return nil, fmt.Errorf("address %v is already used by replica %v", m.Address, existing.Id)
+		}
+	}
+
+	return append(append([]Member{}, node.Meta.members...), m), nil
+}
+
+// Return the configuration with the given member removed. Must be called with the (read) lock held.
+func (node *RaftNode) withoutMember(id int32) ([]Member, error) {
+
+	if _, ok := node.member(id); !ok {
+		return nil, fmt.Errorf("replica %v is not a member", id)
+	}
+
+	if id == node.Meta.replica_id {
+		return nil, fmt.Errorf("replica %v is the leader, transfer its leadership first", id)
+	}
+
+	var members []Member
+	for _, m := range node.Meta.members {
+		if m.Id != id {
+			members = append(members, m)
+		}
+	}
+
+	return members, nil
+}
+
+// Return the configuration with the addresses and the failure domain of the given member replaced by
+// the non-empty ones given. Must be called with the (read) lock held.
+func (node *RaftNode) withAddresses(id int32, address, clientAddress, domain string) ([]Member, error) {
+
+	if _, ok := node.member(id); !ok {
+		return nil, fmt.Errorf("replica %v is not a member", id)
+	}
+
+	members := append([]Member{}, node.Meta.members...)
+	for i := range members {
+
+		if members[i].Id != id {
+
+			if address != "" && members[i].Address == address {
+				return nil, fmt.Errorf("address %v is already used by replica %v", address, members[i].Id)
+			}
+			continue
+		}
+
+		if address != "" {
+			members[i].Address = address
+		}
+
+		if clientAddress != "" {
+			members[i].ClientAddress = clientAddress
+		}
+
+		if domain != "" {
+			members[i].Domain = domain
+		}
+	}
+
+	return members, nil
+}
+
+// Return the configuration with the given member demoted to a learner. Must be called with the (read)
+// lock held.
+func (node *RaftNode) withLearner(id int32) ([]Member, error) {
+
+	if _, ok := node.member(id); !ok {
+		return nil, fmt.Errorf("replica %v is not a member", id)
+	}
+
+	if id == node.Meta.replica_id {
+		return nil, fmt.Errorf("replica %v is the leader, transfer its leadership first", id)
+	}
+
+	members := append([]Member{}, node.Meta.members...)
+	for i := range members {
+		if members[i].Id == id {
+			members[i].Learner = true
+		}
+	}
+
+	return members, nil
+}
+
+// Whether the member responded to an AppendEntries from the leader recently. Must be called on the leader
+// with the (read) lock held.
+func (node *RaftNode) healthy(id int32) bool {
+
+	contact, ok := node.last_contact[id]
+	return ok && node.now().Sub(contact) < memberHealthTimeout
+}
+
+/*
+Check that the given members can make progress without the removed one: the entries known to be held
+by the departing replica (and all the committed ones) must be held by a majority of the remaining
+voters, and a majority of them must be healthy. Also checks the demotion of a voter to a learner, the
+remaining members then including the learner. Must be called on the leader with the (read) lock held.
+*/
+func (node *RaftNode) checkRemoval(id int32, remaining []Member) error {
+
+	durable := node.commitIndex
+	if node.matchIndex[id] > durable {
+		durable = node.matchIndex[id]
+	}
+
+	holding, healthy := 0, 0
+	remaining = voters(remaining)
+
+	for _, m := range remaining {
+
+		if m.Id == node.Meta.replica_id {
+			holding++
+			healthy++
+			continue
+		}
+
+		if node.matchIndex[m.Id] >= durable {
+			holding++
+		}
+
+		if node.healthy(m.Id) {
+			healthy++
+		}
+	}
+
+	quorum := len(remaining)/2 + 1
+
+	if holding < quorum {
+		return fmt.Errorf("entries up to index %v are only held by %v of the %v remaining voters, %v are needed", durable, holding, len(remaining), quorum)
+	}
+
+	if healthy < quorum {
+		return fmt.Errorf("only %v of the %v remaining voters are healthy, %v are needed", healthy, len(remaining), quorum)
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that a replica uses the latest configuration in its
+ * log, whether committed or not, and falls back to the initial members once
+ * the configuration entries are removed from the log.
+ */
+func TestRefreshMembership(t *testing.T) {
+
+	node := &RaftNode{
+		Meta: &NodeMetadata{
+			replica_id: 0,
+			Config:     DefaultConfig(),
+		},
+		commitIndex: 0,
+	}
+
+	initial := []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.Meta.initial_members = initial
+	node.Meta.peer_replica_clients = make([]Transport, 3)
+	node.nextIndex = make([]int32, 3)
+	node.matchIndex = make([]int32, 3)
+
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}}
+	node.refreshMembership()
+
+	if !sameMembers(node.Meta.members, initial) || node.Meta.n_replicas != 3 {
+		t.Fatalf("Expected the initial members, got %v", node.Meta.members)
+	}
+
+	members, err := node.withMember(defaultMember(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := node.withMember(Member{Id: 4, Address: ":5001"}); err == nil {
+		t.Errorf("Expected a member reusing an address to be rejected")
+	}
+
+	node.log = append(node.log, protos.LogEntry{Term: 1, Operation: []string{"CONFIG", encodeMembers(members)}})
+	node.refreshMembership()
+
+	if _, ok := node.member(3); !ok || node.Meta.n_replicas != 4 || len(node.Meta.peer_replica_clients) != 4 {
+		t.Errorf("Expected replica 3 to be a member, got %v", node.Meta.members)
+	}
+
+	if !node.pendingConfigChange() {
+		t.Errorf("Expected the uncommitted configuration to be pending")
+	}
+
+	if _, err := node.withMember(defaultMember(3)); err == nil {
+		t.Errorf("Expected adding an existing member to be rejected")
+	}
+
+	// The uncommitted configuration is overwritten by a new leader.
+	node.log = node.log[:1]
+	node.refreshMembership()
+
+	if _, ok := node.member(3); ok || node.Meta.n_replicas != 3 || node.Meta.peer_replica_clients[3] != nil {
+		t.Errorf("Expected the initial members after the configuration was removed, got %v", node.Meta.members)
+	}
+}
+
+/*
+ * This test case checks that a member is only removed once the entries it
+ * holds are replicated on a majority of the remaining members, and a majority
+ * of the remaining members is healthy.
+ */
+func TestCheckRemoval(t *testing.T) {
+
+	node := &RaftNode{
+		Meta:         &NodeMetadata{replica_id: 0},
+		commitIndex:  4,
+		matchIndex:   []int32{0, 4, 6, 3, 6},
+		last_contact: make(map[int32]time.Time),
+	}
+
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2), defaultMember(3), defaultMember(4)}
+
+	for _, id := range []int32{1, 2, 3, 4} {
+		node.last_contact[id] = time.Now()
+	}
+
+	cases := []struct {
+		id   int32
+		safe bool
+	}{
+		{1, true},  // The others hold up to its index 4
+		{2, false}, // Only replicas 0 and 4 hold up to its index 6
+		{3, true},  // The others hold all the committed entries
+	}
+
+	for _, c := range cases {
+
+		remaining, err := node.withoutMember(c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := node.checkRemoval(c.id, remaining); (err == nil) != c.safe {
+			t.Errorf("Removing replica %v: expected safe=%v, got error %v", c.id, c.safe, err)
+		}
+	}
+
+	// Two of the remaining members are down.
+	node.last_contact[2] = time.Now().Add(-time.Minute)
+	delete(node.last_contact, 4)
+
+	remaining, _ := node.withoutMember(3)
+	if err := node.checkRemoval(3, remaining); err == nil {
+		t.Errorf("Expected the removal to be refused without a healthy quorum")
+	}
+
+	if _, err := node.withoutMember(0); err == nil {
+		t.Errorf("Expected the removal of the leader to be refused")
+	}
+}
+
+/*
+ * This test case checks that a member changing address is redialed at its new
+ * address, keeping its replication indices, and that an address can't be
+ * taken from another member.
+ */
+func TestUpdateMemberAddresses(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{replica_id: 0, Config: DefaultConfig(), metrics: NewMetrics()}}
+
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	previous := &probedTransport{reachable: true}
+	node.Meta.peer_replica_clients = []Transport{nil, previous, &probedTransport{reachable: true}}
+	node.nextIndex, node.matchIndex = []int32{0, 7, 7}, []int32{0, 6, 6}
+
+	if _, err := node.withAddresses(1, defaultMember(2).Address, "", ""); err == nil {
+		t.Errorf("Expected an address used by another member to be rejected")
+	}
+
+	if _, err := node.withAddresses(3, "10.0.0.3:5003", "", ""); err == nil {
+		t.Errorf("Expected the addresses of a replica that isn't a member to be rejected")
+	}
+
+	members, err := node.withAddresses(1, "10.0.0.1:5001", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m := members[1]; m.Address != "10.0.0.1:5001" || m.ClientAddress != defaultMember(1).ClientAddress || node.Meta.members[1].Address != defaultMember(1).Address {
+		t.Fatalf("Expected only the gRPC address of replica 1 to change, got %v", members)
+	}
+
+	node.setMembers(members)
+
+	if node.Meta.peer_replica_clients[1] == Transport(previous) || node.nextIndex[1] != 7 || node.matchIndex[1] != 6 {
+		t.Errorf("Expected replica 1 to be redialed with its indices kept, got %v %v", node.nextIndex, node.matchIndex)
+	}
+
+	if node.Meta.n_replicas != 3 {
+		t.Errorf("Expected the quorum not to change, got %v", node.Meta.n_replicas)
+	}
+}
+
+/*
+ * This test case checks that a membership change is checked again, and built
+ * from the current configuration, right before its entry is appended, so that
+ * concurrent changes can't both be appended.
+ */
+func TestRecheckConfig(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{replica_id: 0, Config: DefaultConfig()}, commitIndex: 0}
+
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}}
+
+	add := func(id int32) configChange {
+		return func() ([]Member, error) { return node.withMember(defaultMember(id)) }
+	}
+
+	// Both additions are checked against the same configuration by their handlers.
+	first := &configProposal{change: add(3)}
+	second := &configProposal{change: add(4)}
+
+	for _, p := range []*configProposal{first, second} {
+		if _, err := node.nextConfig(p.change); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	operation := []string{"CONFIG", ""}
+	if err := node.recheckConfig(context.WithValue(context.Background(), configContextKey{}, first), operation); err != nil {
+		t.Fatal(err)
+	}
+
+	node.log = append(node.log, protos.LogEntry{Term: 1, Operation: operation})
+	node.Meta.members = first.members
+
+	if err := node.recheckConfig(context.WithValue(context.Background(), configContextKey{}, second), []string{"CONFIG", ""}); err != errConfigChangePending {
+		t.Fatalf("Expected the second change to be refused while the first is pending, got %v", err)
+	}
+
+	if err := node.recheckConfig(context.Background(), []string{"CONFIG", ""}); err != errConfigChangePending {
+		t.Errorf("Expected a configuration proposed without a change to be refused while another is pending, got %v", err)
+	}
+
+	// Once the first change is committed, the second one is built from the configuration it led to.
+	node.commitIndex = 1
+
+	operation = []string{"CONFIG", ""}
+	if err := node.recheckConfig(context.WithValue(context.Background(), configContextKey{}, second), operation); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(second.members) != 5 || operation[1] != encodeMembers(second.members) {
+		t.Errorf("Expected the second change to keep replica 3, got %v", second.members)
+	}
+
+	if _, err := node.nextConfig(add(3)); !errors.As(err, &configConflict{}) || proposalStatus(err) != http.StatusConflict {
+		t.Errorf("Expected adding an existing member to be a conflict, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package raft
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Metrics is a minimal registry of counters and gauges, exposed in the Prometheus text format.
+type Metrics struct {
+	mu     sync.Mutex
+	values map[string]float64 // keyed by the metric name along with its formatted labels
+}
+
+// Initialise Metrics object
+func NewMetrics() *Metrics {
+
+	return &Metrics{
+		values: make(map[string]float64),
+	}
+
+}
+
+// Format the series name, e.g. metricKey("x_total", "method", "foo") returns x_total{method="foo"}.
+// Labels are given as alternating names and values.
+func metricKey(name string, labels []string) string {
+
+	if len(labels) == 0 {
+		return name
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add the given value to a counter.
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[metricKey(name, labels)] += value
+}
+
+// Set a gauge to the given value.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[metricKey(name, labels)] = value
+}
+
+// Get the current value of a series.
+func (m *Metrics) Get(name string, labels ...string) float64 {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[metricKey(name, labels)]
+}
+
+// Return a copy of all the series.
+func (m *Metrics) snapshot() map[string]float64 {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := make(map[string]float64, len(m.values))
+	for key, value := range m.values {
+		series[key] = value
+	}
+
+	return series
+}
+
+// Serve the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	m.mu.Lock()
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s %v\n", key, m.values[key])
+	}
+
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
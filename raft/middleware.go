@@ -0,0 +1,205 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Middleware protecting the client-facing HTTP server from exhaustion, e.g. by a slow-loris
+client or a huge request body. The server-wide read timeouts are set on the http.Server in
+StartRaftServer, while the following are applied through the router:
+
+- rate limits:       the requests of each client IP, and of all the clients, are limited, see ratelimit.go.
+- load shedding:     the requests of lower priority are rejected first under overload, see shedding.go.
+- body size limit:   request bodies larger than MaxBodyBytes are rejected.
+- route timeouts:    each route is given ReadRouteTimeout or WriteRouteTimeout to respond.
+- client deadlines:  a client can shorten the time given to its request with the X-Timeout header.
+*/
+
+// Header carrying the time a client is willing to wait for its request, as a duration (e.g. "250ms").
+const TimeoutHeader = "X-Timeout"
+
+/*
+Middleware applying the deadline given by the client in the X-Timeout header to the context of the
+request, so that the request is abandoned (e.g. before a write is proposed) once the client stopped
+waiting for it. The routes then respond with 504 like on a route timeout, see withTimeout.
+*/
+func (node *RaftNode) deadlineMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		header := r.Header.Get(TimeoutHeader)
+
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout, err := time.ParseDuration(header)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Error: invalid %v header %q.", TimeoutHeader, header)
+			return
+		}
+
+		if timeout <= 0 {
+			node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", "deadline")
+			writeError(w, http.StatusGatewayTimeout, "Error: deadline exceeded.")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+	})
+}
+
+// Middleware limiting the size of request bodies to MaxBodyBytes, or to the max_body_bytes cluster
+// setting if set. Requests declaring a larger body are rejected upfront, and reading past the limit
+// fails for the others.
+func (node *RaftNode) bodyLimitMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		max := node.Meta.settings.Int64("max_body_bytes", node.Meta.Config.MaxBodyBytes)
+
+		if max <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > max {
+			node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", "body_size")
+			if httpTrafficClass(r) == classWrite {
+				node.rejectRequest(rejectQuota, r, fmt.Errorf("request body exceeds the limit of %v bytes", max))
+			}
+			writeError(w, http.StatusRequestEntityTooLarge, "Error: request body exceeds the limit of %v bytes.", max)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+/*
+Wrap the handler of a route so that the client gets a 504 Gateway Timeout response if the request
+isn't handled within the given timeout, or before the client's deadline. The handler is given the
+context with the earliest of both deadlines, and its response is buffered until it returns, so
+that a handler still running once the deadline expired can't write past the error response.
+*/
+func (node *RaftNode) withTimeout(handler http.HandlerFunc, timeout time.Duration) http.Handler {
+
+	if timeout <= 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+
+		go func() {
+
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+
+			handler(tw, r.WithContext(ctx))
+			close(done)
+
+		}()
+
+		select {
+
+		case p := <-panicked:
+			panic(p)
+
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			for name, values := range tw.header {
+				w.Header()[name] = values
+			}
+
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+			node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", "timeout")
+			writeError(w, http.StatusGatewayTimeout, "Error: request timed out: %v.", ctx.Err())
+
+		}
+	})
+}
+
+// The response writer of a handler run by withTimeout, buffering its response.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool // Once set, the writes fail with http.ErrHandlerTimeout
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+
+	return tw.body.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+
+	tw.status = status
+}
+
+// Shorthands for wrapping read and write routes with their configured timeouts.
+func (node *RaftNode) readRoute(handler http.HandlerFunc) http.Handler {
+	return node.withTimeout(handler, node.Meta.Config.ReadRouteTimeout)
+}
+
+func (node *RaftNode) writeRoute(handler http.HandlerFunc) http.Handler {
+	return node.withTimeout(handler, node.Meta.Config.WriteRouteTimeout)
+}
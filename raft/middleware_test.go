@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that the deadline given by a client in the X-Timeout
+ * header is applied to the context of its request, and that requests whose
+ * deadline is invalid or already expired are rejected without being handled,
+ * with 504 and the deadline_exceeded code once expired.
+ */
+func TestDeadlineMiddleware(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), rejections: NewRejections()}}
+
+	var deadline time.Time
+	var has_deadline bool
+
+	handler := node.deadlineMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deadline, has_deadline = r.Context().Deadline()
+	}))
+
+	var body []byte
+
+	serve := func(timeout string) int {
+
+		has_deadline = false
+
+		r := httptest.NewRequest("POST", "/key", nil)
+		if timeout != "" {
+			r.Header.Set(TimeoutHeader, timeout)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		body = w.Body.Bytes()
+		return w.Code
+	}
+
+	if code := serve(""); code != http.StatusOK || has_deadline {
+		t.Errorf("Request without a deadline was responded with %v (deadline set: %v)", code, has_deadline)
+	}
+
+	if code := serve("250ms"); code != http.StatusOK || !has_deadline || time.Until(deadline) > 250*time.Millisecond {
+		t.Errorf("Request with a 250ms deadline was responded with %v, deadline %v", code, deadline)
+	}
+
+	if code := serve("soon"); code != http.StatusBadRequest || has_deadline {
+		t.Errorf("Request with an invalid deadline was responded with %v", code)
+	}
+
+	var e ErrorResponse
+	if code := serve("0s"); code != http.StatusGatewayTimeout || has_deadline || json.Unmarshal(body, &e) != nil || e.Code != "deadline_exceeded" {
+		t.Errorf("Request with an expired deadline was responded with %v %q", code, body)
+	}
+
+	// A deadline expiring while the route is handled is answered the same way.
+	slow := node.deadlineMiddleware(node.withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}, time.Second))
+
+	r := httptest.NewRequest("POST", "/key", nil)
+	r.Header.Set(TimeoutHeader, "20ms")
+
+	w := httptest.NewRecorder()
+	slow.ServeHTTP(w, r)
+
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != http.StatusGatewayTimeout || e.Code != "deadline_exceeded" {
+		t.Errorf("Request whose deadline expired was responded with %v %q", w.Code, w.Body.String())
+	}
+}
+
+/*
+ * This test case checks the limits of the client HTTP server: bodies larger
+ * than MaxBodyBytes are rejected with 413, requests past MaxConcurrentRequests
+ * with 503, and routes not handled within their timeout with 504.
+ */
+func TestHTTPLimits(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig(), shedder: &loadShedder{}}}
+	node.Meta.Config.MaxBodyBytes = 8
+	node.Meta.Config.MaxConcurrentRequests = 2
+
+	var read error
+	body := node.bodyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, read = ioutil.ReadAll(r.Body)
+	}))
+
+	w := httptest.NewRecorder()
+	body.ServeHTTP(w, httptest.NewRequest("POST", "/key", strings.NewReader("0123456789")))
+
+	var e ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != http.StatusRequestEntityTooLarge || e.Code != "too_large" {
+		t.Errorf("Expected the oversized body to be rejected with 413, got %v %q", w.Code, w.Body.String())
+	}
+
+	// A body of an unknown length fails once read past the limit.
+	r := httptest.NewRequest("POST", "/key", strings.NewReader("0123456789"))
+	r.ContentLength = -1
+	body.ServeHTTP(httptest.NewRecorder(), r)
+
+	if read == nil {
+		t.Errorf("Expected reading past the limit to fail")
+	}
+
+	// Requests beyond the concurrency cap are shed while the others are served.
+	entered, release := make(chan struct{}), make(chan struct{})
+	shed := node.sheddingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan int)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			shed.ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+			done <- w.Code
+		}()
+		<-entered
+	}
+
+	w = httptest.NewRecorder()
+	shed.ServeHTTP(w, httptest.NewRequest("GET", "/admin/status", nil))
+
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the request past the cap to be rejected with 503, got %v %q", w.Code, w.Body.String())
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected the admitted requests to be served, got %v", code)
+		}
+	}
+
+	// The route timeouts. A handler still running once the error is sent can't write past it.
+	written := make(chan error, 1)
+	timed := node.withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := w.Write([]byte("late"))
+		written <- err
+	}, 20*time.Millisecond)
+
+	w = httptest.NewRecorder()
+	timed.ServeHTTP(w, httptest.NewRequest("GET", "/key", nil))
+
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil || w.Code != http.StatusGatewayTimeout || e.Code != "deadline_exceeded" {
+		t.Errorf("Expected the route timeout to be answered with 504, got %v %q", w.Code, w.Body.String())
+	}
+
+	if err := <-written; err != http.ErrHandlerTimeout {
+		t.Errorf("Expected the late write to fail, got %v", err)
+	}
+
+	fast := node.withTimeout(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}, time.Second)
+
+	w = httptest.NewRecorder()
+	fast.ServeHTTP(w, httptest.NewRequest("POST", "/key", nil))
+
+	if w.Code != http.StatusCreated || w.Body.String() != "created" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Expected the response of the route to be relayed, got %v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,643 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+/*
+The OpenAPI 3 description of the client HTTP API, served by every replica at GET /openapi.json
+(without authentication, like the probes), and from which the typed client of client/rest is
+generated (see client/rest/generate).
+
+Each route of the router (see routes in initial_setup.go) is described by an apiOperation below:
+its parameters, and the Go types of its JSON body and response. The schemas are derived from those
+types by their json tags (see openAPISchemas), so that the document follows the handlers as their
+types change, and TestOpenAPIRoutes checks that the routes and the operations match. The errors of
+every operation are ErrorResponses (see errors.go).
+*/
+
+const openAPIVersion = "3.0.3"
+
+// An operation of the HTTP API, see above.
+type apiOperation struct {
+	Method  string
+	Path    string // OpenAPI path template, e.g. "/admin/members/{id}"
+	ID      string // operationId, the name of its method in the generated client
+	Tag     string
+	Summary string
+	Params  []apiParam
+
+	Body        interface{} // Value of the type of the JSON body, nil if none
+	BodyContent string      // Content type of a body that isn't JSON, e.g. the pairs of an import
+
+	Status   int         // Status of a success, 200 if 0
+	Response interface{} // Value of the type of the JSON response, nil if it isn't JSON
+	Content  string      // Content type of a response that isn't JSON, text/plain if ""
+
+	Public bool // Served without authentication
+}
+
+// A parameter of an operation, in its path, query string or (url-encoded) form.
+type apiParam struct {
+	Name        string
+	In          string // "path", "query" or "form"
+	Type        string // "string", "integer", "boolean", or "array" of strings
+	Description string
+	Required    bool
+}
+
+func pathParam(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: "path", Type: typ, Description: description, Required: true}
+}
+
+func queryParam(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: "query", Type: typ, Description: description}
+}
+
+func formParam(name, typ, description string) apiParam {
+	return apiParam{Name: name, In: "form", Type: typ, Description: description}
+}
+
+// The parameters of the writes of a client, in the form of a POST or PUT or the query string of a DELETE.
+func clientParams(in string) []apiParam {
+	return []apiParam{
+		{Name: "client", In: in, Type: "string", Description: "ID of the client, whose identical consecutive writes are refused"},
+		{Name: "session", In: in, Type: "integer", Description: "Client session of the write, see /admin/sessions"},
+		{Name: "seq", In: in, Type: "integer", Description: "Sequence number of the write in the session"},
+	}
+}
+
+var apiOperations = []apiOperation{
+
+	// Probes
+	{Method: "GET", Path: "/test", ID: "Ping", Tag: "probes", Summary: "Check that the server is up", Public: true},
+	{Method: "GET", Path: "/healthz", ID: "GetHealth", Tag: "probes", Summary: "Whether the replica is alive, 503 if it isn't", Response: Probe{}, Public: true},
+	{Method: "GET", Path: "/readyz", ID: "GetReadiness", Tag: "probes", Summary: "Whether the replica can serve clients, 503 if it can't", Response: Probe{}, Public: true},
+	{Method: "GET", Path: "/openapi.json", ID: "GetOpenAPI", Tag: "probes", Summary: "The OpenAPI description of the HTTP API", Response: map[string]interface{}{}, Public: true},
+
+	// Keys
+	{Method: "POST", Path: "/{key}", ID: "CreateKey", Tag: "keys", Summary: "Create a key, once committed",
+		Params: append([]apiParam{pathParam("key", "string", "The key"), formParam("value", "string", "The value"), formParam("async", "boolean", "Respond once the write is appended to the log of the leader")}, clientParams("form")...),
+		Status: http.StatusCreated},
+	{Method: "GET", Path: "/{key}", ID: "GetKey", Tag: "keys", Summary: "Read a key, answered with a message holding its value",
+		Params: []apiParam{pathParam("key", "string", "The key"), queryParam("rev", "integer", "Revision of the store to read the key at")}},
+	{Method: "PUT", Path: "/{key}", ID: "UpdateKey", Tag: "keys", Summary: "Update an existing key, once committed",
+		Params: append([]apiParam{pathParam("key", "string", "The key"), formParam("value", "string", "The value"), formParam("async", "boolean", "Respond once the write is appended to the log of the leader")}, clientParams("form")...),
+		Status: http.StatusAccepted},
+	{Method: "DELETE", Path: "/{key}", ID: "DeleteKey", Tag: "keys", Summary: "Delete an existing key, once committed",
+		Params: append([]apiParam{pathParam("key", "string", "The key"), queryParam("async", "boolean", "Respond once the write is appended to the log of the leader")}, clientParams("query")...)},
+	{Method: "GET", Path: "/range", ID: "Range", Tag: "keys", Summary: "List the keys from start (included) to end (excluded), paginated",
+		Params:   []apiParam{queryParam("start", "string", "First key"), queryParam("end", "string", "Key after the last one, none if empty"), queryParam("limit", "integer", "Keys per page at most"), queryParam("token", "string", "The next_token of the previous page"), queryParam("rev", "integer", "Revision of the store to list the keys at")},
+		Response: kv_store.RangeResponse{}},
+	{Method: "GET", Path: "/prefix/{prefix}", ID: "Prefix", Tag: "keys", Summary: "List the keys with a prefix, paginated",
+		Params:   []apiParam{pathParam("prefix", "string", "The prefix"), queryParam("limit", "integer", "Keys per page at most"), queryParam("token", "string", "The next_token of the previous page"), queryParam("rev", "integer", "Revision of the store to list the keys at")},
+		Response: kv_store.RangeResponse{}},
+	{Method: "GET", Path: "/audit", ID: "KeyHistory", Tag: "keys", Summary: "The audit history of a key, oldest first",
+		Params: []apiParam{queryParam("key", "string", "The key")}, Response: []AuditRecord{}},
+	{Method: "POST", Path: "/batch", ID: "Batch", Tag: "keys", Summary: "Apply the operations of a batch atomically, as a single entry",
+		Params: clientParams("query"), Body: BatchRequest{}, Response: BatchResponse{}},
+	{Method: "DELETE", Path: "/kvstore", ID: "DeletePrefix", Tag: "keys", Summary: "Delete the keys with a prefix, as a single entry",
+		Params:   append([]apiParam{queryParam("prefix", "string", "The prefix"), queryParam("dry_run", "boolean", "Only count the keys that would be deleted")}, clientParams("query")...),
+		Response: DeletePrefixResponse{}},
+	{Method: "GET", Path: "/commit-status/{index}", ID: "GetCommitStatus", Tag: "keys", Summary: "Whether the entry of an asynchronous write is committed",
+		Params: []apiParam{pathParam("index", "integer", "Index of the entry"), queryParam("term", "integer", "Term of the entry")}, Response: CommitStatus{}},
+	{Method: "POST", Path: "/admin/compact", ID: "Compact", Tag: "keys", Summary: "Discard the revisions of the store older than rev",
+		Params: []apiParam{formParam("rev", "integer", "The oldest revision kept"), formParam("client", "string", "ID of the client")}},
+	{Method: "POST", Path: "/admin/sessions", ID: "RegisterSession", Tag: "keys", Summary: "Register a client session, applying its writes once",
+		Params: []apiParam{formParam("client", "string", "ID of the client")}, Response: struct {
+			Session int64 `json:"session"`
+		}{}},
+	{Method: "POST", Path: "/admin/barrier", ID: "Barrier", Tag: "keys", Summary: "Commit a no-op, once every write acknowledged before is applied",
+		Params: []apiParam{formParam("client", "string", "ID of the client")}, Response: struct {
+			Index    int32 `json:"index"`
+			Term     int32 `json:"term"`
+			LeaderId int32 `json:"leader_id"`
+		}{}},
+
+	// Locks
+	{Method: "GET", Path: "/locks", ID: "ListLocks", Tag: "locks", Summary: "The locks held", Response: []Lock{}},
+	{Method: "POST", Path: "/locks/{name}", ID: "AcquireLock", Tag: "locks", Summary: "Acquire a lock, or renew the lease of its holder",
+		Params:   []apiParam{pathParam("name", "string", "The lock"), formParam("holder", "string", "ID of the holder"), formParam("ttl", "string", "Duration of the lease, e.g. 10s")},
+		Response: Lock{}},
+	{Method: "DELETE", Path: "/locks/{name}", ID: "ReleaseLock", Tag: "locks", Summary: "Release a lock",
+		Params:   []apiParam{pathParam("name", "string", "The lock"), queryParam("holder", "string", "ID of the holder"), queryParam("token", "integer", "Fencing token of the holder")},
+		Response: Lock{}},
+	{Method: "GET", Path: "/locks/{name}/validate", ID: "ValidateLock", Tag: "locks", Summary: "Whether a fencing token is the one of the holder of the lock",
+		Params: []apiParam{pathParam("name", "string", "The lock"), queryParam("token", "integer", "The fencing token")}, Response: LockValidation{}},
+
+	// Zones
+	{Method: "POST", Path: "/zones/{zone}/validate", ID: "ValidateZone", Tag: "zones", Summary: "Check a set of records meant for the zone, writing nothing",
+		Params: []apiParam{pathParam("zone", "string", "The zone")}, Body: []zone.Record{}, Response: ZoneValidation{}},
+	{Method: "GET", Path: "/zones/{zone}/diff", ID: "DiffZone", Tag: "zones", Summary: "The records of the zone changed between two revisions",
+		Params: []apiParam{pathParam("zone", "string", "The zone"), queryParam("from", "integer", "The first revision"), queryParam("to", "integer", "The last revision, the latest if 0")}, Response: ZoneDiff{}},
+	{Method: "GET", Path: "/zones/{zone}/history", ID: "ZoneHistory", Tag: "zones", Summary: "The audit history of the records of the zone, oldest first",
+		Params: []apiParam{pathParam("zone", "string", "The zone")}, Response: []AuditRecord{}},
+	{Method: "GET", Path: "/zones/{zone}/policies", ID: "ListPolicies", Tag: "zones", Summary: "The response policies of the RRsets of the zone",
+		Params: []apiParam{pathParam("zone", "string", "The zone")}, Response: []RRsetPolicy{}},
+	{Method: "PUT", Path: "/zones/{zone}/policies/{name}/{type}", ID: "SetPolicy", Tag: "zones", Summary: "Set the response policy of an RRset",
+		Params: append([]apiParam{pathParam("zone", "string", "The zone"), pathParam("name", "string", "Name of the RRset"), pathParam("type", "string", "Type of the RRset")}, clientParams("query")...),
+		Body:   zone.Policy{}, Response: RRsetPolicy{}},
+	{Method: "DELETE", Path: "/zones/{zone}/policies/{name}/{type}", ID: "DeletePolicy", Tag: "zones", Summary: "Remove the response policy of an RRset",
+		Params: append([]apiParam{pathParam("zone", "string", "The zone"), pathParam("name", "string", "Name of the RRset"), pathParam("type", "string", "Type of the RRset")}, clientParams("query")...),
+		Response: struct {
+			Name    string `json:"name"`
+			Type    string `json:"type"`
+			Deleted bool   `json:"deleted"`
+		}{}},
+
+	// Cluster
+	{Method: "GET", Path: "/admin/status", ID: "GetStatus", Tag: "cluster", Summary: "The state of the replica, as seen by itself", Response: Status{}},
+	{Method: "GET", Path: "/admin/diagnostics", ID: "GetDiagnostics", Tag: "cluster", Summary: "A diagnostics bundle of the replica", Content: "application/gzip"},
+	{Method: "GET", Path: "/admin/metrics", ID: "GetMetrics", Tag: "cluster", Summary: "The metrics of the replica, in the Prometheus text format"},
+	{Method: "GET", Path: "/admin/leader", ID: "GetLeader", Tag: "cluster", Summary: "The last known leader, streamed with every change with watch=true",
+		Params: []apiParam{queryParam("watch", "boolean", "Stream the leader changes as newline-delimited JSON")}, Response: LeaderMetadata{}},
+	{Method: "GET", Path: "/admin/members", ID: "ListMembers", Tag: "cluster", Summary: "The members of the latest configuration", Response: []Member{}},
+	{Method: "POST", Path: "/admin/members", ID: "AddMember", Tag: "cluster", Summary: "Add a member to the cluster",
+		Params: []apiParam{formParam("id", "integer", "Replica ID of the member"), formParam("address", "string", "gRPC address of the member"), formParam("client_address", "string", "Address of its client HTTP server"),
+			formParam("witness", "boolean", "Add it as a witness"), formParam("consensus_only", "boolean", "Add it as a consensus-only member"),
+			formParam("domain", "string", "Failure domain of the member, as zone/rack/host"), formParam("force_placement", "boolean", "Skip the placement check")},
+		Response: []Member{}},
+	{Method: "PUT", Path: "/admin/members/{id}", ID: "UpdateMember", Tag: "cluster", Summary: "Change the addresses or the failure domain of a member",
+		Params: []apiParam{pathParam("id", "integer", "Replica ID of the member"), formParam("address", "string", "The new gRPC address"), formParam("client_address", "string", "The new address of its client HTTP server"),
+			formParam("domain", "string", "The new failure domain, as zone/rack/host"), formParam("force_placement", "boolean", "Skip the placement check")},
+		Response: []Member{}},
+	{Method: "DELETE", Path: "/admin/members/{id}", ID: "RemoveMember", Tag: "cluster", Summary: "Remove a member from the cluster",
+		Params: []apiParam{pathParam("id", "integer", "Replica ID of the member"), queryParam("force", "boolean", "Skip the safety checks"),
+			queryParam("force_placement", "boolean", "Skip the placement check")}, Response: []Member{}},
+	{Method: "POST", Path: "/admin/members/{id}/decommission", ID: "Decommission", Tag: "cluster", Summary: "Start the decommission of a member",
+		Params: []apiParam{pathParam("id", "integer", "Replica ID of the member"), formParam("force_placement", "boolean", "Skip the placement check of its demotion")}, Response: Decommission{}},
+	{Method: "DELETE", Path: "/admin/members/{id}/decommission", ID: "CancelDecommission", Tag: "cluster", Summary: "Cancel the decommission of a member",
+		Params: []apiParam{pathParam("id", "integer", "Replica ID of the member")}, Response: Decommission{}},
+	{Method: "POST", Path: "/admin/shutdown", ID: "Shutdown", Tag: "cluster", Summary: "Shut the replica down, once it isn't a voter",
+		Params: []apiParam{formParam("wipe", "boolean", "Delete its data")}, Response: struct {
+			Wipe bool `json:"wipe"`
+		}{}},
+	{Method: "POST", Path: "/admin/transfer-leader", ID: "TransferLeader", Tag: "cluster", Summary: "Hand the leadership over to another member",
+		Params: []apiParam{formParam("to", "integer", "Replica ID of the member, the most up to date one if empty")}, Response: struct {
+			LeaderId int32 `json:"leader_id"`
+		}{}},
+	{Method: "GET", Path: "/admin/rejections", ID: "ListRejections", Tag: "cluster", Summary: "The writes recently rejected by the replica, newest first",
+		Params:   []apiParam{queryParam("reason", "string", "Only the rejections of the reason"), queryParam("key", "string", "Only the rejections of the key"), queryParam("limit", "integer", "Rejections at most")},
+		Response: []Rejection{}},
+	{Method: "GET", Path: "/admin/query-stats", ID: "GetQueryStats", Tag: "cluster", Summary: "Statistics of the DNS queries answered by the replica",
+		Params: []apiParam{queryParam("top", "integer", "Names and zones listed at most")}, Response: QueryStats{}},
+	{Method: "GET", Path: "/admin/alarms", ID: "ListAlarms", Tag: "cluster", Summary: "The raised alarms", Response: []Alarm{}},
+	{Method: "DELETE", Path: "/admin/alarms", ID: "DisarmAlarms", Tag: "cluster", Summary: "Disarm the alarms, of a member or type if given",
+		Params: []apiParam{queryParam("member", "integer", "Replica ID of the member"), queryParam("type", "string", "Type of the alarms")}, Response: []Alarm{}},
+	{Method: "GET", Path: "/admin/shards", ID: "GetShards", Tag: "cluster", Summary: "The routes of the zones to the groups", Response: struct {
+		Groups int          `json:"groups"`
+		Group  int          `json:"group"`
+		Routes []ShardRoute `json:"routes"`
+	}{}},
+	{Method: "POST", Path: "/admin/shards/split", ID: "SplitShard", Tag: "cluster", Summary: "Move a zone to another group",
+		Params: []apiParam{formParam("zone", "string", "The zone"), formParam("group", "integer", "The group")}, Response: shardChange{}},
+	{Method: "POST", Path: "/admin/shards/merge", ID: "MergeShard", Tag: "cluster", Summary: "Move a zone back to the group of its parent",
+		Params: []apiParam{formParam("zone", "string", "The zone")}, Response: shardChange{}},
+
+	// Backups
+	{Method: "GET", Path: "/admin/snapshot", ID: "GetSnapshot", Tag: "backups", Summary: "The persisted key-value store of the replica, and its client sessions", Content: "application/octet-stream"},
+	{Method: "GET", Path: "/admin/digest", ID: "GetDigest", Tag: "backups", Summary: "The digest of the key-value store of the replica", Response: SnapshotDigest{}},
+	{Method: "GET", Path: "/admin/backup", ID: "GetBackup", Tag: "backups", Summary: "A consistent backup of the cluster, from the leader", Content: "application/octet-stream"},
+	{Method: "GET", Path: "/admin/backups", ID: "ListBackups", Tag: "backups", Summary: "The scheduled backups", Response: BackupScheduleStatus{}},
+	{Method: "GET", Path: "/admin/export", ID: "Export", Tag: "backups", Summary: "The keys at a revision, in a bulk format",
+		Params:  []apiParam{queryParam("format", "string", "json (by default) or protobuf"), queryParam("prefix", "string", "Only the keys with the prefix"), queryParam("revision", "integer", "Revision of the store, the latest if 0")},
+		Content: "application/octet-stream"},
+	{Method: "POST", Path: "/admin/import", ID: "Import", Tag: "backups", Summary: "Import a chunk of pairs, in a bulk format",
+		Params:      []apiParam{queryParam("format", "string", "json (by default) or protobuf"), queryParam("upload", "string", "Name of the upload"), queryParam("offset", "integer", "Offset of the first pair of the chunk in the upload")},
+		BodyContent: "application/octet-stream", Response: ImportStatus{}},
+	{Method: "GET", Path: "/admin/import", ID: "GetImport", Tag: "backups", Summary: "The pairs imported by an upload",
+		Params: []apiParam{queryParam("upload", "string", "Name of the upload")}, Response: ImportStatus{}},
+	{Method: "DELETE", Path: "/admin/import", ID: "DeleteImport", Tag: "backups", Summary: "Forget a complete upload",
+		Params: []apiParam{queryParam("upload", "string", "Name of the upload")}, Response: ImportStatus{}},
+
+	// Settings and access
+	{Method: "GET", Path: "/admin/settings", ID: "ListSettings", Tag: "settings", Summary: "The cluster-wide settings", Response: map[string]string{}},
+	{Method: "GET", Path: "/admin/settings/history", ID: "ListSettingChanges", Tag: "settings", Summary: "The changes of the settings, oldest first",
+		Params: []apiParam{queryParam("name", "string", "Only the changes of the setting")}, Response: []SettingChange{}},
+	{Method: "PUT", Path: "/admin/settings/{name}", ID: "SetSetting", Tag: "settings", Summary: "Set a setting",
+		Params: []apiParam{pathParam("name", "string", "The setting"), formParam("value", "string", "The value"), formParam("client", "string", "ID of the client")}, Response: settingWrite{}},
+	{Method: "DELETE", Path: "/admin/settings/{name}", ID: "DeleteSetting", Tag: "settings", Summary: "Reset a setting to the configuration",
+		Params: []apiParam{pathParam("name", "string", "The setting"), queryParam("client", "string", "ID of the client")}, Response: settingWrite{}},
+	{Method: "GET", Path: "/admin/users", ID: "ListUsers", Tag: "settings", Summary: "The users, without their credentials", Response: []User{}},
+	{Method: "PUT", Path: "/admin/users/{name}", ID: "SetUser", Tag: "settings", Summary: "Create or update a user",
+		Params: []apiParam{pathParam("name", "string", "The user"), formParam("password", "string", "The password"), formParam("token", "string", "The API token"),
+			formParam("permission", "string", "read, write or admin"), formParam("roles", "array", "The roles restricting the user")},
+		Response: userWrite{}},
+	{Method: "DELETE", Path: "/admin/users/{name}", ID: "DeleteUser", Tag: "settings", Summary: "Delete a user",
+		Params: []apiParam{pathParam("name", "string", "The user")}, Response: userWrite{}},
+	{Method: "GET", Path: "/admin/roles", ID: "ListRoles", Tag: "settings", Summary: "The roles", Response: []Role{}},
+	{Method: "PUT", Path: "/admin/roles/{name}", ID: "SetRole", Tag: "settings", Summary: "Create or update a role",
+		Params: []apiParam{pathParam("name", "string", "The role"), formParam("rule", "array", "The rules of the role, e.g. write:zone:example.com")}, Response: roleWrite{}},
+	{Method: "DELETE", Path: "/admin/roles/{name}", ID: "DeleteRole", Tag: "settings", Summary: "Delete a role",
+		Params: []apiParam{pathParam("name", "string", "The role")}, Response: roleWrite{}},
+	{Method: "GET", Path: "/admin/tsig-keys", ID: "ListTSIGKeys", Tag: "settings", Summary: "The TSIG keys, without their secrets", Response: []TSIGKey{}},
+	{Method: "PUT", Path: "/admin/tsig-keys/{name}", ID: "SetTSIGKey", Tag: "settings", Summary: "Create or update a TSIG key",
+		Params:   []apiParam{pathParam("name", "string", "The key"), formParam("algorithm", "string", "e.g. hmac-sha256"), formParam("secret", "string", "Base64 encoded, generated if empty"), formParam("user", "string", "User on behalf of whom the key signs")},
+		Response: tsigKeyWrite{}},
+	{Method: "DELETE", Path: "/admin/tsig-keys/{name}", ID: "DeleteTSIGKey", Tag: "settings", Summary: "Delete a TSIG key",
+		Params: []apiParam{pathParam("name", "string", "The key")}, Response: tsigKeyWrite{}},
+	{Method: "POST", Path: "/admin/tsig-keys/{name}/rotate", ID: "RotateTSIGKey", Tag: "settings", Summary: "Replace the secret of a TSIG key, accepting the previous one for a grace period",
+		Params:   []apiParam{pathParam("name", "string", "The key"), formParam("secret", "string", "Base64 encoded, generated if empty"), formParam("grace", "string", "Time the previous secret is accepted for, e.g. 1h")},
+		Response: tsigKeyWrite{}},
+	{Method: "GET", Path: "/admin/webhooks", ID: "ListWebhooks", Tag: "settings", Summary: "The webhooks, without their secrets", Response: []WebhookStatus{}},
+	{Method: "PUT", Path: "/admin/webhooks/{name}", ID: "SetWebhook", Tag: "settings", Summary: "Create or update a webhook",
+		Params: []apiParam{pathParam("name", "string", "The webhook"), formParam("url", "string", "Receiver of the changes"), formParam("prefix", "string", "Only the changes of the keys with the prefix"),
+			formParam("zone", "string", "Only the changes of the records of the zone"), formParam("secret", "string", "Signs the deliveries")},
+		Response: webhookWrite{}},
+	{Method: "DELETE", Path: "/admin/webhooks/{name}", ID: "DeleteWebhook", Tag: "settings", Summary: "Delete a webhook",
+		Params: []apiParam{pathParam("name", "string", "The webhook")}, Response: webhookWrite{}},
+}
+
+// The responses of the writes of the settings and access, and of the routes of the zones.
+type (
+	shardChange struct {
+		Zone  string `json:"zone"`
+		Route string `json:"route"`
+		Index int32  `json:"index"`
+	}
+
+	settingWrite struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+		Index int32  `json:"index"`
+	}
+
+	userWrite struct {
+		Name       string   `json:"name"`
+		Permission string   `json:"permission"`
+		Roles      []string `json:"roles"`
+		Index      int32    `json:"index"`
+	}
+
+	roleWrite struct {
+		Name  string `json:"name"`
+		Rules []Rule `json:"rules"`
+		Index int32  `json:"index"`
+	}
+
+	tsigKeyWrite struct {
+		Name          string    `json:"name"`
+		Algorithm     string    `json:"algorithm,omitempty"`
+		Secret        string    `json:"secret,omitempty"`
+		User          string    `json:"user,omitempty"`
+		PreviousUntil time.Time `json:"previous_until,omitempty"` // Only after a rotation
+		Deleted       bool      `json:"deleted,omitempty"`
+		Index         int32     `json:"index"`
+	}
+
+	webhookWrite struct {
+		Webhook *Webhook `json:"webhook,omitempty"`
+		Name    string   `json:"name,omitempty"` // Only after a delete
+		Deleted bool     `json:"deleted,omitempty"`
+		Index   int32    `json:"index"`
+	}
+)
+
+// The OpenAPI document, see https://spec.openapis.org/oas/v3.0.3
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Tags       []openAPITag                            `json:"tags"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+	Security   []map[string][]string                   `json:"security"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+type openAPITag struct {
+	Name string `json:"name"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Tags        []string                    `json:"tags"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIBody                `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    *[]map[string][]string      `json:"security,omitempty"` // Empty for the public operations
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIBody struct {
+	Required bool                    `json:"required,omitempty"`
+	Content  map[string]openAPIMedia `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]openAPIMedia `json:"content,omitempty"`
+}
+
+type openAPIMedia struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema    `json:"schemas"`
+	SecuritySchemes map[string]map[string]string `json:"securitySchemes"`
+}
+
+// A schema, of the subset of JSON Schema used by OpenAPI 3.0.
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+}
+
+/*
+The schemas of the Go types, the named struct types being components referred to by their name
+(qualified by their package if another type has it already). The fields are the exported ones, by
+their json names, flattening the embedded structs as encoding/json does; those without omitempty
+are required. A pointer is nullable.
+*/
+type openAPISchemas struct {
+	components map[string]*openAPISchema
+	names      map[reflect.Type]string
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (s *openAPISchemas) of(t reflect.Type) *openAPISchema {
+
+	switch {
+
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+
+	case t == durationType:
+		return &openAPISchema{Type: "integer", Format: "int64", Description: "Nanoseconds"}
+
+	case t == rawMessageType:
+		return &openAPISchema{}
+
+	}
+
+	switch t.Kind() {
+
+	case reflect.Ptr:
+		elem := s.of(t.Elem())
+		if elem.Ref != "" {
+			return &openAPISchema{AllOf: []*openAPISchema{elem}, Nullable: true}
+		}
+		elem.Nullable = true
+		return elem
+
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + s.component(t)}
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &openAPISchema{Type: "string", Format: "byte"}
+		}
+		return &openAPISchema{Type: "array", Items: s.of(t.Elem())}
+
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: s.of(t.Elem())}
+
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+
+	case reflect.Int:
+		return &openAPISchema{Type: "integer"}
+
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: t.Kind().String()}
+
+	case reflect.Float32:
+		return &openAPISchema{Type: "number", Format: "float"}
+
+	case reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+
+	}
+
+	return &openAPISchema{} // Any value, e.g. of an interface{}
+}
+
+// Return the name of the component of the named struct type, adding it if needed.
+func (s *openAPISchemas) component(t reflect.Type) string {
+
+	if name, ok := s.names[t]; ok {
+		return name
+	}
+
+	name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:] // e.g. of the unexported responses above
+	if _, taken := s.components[name]; taken {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.Title(strings.Replace(pkg, "_", "", -1)) + name
+	}
+
+	// Registered before its fields, which may refer to it.
+	s.names[t] = name
+	s.components[name] = nil
+	s.components[name] = s.object(t)
+
+	return name
+}
+
+// Return the schema of the object encoding the struct type.
+func (s *openAPISchemas) object(t reflect.Type) *openAPISchema {
+
+	schema := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	s.fields(t, schema)
+
+	sort.Strings(schema.Required)
+	return schema
+}
+
+func (s *openAPISchemas) fields(t reflect.Type, schema *openAPISchema) {
+
+	for i := 0; i < t.NumField(); i++ {
+
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		name := tag[0]
+
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.fields(field.Type, schema)
+			continue
+		}
+
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		omitempty := false
+		for _, option := range tag[1:] {
+			omitempty = omitempty || option == "omitempty"
+		}
+
+		schema.Properties[name] = s.of(field.Type)
+		if !omitempty {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+}
+
+// Return the OpenAPI document of the operations.
+func openAPI(operations []apiOperation) *openAPIDocument {
+
+	schemas := &openAPISchemas{components: make(map[string]*openAPISchema), names: make(map[reflect.Type]string)}
+	errorSchema := schemas.of(reflect.TypeOf(ErrorResponse{}))
+
+	doc := &openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:       "distributed-dns",
+			Description: "The client HTTP API of the replicas. The writes are served by the leader, the other replicas answering them with 503 and the not_leader code.",
+			Version:     "1",
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: schemas.components,
+			SecuritySchemes: map[string]map[string]string{
+				"bearer": {"type": "http", "scheme": "bearer"},
+				"basic":  {"type": "http", "scheme": "basic"},
+			},
+		},
+		Security: []map[string][]string{{"bearer": {}}, {"basic": {}}},
+	}
+
+	tags := make(map[string]bool)
+
+	for _, op := range operations {
+
+		operation := &openAPIOperation{
+			OperationID: op.ID,
+			Summary:     op.Summary,
+			Tags:        []string{op.Tag},
+			Responses: map[string]*openAPIResponse{
+				"default": {Description: "An error", Content: map[string]openAPIMedia{"application/json": {Schema: errorSchema}}},
+			},
+		}
+
+		if !tags[op.Tag] {
+			tags[op.Tag] = true
+			doc.Tags = append(doc.Tags, openAPITag{Name: op.Tag})
+		}
+
+		if op.Public {
+			operation.Security = &[]map[string][]string{}
+		}
+
+		form := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+
+		for _, p := range op.Params {
+
+			schema := &openAPISchema{Type: p.Type}
+			if p.Type == "array" {
+				schema.Items = &openAPISchema{Type: "string"}
+			}
+
+			if p.In == "form" {
+				schema.Description = p.Description
+				form.Properties[p.Name] = schema
+				continue
+			}
+
+			operation.Parameters = append(operation.Parameters, openAPIParameter{Name: p.Name, In: p.In, Description: p.Description, Required: p.Required, Schema: schema})
+		}
+
+		switch {
+
+		case len(form.Properties) > 0:
+			operation.RequestBody = &openAPIBody{Content: map[string]openAPIMedia{"application/x-www-form-urlencoded": {Schema: form}}}
+
+		case op.Body != nil:
+			operation.RequestBody = &openAPIBody{Required: true, Content: map[string]openAPIMedia{"application/json": {Schema: schemas.of(reflect.TypeOf(op.Body))}}}
+
+		case op.BodyContent != "":
+			operation.RequestBody = &openAPIBody{Required: true, Content: map[string]openAPIMedia{op.BodyContent: {Schema: &openAPISchema{Type: "string", Format: "binary"}}}}
+
+		}
+
+		status, response := op.Status, &openAPIResponse{Description: op.Summary}
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		switch {
+
+		case op.Response != nil:
+			response.Content = map[string]openAPIMedia{"application/json": {Schema: schemas.of(reflect.TypeOf(op.Response))}}
+
+		case op.Content != "":
+			response.Content = map[string]openAPIMedia{op.Content: {Schema: &openAPISchema{Type: "string", Format: "binary"}}}
+
+		default:
+			response.Content = map[string]openAPIMedia{"text/plain": {Schema: &openAPISchema{Type: "string"}}}
+
+		}
+
+		operation.Responses[strconv.Itoa(status)] = response
+
+		if doc.Paths[op.Path] == nil {
+			doc.Paths[op.Path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return doc
+}
+
+// Return the OpenAPI document of the HTTP API, as served at /openapi.json.
+func OpenAPIDocument() ([]byte, error) {
+	return json.MarshalIndent(openAPI(apiOperations), "", "  ")
+}
+
+// Handle requests for the OpenAPI document of the HTTP API.
+func (node *RaftNode) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+
+	doc, err := OpenAPIDocument()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(doc)
+}
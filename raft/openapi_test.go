@@ -0,0 +1,98 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * This test case checks that every route of the client HTTP server is
+ * described by an operation of the OpenAPI document and vice versa, and that
+ * the document is served without authentication.
+ */
+func TestOpenAPIRoutes(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig()}}
+	r := node.routes()
+
+	operations := make(map[string]bool)
+	for _, op := range apiOperations {
+		operations[op.Method+" "+op.Path] = true
+	}
+
+	pattern := regexp.MustCompile(`\{([^}:]+):[^}]*\}`) // e.g. {prefix:.*}
+	routes := make(map[string]bool)
+
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+
+		path, err := route.GetPathTemplate()
+		if err != nil || path == "/admin/clock" { // only with the testclock build tag
+			return nil
+		}
+		path = pattern.ReplaceAllString(path, "{$1}")
+
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Errorf("Expected the route %v to have methods", path)
+		}
+
+		for _, method := range methods {
+			routes[method+" "+path] = true
+			if !operations[method+" "+path] {
+				t.Errorf("Expected the route %v %v to be described in apiOperations", method, path)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	for _, op := range apiOperations {
+
+		if !routes[op.Method+" "+op.Path] {
+			t.Errorf("Expected the operation %v to have a route %v %v", op.ID, op.Method, op.Path)
+		}
+
+		if ids[op.ID] {
+			t.Errorf("Expected the operation IDs to be unique, got %v twice", op.ID)
+		}
+		ids[op.ID] = true
+	}
+
+	request := httptest.NewRequest("GET", "/openapi.json", nil)
+	if permission := requiredPermission(request); permission != "" {
+		t.Errorf("Expected the document to be served without authentication, got the %v permission", permission)
+	}
+
+	w := httptest.NewRecorder()
+	node.OpenAPIHandler(w, request)
+
+	var doc openAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the OpenAPI document, got %v %.100q (%v)", w.Code, w.Body.String(), err)
+	}
+
+	if doc.OpenAPI != openAPIVersion || doc.Paths["/admin/members/{id}"]["delete"].OperationID != "RemoveMember" {
+		t.Errorf("Unexpected document %+v", doc)
+	}
+
+	// The schemas are derived from the json tags of the types of the handlers.
+	status := doc.Components.Schemas["Status"]
+	if status == nil || status.Properties["state"] == nil {
+		t.Errorf("Expected the schema of Status, got %+v", status)
+	}
+
+	for name, schema := range doc.Components.Schemas {
+		if schema == nil || schema.Type != "object" {
+			t.Errorf("Expected the component %v to be an object, got %+v", name, schema)
+		}
+	}
+}
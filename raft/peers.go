@@ -0,0 +1,120 @@
+package raft
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+/*
+Detection of the unreachable peers. The connections to the peers are checked with gRPC keepalive
+pings once idle for PeerKeepaliveTime (gRPC pings at most every 10s), and closed if a ping goes
+unanswered for PeerKeepaliveTimeout, so that a peer that silently went away (e.g. a crashed host)
+doesn't leave a half-open connection behind. The servers accept the pings of their peers every
+keepaliveMinTime.
+
+Independently of the connection, every RPC sent to a peer (AppendEntries, RequestVote,
+TimeoutNow and InstallSnapshot) is tracked: after PeerFailureThreshold consecutive failures the peer is unreachable,
+until an RPC to it succeeds again. The reachability of each peer is reported in the status (see
+admin.go) and in the raft_peer_reachable gauge, the failures in raft_peer_rpc_failures_total.
+
+The leader doesn't wait for the unreachable peers: their AppendEntries are counted as failed right
+away in the quorum of a write, while a probe without entries is sent to them in the background,
+and once one succeeds the peer is sent the missing entries again.
+*/
+
+const keepaliveMinTime = 5 * time.Second // Shortest time between the keepalive pings accepted from a peer
+
+// The RPCs sent to each peer, safe for concurrent use. The zero value tracks no peer.
+type peerTracker struct {
+	mu    sync.Mutex
+	peers map[int32]*peerContact
+}
+
+type peerContact struct {
+	failures    int       // Consecutive failed RPCs
+	lastSuccess time.Time // Time of the latest successful RPC, zero if none yet
+	unreachable bool
+	rtt         time.Duration // Smoothed round-trip time of the successful RPCs, see storms.go
+}
+
+// Return the dial option setting the keepalive parameters of the connections to the peers.
+func (node *RaftNode) peerKeepalive() grpc.DialOption {
+
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                node.Meta.Config.PeerKeepaliveTime,
+		Timeout:             node.Meta.Config.PeerKeepaliveTimeout,
+		PermitWithoutStream: true, // the peers mostly exchange unary RPCs
+	})
+}
+
+// Return the server options accepting the keepalive pings of the peers.
+func peerKeepaliveEnforcement() grpc.ServerOption {
+	return grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: keepaliveMinTime, PermitWithoutStream: true})
+}
+
+// Record the outcome of an RPC sent to a peer, updating its reachability.
+func (node *RaftNode) recordPeerRPC(id int32, rpc string, err error) {
+
+	node.peers.mu.Lock()
+	defer node.peers.mu.Unlock()
+
+	if node.peers.peers == nil {
+		node.peers.peers = make(map[int32]*peerContact)
+	}
+
+	p, ok := node.peers.peers[id]
+	if !ok {
+		p = &peerContact{}
+		node.peers.peers[id] = p
+	}
+
+	peer := strconv.Itoa(int(id))
+
+	if err == nil {
+
+		if p.unreachable {
+			node.logger().Info().Int32("peer", id).Msg("Peer reachable again")
+		}
+
+		p.failures, p.lastSuccess, p.unreachable = 0, node.now(), false
+		node.Meta.metrics.Set("raft_peer_reachable", 1, "peer", peer)
+		return
+	}
+
+	p.failures++
+	node.Meta.metrics.Add("raft_peer_rpc_failures_total", 1, "peer", peer, "rpc", rpc)
+
+	if threshold := node.Meta.Config.PeerFailureThreshold; !p.unreachable && threshold > 0 && p.failures >= threshold {
+		p.unreachable = true
+		node.logger().Warn().Int32("peer", id).Int("failures", p.failures).Err(err).Msg("Peer unreachable")
+		node.Meta.metrics.Set("raft_peer_reachable", 0, "peer", peer)
+	}
+}
+
+// Whether the latest RPCs sent to the peer all failed, see recordPeerRPC.
+func (node *RaftNode) unreachable(id int32) bool {
+
+	node.peers.mu.Lock()
+	defer node.peers.mu.Unlock()
+
+	p, ok := node.peers.peers[id]
+	return ok && p.unreachable
+}
+
+// Return the number of consecutive failed RPCs sent to the peer, and the time of the latest
+// successful one (zero if none yet).
+func (node *RaftNode) peerRPCs(id int32) (int, time.Time) {
+
+	node.peers.mu.Lock()
+	defer node.peers.mu.Unlock()
+
+	if p, ok := node.peers.peers[id]; ok {
+		return p.failures, p.lastSuccess
+	}
+
+	return 0, time.Time{}
+}
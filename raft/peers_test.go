@@ -0,0 +1,112 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+// A Transport recording the number of entries of the AppendEntries it is sent, which only
+// answer once their deadline passes unless it is reachable.
+type probedTransport struct {
+	Transport
+	reachable bool
+	entries   int32 // Entries of the latest AppendEntries, accessed atomically
+	sent      int32
+}
+
+func (t *probedTransport) SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+
+	atomic.StoreInt32(&t.entries, int32(len(msg.Entries)))
+	atomic.AddInt32(&t.sent, 1)
+
+	if !t.reachable {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return &protos.AppendEntriesResponse{Term: msg.Term, Success: true}, nil
+}
+
+/*
+ * This test case checks that a peer is deemed unreachable after the
+ * configured number of consecutive failed RPCs, that the leader then counts
+ * it as failed right away rather than waiting for it, only probing it with
+ * AppendEntries without entries, and that a successful probe makes it
+ * reachable again.
+ */
+func TestUnreachablePeers(t *testing.T) {
+
+	config := DefaultConfig()
+	config.RPCTimeout, config.PeerFailureThreshold = 500*time.Millisecond, 2
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), Config: config, n_replicas: 3, clock: NewManualClock(time.Unix(100, 0))}}
+
+	failed := errors.New("connection refused")
+
+	node.recordPeerRPC(1, "AppendEntries", failed)
+	if node.unreachable(1) {
+		t.Errorf("Expected a single failure not to make the peer unreachable")
+	}
+
+	node.recordPeerRPC(1, "RequestVote", failed)
+	node.recordPeerRPC(2, "AppendEntries", failed)
+	node.recordPeerRPC(2, "AppendEntries", failed)
+
+	if !node.unreachable(1) || !node.unreachable(2) || node.Meta.metrics.Get("raft_peer_reachable", "peer", "1") != 0 || node.Meta.metrics.Get("raft_peer_rpc_failures_total", "peer", "2", "rpc", "AppendEntries") != 2 {
+		t.Fatalf("Expected both peers to be unreachable after 2 failures")
+	}
+
+	// Peer 1 is back, peer 2 still doesn't answer.
+	back, dead := &probedTransport{reachable: true}, &probedTransport{}
+	node.Meta.peer_replica_clients = []Transport{nil, back, dead}
+
+	node.state, node.currentTerm = Leader, 1
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}}
+	node.nextIndex, node.matchIndex = []int32{1, 0, 0}, []int32{0, -1, -1}
+	node.last_contact = make(map[int32]time.Time)
+
+	replicate := func() bool {
+
+		success := make(chan bool)
+		node.LeaderSendAEs(context.Background(), "TEST", &protos.AppendEntriesMessage{Term: 1}, 0, success)
+
+		select {
+		case replicated := <-success:
+			return replicated
+		case <-time.After(config.RPCTimeout / 2):
+			t.Fatalf("Expected the unreachable peers not to be waited for")
+		}
+
+		return false
+	}
+
+	if replicate() {
+		t.Errorf("Expected the entry not to be replicated by unreachable peers")
+	}
+
+	// The probe of peer 1 succeeds, without entries.
+	for deadline := time.Now().Add(time.Second); node.unreachable(1) && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if node.unreachable(1) || atomic.LoadInt32(&back.entries) != 0 || node.Meta.metrics.Get("raft_peer_reachable", "peer", "1") != 1 {
+		t.Fatalf("Expected a probe without entries to make peer 1 reachable again")
+	}
+
+	if !replicate() || atomic.LoadInt32(&back.entries) != 1 {
+		t.Errorf("Expected the entry to be replicated on peer 1 once reachable")
+	}
+
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&dead.sent) < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&dead.sent) != 2 || atomic.LoadInt32(&dead.entries) != 0 {
+		t.Errorf("Expected peer 2 to keep being probed without entries, got %v AppendEntries", atomic.LoadInt32(&dead.sent))
+	}
+}
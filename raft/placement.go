@@ -0,0 +1,167 @@
+package raft
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+// FailureDomain describes where a replica physically runs. Empty fields are
+// treated as undeclared and are ignored while validating a placement.
+type FailureDomain struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+/*
+ParseFailureDomains parses the failure domains of all the replicas from a comma separated
+list, with one "zone/rack/host" entry per replica id (e.g. "z1/r1/h1,z1/r2/h2,z2/r1/h3").
+Trailing parts of an entry can be left out if they aren't known. An empty spec means that
+no failure domains were declared, in which case nil is returned.
+*/
+func ParseFailureDomains(spec string, n_replicas int) ([]FailureDomain, error) {
+
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	entries := strings.Split(spec, ",")
+
+	if len(entries) != n_replicas {
+		return nil, fmt.Errorf("expected failure domains for %v replicas, got %v", n_replicas, len(entries))
+	}
+
+	domains := make([]FailureDomain, n_replicas)
+
+	for i, entry := range entries {
+
+		domain, err := ParseFailureDomain(entry)
+		if err != nil {
+			return nil, fmt.Errorf("replica %v: %v", i, err)
+		}
+
+		domains[i] = domain
+	}
+
+	return domains, nil
+}
+
+// ParseFailureDomain parses a single "zone/rack/host" entry, as given for a replica to
+// ParseFailureDomains or for a member (see Member in membership.go).
+func ParseFailureDomain(entry string) (FailureDomain, error) {
+
+	var domain FailureDomain
+
+	parts := strings.Split(strings.TrimSpace(entry), "/")
+
+	if len(parts) > 3 {
+		return domain, fmt.Errorf("invalid failure domain %q, expected zone/rack/host", entry)
+	}
+
+	fields := []*string{&domain.Zone, &domain.Rack, &domain.Host}
+
+	for j, part := range parts {
+		*fields[j] = strings.TrimSpace(part)
+	}
+
+	return domain, nil
+}
+
+// String returns the domain in the "zone/rack/host" form parsed by ParseFailureDomain,
+// without its trailing undeclared parts.
+func (d FailureDomain) String() string {
+	return strings.TrimRight(strings.Join([]string{d.Zone, d.Rack, d.Host}, "/"), "/")
+}
+
+/*
+ValidatePlacement checks a proposed cluster membership (given as the failure domains of
+its members) and rejects it if a quorum of the members would share a single zone, rack or
+host, since losing that one domain would then make the cluster unavailable. This doesn't
+guarantee that the cluster survives the loss of any domain: with an even number of members,
+a domain holding half of them is accepted, although the other half is no quorum. Racks are
+scoped to their zone and hosts to their rack, so equally named racks in different zones
+are considered independent. If force is set, the violation is only logged.
+*/
+func ValidatePlacement(domains []FailureDomain, force bool) error {
+
+	quorum := len(domains)/2 + 1
+
+	levels := []struct {
+		name string
+		key  func(d FailureDomain) string
+	}{
+		{"zone", func(d FailureDomain) string { return d.Zone }},
+		{"rack", func(d FailureDomain) string { return joinDeclared(d.Zone, d.Rack) }},
+		{"host", func(d FailureDomain) string { return joinDeclared(d.Zone, d.Rack, d.Host) }},
+	}
+
+	for _, level := range levels {
+
+		members := make(map[string]int)
+
+		for _, domain := range domains {
+
+			if key := level.key(domain); key != "" {
+				members[key]++
+			}
+
+		}
+
+		for key, count := range members {
+
+			if count < quorum {
+				continue
+			}
+
+			err := fmt.Errorf("%v of %v replicas (a quorum) are placed in %v %q", count, len(domains), level.name, key)
+
+			if !force {
+				return err
+			}
+
+			logging.Logger.Warn().Err(err).Msg("Placement check overridden")
+		}
+	}
+
+	return nil
+}
+
+// joinDeclared joins the domain path, returning an empty string if its last part is undeclared.
+func joinDeclared(parts ...string) string {
+
+	if parts[len(parts)-1] == "" {
+		return ""
+	}
+
+	return strings.Join(parts, "/")
+}
+
+/*
+Check the placement of the voters of a proposed configuration (see ValidatePlacement), from the
+failure domains of the members. Members without a domain are counted as undeclared, and nothing is
+checked if none of the voters declares one. If force is set, the violation is only logged.
+*/
+func checkPlacement(members []Member, force bool) error {
+
+	var domains []FailureDomain
+	declared := false
+
+	for _, m := range voters(members) {
+
+		domain, err := ParseFailureDomain(m.Domain)
+		if err != nil {
+			return fmt.Errorf("replica %v: %v", m.Id, err)
+		}
+
+		domains = append(domains, domain)
+		declared = declared || m.Domain != ""
+	}
+
+	if !declared {
+		return nil
+	}
+
+	return ValidatePlacement(domains, force)
+}
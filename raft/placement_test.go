@@ -0,0 +1,160 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the placement validation rejects memberships
+ * in which a quorum of the replicas shares a zone, rack or host, and accepts
+ * them when they are spread out or when the check is forced.
+ *
+ * Racks with the same name in different zones must not be counted together.
+ */
+func TestValidatePlacement(t *testing.T) {
+
+	cases := []struct {
+		spec  string
+		force bool
+		valid bool
+	}{
+		{"z1/r1/h1,z2/r1/h2,z3/r1/h3", false, true},
+		{"z1/r1/h1,z1/r1/h2,z2/r1/h3", false, false},
+		{"z1/r1/h1,z1/r2/h2,z2/r1/h3,z2/r2/h4,z3/r1/h5", false, true},
+		{"z1/r1/h1,z1/r1/h2,z1/r2/h3,z2/r1/h4,z3/r1/h5", false, false},
+		{"z1/r1/h1,z1/r1/h2,z2/r1/h3", true, true},
+		{"z1,z2,z3", false, true},
+		{"/r1,/r1,/r2", false, false},
+		{"z1,z1,z2,z2", false, true}, // Half of the replicas in a zone isn't a quorum
+	}
+
+	for _, c := range cases {
+
+		domains, err := ParseFailureDomains(c.spec, strings.Count(c.spec, ",")+1)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", c.spec, err)
+			continue
+		}
+
+		if err := ValidatePlacement(domains, c.force); (err == nil) != c.valid {
+			t.Errorf("Placement %q: expected valid=%v, got error %v", c.spec, c.valid, err)
+		}
+	}
+
+	if _, err := ParseFailureDomains("z1,z2", 3); err == nil {
+		t.Errorf("Expected an error when the number of domains doesn't match the number of replicas")
+	}
+}
+
+/*
+ * This test case checks that the membership changes leaving a quorum of the
+ * voters in a single failure domain are refused, whether they add, update,
+ * remove or demote a member, unless forced with force_placement=true, and that
+ * the members without a domain are counted as undeclared.
+ */
+func TestMembershipPlacement(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "placement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms(), Config: DefaultConfig(), raft_persistence_file: filepath.Join(dir, "3000"), clock: NewManualClock(time.Unix(100, 0))}}
+	node.storage = NewStorage()
+	node.commits_ready = make(chan int32, 1)
+	node.trackMessage = make(map[string][]string)
+
+	node.Meta.members = []Member{{Id: 0, Address: "a0", Domain: "z1"}, {Id: 1, Address: "a1", Domain: "z1"}, {Id: 2, Address: "a2", Domain: "z2"}, {Id: 3, Address: "a3", Domain: "z3"}}
+	node.Meta.initial_members = node.Meta.members
+	node.Meta.n_replicas = 4
+
+	node.state, node.currentTerm = Leader, 2
+	node.log = []protos.LogEntry{{Term: 2, Operation: []string{"NO-OP"}}}
+	node.nextIndex, node.matchIndex = []int32{1, 1, 1, 1}, []int32{0, 0, 0, 0}
+	node.last_contact = map[int32]time.Time{1: node.now(), 2: node.now(), 3: node.now()}
+	node.Meta.peer_replica_clients = []Transport{nil, &probedTransport{reachable: true}, &probedTransport{reachable: true}, &probedTransport{reachable: true}}
+
+	// The committed entries are applied, as ApplyToStateMachine does.
+	go func() {
+		for range node.commits_ready {
+			node.GetLock("Test")
+			node.lastApplied = node.commitIndex
+			node.ReleaseLock("Test")
+		}
+	}()
+	defer close(node.commits_ready)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/members", node.AddMemberHandler).Methods("POST")
+	r.HandleFunc("/admin/members/{id}", node.UpdateMemberHandler).Methods("PUT")
+	r.HandleFunc("/admin/members/{id}", node.RemoveMemberHandler).Methods("DELETE")
+
+	change := func(method, path string) int {
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w.Code
+	}
+
+	cases := []struct {
+		method, path string
+		code         int
+	}{
+		{"POST", "/admin/members?id=4&address=a4&domain=z1/r1/h1", http.StatusConflict}, // 3 of 5 in z1
+		{"POST", "/admin/members?id=4&address=a4&domain=z1/r1/h1/x", http.StatusBadRequest},
+		{"PUT", "/admin/members/3?domain=z1", http.StatusConflict},     // 3 of 4 in z1
+		{"PUT", "/admin/members/3?address=b3", http.StatusOK},          // the placement is unchanged
+		{"DELETE", "/admin/members/2", http.StatusConflict},            // 2 of 3 in z1
+		{"DELETE", "/admin/members/2?force=true", http.StatusConflict}, // only skips the safety checks
+		{"DELETE", "/admin/members/2?force_placement=true", http.StatusOK},
+	}
+
+	for _, c := range cases {
+		if code := change(c.method, c.path); code != c.code {
+			t.Errorf("Expected %v %v to be answered with %v, got %v", c.method, c.path, c.code, code)
+		}
+	}
+
+	node.GetRLock("Test")
+	_, removed := node.member(2)
+	m, _ := node.member(3)
+	node.ReleaseRLock("Test")
+
+	if removed || m.Address != "b3" || m.Domain != "z3" {
+		t.Errorf("Expected replica 2 to be removed and replica 3 to be reached at b3, got %v", node.Meta.members)
+	}
+
+	// The demotion of a decommissioned member is checked likewise.
+	d := Decommission{Member: 3, Step: decommissionDemoting}
+
+	if d, err = node.advanceDecommission(context.Background(), d); err == nil || d.Step != decommissionDemoting {
+		t.Errorf("Expected the demotion of replica 3 to be refused, got %v %v", d.Step, err)
+	}
+
+	d.ForcePlacement = true
+
+	if d, err = node.advanceDecommission(context.Background(), d); err != nil || d.Step != decommissionRemoving {
+		t.Errorf("Expected the forced demotion of replica 3, got %v %v", d.Step, err)
+	}
+
+	// Nothing is checked without any declared domain, the members without one counting as undeclared.
+	if err := checkPlacement([]Member{{Id: 0}, {Id: 1}, {Id: 2}}, false); err != nil {
+		t.Errorf("Expected members without domains to be accepted, got %v", err)
+	}
+
+	if err := checkPlacement([]Member{{Id: 0, Domain: "z1"}, {Id: 1, Domain: "z1"}, {Id: 2}, {Id: 3, Learner: true, Domain: "z2"}}, false); err == nil {
+		t.Errorf("Expected 2 of the 3 voters in z1 to be refused")
+	}
+}
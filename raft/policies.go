@@ -0,0 +1,294 @@
+package raft
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Response policies of the RRsets (see zone/policy.go), evaluated by the DNS listeners on the records
+of each answer, after the records meant for the region of the resolver are chosen (see geo.go). The
+policies are configured through the client HTTP server:
+
+	GET    /zones/{zone}/policies               lists the policies of the RRsets of the zone
+	PUT    /zones/{zone}/policies/{name}/{type} sets the policy of an RRset, given as a JSON object
+	DELETE /zones/{zone}/policies/{name}/{type} removes it, the records being answered unchanged
+
+The changes are transactions, with the checks of the writes of the records themselves (ACLs, zones
+homed on other clusters, shards), and may carry a client ID and session like the other writes. The
+weights and the records down are given by the data of the records, as stored.
+
+The rotation of the round_robin RRsets is kept by each replica, from the first answer after it
+starts. The answers given by a policy are counted in dns_policy_answers_total{view, mode}.
+*/
+
+// The policy of an RRset, as listed and returned by the handlers.
+type RRsetPolicy struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	zone.Policy
+}
+
+// The rotations of the round_robin RRsets of a replica, safe for concurrent use.
+type policyRotations struct {
+	mu   sync.Mutex
+	next map[string]int // Offset of the next answer, by policy key
+}
+
+// Return the offset of the next answer of the RRset, advancing it.
+func (p *policyRotations) advance(key string) int {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next == nil {
+		p.next = make(map[string]int)
+	}
+
+	offset := p.next[key]
+	p.next[key] = offset + 1
+
+	return offset
+}
+
+// Return the records of the RRset answered by its policy.
+func (node *RaftNode) applyPolicy(key string, policy zone.Policy, records []zone.Record) []zone.Record {
+
+	if len(records) == 0 {
+		return records
+	}
+
+	limit := func(records []zone.Record, answers int) []zone.Record {
+		if answers > 0 && answers < len(records) {
+			return records[:answers]
+		}
+		return records
+	}
+
+	switch policy.Mode {
+
+	case zone.PolicyRoundRobin:
+
+		offset := node.policies.advance(key) % len(records)
+		rotated := append(append([]zone.Record{}, records[offset:]...), records[:offset]...)
+
+		return limit(rotated, policy.Answers)
+
+	case zone.PolicyWeighted:
+
+		answers := policy.Answers
+		if answers == 0 {
+			answers = 1
+		}
+
+		weight := func(r zone.Record) int {
+			if w, ok := policy.Weights[r.Data]; ok {
+				return w
+			}
+			return 1
+		}
+
+		// Drawn without replacement, each record in proportion to its weight.
+		remaining := append([]zone.Record{}, records...)
+		var chosen []zone.Record
+
+		for len(chosen) < answers && len(remaining) > 0 {
+
+			total := 0
+			for _, r := range remaining {
+				total += weight(r)
+			}
+
+			if total == 0 {
+				break // Only records of weight 0 are left
+			}
+
+			draw := rand.Intn(total)
+
+			for i, r := range remaining {
+
+				if draw -= weight(r); draw < 0 {
+					chosen = append(chosen, r)
+					remaining = append(remaining[:i], remaining[i+1:]...)
+					break
+				}
+			}
+		}
+
+		if len(chosen) == 0 {
+			return limit(records, answers)
+		}
+
+		return chosen
+
+	case zone.PolicyFailover:
+
+		down := make(map[string]bool)
+		for _, data := range policy.Down {
+			down[data] = true
+		}
+
+		var up []zone.Record
+		for _, r := range records {
+			if !down[r.Data] {
+				up = append(up, r)
+			}
+		}
+
+		// Every record down, answering them all beats answering none.
+		if len(up) == 0 {
+			up = records
+		}
+
+		return limit(up, policy.Answers)
+
+	}
+
+	return records
+}
+
+/*
+Handle requests of the form /zones/{zone}/policies, returning the policies of the RRsets of the zone
+held by the leader.
+*/
+func (node *RaftNode) PoliciesHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := zone.CanonicalName(mux.Vars(r)["zone"])
+
+	if !validNames(w, name) {
+		return
+	}
+
+	node.GetRLock("Policies Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Policies Handler")
+		return
+	}
+
+	node.ReleaseRLock("Policies Handler")
+
+	kvs, err := node.scanLocalStore(zone.KeyPrefix)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	allowed := node.keyFilter(r.Context(), PermissionRead)
+	policies := make([]RRsetPolicy, 0)
+
+	for _, kv := range kvs {
+
+		owner, rtype, ok := zone.ParseRecordKey(kv.Key)
+		if !ok || !zone.IsPolicyKey(kv.Key) || !zone.InZone(owner, name) || (allowed != nil && !allowed(kv.Key)) {
+			continue
+		}
+
+		policy := RRsetPolicy{Name: owner, Type: rtype}
+		if err := json.Unmarshal([]byte(kv.Value), &policy.Policy); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid response policy")
+			continue
+		}
+
+		policies = append(policies, policy)
+	}
+
+	writeJSON(w, http.StatusOK, policies)
+}
+
+/*
+Handle requests of the form /zones/{zone}/policies/{name}/{type}, setting (PUT) or removing (DELETE)
+the policy of the RRset, along with the client form value and the session and seq form values of a
+client session. The response is sent once the change is applied on the leader.
+*/
+func (node *RaftNode) SetPolicyHandler(w http.ResponseWriter, r *http.Request) {
+
+	vars := mux.Vars(r)
+	apex, name, rtype := zone.CanonicalName(vars["zone"]), zone.CanonicalName(vars["name"]), strings.ToUpper(vars["type"])
+
+	node.logger().Info().Str("name", name).Str("type", rtype).Str("method", r.Method).Msg("POLICY request received")
+
+	// The policies of the records stored before the names were checked can still be removed, see validation.go
+	if !validNames(w, apex) || (r.Method == http.MethodPut && !validNames(w, name)) {
+		return
+	}
+
+	if !zone.InZone(name, apex) {
+		writeError(w, http.StatusBadRequest, "Error: %v isn't in zone %v", name, apex)
+		return
+	}
+
+	if _, ok := dns.StringToType[rtype]; !ok {
+		writeError(w, http.StatusBadRequest, "Error: unknown record type %q", rtype)
+		return
+	}
+
+	policy := RRsetPolicy{Name: name, Type: rtype}
+	op := kv_store.Op{Type: kv_store.OpDelete, Key: zone.PolicyKey(name, rtype)}
+
+	if r.Method == http.MethodPut {
+
+		if err := json.NewDecoder(r.Body).Decode(&policy.Policy); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid policy, expected a JSON object: %v", err)
+			return
+		}
+
+		if err := policy.Policy.Validate(); err != nil {
+			writeError(w, http.StatusBadRequest, "Error: %v", err)
+			return
+		}
+
+		encoded, _ := json.Marshal(policy.Policy)
+		op = kv_store.Op{Type: kv_store.OpPut, Key: op.Key, Value: string(encoded)}
+	}
+
+	// Read once the body is, so that it isn't parsed as a form.
+	session, sequence, err := requestSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+
+	node.GetRLock("Set Policy Handler")
+
+	if node.state != Leader {
+		node.rejectRequest(rejectNotLeader, r, errNotLeader)
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Set Policy Handler")
+		writeNotLeader(w, leader)
+		return
+	}
+
+	node.ReleaseRLock("Set Policy Handler")
+
+	result, err := node.replicateTxn(r.Context(), kv_store.Txn{Success: []kv_store.Op{op}}, r.FormValue("client"), session, sequence)
+	if err != nil {
+		node.logger().Error().Err(err).Str("name", name).Str("type", rtype).Msg("Error occured in POLICY request")
+		writeError(w, httpStatus(err), "Error: %v", status.Convert(err).Message())
+		return
+	}
+
+	if r.Method == http.MethodDelete && len(result.Events) == 0 {
+		writeError(w, http.StatusNotFound, "Error: %v %v has no policy.", name, rtype)
+		return
+	}
+
+	node.logger().Info().Str("name", name).Str("type", rtype).Str("method", r.Method).Msg("POLICY request completed successfully")
+
+	if r.Method == http.MethodDelete {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "type": rtype, "deleted": true})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, policy)
+}
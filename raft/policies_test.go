@@ -0,0 +1,141 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks the answers of the RRsets rotated, chosen by weight
+ * and failing over by their policies, the listing of the policies of a zone,
+ * and the refusal of the invalid policies.
+ */
+func TestResponsePolicies(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	put := func(key string, value interface{}) {
+		encoded, _ := json.Marshal(value)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: key, Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	records := func(name string) []zone.Record {
+		return []zone.Record{
+			{Name: name, Type: "A", TTL: 60, Data: "192.0.2.1"},
+			{Name: name, Type: "A", TTL: 60, Data: "192.0.2.2"},
+			{Name: name, Type: "A", TTL: 60, Data: "192.0.2.3"},
+		}
+	}
+
+	for _, name := range []string{"rr.example.com.", "weighted.example.com.", "failover.example.com.", "plain.example.com."} {
+		put(zone.RecordKey(name, "A"), records(name))
+	}
+
+	put(zone.PolicyKey("rr.example.com.", "A"), zone.Policy{Mode: zone.PolicyRoundRobin})
+	put(zone.PolicyKey("weighted.example.com.", "A"), zone.Policy{Mode: zone.PolicyWeighted, Weights: map[string]int{"192.0.2.1": 0, "192.0.2.3": 0}})
+	put(zone.PolicyKey("failover.example.com.", "A"), zone.Policy{Mode: zone.PolicyFailover, Answers: 1, Down: []string{"192.0.2.1"}})
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	handler := node.dnsHandler(DNSView{Name: "external"}, newRawUpdates())
+
+	answer := func(name string) string {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		w := &resolverDNS{addr: &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}}
+		handler.ServeDNS(w, req)
+
+		var addresses []string
+		for _, rr := range w.msg.Answer {
+			addresses = append(addresses, rr.(*dns.A).A.String())
+		}
+
+		return strings.Join(addresses, ",")
+	}
+
+	for _, expected := range []string{"192.0.2.1,192.0.2.2,192.0.2.3", "192.0.2.2,192.0.2.3,192.0.2.1", "192.0.2.3,192.0.2.1,192.0.2.2", "192.0.2.1,192.0.2.2,192.0.2.3"} {
+		if got := answer("rr.example.com."); got != expected {
+			t.Errorf("Expected the rotated answer %v, got %v", expected, got)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := answer("weighted.example.com."); got != "192.0.2.2" {
+			t.Fatalf("Expected the only record of nonzero weight, got %v", got)
+		}
+	}
+
+	if got := answer("failover.example.com."); got != "192.0.2.2" {
+		t.Errorf("Expected the first record up, got %v", got)
+	}
+
+	if got := answer("plain.example.com."); got != "192.0.2.1,192.0.2.2,192.0.2.3" {
+		t.Errorf("Expected the records without a policy unchanged, got %v", got)
+	}
+
+	if got := node.Meta.metrics.Get("dns_policy_answers_total", "view", "external", "mode", zone.PolicyRoundRobin); got != 4 {
+		t.Errorf("Expected 4 round_robin answers, got %v", got)
+	}
+
+	if name, rtype, ok := zone.ParseRecordKey(zone.PolicyKey("rr.example.com", "a")); !ok || name != "rr.example.com." || rtype != "A" {
+		t.Errorf("Expected the policy key to belong to the RRset, got %v %v %v", name, rtype, ok)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/zones/{zone}/policies", node.PoliciesHandler)
+	r.HandleFunc("/zones/{zone}/policies/{name}/{type}", node.SetPolicyHandler)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("GET", "/zones/example.com/policies", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a follower to refuse the listing, got %v", w.Code)
+	}
+
+	node.state = Leader
+
+	var policies []RRsetPolicy
+	if w := do("GET", "/zones/example.com/policies", ""); w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &policies) != nil || len(policies) != 3 || policies[0].Name != "failover.example.com." || policies[0].Mode != zone.PolicyFailover {
+		t.Errorf("Expected the 3 policies of the zone, got %v %v", w.Code, w.Body.String())
+	}
+
+	for _, c := range []struct{ path, body string }{
+		{"/zones/example.com/policies/www.example.org/A", `{"mode": "round_robin"}`},
+		{"/zones/example.com/policies/www.example.com/BOGUS", `{"mode": "round_robin"}`},
+		{"/zones/example.com/policies/www.example.com/A", `{"mode": "random"}`},
+		{"/zones/example.com/policies/www.example.com/A", `{"mode": "round_robin", "weights": {"192.0.2.1": 2}}`},
+		{"/zones/example.com/policies/www.example.com/A", `{"mode": "failover", "answers": -1}`},
+	} {
+		if w := do("PUT", c.path, c.body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected the policy %v of %v to be refused, got %v", c.body, c.path, w.Code)
+		}
+	}
+}
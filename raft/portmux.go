@@ -0,0 +1,178 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Serving the gRPC server (ConsensusService and KVService) and the client HTTP server (the key-value
+and admin APIs) on a single port, with Config.SinglePort. The connections accepted on the port are
+told apart by their first bytes, like cmux does: gRPC connections start with the HTTP/2 client
+preface, anything else is handed to the HTTP server. When one of the servers uses TLS, connections
+starting with a TLS record go to it instead. Both servers can't use TLS on a single port, as their
+connections would then look the same.
+
+Only the peers and the clients need to reach the port: the local key-value store keeps its own
+port, used by the replica itself.
+*/
+
+const (
+	http2Preface       = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	tlsHandshakeType   = 0x16 // First byte of a TLS connection, see RFC 8446
+	portMuxReadTimeout = 10 * time.Second
+)
+
+var errMuxClosed = errors.New("multiplexed listener closed")
+
+// The protocol a connection is routed to.
+type muxProtocol int
+
+const (
+	muxHTTP muxProtocol = iota
+	muxGRPC
+)
+
+// Tell the protocol of a connection from its first bytes, reading no more than needed.
+func detectProtocol(r *bufio.Reader, grpc_tls, http_tls bool) (muxProtocol, error) {
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return muxHTTP, err
+	}
+
+	if first[0] == tlsHandshakeType && (grpc_tls || http_tls) {
+		if grpc_tls {
+			return muxGRPC, nil
+		}
+		return muxHTTP, nil
+	}
+
+	for n := 1; n <= len(http2Preface); n++ {
+
+		prefix, err := r.Peek(n)
+		if err != nil {
+			return muxHTTP, err
+		}
+
+		if !bytes.Equal(prefix, []byte(http2Preface[:n])) {
+			return muxHTTP, nil
+		}
+	}
+
+	return muxGRPC, nil
+}
+
+// A connection whose first bytes were read while detecting its protocol.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// The listener of one of the protocols served on the port.
+type muxListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMuxListener(addr net.Addr) *muxListener {
+	return &muxListener{addr: addr, conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errMuxClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Splits the connections accepted on a port between the gRPC and the HTTP servers.
+type portMux struct {
+	listener net.Listener
+	grpc     *muxListener
+	http     *muxListener
+	grpc_tls bool
+	http_tls bool
+}
+
+func newPortMux(listener net.Listener, grpc_tls, http_tls bool) (*portMux, error) {
+
+	if grpc_tls && http_tls {
+		return nil, errors.New("the gRPC and HTTP servers can't both use TLS on a single port")
+	}
+
+	return &portMux{
+		listener: listener,
+		grpc:     newMuxListener(listener.Addr()),
+		http:     newMuxListener(listener.Addr()),
+		grpc_tls: grpc_tls,
+		http_tls: http_tls,
+	}, nil
+}
+
+// Accept connections until the port is closed, handing each of them to the server of its protocol.
+// The listeners of the protocols are closed by their servers, when they stop.
+func (m *portMux) serve() {
+
+	for {
+
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go m.route(conn)
+	}
+}
+
+func (m *portMux) route(conn net.Conn) {
+
+	r := bufio.NewReader(conn)
+
+	// A client that doesn't send anything is dropped, rather than holding the goroutine forever.
+	conn.SetReadDeadline(time.Now().Add(portMuxReadTimeout))
+	protocol, err := detectProtocol(r, m.grpc_tls, m.http_tls)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	target := m.http
+	if protocol == muxGRPC {
+		target = m.grpc
+	}
+
+	select {
+	case target.conns <- &peekedConn{Conn: conn, r: r}:
+	case <-target.closed:
+		conn.Close()
+	}
+}
+
+func (m *portMux) Close() error {
+	return m.listener.Close()
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that the connections to a single port are told apart
+ * by their first bytes, and that both a gRPC client and an HTTP client reach
+ * their server through it.
+ */
+func TestPortMux(t *testing.T) {
+
+	for input, expected := range map[string]muxProtocol{
+		http2Preface + "\x00\x00": muxGRPC,
+		"GET /test HTTP/1.1\r\n":  muxHTTP,
+		"PUT /key HTTP/1.1\r\n":   muxHTTP,
+		"PRI * HTTP/1.1\r\n\r\n":  muxHTTP,
+	} {
+		if protocol, err := detectProtocol(bufio.NewReader(strings.NewReader(input)), false, false); err != nil || protocol != expected {
+			t.Errorf("Expected %q to be routed to %v, got %v (%v)", input, expected, protocol, err)
+		}
+	}
+
+	if protocol, _ := detectProtocol(bufio.NewReader(strings.NewReader("\x16\x03\x01")), false, true); protocol != muxHTTP {
+		t.Errorf("Expected a TLS connection to be routed to the HTTPS server")
+	}
+
+	if _, err := newPortMux(nil, true, true); err == nil {
+		t.Errorf("Expected TLS on both servers to be rejected")
+	}
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux, err := newPortMux(listener, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go mux.serve()
+	defer mux.Close()
+
+	grpc_server := grpc.NewServer()
+	protos.RegisterConsensusServiceServer(grpc_server, &protos.UnimplementedConsensusServiceServer{})
+	go grpc_server.Serve(mux.grpc)
+	defer grpc_server.Stop()
+
+	http_server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "http")
+	})}
+	go http_server.Serve(mux.http)
+	defer http_server.Close()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "http" {
+		t.Errorf("Expected the HTTP server to answer, got %q", body)
+	}
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The stub server implements none of the RPCs, so reaching it fails with Unimplemented.
+	_, err = protos.NewConsensusServiceClient(conn).TimeoutNow(ctx, &protos.TimeoutNowMessage{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected the gRPC server to answer, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package raft
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Prioritization of the replication traffic. Each peer is reached through two gRPC connections: the
+control one carries the heartbeats, the votes, the leadership transfers and the AppendEntries of
+at most BulkMessageBytes (the entries of the latest writes, which advance the commit index), while
+the bulk one carries the larger AppendEntries (a follower catching up after a restart, or new to
+the cluster) and the snapshots. A follower being sent a large part of the log then can't hold up the
+heartbeats of the other followers, nor its own, behind it in the flow control window of a shared
+connection, which could otherwise last long enough to trigger spurious elections.
+
+The messages sent on each connection are counted in raft_peer_messages_total{peer,lane}. With a
+BulkMessageBytes of 0 or less, each peer is reached through a single connection.
+*/
+
+// The Transport sending the messages to a peer on the control or the bulk connection by size.
+type prioritizedTransport struct {
+	control   Transport
+	bulk      Transport
+	threshold int // Largest AppendEntries sent on the control connection, in bytes
+
+	metrics *Metrics
+	peer    string
+}
+
+// Dial the gRPC connections to the peer at the given address, returning the transport to it.
+// As with grpc.Dial, the peer doesn't need to be reachable yet.
+func (node *RaftNode) dialPeer(id int32, address string) (Transport, error) {
+
+	control, err := grpc.Dial(address, node.peerDialOptions()...)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := NewGRPCTransport(protos.NewConsensusServiceClient(control))
+
+	if threshold := node.Meta.Config.BulkMessageBytes; threshold > 0 {
+
+		bulk, err := grpc.Dial(address, node.peerDialOptions()...)
+		if err != nil {
+			control.Close()
+			return nil, err
+		}
+
+		transport = &prioritizedTransport{
+			control:   transport,
+			bulk:      NewGRPCTransport(protos.NewConsensusServiceClient(bulk)),
+			threshold: threshold,
+			metrics:   node.Meta.metrics,
+			peer:      strconv.Itoa(int(id)),
+		}
+	}
+
+	return node.peerTransport(transport), nil
+}
+
+// Return the transport of the lane, counting the message sent on it.
+func (t *prioritizedTransport) lane(bulk bool) Transport {
+
+	if bulk {
+		t.metrics.Add("raft_peer_messages_total", 1, "peer", t.peer, "lane", "bulk")
+		return t.bulk
+	}
+
+	t.metrics.Add("raft_peer_messages_total", 1, "peer", t.peer, "lane", "control")
+	return t.control
+}
+
+func (t *prioritizedTransport) SendRequestVote(ctx context.Context, msg *protos.RequestVoteMessage) (*protos.RequestVoteResponse, error) {
+	return t.lane(false).SendRequestVote(ctx, msg)
+}
+
+func (t *prioritizedTransport) SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+
+	// The heartbeats carry no entries, and are never measured.
+	return t.lane(len(msg.Entries) > 0 && proto.Size(msg) > t.threshold).SendAppendEntries(ctx, msg)
+}
+
+func (t *prioritizedTransport) SendTimeoutNow(ctx context.Context, msg *protos.TimeoutNowMessage) (*protos.TimeoutNowResponse, error) {
+	return t.lane(false).SendTimeoutNow(ctx, msg)
+}
+
+func (t *prioritizedTransport) SendInstallSnapshot(ctx context.Context, msg *protos.InstallSnapshotMessage) (*protos.InstallSnapshotResponse, error) {
+	return t.lane(true).SendInstallSnapshot(ctx, msg)
+}
@@ -0,0 +1,73 @@
+package raft
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+// A Transport whose AppendEntries block until their context is done.
+type stalledTransport struct {
+	Transport
+}
+
+func (t *stalledTransport) SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+/*
+ * This test case checks that the heartbeats and the small AppendEntries go
+ * through the control connection of a peer, and keep being delivered while
+ * a large AppendEntries catching the peer up is stuck on the bulk one.
+ */
+func TestPrioritizedTransport(t *testing.T) {
+
+	control := &countingTransport{}
+	metrics := NewMetrics()
+
+	transport := &prioritizedTransport{control: control, bulk: &stalledTransport{}, threshold: 1024, metrics: metrics, peer: "1"}
+
+	entry := func(size int) *protos.LogEntry {
+		return &protos.LogEntry{Term: 1, Operation: []string{"PUT", "key", strings.Repeat("v", size)}}
+	}
+
+	// A follower catching up is sent a large part of the log.
+	catchUp := &protos.AppendEntriesMessage{Term: 1, Entries: []*protos.LogEntry{entry(1000), entry(1000)}}
+
+	stuck := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := transport.SendAppendEntries(ctx, catchUp)
+		stuck <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	for i, msg := range []*protos.AppendEntriesMessage{{Term: 1}, {Term: 1, Entries: []*protos.LogEntry{entry(100)}}} {
+		if resp, err := transport.SendAppendEntries(ctx, msg); err != nil || !resp.Success {
+			t.Errorf("Expected AppendEntries %v to be delivered on the control connection, got %v (%v)", i, resp, err)
+		}
+	}
+
+	if err := <-stuck; err == nil {
+		t.Errorf("Expected the large AppendEntries to go through the bulk connection")
+	}
+
+	if control.sent != 2 {
+		t.Errorf("Expected 2 AppendEntries on the control connection, got %v", control.sent)
+	}
+
+	if got := metrics.Get("raft_peer_messages_total", "peer", "1", "lane", "bulk"); got != 1 {
+		t.Errorf("Expected 1 message to be counted on the bulk connection, got %v", got)
+	}
+
+	if got := metrics.Get("raft_peer_messages_total", "peer", "1", "lane", "control"); got != 2 {
+		t.Errorf("Expected 2 messages to be counted on the control connection, got %v", got)
+	}
+}
@@ -0,0 +1,151 @@
+package raft
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+/*
+Health and readiness probes, for orchestrators and load balancers:
+
+	GET /healthz  whether the replica is alive: its state can be locked, and its key-value store answers
+	GET /readyz   whether the replica can serve clients: it is healthy, and either the leader of a quorum
+	              of healthy members, or a follower that heard from the leader within an election
+	              timeout and whose applied index is within ReadinessMaxLag of the leader's commit index
+
+Both answer 200 OK if every check passes and 503 Service Unavailable otherwise, with the outcome of each
+check in the body, and need no authentication. A failing /healthz calls for a restart of the replica,
+while a replica that isn't ready (e.g. catching up after a restart, or cut off from the leader) should
+only be left out of the load balancing. Candidates and witnesses, which don't serve clients, are never
+ready. As the probes are routed before the keys, keys named "healthz" and "readyz" can only be read
+through the KVService.
+*/
+
+const probeLockTimeout = time.Second // Time after which the lock of the state is deemed deadlocked
+
+// The outcome of a probe.
+type Probe struct {
+	OK     bool              `json:"ok"`
+	Checks map[string]string `json:"checks"` // "ok", or why the check failed, by name
+}
+
+func (p *Probe) check(name string, err error) {
+
+	if err != nil {
+		p.OK = false
+		p.Checks[name] = err.Error()
+		return
+	}
+
+	p.Checks[name] = "ok"
+}
+
+func writeProbe(w http.ResponseWriter, p Probe) {
+
+	code := http.StatusOK
+	if !p.OK {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, p)
+}
+
+// Run the checks of /healthz.
+func (node *RaftNode) health() Probe {
+
+	p := Probe{OK: true, Checks: make(map[string]string)}
+
+	locked := make(chan struct{})
+
+	go func() {
+		node.GetRLock("Health")
+		node.ReleaseRLock("Health")
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		p.check("state", nil)
+	case <-time.After(probeLockTimeout):
+		p.check("state", fmt.Errorf("the state couldn't be locked within %v", probeLockTimeout))
+	}
+
+	if _, ok := node.storeUsage(); ok {
+		p.check("store", nil)
+	} else {
+		p.check("store", fmt.Errorf("the key-value store doesn't answer"))
+	}
+
+	return p
+}
+
+// Run the checks of /readyz, on top of those of /healthz.
+func (node *RaftNode) readiness() Probe {
+
+	p := node.health()
+	if p.Checks["state"] != "ok" {
+		return p
+	}
+
+	node.GetRLock("Readiness")
+	defer node.ReleaseRLock("Readiness")
+
+	switch {
+
+	case node.isWitness():
+		p.check("role", fmt.Errorf("witnesses don't serve clients"))
+
+	case node.state == Leader:
+
+		p.check("role", nil)
+
+		// The learners don't count towards the quorum, see membership.go
+		voting := voters(node.Meta.members)
+
+		healthy := 1
+		for _, m := range voting {
+			if m.Id != node.Meta.replica_id && node.healthy(m.Id) {
+				healthy++
+			}
+		}
+
+		if quorum := len(voting)/2 + 1; healthy < quorum {
+			p.check("quorum", fmt.Errorf("%v of the %v voters are healthy, %v are needed", healthy, len(voting), quorum))
+		} else {
+			p.check("quorum", nil)
+		}
+
+	case node.state == Follower:
+
+		p.check("role", nil)
+
+		if since := node.now().Sub(node.Meta.leaderContact); node.Meta.leader_id < 0 || since > node.Meta.Config.ElectionTimeoutMax {
+			p.check("leader", fmt.Errorf("no contact with the leader for %v", since.Round(time.Millisecond)))
+		} else {
+			p.check("leader", nil)
+		}
+
+		if lag := node.Meta.leaderCommit - node.lastApplied; lag > node.Meta.Config.ReadinessMaxLag {
+			p.check("lag", fmt.Errorf("%v committed entries aren't applied yet, at most %v are allowed", lag, node.Meta.Config.ReadinessMaxLag))
+		} else {
+			p.check("lag", nil)
+		}
+
+	default:
+		p.check("role", fmt.Errorf("the replica is in the %v state", node.state))
+
+	}
+
+	return p
+}
+
+// Handle the health probes.
+func (node *RaftNode) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, node.health())
+}
+
+// Handle the readiness probes.
+func (node *RaftNode) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, node.readiness())
+}
@@ -0,0 +1,104 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+ * This test case checks that a leader is only ready with a quorum of healthy
+ * members, that a follower is only ready while it hears from the leader and
+ * keeps up with its commits, and that a replica whose store doesn't answer
+ * is neither healthy nor ready.
+ */
+func TestProbes(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "probes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	start := time.Unix(100, 0)
+	clock := NewManualClock(start)
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), alarms: NewAlarms(), Config: DefaultConfig(), clock: clock}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+
+	probe := func(handler http.HandlerFunc) (int, Probe) {
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+
+		var p Probe
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatalf("Invalid probe %v: %v", w.Body.String(), err)
+		}
+
+		return w.Code, p
+	}
+
+	if code, p := probe(node.HealthHandler); code != http.StatusOK || !p.OK || p.Checks["store"] != "ok" {
+		t.Errorf("Expected the replica to be healthy, got %v %+v", code, p)
+	}
+
+	node.state = Leader
+	node.last_contact = map[int32]time.Time{1: start.Add(-100 * time.Millisecond)}
+
+	if code, p := probe(node.ReadinessHandler); code != http.StatusOK || p.Checks["quorum"] != "ok" {
+		t.Errorf("Expected the leader of a quorum to be ready, got %v %+v", code, p)
+	}
+
+	clock.Advance(2 * memberHealthTimeout)
+
+	if code, p := probe(node.ReadinessHandler); code != http.StatusServiceUnavailable || p.OK || p.Checks["quorum"] == "ok" {
+		t.Errorf("Expected a leader cut off from its followers not to be ready, got %v %+v", code, p)
+	}
+
+	node.state, node.Meta.leader_id, node.Meta.leaderContact = Follower, 1, clock.Now()
+	node.Meta.leaderCommit, node.lastApplied = 1500, 1000
+
+	if code, p := probe(node.ReadinessHandler); code != http.StatusOK || p.Checks["leader"] != "ok" || p.Checks["lag"] != "ok" {
+		t.Errorf("Expected a follower keeping up with the leader to be ready, got %v %+v", code, p)
+	}
+
+	node.Meta.leaderCommit = 2500
+
+	if code, p := probe(node.ReadinessHandler); code != http.StatusServiceUnavailable || p.Checks["lag"] == "ok" {
+		t.Errorf("Expected a lagging follower not to be ready, got %v %+v", code, p)
+	}
+
+	node.Meta.leaderCommit = 1000
+	clock.Advance(time.Second)
+
+	if code, p := probe(node.ReadinessHandler); code != http.StatusServiceUnavailable || p.Checks["leader"] == "ok" {
+		t.Errorf("Expected a follower not hearing from the leader not to be ready, got %v %+v", code, p)
+	}
+
+	node.state = Candidate
+
+	if code, _ := probe(node.ReadinessHandler); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a candidate not to be ready, got %v", code)
+	}
+
+	node.Meta.state_machine.Close()
+
+	if code, p := probe(node.HealthHandler); code != http.StatusServiceUnavailable || p.Checks["store"] == "ok" || p.Checks["state"] != "ok" {
+		t.Errorf("Expected a replica whose store is closed not to be healthy, got %v %+v", code, p)
+	}
+}
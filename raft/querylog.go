@@ -0,0 +1,542 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Query log of the DNS listeners, and the statistics of the queries. Every query answered by a
+replica is logged as a QueryLogEntry (the address of the client, the name and type queried, the
+response code, the time taken to answer it and the replica answering it) to the sinks of the
+"query_log" section of the DNS config:
+
+	{"dns": {"query_log": {"sinks": [
+		{"type": "file", "path": "/var/log/dns/queries.jsonl"},
+		{"type": "syslog", "address": "udp://logs.example.com:514", "tag": "dns"},
+		{"type": "kafka", "address": "http://kafka-rest.example.com:8082", "topic": "dns-queries"}
+	]}, ...}}
+
+The file sinks append the entries as JSON lines, the syslog sinks send them to the syslog daemon
+at the address (the local one if empty), and the kafka sinks produce them to the topic through the
+Kafka REST proxy at the address (its v2 API). Other types of sinks can be added with
+RegisterQuerySink. The entries are handed over to the sinks in batches, off the path of the
+queries: those logged while queryLogBuffer entries are already waiting are dropped, and counted in
+dns_query_log_dropped_total, rather than slowing the answers down. The entries written by each sink
+are counted in dns_query_log_entries_total{sink}, and the failed batches in
+dns_query_log_errors_total{sink}, the sink being its type.
+
+The replica also keeps the statistics of the queries it answered over the last queryStatsWindow,
+by bucket of queryStatsBucket, served by GET /admin/query-stats: the queries per second, the rate
+of NXDOMAIN answers, the names queried most (the top form value, 10 by default) and the queries
+per second of each zone. The zone of a query is the closest one of its view, or else the owner of
+the SOA record of the answer; up to queryStatsNames names are counted by bucket, the others being
+left out of the top names.
+*/
+
+const (
+	queryLogBuffer   = 4096            // Entries waiting for the sinks at most
+	queryLogBatch    = 256             // Entries handed over to the sinks at once at most
+	queryLogFlush    = time.Second     // Time an entry waits for its batch to be full at most
+	querySinkTimeout = 5 * time.Second // Time a batch may take to be written to a network sink
+)
+
+// The statistics of the queries cover queryStatsBuckets buckets of queryStatsBucket.
+const (
+	queryStatsBucket  = time.Minute
+	queryStatsBuckets = 5
+	queryStatsWindow  = queryStatsBuckets * queryStatsBucket
+	queryStatsNames   = 10000 // Names counted by bucket at most
+)
+
+// The query log of the DNS config file.
+type DNSQueryLog struct {
+	Sinks []DNSQuerySink `json:"sinks"`
+}
+
+type DNSQuerySink struct {
+	Type    string `json:"type"`    // file, syslog, kafka or a type registered with RegisterQuerySink
+	Path    string `json:"path"`    // File appended to by a file sink
+	Address string `json:"address"` // Syslog server (e.g. "udp://host:514", the local daemon if empty), or URL of the Kafka REST proxy
+	Tag     string `json:"tag"`     // Tag of the syslog messages, "distributed-dns" if empty
+	Topic   string `json:"topic"`   // Topic of a kafka sink
+}
+
+// An entry of the query log.
+type QueryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"` // IP address of the client
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Rcode    string    `json:"rcode"`
+	Latency  float64   `json:"latency_ms"` // Time taken to answer the query
+	Node     int32     `json:"node"`       // Replica answering the query
+	View     string    `json:"view"`
+	Zone     string    `json:"zone,omitempty"`
+	Protocol string    `json:"protocol"` // udp, tcp or https
+}
+
+// A destination of the query log. Write is called with the entries in batches, from a single goroutine.
+type QuerySink interface {
+	Write(entries []QueryLogEntry) error
+	Close() error
+}
+
+// The types of the sinks, opening a sink as configured.
+var querySinkTypes = map[string]func(DNSQuerySink) (QuerySink, error){
+	"file":   openFileSink,
+	"syslog": openSyslogSink,
+	"kafka":  openKafkaSink,
+}
+
+// Register a type of query log sinks for the config files loaded afterwards. Not safe to call
+// concurrently with loading a config file or starting a replica.
+func RegisterQuerySink(name string, open func(DNSQuerySink) (QuerySink, error)) error {
+
+	if name == "" || open == nil {
+		return fmt.Errorf("query sinks must have a name and an open function")
+	}
+
+	if _, ok := querySinkTypes[name]; ok {
+		return fmt.Errorf("query sink %v is already registered", name)
+	}
+
+	querySinkTypes[name] = open
+
+	return nil
+}
+
+func (q DNSQueryLog) validate() error {
+
+	for i, s := range q.Sinks {
+
+		if _, ok := querySinkTypes[s.Type]; !ok {
+			return fmt.Errorf("dns: query log sink %v: unknown type %q", i, s.Type)
+		}
+
+		switch {
+
+		case s.Type == "file" && s.Path == "":
+			return fmt.Errorf("dns: query log sink %v: a file sink requires a path", i)
+
+		case s.Type == "kafka" && (s.Address == "" || s.Topic == ""):
+			return fmt.Errorf("dns: query log sink %v: a kafka sink requires the address of its REST proxy and a topic", i)
+
+		case s.Type == "syslog" && s.Address != "":
+			if _, _, err := syslogAddress(s.Address); err != nil {
+				return fmt.Errorf("dns: query log sink %v: %v", i, err)
+			}
+
+		}
+	}
+
+	return nil
+}
+
+// The query log and the statistics of the queries of a replica.
+type queryLog struct {
+	entries chan QueryLogEntry // Entries waiting for the sinks, nil without sinks
+	stats   queryStats
+}
+
+// Start the query log, whose sinks are closed once ctx is done.
+func (node *RaftNode) startQueryLog(ctx context.Context, config DNSQueryLog) *queryLog {
+
+	q := &queryLog{stats: queryStats{started: node.now()}}
+	if len(config.Sinks) == 0 {
+		return q
+	}
+
+	sinks := make([]QuerySink, len(config.Sinks))
+	for i, s := range config.Sinks {
+
+		sink, err := querySinkTypes[s.Type](s) // checked by validate
+		CheckErrorFatal(err)
+
+		sinks[i] = sink
+	}
+
+	q.entries = make(chan QueryLogEntry, queryLogBuffer)
+
+	go func() {
+
+		ticker := time.NewTicker(queryLogFlush)
+		defer ticker.Stop()
+
+		var batch []QueryLogEntry
+
+		flush := func() {
+
+			if len(batch) == 0 {
+				return
+			}
+
+			for i, sink := range sinks {
+
+				if err := sink.Write(batch); err != nil {
+					node.logger().Warn().Err(err).Str("sink", config.Sinks[i].Type).Int("entries", len(batch)).Msg("Unable to write the query log")
+					node.Meta.metrics.Add("dns_query_log_errors_total", 1, "sink", config.Sinks[i].Type)
+					continue
+				}
+
+				node.Meta.metrics.Add("dns_query_log_entries_total", float64(len(batch)), "sink", config.Sinks[i].Type)
+			}
+
+			batch = batch[:0]
+		}
+
+		for {
+			select {
+
+			case entry := <-q.entries:
+				if batch = append(batch, entry); len(batch) >= queryLogBatch {
+					flush()
+				}
+
+			case <-ticker.C:
+				flush()
+
+			case <-ctx.Done():
+
+				// The entries already logged are written before the sinks are closed.
+				for len(q.entries) > 0 {
+					batch = append(batch, <-q.entries)
+				}
+				flush()
+
+				for _, sink := range sinks {
+					sink.Close()
+				}
+
+				return
+			}
+		}
+	}()
+
+	return q
+}
+
+// Log the query of the view answered with resp, started at start.
+func (node *RaftNode) logQuery(view DNSView, w dns.ResponseWriter, req, resp *dns.Msg, start time.Time) {
+
+	q := node.query_log
+	if q == nil || len(req.Question) != 1 {
+		return
+	}
+
+	now := node.now()
+	name := zone.CanonicalName(req.Question[0].Name)
+	z := queryZone(view, name, resp)
+
+	q.stats.record(now, name, z, resp.Rcode)
+
+	if q.entries == nil {
+		return
+	}
+
+	entry := QueryLogEntry{
+		Time:     start,
+		Name:     name,
+		Type:     dns.TypeToString[req.Question[0].Qtype],
+		Rcode:    dns.RcodeToString[resp.Rcode],
+		Latency:  float64(time.Since(start)) / float64(time.Millisecond),
+		Node:     node.Meta.replica_id,
+		View:     view.Name,
+		Zone:     z,
+		Protocol: "tcp",
+	}
+
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		entry.Client, entry.Protocol = addr.IP.String(), "udp"
+	case *net.TCPAddr:
+		entry.Client = addr.IP.String()
+	}
+
+	if _, doh := w.(*dohWriter); doh {
+		entry.Protocol = "https"
+	}
+
+	select {
+	case q.entries <- entry:
+	default:
+		node.Meta.metrics.Add("dns_query_log_dropped_total", 1)
+	}
+}
+
+// Return the zone of the name queried: the closest zone of the view holding it, or else the owner of
+// the SOA record of the answer, "" if neither is known.
+func queryZone(view DNSView, name string, resp *dns.Msg) string {
+
+	best := ""
+	for _, z := range view.Zones {
+		if z = zone.CanonicalName(z); zone.InZone(name, z) && len(z) > len(best) {
+			best = z
+		}
+	}
+
+	if best != "" {
+		return best
+	}
+
+	for _, rr := range append(append([]dns.RR{}, resp.Answer...), resp.Ns...) {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return zone.CanonicalName(rr.Header().Name)
+		}
+	}
+
+	return ""
+}
+
+// The statistics of the queries, by bucket of queryStatsBucket.
+type queryStats struct {
+	mu      sync.Mutex
+	started time.Time
+	buckets [queryStatsBuckets]queryBucket
+}
+
+type queryBucket struct {
+	start    time.Time
+	queries  int
+	nxdomain int
+	names    map[string]int
+	zones    map[string]int
+}
+
+// The statistics of the queries answered by a replica, as served by GET /admin/query-stats.
+type QueryStats struct {
+	Window       float64      `json:"window_seconds"` // Time the statistics cover
+	Queries      int          `json:"queries"`
+	QPS          float64      `json:"qps"`
+	NXDomain     int          `json:"nxdomain"`
+	NXDomainRate float64      `json:"nxdomain_rate"` // Ratio of the queries answered NXDOMAIN
+	TopNames     []QueryCount `json:"top_names"`
+	Zones        []QueryCount `json:"zones"`
+}
+
+// The queries of a name or a zone.
+type QueryCount struct {
+	Name    string  `json:"name"`
+	Queries int     `json:"queries"`
+	QPS     float64 `json:"qps"`
+}
+
+// Count a query of the name, of the given zone ("" if unknown), answered with rcode at now.
+func (s *queryStats) record(now time.Time, name, z string, rcode int) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := now.Truncate(queryStatsBucket)
+	b := &s.buckets[int(start.Unix()/int64(queryStatsBucket/time.Second))%queryStatsBuckets]
+
+	if !b.start.Equal(start) {
+		*b = queryBucket{start: start, names: make(map[string]int), zones: make(map[string]int)}
+	}
+
+	b.queries++
+
+	if rcode == dns.RcodeNameError {
+		b.nxdomain++
+	}
+
+	if _, ok := b.names[name]; ok || len(b.names) < queryStatsNames {
+		b.names[name]++
+	}
+
+	if z != "" {
+		b.zones[z]++
+	}
+}
+
+// Return the statistics of the queries of the last queryStatsWindow at now, with the top names queried.
+func (s *queryStats) report(now time.Time, top int) QueryStats {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	window := now.Sub(s.started)
+	if window > queryStatsWindow {
+		window = queryStatsWindow
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+
+	stats := QueryStats{Window: window.Seconds()}
+	names, zones := make(map[string]int), make(map[string]int)
+
+	for _, b := range s.buckets {
+
+		if b.start.IsZero() || now.Sub(b.start) >= queryStatsWindow {
+			continue
+		}
+
+		stats.Queries += b.queries
+		stats.NXDomain += b.nxdomain
+
+		for name, n := range b.names {
+			names[name] += n
+		}
+
+		for z, n := range b.zones {
+			zones[z] += n
+		}
+	}
+
+	stats.QPS = float64(stats.Queries) / stats.Window
+	if stats.Queries > 0 {
+		stats.NXDomainRate = float64(stats.NXDomain) / float64(stats.Queries)
+	}
+
+	stats.TopNames = sortedCounts(names, stats.Window)
+	if len(stats.TopNames) > top {
+		stats.TopNames = stats.TopNames[:top]
+	}
+
+	stats.Zones = sortedCounts(zones, stats.Window)
+
+	return stats
+}
+
+// Return the counts sorted by decreasing number of queries, then by name.
+func sortedCounts(counts map[string]int, window float64) []QueryCount {
+
+	list := make([]QueryCount, 0, len(counts))
+	for name, n := range counts {
+		list = append(list, QueryCount{Name: name, Queries: n, QPS: float64(n) / window})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Queries != list[j].Queries {
+			return list[i].Queries > list[j].Queries
+		}
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+func (node *RaftNode) QueryStatsHandler(w http.ResponseWriter, r *http.Request) {
+
+	top := 10
+	if value := r.FormValue("top"); value != "" {
+
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid top %q, expected a non-negative number", value)
+			return
+		}
+	}
+
+	if node.query_log == nil {
+		writeJSON(w, http.StatusOK, QueryStats{TopNames: []QueryCount{}, Zones: []QueryCount{}})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, node.query_log.stats.report(node.now(), top))
+}
+
+// A sink appending the entries to a file, as JSON lines.
+type fileSink struct {
+	file *os.File
+}
+
+func openFileSink(s DNSQuerySink) (QuerySink, error) {
+
+	file, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Write(entries []QueryLogEntry) error {
+
+	w := bufio.NewWriter(s.file)
+	encoder := json.NewEncoder(w)
+
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// Return the network and address of a syslog server, given as "<network>://<address>".
+func syslogAddress(address string) (string, string, error) {
+
+	u, err := url.Parse(address)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return "", "", fmt.Errorf("invalid syslog address %q, expected udp://<host>:<port> or tcp://<host>:<port>", address)
+	}
+
+	return u.Scheme, u.Host, nil
+}
+
+// A sink producing the entries to a Kafka topic, through the v2 API of the Kafka REST proxy.
+type kafkaSink struct {
+	url    string
+	client *http.Client
+}
+
+func openKafkaSink(s DNSQuerySink) (QuerySink, error) {
+	return &kafkaSink{url: strings.TrimSuffix(s.Address, "/") + "/topics/" + url.PathEscape(s.Topic), client: &http.Client{Timeout: querySinkTimeout}}, nil
+}
+
+func (s *kafkaSink) Write(entries []QueryLogEntry) error {
+
+	type record struct {
+		Value QueryLogEntry `json:"value"`
+	}
+
+	records := make([]record, len(entries))
+	for i, entry := range entries {
+		records[i].Value = entry
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("the Kafka REST proxy answered %v: %v", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+func (s *kafkaSink) Close() error {
+	return nil
+}
@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package raft
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// A sink sending the entries to a syslog daemon, as JSON messages.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+func openSyslogSink(s DNSQuerySink) (QuerySink, error) {
+
+	network, address := "", ""
+
+	if s.Address != "" {
+
+		var err error
+		if network, address, err = syslogAddress(s.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	tag := s.Tag
+	if tag == "" {
+		tag = "distributed-dns"
+	}
+
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) Write(entries []QueryLogEntry) error {
+
+	for _, entry := range entries {
+
+		message, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		if err := s.writer.Info(string(message)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package raft
+
+import "fmt"
+
+// The syslog sinks are only available where log/syslog is, see querylog_syslog.go
+func openSyslogSink(s DNSQuerySink) (QuerySink, error) {
+	return nil, fmt.Errorf("syslog query log sinks aren't supported on this platform")
+}
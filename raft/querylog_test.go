@@ -0,0 +1,156 @@
+package raft
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the queries answered are written to the file
+ * and kafka sinks of the query log, and that the statistics count the queries
+ * by name and zone along with the rate of NXDOMAIN answers.
+ */
+func TestQueryLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A Kafka REST proxy, keeping the records produced.
+	var mu sync.Mutex
+	var produced []QueryLogEntry
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var body struct {
+			Records []struct {
+				Value QueryLogEntry `json:"value"`
+			} `json:"records"`
+		}
+
+		if r.URL.Path != "/topics/dns-queries" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		for _, record := range body.Records {
+			produced = append(produced, record.Value)
+		}
+		mu.Unlock()
+	}))
+	defer proxy.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	path := filepath.Join(dir, "queries.jsonl")
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.replica_id = 2
+	node.Meta.Config.DNS = DNSConfig{
+		Views:     []DNSView{{Name: "external", Zones: []string{"example.com.", "example.org."}}},
+		Listeners: []DNSListener{{Address: address, Protocol: "udp", View: "external"}},
+		QueryLog:  DNSQueryLog{Sinks: []DNSQuerySink{{Type: "file", Path: path}, {Type: "kafka", Address: proxy.URL + "/", Topic: "dns-queries"}}},
+	}
+
+	if err := node.Meta.Config.DNS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	node.StartDNSListeners(ctx)
+
+	// The store isn't running, so the names of the zones are answered SERVFAIL, and the others refused.
+	for _, name := range []string{"www.example.com.", "www.example.com.", "mail.example.org.", "www.example.net."} {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		if _, _, err := new(dns.Client).Exchange(req, address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := node.query_log.stats.report(node.now(), 1)
+	if stats.Queries != 4 || len(stats.TopNames) != 1 || stats.TopNames[0].Name != "www.example.com." || stats.TopNames[0].Queries != 2 {
+		t.Errorf("Expected 4 queries, www.example.com. being the top name, got %+v", stats)
+	}
+
+	if len(stats.Zones) != 2 || stats.Zones[0].Name != "example.com." || stats.Zones[0].Queries != 2 || stats.NXDomainRate != 0 {
+		t.Errorf("Expected the queries of the 2 zones of the view, got %+v", stats)
+	}
+
+	node.query_log.stats.record(node.now(), "missing.example.com.", "example.com.", dns.RcodeNameError)
+	if rate := node.query_log.stats.report(node.now(), 10).NXDomainRate; rate != 0.2 {
+		t.Errorf("Expected an NXDOMAIN rate of 0.2, got %v", rate)
+	}
+
+	// The entries are written once the context is done, at the latest.
+	cancel()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for node.Meta.metrics.Get("dns_query_log_entries_total", "sink", "kafka") < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	if len(produced) != 4 || produced[0].Name != "www.example.com." || produced[0].Node != 2 || produced[0].Client != "127.0.0.1" || produced[0].Protocol != "udp" || produced[3].Rcode != "REFUSED" {
+		t.Errorf("Expected the 4 queries to be produced to the topic, got %+v", produced)
+	}
+	mu.Unlock()
+
+	for node.Meta.metrics.Get("dns_query_log_entries_total", "sink", "file") < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var lines []QueryLogEntry
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+
+		var entry QueryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+
+		lines = append(lines, entry)
+	}
+
+	if len(lines) != 4 || lines[2].Zone != "example.org." || lines[2].Type != "A" || lines[2].Latency <= 0 {
+		t.Errorf("Expected the 4 queries to be appended to the file, got %+v", lines)
+	}
+
+	for _, sink := range []DNSQuerySink{{Type: "file"}, {Type: "kafka", Address: proxy.URL}, {Type: "syslog", Address: "logs:514"}, {Type: "carrier-pigeon"}} {
+		if err := (DNSQueryLog{Sinks: []DNSQuerySink{sink}}).validate(); err == nil {
+			t.Errorf("Expected the sink %+v to be invalid", sink)
+		}
+	}
+
+	if !strings.Contains(RegisterQuerySink("file", openFileSink).Error(), "already registered") {
+		t.Errorf("Expected the types of sinks to be registered once")
+	}
+}
@@ -1,15 +1,22 @@
 package raft
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"log"
+	"encoding/json"
+	"errors"
+	"math/rand"
 	"net/http"
-	"net/url"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 )
 
@@ -22,22 +29,65 @@ const (
 	Down
 )
 
+func (state RaftNodeState) String() string {
+
+	switch state {
+	case Follower:
+		return "Follower"
+	case Candidate:
+		return "Candidate"
+	case Leader:
+		return "Leader"
+	default:
+		return "Down"
+	}
+
+}
+
 // Store metadata related to the key value store and the raft node.
 type NodeMetadata struct {
-	n_replicas            int32                           // The number of replicas in the current replicated system
-	replica_id            int32                           // The unique ID for the current replica
-	peer_replica_clients  []protos.ConsensusServiceClient // Client objects to send messages to other peers
-	grpc_server           *grpc.Server                    // The gRPC server object
-	raft_server           *http.Server                    // The HTTP server object for the Raft server
-	kv_store_server       *http.Server                    // The HTTP server object for the KV store server[TODO]
-	kvstore_addr          string                          // Stores the address of the local key value store
-	raft_persistence_file string                          // File where the log, currentTerm, votedFor, commitIndex and lastApplied are persisted
-	leaderAddress         string                          // Address of the last known leader
-	nodeAddress           string                          // Address of our node
-	latestClient          string                          // Address of client that made latest write request
-	shutdown_chan         chan string                     // Channel indicating termination of given module.
-	Master_ctx            context.Context                 // A context derived from the master context for graceful shutdown
-	Master_cancel         context.CancelFunc              // The cancel function for the above master context
+	n_replicas            int32              // The number of replicas in the current replicated system
+	replica_id            int32              // The unique ID for the current replica
+	peer_replica_clients  []Transport        // Transports to send messages to other peers, see transport.go
+	grpc_server           *grpc.Server       // The gRPC server object
+	raft_server           *http.Server       // The HTTP server object for the Raft server
+	kv_store_server       *http.Server       // The HTTP server object for the KV store server[TODO]
+	state_machine         localStateMachine  // The local key-value store the committed entries are applied to, see state_machine.go
+	kvstore_addr          string             // Stores the address of the local key value store
+	raft_persistence_file string             // File where the log, currentTerm, votedFor, commitIndex, lastApplied, the sessions and the cluster ID are persisted
+	leaderAddress         string             // Address of the last known leader
+	leader_id             int32              // Replica ID of the last known leader, -1 if unknown
+	leaderCommit          int32              // Commit index of the leader, as of its latest AppendEntries
+	leaderContact         time.Time          // Time of the latest AppendEntries from the leader, see follower_reads.go
+	initial_members       []Member           // Members of the cluster on startup, see membership.go
+	members               []Member           // Members of the latest configuration in the log
+	nodeAddress           string             // Address of our node
+	latestClient          string             // Address of client that made latest write request
+	shutdown_chan         chan string        // Channel indicating termination of given module.
+	shutdown_requests     chan bool          // Shutdowns requested by /admin/shutdown, with whether to wipe the data, see decommission.go
+	Master_ctx            context.Context    // A context derived from the master context for graceful shutdown
+	Master_cancel         context.CancelFunc // The cancel function for the above master context
+	Config                *Config            // Operational settings of the replica, see config.go
+	metrics               *Metrics           // Counters and gauges exposed at /admin/metrics
+	settings              *Settings          // Cluster-wide settings replicated through the log, see settings.go
+	users                 *Users             // Users of the client HTTP API replicated through the log, see users.go
+	roles                 *Roles             // Roles of the users replicated through the log, see acl.go
+	tsig_keys             *TSIGKeys          // TSIG keys of the DNS updates replicated through the log, see tsig.go
+	webhooks              *Webhooks          // Webhooks the changes are delivered to, see webhooks.go
+	rejections            *Rejections        // Recently rejected proposals, see rejections.go
+	clock                 Clock              // Clock of the time-based logic, see clock.go
+	raft_clock            TimerClock         // Clock of the Raft timers, the wall clock if nil (see clock.go)
+	timeouts              *rand.Rand         // Source of the election timeouts, the global one if nil (see clock.go)
+	shedder               *loadShedder       // Requests being served by the HTTP and gRPC servers, see shedding.go
+	authorizer            Authorizer         // External authorization of the client writes, if any, see authz.go
+	shards                *ShardHost         // Replicas of the other groups hosted by the process, if sharded, see shards.go
+	logger                *zerolog.Logger    // Logger carrying the replica's ID, see logger()
+	peer_tls              *certReloader      // Certificates used for mutual TLS between replicas, nil if disabled, see tls.go
+	faults                *faultInjector     // Faults injected for tests, nil if disabled, see faults.go
+	snapshots             *snapshotThrottle  // Bandwidth of the snapshot transfers, see throttle.go
+	rate_limits           *httpRateLimiter   // Token buckets of the client HTTP API, see ratelimit.go
+	alarms                *Alarms            // Alarms raised by the members exceeding their limits, see alarms.go
+	locks                 *Locks             // Locks held by external clients, see locks.go
 }
 
 // Main struct storing different aspects of the replica and it's state
@@ -56,25 +106,60 @@ type RaftNode struct {
 	// State to be maintained on all replicas
 	currentTerm int32             // Latest term server has seen
 	votedFor    int32             // Candidate ID of the node that received vote from current node in the latest term
-	log         []protos.LogEntry // The array of the log entry structs
+	log         []protos.LogEntry // The array of the log entry structs, from logStart on (see log.go)
+
+	logStart        int32    // Index of the first entry of log, the previous ones being compacted into a snapshot. Persisted.
+	logStartTerm    int32    // Term of the entry before logStart, if any. Persisted.
+	logStartMembers []Member // Configuration as of the entry before logStart, nil if the initial one. Persisted.
 
 	// State to be maintained on all replicas
-	stopElectiontimer  chan bool     // Channel to signal for stopping the election timer for the node
-	electionResetEvent chan bool     // Channel to signal for resetting the election timer for the node
-	commitIndex        int32         // Index of the highest long entry known to be committed. Persisted.
-	lastApplied        int32         // Index of the highest log entry applied to the state machine. Persisted.
-	state              RaftNodeState // The current state of the node(eg. Candidate, Leader, etc)
+	stopElectiontimer  chan bool               // Channel to signal for stopping the election timer for the node
+	electionResetEvent chan bool               // Channel to signal for resetting the election timer for the node, see resetElectionTimer
+	timeoutNowEvent    chan bool               // Channel to signal the election timer to start an election immediately
+	commitIndex        int32                   // Index of the highest long entry known to be committed. Persisted.
+	lastApplied        int32                   // Index of the highest log entry applied to the state machine. Persisted.
+	sessions           map[int64]clientSession // Client sessions applied to the state machine, see sessions.go. Persisted.
+	sessionBase        int64                   // Offset of the IDs of the registered sessions, after a restore. Persisted.
+	cluster_id         atomic.Value            // ID of the cluster, "" until known, see cluster_id.go. Persisted.
+	state              RaftNodeState           // The current state of the node(eg. Candidate, Leader, etc)
+	transferring       bool                    // Whether the leader is transferring its leadership, see admin.go
 
 	// State to be maintained on the leader (unpersisted)
 	nextIndex  []int32 // Indices of the next log entry to send to each server
 	matchIndex []int32 // Indices of highest log entry known to be replicated on each server
 
-	commits_ready chan int32 // Channel to signal the number of items commited once commit has been made to the log.
+	last_contact  map[int32]time.Time // Time of the latest AppendEntries response from each server, see membership.go
+	peers         peerTracker         // Outcome of the RPCs sent to each peer, see peers.go
+	storms        stormDetector       // Term changes and widening of the election timeouts, see storms.go
+	policies      policyRotations     // Rotations of the round_robin RRsets, see policies.go
+	notifications notifications       // Serials acknowledged by the secondary name servers, see serials.go
+	installs      snapshotInstalls    // Snapshots sent to the followers behind the start of the log, see install.go
+
+	snapshotIndex int32 // Applied index of the latest snapshot taken of the store, -1 if none. Accessed atomically, see snapshot()
+	exports       int32 // Exports in progress, over gRPC and HTTP. Accessed atomically, see export.go
+
+	commits_ready chan int32 // Channel to signal that entries were committed to the log, see notifyCommits.
 	storage       *Storage   // Used for Persistence
+
+	reads       *readCoalescer               // Coalesces the leadership confirmations of concurrent reads, see reads.go
+	watches     *WatchHub                    // Watchers of the changes applied to the state machine, see watch.go
+	txn_results map[int32]kv_store.TxnResult // Outcomes of applied transactions, awaited by the leader's KVService, see kv_service.go
+	jobs        leaderJobs                   // Periodic jobs run while the replica is the leader, see jobs.go
+	federation  federation                   // Zones replicated from other clusters by the leader, see federation.go
+	canary      canaryCheck                  // Error rates of the canary replica checked by the leader, see canary.go
+	proposals   proposalQueue                // Proposals pending on the leader, see admission.go
+	dns_updates updateHistory                // DNS updates recently received, see dns_update.go
+	geo         *geoTable                    // Regions of the DNS resolvers, nil unless configured, see geo.go
+	query_log   *queryLog                    // Query log and statistics of the DNS listeners, see querylog.go
+	rrl         rateLimiters                 // Response rate limiters of the DNS views, see rrl.go
+	answers     answerCache                  // Answers of the DNS lookups, see answercache.go
+	changes     changeStream                 // Changes applied, published by the leader, see changestream.go
+	backups     scheduledBackups             // Storage of the scheduled backups, see backup_schedule.go
 }
 
-// Initialize the RaftNode (and NodeMetadata) objects. Also restores persisted raft state, if any.
-func InitializeNode(n_replica int32, rid int, keyvalue_addr string) *RaftNode {
+// Initialize the RaftNode (and NodeMetadata) objects, with the data in the given layout. Also restores
+// persisted raft state, if any.
+func InitializeNode(n_replica int32, rid int, keyvalue_addr string, layout DataLayout) *RaftNode {
 
 	// Initializes RaftNode and NodeMetadata
 
@@ -86,38 +171,85 @@ func InitializeNode(n_replica int32, rid int, keyvalue_addr string) *RaftNode {
 		votedFor:    -1,
 
 		stopElectiontimer:  make(chan bool),
-		electionResetEvent: make(chan bool),
+		electionResetEvent: make(chan bool, 1),
+		timeoutNowEvent:    make(chan bool),
 		commitIndex:        -1,       // index of highest log entry known to be committed.
 		lastApplied:        -1,       // index of highest log entry applied to state machine.
 		state:              Follower, // all nodes are initialized as followers
 
-		commits_ready: make(chan int32),
+		commits_ready: make(chan int32, 1),
 		storage:       NewStorage(),
+
+		watches:     NewWatchHub(),
+		txn_results: make(map[int32]kv_store.TxnResult),
+		sessions:    make(map[int64]clientSession),
+
+		last_contact: make(map[int32]time.Time),
+
+		snapshotIndex: -1,
 	}
 
 	meta := &NodeMetadata{
 
 		n_replicas:           n_replica,
 		replica_id:           int32(rid),
-		peer_replica_clients: make([]protos.ConsensusServiceClient, n_replica),
+		peer_replica_clients: make([]Transport, n_replica),
+
+		leader_id: -1,
 
 		kvstore_addr:          keyvalue_addr,
-		raft_persistence_file: keyvalue_addr[1:],
+		raft_persistence_file: filepath.Join(layout.WAL, keyvalue_addr[1:]), // 300<id>, see DataLayout.RaftFile
+
+		shutdown_chan:     make(chan string),
+		shutdown_requests: make(chan bool, 1),
+
+		Config:     DefaultConfig(),
+		metrics:    NewMetrics(),
+		settings:   NewSettings(),
+		users:      NewUsers(),
+		roles:      NewRoles(),
+		tsig_keys:  NewTSIGKeys(),
+		webhooks:   NewWebhooks(),
+		alarms:     NewAlarms(),
+		locks:      NewLocks(),
+		rejections: NewRejections(),
+		shedder:    &loadShedder{},
+		clock:      defaultClock(),
+	}
 
-		shutdown_chan: make(chan string),
+	logger := logging.Logger.With().Int32("replica_id", int32(rid)).Logger()
+	if layout.Group != 0 {
+		logger = logger.With().Int("group", layout.Group).Logger()
 	}
+	meta.logger = &logger
 
 	raft_node.Meta = meta
+	raft_node.Meta.Config.Layout = layout
+	raft_node.Meta.settings.setReplica(int32(rid))
+	raft_node.reads = newReadCoalescer(raft_node.confirmLeadership)
+	raft_node.Meta.snapshots = newSnapshotThrottle(raft_node.Meta.metrics, raft_node.snapshotLimits)
+	raft_node.Meta.rate_limits = newHTTPRateLimiter()
+	raft_node.RegisterLeaderJob(raft_node.memberHealthJob())
+	raft_node.RegisterLeaderJob(raft_node.federationJob())
+	raft_node.RegisterLeaderJob(raft_node.canaryJob())
+	raft_node.RegisterLeaderJob(raft_node.alarmsJob())
+	raft_node.RegisterLeaderJob(raft_node.notifyJob())
+	raft_node.RegisterLeaderJob(raft_node.auditRetentionJob())
+	raft_node.RegisterLeaderJob(raft_node.webhooksJob())
+	raft_node.RegisterLeaderJob(raft_node.changeStreamJob())
+	raft_node.RegisterLeaderJob(raft_node.backupScheduleJob())
+	raft_node.RegisterLeaderJob(raft_node.decommissionJob())
+	raft_node.RegisterLeaderJob(raft_node.clusterIDJob())
 
 	if raft_node.storage.HasData(raft_node.Meta.raft_persistence_file) {
 
 		raft_node.RestoreFromStorage(raft_node.storage)
-		log.Printf("\nRestored Persisted Data:\n")
-		log.Printf("\nRestored currentTerm: %v\nRestored votedFor: %v\nRestored log: %v\nRestored log length: %v\n", raft_node.currentTerm, raft_node.votedFor, raft_node.log, len(raft_node.log))
+		raft_node.logger().Info().Int32("term", raft_node.currentTerm).Int32("voted_for", raft_node.votedFor).Int("log_length", len(raft_node.log)).Msg("Restored persisted data")
+		raft_node.logger().Debug().Interface("log", raft_node.log).Msg("Restored log")
 
 	} else {
 
-		log.Printf("\nNo persisted data found.\n")
+		raft_node.logger().Info().Msg("No persisted data found")
 
 	}
 
@@ -129,8 +261,14 @@ func InitializeNode(n_replica int32, rid int, keyvalue_addr string) *RaftNode {
 func (node *RaftNode) ConnectToPeerReplicas(ctx context.Context, rep_addrs []string) {
 
 	// Attempt to connect to the gRPC servers of all other replicas, and obtain the client stubs.
-	// The clients for each corresponding server is stored in client_objs.
-	client_objs := make([]protos.ConsensusServiceClient, node.Meta.n_replicas)
+	// The transports wrapping the clients for each corresponding server are stored in client_objs.
+	// A replica joining the cluster may have an ID beyond the initial replicas.
+	size := node.Meta.n_replicas
+	if node.Meta.replica_id >= size {
+		size = node.Meta.replica_id + 1
+	}
+
+	client_objs := make([]Transport, size)
 
 	// NOTE: even if the grpc Dial to a given server fails the first time, the client stub can still be obtained.
 	// RPC requests using such client stubs will succeed when the connection can be established to
@@ -142,13 +280,51 @@ func (node *RaftNode) ConnectToPeerReplicas(ctx context.Context, rep_addrs []str
 			continue
 		}
 
-		connxn, err := grpc.Dial(rep_addrs[i], grpc.WithInsecure())
+		transport, err := node.dialPeer(i, rep_addrs[i])
 		CheckErrorFatal(err) // there will NOT be an error if the gRPC server is down.
 
-		// Obtain client stub
-		cli := protos.NewConsensusServiceClient(connxn)
+		client_objs[i] = transport
+	}
+
+	node.connectPeers(ctx, rep_addrs, client_objs)
+}
+
+// Start taking part in the cluster, reaching the other replicas through the given transports (e.g. the
+// in-memory ones of a MemoryNetwork, see transport.go), indexed by replica ID.
+func (node *RaftNode) connectPeers(ctx context.Context, rep_addrs []string, client_objs []Transport) {
+
+	initial_members := make([]Member, 0, node.Meta.n_replicas)
+
+	for i := int32(0); i < node.Meta.n_replicas; i++ {
+
+		initial_members = append(initial_members, groupMember(node.group(), i))
+
+		if i != node.Meta.replica_id {
+			initial_members[i].Address = rep_addrs[i]
+		} else if node.Meta.Config.SinglePort {
+			initial_members[i].Address = initial_members[i].ClientAddress // see portmux.go
+		}
+	}
+
+	// The witnesses given on startup, see witness.go
+	for _, id := range node.Meta.Config.Witnesses {
+		if id < node.Meta.n_replicas {
+			initial_members[id].Witness = true
+		}
+	}
+
+	// Likewise for the members dedicated to consensus, see serving.go
+	for _, id := range node.Meta.Config.ConsensusOnly {
+		if id < node.Meta.n_replicas {
+			initial_members[id].ConsensusOnly = true
+		}
+	}
 
-		client_objs[i] = cli
+	// And the failure domains of the initial members, see placement.go
+	for i, domain := range node.Meta.Config.FailureDomains {
+		if int32(i) < node.Meta.n_replicas {
+			initial_members[i].Domain = domain.String()
+		}
 	}
 
 	node.Meta.peer_replica_clients = client_objs
@@ -157,10 +333,15 @@ func (node *RaftNode) ConnectToPeerReplicas(ctx context.Context, rep_addrs []str
 	node.GetLock("ConnectToPeerReplicas")
 	defer node.ReleaseLock("ConnectToPeerReplicas")
 
+	// Switch to the latest configuration in the restored log, if any.
+	node.Meta.initial_members = initial_members
+	node.Meta.members = initial_members
+	node.refreshMembership()
+
 	// suppose node dies before some commits have been applied to the state machine, then
 	// we want to finish applying them.
 	if node.commitIndex > node.lastApplied {
-		node.commits_ready <- (node.commitIndex - node.lastApplied)
+		node.notifyCommits()
 	}
 
 	if node.state == Follower {
@@ -177,9 +358,21 @@ func (node *RaftNode) ConnectToPeerReplicas(ctx context.Context, rep_addrs []str
 
 }
 
+// Tell ApplyToStateMachine that entries were committed. It isn't waited for, as the callers hold the
+// lock ApplyToStateMachine takes: the entries up to commitIndex are applied once it wakes up.
+func (node *RaftNode) notifyCommits() {
+
+	select {
+	case node.commits_ready <- 1:
+	default: // ApplyToStateMachine is already notified
+	}
+}
+
 // Apply committed entries to our key-value store.
 func (node *RaftNode) ApplyToStateMachine(ctx context.Context, testing bool) {
 
+	defer node.diagnoseCrash() // see diagnostics.go
+
 	for {
 
 		select {
@@ -190,115 +383,256 @@ func (node *RaftNode) ApplyToStateMachine(ctx context.Context, testing bool) {
 			}
 			return
 
-		case to_commit := <-node.commits_ready:
-
-			log.Printf("\nApplyToStateMachine received commit(s)\n")
+		case <-node.commits_ready:
 
 			node.GetLock("ApplyToStateMachine")
 
-			var entries []protos.LogEntry
+			node.logger().Debug().Int32("count", node.commitIndex-node.lastApplied).Msg("ApplyToStateMachine received commit(s)")
 
-			// Get the entries that are uncommited and need to be applied.
-			entries = node.log[node.lastApplied+1 : node.lastApplied+to_commit+1]
+			// Apply the entries that are committed, in order.
 			applied := int32(0)
-			halt_applying := false
 
-			for _, entry := range entries {
+			for index := node.lastApplied + 1; index <= node.commitIndex; index++ {
 
-				client := http.Client{}
+				if !node.applyEntry(index) {
+					break
+				}
 
-				switch entry.Operation[0] {
+				applied += 1
+			}
 
-				case "POST":
+			node.lastApplied = node.lastApplied + applied
 
-					formData := url.Values{
-						"value": {entry.Operation[2]},
-					}
+			// The entries applied may no longer be needed in the log, see compaction.go
+			node.compact()
 
-					url := fmt.Sprintf("http://localhost%s/%s", node.Meta.kvstore_addr, entry.Operation[1])
-					resp, err := http.PostForm(url, formData)
+			node.PersistToStorage()
 
-					if err != nil {
+			node.ReleaseLock("ApplyToStateMachine")
 
-						log.Printf("\nError in http.PostForm in POST ApplyToStateMachine: %v\n", err)
+		}
 
-						halt_applying = true
-						break
-					}
+	}
+}
 
-					resp.Body.Close()
+// Apply the committed entry at the given index to the state machine. Return false if it couldn't be
+// applied, in which case the entries that follow it aren't applied either. Must be called with the
+// lock held.
+func (node *RaftNode) applyEntry(index int32) bool {
 
-				case "PUT":
+	entry := node.entry(index)
 
-					formData := url.Values{
-						"value": {entry.Operation[2]},
-					}
+	halt_applying := false
 
-					req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://localhost%s/%s", node.Meta.kvstore_addr, entry.Operation[1]), bytes.NewBufferString(formData.Encode()))
-					if err != nil {
-						log.Printf("\nError in http.NewRequest in PUT ApplyToStateMachine: %v\n", err)
+	// The entry is applied as part of the trace of the request that proposed it, see tracing.go
+	_, span := startChildSpan(contextWithTraceparent(context.Background(), entry.Traceparent), "raft.apply", trace.WithAttributes(
+		attribute.String("raft.operation", entry.Operation[0]),
+		attribute.Int("raft.index", int(index)),
+		attribute.Int("raft.replica_id", int(node.Meta.replica_id)),
+	))
 
-						halt_applying = true
-						break
+	// Writes of a client session are applied at most once, see sessions.go
+	if node.skipSessionEntry(node.entry(index), index) {
+		span.End()
+		return true
+	}
 
-					}
-					req.Header.Set("Content-Type", "application/x-www-form-urlencoded; param=value")
+	// Witnesses hold no keys, see witness.go
+	if node.isWitness() && isDataEntry(node.entry(index)) {
+		node.recordSessionWrite(node.entry(index), index, kv_store.TxnResult{})
+		span.End()
+		return true
+	}
 
-					resp, err := client.Do(req)
-					if err != nil {
-						log.Printf("\nError in client.Do in PUT ApplyToStateMachine: %v\n", err)
+	var outcome kv_store.TxnResult // Result of a transaction, kept for its session
 
-						halt_applying = true
-						break
+	switch entry.Operation[0] {
 
-					}
+	case "POST", "PUT", "DELETE", "TXN", "DELETE_PREFIX", "COMPACT":
 
-					resp.Body.Close()
+		result, err := node.stateMachine().Apply(entry.Operation)
 
-				case "DELETE":
+		if err != nil {
 
-					req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://localhost%s/%s", node.Meta.kvstore_addr, entry.Operation[1]), nil)
-					if err != nil {
-						log.Printf("\nError in http.NewRequest in DELETE ApplyToStateMachine: %v\n", err)
+			node.logger().Error().Err(err).Int32("index", index).Str("operation", entry.Operation[0]).Msg("Unable to apply the entry to the state machine")
 
-						halt_applying = true
-						break
+			halt_applying = true
+			break
+		}
 
-					}
-					req.Header.Set("Content-Type", "application/x-www-form-urlencoded;")
+		for _, event := range result.Events {
+			node.watches.Publish(txnEventToProto(event, index))
+		}
 
-					resp, err := client.Do(req)
-					if err != nil {
+		// The answers of the changed records are no longer cached, see answercache.go
+		node.invalidateAnswers(result.Events)
 
-						log.Printf("\nError in client.Do in DELETE ApplyToStateMachine: %v\n", err)
-						halt_applying = true
-						break
+		// The changes are recorded in the audit history of their keys, see audit.go. The entry being
+		// applied already, a failure is only logged.
+		if txn, ok := auditTxn(entry, index, result); ok {
+			node.applyTxn(txn, index, false)
+		}
 
-					}
+		// And kept for the change stream, see changestream.go
+		node.recordChanges(entry, index, result)
 
-					resp.Body.Close()
+		if entry.Operation[0] == "TXN" || entry.Operation[0] == "DELETE_PREFIX" {
 
-				case "NO-OP":
-					log.Printf("\nNO-OP encountered, continuing...\n")
+			// The leader keeps the outcome around for the client waiting on it in Txn or deletePrefix.
+			if node.state == Leader {
+				node.storeTxnResult(index, result)
+			}
 
-				default:
-					log.Printf("\nFatal: Invalid operation: %v\n", entry.Operation[0])
+			outcome = result
+		}
 
-				}
+	case "SESSION":
+		node.registerSession(node.sessionID(index), index)
+		node.logger().Info().Int32("index", index).Str("client", entry.Clientid).Msg("Client session registered")
 
-				if halt_applying {
-					break
-				}
+	case "SETTING":
 
-				applied += 1
-			}
+		txn, change := node.settingTxn(node.entry(index), index)
 
-			node.lastApplied = node.lastApplied + applied
-			node.PersistToStorage()
+		if !node.applyTxn(txn, index, true) {
+			halt_applying = true
+			break
+		}
 
-			node.ReleaseLock("ApplyToStateMachine")
+		node.Meta.settings.apply(change)
+		node.flushAnswers() // The delegations and the routes of the shards are settings
+		node.logger().Info().Int32("index", index).Str("name", change.Name).Str("previous", change.Previous).Str("value", change.Value).Str("author", change.Author).Msg("Setting changed")
+
+		if compressionSetting(change.Name) {
+			node.configureCompression()
+		}
+
+	case "USER":
+
+		// The records of the users aren't published to the watchers, see users.go
+		txn, name, user := userTxn(node.entry(index))
+
+		if !node.applyTxn(txn, index, false) {
+			halt_applying = true
+			break
+		}
+
+		node.Meta.users.apply(name, user)
+		node.logger().Info().Int32("index", index).Str("name", name).Bool("removed", user == nil).Msg("User changed")
+
+	case "ROLE":
+
+		// Like the users, the roles aren't published to the watchers, see acl.go
+		txn, name, role := roleTxn(node.entry(index))
+
+		if !node.applyTxn(txn, index, false) {
+			halt_applying = true
+			break
+		}
+
+		node.Meta.roles.apply(name, role)
+		node.logger().Info().Int32("index", index).Str("name", name).Bool("removed", role == nil).Msg("Role changed")
+
+	case "TSIG":
+
+		// Like the users, the TSIG keys aren't published to the watchers, see tsig.go
+		txn, name, key := tsigTxn(node.entry(index))
+
+		if !node.applyTxn(txn, index, false) {
+			halt_applying = true
+			break
+		}
+
+		node.Meta.tsig_keys.apply(name, key)
+		node.logger().Info().Int32("index", index).Str("name", name).Bool("removed", key == nil).Msg("TSIG key changed")
+
+	case "WEBHOOK":
+
+		// Nor are the webhooks, which hold their secrets, see webhooks.go
+		txn, name, hook := webhookTxn(node.entry(index))
+
+		if !node.applyTxn(txn, index, false) {
+			halt_applying = true
+			break
+		}
 
+		node.Meta.webhooks.apply(name, hook)
+		node.logger().Info().Int32("index", index).Str("name", name).Bool("removed", hook == nil).Msg("Webhook changed")
+
+	case "ALARM":
+
+		txn, name, alarm := alarmTxn(node.entry(index))
+
+		if !node.applyTxn(txn, index, false) {
+			halt_applying = true
+			break
+		}
+
+		node.Meta.alarms.apply(name, alarm)
+		node.logger().Warn().Int32("index", index).Str("name", name).Bool("disarmed", alarm == nil).Msg("Alarm changed")
+
+	case "LOCK":
+
+		// Refused requests change nothing, see locks.go
+		txn, lock := node.lockTxn(node.entry(index), index)
+		if lock == nil {
+			break
 		}
 
+		if !node.applyTxn(txn, index, false) {
+			halt_applying = true
+			break
+		}
+
+		node.Meta.locks.apply(*lock)
+		node.logger().Info().Int32("index", index).Str("name", lock.Name).Str("holder", lock.Holder).Int64("token", lock.Token).Msg("Lock changed")
+
+	case "NO-OP":
+		node.logger().Debug().Int32("index", index).Msg("NO-OP encountered, continuing")
+
+	case "CONFIG":
+		// Configurations take effect when appended to the log, see membership.go
+		node.logger().Info().Int32("index", index).Str("members", entry.Operation[1]).Msg("Configuration committed")
+
+	case "CLUSTER_ID":
+		node.applyClusterID(index, entry.Operation[1])
+
+	default:
+		node.logger().Error().Int32("index", index).Str("operation", entry.Operation[0]).Msg("Invalid operation")
+
 	}
+
+	if halt_applying {
+		endSpan(span, errors.New("unable to apply the entry to the key-value store"))
+		return false
+	}
+
+	node.recordSessionWrite(node.entry(index), index, outcome)
+
+	span.End()
+
+	return true
+}
+
+// Apply the transaction of an entry that isn't a client transaction (e.g. a setting) to the state
+// machine, publishing its changes if requested. Return whether it was applied.
+func (node *RaftNode) applyTxn(txn kv_store.Txn, index int32, publish bool) bool {
+
+	encoded, _ := json.Marshal(txn)
+
+	result, err := node.stateMachine().Apply([]string{"TXN", string(encoded)})
+	if err != nil {
+		node.logger().Error().Err(err).Int32("index", index).Msg("Unable to apply the entry to the state machine")
+		return false
+	}
+
+	if publish {
+		for _, event := range result.Events {
+			node.watches.Publish(txnEventToProto(event, index))
+		}
+	}
+
+	node.invalidateAnswers(result.Events)
+
+	return true
 }
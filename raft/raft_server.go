@@ -2,12 +2,40 @@ package raft
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc/status"
 )
 
+// Headers carrying the last known leader on every response, so that clients can re-route their
+// writes after a leader change without first having one rejected.
+const (
+	LeaderHeader   = "X-Raft-Leader"    // Address of the leader's client HTTP server
+	LeaderIdHeader = "X-Raft-Leader-Id" // Replica ID of the leader
+)
+
+// Middleware setting the leader headers on every response.
+func (node *RaftNode) leaderHeaderMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		node.GetRLock("Leader Header Middleware")
+		leader := node.leaderInfo()
+		node.ReleaseRLock("Leader Header Middleware")
+
+		if leader != nil {
+			w.Header().Set(LeaderHeader, leader.Address)
+			w.Header().Set(LeaderIdHeader, strconv.Itoa(int(leader.Id)))
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
+
 // Clients can make a request to the /test endpoint to check if the server is up.
 func (node *RaftNode) TestHandler(w http.ResponseWriter, r *http.Request) {
 
@@ -18,26 +46,26 @@ func (node *RaftNode) TestHandler(w http.ResponseWriter, r *http.Request) {
 // Handle POST requests
 func (node *RaftNode) PostHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nPOST request received\n")
+	node.logger().Info().Msg("POST request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusCreated)
-
 	if err := r.ParseForm(); err != nil {
-		fmt.Fprintf(w, "ParseForm() err: %v", err)
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
 		return
 	}
 
-	node.GetRLock("Raft Server Post Handler")
-
-	if node.state != Leader {
-
-		fmt.Fprintf(w, "\nError: Not a leader.\n")
+	// Retries of a write made in a client session are only applied once, see sessions.go
+	session, sequence, err := requestSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
 
-		fmt.Fprintf(w, "\nLast known leader's address: "+node.Meta.leaderAddress+"\n")
-		node.ReleaseRLock("Raft Server Post Handler")
+	async, err := asyncRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
 		return
 	}
 
@@ -46,53 +74,99 @@ func (node *RaftNode) PostHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	key := params["key"]
 
+	if !node.validRequestKey(w, r, key, validateWrittenKey) {
+		return
+	}
+
+	node.GetRLock("Raft Server Post Handler")
+
+	if node.state != Leader {
+		node.rejectRequest(rejectNotLeader, r, errNotLeader)
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Raft Server Post Handler")
+		writeNotLeader(w, leader)
+		return
+	}
+
 	operation := make([]string, 3)
 	operation[0] = "POST"
 	operation[1] = key
 	operation[2] = value
 
-	success, err := node.WriteCommand(operation, client)
-	if success { // Mutex will be unlocked in WriteCommand
-		log.Printf("\nPOST request completed successfully and committed.\n")
+	if async { // Mutex will be unlocked in asyncWriteHandler
+		node.asyncWriteHandler(w, r, http.StatusCreated, operation, client, session, sequence)
+		return
+	}
+
+	_, success, err := node.proposeSessionCommand(r.Context(), operation, client, session, sequence)
+	if success { // Mutex will be unlocked in proposeSessionCommand
+		node.logger().Info().Str("key", key).Msg("POST request completed successfully and committed")
+		w.WriteHeader(http.StatusCreated)
 		fmt.Fprintf(w, "\nPOST request completed successfully and committed.\n")
 	} else {
-		log.Printf("\nError occured in POST request: %v\n", err.Error())
-		fmt.Fprintf(w, "\nError occured in POST request: %v\n", err.Error())
+		node.logger().Error().Err(err).Str("key", key).Msg("Error occured in POST request")
+		node.writeProposalError(w, "POST", err)
 	}
 }
 
 // Handle GET requests
 func (node *RaftNode) GetHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nGET request received\n")
+	node.logger().Info().Msg("GET request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusOK)
-
 	// TODO: Make sure all committed entries are applied before responding to it.
 
 	node.GetRLock("Raft Server GET Handler")
+
+	mode, staleness := node.readMode(r)
+
+	if mode == readForward {
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Raft Server GET Handler")
+		node.forwardToLeader(w, r, leader)
+		return
+	}
+
 	defer node.ReleaseRLock("Raft Server GET Handler")
 
-	if node.state != Leader {
-		fmt.Fprintf(w, "\nError: Not a leader.\n")
-		fmt.Fprintf(w, "\nLast known leader's address: "+node.Meta.leaderAddress+"\n") //sends leader address if its not the leader
+	if mode == readRefused {
+		writeNotLeader(w, node.Meta.leaderAddress)
 		return
 	}
 
+	setStaleness(w, staleness)
+
 	params := mux.Vars(r)
 	key := params["key"]
 
-	if response, err := node.ReadCommand(key); err == nil {
+	// Reads at a specific revision are served from the store's history.
+	if rev := r.FormValue("rev"); rev != "" {
+		key += "?rev=" + url.QueryEscape(rev)
+	}
+
+	read := node.readFromStore
+	if mode == readLocal {
+		read = node.readLocally
+	}
 
-		prnt_str := "\nRead operation completed. Result: " + response + "\n"
-		fmt.Fprintf(w, prnt_str)
+	response, status, err := read(key)
 
-	} else {
+	switch {
 
-		fmt.Fprintf(w, "\nRead failed with error: %v\n", err)
+	case err != nil:
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+
+	// A missing key (404), an invalid revision (400) or a compacted one (410), see kv_store.
+	case status != http.StatusOK:
+		writeError(w, status, "Error: %v", response)
+
+	default:
+		w.WriteHeader(http.StatusOK)
+		prnt_str := "\nRead operation completed. Result: " + response + "\n"
+		fmt.Fprintf(w, prnt_str)
 
 	}
 
@@ -101,24 +175,25 @@ func (node *RaftNode) GetHandler(w http.ResponseWriter, r *http.Request) {
 // Handle PUT requests
 func (node *RaftNode) PutHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nPUT request received\n")
+	node.logger().Info().Msg("PUT request received")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Connection", "close")
 
-	w.WriteHeader(http.StatusAccepted)
-
 	if err := r.ParseForm(); err != nil {
-		fmt.Fprintf(w, "ParseForm() err: %v", err)
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
 		return
 	}
 
-	node.GetRLock("Raft Server PUT Handler")
+	session, sequence, err := requestSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
 
-	if node.state != Leader {
-		fmt.Fprintf(w, "\nError: Not a leader.\n")
-		fmt.Fprintf(w, "\nLast known leader's address: "+node.Meta.leaderAddress+"\n")
-		node.ReleaseRLock("Raft Server PUT Handler")
+	async, err := asyncRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
 		return
 	}
 
@@ -127,18 +202,38 @@ func (node *RaftNode) PutHandler(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	key := params["key"]
 
+	if !node.validRequestKey(w, r, key, validateWrittenKey) {
+		return
+	}
+
+	node.GetRLock("Raft Server PUT Handler")
+
+	if node.state != Leader {
+		node.rejectRequest(rejectNotLeader, r, errNotLeader)
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Raft Server PUT Handler")
+		writeNotLeader(w, leader)
+		return
+	}
+
 	operation := make([]string, 3)
 	operation[0] = "PUT"
 	operation[1] = key
 	operation[2] = value
 
-	success, err := node.WriteCommand(operation, client)
-	if success { // Mutex will be unlocked in WriteCommand
-		log.Printf("\nPUT request completed successfully and committed.\n")
+	if async { // Mutex will be unlocked in asyncWriteHandler
+		node.asyncWriteHandler(w, r, http.StatusAccepted, operation, client, session, sequence)
+		return
+	}
+
+	_, success, err := node.proposeSessionCommand(r.Context(), operation, client, session, sequence)
+	if success { // Mutex will be unlocked in proposeSessionCommand
+		node.logger().Info().Str("key", key).Msg("PUT request completed successfully and committed")
+		w.WriteHeader(http.StatusAccepted)
 		fmt.Fprintf(w, "\nPUT request completed successfully and committed.\n")
 	} else {
-		log.Printf("\nError occured in PUT request: %v\n", err.Error())
-		fmt.Fprintf(w, "\nError occured in PUT request: %v\n", err.Error())
+		node.logger().Error().Err(err).Str("key", key).Msg("Error occured in PUT request")
+		node.writeProposalError(w, "PUT", err)
 	}
 
 }
@@ -146,40 +241,195 @@ func (node *RaftNode) PutHandler(w http.ResponseWriter, r *http.Request) {
 // Handles DELETE requests
 func (node *RaftNode) DeleteHandler(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("\nDELETE request received\n")
+	node.logger().Info().Msg("DELETE request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
 
 	if err := r.ParseForm(); err != nil {
-		fmt.Fprintf(w, "ParseForm() err: %v", err)
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Connection", "close")
+	session, sequence, err := requestSession(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+
+	async, err := asyncRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error: %v", err)
+		return
+	}
+
+	params := mux.Vars(r)
+	key := params["key"]
 
-	w.WriteHeader(http.StatusOK)
+	// The records stored before the names were checked can still be deleted, see validation.go
+	if !node.validRequestKey(w, r, key, validateKey) {
+		return
+	}
 
 	node.GetRLock("Raft Server Delete Handler")
 
 	if node.state != Leader {
-		fmt.Fprintf(w, "\nError: Not a leader.\n")
-		fmt.Fprintf(w, "\nLast known leader's address: "+node.Meta.leaderAddress+"\n") //sends leader address if its not the leader
+		node.rejectRequest(rejectNotLeader, r, errNotLeader)
+		leader := node.Meta.leaderAddress
 		node.ReleaseRLock("Raft Server Delete Handler")
+		writeNotLeader(w, leader)
 		return
 	}
 
-	params := mux.Vars(r)
-	key := params["key"]
-
 	operation := make([]string, 2)
 	operation[0] = "DELETE"
 	operation[1] = key
 
-	success, err := node.WriteCommand(operation, "")
-	if success { // Mutex will be unlocked in WriteCommand
-		log.Printf("\nDELETE requested completed successfully and committed.\n")
+	if async { // Mutex will be unlocked in asyncWriteHandler
+		node.asyncWriteHandler(w, r, http.StatusOK, operation, "", session, sequence)
+		return
+	}
+
+	_, success, err := node.proposeSessionCommand(r.Context(), operation, "", session, sequence)
+	if success { // Mutex will be unlocked in proposeSessionCommand
+		node.logger().Info().Str("key", key).Msg("DELETE requested completed successfully and committed")
+		w.WriteHeader(http.StatusOK)
 		fmt.Fprintf(w, "\nDELETE requested completed successfully and committed.\n")
 	} else {
-		log.Printf("\nError occured in DELETE request: %v\n", err.Error())
-		fmt.Fprintf(w, "\nError occured in DELETE request: %v\n", err.Error())
+		node.logger().Error().Err(err).Str("key", key).Msg("Error occured in DELETE request")
+		node.writeProposalError(w, "DELETE", err)
+	}
+}
+
+// Handle compaction requests, which discard all revisions of the store older than the given one.
+// The compaction is replicated through the log so that all replicas retain the same history.
+func (node *RaftNode) CompactHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("COMPACT request received")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	rev := r.FormValue("rev")
+	if _, err := strconv.ParseInt(rev, 10, 64); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid revision: %v", rev)
+		return
+	}
+
+	node.GetRLock("Raft Server Compact Handler")
+
+	if node.state != Leader {
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Raft Server Compact Handler")
+		writeNotLeader(w, leader)
+		return
+	}
+
+	operation := make([]string, 2)
+	operation[0] = "COMPACT"
+	operation[1] = rev
+
+	success, err := node.WriteCommand(r.Context(), operation, r.FormValue("client"))
+	if success { // Mutex will be unlocked in WriteCommand
+		node.logger().Info().Str("rev", rev).Msg("COMPACT request completed successfully and committed")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "\nCOMPACT request completed successfully and committed.\n")
+	} else {
+		node.logger().Error().Err(err).Str("rev", rev).Msg("Error occured in COMPACT request")
+		node.writeProposalError(w, "COMPACT", err)
+	}
+}
+
+// Handle range requests of the form /range?start=<key>&end=<key>&limit=<n>&token=<token>
+func (node *RaftNode) RangeHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("RANGE request received")
+
+	node.scanHandler(w, r, "range?"+r.URL.RawQuery)
+
+}
+
+// Handle prefix listing requests of the form /prefix/{prefix}?limit=<n>&token=<token>
+func (node *RaftNode) PrefixHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("PREFIX request received")
+
+	params := mux.Vars(r)
+	prefix := params["prefix"]
+
+	node.scanHandler(w, r, "prefix/"+url.PathEscape(prefix)+"?"+r.URL.RawQuery)
+
+}
+
+// Perform a linearizable read of a range or prefix query on the local key-value store,
+// and relay its (paginated) JSON response to the client, without the keys it can't read.
+func (node *RaftNode) scanHandler(w http.ResponseWriter, r *http.Request, path string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+
+	node.GetRLock("Raft Server Scan Handler")
+
+	mode, staleness := node.readMode(r)
+
+	if mode == readForward {
+		leader := node.Meta.leaderAddress
+		node.ReleaseRLock("Raft Server Scan Handler")
+		node.forwardToLeader(w, r, leader)
+		return
+	}
+
+	defer node.ReleaseRLock("Raft Server Scan Handler")
+
+	if mode == readRefused {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		return
+	}
+
+	setStaleness(w, staleness)
+
+	read := node.readFromStore
+	if mode == readLocal {
+		read = node.readLocally
+	}
+
+	response, status, err := read(path)
+
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	// An invalid request (400) or a listing at a compacted revision (410), see kv_store/range.go.
+	if status != http.StatusOK {
+		writeError(w, status, "Error: %v", response)
+		return
+	}
+
+	if allowed := node.keyFilter(r.Context(), PermissionRead); allowed != nil {
+		response = filterPage(response, allowed)
+	}
+
+	w.WriteHeader(status)
+	fmt.Fprint(w, response)
+
+}
+
+// Check the key of a request with validate, answering 400 and journaling the rejection of the write
+// if it isn't valid, see validation.go. Return whether it is.
+func (node *RaftNode) validRequestKey(w http.ResponseWriter, r *http.Request, key string, validate func(string) error) bool {
+
+	err := validate(key)
+	if err == nil {
+		return true
 	}
+
+	node.rejectRequest(rejectValidation, r, err)
+	writeError(w, http.StatusBadRequest, "Error: %v", status.Convert(err).Message())
+	return false
 }
@@ -0,0 +1,184 @@
+package raft
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Rate limits of the client HTTP API, protecting the consensus pipeline from a client flooding the
+replica. The requests of each client IP are limited to ClientRateLimit per second (-client-rate-limit,
+with bursts of ClientRateBurst), and the requests of all the clients together to GlobalRateLimit per
+second (-global-rate-limit, with bursts of GlobalRateBurst), by token buckets. The client_rate_limit,
+client_rate_burst, global_rate_limit and global_rate_burst settings override the configuration, a
+limit of 0 disabling it.
+
+The requests over a limit are answered with 429 Too Many Requests and a Retry-After header, counted
+in http_requests_rejected_total by the client_rate or global_rate reason, and the writes are journaled
+with the rate_limit reason (see rejections.go). The probes and the admin API (/admin/..., see
+httpTrafficClass in shedding.go) aren't limited, so that an operator can still reach a replica
+flooded by its clients, except for the exports and imports of the keys (see bulkTransfer), which are
+as heavy as many client requests. A request is only taken from the buckets once both of them have a
+token, so that a client over its own limit doesn't use up the capacity of the others, nor a request
+over the global limit the quota of its client.
+*/
+
+// Time after which the bucket of a client that made no request is forgotten.
+const rateLimitIdle = time.Minute
+
+// The token buckets of the client HTTP API, safe for concurrent use.
+type httpRateLimiter struct {
+	mu      sync.Mutex
+	global  rateBucket
+	clients map[string]*rateBucket
+	swept   time.Time
+}
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newHTTPRateLimiter() *httpRateLimiter {
+	return &httpRateLimiter{clients: make(map[string]*rateBucket)}
+}
+
+/*
+Refill the bucket at now, at rate per second up to burst tokens (rate if burst isn't positive). Return
+0 if a token is available, the time until one is otherwise. A rate that isn't positive doesn't limit.
+*/
+func (b *rateBucket) refill(now time.Time, rate, burst float64) time.Duration {
+
+	if rate <= 0 {
+		return 0
+	}
+
+	if burst <= 0 {
+		burst = rate
+	}
+
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	}
+
+	b.updated = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// Take the token made available by refill, if the rate limits.
+func (b *rateBucket) take(rate float64) {
+
+	if rate > 0 {
+		b.tokens--
+	}
+}
+
+// The limits of the client HTTP API, from the settings or the configuration.
+type httpRateLimits struct {
+	client, clientBurst, global, globalBurst float64
+}
+
+func (node *RaftNode) httpRateLimits() httpRateLimits {
+
+	config, settings := node.Meta.Config, node.Meta.settings
+
+	return httpRateLimits{
+		client:      float64(settings.Int64("client_rate_limit", config.ClientRateLimit)),
+		clientBurst: float64(settings.Int64("client_rate_burst", config.ClientRateBurst)),
+		global:      float64(settings.Int64("global_rate_limit", config.GlobalRateLimit)),
+		globalBurst: float64(settings.Int64("global_rate_burst", config.GlobalRateBurst)),
+	}
+}
+
+// Take a request of the client at now, returning the limit it exceeds ("" if none) and the time
+// until it may be retried.
+func (l *httpRateLimiter) allow(now time.Time, client string, limits httpRateLimits) (string, time.Duration) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.swept) > rateLimitIdle {
+
+		for c, b := range l.clients {
+			if now.Sub(b.updated) > rateLimitIdle {
+				delete(l.clients, c)
+			}
+		}
+
+		l.swept = now
+	}
+
+	b := &rateBucket{} // not kept without a limit
+
+	if limits.client > 0 {
+
+		if kept, ok := l.clients[client]; ok {
+			b = kept
+		} else {
+			l.clients[client] = b
+		}
+	}
+
+	if wait := b.refill(now, limits.client, limits.clientBurst); wait > 0 {
+		return "client_rate", wait
+	}
+
+	if wait := l.global.refill(now, limits.global, limits.globalBurst); wait > 0 {
+		return "global_rate", wait
+	}
+
+	b.take(limits.client)
+	l.global.take(limits.global)
+
+	return "", 0
+}
+
+// Whether the request exports or imports the keys, limited as the requests of the clients although in
+// the admin API, see export.go and import.go.
+func bulkTransfer(r *http.Request) bool {
+	return (r.Method == http.MethodGet && r.URL.Path == "/admin/export") || (r.Method == http.MethodPost && r.URL.Path == "/admin/import")
+}
+
+// Middleware applying the rate limits to the requests of the clients, see above.
+func (node *RaftNode) rateLimitMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		limits, class := node.httpRateLimits(), httpTrafficClass(r)
+
+		// The probes and the admin API, including the leader watches, aren't limited, but for the bulk transfers.
+		if (limits.client <= 0 && limits.global <= 0) || (class == classAdmin && !bulkTransfer(r)) || class == classWatch {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit, wait := node.Meta.rate_limits.allow(node.now(), requestHost(r), limits)
+		if limit == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		err := fmt.Errorf("too many requests, over the %v limit, retry in %v", strings.Replace(limit, "_", " ", 1), wait.Round(time.Millisecond))
+
+		node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", limit)
+		if class == classWrite {
+			node.rejectRequest(rejectRateLimit, r, err)
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "Error: %v.", err)
+
+	})
+}
@@ -0,0 +1,114 @@
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that the requests of each client IP are limited to
+ * its rate with bursts, then those of all the clients together, without the
+ * requests over the global limit using up the quota of their client, that the
+ * admin API isn't limited but for the exports and imports, and that the
+ * settings override the configuration.
+ */
+func TestRateLimits(t *testing.T) {
+
+	clock := NewManualClock(time.Unix(100, 0))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig(), clock: clock, rate_limits: newHTTPRateLimiter()}}
+	node.Meta.Config.ClientRateLimit, node.Meta.Config.ClientRateBurst = 2, 3
+
+	handler := node.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(method, path, client string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = client + ":1234"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := send("GET", "/a", "10.0.0.1"); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %v of the burst to be served, got %v", i, w.Code)
+		}
+	}
+
+	w := send("PUT", "/a", "10.0.0.1")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected the request over the burst to be rejected with 429, got %v %v", w.Code, w.Header())
+	}
+
+	if node.Meta.metrics.Get("http_requests_rejected_total", "reason", "client_rate") != 1 || len(node.Meta.rejections.List(rejectRateLimit, "", 0)) != 1 {
+		t.Errorf("Expected the rejected write to be counted and journaled")
+	}
+
+	if w := send("GET", "/a", "10.0.0.2"); w.Code != http.StatusOK {
+		t.Errorf("Expected another client to be served, got %v", w.Code)
+	}
+
+	if w := send("GET", "/admin/status", "10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected the admin API not to be limited, got %v", w.Code)
+	}
+
+	if w := send("GET", "/admin/export", "10.0.0.1"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the exports to be limited, got %v", w.Code)
+	}
+
+	// The bucket is refilled at the rate.
+	clock.Advance(500 * time.Millisecond)
+
+	if w := send("GET", "/a", "10.0.0.1"); w.Code != http.StatusOK {
+		t.Errorf("Expected the client to be served once refilled, got %v", w.Code)
+	}
+
+	// The global limit applies to all the clients together.
+	node.Meta.settings.apply(SettingChange{Name: "client_rate_limit", Action: "SET", Value: "0"})
+	node.Meta.settings.apply(SettingChange{Name: "global_rate_limit", Action: "SET", Value: "1"})
+
+	if w := send("GET", "/a", "10.0.0.3"); w.Code != http.StatusOK {
+		t.Errorf("Expected the first request to be served, got %v", w.Code)
+	}
+
+	if w := send("GET", "/a", "10.0.0.4"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the global limit to apply to another client, got %v", w.Code)
+	}
+
+	// The requests rejected by the global limit don't use up the quota of their client.
+	node.Meta.settings.apply(SettingChange{Name: "client_rate_limit", Action: "SET", Value: "2"})
+
+	for i := 0; i < 5; i++ {
+		if w := send("GET", "/a", "10.0.0.6"); w.Code != http.StatusTooManyRequests || node.Meta.metrics.Get("http_requests_rejected_total", "reason", "global_rate") != float64(2+i) {
+			t.Fatalf("Expected request %v to be rejected by the global limit, got %v", i, w.Code)
+		}
+	}
+
+	node.Meta.settings.apply(SettingChange{Name: "global_rate_limit", Action: "UNSET"})
+
+	for i := 0; i < 3; i++ {
+		if w := send("GET", "/a", "10.0.0.6"); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %v of the burst of the client to be served, got %v", i, w.Code)
+		}
+	}
+
+	node.Meta.settings.apply(SettingChange{Name: "client_rate_limit", Action: "SET", Value: "0"})
+
+	node.Meta.settings.apply(SettingChange{Name: "global_rate_limit", Action: "UNSET"})
+
+	for i := 0; i < 10; i++ {
+		if w := send("GET", "/a", "10.0.0.4"); w.Code != http.StatusOK {
+			t.Fatalf("Expected the requests to be served without limits, got %v", w.Code)
+		}
+	}
+
+	// The buckets of the idle clients are forgotten.
+	clock.Advance(2 * rateLimitIdle)
+	node.Meta.rate_limits.allow(clock.Now(), "10.0.0.5", httpRateLimits{client: 1})
+
+	if len(node.Meta.rate_limits.clients) != 1 {
+		t.Errorf("Expected the idle buckets to be forgotten, got %v", len(node.Meta.rate_limits.clients))
+	}
+}
@@ -0,0 +1,55 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+Read-only mode of the cluster, e.g. during a migration or before a backup, enabled by the read_only
+setting (raftctl read-only on, or PUT /admin/settings/read_only with value=true). As the settings,
+it is changed through the log, so that every replica agrees on the writes it rejects.
+
+While it is enabled, the leader rejects the writes of the clients (POST, PUT, DELETE, DELETE_PREFIX
+and the transactions, including the DNS updates and the imports) with errReadOnly, counted in
+proposals_rejected_total by the read_only reason, and the reads are served as usual. The admin
+operations (the settings, members, users, roles, TSIG keys, webhooks, alarms and compactions) are
+still accepted, as are the transactions of the replicas only writing reserved keys, so that the
+leader jobs (e.g. the scheduled backups) keep running.
+*/
+
+var errReadOnly = errors.New("the cluster is in read-only mode (see the read_only setting), writes are rejected until an admin disables it")
+
+// Whether the cluster is in read-only mode.
+func (node *RaftNode) readOnly() bool {
+	return node.Meta.settings.Bool("read_only", false)
+}
+
+// Return errReadOnly if the operation is a write of a client while the cluster is in read-only
+// mode.
+func (node *RaftNode) checkReadOnly(operation []string) error {
+
+	if !clientWrite(operation) || !node.readOnly() {
+		return nil
+	}
+
+	if operation[0] == "TXN" {
+
+		var txn kv_store.Txn
+		if err := json.Unmarshal([]byte(operation[1]), &txn); err != nil {
+			return errReadOnly
+		}
+
+		for _, op := range append(append([]kv_store.Op{}, txn.Success...), txn.Failure...) {
+			if !reservedKey(op.Key) {
+				return errReadOnly
+			}
+		}
+
+		return nil
+	}
+
+	return errReadOnly
+}
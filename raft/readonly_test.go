@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * This test case checks that while the cluster is read-only, the writes of the
+ * clients are rejected, unlike the admin operations and the transactions of
+ * the replicas only writing reserved keys.
+ */
+func TestReadOnly(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), alarms: NewAlarms()}}
+	node.state = Leader
+
+	encode := func(ops ...kv_store.Op) string {
+		encoded, _ := json.Marshal(kv_store.Txn{Success: ops})
+		return string(encoded)
+	}
+
+	operations := []struct {
+		operation []string
+		rejected  bool
+	}{
+		{[]string{"POST", "a", "1"}, true},
+		{[]string{"PUT", "a", "2"}, true},
+		{[]string{"DELETE", "a"}, true},
+		{[]string{"DELETE_PREFIX", "a"}, true},
+		{[]string{"TXN", encode(kv_store.Op{Type: kv_store.OpDelete, Key: "a"})}, true},
+		{[]string{"TXN", encode(kv_store.Op{Type: kv_store.OpPut, Key: BackupScheduleKey, Value: "1"}, kv_store.Op{Type: kv_store.OpPut, Key: "b", Value: "1"})}, true},
+		{[]string{"TXN", encode(kv_store.Op{Type: kv_store.OpPut, Key: BackupScheduleKey, Value: "1"})}, false},
+		{[]string{"SETTING", "SET", "read_only", "false"}, false},
+		{[]string{"COMPACT", "10"}, false},
+	}
+
+	for _, o := range operations {
+		if err := node.checkReadOnly(o.operation); err != nil {
+			t.Errorf("Expected %v to be accepted by default, got %v", o.operation, err)
+		}
+	}
+
+	node.Meta.settings.apply(SettingChange{Name: "read_only", Action: "SET", Value: "true"})
+
+	if !node.readOnly() {
+		t.Fatal("Expected the cluster to be read-only")
+	}
+
+	for _, o := range operations {
+		if err := node.checkReadOnly(o.operation); (err == errReadOnly) != o.rejected {
+			t.Errorf("Unexpected outcome of %v while the cluster is read-only: %v", o.operation, err)
+		}
+	}
+
+	// The KVService rejects the writes with FailedPrecondition, journaling them.
+	put := kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: "a", Value: "1"}}}
+	if _, err := node.replicateTxn(context.Background(), put, "c", 0, 0); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Expected the write to be rejected with FailedPrecondition, got %v", err)
+	}
+
+	if rejections := node.Meta.rejections.List(rejectReadOnly, "", 0); len(rejections) != 1 || rejections[0].Client != "c" {
+		t.Errorf("Expected the write to be journaled, got %+v", rejections)
+	}
+
+	node.Meta.settings.apply(SettingChange{Name: "read_only", Action: "UNSET"})
+
+	if node.checkReadOnly([]string{"POST", "a", "1"}) != nil {
+		t.Errorf("Expected the writes to be accepted once the read-only mode is disabled")
+	}
+}
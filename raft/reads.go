@@ -0,0 +1,117 @@
+package raft
+
+import (
+	"sync"
+)
+
+/*
+Coalescing of linearizable reads. Before serving a read, the leader confirms that it is still the
+leader by exchanging heartbeats with a majority of the replicas (see readFromStore). Rather than
+sending a round of heartbeats for every read, the reads arriving concurrently wait for a single
+round, and identical reads (of the same path) made after that round share a single request to the
+key-value store.
+
+A read may only rely on a round started after it arrived, so the reads arriving while a round is
+in flight wait for the next one, which is started as soon as the current one completes.
+*/
+
+// A round of leadership confirmation, shared by the reads waiting for it.
+type readRound struct {
+	done chan struct{} // Closed once the round completes
+	ok   bool          // Whether the leadership was confirmed, set before done is closed
+
+	mu      sync.Mutex
+	results map[string]*readResult // Reads made after the round, by path
+}
+
+// The outcome of a read of the key-value store, shared by the identical reads of a round.
+type readResult struct {
+	once     sync.Once
+	contents string
+	status   int
+	err      error
+}
+
+func newReadRound() *readRound {
+	return &readRound{done: make(chan struct{}), results: make(map[string]*readResult)}
+}
+
+// Perform the read of the given path with fetch, unless an identical read of the round already did.
+func (round *readRound) read(path string, fetch func(path string) (string, int, error)) (string, int, error) {
+
+	round.mu.Lock()
+	result, ok := round.results[path]
+	if !ok {
+		result = &readResult{}
+		round.results[path] = result
+	}
+	round.mu.Unlock()
+
+	result.once.Do(func() {
+		result.contents, result.status, result.err = fetch(path)
+	})
+
+	return result.contents, result.status, result.err
+}
+
+// Coalesces the rounds of leadership confirmation of concurrent reads.
+type readCoalescer struct {
+	confirm func() bool // Performs a round of leadership confirmation
+
+	mu       sync.Mutex
+	inflight bool       // Whether a round is in progress
+	next     *readRound // The round the reads arriving now wait for, started after the one in progress
+}
+
+func newReadCoalescer(confirm func() bool) *readCoalescer {
+	return &readCoalescer{confirm: confirm}
+}
+
+// Wait for a round of leadership confirmation started after the call, and return it.
+func (c *readCoalescer) wait() *readRound {
+
+	c.mu.Lock()
+
+	if c.next == nil {
+		c.next = newReadRound()
+	}
+	round := c.next
+
+	start := !c.inflight
+	if start {
+		c.inflight = true
+		c.next = nil
+	}
+
+	c.mu.Unlock()
+
+	if start {
+		go c.run(round)
+	}
+
+	<-round.done
+	return round
+}
+
+// Perform the given round, then the rounds requested while it was in progress.
+func (c *readCoalescer) run(round *readRound) {
+
+	for {
+
+		round.ok = c.confirm()
+		close(round.done)
+
+		c.mu.Lock()
+
+		if c.next == nil {
+			c.inflight = false
+			c.mu.Unlock()
+			return
+		}
+
+		round = c.next
+		c.next = nil
+
+		c.mu.Unlock()
+	}
+}
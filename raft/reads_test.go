@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that concurrent reads wait for a shared round of
+ * leadership confirmation, that reads arriving during a round wait for the
+ * next one, and that identical reads of a round share a single fetch.
+ */
+func TestReadCoalescing(t *testing.T) {
+
+	var rounds int32
+	release := make(chan bool)
+
+	c := newReadCoalescer(func() bool {
+		atomic.AddInt32(&rounds, 1)
+		return <-release
+	})
+
+	// The first read starts a round right away.
+	first := make(chan *readRound)
+	go func() { first <- c.wait() }()
+
+	for atomic.LoadInt32(&rounds) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Reads arriving while it is in progress wait for the next round.
+	var wg sync.WaitGroup
+	waiting := make([]*readRound, 20)
+
+	for i := range waiting {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			waiting[i] = c.wait()
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	release <- true
+
+	if round := <-first; !round.ok {
+		t.Fatalf("First round was not confirmed")
+	}
+
+	release <- true
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&rounds); n != 2 {
+		t.Fatalf("Expected 2 rounds for 21 reads, got %v", n)
+	}
+
+	var fetches int32
+	fetch := func(path string) (string, int, error) {
+		atomic.AddInt32(&fetches, 1)
+		return "value of " + path, 200, nil
+	}
+
+	for _, round := range waiting {
+
+		if round != waiting[0] || !round.ok {
+			t.Fatalf("Reads waiting for the same round got different rounds")
+		}
+
+		if contents, _, _ := round.read("a", fetch); contents != "value of a" {
+			t.Errorf("Unexpected contents %q", contents)
+		}
+	}
+
+	waiting[0].read("b", fetch)
+
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Expected 2 fetches for 2 distinct paths, got %v", n)
+	}
+
+	// A failed round isn't reused by later reads.
+	go func() { release <- false }()
+	if round := c.wait(); round.ok {
+		t.Errorf("Expected the leadership not to be confirmed")
+	}
+}
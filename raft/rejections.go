@@ -0,0 +1,161 @@
+package raft
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+Journal of the proposals recently rejected by the replica, so that a client wondering why its write
+didn't take effect can find out from GET /admin/rejections (or raftctl rejections). Each rejection
+is recorded with one of the reason codes below:
+
+	not_leader    the replica isn't the leader, or leadership is being handed over
+	validation    the write is malformed, targets a reserved key, or a key missing for PUT and DELETE
+	acl           the caller isn't authenticated, or lacks the permission for the key
+	quota         the request was shed under overload, or its body exceeds the size limit
+	duplicate     the write repeats the previous write of the same client
+	session       the client session is unknown, or the sequence number is stale (see sessions.go)
+	federation    the key belongs to a zone homed on, or delegated to, another cluster (see federation.go and delegation.go)
+	shard         the key belongs to another group, or its zone is moving (see shards.go)
+	alarm         the write adds data while an alarm is raised (see alarms.go)
+	read_only     the write of a client was made while the cluster is read-only (see readonly.go)
+	backpressure  the leader has too many writes pending, or its followers lag too far behind (see admission.go)
+	rate_limit    the client, or all the clients together, sent more requests than the rate limits allow (see ratelimit.go)
+	config        a membership change was made while another one is in progress, or no longer suits the configuration (see membership.go)
+
+The journal is kept in memory by each replica, and only holds the last maxRejections entries:
+rejections by a follower (e.g. not_leader) are found on that follower. The rejections are also
+counted in proposals_rejected_total, by reason.
+*/
+
+const (
+	rejectNotLeader    = "not_leader"
+	rejectValidation   = "validation"
+	rejectACL          = "acl"
+	rejectQuota        = "quota"
+	rejectDuplicate    = "duplicate"
+	rejectSession      = "session"
+	rejectFederation   = "federation"
+	rejectShard        = "shard"
+	rejectAlarm        = "alarm"
+	rejectReadOnly     = "read_only"
+	rejectBackpressure = "backpressure"
+	rejectRateLimit    = "rate_limit"
+	rejectConfig       = "config"
+
+	maxRejections = 256
+)
+
+// A rejected proposal, as listed by /admin/rejections.
+type Rejection struct {
+	Time      time.Time `json:"time"`
+	Reason    string    `json:"reason"`
+	Operation string    `json:"operation"` // e.g. POST, TXN, or the gRPC method for requests rejected upfront
+	Key       string    `json:"key,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Error     string    `json:"error"`
+}
+
+// The last maxRejections rejections, safe for concurrent use.
+type Rejections struct {
+	mu      sync.Mutex
+	entries []Rejection // Ring buffer, next being the oldest entry once full
+	next    int
+}
+
+func NewRejections() *Rejections {
+	return &Rejections{entries: make([]Rejection, 0, maxRejections)}
+}
+
+func (r *Rejections) add(rejection Rejection) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) < maxRejections {
+		r.entries = append(r.entries, rejection)
+		return
+	}
+
+	r.entries[r.next] = rejection
+	r.next = (r.next + 1) % maxRejections
+}
+
+// Return the rejections with the given reason and key (any if empty), newest first, at most limit
+// of them if positive.
+func (r *Rejections) List(reason, key string, limit int) []Rejection {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]Rejection, 0)
+
+	for i := len(r.entries) - 1; i >= 0 && (limit <= 0 || len(list) < limit); i-- {
+
+		rejection := r.entries[(r.next+i)%len(r.entries)]
+
+		if (reason == "" || rejection.Reason == reason) && (key == "" || rejection.Key == key) {
+			list = append(list, rejection)
+		}
+	}
+
+	return list
+}
+
+// Record a rejected request in the journal, returning err.
+func (node *RaftNode) reject(reason, operation, key, client string, err error) error {
+
+	node.Meta.rejections.add(Rejection{
+		Time:      node.now(),
+		Reason:    reason,
+		Operation: operation,
+		Key:       key,
+		Client:    client,
+		Error:     err.Error(),
+	})
+
+	node.Meta.metrics.Add("proposals_rejected_total", 1, "reason", reason)
+	node.logger().Debug().Str("reason", reason).Str("operation", operation).Str("key", key).Err(err).Msg("Rejected proposal")
+
+	return err
+}
+
+// Record a rejected log entry proposal, see proposeSessionCommand.
+func (node *RaftNode) rejectProposal(reason string, operation []string, client string, err error) error {
+
+	key := ""
+	if len(operation) > 1 && (operation[0] == "POST" || operation[0] == "PUT" || operation[0] == "DELETE" || operation[0] == "DELETE_PREFIX") {
+		key = operation[1]
+	}
+
+	return node.reject(reason, operation[0], key, client, err)
+}
+
+// Record a rejected write request to the client HTTP server, before its entry is proposed. The
+// client is only known if the form of the request was already parsed.
+func (node *RaftNode) rejectRequest(reason string, r *http.Request, err error) error {
+	return node.reject(reason, r.Method, mux.Vars(r)["key"], r.Form.Get("client"), err)
+}
+
+// Handle requests listing the recent rejections of this replica, filtered by the reason and key
+// parameters, with at most limit of them.
+func (node *RaftNode) RejectionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	limit := 0
+
+	if s := r.FormValue("limit"); s != "" {
+
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid limit %q", s)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, node.Meta.rejections.List(r.FormValue("reason"), r.FormValue("key"), limit))
+}
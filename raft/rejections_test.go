@@ -0,0 +1,79 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+ * This test case checks that the rejected proposals are journaled with their
+ * reason, listed newest first and filtered by reason and key, that only the
+ * last maxRejections of them are kept, and that a follower records the writes
+ * it turns away.
+ */
+func TestRejections(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), rejections: NewRejections()}}
+
+	node.rejectProposal(rejectValidation, []string{"PUT", "a", "1"}, "c1", errors.New("no value exists"))
+	node.rejectProposal(rejectNotLeader, []string{"TXN", "{}"}, "c2", errNotLeader)
+
+	if err := node.rejectProposal(rejectDuplicate, []string{"POST", "b", "2"}, "c1", errDuplicateWrite); err != errDuplicateWrite {
+		t.Errorf("Expected the error to be returned, got %v", err)
+	}
+
+	list := node.Meta.rejections.List("", "", 0)
+	if len(list) != 3 || list[0].Reason != rejectDuplicate || list[2].Key != "a" || list[1].Key != "" || list[1].Operation != "TXN" {
+		t.Fatalf("Unexpected rejections: %+v", list)
+	}
+
+	if list := node.Meta.rejections.List(rejectValidation, "", 0); len(list) != 1 || list[0].Client != "c1" {
+		t.Errorf("Expected a single validation rejection, got %+v", list)
+	}
+
+	if list := node.Meta.rejections.List("", "b", 0); len(list) != 1 || list[0].Reason != rejectDuplicate {
+		t.Errorf("Expected a single rejection of key b, got %+v", list)
+	}
+
+	if got := node.Meta.metrics.Get("proposals_rejected_total", "reason", rejectNotLeader); got != 1 {
+		t.Errorf("Expected 1 not_leader rejection to be counted, got %v", got)
+	}
+
+	for i := 0; i < maxRejections+10; i++ {
+		node.reject(rejectQuota, "POST", fmt.Sprint(i), "", errors.New("overloaded"))
+	}
+
+	list = node.Meta.rejections.List("", "", 0)
+	if len(list) != maxRejections || list[0].Key != fmt.Sprint(maxRejections+9) || list[maxRejections-1].Key != "10" {
+		t.Errorf("Expected the last %v rejections to be kept, got %v from %v to %v", maxRejections, len(list), list[0].Key, list[len(list)-1].Key)
+	}
+
+	if list := node.Meta.rejections.List(rejectQuota, "", 5); len(list) != 5 {
+		t.Errorf("Expected the limit to be applied, got %v rejections", len(list))
+	}
+
+	// A follower journals the writes sent to it.
+	follower := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), rejections: NewRejections()}, state: Follower}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/{key}", follower.PostHandler).Methods("POST")
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/key?client=c3", nil))
+
+	w := httptest.NewRecorder()
+	follower.RejectionsHandler(w, httptest.NewRequest("GET", "/admin/rejections?reason=not_leader", nil))
+
+	var rejections []Rejection
+	if err := json.Unmarshal(w.Body.Bytes(), &rejections); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Unable to list the rejections: %v %v", w.Code, err)
+	}
+
+	if len(rejections) != 1 || rejections[0].Operation != "POST" || rejections[0].Key != "key" || rejections[0].Client != "c3" {
+		t.Errorf("Expected the write to the follower to be journaled, got %+v", rejections)
+	}
+}
@@ -0,0 +1,198 @@
+package raft
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Point-in-time recovery, to undo bad writes (e.g. the bulk deletion of a zone). Unless its log was
+compacted (see compaction.go), the raft state file of a replica ("300<id>") holds every entry since
+the cluster was created, or restored: ReplayLog applies its committed entries, up to a given index or
+time, to a fresh key-value store, and saves the result as a snapshot. raftctl replay does so offline,
+and the replicas of a brand-new cluster are then started from the snapshot with -restore <snapshot>.
+
+Each entry carries the time the leader appended it at. Entries appended before the timestamps were
+added have none, and are replayed whatever the time given. The log of a cluster restored from a
+snapshot starts after it: the same snapshot has to be given as the base of the replay.
+*/
+
+// The last entry replayed by ReplayLog.
+type ReplayTarget struct {
+	Index int32     // Index of the last entry to replay, or -1 for the last committed one
+	Time  time.Time // If not zero, the entries appended after this time aren't replayed
+}
+
+// The outcome of a replay.
+type ReplayResult struct {
+	SnapshotDigest           // Index and term of the last entry replayed, and the digest of the store
+	Time           time.Time `json:"time"` // Time the last entry replayed was appended at, if known
+}
+
+// Read the log and the sessions base persisted in the raft state file of a replica. Unlike
+// RestoreFromStorage, a missing or invalid file is reported rather than fatal. A compacted log is
+// refused, its first entries being no longer known.
+func readPersistedLog(path string) ([]protos.LogEntry, int32, int64, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	storage := NewStorage() // registers the types of the state
+
+	if err := gob.NewDecoder(file).Decode(&storage.m); err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid raft state file %v: %v", path, err)
+	}
+
+	log, ok := storage.m["log"].([]protos.LogEntry)
+	if !ok {
+		return nil, 0, 0, fmt.Errorf("invalid raft state file %v: the log is missing", path)
+	}
+
+	if start, _ := storage.m["logStart"].(int32); start > 0 {
+		return nil, 0, 0, fmt.Errorf("the log of %v starts at entry %v, the previous ones were compacted", path, start)
+	}
+
+	commitIndex, _ := storage.m["commitIndex"].(int32)
+	base, _ := storage.m["sessionBase"].(int64) // only set in clusters restored from a snapshot
+
+	return log, commitIndex, base, nil
+}
+
+/*
+Replay the committed entries of the log persisted in the raft state file, up to the target, onto the
+snapshot of the base file if not empty (a snapshot or a backup, see RestoreSnapshot), or an empty
+store otherwise. The resulting store and client sessions are written as a snapshot to the given file.
+*/
+func ReplayLog(raftFile, baseFile string, target ReplayTarget, snapshotFile string) (ReplayResult, error) {
+
+	var result ReplayResult
+
+	if _, err := os.Stat(snapshotFile); err == nil {
+		return result, fmt.Errorf("%v already exists, refusing to overwrite it", snapshotFile)
+	}
+
+	log, commitIndex, sessionBase, err := readPersistedLog(raftFile)
+	if err != nil {
+		return result, err
+	}
+
+	last := commitIndex
+	if target.Index >= 0 {
+
+		if target.Index > commitIndex {
+			return result, fmt.Errorf("entry %v isn't committed, the last committed entry is %v", target.Index, commitIndex)
+		}
+		last = target.Index
+	}
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(dir)
+
+	sessions := make(map[int64]clientSession)
+	storeFile := filepath.Join(dir, "store")
+
+	if baseFile != "" {
+
+		var store []byte
+		if store, sessions, _, _, err = readSnapshotFile(baseFile); err != nil {
+			return result, err
+		}
+
+		if err := ioutil.WriteFile(storeFile, store, 0644); err != nil {
+			return result, err
+		}
+	}
+
+	// The entries are applied to a map store, whatever the backend of the replicas (see state_machine.go).
+	sm, err := newMapStateMachine(storeFile)
+	if err != nil {
+		return result, err
+	}
+	defer sm.Close()
+
+	// The store is served over HTTP as by the replicas, for the configuration of its compression.
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return result, err
+	}
+
+	srv := &http.Server{Handler: sm.Router()}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	node := &RaftNode{
+		log:         log,
+		sessions:    sessions,
+		sessionBase: sessionBase,
+		watches:     NewWatchHub(),
+		txn_results: make(map[int32]kv_store.TxnResult),
+	}
+
+	node.Meta = &NodeMetadata{
+		kvstore_addr:  fmt.Sprintf(":%d", listener.Addr().(*net.TCPAddr).Port),
+		state_machine: sm,
+		Config:        DefaultConfig(),
+		metrics:       NewMetrics(),
+		settings:      NewSettings(),
+		users:         NewUsers(),
+		roles:         NewRoles(),
+		tsig_keys:     NewTSIGKeys(),
+		webhooks:      NewWebhooks(),
+		alarms:        NewAlarms(),
+		locks:         NewLocks(),
+		rejections:    NewRejections(),
+		clock:         defaultClock(),
+	}
+
+	// The state of the base, as loaded by Setup_raft_node.
+	node.loadTables()
+
+	result.AppliedIndex = -1
+
+	for index := int32(0); index <= last; index++ {
+
+		entry := &node.log[index]
+
+		if !target.Time.IsZero() && entry.Timestamp != 0 && time.Unix(0, entry.Timestamp).After(target.Time) {
+			break
+		}
+
+		if !node.applyEntry(index) {
+			return result, fmt.Errorf("unable to apply entry %v", index)
+		}
+
+		result.AppliedIndex, result.Term = index, entry.Term
+		if entry.Timestamp != 0 {
+			result.Time = time.Unix(0, entry.Timestamp).UTC()
+		}
+	}
+
+	// The node isn't shared, so no lock is needed to take its snapshot.
+	snapshot, digest, err := node.snapshot()
+	if err != nil {
+		return result, err
+	}
+
+	result.Revision, result.Digest = digest.Revision, digest.Digest
+
+	if err := ioutil.WriteFile(snapshotFile, snapshot.Bytes(), 0644); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
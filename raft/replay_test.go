@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the committed entries of a persisted log are
+ * replayed up to an index or a time into a snapshot, that entries which
+ * aren't committed are never replayed, and that the log of a restored
+ * cluster is replayed onto the snapshot it was restored from.
+ */
+func TestReplayLog(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Persist the given log as the raft state file of a replica, the entries being appended a second apart.
+	persist := func(name string, commitIndex int32, operations ...[]string) string {
+
+		log := make([]protos.LogEntry, 0)
+		for i, operation := range operations {
+			log = append(log, protos.LogEntry{Term: 1, Operation: operation, Clientid: " ", Timestamp: start.Add(time.Duration(i) * time.Second).UnixNano()})
+		}
+
+		storage := NewStorage()
+		storage.Set("currentTerm", int32(1))
+		storage.Set("votedFor", int32(0))
+		storage.Set("log", log)
+		storage.Set("commitIndex", commitIndex)
+		storage.Set("lastApplied", commitIndex)
+		storage.Set("sessions", map[int64]clientSession{})
+		storage.Set("sessionBase", int64(0))
+
+		path := filepath.Join(dir, name)
+		storage.WriteFile(path)
+
+		return path
+	}
+
+	// Return the values of the keys in the store of the snapshot.
+	values := func(snapshot string, keys ...string) []string {
+
+		store, _, _, _, err := readSnapshotFile(snapshot)
+		if err != nil {
+			t.Fatalf("Invalid snapshot %v: %v", snapshot, err)
+		}
+
+		path := snapshot + ".store"
+		ioutil.WriteFile(path, store, 0644)
+
+		kv, err := kv_store.OpenStore(path, kv_store.BackendMap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer kv.Close()
+
+		values := make([]string, 0)
+		for _, key := range keys {
+			values = append(values, kv.Get(key))
+		}
+
+		return values
+	}
+
+	raftFile := persist("3000", 3,
+		[]string{"NO-OP"},
+		[]string{"POST", "a", "1"},
+		[]string{"POST", "b", "2"},
+		[]string{"DELETE", "a"},    // the bad write
+		[]string{"POST", "c", "3"}, // not committed
+	)
+
+	for _, test := range []struct {
+		target ReplayTarget
+		last   int32
+		values []string
+	}{
+		{ReplayTarget{Index: -1}, 3, []string{"Invalid", "2", "Invalid"}},
+		{ReplayTarget{Index: 2}, 2, []string{"1", "2", "Invalid"}},
+		{ReplayTarget{Index: -1, Time: start.Add(2500 * time.Millisecond)}, 2, []string{"1", "2", "Invalid"}},
+		{ReplayTarget{Index: 2, Time: start.Add(time.Second)}, 1, []string{"1", "Invalid", "Invalid"}},
+	} {
+
+		snapshot := filepath.Join(dir, "snapshot")
+		os.Remove(snapshot)
+
+		result, err := ReplayLog(raftFile, "", test.target, snapshot)
+		if err != nil {
+			t.Fatalf("Unable to replay the log up to %+v: %v", test.target, err)
+		}
+
+		if result.AppliedIndex != test.last || result.Term != 1 || !result.Time.Equal(start.Add(time.Duration(test.last)*time.Second)) {
+			t.Errorf("Expected the log replayed up to %+v to stop at entry %v, got %+v", test.target, test.last, result)
+		}
+
+		if got := values(snapshot, "a", "b", "c"); got[0] != test.values[0] || got[1] != test.values[1] || got[2] != test.values[2] {
+			t.Errorf("Expected the values %v once replayed up to %+v, got %v", test.values, test.target, got)
+		}
+	}
+
+	if _, err := ReplayLog(raftFile, "", ReplayTarget{Index: 4}, filepath.Join(dir, "uncommitted")); err == nil {
+		t.Errorf("Expected an entry that isn't committed not to be replayed")
+	}
+
+	if _, err := ReplayLog(raftFile, "", ReplayTarget{Index: -1}, filepath.Join(dir, "snapshot")); err == nil {
+		t.Errorf("Expected an existing snapshot not to be overwritten")
+	}
+
+	// A cluster restored from the snapshot of entry 1 logs its writes from scratch.
+	base := filepath.Join(dir, "base")
+	if _, err := ReplayLog(raftFile, "", ReplayTarget{Index: 1}, base); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := persist("3001", 1, []string{"NO-OP"}, []string{"POST", "d", "4"})
+
+	snapshot := filepath.Join(dir, "restored")
+	if _, err := ReplayLog(restored, base, ReplayTarget{Index: -1}, snapshot); err != nil {
+		t.Fatalf("Unable to replay the log onto its base: %v", err)
+	}
+
+	if got := values(snapshot, "a", "d"); got[0] != "1" || got[1] != "4" {
+		t.Errorf("Expected the log replayed onto the keys of its base, got %v", got)
+	}
+}
@@ -0,0 +1,207 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Resource usage of a replica, reported in its /admin/status and refreshed every
+resourceCheckInterval in the resource_usage_bytes gauges (by resource) and resource_goroutines, along
+with the store_compression_ratio of the compressed values (by prefix, see compression.go):
+
+	log     the entries of the in-memory log
+	cache   the client sessions, the outcomes of transactions awaited by clients and the last
+	        write of every client (kept to reject duplicates)
+	store   the keys, values and history of the key-value store
+	memory  the total of the above
+	heap    the heap of the process, as reported by the Go runtime
+	disk    the files persisted by the replica
+
+Memory and disk are checked against MaxMemoryBytes and MaxDiskBytes (or the max_memory_bytes and
+max_disk_bytes settings): past resourceWatermark of a limit the replica logs a warning and sets
+resource_watermark_exceeded, and past the limit itself the leader raises an alarm blocking the
+writes, see alarms.go. The sizes are estimates of the data held, not of the memory allocated for it.
+*/
+
+const (
+	resourceCheckInterval = 5 * time.Second
+	resourceWatermark     = 0.8 // Fraction of a limit past which the replica warns
+	sessionOverhead       = 32  // Estimated size of the bookkeeping of a client session
+)
+
+// Response of the /admin/status endpoint describing the usage of the replica.
+type ResourceUsage struct {
+	LogBytes    int64 `json:"log_bytes"`
+	CacheBytes  int64 `json:"cache_bytes"`
+	StoreBytes  int64 `json:"store_bytes"`
+	StoreKeys   int   `json:"store_keys"`
+	MemoryBytes int64 `json:"memory_bytes"` // Log, cache and store
+	HeapBytes   int64 `json:"heap_bytes"`
+	DiskBytes   int64 `json:"disk_bytes"`
+	Goroutines  int   `json:"goroutines"`
+
+	Compression []kv_store.CompressionStats `json:"compression,omitempty"` // Compressed values of the store, see compression.go
+}
+
+// Estimated size of the outcome of a transaction.
+func txnResultBytes(result kv_store.TxnResult) int64 {
+
+	size := int64(0)
+	for _, event := range result.Events {
+		size += int64(len(event.Type) + len(event.Key) + len(event.Value))
+	}
+
+	return size
+}
+
+// The files persisted by the replica: the state of the Raft node and the key-value store.
+func (node *RaftNode) persistedFiles() []string {
+	kv_file := node.Meta.Config.Layout.StoreFile(int(node.Meta.replica_id))
+	return []string{node.Meta.raft_persistence_file, kv_file, kv_file + ".db"} // the database of the bolt backend, if any
+}
+
+// Measure the resources used by the replica. Must be called without the lock held.
+func (node *RaftNode) resourceUsage() ResourceUsage {
+
+	store, _ := node.storeUsage()
+	return node.resourceUsageOf(store)
+}
+
+// Measure the resources used by the replica, given the usage of its key-value store.
+func (node *RaftNode) resourceUsageOf(store kv_store.Usage) ResourceUsage {
+
+	var usage ResourceUsage
+
+	node.GetRLock("Resource Usage")
+
+	for i := range node.log {
+		usage.LogBytes += int64(proto.Size(&node.log[i]))
+	}
+
+	for _, session := range node.sessions {
+		usage.CacheBytes += sessionOverhead + txnResultBytes(session.Result)
+	}
+
+	for _, result := range node.txn_results {
+		usage.CacheBytes += txnResultBytes(result)
+	}
+
+	for client, operation := range node.trackMessage {
+		usage.CacheBytes += int64(len(client))
+		for _, s := range operation {
+			usage.CacheBytes += int64(len(s))
+		}
+	}
+
+	node.ReleaseRLock("Resource Usage")
+
+	usage.StoreBytes, usage.StoreKeys, usage.Compression = store.Bytes+store.HistoryBytes, store.Keys, store.Compression
+
+	usage.MemoryBytes = usage.LogBytes + usage.CacheBytes + usage.StoreBytes
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	usage.HeapBytes = int64(stats.HeapAlloc)
+
+	for _, file := range node.persistedFiles() {
+		if info, err := os.Stat(file); err == nil {
+			usage.DiskBytes += info.Size()
+		}
+	}
+
+	usage.Goroutines = runtime.NumGoroutine()
+
+	return usage
+}
+
+// Return the usage of the local key-value store, and whether it responded.
+func (node *RaftNode) storeUsage() (kv_store.Usage, bool) {
+
+	var store kv_store.Usage
+
+	contents, code, err := node.fetchFromStore("admin/usage")
+	if err != nil || code != http.StatusOK {
+		return store, false
+	}
+
+	if err := json.Unmarshal([]byte(contents), &store); err != nil {
+		return store, false
+	}
+
+	return store, true
+}
+
+// The limits on the memory and disk usage of a replica, 0 if unlimited.
+func (node *RaftNode) resourceLimits() (memory, disk int64) {
+	return node.Meta.settings.Int64("max_memory_bytes", node.Meta.Config.MaxMemoryBytes), node.Meta.settings.Int64("max_disk_bytes", node.Meta.Config.MaxDiskBytes)
+}
+
+// Measure the resources used by the replica, and update their gauges.
+func (node *RaftNode) recordResourceUsage() ResourceUsage {
+
+	usage := node.resourceUsage()
+
+	for resource, bytes := range map[string]int64{
+		"log":    usage.LogBytes,
+		"cache":  usage.CacheBytes,
+		"store":  usage.StoreBytes,
+		"memory": usage.MemoryBytes,
+		"heap":   usage.HeapBytes,
+		"disk":   usage.DiskBytes,
+	} {
+		node.Meta.metrics.Set("resource_usage_bytes", float64(bytes), "resource", resource)
+	}
+
+	node.Meta.metrics.Set("resource_goroutines", float64(usage.Goroutines))
+
+	for _, c := range usage.Compression {
+		if c.StoredBytes > 0 {
+			node.Meta.metrics.Set("store_compression_ratio", float64(c.RawBytes)/float64(c.StoredBytes), "prefix", c.Prefix)
+		}
+	}
+
+	memory, disk := node.resourceLimits()
+
+	for resource, check := range map[string][2]int64{"memory": {usage.MemoryBytes, memory}, "disk": {usage.DiskBytes, disk}} {
+
+		used, limit := check[0], check[1]
+		exceeded := limit > 0 && float64(used) > resourceWatermark*float64(limit)
+
+		if exceeded {
+			node.logger().Warn().Str("resource", resource).Int64("used", used).Int64("limit", limit).Msg("Resource usage past its watermark")
+			node.Meta.metrics.Set("resource_watermark_exceeded", 1, "resource", resource)
+		} else {
+			node.Meta.metrics.Set("resource_watermark_exceeded", 0, "resource", resource)
+		}
+	}
+
+	return usage
+}
+
+// Refresh the usage of the resources every resourceCheckInterval, until ctx is done.
+func (node *RaftNode) monitorResources(ctx context.Context) {
+
+	defer node.diagnoseCrash() // see diagnostics.go
+
+	ticker := time.NewTicker(resourceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+
+		node.recordResourceUsage()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package raft
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+ * This test case checks the usage reported for the log, the caches, the
+ * key-value store and the persisted files, and that the watermark of a limit
+ * is reported once exceeded.
+ */
+func TestResourceUsage(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if !t.Failed() {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	store := httptest.NewServer(http.HandlerFunc(kv.UsageHandler))
+	defer store.Close()
+
+	kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(`{"success": [{"type": "PUT", "key": "a", "value": "1234"}]}`)))
+
+	raft_file := filepath.Join(dir, "raft")
+	if err := ioutil.WriteFile(raft_file, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), alarms: NewAlarms(), Config: DefaultConfig()}}
+	node.Meta.replica_id = 97
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.raft_persistence_file = raft_file
+
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}, {Term: 1, Operation: []string{"POST", "a", "1234"}, Clientid: "c"}}
+	node.sessions = map[int64]clientSession{1: {Result: kv_store.TxnResult{Events: []kv_store.Event{{Type: "PUT", Key: "a", Value: "1234"}}}}}
+	node.trackMessage = map[string][]string{"c": {"POST", "a", "1234"}}
+
+	usage := node.resourceUsage()
+
+	if expected := int64(proto.Size(&node.log[0]) + proto.Size(&node.log[1])); usage.LogBytes != expected {
+		t.Errorf("Expected %v bytes of log, got %+v", expected, usage)
+	}
+
+	if expected := int64(sessionOverhead + 3 + 1 + 4 + 1 + 4 + 1 + 4); usage.CacheBytes != expected {
+		t.Errorf("Expected %v bytes of cache, got %+v", expected, usage)
+	}
+
+	if usage.StoreKeys != 1 || usage.StoreBytes == 0 || usage.MemoryBytes != usage.LogBytes+usage.CacheBytes+usage.StoreBytes {
+		t.Errorf("Unexpected usage of the store %+v", usage)
+	}
+
+	if usage.DiskBytes != 100 || usage.HeapBytes == 0 || usage.Goroutines == 0 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+
+	// 100 bytes on disk are past the watermark of a 110 bytes limit, but not of 200 bytes.
+	for _, c := range []struct {
+		limit    int64
+		exceeded float64
+	}{{110, 1}, {200, 0}} {
+
+		node.Meta.Config.MaxDiskBytes = c.limit
+		node.recordResourceUsage()
+
+		series := node.Meta.metrics.snapshot()
+		if series[metricKey("resource_usage_bytes", []string{"resource", "disk"})] != 100 || series[metricKey("resource_watermark_exceeded", []string{"resource", "disk"})] != c.exceeded {
+			t.Errorf("Unexpected gauges with a limit of %v bytes: %v", c.limit, series)
+		}
+	}
+}
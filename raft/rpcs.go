@@ -2,7 +2,7 @@ package raft
 
 import (
 	"context"
-	"log"
+	"time"
 
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
 )
@@ -15,16 +15,20 @@ func (node *RaftNode) RequestVote(ctx context.Context, in *protos.RequestVoteMes
 
 	node.GetLock("RequestVote")
 
-	latestLogIndex := int32(-1)
-	latestLogTerm := int32(-1)
+	latestLogIndex := node.lastLogIndex()
+	latestLogTerm, _ := node.termAt(latestLogIndex)
 
-	if logLen := int32(len(node.log)); logLen > 0 {
-		latestLogIndex = logLen - 1
-		latestLogTerm = node.log[latestLogIndex].Term
+	// Replicas outside of the configuration (e.g. removed ones) must not disrupt the cluster, see membership.go
+	if _, ok := node.member(in.CandidateId); !ok {
+		node.logger().Info().Int32("candidate_id", in.CandidateId).Msg("Ignoring vote request from a replica which is not a member of the cluster")
+		node.ReleaseLock("RequestVote0")
+		return &protos.RequestVoteResponse{Term: node.currentTerm, VoteGranted: false}, nil
 	}
 
-	log.Printf("\nReceived term: %v, My term: %v, My votedFor: %v\n", in.Term, node.currentTerm, node.votedFor)
-	log.Printf("\nReceived latestLogIndex: %v, My latestLogIndex: %v, Received latestLogTerm: %v, My latestLogTerm: %v\n", in.LastLogIndex, latestLogIndex, in.LastLogTerm, latestLogTerm)
+	node.logger().Debug().
+		Int32("candidate_id", in.CandidateId).Int32("candidate_term", in.Term).Int32("term", node.currentTerm).Int32("voted_for", node.votedFor).
+		Int32("candidate_last_index", in.LastLogIndex).Int32("candidate_last_term", in.LastLogTerm).Int32("last_index", latestLogIndex).Int32("last_term", latestLogTerm).
+		Msg("Received vote request")
 
 	// If the received message's term is greater than the replica's current term, transition to
 	// follower (if not already a follower) and update term.
@@ -33,23 +37,26 @@ func (node *RaftNode) RequestVote(ctx context.Context, in *protos.RequestVoteMes
 	}
 
 	// If ToFollower was called above, in.Term and node.currentTerm will be equal. If in.Term < node.currentTerm, reject vote.
-	// If the candidate's log is not atleast as up-to-date as the replica's, reject vote.
-	if (node.votedFor == in.CandidateId) ||
-		((in.Term == node.currentTerm) && (node.votedFor == -1) &&
-			(in.LastLogTerm > latestLogTerm || ((in.LastLogTerm == latestLogTerm) && (in.LastLogIndex >= latestLogIndex)))) {
+	// If the candidate's log is not atleast as up-to-date as the replica's, reject vote. A candidate asking again
+	// in the same term (e.g. after a lost response) gets the same answer.
+	if (in.Term == node.currentTerm) && (node.votedFor == -1 || node.votedFor == in.CandidateId) &&
+		(in.LastLogTerm > latestLogTerm || ((in.LastLogTerm == latestLogTerm) && (in.LastLogIndex >= latestLogIndex))) {
 
 		node.votedFor = in.CandidateId
 
-		log.Printf("\nGranting vote to %v\n", in.CandidateId)
+		// The vote is on disk before the candidate learns about it, so that a restart can't grant a second one in the term.
+		node.logger().Info().Int32("term", in.Term).Int32("candidate_id", in.CandidateId).Msg("Granting vote")
 		node.PersistToStorage()
 		node.ReleaseLock("RequestVote1")
 		return &protos.RequestVoteResponse{Term: in.Term, VoteGranted: true}, nil
 
 	} else {
 
-		log.Printf("\nRejecting vote to %v\n", in.CandidateId)
+		// The current term is returned, so that a candidate of an earlier term steps down.
+		node.logger().Info().Int32("term", in.Term).Int32("candidate_id", in.CandidateId).Msg("Rejecting vote")
+		term := node.currentTerm
 		node.ReleaseLock("RequestVote2")
-		return &protos.RequestVoteResponse{Term: in.Term, VoteGranted: false}, nil
+		return &protos.RequestVoteResponse{Term: term, VoteGranted: false}, nil
 
 	}
 
@@ -66,14 +73,14 @@ func (node *RaftNode) AppendEntries(ctx context.Context, in *protos.AppendEntrie
 
 		// Check if the logs were replicated earlier, i.e. if entry at PrevLogIndex (if it exists)
 		// has term PrevLogTerm. If yes, check if the logs match.
-		if (in.PrevLogIndex == int32(-1)) || ((in.PrevLogIndex < int32(len(node.log))) && (node.log[in.PrevLogIndex].Term == in.PrevLogTerm)) {
+		if prev_term, ok := node.termAt(in.PrevLogIndex); ok && prev_term == in.PrevLogTerm {
 
 			entryIndex := 0
 
-			for logIndex := int(in.PrevLogIndex + 1); (entryIndex < len(in.Entries)) && (logIndex < len(node.log)); logIndex++ {
+			for logIndex := in.PrevLogIndex + 1; (entryIndex < len(in.Entries)) && (logIndex <= node.lastLogIndex()); logIndex++ {
 
 				// we start from prevlogindex and try to find the first mismatch, if any
-				if node.log[logIndex].Term != in.Entries[entryIndex].Term {
+				if node.entry(logIndex).Term != in.Entries[entryIndex].Term {
 					break
 				}
 
@@ -88,14 +95,14 @@ func (node *RaftNode) AppendEntries(ctx context.Context, in *protos.AppendEntrie
 				return &protos.AppendEntriesResponse{Term: node.currentTerm, Success: true}, nil
 			} else {
 				node.ReleaseLock("AppendEntries2")
-				log.Printf("\nResponding False in AE because entryIndex != len(in.Entries)")
+				node.logger().Debug().Int32("prev_index", in.PrevLogIndex).Msg("Responding False in AE because entryIndex != len(in.Entries)")
 				return &protos.AppendEntriesResponse{Term: node.currentTerm, Success: false}, nil
 			}
 
 		} else {
 			// entry at PrevLogIndex does not have term PrevLogTerm
 			node.ReleaseLock("AppendEntries3")
-			log.Printf("\nResponding False in AE because entry at PrevLogIndex does not have term PrevLogTerm")
+			node.logger().Debug().Int32("prev_index", in.PrevLogIndex).Int32("prev_term", in.PrevLogTerm).Msg("Responding False in AE because entry at PrevLogIndex does not have term PrevLogTerm")
 			return &protos.AppendEntriesResponse{Term: node.currentTerm, Success: false}, nil
 		}
 
@@ -112,20 +119,29 @@ func (node *RaftNode) AppendEntries(ctx context.Context, in *protos.AppendEntrie
 
 	// here we can be sure that the node's current term and the term in the message match, and that the current replica
 	// is not a leader or a candidate.
-	node.electionResetEvent <- true
+	node.resetElectionTimer()
 
-	node.Meta.leaderAddress = in.LeaderAddr // gets the leaders address
+	node.setLeader(in.LeaderId, in.LeaderAddr) // gets the leaders address
+	node.Meta.leaderCommit, node.Meta.leaderContact = in.LeaderCommit, node.now()
+
+	// The entries up to the start of the log were compacted into a snapshot (see log.go). Being committed, they
+	// match the leader's, which holds every committed entry: only the entries following them are checked.
+	prev_index, prev_term, entries := in.PrevLogIndex, in.PrevLogTerm, in.Entries
+
+	for len(entries) > 0 && prev_index < node.logStart-1 {
+		prev_index, prev_term, entries = prev_index+1, entries[0].Term, entries[1:]
+	}
 
 	// we ensure that the entry at PrevLogIndex (if it exists) has term PrevLogTerm
-	if (in.PrevLogIndex == int32(-1)) || ((in.PrevLogIndex < int32(len(node.log))) && (node.log[in.PrevLogIndex].Term == in.PrevLogTerm)) {
+	if term, ok := node.termAt(prev_index); prev_index < node.logStart-1 || (ok && term == prev_term) {
 
-		logIndex := int(in.PrevLogIndex + 1)
+		logIndex := prev_index + 1
 		entryIndex := 0
 
-		for ; (entryIndex < len(in.Entries)) && (logIndex < len(node.log)); logIndex++ {
+		for ; (entryIndex < len(entries)) && (logIndex <= node.lastLogIndex()); logIndex++ {
 
 			// we start from prevlogindex and try to find the first mismatch, if any
-			if node.log[logIndex].Term != in.Entries[entryIndex].Term {
+			if node.entry(logIndex).Term != entries[entryIndex].Term {
 				break
 			}
 
@@ -136,49 +152,59 @@ func (node *RaftNode) AppendEntries(ctx context.Context, in *protos.AppendEntrie
 		// at this point, logIndex has either reached the end of the log (or the first conflicting entry), and/or entryIndex has reached the end
 		// of the message's entries. if entryIndex has reached the end, it means that there is nothing new to add to the candidate's log.
 
-		for ; entryIndex < len(in.Entries); entryIndex++ {
+		config_changed := false
 
-			if logIndex == len(node.log) {
+		// If an existing entry conflicts with a new one, delete the existing entry and all that follow it (§5.3).
+		// Otherwise, entries of an earlier term could stay after the new ones, and later be committed.
+		if entryIndex < len(entries) && logIndex <= node.lastLogIndex() {
 
-				// add new entry to log
-				log.Printf("\nAdd new entry to logs\n")
-				node.log = append(node.log, *in.Entries[entryIndex])
+			node.logger().Debug().Int32("index", logIndex).Msg("Delete invalidated log entries")
 
-			} else {
+			for i := logIndex; i <= node.lastLogIndex(); i++ {
+				config_changed = config_changed || isConfigEntry(node.entry(i))
+			}
 
-				// overwrite invalidated log entry
-				log.Printf("\nOverwrite invalidated log entry\n")
-				node.log[logIndex] = *in.Entries[entryIndex]
+			node.truncateLog(logIndex)
+		}
 
-			}
+		for ; entryIndex < len(entries); entryIndex++ {
+
+			config_changed = config_changed || isConfigEntry(entries[entryIndex])
 
-			logIndex++
+			// add new entry to log
+			node.logger().Debug().Int32("index", node.lastLogIndex()+1).Msg("Add new entry to logs")
+			node.log = append(node.log, *entries[entryIndex])
 
 		}
 
-		if in.LeaderCommit > node.commitIndex {
+		if config_changed {
+			node.refreshMembership()
+		}
 
-			old_commit_index := node.commitIndex
+		// Only the entries known to match the leader's log can be committed: those up to the last new entry.
+		last_new_index := prev_index + int32(len(entries))
+
+		if in.LeaderCommit > node.commitIndex && last_new_index > node.commitIndex {
 
 			node.Meta.latestClient = in.LatestClient // stores the id of the most recent client
 
-			for i := node.commitIndex + 1; i <= in.LeaderCommit && i < int32(len(node.log)); i++ {
+			for i := node.commitIndex + 1; i <= in.LeaderCommit && i <= last_new_index; i++ {
 
-				node.trackMessage[node.log[i].Clientid] = node.log[i].Operation //Updates the trackMessages for each client to the latest operation
+				node.trackMessage[node.entry(i).Clientid] = node.entry(i).Operation //Updates the trackMessages for each client to the latest operation
 
 			}
 
-			if in.LeaderCommit < int32(len(node.log)) {
+			if in.LeaderCommit < last_new_index {
 
 				node.commitIndex = in.LeaderCommit
 
 			} else {
 
-				node.commitIndex = int32(len(node.log) - 1)
+				node.commitIndex = last_new_index
 
 			}
 
-			node.commits_ready <- (node.commitIndex - old_commit_index)
+			node.notifyCommits()
 
 		}
 
@@ -190,9 +216,40 @@ func (node *RaftNode) AppendEntries(ctx context.Context, in *protos.AppendEntrie
 	} else { //Reply false if log doesn’t contain an entry at prevLogIndex whose term matches prevLogTerm (§5.3)
 
 		node.ReleaseLock("AppendEntries5")
-		log.Printf("\nResponding False in AE because log doesn’t contain an entry at prevLogIndex whose term matches prevLogTerm 2")
+		node.logger().Debug().Int32("prev_index", in.PrevLogIndex).Int32("prev_term", in.PrevLogTerm).Msg("Responding False in AE because log doesn’t contain an entry at prevLogIndex whose term matches prevLogTerm")
 		return &protos.AppendEntriesResponse{Term: in.Term, Success: false}, nil
 
 	}
 
 }
+
+// Implements the functionality involved when a replica receives a TimeoutNow RPC from a leader
+// transferring its leadership to it: the replica starts an election immediately, instead of
+// waiting for its election timer to run out.
+func (node *RaftNode) TimeoutNow(ctx context.Context, in *protos.TimeoutNowMessage) (*protos.TimeoutNowResponse, error) {
+
+	node.GetRLock("TimeoutNow1")
+	term, state := node.currentTerm, node.state
+	_, is_member := node.member(node.Meta.replica_id)
+	witness := node.isWitness()
+	node.ReleaseRLock("TimeoutNow1")
+
+	if in.Term != term || state != Follower || !is_member || witness {
+		return &protos.TimeoutNowResponse{Term: term, Success: false}, nil
+	}
+
+	node.logger().Info().Int32("term", term).Int32("leader_id", in.LeaderId).Msg("Asked by the leader to start an election")
+
+	// The election is started by the running election timer, as if it had run out.
+	select {
+
+	case node.timeoutNowEvent <- true:
+
+	case <-time.After(100 * time.Millisecond):
+		node.logger().Warn().Msg("TimeoutNow: election timer is not running, not starting an election")
+		return &protos.TimeoutNowResponse{Term: term, Success: false}, nil
+
+	}
+
+	return &protos.TimeoutNowResponse{Term: term, Success: true}, nil
+}
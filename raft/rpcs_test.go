@@ -0,0 +1,195 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that a vote is only granted to a candidate whose log
+ * is at least as up-to-date as the voter's, at most once per term, and that
+ * the granted vote is persisted before the reply.
+ */
+func TestRequestVote(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "vote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	node := &RaftNode{
+		Meta: &NodeMetadata{
+			replica_id:            0,
+			Config:                DefaultConfig(),
+			Master_ctx:            context.Background(),
+			raft_persistence_file: filepath.Join(dir, "state"),
+		},
+		state:              Follower,
+		currentTerm:        2,
+		votedFor:           -1,
+		electionResetEvent: make(chan bool, 10),
+		storage:            NewStorage(),
+	}
+
+	node.Meta.initial_members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.Meta.peer_replica_clients = make([]Transport, 3)
+	node.nextIndex = make([]int32, 3)
+	node.matchIndex = make([]int32, 3)
+	node.refreshMembership()
+
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}, {Term: 2, Operation: []string{"NO-OP"}}}
+
+	vote := func(term, candidate, last_index, last_term int32) *protos.RequestVoteResponse {
+		response, err := node.RequestVote(context.Background(), &protos.RequestVoteMessage{Term: term, CandidateId: candidate, LastLogIndex: last_index, LastLogTerm: last_term})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if response := vote(3, 1, 5, 1); response.VoteGranted {
+		t.Errorf("Expected a candidate with an older last term to be rejected")
+	}
+
+	if response := vote(3, 1, 0, 2); response.VoteGranted {
+		t.Errorf("Expected a candidate with a shorter log to be rejected")
+	}
+
+	if response := vote(3, 2, 1, 2); !response.VoteGranted {
+		t.Fatalf("Expected a candidate with an up-to-date log to get the vote")
+	}
+
+	if response := vote(3, 2, 1, 2); !response.VoteGranted {
+		t.Errorf("Expected a candidate asking again in the same term to get the vote again")
+	}
+
+	if response := vote(3, 1, 1, 2); response.VoteGranted {
+		t.Errorf("Expected a second candidate of the term to be rejected")
+	}
+
+	if response := vote(2, 2, 1, 2); response.VoteGranted || response.Term != 3 {
+		t.Errorf("Expected a candidate of an earlier term to be rejected with the current term, got %v", response)
+	}
+
+	restored := NewStorage()
+	if voted, ok := restored.Get("votedFor", node.Meta.raft_persistence_file); !ok || voted.(int32) != 2 {
+		t.Errorf("Expected the vote to be persisted, got %v", voted)
+	}
+}
+
+// A follower of the given term holding the given log, with no election timer nor ApplyToStateMachine running.
+func newTestFollower(t *testing.T, term int32, log []protos.LogEntry) *RaftNode {
+
+	dir, err := ioutil.TempDir("", "follower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	node := InitializeNode(3, 0, ":0", DataLayout{WAL: dir})
+	node.Meta.Master_ctx = context.Background()
+	node.Meta.initial_members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.nextIndex = make([]int32, 3)
+	node.matchIndex = make([]int32, 3)
+	node.refreshMembership()
+
+	node.currentTerm = term
+	node.log = log
+
+	return node
+}
+
+/*
+ * This test case checks that the handlers don't wait for the election timer or ApplyToStateMachine while
+ * holding the lock: these take the lock themselves, and may be waiting for it.
+ */
+func TestAppendEntriesDoesNotBlock(t *testing.T) {
+
+	node := newTestFollower(t, 1, []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}})
+
+	done := make(chan bool)
+
+	go func() {
+
+		for i := int32(0); i < 3; i++ {
+
+			entry := &protos.LogEntry{Term: 1, Operation: []string{"NO-OP"}}
+			msg := &protos.AppendEntriesMessage{Term: 1, LeaderId: 1, PrevLogIndex: i, PrevLogTerm: 1, LeaderCommit: i + 1, Entries: []*protos.LogEntry{entry}}
+
+			if response, err := node.AppendEntries(context.Background(), msg); err != nil || !response.Success {
+				t.Errorf("Expected entry %v to be appended, got %v, %v", i+1, response, err)
+			}
+		}
+
+		node.GetLock("TestAppendEntriesDoesNotBlock")
+		node.ToFollower(context.Background(), 2)
+		node.ReleaseLock("TestAppendEntriesDoesNotBlock")
+
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("AppendEntries blocked on the election timer or ApplyToStateMachine")
+	}
+
+	if node.commitIndex != 3 {
+		t.Errorf("Expected commit index 3, got %v", node.commitIndex)
+	}
+
+	select {
+	case <-node.commits_ready:
+	default:
+		t.Errorf("Expected ApplyToStateMachine to be notified of the commits")
+	}
+}
+
+/*
+ * This test case checks that a follower deletes the entries following a conflicting one, rather than keeping
+ * stale entries of an earlier term after the leader's, and that it doesn't commit past the entries known to
+ * match the leader's log.
+ */
+func TestAppendEntriesConflict(t *testing.T) {
+
+	noop := func(term int32) protos.LogEntry { return protos.LogEntry{Term: term, Operation: []string{"NO-OP"}} }
+
+	// Entries 2 to 4 were appended by a leader of term 2, which lost its leadership before replicating them.
+	node := newTestFollower(t, 3, []protos.LogEntry{noop(1), noop(1), noop(2), noop(2), noop(2)})
+
+	entry := noop(3)
+	msg := &protos.AppendEntriesMessage{Term: 3, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 4, Entries: []*protos.LogEntry{&entry}}
+
+	if response, err := node.AppendEntries(context.Background(), msg); err != nil || !response.Success {
+		t.Fatalf("Expected the entry to be appended, got %v, %v", response, err)
+	}
+
+	if len(node.log) != 3 || node.log[2].Term != 3 {
+		t.Fatalf("Expected the entries following the conflicting one to be deleted, got %v", node.log)
+	}
+
+	// The leader's commit index is past the entries it sent: only those are known to match its log.
+	if node.commitIndex != 2 {
+		t.Errorf("Expected commit index 2, got %v", node.commitIndex)
+	}
+
+	// A heartbeat matching an earlier entry doesn't commit the ones following it.
+	node = newTestFollower(t, 3, []protos.LogEntry{noop(1), noop(1), noop(2)})
+
+	heartbeat := &protos.AppendEntriesMessage{Term: 3, LeaderId: 1, PrevLogIndex: 1, PrevLogTerm: 1, LeaderCommit: 5}
+
+	if response, err := node.AppendEntries(context.Background(), heartbeat); err != nil || !response.Success {
+		t.Fatalf("Expected the heartbeat to succeed, got %v, %v", response, err)
+	}
+
+	if len(node.log) != 3 || node.commitIndex != 1 {
+		t.Errorf("Expected the log to be kept and commit index 1, got %v and %v", node.log, node.commitIndex)
+	}
+}
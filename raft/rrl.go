@@ -0,0 +1,315 @@
+package raft
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Response rate limiting (RRL) of the DNS listeners, guarding the authoritative answers served on the
+open internet from being used to amplify attacks on the spoofed addresses of the queries. A view
+with a "rate_limit" limits the responses sent over UDP to each client network (its /24 for IPv4 and
+its /56 for IPv6, by default), by token buckets refilled at a number of responses per second:
+
+	{"name": "external", "zones": ["example.com."], "rate_limit": {
+		"responses_per_second": 5, "nxdomains_per_second": 2, "errors_per_second": 2,
+		"burst": 10, "slip": 2, "exempt": ["192.0.2.0/24"]
+	}}
+
+As in the RRL of BIND, the responses are accounted by what they answer, so that a flood of queries
+for one name doesn't keep the network from getting the others:
+
+  - the answers, by name and type queried (the referrals by delegated zone)
+  - the NXDOMAIN and NODATA answers, by zone, nxdomains_per_second applying
+  - the other errors (e.g. REFUSED or SERVFAIL), together, errors_per_second applying
+
+A bucket holds burst responses at most (the rate of the bucket, by default). The responses over the
+limit are dropped, but for every slip-th one (2 by default, -1 dropping them all), which is sent
+truncated and empty, so that a legitimate client retries over TCP, whose answers aren't limited:
+the addresses of TCP clients can't be spoofed. The networks listed as exempt, e.g. those of the
+known resolvers, aren't limited. The replica keeps rrlMaxBuckets buckets at most, the responses to
+the networks beyond them not being limited. The limited responses are counted in
+dns_rrl_responses_total{view, action}, the action being dropped or slipped.
+*/
+
+const rrlMaxBuckets = 100000 // Buckets, across the views, a replica keeps at most
+
+// The response rate limits of a view.
+type DNSRateLimit struct {
+	ResponsesPerSecond float64  `json:"responses_per_second"` // Answers of a name and type to a network
+	NXDomainsPerSecond float64  `json:"nxdomains_per_second"` // NXDOMAIN and NODATA answers of a zone, responses_per_second if 0
+	ErrorsPerSecond    float64  `json:"errors_per_second"`    // Other errors, responses_per_second if 0
+	Burst              float64  `json:"burst"`                // Responses of a bucket sent at once at most, its rate if 0
+	Slip               int      `json:"slip"`                 // Every slip-th response dropped is sent truncated, 2 if 0, -1 for none
+	IPv4Prefix         int      `json:"ipv4_prefix"`          // Prefix length of the networks of the IPv4 clients, 24 if 0
+	IPv6Prefix         int      `json:"ipv6_prefix"`          // Prefix length of the networks of the IPv6 clients, 56 if 0
+	Exempt             []string `json:"exempt"`               // Networks whose responses aren't limited
+}
+
+func (l *DNSRateLimit) validate(view string) error {
+
+	if l.ResponsesPerSecond <= 0 || l.NXDomainsPerSecond < 0 || l.ErrorsPerSecond < 0 || l.Burst < 0 {
+		return fmt.Errorf("dns: view %v: rate_limit: expected a positive responses_per_second, and non-negative rates and burst", view)
+	}
+
+	if l.Slip < -1 || l.IPv4Prefix < 0 || l.IPv4Prefix > 32 || l.IPv6Prefix < 0 || l.IPv6Prefix > 128 {
+		return fmt.Errorf("dns: view %v: rate_limit: invalid slip or prefix lengths", view)
+	}
+
+	for _, network := range l.Exempt {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("dns: view %v: rate_limit: invalid exempt network %q", view, network)
+		}
+	}
+
+	return nil
+}
+
+// The response limiters of the views, created on their first response. The zero value is empty.
+type rateLimiters struct {
+	mu      sync.Mutex
+	views   map[string]*responseLimiter
+	buckets int // Buckets of all the limiters
+}
+
+// Return the limiter of the view, nil if its responses aren't limited.
+func (r *rateLimiters) of(view DNSView) *responseLimiter {
+
+	if view.RateLimit == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.views == nil {
+		r.views = make(map[string]*responseLimiter)
+	}
+
+	if l, ok := r.views[view.Name]; ok {
+		return l
+	}
+
+	l := &responseLimiter{config: *view.RateLimit, parent: r, buckets: make(map[string]*rrlBucket)}
+
+	for _, network := range view.RateLimit.Exempt {
+		_, n, _ := net.ParseCIDR(network) // checked by Validate
+		l.exempt = append(l.exempt, n)
+	}
+
+	r.views[view.Name] = l
+
+	return l
+}
+
+// The token buckets of the responses of a view.
+type responseLimiter struct {
+	config DNSRateLimit
+	exempt []*net.IPNet
+	parent *rateLimiters
+
+	mu      sync.Mutex
+	buckets map[string]*rrlBucket
+}
+
+type rrlBucket struct {
+	tokens  float64
+	rate    float64
+	updated time.Time
+	dropped int // Responses dropped since the bucket was last refilled
+}
+
+// Refill the bucket at now, up to burst tokens.
+func (b *rrlBucket) refill(now time.Time, burst float64) {
+
+	b.tokens += now.Sub(b.updated).Seconds() * b.rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+
+	b.updated = now
+}
+
+// Return the key of the bucket of the response to the client network, and the rate of the bucket.
+func (l *responseLimiter) bucketKey(network string, req, resp *dns.Msg) (string, float64) {
+
+	nxdomains, errors := l.config.NXDomainsPerSecond, l.config.ErrorsPerSecond
+	if nxdomains == 0 {
+		nxdomains = l.config.ResponsesPerSecond
+	}
+	if errors == 0 {
+		errors = l.config.ResponsesPerSecond
+	}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return "error " + network, errors
+	}
+
+	if len(resp.Answer) == 0 {
+		for _, rr := range resp.Ns {
+
+			switch rr.Header().Rrtype {
+			case dns.TypeSOA:
+				return "empty " + network + " " + zone.CanonicalName(rr.Header().Name), nxdomains
+			case dns.TypeNS:
+				return "answer " + network + " " + zone.CanonicalName(rr.Header().Name) + " NS", l.config.ResponsesPerSecond
+			}
+		}
+
+		if resp.Rcode == dns.RcodeNameError {
+			return "empty " + network, nxdomains
+		}
+	}
+
+	q := req.Question[0]
+	return "answer " + network + " " + zone.CanonicalName(q.Name) + " " + dns.TypeToString[q.Qtype], l.config.ResponsesPerSecond
+}
+
+// Return the network of the client, as limited.
+func (l *responseLimiter) network(ip net.IP) string {
+
+	if ip4 := ip.To4(); ip4 != nil {
+
+		ones := l.config.IPv4Prefix
+		if ones == 0 {
+			ones = 24
+		}
+
+		return ip4.Mask(net.CIDRMask(ones, 32)).String() + "/" + fmt.Sprint(ones)
+	}
+
+	ones := l.config.IPv6Prefix
+	if ones == 0 {
+		ones = 56
+	}
+
+	return ip.Mask(net.CIDRMask(ones, 128)).String() + "/" + fmt.Sprint(ones)
+}
+
+/*
+Return whether the response to the client at now is sent, and whether it is sent truncated (slipped)
+rather than as answered. The responses over the limit of their bucket aren't sent, but for every
+slip-th one.
+*/
+func (l *responseLimiter) allow(now time.Time, ip net.IP, req, resp *dns.Msg) (bool, bool) {
+
+	for _, n := range l.exempt {
+		if n.Contains(ip) {
+			return true, false
+		}
+	}
+
+	key, rate := l.bucketKey(l.network(ip), req, resp)
+
+	burst := l.config.Burst
+	if burst == 0 {
+		burst = rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+
+		if !l.track(now) {
+			return true, false
+		}
+
+		b = &rrlBucket{tokens: burst, rate: rate, updated: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(now, burst)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.dropped = 0
+		return true, false
+	}
+
+	b.dropped++
+
+	slip := l.config.Slip
+	if slip == 0 {
+		slip = 2
+	}
+
+	if slip > 0 && b.dropped%slip == 0 {
+		return true, true
+	}
+
+	return false, false
+}
+
+// Reserve a bucket among those of all the views, forgetting the full ones of the view when there is
+// none left. Return whether one was reserved. Called with l.mu held.
+func (l *responseLimiter) track(now time.Time) bool {
+
+	l.parent.mu.Lock()
+	defer l.parent.mu.Unlock()
+
+	if l.parent.buckets >= rrlMaxBuckets {
+
+		// A full bucket is the same as none.
+		for key, b := range l.buckets {
+
+			burst := l.config.Burst
+			if burst == 0 {
+				burst = b.rate
+			}
+
+			if b.tokens+now.Sub(b.updated).Seconds()*b.rate >= burst {
+				delete(l.buckets, key)
+				l.parent.buckets--
+			}
+		}
+
+		if l.parent.buckets >= rrlMaxBuckets {
+			return false
+		}
+	}
+
+	l.parent.buckets++
+
+	return true
+}
+
+// Apply the response rate limit of the view to the response to a query received over UDP, returning
+// the response to send, nil if it is dropped.
+func (node *RaftNode) limitResponse(view DNSView, limiter *responseLimiter, w dns.ResponseWriter, req, resp *dns.Msg) *dns.Msg {
+
+	addr, udp := w.RemoteAddr().(*net.UDPAddr)
+	if limiter == nil || !udp || len(req.Question) != 1 {
+		return resp
+	}
+
+	send, slip := limiter.allow(node.now(), addr.IP, req, resp)
+
+	switch {
+
+	case !send:
+		node.Meta.metrics.Add("dns_rrl_responses_total", 1, "view", view.Name, "action", "dropped")
+		return nil
+
+	case slip:
+		node.Meta.metrics.Add("dns_rrl_responses_total", 1, "view", view.Name, "action", "slipped")
+
+		truncated := new(dns.Msg)
+		truncated.SetReply(req)
+		truncated.Truncated = true
+
+		return truncated
+
+	}
+
+	return resp
+}
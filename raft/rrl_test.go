@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the responses over the rate limit of a view are
+ * dropped but for every slip-th one, sent truncated, that the buckets are kept
+ * by client network and by name, refilled over time, and that the TCP clients
+ * and the exempt networks aren't limited.
+ */
+func TestResponseRateLimiting(t *testing.T) {
+
+	view := DNSView{Name: "external", RateLimit: &DNSRateLimit{ResponsesPerSecond: 1, Burst: 2, Exempt: []string{"198.51.100.0/24"}}}
+	config := DNSConfig{Views: []DNSView{view}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	limiter := node.rrl.of(view)
+
+	// Return the response sent to the client for the name, nil if dropped.
+	respond := func(addr net.Addr, name string) *dns.Msg {
+
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		rr, _ := dns.NewRR(name + " 60 IN A 192.0.2.1")
+		resp.Answer = []dns.RR{rr}
+
+		return node.limitResponse(view, limiter, &resolverDNS{addr: addr}, req, resp)
+	}
+
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 53}
+
+	var sent, slipped, dropped int
+	for i := 0; i < 6; i++ {
+		switch resp := respond(client, "www.example.com."); {
+		case resp == nil:
+			dropped++
+		case resp.Truncated && len(resp.Answer) == 0:
+			slipped++
+		default:
+			sent++
+		}
+	}
+
+	if sent != 2 || slipped != 2 || dropped != 2 {
+		t.Errorf("Expected the burst to be sent and every other response over it to slip, got %v sent, %v slipped and %v dropped", sent, slipped, dropped)
+	}
+
+	// Another name, another network, a TCP client and an exempt network have buckets of their own or none.
+	neighbour := &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 53}
+	if resp := respond(neighbour, "www.example.com."); resp != nil {
+		t.Errorf("Expected the clients of the same /24 to share their buckets, got %v", resp)
+	}
+
+	for _, c := range []struct {
+		addr net.Addr
+		name string
+	}{
+		{client, "api.example.com."},
+		{&net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 53}, "www.example.com."},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 53}, "www.example.com."},
+		{&net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}, "www.example.com."},
+	} {
+		if resp := respond(c.addr, c.name); resp == nil || resp.Truncated {
+			t.Errorf("Expected the response to %v for %v to be sent, got %v", c.addr, c.name, resp)
+		}
+	}
+
+	// The bucket is refilled at the rate of the view.
+	now := time.Now().Add(1500 * time.Millisecond)
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	if send, slip := limiter.allow(now, client.IP, req, resp); !send || slip {
+		t.Errorf("Expected the bucket to be refilled after a second")
+	}
+
+	if got := node.Meta.metrics.Get("dns_rrl_responses_total", "view", "external", "action", "dropped"); got != 3 {
+		t.Errorf("Expected 3 responses to be dropped, got %v", got)
+	}
+
+	for _, limit := range []DNSRateLimit{{}, {ResponsesPerSecond: 1, Slip: -2}, {ResponsesPerSecond: 1, IPv4Prefix: 33}, {ResponsesPerSecond: 1, Exempt: []string{"192.0.2.1"}}} {
+		if err := limit.validate("external"); err == nil {
+			t.Errorf("Expected the rate limit %+v to be invalid", limit)
+		}
+	}
+}
@@ -3,58 +3,92 @@ package raft
 import (
 	"context"
 	"sync/atomic"
-	"time"
 
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // To send AppendEntry to single replica, and retry if needed (called by LeaderSendAEs defined below).
-func (node *RaftNode) LeaderSendAE(parent_ctx context.Context, replica_id int32, upper_index int32, client_obj protos.ConsensusServiceClient, msg *protos.AppendEntriesMessage) (status bool) {
+func (node *RaftNode) LeaderSendAE(parent_ctx context.Context, replica_id int32, upper_index int32, client_obj Transport, msg *protos.AppendEntriesMessage) (status bool) {
 
 	var response *protos.AppendEntriesResponse
 	var err error
 
 	// Call the AppendEntries RPC for the given client
-	ctx, _ := context.WithTimeout(parent_ctx, 40*time.Millisecond)
-	response, err = client_obj.AppendEntries(ctx, msg)
+	sent := node.now()
+	ctx, cancel := context.WithTimeout(parent_ctx, node.Meta.Config.RPCTimeout)
+	response, err = client_obj.SendAppendEntries(ctx, msg)
+	cancel()
+
+	node.recordPeerRPC(replica_id, "AppendEntries", err)
 
 	if err != nil {
 		return false
 	}
 
+	node.recordPeerRTT(replica_id, node.now().Sub(sent))
+
 	node.GetLock("LeaderSendAE")
 
+	node.last_contact[replica_id] = node.now()
+
 	if response.Success == false {
 
-		if node.state != Leader {
+		if response.Term > node.currentTerm {
+
+			node.ToFollower(parent_ctx, response.Term)
 			node.ReleaseLock("LeaderSendAE")
 			return false
 		}
 
-		if response.Term > node.currentTerm {
-
-			node.ToFollower(parent_ctx, response.Term)
+		// The replica may have stepped down since, and its log been truncated by the next leader.
+		if !node.replicating(msg.Term, upper_index) {
 			node.ReleaseLock("LeaderSendAE")
 			return false
 		}
 
 		// will reach here if response.Term == node.currentTerm and response.Success == false
 		// Keep decrementing nextIndex and retrying the RPC until it succeeds
-		node.nextIndex[replica_id]--
+		if msg.PrevLogIndex < 0 {
+			node.ReleaseLock("LeaderSendAE")
+			return false
+		}
 
-		var entries []*protos.LogEntry
+		node.nextIndex[replica_id] = msg.PrevLogIndex
+
+		// The entries the replica misses were compacted: it is sent a snapshot instead, see install.go.
+		if node.nextIndex[replica_id] < node.logStart {
+
+			node.ReleaseLock("LeaderSendAE")
+
+			if !node.sendSnapshot(replica_id, client_obj, msg.Term) {
+				return false
+			}
+
+			node.GetLock("LeaderSendAE")
 
-		for i := msg.PrevLogIndex; i <= upper_index; i++ {
-			entries = append(entries, &node.log[i])
+			if !node.replicating(msg.Term, upper_index) || node.nextIndex[replica_id] < node.logStart {
+				node.ReleaseLock("LeaderSendAE")
+				return false
+			}
+
+			// The snapshot may hold all the entries sent.
+			if node.matchIndex[replica_id] >= upper_index {
+				node.ReleaseLock("LeaderSendAE")
+				return true
+			}
 		}
 
-		prevLogIndex := int32(msg.PrevLogIndex - 1)
-		prevLogTerm := int32(-1)
+		var entries []*protos.LogEntry
 
-		if prevLogIndex >= 0 {
-			prevLogTerm = node.log[prevLogIndex].Term
+		for i := node.nextIndex[replica_id]; i <= upper_index; i++ {
+			entries = append(entries, node.entry(i))
 		}
 
+		prevLogIndex := node.nextIndex[replica_id] - 1
+		prevLogTerm, _ := node.termAt(prevLogIndex)
+
 		new_msg := &protos.AppendEntriesMessage{
 
 			Term:         node.currentTerm,
@@ -72,15 +106,22 @@ func (node *RaftNode) LeaderSendAE(parent_ctx context.Context, replica_id int32,
 
 	} else { //response.Success == true
 
+		// A replica of a later term may hold the entries, but they don't count towards the commit of a stale leader.
 		if node.currentTerm < response.Term {
 
 			node.ToFollower(parent_ctx, response.Term)
+			node.ReleaseLock("LeaderSendAE")
+			return false
 
-		} else {
+		}
 
+		// The sends to the replica (e.g. a heartbeat and a write, or a snapshot) may complete out of order.
+		if upper_index >= node.nextIndex[replica_id] {
 			node.nextIndex[replica_id] = upper_index + 1
-			node.matchIndex[replica_id] = upper_index
+		}
 
+		if upper_index > node.matchIndex[replica_id] {
+			node.matchIndex[replica_id] = upper_index
 		}
 
 		node.ReleaseLock("LeaderSendAE")
@@ -90,14 +131,30 @@ func (node *RaftNode) LeaderSendAE(parent_ctx context.Context, replica_id int32,
 
 }
 
+// Whether the replica still leads the given term, with the entries up to the given index in its log. Must be
+// called with the (read) lock held.
+func (node *RaftNode) replicating(term int32, upper_index int32) bool {
+	return node.state == Leader && node.currentTerm == term && upper_index <= node.lastLogIndex()
+}
+
 // Called when the replica wants to send AppendEntries to all other replicas.
-func (node *RaftNode) LeaderSendAEs(msg_type string, msg *protos.AppendEntriesMessage, upper_index int32, successful_write chan bool) {
+func (node *RaftNode) LeaderSendAEs(ctx context.Context, msg_type string, msg *protos.AppendEntriesMessage, upper_index int32, successful_write chan bool) {
 
 	replica_id := int32(0)
 
 	successes := int32(1)
 	failures := int32(0)
 
+	// The learners don't count towards the quorum, they are sent the entries all the same.
+	learners := make(map[int32]bool)
+	for _, m := range node.Meta.members {
+		learners[m.Id] = m.Learner
+	}
+
+	// The quorum is that of the configuration the entries are sent to, which a membership change may
+	// replace once the outcome is known, while the slowest replicas are still being sent them.
+	n_replicas := node.Meta.n_replicas
+
 	for _, client_obj := range node.Meta.peer_replica_clients {
 
 		if replica_id == node.Meta.replica_id {
@@ -105,66 +162,137 @@ func (node *RaftNode) LeaderSendAEs(msg_type string, msg *protos.AppendEntriesMe
 			continue
 		}
 
+		// A voter the replica isn't connected to counts as failed, so that the outcome is always sent.
+		// Those of the replicas removed from the configuration are left unset, see setMembers.
 		if client_obj == nil {
+			if node.voter(replica_id) && atomic.AddInt32(&failures, 1) == (n_replicas+1)/2 {
+				go func() { successful_write <- false }()
+			}
 			replica_id++
 			continue
 		}
 
-		go func(node *RaftNode, client_obj protos.ConsensusServiceClient, replica_id int32, upper_index int32, successful_write chan bool) {
+		go func(node *RaftNode, client_obj Transport, replica_id int32, upper_index int32, voter bool, successful_write chan bool) {
+
+			// An unreachable peer doesn't hold up the write: it counts as failed right away, and is
+			// only probed with an AppendEntries without entries, see peers.go
+			probe := node.unreachable(replica_id)
+
+			if probe && voter && atomic.AddInt32(&failures, 1) == (n_replicas+1)/2 {
+				successful_write <- false
+			}
 
 			node.GetRLock("LeaderSendAEs1")
 
-			prevLogIndex := node.nextIndex[replica_id] - 1
-			prevLogTerm := int32(-1)
+			// The entries the replica misses were compacted: it is sent a snapshot first, see install.go.
+			// An unreachable replica is only probed from the start of the log, and sent the snapshot once
+			// it answers (see LeaderSendAE).
+			if !probe && node.replicating(msg.Term, upper_index) && node.nextIndex[replica_id] < node.logStart {
 
-			if prevLogIndex >= 0 {
-				prevLogTerm = node.log[prevLogIndex].Term
+				node.ReleaseRLock("LeaderSendAEs3")
+				node.sendSnapshot(replica_id, client_obj, msg.Term)
+				node.GetRLock("LeaderSendAEs3")
 			}
 
-			msg.PrevLogIndex = prevLogIndex
-			msg.PrevLogTerm = prevLogTerm
+			// The replica may have stepped down since, and its log been truncated by the next leader.
+			if !node.replicating(msg.Term, upper_index) || (!probe && node.nextIndex[replica_id] < node.logStart) {
+
+				node.ReleaseRLock("LeaderSendAEs2")
+
+				if !probe && voter && atomic.AddInt32(&failures, 1) == (n_replicas+1)/2 {
+					successful_write <- false
+				}
+
+				return
+			}
+
+			prevLogIndex := node.nextIndex[replica_id] - 1
+			if prevLogIndex < node.logStart-1 {
+				prevLogIndex = node.logStart - 1
+			}
+
+			prevLogTerm, _ := node.termAt(prevLogIndex)
+
+			// A successful probe only confirms the entries up to prevLogIndex.
+			if probe {
+				upper_index = prevLogIndex
+			}
 
 			var entries []*protos.LogEntry
 
 			for i := int32(prevLogIndex + 1); i <= upper_index; i++ {
-				entries = append(entries, &node.log[i])
+				entries = append(entries, node.entry(i))
 			}
 
 			node.ReleaseRLock("LeaderSendAEs")
 
-			msg.Entries = entries
+			// Each replica gets its own message, as they are sent concurrently.
+			msg := &protos.AppendEntriesMessage{
+				Term:         msg.Term,
+				LeaderId:     msg.LeaderId,
+				PrevLogIndex: prevLogIndex,
+				PrevLogTerm:  prevLogTerm,
+				LeaderCommit: msg.LeaderCommit,
+				Entries:      entries,
+				LeaderAddr:   msg.LeaderAddr,
+				LatestClient: msg.LatestClient,
+			}
+
+			// The RPC is part of the trace of the proposal (if any), but isn't cancelled along with it.
+			_, span := startChildSpan(ctx, "raft.append_entries", trace.WithAttributes(attribute.Int("raft.peer_id", int(replica_id)), attribute.Int("raft.entries", len(entries))))
+			// The retries with earlier entries share the deadline of the first RPC.
+			rpc_ctx, cancel := context.WithTimeout(trace.ContextWithSpan(context.Background(), span), node.Meta.Config.RPCTimeout)
+
+			replicated := node.LeaderSendAE(rpc_ctx, replica_id, upper_index, client_obj, msg)
+			cancel()
+			span.SetAttributes(attribute.Bool("raft.success", replicated))
+			span.End()
 
-			ctx, _ := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			if probe || !voter {
+				return
+			}
 
-			if node.LeaderSendAE(ctx, replica_id, upper_index, client_obj, msg) {
+			if replicated {
 
 				tot_success := atomic.AddInt32(&successes, 1)
 
-				if tot_success == (node.Meta.n_replicas)/2+1 { // write quorum achieved
+				if tot_success == (n_replicas)/2+1 { // write quorum achieved
 					successful_write <- true // indicate to the calling function that the operation was performed successfully.
 				}
 
 			} else {
 				tot_fail := atomic.AddInt32(&failures, 1)
 
-				if tot_fail == (node.Meta.n_replicas+1)/2 {
+				if tot_fail == (n_replicas+1)/2 {
 					successful_write <- false // indicate to the calling function that the operation failed.
 				}
 			}
 
-		}(node, client_obj, replica_id, upper_index, successful_write)
+		}(node, client_obj, replica_id, upper_index, !learners[replica_id], successful_write)
 
 		replica_id++
 
 	}
 
+	// The leader alone is a quorum of a single replica cluster.
+	if n_replicas/2+1 == 1 {
+		go func() { successful_write <- true }()
+	}
+
 }
 
 // HeartBeats is a goroutine that periodically sends heartbeats as long as the replicas thinks it's a leader
 func (node *RaftNode) HeartBeats(ctx context.Context) {
 
-	ticker := time.NewTicker(50 * time.Millisecond)
-	defer ticker.Stop()
+	defer node.diagnoseCrash() // see diagnostics.go
+
+	// The heartbeats are sent for the term the replica leads when called.
+	node.GetRLock("HeartBeats")
+	term := node.currentTerm
+	node.ReleaseRLock("HeartBeats")
+
+	// Each round starts a heartbeat interval after the previous one started, on the clock of the Raft timers.
+	tick := node.after(node.Meta.Config.HeartbeatInterval)
 
 	/*
 	 * The following select statements are to make sure that the context being
@@ -175,23 +303,23 @@ func (node *RaftNode) HeartBeats(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-tick:
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
 
+			tick = node.after(node.Meta.Config.HeartbeatInterval)
+
 			node.GetRLock("HeartBeats")
 
-			if node.state != Leader {
+			if node.state != Leader || node.currentTerm != term {
 
 				node.ReleaseRLock("HeartBeats1")
 				return
 			}
 
-			node.ReleaseRLock("HeartBeats2")
-
 			hbeat_msg := &protos.AppendEntriesMessage{
 
 				Term:         node.currentTerm,
@@ -201,8 +329,12 @@ func (node *RaftNode) HeartBeats(ctx context.Context) {
 				LatestClient: node.Meta.latestClient,
 			}
 
+			upper_index := node.lastLogIndex()
+
+			node.ReleaseRLock("HeartBeats2")
+
 			success := make(chan bool)
-			node.LeaderSendAEs("HBEAT", hbeat_msg, int32(len(node.log)-1), success)
+			node.LeaderSendAEs(ctx, "HBEAT", hbeat_msg, upper_index, success)
 			<-success
 		}
 	}
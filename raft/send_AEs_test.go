@@ -0,0 +1,103 @@
+package raft
+
+import (
+	"context"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc"
+)
+
+// A peer answering the AppendEntries RPCs with the given function, recording the messages it receives.
+type replyingPeer struct {
+	protos.ConsensusServiceClient
+
+	reply    func(in *protos.AppendEntriesMessage) *protos.AppendEntriesResponse
+	received []*protos.AppendEntriesMessage
+}
+
+func (peer *replyingPeer) AppendEntries(ctx context.Context, in *protos.AppendEntriesMessage, opts ...grpc.CallOption) (*protos.AppendEntriesResponse, error) {
+
+	peer.received = append(peer.received, in)
+	return peer.reply(in), nil
+}
+
+// A leader of the given term holding the given log.
+func newTestLeader(t *testing.T, term int32, log []protos.LogEntry) *RaftNode {
+
+	node := newTestFollower(t, term, log)
+	node.state = Leader
+	node.commitIndex = -1
+
+	return node
+}
+
+/*
+ * This test case checks that the leader only commits an entry it replicated itself, by its index and term,
+ * rather than incrementing its commit index.
+ */
+func TestCommitReplicated(t *testing.T) {
+
+	node := newTestLeader(t, 2, []protos.LogEntry{{Term: 1}, {Term: 1}, {Term: 2}})
+
+	node.commitReplicated(1, 2)
+	if node.commitIndex != -1 {
+		t.Errorf("Expected an entry of another term not to be committed, got commit index %v", node.commitIndex)
+	}
+
+	node.commitReplicated(2, 2)
+	if node.commitIndex != 2 {
+		t.Errorf("Expected commit index 2, got %v", node.commitIndex)
+	}
+
+	node.commitReplicated(1, 1)
+	if node.commitIndex != 2 {
+		t.Errorf("Expected the commit index not to go back, got %v", node.commitIndex)
+	}
+
+	node.commitReplicated(3, 2)
+	if node.commitIndex != 2 {
+		t.Errorf("Expected an entry missing from the log not to be committed, got commit index %v", node.commitIndex)
+	}
+}
+
+/*
+ * This test case checks that a stale leader doesn't count a replica of a later term as holding its entries,
+ * and that it stops probing backwards once a replica rejects the start of the log.
+ */
+func TestLeaderSendAE(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	node := newTestLeader(t, 2, []protos.LogEntry{{Term: 1}, {Term: 2}})
+
+	later := &replyingPeer{reply: func(in *protos.AppendEntriesMessage) *protos.AppendEntriesResponse {
+		return &protos.AppendEntriesResponse{Term: 3, Success: true}
+	}}
+
+	msg := &protos.AppendEntriesMessage{Term: 2, PrevLogIndex: 0, PrevLogTerm: 1, Entries: []*protos.LogEntry{&node.log[1]}}
+
+	if node.LeaderSendAE(ctx, 1, 1, NewGRPCTransport(later), msg) {
+		t.Errorf("Expected the reply of a later term not to count as replicated")
+	}
+
+	if node.matchIndex[1] != 0 || node.state != Follower || node.currentTerm != 3 {
+		t.Errorf("Expected the leader to step down without updating matchIndex, got %v in term %v with matchIndex %v", node.state, node.currentTerm, node.matchIndex[1])
+	}
+
+	node = newTestLeader(t, 2, []protos.LogEntry{{Term: 1}, {Term: 2}})
+	node.nextIndex[1] = 1
+
+	rejecting := &replyingPeer{reply: func(in *protos.AppendEntriesMessage) *protos.AppendEntriesResponse {
+		return &protos.AppendEntriesResponse{Term: 2, Success: false}
+	}}
+
+	if node.LeaderSendAE(ctx, 1, 1, NewGRPCTransport(rejecting), msg) {
+		t.Errorf("Expected the rejected entries not to count as replicated")
+	}
+
+	if len(rejecting.received) != 2 || rejecting.received[1].PrevLogIndex != -1 || node.nextIndex[1] != 0 {
+		t.Errorf("Expected the leader to stop at the start of the log, got %v messages and nextIndex %v", len(rejecting.received), node.nextIndex[1])
+	}
+}
@@ -0,0 +1,277 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Serials of the zones, and the NOTIFY messages (RFC 1996) sending their changes to the secondary name
+servers. The serial of a zone, given by the SOA record of its apex, is incremented by every write
+changing the records of the zone, by an apply hook (see hooks.go) keeping the serial served under
+SerialsPrefix (e.g. "_dns_serials:example.com."). Being applied by the state machine, the serial is
+the same on every replica, whichever wrote the records (the client HTTP API, transactions, gRPC or
+the DNS updates), and is incremented once by a write changing several RRsets. The DNS listeners
+answer the SOA records with the serial served, the stored SOA record giving the other fields: a
+write of the SOA record itself sets the serial, as long as it is greater than the one served (in the
+sequence space arithmetic of RFC 1982), otherwise the serial keeps being incremented from the one
+served.
+
+The setting notify.<zone> holds the comma separated addresses of the secondary name servers of the
+zone, e.g. notify.example.com = "192.0.2.53:53,198.51.100.53:53". The leader sends them a NOTIFY
+whenever the serial of the zone changed since the last one they acknowledged, sending it again at
+each check until they do. The NOTIFY messages are counted in dns_notifies_total{zone, outcome}.
+*/
+
+const (
+	SerialsPrefix  = "_dns_serials:" // Prefix of the serials served of the zones
+	NotifyPrefix   = "notify."       // Prefix of the settings listing the secondary name servers of a zone
+	notifyInterval = 2 * time.Second // Interval of the checks of the serials notified
+)
+
+func init() {
+
+	if err := RegisterApplyHook(kv_store.Hook{Name: "dns-serials", Prefix: zone.KeyPrefix, Derived: SerialsPrefix, Apply: incrementSerials}); err != nil {
+		panic(err)
+	}
+}
+
+// Whether the serial a is greater than b, in sequence space arithmetic (RFC 1982).
+func serialGreater(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// Return the serial field of the data of an SOA record, if it is valid.
+func soaSerial(data string) (uint32, bool) {
+
+	fields := strings.Fields(data)
+	if len(fields) != 7 {
+		return 0, false
+	}
+
+	serial, err := strconv.ParseUint(fields[2], 10, 32)
+	return uint32(serial), err == nil
+}
+
+// Return the data of an SOA record with the given serial.
+func withSerial(data string, serial uint32) string {
+
+	fields := strings.Fields(data)
+	if len(fields) != 7 {
+		return data
+	}
+
+	fields[2] = strconv.FormatUint(uint64(serial), 10)
+	return strings.Join(fields, " ")
+}
+
+// Increment the serials of the zones whose records changed.
+func incrementSerials(view kv_store.View, events []kv_store.Event) []kv_store.Op {
+
+	// The stored serial of the apex, if it holds an SOA record.
+	stored := func(apex string) (uint32, bool) {
+
+		value, ok := view.Get(zone.RecordKey(apex, "SOA"))
+		if !ok {
+			return 0, false
+		}
+
+		var records []zone.Record
+		if json.Unmarshal([]byte(value), &records) != nil || len(records) != 1 {
+			return 0, false
+		}
+
+		return soaSerial(records[0].Data)
+	}
+
+	// The zones changed by the write, in the order of their first change, and whether their SOA
+	// record was written.
+	var zones []string
+	changed, soaWritten := make(map[string]bool), make(map[string]bool)
+	var ops []kv_store.Op
+
+	for _, event := range events {
+
+		name, rtype, ok := zone.ParseRecordKey(event.Key)
+		if !ok || zone.IsPolicyKey(event.Key) {
+			continue
+		}
+
+		if rtype == "SOA" {
+
+			if _, ok := stored(name); !ok {
+				ops = append(ops, kv_store.Op{Type: kv_store.OpDelete, Key: SerialsPrefix + name})
+				continue
+			}
+
+			if _, ok := changed[name]; !ok {
+				zones = append(zones, name)
+				changed[name] = false
+			}
+
+			soaWritten[name] = true
+			continue
+		}
+
+		for i := 0; ; {
+
+			apex := dns.Fqdn(name[i:])
+
+			if _, ok := stored(apex); ok {
+
+				if _, ok := changed[apex]; !ok {
+					zones = append(zones, apex)
+				}
+
+				changed[apex] = true
+				break
+			}
+
+			var end bool
+			if i, end = dns.NextLabel(name, i); end {
+				break
+			}
+		}
+	}
+
+	for _, apex := range zones {
+
+		serial, _ := stored(apex)
+
+		value, known := view.Get(SerialsPrefix + apex)
+		served, err := strconv.ParseUint(value, 10, 32)
+		known = known && err == nil
+
+		// A serial set by the write itself is kept, provided it is ahead of the one served.
+		next := uint32(served)
+		switch {
+		case soaWritten[apex] && (!known || serialGreater(serial, next)):
+			next = serial
+		case !known:
+			next = serial + 1
+		case changed[apex]:
+			next++
+		}
+
+		if encoded := strconv.FormatUint(uint64(next), 10); encoded != value {
+			ops = append(ops, kv_store.Op{Type: kv_store.OpPut, Key: SerialsPrefix + apex, Value: encoded})
+		}
+	}
+
+	return ops
+}
+
+// Return the serial served of the zone, if it was kept by the replica.
+func (node *RaftNode) servedSerial(apex string) (uint32, bool) {
+
+	contents, _, err := node.shardOf(apex).stateMachine().Lookup(url.PathEscape(SerialsPrefix + apex))
+	if err != nil {
+		return 0, false
+	}
+
+	if !strings.HasPrefix(contents, "Value = ") {
+		return 0, false
+	}
+
+	serial, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(contents, "Value = "), "\n"), 10, 32)
+	return uint32(serial), err == nil
+}
+
+// The serials last acknowledged by the secondary name servers, on the leader.
+type notifications struct {
+	mu    sync.Mutex
+	acked map[string]uint32 // By zone and address of the name server
+}
+
+// Job sending a NOTIFY to the secondary name servers of the zones whose serial changed.
+func (node *RaftNode) notifyJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "dns_notify",
+		Interval: notifyInterval,
+		Run: func(ctx context.Context) error {
+
+			node.notifications.mu.Lock()
+			defer node.notifications.mu.Unlock()
+
+			if node.notifications.acked == nil {
+				node.notifications.acked = make(map[string]uint32)
+			}
+
+			for setting, value := range node.Meta.settings.All() {
+
+				if !strings.HasPrefix(setting, NotifyPrefix) || strings.TrimSpace(value) == "" {
+					continue
+				}
+
+				apex := zone.CanonicalName(strings.TrimPrefix(setting, NotifyPrefix))
+
+				stored, err := node.readName(apex)
+				if err != nil {
+					return err
+				}
+
+				soa := node.storedRRs(apex, "SOA", stored.records["SOA"])
+				if len(soa) != 1 {
+					continue
+				}
+
+				serial := soa[0].(*dns.SOA).Serial
+
+				for _, server := range splitList(value) {
+
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+
+					key := apex + " " + server
+					if acked, ok := node.notifications.acked[key]; ok && acked == serial {
+						continue
+					}
+
+					if err := node.sendNotify(apex, soa[0], server); err != nil {
+						node.logger().Debug().Err(err).Str("zone", apex).Str("server", server).Msg("NOTIFY not acknowledged")
+						node.Meta.metrics.Add("dns_notifies_total", 1, "zone", apex, "outcome", "failed")
+						continue
+					}
+
+					node.notifications.acked[key] = serial
+					node.Meta.metrics.Add("dns_notifies_total", 1, "zone", apex, "outcome", "acknowledged")
+					node.logger().Info().Str("zone", apex).Str("server", server).Uint32("serial", serial).Msg("NOTIFY acknowledged")
+				}
+			}
+
+			return nil
+		},
+	}
+}
+
+// Send a NOTIFY of the zone to the name server, returning an error unless it acknowledged it.
+func (node *RaftNode) sendNotify(apex string, soa dns.RR, server string) error {
+
+	req := new(dns.Msg)
+	req.SetNotify(apex)
+	req.Authoritative = true
+	req.Answer = []dns.RR{soa}
+
+	resp, _, err := (&dns.Client{Net: "udp", Timeout: dnsTimeout}).Exchange(req, server)
+	if err != nil {
+		return err
+	}
+
+	if resp.Opcode != dns.OpcodeNotify || resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("answered %v", dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
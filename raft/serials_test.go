@@ -0,0 +1,146 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the serial of a zone is incremented once by
+ * each write changing its records, that a serial set by a write is kept when
+ * ahead, and that the secondary name servers are notified of the changes
+ * until they acknowledge them.
+ */
+func TestSerials(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "serials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	write := func(ops ...kv_store.Op) {
+		txn, _ := json.Marshal(kv_store.Txn{Success: ops})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put := func(name, rtype, data string) kv_store.Op {
+		encoded, _ := json.Marshal([]zone.Record{{Name: name, Type: rtype, TTL: 300, Data: data}})
+		return kv_store.Op{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+
+	serial := func() uint32 {
+
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeSOA)
+
+		resp := node.answerDNS(DNSView{Name: "external"}, req, nil)
+		if len(resp.Answer) != 1 {
+			t.Fatalf("Expected the SOA record, got %v", resp)
+		}
+
+		return resp.Answer[0].(*dns.SOA).Serial
+	}
+
+	soa := func(serial string) kv_store.Op {
+		return put("example.com.", "SOA", "ns1.example.com. admin.example.com. "+serial+" 7200 900 1209600 300")
+	}
+
+	write(soa("10"))
+	if got := serial(); got != 10 {
+		t.Errorf("Expected the serial of the SOA record written, got %v", got)
+	}
+
+	write(put("www.example.com.", "A", "192.0.2.1"), put("mail.example.com.", "A", "192.0.2.2"))
+	write(put("www.example.com.", "AAAA", "2001:db8::1"))
+	write(put("www.example.org.", "A", "192.0.2.3"))
+
+	if got := serial(); got != 12 {
+		t.Errorf("Expected the serial to be incremented once by each write to the zone, got %v", got)
+	}
+
+	// A DNS update bumps the stored serial along with its changes, which is behind the one served.
+	write(soa("11"), put("www.example.com.", "TXT", `"v=1"`))
+	if got := serial(); got != 13 {
+		t.Errorf("Expected the serial served to be incremented, got %v", got)
+	}
+
+	write(soa("2026101400"))
+	if got := serial(); got != 2026101400 {
+		t.Errorf("Expected the serial set ahead of the one served, got %v", got)
+	}
+
+	// A secondary name server acknowledging the NOTIFY messages.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notified := make(chan uint32, 10)
+	secondary := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+
+		if req.Opcode == dns.OpcodeNotify && len(req.Answer) == 1 {
+			notified <- req.Answer[0].(*dns.SOA).Serial
+		}
+
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		w.WriteMsg(resp)
+	})}
+
+	go secondary.ActivateAndServe()
+	defer secondary.Shutdown()
+
+	node.Meta.settings.apply(SettingChange{Name: NotifyPrefix + "example.com", Action: "SET", Value: conn.LocalAddr().String()})
+
+	job := node.notifyJob()
+
+	for _, expected := range []uint32{2026101400, 0, 2026101401} {
+
+		if expected == 2026101401 {
+			write(put("ftp.example.com.", "A", "192.0.2.4"))
+		}
+
+		if err := job.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-notified:
+			if got != expected {
+				t.Errorf("Expected a NOTIFY of serial %v, got %v", expected, got)
+			}
+		default:
+			if expected != 0 {
+				t.Errorf("Expected a NOTIFY of serial %v", expected)
+			}
+		}
+	}
+
+	if got := node.Meta.metrics.Get("dns_notifies_total", "zone", "example.com.", "outcome", "acknowledged"); got != 2 {
+		t.Errorf("Expected 2 NOTIFY messages acknowledged, got %v", got)
+	}
+}
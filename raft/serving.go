@@ -0,0 +1,145 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+Members dedicated to consensus, so that a heavy read load of the clients can't slow down the members
+keeping the quorum stable. A member of the configuration whose ConsensusOnly flag is set (given with
+-consensus-only on startup, or add-member -consensus-only) votes, replicates the log and may lead
+like any other member, but serves no queries: its client HTTP server refuses the reads of keys,
+ranges and prefixes with 503 Service Unavailable, its KVService refuses watches and its DNS
+listeners answer REFUSED. The other members (but the witnesses) serve the queries.
+
+Every write goes through the leader, so a consensus-only leader still accepts the writes, along
+with the gRPC Get and Range calls (only served by the leader) and the reads forwarded to it by
+the members serving queries: a follower which can't serve a read from its local store (see
+follower_reads.go) forwards it to a consensus-only leader rather than refusing it, even with
+follower reads disabled.
+
+The refused HTTP reads carry the ServingHeader, with the client addresses of the members serving
+queries, and the refusals are counted in client_queries_refused_total{protocol}. At least one member
+of the initial configuration must serve queries.
+*/
+
+const ServingHeader = "X-Raft-Serving" // Client addresses of the members serving queries, comma separated
+
+var errConsensusOnly = errors.New("this replica is dedicated to consensus, and serves no queries")
+
+/*
+ParseConsensusOnly parses the comma separated IDs of the initial members dedicated to consensus
+(e.g. "0,1"). An empty spec means that every member serves queries, in which case nil is returned.
+*/
+func ParseConsensusOnly(spec string, n_replicas int, witnesses []int32) ([]int32, error) {
+
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var ids []int32
+	excluded := make(map[int32]bool)
+
+	for _, id := range witnesses {
+		excluded[id] = true
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+
+		id, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil || id < 0 || id >= n_replicas {
+			return nil, fmt.Errorf("invalid consensus-only replica %q, expected the ID of one of the %v replicas", entry, n_replicas)
+		}
+
+		if !excluded[int32(id)] {
+			excluded[int32(id)] = true
+			ids = append(ids, int32(id))
+		}
+	}
+
+	if len(excluded) == n_replicas {
+		return nil, fmt.Errorf("at least one replica must serve queries, neither a witness nor dedicated to consensus")
+	}
+
+	return ids, nil
+}
+
+// Whether this replica serves the queries of the clients. Must be called with the (read) lock held.
+func (node *RaftNode) servesQueries() bool {
+
+	m, ok := node.member(node.Meta.replica_id)
+	return !ok || !m.ConsensusOnly
+}
+
+// Whether the leader is dedicated to consensus. Must be called with the (read) lock held.
+func (node *RaftNode) consensusOnlyLeader() bool {
+
+	m, ok := node.member(node.Meta.leader_id)
+	return ok && m.ConsensusOnly
+}
+
+// Return the client addresses of the members serving queries. Must be called with the (read) lock held.
+func (node *RaftNode) queryServers() []string {
+
+	var addresses []string
+	for _, m := range node.Meta.members {
+		if !m.ConsensusOnly && !m.Witness {
+			addresses = append(addresses, m.ClientAddress)
+		}
+	}
+
+	return addresses
+}
+
+// Middleware refusing the reads of the clients on the replicas dedicated to consensus. The reads
+// forwarded by the other members are served.
+func (node *RaftNode) servingMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if httpTrafficClass(r) != classRead || r.Header.Get(ForwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		node.GetRLock("Serving Middleware")
+		serves, servers := node.servesQueries(), node.queryServers()
+		node.ReleaseRLock("Serving Middleware")
+
+		if serves {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		node.Meta.metrics.Add("client_queries_refused_total", 1, "protocol", "http")
+		w.Header().Set(ServingHeader, strings.Join(servers, ","))
+		writeError(w, http.StatusServiceUnavailable, "Error: %v.\n\nMembers serving queries: %v", errConsensusOnly, strings.Join(servers, ", "))
+	})
+}
+
+// Refuse the DNS query if the replica is dedicated to consensus, returning whether it was.
+func (node *RaftNode) refuseDNSQuery(view DNSView, w dns.ResponseWriter, req *dns.Msg) bool {
+
+	node.GetRLock("Refuse DNS Query")
+	serves := node.servesQueries()
+	node.ReleaseRLock("Refuse DNS Query")
+
+	if serves {
+		return false
+	}
+
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeRefused)
+
+	node.Meta.metrics.Add("client_queries_refused_total", 1, "protocol", "dns")
+	node.Meta.metrics.Add("dns_queries_total", 1, "view", view.Name, "rcode", dns.RcodeToString[resp.Rcode])
+	w.WriteMsg(resp)
+
+	return true
+}
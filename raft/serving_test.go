@@ -0,0 +1,101 @@
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// A dns.ResponseWriter keeping the message written.
+type recordedDNS struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *recordedDNS) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+/*
+ * This test case checks that the replicas dedicated to consensus refuse the
+ * HTTP reads and DNS queries of the clients, pointing them to the members
+ * serving queries, while still accepting the writes and the reads forwarded by
+ * the other members, which forward their reads to a consensus-only leader.
+ */
+func TestConsensusOnly(t *testing.T) {
+
+	if _, err := ParseConsensusOnly("0,1", 3, []int32{2}); err == nil {
+		t.Errorf("Expected a cluster without a replica serving queries to be refused")
+	}
+
+	if ids, err := ParseConsensusOnly("0, 1", 3, nil); err != nil || len(ids) != 2 {
+		t.Errorf("Expected 2 consensus-only replicas, got %v (%v)", ids, err)
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig()}}
+	node.Meta.members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.Meta.members[0].ConsensusOnly = true
+	node.Meta.members[2].Witness = true
+
+	served := 0
+	handler := node.servingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	}))
+
+	serve := func(method, path string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Replica 0 is dedicated to consensus.
+	if w := serve("GET", "/key", nil); w.Code != http.StatusServiceUnavailable || w.Header().Get(ServingHeader) != ":4001" || served != 0 {
+		t.Errorf("Expected the read to be refused, pointing to replica 1, got %v %v", w.Code, w.Header())
+	}
+
+	serve("POST", "/key", nil)
+	serve("GET", "/key", http.Header{ForwardedHeader: {"1"}})
+	serve("GET", "/admin/status", nil)
+
+	if served != 3 {
+		t.Errorf("Expected the writes, forwarded reads and admin requests to be served, got %v", served)
+	}
+
+	w := &recordedDNS{}
+	if !node.refuseDNSQuery(DNSView{Name: "default"}, w, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)) || w.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected the DNS query to be refused")
+	}
+
+	if got := node.Meta.metrics.Get("client_queries_refused_total", "protocol", "dns"); got != 1 {
+		t.Errorf("Expected the refused DNS query to be counted, got %v", got)
+	}
+
+	// Replica 1 serves the queries, and forwards the reads it can't serve to the consensus-only leader.
+	node.Meta.replica_id, node.Meta.leader_id = 1, 0
+	node.state = Follower
+
+	if w := serve("GET", "/key", nil); w.Code != http.StatusOK || served != 4 {
+		t.Errorf("Expected replica 1 to serve the read, got %v", w.Code)
+	}
+
+	if node.refuseDNSQuery(DNSView{Name: "default"}, &recordedDNS{}, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)) {
+		t.Errorf("Expected replica 1 to answer the DNS queries")
+	}
+
+	if mode, _ := node.readMode(httptest.NewRequest("GET", "/key", nil)); mode != readForward {
+		t.Errorf("Expected the read to be forwarded to the consensus-only leader, got mode %v", mode)
+	}
+
+	node.Meta.members[0].ConsensusOnly = false
+
+	if mode, _ := node.readMode(httptest.NewRequest("GET", "/key", nil)); mode != readRefused {
+		t.Errorf("Expected the read to be refused once the leader serves queries, got mode %v", mode)
+	}
+}
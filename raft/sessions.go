@@ -0,0 +1,294 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Client sessions, so that retried writes (e.g. resent after a timeout) are applied at most once, as
+described in section 6.3 of the Raft dissertation. A client registers a session through a "SESSION"
+log entry, whose index is the ID of the session, then numbers its writes with increasing sequence
+numbers, carried in their log entries along with the session.
+
+When applying an entry, the state machine skips it if its session already applied a write with the
+same or a higher sequence number, and the result of the latest write of each session is kept so that
+a retry of that write gets it again. The sessions are part of the state machine, persisted along with
+lastApplied: every replica applies the same entries, so they all agree on the sessions. The least
+recently used sessions are expired once there are more than maxClientSessions of them.
+
+The snapshots of a replica carry its sessions after the key-value store (see SnapshotHandler), so
+that a cluster restored from a snapshot (see RestoreSnapshot) still skips the retries of the writes
+applied before it. As the log of the restored cluster starts over, the restored sessions are marked
+as applied before its first entry, and the IDs of the sessions it registers are offset by
+sessionBase, past those of the restored ones.
+
+Writes without a session (session 0) are applied as before.
+*/
+
+const maxClientSessions = 4096
+
+var (
+	errUnknownSession = errors.New("unknown or expired session, register a new one")
+	errStaleSequence  = errors.New("a write with a higher sequence number was already applied in this session")
+)
+
+// The state of a client session, as applied by the state machine.
+type clientSession struct {
+	LastSequence int64              // Sequence number of the latest write applied in the session
+	LastIndex    int32              // Index of the log entry of that write, or of the registration
+	Result       kv_store.TxnResult // Outcome of that write, if it was a transaction
+}
+
+// Return the ID of the session registered by the log entry at the given index.
+func (node *RaftNode) sessionID(index int32) int64 {
+	return node.sessionBase + int64(index)
+}
+
+// Apply the registration of the session with the given ID from the entry at the given index,
+// expiring the least recently used ones. Must be called with the lock held.
+func (node *RaftNode) registerSession(id int64, index int32) {
+
+	node.sessions[id] = clientSession{LastIndex: index}
+
+	for len(node.sessions) > maxClientSessions {
+
+		oldest := id
+		for i, s := range node.sessions {
+			if s.LastIndex < node.sessions[oldest].LastIndex {
+				oldest = i
+			}
+		}
+
+		delete(node.sessions, oldest)
+		node.logger().Debug().Int64("session", oldest).Msg("Expired client session")
+	}
+}
+
+/*
+Whether the committed entry has to be skipped: if it belongs to a session that already applied
+its sequence number, or to an unknown session. Must be called with the lock held.
+*/
+func (node *RaftNode) skipSessionEntry(entry *protos.LogEntry, index int32) bool {
+
+	if entry.Session == 0 {
+		return false
+	}
+
+	session, ok := node.sessions[entry.Session]
+
+	if !ok {
+		node.logger().Warn().Int32("index", index).Int64("session", entry.Session).Msg("Write of an unknown session skipped")
+		return true
+	}
+
+	if entry.Sequence <= session.LastSequence {
+		node.Meta.metrics.Add("raft_duplicate_writes_total", 1)
+		node.logger().Debug().Int32("index", index).Int64("session", entry.Session).Int64("sequence", entry.Sequence).Msg("Duplicate write skipped")
+		return true
+	}
+
+	return false
+}
+
+// Record the write applied from the entry in its session. Must be called with the lock held.
+func (node *RaftNode) recordSessionWrite(entry *protos.LogEntry, index int32, result kv_store.TxnResult) {
+
+	if entry.Session == 0 {
+		return
+	}
+
+	node.sessions[entry.Session] = clientSession{LastSequence: entry.Sequence, LastIndex: index, Result: result}
+}
+
+/*
+Check a write of a session before it is proposed. Returns the index of the entry that applied the
+write if it was already applied, or -1 if it has to be proposed. Must be called with the lock held.
+*/
+func (node *RaftNode) checkSessionWrite(session, sequence int64) (int32, error) {
+
+	if session == 0 {
+		return -1, nil
+	}
+
+	s, ok := node.sessions[session]
+
+	switch {
+
+	case !ok:
+		return -1, errUnknownSession
+
+	case sequence <= 0:
+		return -1, errors.New("writes of a session require a positive sequence number")
+
+	case sequence == s.LastSequence:
+		return s.LastIndex, nil
+
+	case sequence < s.LastSequence:
+		return -1, errStaleSequence
+
+	}
+
+	return -1, nil
+}
+
+/*
+Return the result of the applied write of a session, once the leader no longer holds it (e.g. the
+write was a retry, skipped by the state machine). Must be called with the lock held.
+*/
+func (node *RaftNode) sessionResult(session, sequence int64) (kv_store.TxnResult, error) {
+
+	s, ok := node.sessions[session]
+
+	switch {
+
+	case session == 0:
+
+	case !ok:
+		return kv_store.TxnResult{}, status.Error(codes.FailedPrecondition, errUnknownSession.Error())
+
+	case sequence == s.LastSequence:
+		return s.Result, nil
+
+	case sequence < s.LastSequence:
+		return kv_store.TxnResult{}, status.Error(codes.FailedPrecondition, errStaleSequence.Error())
+
+	}
+
+	return kv_store.TxnResult{}, status.Error(codes.Unavailable, "leadership lost before the outcome of the transaction was known")
+}
+
+// Propose the registration of a session, and return its ID once it is applied.
+func (node *RaftNode) proposeSession(ctx context.Context, client string) (int64, error) {
+
+	node.GetRLock("Register Session")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Register Session")
+		return 0, errNotLeader
+	}
+
+	index, success, err := node.proposeCommand(ctx, []string{"SESSION"}, client) // releases the lock
+	if !success {
+		return 0, err
+	}
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		return 0, err
+	}
+
+	return node.sessionID(index), nil
+}
+
+// Append the sessions to a snapshot, after the key-value store.
+func encodeSessions(w io.Writer, sessions map[int64]clientSession) error {
+	return gob.NewEncoder(w).Encode(sessions)
+}
+
+/*
+Return the sessions following the key-value store in a snapshot, as restored into a fresh cluster,
+along with the base of the IDs of the sessions registered by that cluster. Snapshots taken before
+the sessions were added to them have none.
+*/
+func restoredSessions(r *bytes.Reader) (map[int64]clientSession, int64, error) {
+
+	sessions := make(map[int64]clientSession)
+
+	if r.Len() == 0 {
+		return sessions, 0, nil
+	}
+
+	if err := gob.NewDecoder(r).Decode(&sessions); err != nil {
+		return nil, 0, fmt.Errorf("invalid sessions in snapshot: %v", err)
+	}
+
+	base := int64(0)
+
+	for id, s := range sessions {
+
+		// Retries of the latest write are proposed again, and skipped by the state machine.
+		s.LastIndex = -1
+		sessions[id] = s
+
+		if id >= base {
+			base = id + 1
+		}
+	}
+
+	return sessions, base, nil
+}
+
+// Return the session and sequence number of an HTTP write, from its session and seq form values.
+func requestSession(r *http.Request) (session, sequence int64, err error) {
+
+	if r.FormValue("session") == "" {
+		return 0, 0, nil
+	}
+
+	if session, err = strconv.ParseInt(r.FormValue("session"), 10, 64); err != nil {
+		return 0, 0, errors.New("invalid session")
+	}
+
+	if sequence, err = strconv.ParseInt(r.FormValue("seq"), 10, 64); err != nil {
+		return 0, 0, errors.New("invalid sequence number")
+	}
+
+	return session, sequence, nil
+}
+
+// Handle requests registering a client session, of the form /admin/sessions?client=<client>.
+func (node *RaftNode) RegisterSessionHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("SESSION request received")
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	session, err := node.proposeSession(ctx, r.FormValue("client"))
+	if err == errNotLeader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error occured in SESSION request: %v", err)
+		return
+	}
+
+	node.logger().Info().Int64("session", session).Msg("SESSION request completed successfully and committed")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"session": session})
+}
+
+func (s *kvServer) RegisterSession(ctx context.Context, in *protos.RegisterSessionRequest) (*protos.RegisterSessionResponse, error) {
+
+	session, err := s.node.proposeSession(ctx, in.Client)
+
+	switch {
+
+	case err == errNotLeader:
+		s.node.GetRLock("KVService Register Session")
+		defer s.node.ReleaseRLock("KVService Register Session")
+		return nil, s.node.notLeaderError()
+
+	case err == context.DeadlineExceeded || err == context.Canceled:
+		return nil, status.FromContextError(err).Err()
+
+	case err != nil:
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+
+	}
+
+	return &protos.RegisterSessionResponse{Session: session}, nil
+}
@@ -0,0 +1,106 @@
+package raft
+
+import (
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the writes of a client session are applied once
+ * per sequence number, that a retry of the latest write gets its result, and
+ * that the least recently used sessions are expired.
+ */
+func TestClientSessions(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics()}, sessions: make(map[int64]clientSession)}
+
+	// Apply the entry if it isn't a duplicate, as ApplyToStateMachine does.
+	applied := 0
+	apply := func(index int32, entry *protos.LogEntry, result kv_store.TxnResult) {
+		if !node.skipSessionEntry(entry, index) {
+			applied++
+			node.recordSessionWrite(entry, index, result)
+		}
+	}
+
+	node.registerSession(7, 7)
+
+	if _, err := node.checkSessionWrite(8, 1); err != errUnknownSession {
+		t.Errorf("Expected the writes of an unregistered session to be rejected, got %v", err)
+	}
+
+	first := &protos.LogEntry{Operation: []string{"TXN", "{}"}, Session: 7, Sequence: 1}
+	apply(8, first, kv_store.TxnResult{Succeeded: true})
+
+	// A retry proposed before the first attempt was applied is skipped by the state machine.
+	apply(9, &protos.LogEntry{Operation: []string{"TXN", "{}"}, Session: 7, Sequence: 1}, kv_store.TxnResult{})
+
+	if applied != 1 {
+		t.Fatalf("Expected the write to be applied once, got %v", applied)
+	}
+
+	// A retry made once it was applied isn't proposed again, and gets the result of the write.
+	if index, err := node.checkSessionWrite(7, 1); index != 8 || err != nil {
+		t.Errorf("Expected the retry to be answered by entry 8, got %v (%v)", index, err)
+	}
+
+	if result, err := node.sessionResult(7, 1); err != nil || !result.Succeeded {
+		t.Errorf("Expected the cached result of the write, got %v (%v)", result, err)
+	}
+
+	apply(10, &protos.LogEntry{Operation: []string{"TXN", "{}"}, Session: 7, Sequence: 2}, kv_store.TxnResult{})
+
+	if _, err := node.checkSessionWrite(7, 1); err != errStaleSequence {
+		t.Errorf("Expected a write older than the latest one to be rejected, got %v", err)
+	}
+
+	// Writes without a session are always applied.
+	apply(11, &protos.LogEntry{Operation: []string{"PUT", "a", "1"}}, kv_store.TxnResult{})
+	apply(12, &protos.LogEntry{Operation: []string{"PUT", "a", "1"}}, kv_store.TxnResult{})
+
+	if applied != 4 {
+		t.Errorf("Expected 4 writes to be applied, got %v", applied)
+	}
+
+	for i := int64(0); i < maxClientSessions; i++ {
+		node.registerSession(100+i, int32(100+i))
+	}
+
+	if _, ok := node.sessions[7]; ok || len(node.sessions) != maxClientSessions {
+		t.Errorf("Expected the oldest session to be expired, with %v sessions left", len(node.sessions))
+	}
+
+	// A session restored from a snapshot predates the log: a retry of its latest write is proposed
+	// again, and skipped.
+	node.sessions[5000] = clientSession{LastSequence: 3, LastIndex: -1}
+
+	if index, err := node.checkSessionWrite(5000, 3); index != -1 || err != nil {
+		t.Errorf("Expected the retry of a restored write to be proposed, got %v (%v)", index, err)
+	}
+
+	if !node.skipSessionEntry(&protos.LogEntry{Operation: []string{"TXN", "{}"}, Session: 5000, Sequence: 3}, 0) {
+		t.Errorf("Expected the retry of a restored write to be skipped")
+	}
+
+	node.sessionBase = 5001
+	if id := node.sessionID(2); id != 5003 {
+		t.Errorf("Expected the sessions registered after a restore to be offset, got %v", id)
+	}
+
+	// Their registration is recorded at its log index, not at the offset ID, when expiring.
+	delete(node.sessions, 5000)
+	delete(node.sessions, 100)
+	node.registerSession(5003, 2)
+
+	if s := node.sessions[5003]; s.LastIndex != 2 {
+		t.Errorf("Expected the session to be registered at index 2, got %+v", s)
+	}
+
+	node.registerSession(5001+4200, 4200)
+
+	if _, ok := node.sessions[5003]; ok || len(node.sessions) != maxClientSessions {
+		t.Errorf("Expected the session registered at index 2 to be expired first, with %v sessions left", len(node.sessions))
+	}
+}
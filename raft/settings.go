@@ -0,0 +1,449 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Cluster-wide settings. Operational settings are stored in the key-value store under the reserved
+SettingsPrefix, and are only changed through "SETTING" log entries (made by the /admin/settings
+endpoints), so that every replica applies a change at the same point of its log. Along with the
+change, an audit record holding the previous value, the author and the time of the change is
+stored under SettingsAuditPrefix, keyed by the index of the log entry. Clients can read the
+reserved keys, but not write them.
+
+The settings currently used by the replicas are:
+
+	log_rpcs            log every RPC handled by the gRPC servers ("true" or "false"), overrides -log-rpcs
+	slow_rpc_threshold  log RPCs taking longer than this duration (e.g. "250ms"), 0 disables it
+	max_body_bytes      maximum size of a client request body, overrides -max-body-bytes
+	feature.<name>      feature flags, see FeatureEnabled
+	dns.forwarders      comma separated list of upstream resolvers
+	acl.<name>          comma separated access control lists
+	federation.<zone>   comma separated gRPC addresses of the home cluster of the zone, see federation.go
+	delegation.<zone>   comma separated DNS addresses of the cluster the zone is delegated to, see delegation.go
+	shard.<zone>        group owning the zone, in the settings of group 0, see shards.go
+	canary_replica      ID of the replica reading the staged values canary.<name>, see canary.go
+	snapshot_max_rate   bytes per second sent to each peer by the snapshot transfers, see throttle.go
+	snapshot_latency_target
+	                    write latency (e.g. "50ms") below which the snapshot transfers aren't slowed down
+	max_memory_bytes    memory usage of a replica raising the NOMEMORY alarm, overrides -max-memory-bytes
+	max_disk_bytes      disk usage of a replica raising the NOSPACE alarm, overrides -max-disk-bytes
+	compression_prefixes
+	                    comma separated prefixes of the keys whose values are compressed, see compression.go
+	compression_threshold
+	                    minimum size of the compressed values, 1024 bytes by default
+	follower_read_staleness
+	                    entries a follower may lag behind and still serve reads, overrides -follower-read-staleness
+	audit_retention     age beyond which the changes of the audit history of the keys are forgotten, see audit.go
+	audit_max_versions  changes kept in the audit history of every key
+	read_only           reject the writes of the clients ("true" or "false"), see readonly.go
+
+Other names can be set too, e.g. for settings used by newer replicas during a rolling upgrade.
+*/
+
+const (
+	SettingsPrefix      = "_settings:"       // Keys holding the current value of each setting
+	SettingsAuditPrefix = "_settings_audit:" // Keys holding the audit record of each change
+)
+
+var settingNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,127}$`)
+
+var errReservedKey = errors.New("\nKeys starting with " + SettingsPrefix + ", " + SettingsAuditPrefix + ", " + UsersPrefix + ", " + RolesPrefix + ", " + AlarmsPrefix + ", " + LocksPrefix + ", " + TSIGKeysPrefix + ", " + AuditPrefix + ", " + WebhooksPrefix + ", " + WebhookCursorsPrefix + ", " + ChangeStreamKey + ", " + ImportsPrefix + ", " + BackupScheduleKey + " or " + DecommissionsPrefix + " are reserved for the cluster settings, users, roles, alarms, locks, TSIG keys, audit history, webhooks, change stream, imports, backup schedule and decommissions, as are the keys derived by the apply hooks.\n")
+
+// The prefixes of the reserved namespaces of the settings, of the users (see users.go), of the roles
+// (see acl.go), of the alarms (see alarms.go), of the locks (see locks.go), of the TSIG keys (see
+// tsig.go), of the audit history (see audit.go), of the webhooks (see webhooks.go), of the change
+// stream (see changestream.go), of the imports (see import.go), of the backup schedule (see
+// backup_schedule.go), of the decommissions (see decommission.go) and of the keys derived by the apply
+// hooks (see hooks.go).
+var reservedPrefixes = []string{SettingsPrefix, SettingsAuditPrefix, UsersPrefix, RolesPrefix, AlarmsPrefix, LocksPrefix, TSIGKeysPrefix, AuditPrefix, WebhooksPrefix, WebhookCursorsPrefix, ChangeStreamKey, ImportsPrefix, BackupScheduleKey, DecommissionsPrefix}
+
+// Whether the key belongs to one of the reserved namespaces.
+func reservedKey(key string) bool {
+
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A change made to a setting, as stored in the audit history.
+type SettingChange struct {
+	Index    int32     `json:"index"` // Index of the log entry making the change
+	Term     int32     `json:"term"`
+	Name     string    `json:"name"`
+	Action   string    `json:"action"` // "SET" or "UNSET"
+	Value    string    `json:"value,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Author   string    `json:"author,omitempty"`
+	Time     time.Time `json:"time"` // Time at which the leader received the change
+}
+
+// The current settings of a replica, safe for concurrent use.
+type Settings struct {
+	mu      sync.RWMutex
+	values  map[string]string
+	replica string // ID of the replica, which reads the staged values if it is the canary
+}
+
+func NewSettings() *Settings {
+	return &Settings{values: make(map[string]string)}
+}
+
+// Forget the settings, before they are loaded again from the store.
+func (s *Settings) reset() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.values = make(map[string]string)
+}
+
+// Set the ID of the replica the settings are read by, see canary.go
+func (s *Settings) setReplica(id int32) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replica = strconv.Itoa(int(id))
+}
+
+// Return the value of the setting, and whether it is set. The canary replica reads the staged value
+// of the setting instead, if any.
+func (s *Settings) Get(name string) (string, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if canary, ok := s.values[CanaryReplicaSetting]; ok && canary == s.replica {
+		if value, ok := s.values[CanaryPrefix+name]; ok {
+			return value, true
+		}
+	}
+
+	value, ok := s.values[name]
+	return value, ok
+}
+
+// Return the value of the setting as replicated, ignoring any staged value.
+func (s *Settings) stored(name string) (string, bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	value, ok := s.values[name]
+	return value, ok
+}
+
+// Return a copy of all the settings.
+func (s *Settings) All() map[string]string {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string]string, len(s.values))
+	for name, value := range s.values {
+		all[name] = value
+	}
+
+	return all
+}
+
+// Typed accessors, returning def if the setting isn't set or can't be parsed.
+func (s *Settings) Bool(name string, def bool) bool {
+
+	if value, ok := s.Get(name); ok {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+
+	return def
+}
+
+func (s *Settings) Int64(name string, def int64) int64 {
+
+	if value, ok := s.Get(name); ok {
+		if parsed, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return parsed
+		}
+	}
+
+	return def
+}
+
+func (s *Settings) Duration(name string, def time.Duration) time.Duration {
+
+	if value, ok := s.Get(name); ok {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+
+	return def
+}
+
+// Return the comma separated elements of the setting, or nil if it isn't set.
+func (s *Settings) List(name string) []string {
+
+	value, ok := s.Get(name)
+	if !ok {
+		return nil
+	}
+
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+
+	return list
+}
+
+func (s *Settings) apply(change SettingChange) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if change.Action == "UNSET" {
+		delete(s.values, change.Name)
+	} else {
+		s.values[change.Name] = change.Value
+	}
+}
+
+// Whether the feature flag feature.<name> is set to true.
+func (node *RaftNode) FeatureEnabled(name string) bool {
+	return node.Meta.settings.Bool("feature."+name, false)
+}
+
+// Return the operation of the log entry making the change. The time is chosen by the leader, so that all
+// the replicas store the same audit record.
+func settingOperation(name, value, action, author string) []string {
+	return []string{"SETTING", name, value, action, author, strconv.FormatInt(time.Now().UnixNano(), 10)}
+}
+
+/*
+Return the transaction applying the "SETTING" log entry at the given index to the key-value store,
+along with the change it makes. Must be called in ApplyToStateMachine, before the previous changes
+have been applied to the settings.
+*/
+func (node *RaftNode) settingTxn(entry *protos.LogEntry, index int32) (kv_store.Txn, SettingChange) {
+
+	nanos, _ := strconv.ParseInt(entry.Operation[5], 10, 64)
+
+	change := SettingChange{
+		Index:  index,
+		Term:   entry.Term,
+		Name:   entry.Operation[1],
+		Action: entry.Operation[3],
+		Author: entry.Operation[4],
+		Time:   time.Unix(0, nanos).UTC(),
+	}
+
+	if change.Action != "UNSET" {
+		change.Value = entry.Operation[2]
+	}
+
+	change.Previous, _ = node.Meta.settings.stored(change.Name)
+
+	op := kv_store.Op{Type: kv_store.OpPut, Key: SettingsPrefix + change.Name, Value: change.Value}
+	if change.Action == "UNSET" {
+		op = kv_store.Op{Type: kv_store.OpDelete, Key: SettingsPrefix + change.Name}
+	}
+
+	record, _ := json.Marshal(change)
+
+	return kv_store.Txn{
+		Success: []kv_store.Op{
+			op,
+			{Type: kv_store.OpPut, Key: fmt.Sprintf("%s%010d", SettingsAuditPrefix, index), Value: string(record)},
+		},
+	}, change
+}
+
+// Fetch all the keys with the given prefix from the local key-value store, without any consistency
+// guarantee. Used on startup, before the replica takes part in the cluster.
+func (node *RaftNode) scanLocalStore(prefix string) ([]kv_store.KeyValue, error) {
+
+	var kvs []kv_store.KeyValue
+	token := ""
+
+	for {
+
+		contents, _, err := node.stateMachine().Lookup(fmt.Sprintf("prefix/%s?limit=1000&token=%s", url.PathEscape(prefix), url.QueryEscape(token)))
+		if err != nil {
+			return nil, err
+		}
+
+		var page kv_store.RangeResponse
+		if err := json.Unmarshal([]byte(contents), &page); err != nil {
+			return nil, err
+		}
+
+		kvs = append(kvs, page.Kvs...)
+
+		if page.NextToken == "" {
+			return kvs, nil
+		}
+
+		token = page.NextToken
+	}
+}
+
+// Load the settings persisted in the local key-value store.
+func (node *RaftNode) loadSettings() {
+
+	kvs, err := node.scanLocalStore(SettingsPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the cluster settings")
+		return
+	}
+
+	for _, kv := range kvs {
+		node.Meta.settings.apply(SettingChange{Name: strings.TrimPrefix(kv.Key, SettingsPrefix), Action: "SET", Value: kv.Value})
+	}
+
+	node.logger().Info().Int("count", len(kvs)).Msg("Loaded cluster settings")
+}
+
+// Handle requests listing the settings, as applied by this replica.
+func (node *RaftNode) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.settings.All())
+}
+
+// Handle requests for the audit history of the settings, optionally restricted to a single setting
+// with ?name=<name>. The history is read from the leader.
+func (node *RaftNode) SettingsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := r.FormValue("name")
+
+	node.GetRLock("Settings History Handler")
+	defer node.ReleaseRLock("Settings History Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		return
+	}
+
+	history := make([]SettingChange, 0)
+	token := ""
+
+	for {
+
+		response, status, err := node.readFromStore("prefix/" + url.PathEscape(SettingsAuditPrefix) + "?limit=1000&token=" + url.QueryEscape(token))
+		if err != nil || status != http.StatusOK {
+			writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+			return
+		}
+
+		var page kv_store.RangeResponse
+		if err := json.Unmarshal([]byte(response), &page); err != nil {
+			writeError(w, http.StatusInternalServerError, "Invalid audit history: %v", err)
+			return
+		}
+
+		for _, kv := range page.Kvs {
+
+			var change SettingChange
+			if err := json.Unmarshal([]byte(kv.Value), &change); err != nil {
+				node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid audit record")
+				continue
+			}
+
+			if name == "" || change.Name == name {
+				history = append(history, change)
+			}
+		}
+
+		if page.NextToken == "" {
+			break
+		}
+
+		token = page.NextToken
+	}
+
+	sort.Slice(history, func(i, j int) bool { return history[i].Index < history[j].Index })
+
+	writeJSON(w, http.StatusOK, history)
+}
+
+// Handle requests setting (PUT, with value=<value>) or unsetting (DELETE) a setting. The author of the
+// change can be given with client=<id>. The response is sent once the change is applied on the leader.
+func (node *RaftNode) SetSettingHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("SETTING request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !settingNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "Invalid setting name: %q", name)
+		return
+	}
+
+	action := "SET"
+	if r.Method == http.MethodDelete {
+		action = "UNSET"
+	}
+
+	value := r.FormValue("value")
+	author := r.FormValue("client")
+
+	node.GetRLock("Set Setting Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Set Setting Handler")
+		return
+	}
+
+	if _, ok := node.Meta.settings.stored(name); !ok && action == "UNSET" {
+		writeError(w, http.StatusNotFound, "Error: Setting %v is not set.", name)
+		node.ReleaseRLock("Set Setting Handler")
+		return
+	}
+
+	index, success, err := node.proposeCommand(r.Context(), settingOperation(name, value, action, author), author) // releases the lock
+	if !success {
+		node.logger().Error().Err(err).Str("name", name).Msg("Error occured in SETTING request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in SETTING request: %v", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: Setting committed but not applied yet: %v", err)
+		return
+	}
+
+	node.logger().Info().Str("name", name).Int32("index", index).Msg("SETTING request completed successfully and committed")
+
+	current, _ := node.Meta.settings.stored(name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "value": current, "index": index})
+}
@@ -0,0 +1,58 @@
+package raft
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that a "SETTING" log entry is applied as a transaction
+ * updating the setting and recording the change, along with the previous value,
+ * under the index of the entry in the audit history.
+ */
+func TestSettingTxn(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings()}}
+	node.Meta.settings.apply(SettingChange{Name: "max_body_bytes", Action: "SET", Value: "1024"})
+
+	entry := &protos.LogEntry{Term: 3, Operation: settingOperation("max_body_bytes", "2048", "SET", "admin")}
+	txn, change := node.settingTxn(entry, 7)
+
+	if change.Index != 7 || change.Term != 3 || change.Previous != "1024" || change.Value != "2048" || change.Author != "admin" {
+		t.Errorf("Unexpected change %+v", change)
+	}
+
+	if time.Since(change.Time) > time.Minute {
+		t.Errorf("Unexpected time of the change %v", change.Time)
+	}
+
+	if len(txn.Success) != 2 || txn.Success[0] != (kv_store.Op{Type: kv_store.OpPut, Key: "_settings:max_body_bytes", Value: "2048"}) {
+		t.Fatalf("Unexpected transaction %+v", txn)
+	}
+
+	var recorded SettingChange
+	if err := json.Unmarshal([]byte(txn.Success[1].Value), &recorded); err != nil || txn.Success[1].Key != "_settings_audit:0000000007" || recorded.Previous != "1024" {
+		t.Errorf("Unexpected audit record %v = %v (%v)", txn.Success[1].Key, txn.Success[1].Value, err)
+	}
+
+	node.Meta.settings.apply(change)
+	if node.Meta.settings.Int64("max_body_bytes", 0) != 2048 {
+		t.Errorf("Setting was not applied")
+	}
+
+	entry = &protos.LogEntry{Term: 3, Operation: settingOperation("max_body_bytes", "", "UNSET", "admin")}
+	txn, change = node.settingTxn(entry, 8)
+	node.Meta.settings.apply(change)
+
+	if txn.Success[0].Type != kv_store.OpDelete || change.Previous != "2048" {
+		t.Errorf("Unexpected transaction %+v for the change %+v", txn, change)
+	}
+
+	if node.Meta.settings.Int64("max_body_bytes", 42) != 42 || !reservedKey(txn.Success[1].Key) {
+		t.Errorf("Setting was not unset")
+	}
+}
@@ -0,0 +1,684 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/client"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Sharding of the zones across independent Raft groups, for datasets too large for a single group. With
+-groups <n>, each process hosts a replica of every group, each group with its own log, leader and key-
+value store: the replica <id> of group <g> serves the ports 4<g>00<id> (client HTTP), 5<g>00<id> (gRPC)
+and 3<g>00<id> (key-value store), e.g. 42001 for the client HTTP server of replica 1 of group 2, and
+keeps its files 3<g>00<id> and 6<g>00<id>. Group 0 keeps the ports and files of an unsharded replica
+(e.g. 4001), so that an existing cluster becomes the group 0 of a sharded one.
+
+The routing table is replicated by group 0, as its settings shard.<zone> = <group>: the most specific
+zone applies, and the records of the other zones (and the keys which aren't records) belong to group 0.
+Each group reads the table from the replica of group 0 in the same process (see ShardHost). The writes
+of a key belonging to another group are rejected with the client addresses of that group, the requests
+of the /{key} routes are answered with 421 Misdirected Request and the ShardHeader, naming the replica
+of the owning group in the same process, and the DNS listeners (started by group 0) answer each query
+from the local replica of the group owning the name, but refuse the updates of the other groups.
+
+POST /admin/shards/split (zone=<zone>&group=<group>) moves a zone to another group, and POST
+/admin/shards/merge (zone=<zone>) moves it back to the group of its parent zone, both on the leader of
+group 0. While moving, the entry of the zone holds "<from>><to>": its writes are refused as retryable
+(503 / Unavailable) in every group, and its reads are served by the former group. The leader of the new
+group copies the records of the zone from the former one through its KVService (with the ClientToken),
+the leader of group 0 completes the move once the replicas of both groups in its process hold the same
+records, and the leaders of the groups then delete the records they no longer own, once held by their
+new group. The jobs only act while the replica of group 0 of their process is up to date with its
+leader, so on a table at most a heartbeat behind.
+
+The gRPC reads (Get, Range and Watch) are served by the group they are sent to, and the standby
+replicas and the restores from a snapshot only cover group 0.
+*/
+
+const (
+	ShardPrefix = "shard."       // Prefix of the settings of group 0 routing a zone to a group
+	ShardHeader = "X-Raft-Shard" // Client address of the replica of the group owning the key, in the same process
+	MaxGroups   = 10             // Groups a process can host, as the group is a digit of the ports
+
+	shardClient  = "_shard:" // Client ID of the writes made by the moves, followed by the zone
+	shardRefresh = time.Second
+)
+
+var errShardMoving = errors.New("the zone of the key is moving to another group, retry shortly")
+
+// Error returned for the writes of a key belonging to another group.
+type wrongShardError struct {
+	zone      string
+	group     int
+	addresses []string
+}
+
+func (e *wrongShardError) Error() string {
+
+	name := e.zone
+	if name == "" {
+		name = "of the key"
+	}
+
+	return fmt.Sprintf("zone %v belongs to group %v, send its writes to %v", name, e.group, strings.Join(e.addresses, ","))
+}
+
+/*
+Return the port of a service of the replica in the group, given by its first digit (3 for the key-value
+store, 4 for the client HTTP server, 5 for the gRPC server, and 3 and 6 for the files of the raft state
+and of the store): e.g. 4001 for the client HTTP server of replica 1 of group 0, 42001 in group 2.
+*/
+func groupPort(service, group, id int) string {
+
+	if group == 0 {
+		return fmt.Sprintf("%d00%d", service, id)
+	}
+
+	return fmt.Sprintf("%d%d%03d", service, group, id)
+}
+
+// Return the default address of the gRPC server of the replica in the group.
+func PeerAddress(group, id int) string {
+	return ":" + groupPort(5, group, id)
+}
+
+// Return the default address of the client HTTP server of the replica in the group.
+func ClientAddress(group, id int) string {
+	return ":" + groupPort(4, group, id)
+}
+
+// The group of the replica, 0 unless sharded.
+func (node *RaftNode) group() int {
+	return node.Meta.Config.Layout.Group
+}
+
+// The route of a zone, as given by the routing table.
+type ShardRoute struct {
+	Zone  string `json:"zone"`  // Zone of the entry, empty for the default route to group 0
+	Group int    `json:"group"` // Group owning the zone, or receiving it while moving
+	From  int    `json:"from"`  // Group the zone is moving from, -1 unless moving
+}
+
+func (r ShardRoute) moving() bool {
+	return r.From >= 0
+}
+
+// Parse the value of an entry of the routing table, "<group>" or "<from>><to>" while moving.
+func parseShardRoute(z, value string) (ShardRoute, error) {
+
+	route := ShardRoute{Zone: z, From: -1}
+	groups := strings.Split(strings.TrimSpace(value), ">")
+
+	var err error
+
+	if len(groups) == 2 {
+		if route.From, err = strconv.Atoi(groups[0]); err != nil {
+			return route, fmt.Errorf("invalid route %q of zone %v", value, z)
+		}
+	}
+
+	if len(groups) > 2 {
+		return route, fmt.Errorf("invalid route %q of zone %v", value, z)
+	}
+
+	if route.Group, err = strconv.Atoi(groups[len(groups)-1]); err != nil {
+		return route, fmt.Errorf("invalid route %q of zone %v", value, z)
+	}
+
+	return route, nil
+}
+
+// The routing table, by zone.
+type shardTable map[string]ShardRoute
+
+// Return the route of the name: the entry of the most specific zone containing it, if any.
+func (t shardTable) routeName(name string) ShardRoute {
+
+	best := ShardRoute{From: -1}
+
+	for z, route := range t {
+		if zone.InZone(name, z) && len(z) > len(best.Zone) {
+			best = route
+		}
+	}
+
+	return best
+}
+
+// Return the route of the key, the default one unless it is a record.
+func (t shardTable) route(key string) ShardRoute {
+
+	name, _, ok := zone.ParseRecordKey(key)
+	if !ok {
+		return ShardRoute{From: -1}
+	}
+
+	return t.routeName(zone.CanonicalName(name))
+}
+
+// Return the route of the parent of the zone, the one the zone gets back when merged.
+func (t shardTable) parent(z string) ShardRoute {
+
+	without := make(shardTable, len(t))
+	for name, route := range t {
+		if name != z {
+			without[name] = route
+		}
+	}
+
+	return without.routeName(z)
+}
+
+/*
+The replicas of the groups hosted by a process, indexed by group. Each replica reads the routing table
+from the replica of group 0, and the replicas of the other groups are used to route the requests of
+the keys they own.
+*/
+type ShardHost struct {
+	groups []*RaftNode
+}
+
+// Create the host of the replicas of the groups, indexed by group.
+func NewShardHost(groups []*RaftNode) *ShardHost {
+
+	host := &ShardHost{groups: groups}
+
+	for _, node := range groups {
+		node.Meta.shards = host
+		node.RegisterLeaderJob(node.shardsJob())
+	}
+
+	return host
+}
+
+// Return the routing table, as applied by the replica of group 0.
+func (h *ShardHost) table() shardTable {
+
+	t := make(shardTable)
+
+	for setting, value := range h.groups[0].Meta.settings.All() {
+
+		if !strings.HasPrefix(setting, ShardPrefix) {
+			continue
+		}
+
+		z := zone.CanonicalName(strings.TrimPrefix(setting, ShardPrefix))
+
+		// The invalid routes (e.g. set by hand) are ignored.
+		route, err := parseShardRoute(z, value)
+		if err != nil || route.Group < 0 || route.Group >= len(h.groups) || route.From >= len(h.groups) {
+			continue
+		}
+
+		t[z] = route
+	}
+
+	return t
+}
+
+// Whether the replica of group 0 is up to date with its leader, so that the table is at most a
+// heartbeat behind.
+func (h *ShardHost) tableCurrent() bool {
+
+	meta := h.groups[0]
+
+	if meta.leaderSilence() > meta.Meta.Config.ElectionTimeoutMin {
+		return false
+	}
+
+	meta.GetRLock("Shard Table")
+	defer meta.ReleaseRLock("Shard Table")
+
+	return meta.commitIndex >= 0 && meta.lastApplied == meta.commitIndex
+}
+
+// Return the local replica of the group.
+func (h *ShardHost) node(group int) *RaftNode {
+	return h.groups[group]
+}
+
+// Return the addresses of the members of the group, their gRPC addresses if peer is set.
+func (h *ShardHost) addresses(group int, peer bool) []string {
+
+	node := h.groups[group]
+
+	node.GetRLock("Shard Addresses")
+	defer node.ReleaseRLock("Shard Addresses")
+
+	var addresses []string
+	for _, m := range node.Meta.members {
+		if peer {
+			addresses = append(addresses, m.Address)
+		} else if !m.Witness && !m.ConsensusOnly {
+			addresses = append(addresses, m.ClientAddress)
+		}
+	}
+
+	return addresses
+}
+
+// Return the client address of the replica of the group in this process.
+func (h *ShardHost) localAddress(group int) string {
+
+	node := h.groups[group]
+
+	node.GetRLock("Shard Local Address")
+	defer node.ReleaseRLock("Shard Local Address")
+
+	if m, ok := node.member(node.Meta.replica_id); ok {
+		return m.ClientAddress
+	}
+
+	return ClientAddress(group, int(node.Meta.replica_id))
+}
+
+// Check that the key may be written in the group of the replica.
+func (node *RaftNode) checkShardWrite(key string) error {
+
+	h := node.Meta.shards
+	if h == nil {
+		return nil
+	}
+
+	route := h.table().route(key)
+
+	if route.moving() {
+		return errShardMoving
+	}
+
+	if route.Group != node.group() {
+		return &wrongShardError{zone: route.Zone, group: route.Group, addresses: h.addresses(route.Group, false)}
+	}
+
+	return nil
+}
+
+// Return the gRPC status of an error of checkShardWrite, retryable while the zone is moving.
+func shardStatus(err error) error {
+
+	if err == errShardMoving {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+
+	return status.Error(codes.FailedPrecondition, err.Error())
+}
+
+// Return the local replica of the group serving the reads of the records of the name.
+func (node *RaftNode) shardOf(name string) *RaftNode {
+
+	h := node.Meta.shards
+	if h == nil {
+		return node
+	}
+
+	route := h.table().routeName(name)
+	if route.moving() {
+		return h.node(route.From)
+	}
+
+	return h.node(route.Group)
+}
+
+// Middleware answering the requests of the /{key} routes with 421 Misdirected Request when the key
+// belongs to another group. The writes of a moving zone are refused when proposed.
+func (node *RaftNode) shardMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		key, ok := mux.Vars(r)["key"]
+		h := node.Meta.shards
+
+		if h == nil || !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := h.table().route(key)
+		owner := route.Group
+
+		if route.moving() {
+
+			if httpTrafficClass(r) != classRead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			owner = route.From
+		}
+
+		if owner == node.group() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		address := h.localAddress(owner)
+
+		node.Meta.metrics.Add("shard_misdirected_total", 1, "group", strconv.Itoa(owner))
+		w.Header().Set(ShardHeader, address)
+		writeError(w, http.StatusMisdirectedRequest, "Error: Key %v belongs to group %v.\n\nReplica of group %v: %v", key, owner, owner, address)
+	})
+}
+
+// Job moving the zones to the group of the leader, completing the moves on group 0, and deleting the
+// records moved to another group.
+func (node *RaftNode) shardsJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "shards",
+		Interval: shardRefresh,
+		Run: func(ctx context.Context) error {
+
+			h := node.Meta.shards
+			if h == nil || !h.tableCurrent() {
+				return nil
+			}
+
+			table := h.table()
+
+			for z, route := range table {
+
+				if !route.moving() {
+					continue
+				}
+
+				if route.Group == node.group() {
+					if err := node.pullZone(ctx, table, route); err != nil {
+						node.logger().Warn().Err(err).Str("zone", z).Int("from", route.From).Msg("Unable to copy the zone from its former group")
+					}
+				}
+
+				if node.group() == 0 {
+					if err := node.completeMove(ctx, table, route); err != nil {
+						node.logger().Warn().Err(err).Str("zone", z).Msg("Unable to complete the move of the zone")
+					}
+				}
+			}
+
+			return node.dropMovedRecords(ctx, table)
+		},
+	}
+}
+
+// Return whether the key is a record routed by the entry of the zone.
+func (t shardTable) routedBy(z string) func(key string) bool {
+
+	return func(key string) bool {
+		name, _, ok := zone.ParseRecordKey(key)
+		return ok && zone.InZone(zone.CanonicalName(name), z) && t.routeName(zone.CanonicalName(name)).Zone == z
+	}
+}
+
+// Copy the records of the moving zone from its former group, through the log of the group.
+func (node *RaftNode) pullZone(ctx context.Context, table shardTable, route ShardRoute) error {
+
+	config := client.DefaultConfig(node.Meta.shards.addresses(route.From, true)...)
+	config.Token = node.Meta.Config.ClientToken
+
+	c, err := client.New(config)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return node.syncRecords(ctx, c, route.Zone, table.routedBy(route.Zone), shardClient+route.Zone)
+}
+
+// Return the records of the local store the filter selects, by key.
+func (node *RaftNode) localRecords(selected func(key string) bool) (map[string]string, error) {
+
+	kvs, err := node.scanLocalStore(zone.KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string]string)
+	for _, kv := range kvs {
+		if selected(kv.Key) {
+			records[kv.Key] = kv.Value
+		}
+	}
+
+	return records, nil
+}
+
+// Complete the move of the zone once the replicas of both groups in this process hold the same records,
+// routing the zone to its new group, or removing its entry if merged back to the group of its parent.
+func (node *RaftNode) completeMove(ctx context.Context, table shardTable, route ShardRoute) error {
+
+	h := node.Meta.shards
+	routed := table.routedBy(route.Zone)
+
+	from, err := h.node(route.From).localRecords(routed)
+	if err != nil {
+		return err
+	}
+
+	to, err := h.node(route.Group).localRecords(routed)
+	if err != nil {
+		return err
+	}
+
+	if len(from) != len(to) {
+		return nil
+	}
+
+	for key, value := range from {
+		if to[key] != value {
+			return nil
+		}
+	}
+
+	name, value, action := ShardPrefix+route.Zone, strconv.Itoa(route.Group), "SET"
+
+	if parent := table.parent(route.Zone); !parent.moving() && parent.Group == route.Group {
+		action = "UNSET"
+	}
+
+	node.GetRLock("Complete Shard Move")
+
+	if node.state != Leader {
+		node.ReleaseRLock("Complete Shard Move")
+		return errNotLeader
+	}
+
+	if _, success, err := node.proposeCommand(ctx, settingOperation(name, value, action, shardClient+route.Zone), shardClient+route.Zone); !success { // releases the lock
+		return err
+	}
+
+	node.Meta.metrics.Add("shard_moves_total", 1, "from", strconv.Itoa(route.From), "to", strconv.Itoa(route.Group))
+	node.logger().Info().Str("zone", route.Zone).Int("from", route.From).Int("to", route.Group).Int("records", len(from)).Msg("Completed the move of the zone")
+
+	return nil
+}
+
+// Delete the records of the local store belonging to another group, once held by the replica of that
+// group in this process.
+func (node *RaftNode) dropMovedRecords(ctx context.Context, table shardTable) error {
+
+	h := node.Meta.shards
+
+	kvs, err := node.scanLocalStore(zone.KeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	owned := make(map[int]map[string]string) // Records of the replicas of the other groups
+	ops := make(map[string][]kv_store.Op)    // Deletions by zone
+
+	for _, kv := range kvs {
+
+		route := table.route(kv.Key)
+		if route.moving() || route.Group == node.group() {
+			continue
+		}
+
+		if _, ok := owned[route.Group]; !ok {
+			if owned[route.Group], err = h.node(route.Group).localRecords(func(string) bool { return true }); err != nil {
+				return err
+			}
+		}
+
+		if value, ok := owned[route.Group][kv.Key]; ok && value == kv.Value {
+			ops[route.Zone] = append(ops[route.Zone], kv_store.Op{Type: kv_store.OpDelete, Key: kv.Key})
+		}
+	}
+
+	for z, deletions := range ops {
+
+		if err := node.proposeRecords(ctx, shardClient+z, deletions); err != nil {
+			return err
+		}
+
+		node.logger().Info().Str("zone", z).Int("records", len(deletions)).Msg("Deleted the records moved to another group")
+	}
+
+	return nil
+}
+
+// Handle requests listing the routing table.
+func (node *RaftNode) ShardsHandler(w http.ResponseWriter, r *http.Request) {
+
+	h := node.Meta.shards
+	if h == nil {
+		writeError(w, http.StatusNotFound, "Error: The replica isn't sharded, see -groups.")
+		return
+	}
+
+	routes := make([]ShardRoute, 0)
+	for _, route := range h.table() {
+		routes = append(routes, route)
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Zone < routes[j].Zone })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": len(h.groups), "group": node.group(), "routes": routes})
+}
+
+// Handle requests moving a zone to another group (zone=<zone>&group=<group>), on the leader of group 0.
+func (node *RaftNode) SplitShardHandler(w http.ResponseWriter, r *http.Request) {
+
+	z, table, ok := node.shardRequest(w, r)
+	if !ok {
+		return
+	}
+
+	group, err := strconv.Atoi(r.FormValue("group"))
+	if err != nil || group < 0 || group >= len(node.Meta.shards.groups) {
+		writeError(w, http.StatusBadRequest, "Invalid group: %q", r.FormValue("group"))
+		return
+	}
+
+	current := table.routeName(z)
+
+	switch {
+
+	case current.moving():
+		writeError(w, http.StatusConflict, "Error: Zone %v is moving from group %v to group %v.", z, current.From, current.Group)
+
+	case current.Group == group:
+		writeError(w, http.StatusConflict, "Error: Zone %v already belongs to group %v.", z, group)
+
+	default:
+		node.proposeShardRoute(w, r, z, fmt.Sprintf("%d>%d", current.Group, group), "SET")
+	}
+}
+
+// Handle requests moving a zone back to the group of its parent zone (zone=<zone>), on the leader of
+// group 0.
+func (node *RaftNode) MergeShardHandler(w http.ResponseWriter, r *http.Request) {
+
+	z, table, ok := node.shardRequest(w, r)
+	if !ok {
+		return
+	}
+
+	route, ok := table[z]
+	parent := table.parent(z)
+
+	switch {
+
+	case !ok:
+		writeError(w, http.StatusNotFound, "Error: Zone %v has no route.", z)
+
+	case route.moving() || parent.moving():
+		writeError(w, http.StatusConflict, "Error: Zone %v or its parent is moving.", z)
+
+	case route.Group == parent.Group:
+		node.proposeShardRoute(w, r, z, "", "UNSET")
+
+	default:
+		node.proposeShardRoute(w, r, z, fmt.Sprintf("%d>%d", route.Group, parent.Group), "SET")
+	}
+}
+
+// Parse the zone of a split or merge request, returning whether it may be served by the replica.
+func (node *RaftNode) shardRequest(w http.ResponseWriter, r *http.Request) (string, shardTable, bool) {
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return "", nil, false
+	}
+
+	if node.Meta.shards == nil {
+		writeError(w, http.StatusNotFound, "Error: The replica isn't sharded, see -groups.")
+		return "", nil, false
+	}
+
+	if node.group() != 0 {
+		writeError(w, http.StatusBadRequest, "Error: The routing table is replicated by group 0, send the request to %v.", node.Meta.shards.localAddress(0))
+		return "", nil, false
+	}
+
+	z := zone.CanonicalName(r.FormValue("zone"))
+	if z == "." || !settingNamePattern.MatchString(ShardPrefix+z) {
+		writeError(w, http.StatusBadRequest, "Invalid zone: %q", r.FormValue("zone"))
+		return "", nil, false
+	}
+
+	return z, node.Meta.shards.table(), true
+}
+
+// Change the route of the zone through the log of group 0, answering once applied on the leader.
+func (node *RaftNode) proposeShardRoute(w http.ResponseWriter, r *http.Request, z, value, action string) {
+
+	node.GetRLock("Shard Route Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Shard Route Handler")
+		return
+	}
+
+	author := r.FormValue("client")
+
+	index, success, err := node.proposeCommand(r.Context(), settingOperation(ShardPrefix+z, value, action, author), author) // releases the lock
+	if !success {
+		writeError(w, http.StatusServiceUnavailable, "Error occured in SHARD request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: Route committed but not applied yet: %v", err)
+		return
+	}
+
+	node.logger().Info().Str("zone", z).Str("route", value).Str("action", action).Int32("index", index).Msg("Shard route changed")
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"zone": z, "route": node.Meta.shards.table().routeName(z), "index": index})
+}
@@ -0,0 +1,131 @@
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+/*
+ * This test case checks the ports and files of the replicas of the groups,
+ * the routing of the keys by the routing table of group 0, the rejection of
+ * the writes of the keys of another group or of a moving zone, the 421 answers
+ * of the /{key} routes, and the checks of the split and merge requests.
+ */
+func TestShards(t *testing.T) {
+
+	if ClientAddress(0, 1) != ":4001" || PeerAddress(2, 1) != ":52001" || (DataLayout{Group: 2}).RaftFile(1) != "32001" || (DataLayout{}).StoreFile(1) != "6001" {
+		t.Errorf("Expected group 0 to keep the legacy ports and files, got %v %v %v", ClientAddress(0, 1), PeerAddress(2, 1), (DataLayout{Group: 2}).RaftFile(1))
+	}
+
+	groups := make([]*RaftNode, 2)
+	for g := range groups {
+		groups[g] = &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), rejections: NewRejections(), Config: DefaultConfig()}}
+		groups[g].Meta.Config.Layout.Group = g
+		groups[g].Meta.members = []Member{groupMember(g, 0), groupMember(g, 1)}
+	}
+
+	host := NewShardHost(groups)
+
+	for name, value := range map[string]string{"example.com.": "1", "sub.example.com.": "1>0", "bad.example.com.": "7"} {
+		groups[0].Meta.settings.apply(SettingChange{Name: ShardPrefix + name, Value: value})
+	}
+
+	table := host.table()
+
+	cases := []struct {
+		key   string
+		group int
+		from  int
+	}{
+		{zone.RecordKey("www.example.com", "A"), 1, -1},
+		{zone.RecordKey("a.sub.example.com", "A"), 0, 1},
+		{zone.RecordKey("www.bad.example.com", "A"), 1, -1}, // The invalid route is ignored
+		{zone.RecordKey("example.org", "A"), 0, -1},
+		{"app.config", 0, -1},
+	}
+
+	for _, c := range cases {
+		if route := table.route(c.key); route.Group != c.group || route.From != c.from {
+			t.Errorf("Expected %v to be routed to group %v from %v, got %+v", c.key, c.group, c.from, route)
+		}
+	}
+
+	if parent := table.parent("sub.example.com."); parent.Zone != "example.com." || parent.Group != 1 {
+		t.Errorf("Expected the parent of sub.example.com. to be example.com. in group 1, got %+v", parent)
+	}
+
+	err := groups[0].checkShardWrite(zone.RecordKey("www.example.com", "A"))
+	if wrong, ok := err.(*wrongShardError); !ok || wrong.group != 1 || strings.Join(wrong.addresses, ",") != ":41000,:41001" {
+		t.Errorf("Expected the write to be sent to group 1, got %v", err)
+	}
+
+	if err := groups[1].checkShardWrite(zone.RecordKey("a.sub.example.com", "A")); err != errShardMoving {
+		t.Errorf("Expected the write of the moving zone to be refused, got %v", err)
+	}
+
+	if err := groups[0].checkShardWrite("app.config"); err != nil {
+		t.Errorf("Expected group 0 to take the writes of the other keys, got %v", err)
+	}
+
+	// The reads of the /{key} routes are sent to the group owning the key, the former one while moving.
+	served := 0
+	r := mux.NewRouter()
+	r.Use(groups[0].shardMiddleware)
+	r.HandleFunc("/{key}", func(w http.ResponseWriter, r *http.Request) { served++ })
+
+	serve := func(method, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, "/"+url.PathEscape(key), nil))
+		return w
+	}
+
+	if w := serve("GET", zone.RecordKey("www.example.com", "A")); w.Code != http.StatusMisdirectedRequest || w.Header().Get(ShardHeader) != ":41000" {
+		t.Errorf("Expected the read to be sent to the replica of group 1, got %v %v", w.Code, w.Header())
+	}
+
+	if w := serve("GET", zone.RecordKey("a.sub.example.com", "A")); w.Code != http.StatusMisdirectedRequest || w.Header().Get(ShardHeader) != ":41000" {
+		t.Errorf("Expected the read of the zone moving from group 1 to be sent to group 1, got %v", w.Code)
+	}
+
+	// The writes of a moving zone are refused when proposed.
+	if w := serve("PUT", zone.RecordKey("a.sub.example.com", "A")); w.Code != http.StatusOK || served != 1 {
+		t.Errorf("Expected the write of the moving zone to reach its handler, got %v", w.Code)
+	}
+
+	if w := serve("POST", zone.RecordKey("example.org", "A")); w.Code != http.StatusOK || served != 2 {
+		t.Errorf("Expected group 0 to serve its keys, got %v", w.Code)
+	}
+
+	// The moves are checked against the routing table.
+	admin := func(handler http.HandlerFunc, form url.Values) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/admin/shards", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler(w, req)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		handler http.HandlerFunc
+		form    url.Values
+		code    int
+	}{
+		{groups[0].SplitShardHandler, url.Values{"zone": {"example.com"}, "group": {"1"}}, http.StatusConflict},
+		{groups[0].SplitShardHandler, url.Values{"zone": {"x.sub.example.com"}, "group": {"1"}}, http.StatusConflict},
+		{groups[0].SplitShardHandler, url.Values{"zone": {"example.org"}, "group": {"2"}}, http.StatusBadRequest},
+		{groups[0].MergeShardHandler, url.Values{"zone": {"example.org"}}, http.StatusNotFound},
+		{groups[0].MergeShardHandler, url.Values{"zone": {"sub.example.com"}}, http.StatusConflict},
+		{groups[1].SplitShardHandler, url.Values{"zone": {"example.org"}, "group": {"1"}}, http.StatusBadRequest},
+		{groups[0].SplitShardHandler, url.Values{"zone": {"example.org"}, "group": {"1"}}, http.StatusServiceUnavailable}, // Not the leader
+	} {
+		if code := admin(c.handler, c.form); code != c.code {
+			t.Errorf("Expected %v to be answered %v, got %v", c.form, c.code, code)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Load shedding by priority class. The requests served by the HTTP and gRPC servers of a replica share
+a capacity of MaxConcurrentRequests, and under overload the classes of lower priority are rejected
+first, so that the Raft RPCs between replicas always get through and the cluster stays available:
+
+	peer   Raft RPCs from the other replicas, never rejected (but counted towards the load)
+	admin  /admin endpoints (and /test and the probes), rejected once the whole capacity is in use
+	write  client writes, rejected from 90% of the capacity
+	read   client reads, rejected from 75% of the capacity
+	watch  new watch streams (and streams of leader changes, and exports), rejected from 50% of the capacity.
+	       Open streams are long lived, so they aren't counted towards the load.
+
+Rejected HTTP requests get a 503 Service Unavailable, and gRPC calls a ResourceExhausted status.
+*/
+
+type trafficClass int
+
+const (
+	classPeer trafficClass = iota
+	classAdmin
+	classWrite
+	classRead
+	classWatch
+)
+
+var trafficClassNames = []string{"peer", "admin", "write", "read", "watch"}
+
+func (c trafficClass) String() string {
+	return trafficClassNames[c]
+}
+
+// Percentage of the capacity in use from which requests of each class are rejected.
+var shedThresholds = []int64{classPeer: 0, classAdmin: 100, classWrite: 90, classRead: 75, classWatch: 50}
+
+// Counts the requests being served by the replica, safe for concurrent use.
+type loadShedder struct {
+	inflight int64 // Accessed atomically
+}
+
+// Admit a request of the given class, unless too many of the capacity's requests are already being
+// served. Admitted requests, other than watches, must be released with done. A capacity of 0 or less
+// disables shedding.
+func (s *loadShedder) admit(class trafficClass, capacity int) bool {
+
+	limit := int64(capacity) * shedThresholds[class]
+
+	if class == classWatch {
+		return capacity <= 0 || atomic.LoadInt64(&s.inflight)*100 < limit
+	}
+
+	inflight := atomic.AddInt64(&s.inflight, 1) - 1
+
+	if class == classPeer || capacity <= 0 || inflight*100 < limit {
+		return true
+	}
+
+	atomic.AddInt64(&s.inflight, -1)
+	return false
+}
+
+func (s *loadShedder) done() {
+	atomic.AddInt64(&s.inflight, -1)
+}
+
+// Return the class of a request to the client HTTP server.
+func httpTrafficClass(r *http.Request) trafficClass {
+
+	switch {
+
+	case leaderWatch(r):
+		return classWatch
+
+	case r.URL.Path == "/test" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/openapi.json" || strings.HasPrefix(r.URL.Path, "/admin/"):
+		return classAdmin
+
+	case r.Method == http.MethodGet, zoneValidation(r):
+		return classRead
+
+	}
+
+	return classWrite
+}
+
+// Return the class of a call to the gRPC server.
+func grpcTrafficClass(method string) trafficClass {
+
+	switch {
+
+	case strings.HasPrefix(method, "/protos.ConsensusService/"):
+		return classPeer
+
+	case method == "/protos.KVService/Watch" || method == "/protos.KVService/Export":
+		return classWatch
+
+	case method == "/protos.KVService/Get" || method == "/protos.KVService/Range":
+		return classRead
+
+	case strings.HasPrefix(method, "/protos.KVService/"):
+		return classWrite
+
+	}
+
+	return classAdmin
+}
+
+// Middleware rejecting requests with 503 Service Unavailable when the replica is too loaded for their class.
+func (node *RaftNode) sheddingMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		class := httpTrafficClass(r)
+
+		if !node.Meta.shedder.admit(class, node.Meta.Config.MaxConcurrentRequests) {
+			node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", "overload", "class", class.String())
+			if class == classWrite {
+				node.rejectRequest(rejectQuota, r, errors.New("too many concurrent requests"))
+			}
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "Error: too many concurrent requests, retry later.")
+			return
+		}
+
+		if class != classWatch {
+			defer node.Meta.shedder.done()
+		}
+
+		// The writes are then subject to the backpressure of the leader, see admission.go
+		if class == classWrite && !node.admitHTTPWrite(w, r) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+
+	})
+}
+
+// Admit a call to the gRPC server, returning the function releasing it.
+func (node *RaftNode) admitRPC(method string) (func(), error) {
+
+	class := grpcTrafficClass(method)
+
+	if !node.Meta.shedder.admit(class, node.Meta.Config.MaxConcurrentRequests) {
+		node.Meta.metrics.Add("grpc_server_shed_total", 1, "method", method, "class", class.String())
+		err := status.Errorf(codes.ResourceExhausted, "replica overloaded, %v requests are being shed", class)
+		if class == classWrite {
+			node.reject(rejectQuota, method, "", "", err)
+		}
+		return nil, err
+	}
+
+	if class == classWatch {
+		return func() {}, nil
+	}
+
+	return node.Meta.shedder.done, nil
+}
+
+func (node *RaftNode) sheddingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	done, err := node.admitRPC(info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// The writes are then subject to the backpressure of the leader, see admission.go
+	if grpcTrafficClass(info.FullMethod) == classWrite {
+		if err := node.admitRPCWrite(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+	}
+
+	return handler(ctx, req)
+}
+
+func (node *RaftNode) sheddingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	done, err := node.admitRPC(info.FullMethod)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return handler(srv, ss)
+}
@@ -0,0 +1,80 @@
+package raft
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+/*
+ * This test case checks that as the load of a replica grows, watches, reads,
+ * writes and admin requests are shed in that order, while the Raft RPCs of the
+ * peers are always admitted.
+ */
+func TestLoadShedding(t *testing.T) {
+
+	var s loadShedder
+	capacity := 10
+
+	admit := func(class trafficClass, n int) int {
+
+		admitted := 0
+		for i := 0; i < n; i++ {
+			if s.admit(class, capacity) {
+				admitted++
+			}
+		}
+
+		return admitted
+	}
+
+	if admit(classWatch, 3) != 3 || admit(classWrite, 5) != 5 {
+		t.Fatalf("Expected requests to be admitted when the replica isn't loaded")
+	}
+
+	// 5 of the 10 requests are in use, and watches aren't counted towards the load.
+	expected := []struct {
+		class    trafficClass
+		admitted int
+	}{
+		{classWatch, 0},
+		{classRead, 3},
+		{classWrite, 1},
+		{classAdmin, 1},
+		{classPeer, 10},
+	}
+
+	for _, e := range expected {
+		if admitted := admit(e.class, 10); admitted != e.admitted {
+			t.Errorf("Expected %v %v requests to be admitted, got %v", e.admitted, e.class, admitted)
+		}
+	}
+
+	for i := 0; i < 20; i++ {
+		s.done()
+	}
+
+	if !s.admit(classWatch, capacity) || s.inflight != 0 {
+		t.Errorf("Expected watches to be admitted once the load is gone, with %v requests in flight", s.inflight)
+	}
+
+	classes := map[trafficClass][]string{
+		classPeer:  {"/protos.ConsensusService/AppendEntries", "/protos.ConsensusService/RequestVote"},
+		classWatch: {"/protos.KVService/Watch"},
+		classRead:  {"/protos.KVService/Get", "/protos.KVService/Range"},
+		classWrite: {"/protos.KVService/Put", "/protos.KVService/Txn"},
+	}
+
+	for class, methods := range classes {
+		for _, method := range methods {
+			if c := grpcTrafficClass(method); c != class {
+				t.Errorf("Expected %v to be classified as %v, got %v", method, class, c)
+			}
+		}
+	}
+
+	if httpTrafficClass(httptest.NewRequest("GET", "/admin/status", nil)) != classAdmin ||
+		httpTrafficClass(httptest.NewRequest("GET", "/key", nil)) != classRead ||
+		httpTrafficClass(httptest.NewRequest("DELETE", "/key", nil)) != classWrite {
+		t.Errorf("Unexpected classification of HTTP requests")
+	}
+}
@@ -0,0 +1,430 @@
+package raft
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+var (
+	simRuns = flag.Int("sim.runs", 10, "number of seeded runs of TestSimulation")
+	simSeed = flag.Int64("sim.seed", 0, "seed of the first run of TestSimulation, the current time if 0")
+)
+
+const (
+	simReplicas = 5
+	simDuration = 3 * time.Second       // Duration of a run, on the clock of the simulation
+	simStep     = 5 * time.Millisecond  // Time the clock is advanced by at each step
+	simTimeout  = 20 * time.Millisecond // Time after which the RPCs whose messages are lost fail
+	simYields   = 4                     // Times the driver yields before checking that the replicas settled
+)
+
+// A cluster of replicas on a MemoryNetwork, run by TestSimulation.
+type simulation struct {
+	t       *testing.T
+	seed    int64
+	rand    *rand.Rand
+	clock   *ManualClock
+	network *MemoryNetwork
+	nodes   []*RaftNode
+	cancel  context.CancelFunc
+	stacks  []byte // Buffer of the dumps of the stacks of the goroutines, see settle
+
+	leaders   map[int32]int32    // Leader seen in each term
+	committed map[int32]simEntry // Entry seen committed at each index
+}
+
+// The term and operation of a log entry, as compared across replicas.
+type simEntry struct {
+	term      int32
+	operation string
+}
+
+func newSimulation(t *testing.T, seed int64, dir string) *simulation {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sim := &simulation{
+		t:         t,
+		seed:      seed,
+		rand:      rand.New(rand.NewSource(seed)),
+		clock:     NewManualClock(time.Unix(0, 0)),
+		network:   NewMemoryNetwork(seed),
+		nodes:     make([]*RaftNode, simReplicas),
+		cancel:    cancel,
+		stacks:    make([]byte, 64<<10),
+		leaders:   make(map[int32]int32),
+		committed: make(map[int32]simEntry),
+	}
+
+	sim.network.DropRate = 0.05
+	sim.network.MaxDelay = 2 * simStep
+	sim.network.Timeout = simTimeout
+	sim.network.Clock = sim.clock
+
+	addrs := make([]string, simReplicas)
+	for i := range addrs {
+		addrs[i] = ":sim" + strconv.Itoa(i)
+	}
+
+	for i := range sim.nodes {
+
+		node := InitializeNode(simReplicas, i, addrs[i], DataLayout{})
+
+		logger := zerolog.Nop()
+		node.Meta.logger = &logger
+		node.Meta.raft_persistence_file = filepath.Join(dir, fmt.Sprintf("%v-%v", seed, i))
+		node.Meta.Master_ctx, node.Meta.Master_cancel = ctx, cancel
+		node.Meta.clock, node.Meta.raft_clock = sim.clock, sim.clock
+		node.Meta.timeouts = rand.New(rand.NewSource(seed + int64(i)))
+
+		node.Meta.Config.ElectionTimeoutMin = 50 * time.Millisecond
+		node.Meta.Config.ElectionTimeoutMax = 100 * time.Millisecond
+		node.Meta.Config.HeartbeatInterval = 10 * time.Millisecond
+		node.Meta.Config.RPCTimeout = time.Hour // on the wall clock: the network times the RPCs out instead
+
+		// The leader jobs (e.g. giving the cluster its ID, see jobs.go) run on the wall clock, and
+		// aren't part of the simulation.
+		node.jobs.jobs = nil
+
+		sim.network.Register(int32(i), node)
+		sim.nodes[i] = node
+	}
+
+	for i, node := range sim.nodes {
+		go node.ApplyToStateMachine(ctx, true)
+		node.connectPeers(ctx, addrs, sim.network.Transports(int32(i), simReplicas))
+	}
+
+	return sim
+}
+
+// Drive the cluster for simDuration: writes are proposed to the leader while the network is
+// partitioned and healed at random, and the safety properties are checked at every step. At each
+// step, the timers of the clock due within simStep (those of the replicas and the messages of the
+// network) fire one at a time, the replicas settling after each: the wall clock plays no part.
+func (sim *simulation) run() {
+
+	defer sim.stop()
+
+	sequence := 0
+
+	for elapsed := time.Duration(0); elapsed < simDuration; elapsed += simStep {
+
+		switch r := sim.rand.Float64(); {
+
+		case r < 0.01:
+			sim.partition()
+
+		case r < 0.025:
+			sim.network.Partition()
+
+		case r < 0.3:
+			sequence++
+			go sim.propose(strconv.Itoa(sequence))
+			sim.settle()
+
+		}
+
+		for until := sim.clock.Now().Add(simStep); sim.clock.Fire(until); {
+			sim.settle()
+		}
+
+		if !sim.check() {
+			return
+		}
+	}
+}
+
+// Stop the replicas, and wait for them to settle.
+func (sim *simulation) stop() {
+
+	sim.cancel()
+	sim.settle()
+}
+
+// Wait until the replicas settle, i.e. no goroutine but the caller's can run: they are all waiting
+// for the clock, the network or each other. Only the next timer fired then moves the cluster on, so
+// that the replicas react to each in the same way when a seed is replayed.
+func (sim *simulation) settle() {
+
+	buf := sim.stacks
+
+	for {
+
+		// The goroutines are given a chance to block before each dump, which stops them all.
+		for i := 0; i < simYields; i++ {
+			runtime.Gosched()
+		}
+
+		n := runtime.Stack(buf, true)
+		if n == len(buf) {
+			buf = make([]byte, 2*len(buf))
+			sim.stacks = buf
+			continue
+		}
+
+		if !simBusy(string(buf[:n])) {
+			return
+		}
+	}
+}
+
+// Return whether a goroutine other than the first one (the caller) of the given dump of their stacks
+// is running, ready to run, or sleeping (e.g. a write waiting for the entries committed to be applied,
+// see proposeCommand).
+func simBusy(dump string) bool {
+
+	for _, trace := range strings.Split(dump, "\n\n")[1:] {
+
+		// e.g. "goroutine 7 [select, 2 minutes]:"
+		header := trace[:strings.IndexByte(trace+"\n", '\n')]
+
+		start, end := strings.IndexByte(header, '['), strings.IndexAny(header, ",]")
+		if start < 0 || end < start {
+			continue
+		}
+
+		switch header[start+1 : end] {
+		case "running", "runnable", "syscall", "copystack", "preempted", "sleep":
+			return true
+		}
+	}
+
+	return false
+}
+
+// Split the replicas into two random groups.
+func (sim *simulation) partition() {
+
+	var groups [2][]int32
+	for _, i := range sim.rand.Perm(simReplicas) {
+		g := sim.rand.Intn(2)
+		groups[g] = append(groups[g], int32(i))
+	}
+
+	sim.network.Partition(groups[0], groups[1])
+}
+
+// Propose a write to every replica that believes it is the leader.
+func (sim *simulation) propose(value string) {
+
+	for _, node := range sim.nodes {
+
+		node.GetRLock("Simulation")
+
+		if node.state != Leader {
+			node.ReleaseRLock("Simulation")
+			continue
+		}
+
+		// The write waits for its outcome, the network failing the RPCs whose messages are lost.
+		node.proposeCommand(node.Meta.Master_ctx, []string{"NO-OP", value}, "sim") // releases the lock
+	}
+}
+
+// Check election safety, log matching and state machine safety over the current state of the
+// replicas, reporting a violation along with the seed of the run.
+func (sim *simulation) check() bool {
+
+	logs := make([][]simEntry, simReplicas)
+	commits := make([]int32, simReplicas)
+
+	for i, node := range sim.nodes {
+
+		node.GetRLock("Simulation Check")
+
+		if node.state == Leader {
+			if leader, ok := sim.leaders[node.currentTerm]; ok && leader != int32(i) {
+				node.ReleaseRLock("Simulation Check")
+				sim.t.Errorf("seed %v: election safety violated, replicas %v and %v are both leaders of term %v", sim.seed, leader, i, node.currentTerm)
+				return false
+			}
+			sim.leaders[node.currentTerm] = int32(i)
+		}
+
+		for k := range node.log {
+			logs[i] = append(logs[i], simEntry{term: node.log[k].Term, operation: strings.Join(node.log[k].Operation, " ")})
+		}
+		commits[i] = node.commitIndex
+
+		node.ReleaseRLock("Simulation Check")
+	}
+
+	// If two logs hold an entry with the same index and term, the logs are identical up to it.
+	for i := range logs {
+		for j := i + 1; j < len(logs); j++ {
+
+			last := len(logs[i])
+			if len(logs[j]) < last {
+				last = len(logs[j])
+			}
+
+			for k := last - 1; k >= 0; k-- {
+				if logs[i][k].term != logs[j][k].term {
+					continue
+				}
+
+				for l := 0; l <= k; l++ {
+					if logs[i][l] != logs[j][l] {
+						sim.t.Errorf("seed %v: log matching violated, replicas %v and %v agree at index %v but differ at %v", sim.seed, i, j, k, l)
+						return false
+					}
+				}
+
+				break
+			}
+		}
+	}
+
+	// No two replicas commit different entries at an index, and a committed entry never changes.
+	for i, log := range logs {
+		for k := int32(0); k <= commits[i] && k < int32(len(log)); k++ {
+
+			if entry, ok := sim.committed[k]; ok && entry != log[k] {
+				sim.t.Errorf("seed %v: state machine safety violated, replica %v committed %v at index %v, after %v", sim.seed, i, log[k].operation, k, entry.operation)
+				return false
+			}
+
+			sim.committed[k] = log[k]
+		}
+	}
+
+	return true
+}
+
+// Return a new directory for the files of the replicas, in memory if possible: the simulation waits for
+// their writes, whose syncs would otherwise take most of a run.
+func simDir() (string, error) {
+
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return ioutil.TempDir("/dev/shm", "simulation")
+	}
+
+	return ioutil.TempDir("", "simulation")
+}
+
+// Environment variable set in the process running the simulation, see simIsolated.
+const simProcessEnv = "RAFT_SIMULATION_PROCESS"
+
+/*
+Run the test in a process of its own, running it alone, and return true once it is done; or return
+false if called in that process, which then runs the test. The replicas only settle once every
+goroutine but the driver's is blocked (see settle), which the goroutines left running by the other
+tests of the package would hold up.
+*/
+func simIsolated(t *testing.T, seed int64) bool {
+
+	if os.Getenv(simProcessEnv) != "" {
+		return false
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v", "-test.timeout", flag.Lookup("test.timeout").Value.String(), "-sim.runs", strconv.Itoa(*simRuns), "-sim.seed", strconv.FormatInt(seed, 10))
+	cmd.Env = append(os.Environ(), simProcessEnv+"=1")
+
+	output, err := cmd.CombinedOutput()
+
+	if err != nil {
+		t.Fatalf("The simulation failed: %v\n%s", err, output)
+	}
+
+	if testing.Verbose() {
+		t.Logf("%s", output)
+	}
+
+	return true
+}
+
+// Summarize the outcome of the run, which a replay of its seed reproduces.
+func (sim *simulation) summary() string {
+	return fmt.Sprintf("leaders %v, committed %v, %v messages delivered, %v dropped, at %v", sim.leaders, sim.committed, sim.network.Delivered, sim.network.Dropped, sim.clock.Now().UnixNano())
+}
+
+/*
+ * This test case runs clusters of replicas on an in-memory network, which
+ * drops, delays and reorders messages and is partitioned at random, and
+ * checks that the safety properties of Raft hold throughout. The faults and
+ * the workload are drawn from the seed of each run, reported on failure and
+ * given with -sim.seed to replay the run: the Raft timers, the messages and
+ * the RPC timeouts all run on a ManualClock whose timers fire one at a time,
+ * the replicas settling in between, so a replay goes through the same
+ * states. The default runs keep the test short; CI runs thousands of seeds
+ * with e.g. -run TestSimulation -sim.runs 2000 -timeout 2h.
+ */
+func TestSimulation(t *testing.T) {
+
+	seed := *simSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	if simIsolated(t, seed) {
+		return
+	}
+
+	dir, err := simDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for run := 0; run < *simRuns && !t.Failed(); run++ {
+
+		sim := newSimulation(t, seed+int64(run), dir)
+		sim.run()
+
+		if len(sim.leaders) == 0 {
+			t.Errorf("seed %v: no leader was elected", sim.seed)
+		}
+
+		t.Logf("seed %v: %v terms with a leader, %v entries committed, %v messages delivered, %v dropped", sim.seed, len(sim.leaders), len(sim.committed), sim.network.Delivered, sim.network.Dropped)
+	}
+}
+
+/*
+ * This test case checks that a run of the simulation is reproduced by a
+ * replay of its seed.
+ */
+func TestSimulationReplay(t *testing.T) {
+
+	if simIsolated(t, 1) {
+		return
+	}
+
+	dir, err := simDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var runs [2]*simulation
+
+	for i := range runs {
+
+		sub := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		runs[i] = newSimulation(t, 1, sub)
+		runs[i].run()
+	}
+
+	first, replay := runs[0], runs[1]
+
+	if first.summary() != replay.summary() {
+		t.Errorf("Expected the replay to reproduce the run:\n%v\n%v", first.summary(), replay.summary())
+	}
+}
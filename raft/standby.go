@@ -0,0 +1,303 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Cold standby. A standby isn't a member of any cluster: it periodically pulls a snapshot of the key-
+value store from the replicas of the primary cluster (see SnapshotHandler in admin.go), checks it
+against the digest reported with it, and keeps the latest one on disk along with a .meta file in the
+format of raftctl snapshot, so that raftctl verify-snapshot can check it too.
+
+If the primary cluster is lost, the replicas of a fresh cluster are started with -restore <snapshot>,
+which loads the snapshot into their key-value store before they start (see RestoreSnapshot): every
+replica then starts from the same state, with an empty log. The settings, users, roles and client
+sessions are part of the snapshot.
+*/
+
+// The settings of a standby.
+type StandbyConfig struct {
+	Sources  []string      // Client HTTP addresses of the replicas of the primary cluster, e.g. localhost:4000
+	Interval time.Duration // Time between two pulls
+	Path     string        // File the latest snapshot is kept in
+	Token    string        // Bearer token presented to the replicas, if they require authentication
+	CAFile   string        // PEM certificate of the CA of the replicas, if they serve HTTPS
+}
+
+// The metadata kept next to the snapshot of a standby, compatible with the .meta files of raftctl.
+type StandbySnapshot struct {
+	SnapshotDigest
+	Checksum string    `json:"checksum"` // Hex encoded SHA-256 hash of the snapshot file
+	Source   string    `json:"source"`
+	Fetched  time.Time `json:"fetched"`
+}
+
+/*
+Run a standby until the context is cancelled, pulling a snapshot from the first source able to
+serve one at each interval. A snapshot is only kept if it is consistent and newer than the previous
+one, which is replaced atomically.
+*/
+func RunStandby(ctx context.Context, config StandbyConfig) error {
+
+	if len(config.Sources) == 0 {
+		return errors.New("a standby needs the address of at least one replica")
+	}
+
+	client, scheme := &http.Client{Timeout: time.Minute}, "http"
+
+	if config.CAFile != "" {
+
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %v", config.CAFile)
+		}
+
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		scheme = "https"
+	}
+
+	latest := StandbySnapshot{SnapshotDigest: SnapshotDigest{AppliedIndex: -1}}
+	if contents, err := ioutil.ReadFile(config.Path + ".meta"); err == nil {
+		json.Unmarshal(contents, &latest)
+	}
+
+	for {
+
+		snapshot, err := pullSnapshot(ctx, client, scheme, config, latest.SnapshotDigest)
+
+		switch {
+
+		case err != nil:
+			logging.Logger.Warn().Err(err).Msg("Unable to pull a snapshot")
+
+		case snapshot == nil:
+			logging.Logger.Debug().Int32("applied_index", latest.AppliedIndex).Msg("Standby snapshot is up to date")
+
+		default:
+			latest = *snapshot
+			logging.Logger.Info().Str("source", latest.Source).Int32("applied_index", latest.AppliedIndex).Int64("revision", latest.Revision).Msg("Standby snapshot updated")
+
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(config.Interval):
+		}
+	}
+}
+
+// Pull a snapshot of the same cluster newer than the latest one and save it, returning nil if there
+// is none.
+func pullSnapshot(ctx context.Context, client *http.Client, scheme string, config StandbyConfig, latest SnapshotDigest) (*StandbySnapshot, error) {
+
+	var errs []string
+
+	for _, source := range config.Sources {
+
+		contents, digest, err := fetchSnapshot(ctx, client, fmt.Sprintf("%s://%s/admin/snapshot", scheme, source), config.Token)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", source, err))
+			continue
+		}
+
+		// The snapshots of another cluster, e.g. a source added by mistake, are never mixed with the
+		// ones kept, see cluster_id.go.
+		if latest.ClusterID != "" && digest.ClusterID != "" && digest.ClusterID != latest.ClusterID {
+			errs = append(errs, fmt.Sprintf("%v: the snapshot belongs to cluster %v, expected cluster %v", source, digest.ClusterID, latest.ClusterID))
+			continue
+		}
+
+		if digest.AppliedIndex <= latest.AppliedIndex {
+			return nil, nil
+		}
+
+		checksum := sha256.Sum256(contents)
+		snapshot := &StandbySnapshot{
+			SnapshotDigest: digest,
+			Checksum:       hex.EncodeToString(checksum[:]),
+			Source:         source,
+			Fetched:        time.Now(),
+		}
+
+		return snapshot, saveStandbySnapshot(config.Path, contents, snapshot)
+	}
+
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// Fetch a snapshot from a replica, and check that it matches the digest reported along with it.
+func fetchSnapshot(ctx context.Context, client *http.Client, url, token string) ([]byte, SnapshotDigest, error) {
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, SnapshotDigest{}, err
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, SnapshotDigest{}, err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, SnapshotDigest{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, SnapshotDigest{}, fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(contents)))
+	}
+
+	applied, _ := strconv.Atoi(resp.Header.Get("X-Raft-Applied-Index"))
+	term, _ := strconv.Atoi(resp.Header.Get("X-Raft-Term"))
+	revision, _ := strconv.ParseInt(resp.Header.Get("X-Store-Revision"), 10, 64)
+
+	expected := SnapshotDigest{AppliedIndex: int32(applied), Term: int32(term), Revision: revision, Digest: resp.Header.Get("X-Store-Digest"), ClusterID: resp.Header.Get("X-Cluster-Id")}
+
+	digest, err := kv_store.VerifySnapshot(bytes.NewReader(contents))
+	if err != nil {
+		return nil, SnapshotDigest{}, err
+	}
+
+	if digest.Digest != expected.Digest || digest.Revision != expected.Revision {
+		return nil, SnapshotDigest{}, fmt.Errorf("digest mismatch: the snapshot contains revision %v with digest %v, expected revision %v with digest %v",
+			digest.Revision, digest.Digest, expected.Revision, expected.Digest)
+	}
+
+	return contents, expected, nil
+}
+
+// Replace the snapshot at the given path and its metadata, through renames so that a crash leaves
+// either the previous or the new snapshot.
+func saveStandbySnapshot(path string, contents []byte, snapshot *StandbySnapshot) error {
+
+	meta, _ := json.MarshalIndent(snapshot, "", "  ")
+
+	if err := ioutil.WriteFile(path+".tmp", contents, 0644); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".meta.tmp", meta, 0644); err != nil {
+		return err
+	}
+
+	// The metadata is removed first, so that it never describes another snapshot.
+	os.Remove(path + ".meta")
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".meta.tmp", path+".meta")
+}
+
+/*
+Load a snapshot into the key-value store of the given replica before it is started, to promote a
+standby into a fresh cluster. The snapshot is checked first, and is only loaded by a replica without
+any persisted state in the given layout, so that an existing cluster is never overwritten. The path
+may also be that of a backup (see backup.go), whose snapshot is checked against its metadata.
+*/
+func RestoreSnapshot(path string, id int, layout DataLayout) error {
+
+	store, sessions, base, digest, err := readSnapshotFile(path)
+	if err != nil {
+		return err
+	}
+
+	kv_file, raft_file := layout.StoreFile(id), layout.RaftFile(id)
+
+	// The database of a bolt store would take precedence over the restored file, see kv_store.OpenStore.
+	for _, file := range []string{kv_file, kv_file + ".db", raft_file} {
+		if fi, err := os.Stat(file); err == nil && fi.Size() > 0 {
+			return fmt.Errorf("replica %v already has persisted state in %v, refusing to restore over it", id, file)
+		}
+	}
+
+	if err := ioutil.WriteFile(kv_file, store, 0644); err != nil {
+		return err
+	}
+
+	// The raft state of a fresh replica, holding the restored sessions.
+	storage := NewStorage()
+	storage.Set("currentTerm", int32(0))
+	storage.Set("votedFor", int32(-1))
+	storage.Set("log", []protos.LogEntry{})
+	storage.Set("commitIndex", int32(-1))
+	storage.Set("lastApplied", int32(-1))
+	storage.Set("sessions", sessions)
+	storage.Set("sessionBase", base)
+	storage.WriteFile(raft_file)
+
+	logging.Logger.Info().Str("snapshot", path).Int64("revision", digest.Revision).Str("digest", digest.Digest).Int("sessions", len(sessions)).Msg("Restored snapshot")
+
+	return nil
+}
+
+// Read and verify the snapshot, or the backup, in the given file. Return the contents of its
+// key-value store, its client sessions and the base of the IDs of the sessions registered after it.
+func readSnapshotFile(path string) ([]byte, map[int64]clientSession, int64, kv_store.Digest, error) {
+
+	var digest kv_store.Digest
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, 0, digest, err
+	}
+
+	if isBackup(contents) {
+
+		meta, snapshot, err := ReadBackup(bytes.NewReader(contents))
+		if err != nil {
+			return nil, nil, 0, digest, err
+		}
+
+		logging.Logger.Info().Str("backup", path).Int32("term", meta.Term).Int32("applied_index", meta.AppliedIndex).Str("members", encodeMembers(meta.Members)).Time("created", meta.Created).Msg("Reading backup")
+		contents = snapshot
+	}
+
+	r := bytes.NewReader(contents)
+
+	digest, err = kv_store.VerifySnapshot(r)
+	if err != nil {
+		return nil, nil, 0, digest, err
+	}
+
+	// The client sessions follow the store, see SnapshotHandler.
+	store := contents[:len(contents)-r.Len()]
+
+	sessions, base, err := restoredSessions(r)
+	if err != nil {
+		return nil, nil, 0, digest, err
+	}
+
+	return store, sessions, base, digest, nil
+}
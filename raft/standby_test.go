@@ -0,0 +1,104 @@
+package raft
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+ * This test case checks that a standby only keeps snapshots matching their
+ * digest, of the same cluster and newer than the one it has, and that a
+ * snapshot is only restored into a replica without persisted state, along
+ * with its client sessions.
+ */
+func TestStandbySnapshot(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "standby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+
+	post := httptest.NewRequest(http.MethodPost, "/a", strings.NewReader(url.Values{"value": {"1"}}.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	kv.PostHandler(httptest.NewRecorder(), post)
+
+	applied, digest := "5", ""
+
+	// A replica serving the snapshot of the store, as SnapshotHandler in admin.go does.
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		stored := httptest.NewRecorder()
+		kv.SnapshotHandler(stored, r)
+
+		for name, values := range stored.Header() {
+			w.Header()[name] = values
+		}
+
+		w.Header().Set("X-Raft-Applied-Index", applied)
+		w.Header().Set("X-Raft-Term", "2")
+		w.Header().Set("X-Cluster-Id", "primary")
+		if digest != "" {
+			w.Header().Set("X-Store-Digest", digest)
+		}
+
+		w.Write(stored.Body.Bytes())
+		encodeSessions(w, map[int64]clientSession{3: {LastSequence: 4, LastIndex: 9}})
+	}))
+	defer replica.Close()
+
+	config := StandbyConfig{Sources: []string{"localhost:1", strings.TrimPrefix(replica.URL, "http://")}, Path: filepath.Join(dir, "standby.snapshot")}
+
+	snapshot, err := pullSnapshot(context.Background(), http.DefaultClient, "http", config, SnapshotDigest{AppliedIndex: -1})
+	if err != nil || snapshot == nil || snapshot.AppliedIndex != 5 || snapshot.Revision != 1 || snapshot.ClusterID != "primary" {
+		t.Fatalf("Expected the snapshot at applied index 5 to be pulled from the second source, got %+v (%v)", snapshot, err)
+	}
+
+	if _, err := os.Stat(config.Path + ".meta"); err != nil {
+		t.Errorf("Expected the metadata to be saved next to the snapshot: %v", err)
+	}
+
+	if snapshot, err := pullSnapshot(context.Background(), http.DefaultClient, "http", config, SnapshotDigest{AppliedIndex: 5}); snapshot != nil || err != nil {
+		t.Errorf("Expected a snapshot that isn't newer to be skipped, got %+v (%v)", snapshot, err)
+	}
+
+	applied = "6"
+	if _, err := pullSnapshot(context.Background(), http.DefaultClient, "http", config, SnapshotDigest{AppliedIndex: 5, ClusterID: "another"}); err == nil {
+		t.Errorf("Expected the snapshot of another cluster to be rejected")
+	}
+
+	applied, digest = "6", "tampered"
+	if _, err := pullSnapshot(context.Background(), http.DefaultClient, "http", config, SnapshotDigest{AppliedIndex: 5}); err == nil {
+		t.Errorf("Expected a snapshot not matching its digest to be rejected")
+	}
+
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(dir)
+
+	if err := RestoreSnapshot(config.Path, 7, DataLayout{}); err != nil {
+		t.Fatalf("Expected the snapshot to be restored into a fresh replica: %v", err)
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{raft_persistence_file: "3007"}, storage: NewStorage()}
+	node.RestoreFromStorage(node.storage)
+
+	if s, ok := node.sessions[3]; !ok || s.LastSequence != 4 || s.LastIndex != -1 || node.sessionBase != 4 || len(node.log) != 0 {
+		t.Errorf("Expected session 3 to be restored before the first entry, got %+v (base %v)", node.sessions, node.sessionBase)
+	}
+
+	if err := RestoreSnapshot(config.Path, 7, DataLayout{}); err == nil {
+		t.Errorf("Expected a replica with persisted state to refuse the snapshot")
+	}
+}
@@ -0,0 +1,304 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+)
+
+/*
+The state machine the committed entries are applied to. The Raft core only reaches the state of a
+replica through this interface, so that the storage of the keys can change without affecting it.
+There are two implementations, selected by Config.StoreBackend (-store-backend):
+
+	map   mapStateMachine holds the keys in memory, the store being rewritten to its file on every
+	      change. This is the default.
+	bolt  boltStateMachine holds the keys in a bbolt database, to which every entry applied is
+	      committed as a single transaction. The keys then needn't fit in memory.
+
+Both apply the entries to a local key-value store (see kv_store/backend.go) in process, which keeps
+the revisions, the history and the hooks of the keys whichever backend holds them, so that the
+replicas of a cluster agree on their digests and may use different backends. An entry is applied by
+a call to the store rather than a request, so that it can't time out once the store applied it, to be
+applied again later. The store is also served over HTTP (see StartKVStore), for its digest, usage,
+compression and change stream.
+*/
+type StateMachine interface {
+
+	// Apply the operation of a committed entry, returning the changes it made. POST, PUT and
+	// DELETE change a single key, TXN applies a JSON encoded kv_store.Txn, DELETE_PREFIX deletes
+	// all the keys with a prefix and COMPACT compacts the history up to a revision. An operation the
+	// state machine doesn't apply is an error, the entry then being applied again later, while an
+	// operation that made no change (e.g. the POST of an existing key) isn't. The result holds the
+	// previous values of the changed keys, see audit.go
+	Apply(operation []string) (kv_store.TxnResult, error)
+
+	// Return the persisted form of the state (see kv_store.VerifySnapshot), along with its digest.
+	Snapshot() ([]byte, kv_store.Digest, error)
+
+	// Replace the state by the given snapshot, returning its digest.
+	Restore(snapshot []byte) (kv_store.Digest, error)
+
+	// Read the state, returning the response to the query (e.g. a key, or "prefix/<prefix>") and
+	// its HTTP status code.
+	Lookup(query string) (string, int, error)
+}
+
+// A state machine held by the replica, whose store is also served over HTTP by StartKVStore.
+type localStateMachine interface {
+	StateMachine
+	Router() *mux.Router
+	Close() error
+}
+
+// Open the state machine of the given backend, held in the given file (see DataLayout.StoreFile).
+func openStateMachine(backend, filename string) (localStateMachine, error) {
+
+	var sm localStateMachine
+	var err error
+
+	switch backend {
+
+	case "", kv_store.BackendMap:
+		sm, err = newMapStateMachine(filename)
+
+	case kv_store.BackendBolt:
+		sm, err = newBoltStateMachine(filename)
+
+	default:
+		return nil, fmt.Errorf("unknown store backend %q, expected %v or %v", backend, kv_store.BackendMap, kv_store.BackendBolt)
+
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sm, nil
+}
+
+// Return the state machine of the replica, which fails every operation until its store is opened.
+func (node *RaftNode) stateMachine() StateMachine {
+
+	if node.Meta.state_machine == nil {
+		return &storeStateMachine{closed: true}
+	}
+
+	return node.Meta.state_machine
+}
+
+// The state machine holding the keys in memory (the map backend of the store, see kv_store/backend.go).
+type mapStateMachine struct {
+	*storeStateMachine
+}
+
+func newMapStateMachine(filename string) (*mapStateMachine, error) {
+
+	kv, err := kv_store.OpenStore(filename, kv_store.BackendMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mapStateMachine{newStoreStateMachine(kv)}, nil
+}
+
+// The state machine holding the keys in the bbolt database "<filename>.db" (the bolt backend of the
+// store, see kv_store/bolt.go). The keys of a map store in the file are imported on the first start.
+type boltStateMachine struct {
+	*storeStateMachine
+}
+
+func newBoltStateMachine(filename string) (*boltStateMachine, error) {
+
+	kv, err := kv_store.OpenStore(filename, kv_store.BackendBolt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStateMachine{newStoreStateMachine(kv)}, nil
+}
+
+// The operations of the local key-value store (see kv_store.OpenStore) the state machines use.
+type localStore interface {
+	Create(key, value string) kv_store.TxnResult
+	Update(key, value string) kv_store.TxnResult
+	Remove(key string) kv_store.TxnResult
+	Txn(txn kv_store.Txn) kv_store.TxnResult
+	DeletePrefix(prefix string) kv_store.TxnResult
+	Compact(rev int64) int64
+	Snapshot() ([]byte, kv_store.Digest, error)
+	Restore(snapshot []byte) (kv_store.Digest, error)
+	RegisterHook(hook kv_store.Hook)
+	Router() *mux.Router
+	Close() error
+}
+
+// The operations of a state machine on its local key-value store, shared by the backends.
+type storeStateMachine struct {
+	mu     sync.RWMutex // Held exclusively to close the store, the other operations then failing
+	closed bool
+	kv     localStore
+	router *mux.Router // Routes of the store, serving the lookups
+}
+
+var errStateMachineClosed = errors.New("the key-value store isn't open")
+
+// Return the state machine of the store, on which the hooks of the replicas are registered (see
+// hooks.go) so that every write is seen by them.
+func newStoreStateMachine(kv localStore) *storeStateMachine {
+
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	return &storeStateMachine{kv: kv, router: kv.Router()}
+}
+
+func (sm *storeStateMachine) Apply(operation []string) (kv_store.TxnResult, error) {
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if sm.closed {
+		return kv_store.TxnResult{}, errStateMachineClosed
+	}
+
+	switch operation[0] {
+
+	case "POST":
+		return sm.kv.Create(operation[1], operation[2]), nil
+
+	case "PUT":
+		return sm.kv.Update(operation[1], operation[2]), nil
+
+	case "DELETE":
+		return sm.kv.Remove(operation[1]), nil
+
+	case "TXN":
+
+		// An invalid transaction is never applied, so it changes nothing rather than failing.
+		var txn kv_store.Txn
+		if err := json.Unmarshal([]byte(operation[1]), &txn); err != nil {
+			logging.Logger.Error().Err(err).Msg("Unable to decode a transaction")
+			return kv_store.TxnResult{}, nil
+		}
+
+		return sm.kv.Txn(txn), nil
+
+	case "DELETE_PREFIX":
+		return sm.kv.DeletePrefix(operation[1]), nil
+
+	case "COMPACT":
+
+		rev, err := strconv.ParseInt(operation[1], 10, 64)
+		if err != nil {
+			logging.Logger.Error().Err(err).Msg("Unable to decode the revision of a compaction")
+			return kv_store.TxnResult{}, nil
+		}
+
+		sm.kv.Compact(rev)
+		return kv_store.TxnResult{Succeeded: true}, nil
+
+	}
+
+	return kv_store.TxnResult{}, fmt.Errorf("operation %v isn't applied to the state machine", operation[0])
+}
+
+func (sm *storeStateMachine) Snapshot() ([]byte, kv_store.Digest, error) {
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if sm.closed {
+		return nil, kv_store.Digest{}, errStateMachineClosed
+	}
+
+	return sm.kv.Snapshot()
+}
+
+func (sm *storeStateMachine) Restore(snapshot []byte) (kv_store.Digest, error) {
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if sm.closed {
+		return kv_store.Digest{}, errStateMachineClosed
+	}
+
+	return sm.kv.Restore(snapshot)
+}
+
+// The query is served by the routes of the store, as it would be over HTTP.
+func (sm *storeStateMachine) Lookup(query string) (string, int, error) {
+
+	req, err := http.NewRequest(http.MethodGet, "/"+query, nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if sm.closed {
+		return "", 0, errStateMachineClosed
+	}
+
+	var response lookupResponse
+	sm.router.ServeHTTP(&response, req)
+
+	return response.body.String(), response.status, nil
+}
+
+func (sm *storeStateMachine) Router() *mux.Router {
+	return sm.kv.Router()
+}
+
+// Close the store, once the operations in progress are done.
+func (sm *storeStateMachine) Close() error {
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.closed {
+		return nil
+	}
+
+	sm.closed = true
+	return sm.kv.Close()
+}
+
+// The response of the store to a lookup.
+type lookupResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *lookupResponse) Header() http.Header {
+
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+
+	return r.header
+}
+
+func (r *lookupResponse) WriteHeader(status int) {
+
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *lookupResponse) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
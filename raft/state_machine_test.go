@@ -0,0 +1,167 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+)
+
+/*
+ * This test case checks that the operations of the committed entries are applied to the state
+ * machines of both store backends with the same changes, and that the snapshot of one of them
+ * restores the other.
+ */
+func TestStateMachine(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "state_machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stateMachine := func(filename, backend string) StateMachine {
+
+		sm, err := openStateMachine(backend, filepath.Join(dir, filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sm.Close() })
+
+		return sm
+	}
+
+	txn, _ := json.Marshal(kv_store.Txn{
+		Compare: []kv_store.Compare{{Key: "b", Condition: kv_store.CompareValueEqual, Value: "2"}},
+		Success: []kv_store.Op{{Type: kv_store.OpPut, Key: "c", Value: "3"}, {Type: kv_store.OpDelete, Key: "a"}},
+	})
+
+	operations := []struct {
+		operation []string
+		events    int
+	}{
+		{[]string{"POST", "a", "1"}, 1},
+		{[]string{"POST", "a", "again"}, 0}, // already exists
+		{[]string{"POST", "b", "1"}, 1},
+		{[]string{"PUT", "b", "2"}, 1},
+		{[]string{"PUT", "missing", "2"}, 0},
+		{[]string{"TXN", string(txn)}, 2},
+		{[]string{"DELETE", "missing"}, 0},
+		{[]string{"COMPACT", "2"}, 0},
+	}
+
+	machines := []StateMachine{stateMachine("map", kv_store.BackendMap), stateMachine("bolt", kv_store.BackendBolt)}
+
+	if _, ok := machines[0].(*mapStateMachine); !ok {
+		t.Errorf("Expected the map backend to be selected, got %T", machines[0])
+	}
+
+	if _, ok := machines[1].(*boltStateMachine); !ok {
+		t.Errorf("Expected the bolt backend to be selected, got %T", machines[1])
+	}
+
+	if _, err := openStateMachine("unknown", filepath.Join(dir, "unknown")); err == nil {
+		t.Errorf("Expected an unknown backend to be rejected")
+	}
+
+	for _, sm := range machines {
+		for _, op := range operations {
+
+			result, err := sm.Apply(op.operation)
+			if err != nil {
+				t.Fatalf("Unable to apply %v: %v", op.operation, err)
+			}
+
+			if len(result.Events) != op.events {
+				t.Errorf("Expected %v events applying %v, got %v", op.events, op.operation, result.Events)
+			}
+		}
+	}
+
+	if _, err := machines[0].Apply([]string{"NO-OP"}); err == nil {
+		t.Errorf("Expected an operation without changes not to be applied")
+	}
+
+	snapshots := make([]kv_store.Digest, len(machines))
+	var snapshot []byte
+
+	for i, sm := range machines {
+
+		snapshot, snapshots[i], err = sm.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if contents, status, err := sm.Lookup("c"); err != nil || status != http.StatusOK || !strings.Contains(contents, "3") {
+			t.Errorf("Expected c = 3, got %q (%v, %v)", contents, status, err)
+		}
+	}
+
+	if snapshots[0] != snapshots[1] || snapshots[0].Revision != 4 {
+		t.Errorf("Expected the backends to agree at revision 4, got %v and %v", snapshots[0], snapshots[1])
+	}
+
+	// The snapshot of the bolt backend, restored to a fresh map backend.
+	digest, err := stateMachine("restored", kv_store.BackendMap).Restore(snapshot)
+	if err != nil || digest != snapshots[1] {
+		t.Errorf("Expected the restored digest %v, got %v (%v)", snapshots[1], digest, err)
+	}
+
+	if _, err := machines[0].Restore([]byte("invalid")); err == nil {
+		t.Errorf("Expected an invalid snapshot to be rejected")
+	}
+}
+
+/*
+ * This test case checks that the entries are applied to the store once, with
+ * the previous values of their keys, and that a closed state machine fails
+ * them without changing the store.
+ */
+func TestStateMachineClosed(t *testing.T) {
+
+	filename := filepath.Join(t.TempDir(), "store")
+
+	sm, err := openStateMachine(kv_store.BackendBolt, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.Apply([]string{"POST", "a", "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := sm.Apply([]string{"PUT", "a", "2"})
+	if err != nil || !result.Succeeded || result.PreviousValue(0) == nil || *result.PreviousValue(0) != "1" {
+		t.Errorf("Expected the previous value of the key, got %v (%v)", result, err)
+	}
+
+	_, before, _ := sm.Snapshot()
+
+	if err := sm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.Apply([]string{"PUT", "a", "3"}); err != errStateMachineClosed {
+		t.Errorf("Expected the entry to fail once the state machine is closed, got %v", err)
+	}
+
+	if _, _, err := sm.Lookup("a"); err != errStateMachineClosed {
+		t.Errorf("Expected the lookup to fail once the state machine is closed, got %v", err)
+	}
+
+	// Reopened, the store holds the changes made before it was closed only.
+	sm, err = openStateMachine(kv_store.BackendBolt, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.Close()
+
+	if _, after, _ := sm.Snapshot(); after != before || after.Revision != 2 {
+		t.Errorf("Expected the store to be left at %v, got %v", before, after)
+	}
+}
@@ -2,7 +2,6 @@ package raft
 
 import (
 	"context"
-	"log"
 
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
 )
@@ -10,9 +9,12 @@ import (
 // Method to transition the replica to Follower state.
 func (node *RaftNode) ToFollower(ctx context.Context, term int32) {
 
-	log.Printf("\nIn ToFollower, previous state: %v\n", node.state)
+	node.logger().Debug().Int32("term", term).Str("previous_state", node.state.String()).Msg("In ToFollower")
 	prevState := node.state
 	node.state = Follower
+	if term != node.currentTerm {
+		node.termChanged(term)
+	}
 	node.currentTerm = term
 	node.votedFor = -1
 
@@ -22,14 +24,13 @@ func (node *RaftNode) ToFollower(ctx context.Context, term int32) {
 	// candidate, reset the election timer.
 
 	if prevState == Leader {
+		node.stopLeaderJobs()
 		go node.RunElectionTimer(ctx)
 	} else {
-		go func() {
-			node.electionResetEvent <- true
-		}()
+		node.resetElectionTimer()
 	}
 
-	log.Printf("\nReplica %v finished ToFollower\n", node.Meta.replica_id)
+	node.logger().Info().Int32("term", term).Str("previous_state", prevState.String()).Msg("Became follower")
 }
 
 // ToCandidate is called when election timer runs out
@@ -38,6 +39,7 @@ func (node *RaftNode) ToCandidate(ctx context.Context) {
 
 	node.state = Candidate
 	node.currentTerm++
+	node.termChanged(node.currentTerm)
 	node.votedFor = node.Meta.replica_id
 	node.PersistToStorage()
 	// We can start an election for the candidate to become the leader
@@ -47,24 +49,33 @@ func (node *RaftNode) ToCandidate(ctx context.Context) {
 // ToLeader is called when the candidate gets majority votes in election
 func (node *RaftNode) ToLeader(ctx context.Context) {
 
-	log.Printf("\nTransitioning to leader\n")
+	node.logger().Debug().Int32("term", node.currentTerm).Msg("Transitioning to leader")
 
-	// Stop election timer since leader doesn't need it
-	node.stopElectiontimer <- true
+	// Stop election timer since leader doesn't need it. It isn't waited for: the timer may have run
+	// out already, and be waiting for the lock held here, in which case it stops by itself.
+	select {
+	case node.stopElectiontimer <- true:
+	default:
+	}
 
 	node.state = Leader
+	term := node.currentTerm
+	node.setLeader(node.Meta.replica_id, node.Meta.nodeAddress)
 
-	node.nextIndex = make([]int32, node.Meta.n_replicas, node.Meta.n_replicas)
-	node.matchIndex = make([]int32, node.Meta.n_replicas, node.Meta.n_replicas)
+	// nextIndex and matchIndex are indexed by replica ID, like the peer clients.
+	size := int32(len(node.Meta.peer_replica_clients))
+
+	node.nextIndex = make([]int32, size, size)
+	node.matchIndex = make([]int32, size, size)
 
 	// Initialize nextIndex, matchIndex
-	for replica_id := int32(0); replica_id < node.Meta.n_replicas; replica_id++ {
+	for replica_id := int32(0); replica_id < size; replica_id++ {
 
 		if int32(replica_id) == node.Meta.replica_id {
 			continue
 		}
 
-		node.nextIndex[replica_id] = int32(len(node.log))
+		node.nextIndex[replica_id] = node.lastLogIndex() + 1
 		node.matchIndex[replica_id] = int32(0)
 
 	}
@@ -73,7 +84,7 @@ func (node *RaftNode) ToLeader(ctx context.Context) {
 	var operation []string
 	operation = append(operation, "NO-OP")
 
-	node.log = append(node.log, protos.LogEntry{Term: node.currentTerm, Operation: operation, Clientid: " "})
+	node.log = append(node.log, protos.LogEntry{Term: node.currentTerm, Operation: operation, Clientid: " ", Timestamp: node.now().UnixNano()})
 
 	msg := &protos.AppendEntriesMessage{
 
@@ -84,6 +95,8 @@ func (node *RaftNode) ToLeader(ctx context.Context) {
 		LatestClient: node.Meta.latestClient,
 	}
 
+	index := node.lastLogIndex()
+
 	node.PersistToStorage()
 	node.ReleaseLock("ToLeader1")
 
@@ -91,15 +104,15 @@ func (node *RaftNode) ToLeader(ctx context.Context) {
 	for {
 
 		success := make(chan bool)
-		node.LeaderSendAEs("NO-OP", msg, int32(len(node.log)-1), success)
+		node.LeaderSendAEs(context.Background(), "NO-OP", msg, index, success)
 
 		if <-success {
 
 			node.GetLock("ToLeader")
-			node.commitIndex++
+			node.commitReplicated(index, term)
 			node.PersistToStorage()
 			node.ReleaseLock("ToLeader2")
-			node.commits_ready <- 1
+			node.notifyCommits()
 			break
 
 		} else {
@@ -107,18 +120,72 @@ func (node *RaftNode) ToLeader(ctx context.Context) {
 			node.GetRLock("ToLeader")
 
 			if node.state != Leader {
-				log.Printf("\nStopped attempting transition to leader\n")
+				node.logger().Info().Msg("Stopped attempting transition to leader")
 				node.ReleaseRLock("ToLeader1")
 				return
 			}
 
 			node.ReleaseRLock("ToLeader2")
+
+			// The outcome is known as soon as a majority is unreachable (see LeaderSendAEs), their probes
+			// still being in flight: the retries are spaced by a heartbeat interval.
+			select {
+			case <-ctx.Done():
+				return
+			case <-node.after(node.Meta.Config.HeartbeatInterval):
+			}
 		}
 
 	}
 
 	go node.HeartBeats(ctx)
+	node.startLeaderJobs(ctx, term)
+
+	node.logger().Info().Msg("Transitioned to leader")
+
+}
+
+// Commit the entries up to the given index, once it was replicated on a majority of the replicas by the
+// leader of the given term. Nothing is committed if the entry was replaced since, e.g. by a later leader,
+// or if a later entry was committed already. Must be called with the lock held.
+func (node *RaftNode) commitReplicated(index int32, term int32) {
+
+	if index > node.commitIndex && node.hasEntry(index) && node.entry(index).Term == term {
+		node.commitIndex = index
+	}
+}
+
+// Record the leader of the current term. If leadership moved to another replica, the clients
+// watching for changes are notified of the new leader. Must be called with the lock held.
+func (node *RaftNode) setLeader(leader_id int32, address string) {
+
+	changed := leader_id != node.Meta.leader_id || address != node.Meta.leaderAddress
+
+	node.Meta.leader_id = leader_id
+	node.Meta.leaderAddress = address
+
+	if changed {
+		node.logger().Info().Int32("term", node.currentTerm).Int32("leader_id", leader_id).Str("leader_address", address).Msg("Leader changed")
+		node.watches.Notify(&protos.WatchEvent{Leader: node.leaderInfo()})
+	}
+}
 
-	log.Printf("\nTransitioned to leader\n")
+// Return the last known leader, or nil if it isn't known. Must be called with the (read) lock held.
+func (node *RaftNode) leaderInfo() *protos.LeaderInfo {
+
+	if node.Meta.leader_id < 0 {
+		return nil
+	}
+
+	info := &protos.LeaderInfo{
+		Id:      node.Meta.leader_id,
+		Address: node.Meta.leaderAddress,
+		Term:    node.currentTerm,
+	}
+
+	if m, ok := node.member(node.Meta.leader_id); ok {
+		info.GrpcAddress = m.Address
+	}
 
+	return info
 }
@@ -3,10 +3,10 @@ package raft
 import (
 	"encoding/gob"
 	"fmt"
-	"log"
 	"os"
 	"sync"
 
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
 )
 
@@ -19,6 +19,7 @@ type Storage struct {
 func NewStorage() *Storage {
 
 	gob.Register([]protos.LogEntry{})
+	gob.Register(map[int64]clientSession{})
 
 	m := make(map[string]interface{})
 	return &Storage{
@@ -26,9 +27,10 @@ func NewStorage() *Storage {
 	}
 }
 
-// Encode as gob and write to file for persistence.
+// Encode as gob and write to file for persistence. The data is written to a temporary file, synced and
+// renamed over the previous one, so that a crash leaves either the previous or the new state on disk.
 func (stored *Storage) WriteFile(filename string) {
-	dataFile, err := os.Create(filename)
+	dataFile, err := os.Create(filename + ".tmp")
 
 	if err != nil {
 		fmt.Println(err)
@@ -40,11 +42,19 @@ func (stored *Storage) WriteFile(filename string) {
 
 	err = dataEncoder.Encode(stored.m)
 
-	if err != nil {
-		log.Printf("Error in WriteFile: %v", err.Error())
+	if err == nil {
+		err = dataFile.Sync()
 	}
 
 	dataFile.Close()
+
+	if err == nil {
+		err = os.Rename(filename+".tmp", filename)
+	}
+
+	if err != nil {
+		logging.Logger.Error().Err(err).Msg("Error in WriteFile")
+	}
 }
 
 // Read the file and decode the gob.
@@ -110,34 +120,68 @@ func (node *RaftNode) RestoreFromStorage(storage *Storage) {
 	var t1, t2, t3, t4, t5 interface{}
 
 	if t1, check = node.storage.Get("currentTerm", node.Meta.raft_persistence_file); !check {
-		log.Fatalf("\nFatal: persisted data found, but currentTerm not found in storage\n")
+		node.logger().Fatal().Msg("Persisted data found, but currentTerm not found in storage")
 	}
 
 	node.currentTerm = t1.(int32)
 
 	if t2, check = node.storage.Get("votedFor", node.Meta.raft_persistence_file); !check {
-		log.Fatalf("\nFatal: persisted data found, but votedFor not found in storage\n")
+		node.logger().Fatal().Msg("Persisted data found, but votedFor not found in storage")
 	}
 
 	node.votedFor = t2.(int32)
 
 	if t3, check = node.storage.Get("log", node.Meta.raft_persistence_file); !check {
-		log.Fatalf("\nFatal: persisted data found, but log not found in storage\n")
+		node.logger().Fatal().Msg("Persisted data found, but log not found in storage")
 	}
 
 	node.log = t3.([]protos.LogEntry)
 
 	if t4, check = node.storage.Get("commitIndex", node.Meta.raft_persistence_file); !check {
-		log.Fatalf("\nFatal: persisted data found, but commitIndex not found in storage\n")
+		node.logger().Fatal().Msg("Persisted data found, but commitIndex not found in storage")
 	}
 
 	node.commitIndex = t4.(int32)
 
 	if t5, check = node.storage.Get("lastApplied", node.Meta.raft_persistence_file); !check {
-		log.Fatalf("\nFatal: persisted data found, but lastApplied not found in storage\n")
+		node.logger().Fatal().Msg("Persisted data found, but lastApplied not found in storage")
 	}
 
 	node.lastApplied = t5.(int32)
+
+	// The client sessions were added later on, and may be missing from older files.
+	if t6, check := node.storage.Get("sessions", node.Meta.raft_persistence_file); check {
+		node.sessions = t6.(map[int64]clientSession)
+	}
+
+	// Only set in clusters restored from a snapshot, see RestoreSnapshot.
+	if t7, check := node.storage.Get("sessionBase", node.Meta.raft_persistence_file); check {
+		node.sessionBase = t7.(int64)
+	}
+
+	// Missing until the cluster has an ID, see cluster_id.go.
+	if t8, check := node.storage.Get("clusterID", node.Meta.raft_persistence_file); check {
+		node.cluster_id.Store(t8.(string))
+	}
+
+	// Missing until the log starts after a snapshot, see log.go.
+	if t9, check := node.storage.Get("logStart", node.Meta.raft_persistence_file); check {
+		node.logStart = t9.(int32)
+	}
+
+	if t10, check := node.storage.Get("logStartTerm", node.Meta.raft_persistence_file); check {
+		node.logStartTerm = t10.(int32)
+	}
+
+	if t11, check := node.storage.Get("logStartMembers", node.Meta.raft_persistence_file); check {
+
+		members, err := decodeMembers(t11.(string))
+		if err != nil {
+			node.logger().Fatal().Err(err).Msg("Persisted data found, but logStartMembers is invalid")
+		}
+
+		node.logStartMembers = members
+	}
 }
 
 func (node *RaftNode) PersistToStorage() {
@@ -147,6 +191,18 @@ func (node *RaftNode) PersistToStorage() {
 	node.storage.Set("log", node.log)
 	node.storage.Set("commitIndex", node.commitIndex)
 	node.storage.Set("lastApplied", node.lastApplied)
+	node.storage.Set("sessions", node.sessions)
+	node.storage.Set("sessionBase", node.sessionBase)
+	node.storage.Set("logStart", node.logStart)
+	node.storage.Set("logStartTerm", node.logStartTerm)
+
+	if node.logStartMembers != nil {
+		node.storage.Set("logStartMembers", encodeMembers(append([]Member(nil), node.logStartMembers...)))
+	}
+
+	if id := node.clusterID(); id != "" {
+		node.storage.Set("clusterID", id)
+	}
 
 	node.storage.WriteFile(node.Meta.raft_persistence_file)
 
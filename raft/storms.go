@@ -0,0 +1,187 @@
+package raft
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+Detection of the election storms. A cluster without a stable leader (e.g. a peer whose messages are
+delayed beyond the election timeout, or a flapping link) can go through election after election, the
+replicas timing out at about the same time and splitting the votes. Each replica records the times
+its term changes: more than stormTerms changes within stormWindow are a storm, which is logged with
+a diagnosis of the peers (whether they are reachable, their consecutive failed RPCs, the time of their
+latest successful RPC and response to AppendEntries, and their round-trip time), and counted in
+election_storms_total.
+
+During a storm, the replica widens its election timeouts, multiplying the timeouts drawn between
+ElectionTimeoutMin and ElectionTimeoutMax by a factor doubling with each storm, up to
+maxStormFactor. The wider range of the timeouts makes it likelier that a candidate wins before the
+others time out, and gives the slow peers time to answer. The timeouts are restored once no storm was
+seen for stormCooldown. The factor is reported in the election_timeout_factor gauge.
+
+The safety of Raft doesn't depend on the election timeouts: while they are widened, only a failed
+leader takes longer to be replaced.
+*/
+
+const (
+	stormTerms     = 3                // Term changes within stormWindow beyond which the elections are a storm
+	stormWindow    = 10 * time.Second // Window over which the term changes are counted
+	stormCooldown  = time.Minute      // Time without a storm after which the election timeouts are restored
+	maxStormFactor = 4                // Largest factor the election timeouts are widened by
+)
+
+// The term changes of the replica and the widening of its election timeouts, safe for concurrent use.
+// The zero value has seen no storm.
+type stormDetector struct {
+	mu     sync.Mutex
+	terms  []time.Time // Times of the term changes within the window
+	factor int         // Factor the election timeouts are widened by, 0 or 1 if they aren't
+	until  time.Time   // Time the timeouts are restored, unless another storm is seen
+}
+
+// The diagnosis of a peer logged on a storm.
+type stormPeer struct {
+	Id          int32      `json:"id"`
+	Reachable   bool       `json:"reachable"`
+	Failures    int        `json:"failures"`               // Consecutive failed RPCs
+	LastSuccess *time.Time `json:"last_success,omitempty"` // Time of its latest successful RPC, nil if none yet
+	LastContact *time.Time `json:"last_contact,omitempty"` // Time of its latest AppendEntries response, nil if none yet
+	RTT         string     `json:"rtt,omitempty"`          // Round-trip time of its latest successful RPCs, see recordPeerRTT
+}
+
+// Record a change of the term of the replica, widening the election timeouts if the changes are a storm.
+// Must be called with the lock held.
+func (node *RaftNode) termChanged(term int32) {
+
+	now := node.now()
+	s := &node.storms
+
+	s.mu.Lock()
+
+	recent := s.terms[:0]
+	for _, t := range s.terms {
+		if now.Sub(t) < stormWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.terms = append(recent, now)
+
+	if len(s.terms) <= stormTerms {
+		s.mu.Unlock()
+		return
+	}
+
+	// The changes counted by the next storm start after this one.
+	changes := len(s.terms)
+	s.terms = nil
+
+	if s.factor < 1 {
+		s.factor = 1
+	}
+	if s.factor < maxStormFactor {
+		s.factor *= 2
+	}
+	s.until = now.Add(stormCooldown)
+	factor := s.factor
+
+	s.mu.Unlock()
+
+	node.Meta.metrics.Add("election_storms_total", 1)
+	node.Meta.metrics.Set("election_timeout_factor", float64(factor))
+
+	node.logger().Warn().Int32("term", term).Int("term_changes", changes).Dur("window", stormWindow).
+		Int("timeout_factor", factor).Interface("peers", node.stormDiagnosis()).
+		Msg("Election storm, widening the election timeouts")
+}
+
+// Return the diagnosis of the peers. Must be called with the lock held.
+func (node *RaftNode) stormDiagnosis() []stormPeer {
+
+	var peers []stormPeer
+
+	for _, m := range node.Meta.members {
+
+		if m.Id == node.Meta.replica_id {
+			continue
+		}
+
+		peer := stormPeer{Id: m.Id, Reachable: !node.unreachable(m.Id)}
+
+		failures, success := node.peerRPCs(m.Id)
+		if peer.Failures = failures; !success.IsZero() {
+			peer.LastSuccess = &success
+		}
+
+		if contact, ok := node.last_contact[m.Id]; ok {
+			peer.LastContact = &contact
+		}
+
+		if rtt := node.peerRTT(m.Id); rtt > 0 {
+			peer.RTT = rtt.String()
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
+
+// Return the timeout of the next election timer, widened during a storm.
+func (node *RaftNode) widenedElectionTimeout() time.Duration {
+
+	s := &node.storms
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The seeded source of the timeouts (if any) isn't safe for concurrent use.
+	timeout := node.Meta.Config.electionTimeout(node.Meta.timeouts)
+
+	if s.factor <= 1 {
+		return timeout
+	}
+
+	if !node.now().Before(s.until) {
+		s.factor = 1
+		node.Meta.metrics.Set("election_timeout_factor", 1)
+		node.logger().Info().Msg("No election storm lately, restoring the election timeouts")
+		return timeout
+	}
+
+	return timeout * time.Duration(s.factor)
+}
+
+// Record the round-trip time of a successful RPC sent to a peer, smoothed over the latest RPCs.
+func (node *RaftNode) recordPeerRTT(id int32, rtt time.Duration) {
+
+	node.peers.mu.Lock()
+	defer node.peers.mu.Unlock()
+
+	p, ok := node.peers.peers[id]
+	if !ok {
+		return // recordPeerRPC is called first
+	}
+
+	if p.rtt == 0 {
+		p.rtt = rtt
+	} else {
+		p.rtt = (7*p.rtt + rtt) / 8
+	}
+
+	node.Meta.metrics.Set("raft_peer_rtt_seconds", p.rtt.Seconds(), "peer", strconv.Itoa(int(id)))
+}
+
+// Return the smoothed round-trip time of the RPCs sent to the peer, 0 if none succeeded yet.
+func (node *RaftNode) peerRTT(id int32) time.Duration {
+
+	node.peers.mu.Lock()
+	defer node.peers.mu.Unlock()
+
+	if p, ok := node.peers.peers[id]; ok {
+		return p.rtt
+	}
+
+	return 0
+}
@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that more than stormTerms term changes within
+ * stormWindow widen the election timeouts, by a factor doubling with each
+ * storm up to maxStormFactor, that the diagnosis covers the peers, and that
+ * the timeouts are restored once no storm was seen for stormCooldown.
+ */
+func TestElectionStorms(t *testing.T) {
+
+	clock := NewManualClock(time.Unix(100, 0))
+	members := []Member{{Id: 0}, {Id: 1}, {Id: 2}}
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), Config: DefaultConfig(), clock: clock, members: members}, last_contact: make(map[int32]time.Time)}
+	min, max := node.Meta.Config.ElectionTimeoutMin, node.Meta.Config.ElectionTimeoutMax
+
+	within := func(factor time.Duration) {
+		for i := 0; i < 20; i++ {
+			if timeout := node.widenedElectionTimeout(); timeout < factor*min || timeout > factor*max {
+				t.Fatalf("Expected an election timeout widened by %v, got %v", factor, timeout)
+			}
+		}
+	}
+
+	// Term changes spread beyond the window aren't a storm.
+	for term := int32(1); term <= 6; term++ {
+		node.termChanged(term)
+		clock.Advance(4 * time.Second)
+	}
+	within(1)
+
+	node.recordPeerRPC(1, "AppendEntries", nil)
+	node.recordPeerRTT(1, 10*time.Millisecond)
+	node.recordPeerRPC(2, "RequestVote", errors.New("connection refused"))
+
+	for term := int32(7); term <= 10; term++ {
+		node.termChanged(term)
+		clock.Advance(time.Second)
+	}
+	within(2)
+
+	if got := node.Meta.metrics.Get("election_storms_total"); got != 1 {
+		t.Errorf("Expected a storm, got %v", got)
+	}
+
+	peers := node.stormDiagnosis()
+	if len(peers) != 2 || peers[0].RTT != "10ms" || peers[0].LastSuccess == nil || !peers[1].Reachable || peers[1].Failures != 1 {
+		t.Errorf("Expected the diagnosis of both peers, got %+v", peers)
+	}
+
+	for storm := 0; storm < 3; storm++ {
+		for i := 0; i <= stormTerms; i++ {
+			node.termChanged(int32(11 + 4*storm + i))
+		}
+	}
+	within(maxStormFactor)
+
+	if got := node.Meta.metrics.Get("election_timeout_factor"); got != maxStormFactor {
+		t.Errorf("Expected the factor gauge to be %v, got %v", maxStormFactor, got)
+	}
+
+	clock.Advance(stormCooldown)
+	within(1)
+
+	if got := node.Meta.metrics.Get("election_timeout_factor"); got != 1 {
+		t.Errorf("Expected the timeouts to be restored, got a factor of %v", got)
+	}
+}
@@ -11,11 +11,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
 	"github.com/krithikvaidya/distributed-dns/raft/protos"
 )
 
 type oldConnections struct {
-	vertices []protos.ConsensusServiceClient
+	vertices []Transport
 }
 
 type testing_st struct {
@@ -58,7 +59,7 @@ func start_test(t *testing.T, n int) *testing_st {
 		master_ctx, master_cancel := context.WithCancel(context.Background())
 
 		// Obtain the RaftNode object for the current node
-		new_test_st.nodes[i] = Setup_raft_node(master_ctx, i, new_test_st.n, true)
+		new_test_st.nodes[i] = Setup_raft_node(master_ctx, i, new_test_st.n, kv_store.BackendMap, DataLayout{}, true)
 
 		// Set the master context and cancel entities in the node metadata struct
 		new_test_st.nodes[i].Meta.Master_ctx = master_ctx
@@ -80,7 +81,7 @@ func start_test(t *testing.T, n int) *testing_st {
 	// store backups of all connections
 	for i := 0; i < n; i++ {
 		new_test_st.backup[i] = &oldConnections{
-			vertices: make([]protos.ConsensusServiceClient, n),
+			vertices: make([]Transport, n),
 		}
 	}
 
@@ -99,9 +100,17 @@ func end_test(test_st *testing_st) {
 	for i := 0; i < test_st.n; i++ {
 		// Cancel the master contexts of each of the nodes
 		test_st.nodes[i].Meta.Master_cancel()
+	}
+
+	// padding time so that the OS recognises that the sockets have been
+	// unbound from the ports.
+	time.Sleep(5 * time.Second)
+
+	for i := 0; i < test_st.n; i++ {
 
 		/*
-		 * Remove the persistent files
+		 * Remove the persistent files, once the nodes stopped persisting
+		 * their state.
 		 *
 		 * Here, the filenames starting with `600` and ending with
 		 * the id of the node represent the kv store files and the files
@@ -111,13 +120,11 @@ func end_test(test_st *testing_st) {
 		fname_kv_store := "600" + strconv.Itoa(i)
 		fname_raft_persistent := "300" + strconv.Itoa(i)
 		os.Remove(fname_kv_store)
+		os.Remove(fname_kv_store + ".db")
 		os.Remove(fname_raft_persistent)
+		os.Remove(fname_raft_persistent + ".tmp")
 	}
 
-	// padding time so that the OS recognises that the sockets have been
-	// unbound from the ports.
-	time.Sleep(5 * time.Second)
-
 }
 
 /*
@@ -146,7 +153,7 @@ func (test_st *testing_st) restart_raft_node(id int) {
 	master_ctx, master_cancel := context.WithCancel(context.Background())
 
 	// Obtain the RaftNode object for the node
-	test_st.nodes[id] = Setup_raft_node(master_ctx, id, test_st.n, true)
+	test_st.nodes[id] = Setup_raft_node(master_ctx, id, test_st.n, kv_store.BackendMap, DataLayout{}, true)
 
 	// Set the master context and cancel entities in the node metadata struct
 	test_st.nodes[id].Meta.Master_ctx = master_ctx
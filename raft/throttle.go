@@ -0,0 +1,253 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+Throttling of snapshot transfers. Streaming a snapshot to a peer (a standby pulling /admin/snapshot,
+see standby.go) competes with the replication of the client writes for the disk and network of the
+replica, so the bytes sent to each peer are limited to a rate adapting to the latency of the writes.
+
+The latency of the writes committed by the replica is averaged over each snapshotAdjustInterval.
+While no transfer is in progress, it feeds the baseline latency. During a transfer, an interval whose
+latency exceeds both SnapshotLatencyTarget and snapshotLatencyTolerance times the baseline halves the
+rate, down to a twentieth of SnapshotMaxRate so that the transfer still completes; any other interval
+raises it by a tenth of SnapshotMaxRate, up to SnapshotMaxRate. The transfers to the same peer share
+its rate.
+
+The snapshot_max_rate (bytes per second, 0 for unlimited) and snapshot_latency_target settings
+override the configuration.
+*/
+
+const (
+	snapshotAdjustInterval    = 250 * time.Millisecond
+	snapshotLatencyTolerance  = 1.5
+	snapshotChunkBytes        = 32 << 10 // Bytes sent at once, each chunk waiting for its share of the rate
+	snapshotBaselineSmoothing = 0.1      // Weight of the latest interval in the baseline latency
+)
+
+// The bandwidth allowed to the snapshot transfers of a replica, safe for concurrent use.
+type snapshotThrottle struct {
+	metrics *Metrics
+	limits  func() (int64, time.Duration) // Maximum rate (0 if unlimited) and latency target
+
+	mu       sync.Mutex
+	rate     float64 // Current rate of each peer, in bytes per second
+	baseline float64 // Average latency of the writes without transfers, in seconds, 0 if unknown
+	start    time.Time
+	sum      float64 // Latency of the writes of the current interval, in seconds
+	count    int
+	peers    map[string]*snapshotPeer
+}
+
+// The transfers in progress to a peer.
+type snapshotPeer struct {
+	active int
+	next   time.Time // Time the next chunk may be sent at
+}
+
+func newSnapshotThrottle(metrics *Metrics, limits func() (int64, time.Duration)) *snapshotThrottle {
+	return &snapshotThrottle{metrics: metrics, limits: limits, peers: make(map[string]*snapshotPeer)}
+}
+
+// Return the limits of the snapshot transfers, from the settings or the configuration.
+func (node *RaftNode) snapshotLimits() (int64, time.Duration) {
+	return node.Meta.settings.Int64("snapshot_max_rate", node.Meta.Config.SnapshotMaxRate),
+		node.Meta.settings.Duration("snapshot_latency_target", node.Meta.Config.SnapshotLatencyTarget)
+}
+
+// Record the latency of a committed write.
+func (t *snapshotThrottle) observe(latency time.Duration) {
+
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.roll(time.Now())
+	t.sum += latency.Seconds()
+	t.count++
+}
+
+// End the current interval if it is over, adjusting the rate. Must be called with t.mu held.
+func (t *snapshotThrottle) roll(now time.Time) {
+
+	if now.Sub(t.start) < snapshotAdjustInterval {
+		return
+	}
+
+	max, target := t.limits()
+
+	latency := 0.0
+	if t.count > 0 {
+		latency = t.sum / float64(t.count)
+	}
+
+	transferring := len(t.peers) > 0
+
+	switch {
+
+	case !transferring && t.count > 0 && t.baseline == 0:
+		t.baseline = latency
+
+	case !transferring && t.count > 0:
+		t.baseline += snapshotBaselineSmoothing * (latency - t.baseline)
+
+	case transferring && t.count > 0 && latency > target.Seconds() && latency > snapshotLatencyTolerance*t.baseline:
+		t.rate /= 2
+
+	default:
+		t.rate += float64(max) / 10
+
+	}
+
+	if t.rate > float64(max) || !transferring {
+		t.rate = float64(max)
+	}
+	if t.rate < float64(max)/20 {
+		t.rate = float64(max) / 20
+	}
+
+	t.metrics.Set("snapshot_rate_bytes", t.rate)
+
+	t.start, t.sum, t.count = now, 0, 0
+}
+
+// Start a transfer to the peer.
+func (t *snapshotThrottle) begin(peer string) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The rate starts from its maximum.
+	if len(t.peers) == 0 {
+		max, _ := t.limits()
+		t.rate = float64(max)
+	}
+
+	p, ok := t.peers[peer]
+	if !ok {
+		p = &snapshotPeer{}
+		t.peers[peer] = p
+	}
+	p.active++
+}
+
+// End a transfer to the peer.
+func (t *snapshotThrottle) end(peer string) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p := t.peers[peer]; p != nil {
+		if p.active--; p.active == 0 {
+			delete(t.peers, peer)
+		}
+	}
+}
+
+// Wait until n more bytes may be sent to the peer, or ctx is done.
+func (t *snapshotThrottle) wait(ctx context.Context, peer string, n int) error {
+
+	t.mu.Lock()
+
+	now := time.Now()
+	t.roll(now)
+
+	p := t.peers[peer]
+	if p == nil || t.rate <= 0 {
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+
+	if p.next.Before(now) {
+		p.next = now
+	}
+
+	delay := p.next.Sub(now)
+	p.next = p.next.Add(time.Duration(float64(n) / t.rate * float64(time.Second)))
+
+	t.mu.Unlock()
+
+	t.metrics.Add("snapshot_sent_bytes_total", float64(n), "peer", peer)
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	t.metrics.Add("snapshot_throttled_seconds_total", delay.Seconds(), "peer", peer)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// A writer sending a snapshot to a peer, at the rate of the throttle.
+type throttledWriter struct {
+	ctx      context.Context
+	throttle *snapshotThrottle
+	peer     string
+	w        io.Writer
+}
+
+// Return a writer sending to the peer through w at the rate of the throttle, and the function to
+// call once the transfer is over. Without a throttle, w is returned as is.
+func (t *snapshotThrottle) writer(ctx context.Context, peer string, w io.Writer) (io.Writer, func()) {
+
+	if t == nil {
+		return w, func() {}
+	}
+
+	t.begin(peer)
+	return &throttledWriter{ctx: ctx, throttle: t, peer: peer, w: w}, func() { t.end(peer) }
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+
+	written := 0
+
+	for len(p) > 0 {
+
+		chunk := p
+		if len(chunk) > snapshotChunkBytes {
+			chunk = chunk[:snapshotChunkBytes]
+		}
+
+		if err := tw.throttle.wait(tw.ctx, tw.peer, len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := tw.w.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Return the host the request came from, e.g. the peer a snapshot is sent to over HTTP.
+func requestHost(r *http.Request) string {
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
@@ -0,0 +1,100 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+/*
+ * This test case checks that the rate of the snapshot transfers is halved
+ * while the writes are slower than both the latency target and their latency
+ * without transfers, down to a floor, and raised back once they recover. It
+ * then checks that the writer sends the snapshot at the rate of the throttle.
+ */
+func TestSnapshotThrottle(t *testing.T) {
+
+	const max = 1 << 20
+
+	throttle := newSnapshotThrottle(NewMetrics(), func() (int64, time.Duration) { return max, 20 * time.Millisecond })
+
+	now := time.Now()
+
+	// Write the given latency in an interval, then end it.
+	interval := func(latency time.Duration) {
+		throttle.sum, throttle.count = latency.Seconds(), 1
+		now = now.Add(snapshotAdjustInterval)
+		throttle.roll(now)
+	}
+
+	interval(10 * time.Millisecond)
+	interval(10 * time.Millisecond)
+
+	if throttle.baseline != 0.01 || throttle.rate != max {
+		t.Fatalf("Expected a baseline of 10ms at the maximum rate, got %v at %v", throttle.baseline, throttle.rate)
+	}
+
+	throttle.begin("standby")
+
+	interval(40 * time.Millisecond)
+	if throttle.rate != max/2 {
+		t.Errorf("Expected the rate to be halved, got %v", throttle.rate)
+	}
+
+	for i := 0; i < 10; i++ {
+		interval(40 * time.Millisecond)
+	}
+	if throttle.rate != float64(max)/20 {
+		t.Errorf("Expected the rate to stop at a twentieth of the maximum, got %v", throttle.rate)
+	}
+
+	// Within the target, or within the tolerance of the baseline.
+	interval(18 * time.Millisecond)
+	interval(14 * time.Millisecond)
+	if throttle.rate != float64(max)/20+2*float64(max)/10 {
+		t.Errorf("Expected the rate to be raised twice, got %v", throttle.rate)
+	}
+
+	if throttle.baseline != 0.01 {
+		t.Errorf("Expected the baseline not to change during a transfer, got %v", throttle.baseline)
+	}
+
+	throttle.end("standby")
+
+	interval(40 * time.Millisecond)
+	if throttle.rate != max || len(throttle.peers) != 0 {
+		t.Errorf("Expected the rate to be reset after the transfer, got %v", throttle.rate)
+	}
+
+	// 256 KiB sent at 1 MiB/s take about 220ms, the first chunk of 32 KiB being sent right away.
+	var sent bytes.Buffer
+	snapshot := bytes.Repeat([]byte("x"), 256<<10)
+
+	writer, done := throttle.writer(context.Background(), "standby", &sent)
+
+	start := time.Now()
+	if n, err := writer.Write(snapshot); n != len(snapshot) || err != nil || !bytes.Equal(sent.Bytes(), snapshot) {
+		t.Fatalf("Unable to send the snapshot: %v bytes sent (%v)", n, err)
+	}
+	done()
+
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected the snapshot to be sent in about 220ms, took %v", elapsed)
+	}
+
+	// The transfer stops once the client is gone.
+	ctx, cancel := context.WithCancel(context.Background())
+	writer, done = throttle.writer(ctx, "standby", &sent)
+	defer done()
+
+	cancel()
+	if _, err := writer.Write(snapshot); err == nil {
+		t.Errorf("Expected the transfer to stop with its context")
+	}
+
+	var nilThrottle *snapshotThrottle
+	if writer, _ := nilThrottle.writer(context.Background(), "standby", &sent); writer != &sent {
+		t.Errorf("Expected the writer to be returned as is without a throttle")
+	}
+}
@@ -0,0 +1,281 @@
+package raft
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/*
+Mutual TLS between the replicas. When a certificate, key and CA are configured, the gRPC server
+of the replica only accepts TLS connections, and the connections to the peers are made over TLS,
+presenting the same certificate. A replica trusts any peer whose certificate is signed by the CA,
+so the certificates need to be valid for both server and client authentication. With PeerNames
+(-peer-names), the certificate of a peer must also carry one of the names given, as its common name
+or one of its DNS names, both when dialing it and when it calls the ConsensusService, so that the
+certificates the CA signs for other purposes (e.g. for the clients) can't be used to join the cluster.
+
+The KVService is served on the same port, so clients need to connect over TLS as well, and the
+ConsensusService additionally requires the caller to have presented a certificate signed by the CA
+(see authorize in interceptors.go).
+
+The files are checked for changes on every handshake, so that certificates can be rotated by
+replacing them on disk, without restarting the replica. Established connections keep using the
+certificate they were set up with until they are re-established.
+*/
+
+// Loads the certificate, key and CA of the replica, reloading them whenever the files change.
+// Also used for the client HTTP server, see StartRaftServer.
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.Mutex
+	modTime [3]time.Time     // Modification times of the loaded files
+	cert    *tls.Certificate // The current certificate of the replica
+	pool    *x509.CertPool   // The CA certificates trusted for peers
+
+	names []string // Names one of which the certificates of the peers must carry, any if empty
+}
+
+// Create a reloader for the given files, failing if they can't be loaded. The CA is optional
+// for servers that don't authenticate their clients with certificates.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both the certificate and key files are required for TLS")
+	}
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+
+	modTime, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) modTimes() ([3]time.Time, error) {
+
+	var modTime [3]time.Time
+
+	for i, file := range []string{r.certFile, r.keyFile, r.caFile} {
+
+		if file == "" {
+			continue
+		}
+
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+
+		modTime[i] = info.ModTime()
+	}
+
+	return modTime, nil
+}
+
+// Load the files, and replace the current certificate and CA by them if they are valid.
+func (r *certReloader) load(modTime [3]time.Time) error {
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+
+	if r.caFile != "" {
+
+		ca, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no valid certificate found in %v", r.caFile)
+		}
+	}
+
+	r.cert, r.pool, r.modTime = &cert, pool, modTime
+
+	return nil
+}
+
+// Return the current certificate and CA, reloading them first if the files changed. If the new
+// files can't be loaded (e.g. they are being replaced), the ones previously loaded are kept.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.modTimes()
+
+	if err == nil && modTime != r.modTime {
+
+		if err = r.load(modTime); err == nil {
+			logging.Logger.Info().Str("cert_file", r.certFile).Str("ca_file", r.caFile).Msg("Reloaded TLS certificates")
+		}
+	}
+
+	if err != nil {
+		logging.Logger.Warn().Err(err).Msg("Failed to reload TLS certificates, keeping the current ones")
+	}
+
+	return r.cert, r.pool
+}
+
+// Return the TLS configuration of the gRPC server. Clients presenting a certificate must have it
+// signed by the CA; whether one is required depends on the service called.
+func (r *certReloader) serverConfig() *tls.Config {
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+
+			cert, pool := r.current()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			}, nil
+		},
+	}
+
+}
+
+// Return the TLS configuration of a server presenting the current certificate, without
+// authenticating its clients.
+func (r *certReloader) certificateConfig() *tls.Config {
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+
+}
+
+// Return the TLS configuration used for connecting to the peers.
+func (r *certReloader) clientConfig() *tls.Config {
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+
+		// Peers are addressed by port only (e.g. ":5001"), so there is no host name to check the
+		// certificate against: the chain is verified against the current CA in VerifyConnection.
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("peer presented no certificate")
+			}
+
+			_, pool := r.current()
+
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}
+
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+
+			if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+				return err
+			}
+
+			if !namedCertificate(cs.PeerCertificates[0], r.names) {
+				return fmt.Errorf("the certificate of the peer isn't issued to any of %v", r.names)
+			}
+
+			return nil
+		},
+	}
+
+}
+
+// Load the certificates of the replica if TLS is configured. Called before connecting to the peers.
+func (node *RaftNode) setupPeerTLS() error {
+
+	config := node.Meta.Config
+
+	if config.PeerCertFile == "" && config.PeerKeyFile == "" && config.PeerCAFile == "" {
+		return nil
+	}
+
+	if config.PeerCAFile == "" {
+		return errors.New("the CA file is required for mutual TLS between replicas")
+	}
+
+	r, err := newCertReloader(config.PeerCertFile, config.PeerKeyFile, config.PeerCAFile)
+	if err != nil {
+		return err
+	}
+
+	r.names = config.PeerNames
+
+	node.Meta.peer_tls = r
+	node.logger().Info().Str("cert_file", config.PeerCertFile).Str("ca_file", config.PeerCAFile).Strs("peer_names", config.PeerNames).Msg("Using mutual TLS between replicas")
+
+	return nil
+}
+
+// Report whether the certificate carries one of the given names, as its common name or one of its DNS
+// names. Any certificate does if no name is given.
+func namedCertificate(cert *x509.Certificate, names []string) bool {
+
+	if len(names) == 0 {
+		return true
+	}
+
+	for _, name := range names {
+
+		if cert.Subject.CommonName == name {
+			return true
+		}
+
+		for _, dns := range cert.DNSNames {
+			if dns == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the dial option securing the connections to the peers (and to the replica's own server).
+func (node *RaftNode) transportDialOption() grpc.DialOption {
+
+	if node.Meta.peer_tls == nil {
+		return grpc.WithInsecure()
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(node.Meta.peer_tls.clientConfig()))
+}
@@ -0,0 +1,225 @@
+package raft
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Write a certificate and its key to <dir>/<name>.pem and <dir>/<name>-key.pem, signed by
+// parent (self-signed if nil), and return them.
+func writeTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// Perform a TLS handshake between the given configurations, and return the certificate presented by the server.
+func testHandshake(t *testing.T, server, client *tls.Config) (*x509.Certificate, error) {
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+/*
+ * This test case checks that replicas with certificates signed by the same CA can
+ * connect to each other, that a certificate signed by another CA is rejected, and
+ * that certificates replaced on disk are used without recreating the configurations.
+ */
+func TestPeerTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "raft-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeTestCert(t, dir, "ca", 1, nil, nil)
+	writeTestCert(t, dir, "replica", 2, ca, caKey)
+
+	r, err := newCertReloader(filepath.Join(dir, "replica.pem"), filepath.Join(dir, "replica-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := r.serverConfig(), r.clientConfig()
+
+	cert, err := testHandshake(t, server, client)
+	if err != nil {
+		t.Fatalf("Handshake between replicas failed: %v", err)
+	}
+	if cert.SerialNumber.Int64() != 2 {
+		t.Errorf("Expected the server to present certificate 2, got %v", cert.SerialNumber)
+	}
+
+	// A replica with a certificate from another CA doesn't trust the server.
+	other := filepath.Join(dir, "other")
+	os.Mkdir(other, 0700)
+	otherCA, otherKey := writeTestCert(t, other, "ca", 3, nil, nil)
+	writeTestCert(t, other, "replica", 4, otherCA, otherKey)
+
+	stranger, err := newCertReloader(filepath.Join(other, "replica.pem"), filepath.Join(other, "replica-key.pem"), filepath.Join(other, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testHandshake(t, server, stranger.clientConfig()); err == nil {
+		t.Errorf("Expected a server signed by another CA to be rejected")
+	}
+
+	// Rotate the certificate of the replica.
+	writeTestCert(t, dir, "replica", 5, ca, caKey)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "replica.pem"), later, later)
+
+	cert, err = testHandshake(t, server, client)
+	if err != nil {
+		t.Fatalf("Handshake after rotation failed: %v", err)
+	}
+	if cert.SerialNumber.Int64() != 5 {
+		t.Errorf("Expected the rotated certificate 5 to be presented, got %v", cert.SerialNumber)
+	}
+
+	// An invalid file is ignored, and the current certificate kept.
+	ioutil.WriteFile(filepath.Join(dir, "replica.pem"), []byte("garbage"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "replica.pem"), later, later)
+
+	if cert, err = testHandshake(t, server, client); err != nil || cert.SerialNumber.Int64() != 5 {
+		t.Errorf("Expected the current certificate to be kept, got %v", err)
+	}
+}
+
+/*
+ * This test case checks that with peer names, the certificates signed by the
+ * CA for other names are refused, both when dialing a peer and on the
+ * ConsensusService, unlike on the KVService.
+ */
+func TestPeerNames(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "raft-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeTestCert(t, dir, "ca", 1, nil, nil)
+	replicaCert, _ := writeTestCert(t, dir, "replica", 2, ca, caKey)
+	clientCert, _ := writeTestCert(t, dir, "client", 3, ca, caKey)
+
+	load := func(name string) *certReloader {
+		r, err := newCertReloader(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"), filepath.Join(dir, "ca.pem"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.names = []string{"replica"}
+		return r
+	}
+
+	replica, client := load("replica"), load("client")
+
+	if _, err := testHandshake(t, replica.serverConfig(), replica.clientConfig()); err != nil {
+		t.Errorf("Expected a peer with one of the names to be trusted, got %v", err)
+	}
+
+	if _, err := testHandshake(t, client.serverConfig(), replica.clientConfig()); err == nil {
+		t.Errorf("Expected a server with another name to be rejected")
+	}
+
+	node := &RaftNode{Meta: &NodeMetadata{Config: DefaultConfig(), peer_tls: replica}}
+
+	caller := func(cert *x509.Certificate) context.Context {
+		info := credentials.TLSInfo{}
+		info.State.VerifiedChains = [][]*x509.Certificate{{cert, ca}}
+		return peer.NewContext(context.Background(), &peer.Peer{AuthInfo: info})
+	}
+
+	if _, err := node.authorize(caller(replicaCert), "/protos.ConsensusService/AppendEntries"); err != nil {
+		t.Errorf("Expected a peer with one of the names to be authorized, got %v", err)
+	}
+
+	if _, err := node.authorize(caller(clientCert), "/protos.ConsensusService/AppendEntries"); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected a caller with another name to be denied, got %v", err)
+	}
+
+	if _, err := node.authorize(caller(clientCert), "/protos.KVService/Get"); err != nil {
+		t.Errorf("Expected the clients of the KVService not to be checked, got %v", err)
+	}
+
+	if !namedCertificate(clientCert, nil) {
+		t.Errorf("Expected any certificate to be accepted without names")
+	}
+}
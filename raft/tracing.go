@@ -0,0 +1,266 @@
+package raft
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Tracing of client requests through consensus, using OpenTelemetry. A write is traced end-to-end
+across the replicas with the following spans:
+
+- the client's HTTP request (tracingMiddleware) or KVService call (tracing interceptors), continuing
+  the caller's trace if it sent a W3C traceparent header.
+- raft.propose, the proposal of the write to the log on the leader.
+- raft.append_entries, for each AppendEntries sent to a peer. The trace context is sent along in
+  the gRPC metadata, so that the handling of the RPC by the peer is part of the same trace.
+- raft.apply, the application of the entry to the state machine, on every replica. The trace
+  context of the proposal is stored in the log entry, so it reaches the followers along with it.
+
+Background work (heartbeats, elections) isn't traced. Spans are only recorded once a tracer
+provider is installed, e.g. by SetupTracing; until then, tracing is a no-op.
+*/
+
+var tracer = otel.Tracer("github.com/krithikvaidya/distributed-dns/raft")
+
+var propagator = propagation.TraceContext{}
+
+// Install a tracer provider exporting the spans of this replica as JSON to w. Returns a function
+// flushing the remaining spans, to be called on shutdown.
+func SetupTracing(w io.Writer, replica_id int) (func(context.Context) error, error) {
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "distributed-dns"),
+			attribute.Int("raft.replica_id", replica_id),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	return provider.Shutdown, nil
+}
+
+// Start a span as a child of the span in ctx, if any. Without a parent span, a no-op span is returned,
+// so that background work isn't traced.
+func startChildSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	return tracer.Start(ctx, name, opts...)
+}
+
+// Mark the span as failed, if err isn't nil.
+func endSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// Return the trace context of ctx in the traceparent format, or "" if ctx isn't part of a trace.
+func traceparent(ctx context.Context) string {
+
+	carrier := propagation.HeaderCarrier(http.Header{})
+	propagator.Inject(ctx, carrier)
+
+	return carrier.Get("traceparent")
+}
+
+// Return a context carrying the given trace context, as stored in a log entry.
+func contextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+
+	if traceparent == "" {
+		return ctx
+	}
+
+	carrier := propagation.HeaderCarrier(http.Header{})
+	carrier.Set("traceparent", traceparent)
+
+	return propagator.Extract(ctx, carrier)
+}
+
+// Adapts gRPC metadata to the propagation API.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Records the status code of an HTTP response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Let the streamed responses (see leader.go) be flushed through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Middleware tracing the client HTTP requests.
+func (node *RaftNode) tracingMiddleware(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				name = template
+			}
+		}
+
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "HTTP "+r.Method+" "+name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", r.URL.RequestURI()),
+				attribute.Int("raft.replica_id", int(node.Meta.replica_id)),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+		node.Meta.metrics.Add("http_requests_total", 1, "code", strconv.Itoa(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(otelcodes.Error, http.StatusText(recorder.status))
+		}
+
+	})
+}
+
+/*
+Start the server span of an RPC. Client calls are always traced, while calls between replicas are
+only traced if they are part of a trace, so that the heartbeats are left out.
+*/
+func (node *RaftNode) startRPCSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = propagator.Extract(ctx, metadataCarrier(md))
+
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.method", method),
+			attribute.Int("raft.replica_id", int(node.Meta.replica_id)),
+		),
+	}
+
+	if strings.HasPrefix(method, "/protos.ConsensusService/") {
+		return startChildSpan(ctx, method, opts...)
+	}
+
+	return tracer.Start(ctx, method, opts...)
+}
+
+func endRPCSpan(span trace.Span, err error) {
+
+	if err != nil {
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+	}
+
+	endSpan(span, err)
+}
+
+func (node *RaftNode) tracingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	ctx, span := node.startRPCSpan(ctx, info.FullMethod)
+
+	resp, err := handler(ctx, req)
+	endRPCSpan(span, err)
+
+	return resp, err
+}
+
+// A server stream whose context was replaced, e.g. to carry the span of the RPC.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func (node *RaftNode) tracingStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+
+	ctx, span := node.startRPCSpan(ss.Context(), info.FullMethod)
+
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	endRPCSpan(span, err)
+
+	return err
+}
+
+// Client interceptor sending the trace context of the calls to the peers along in their metadata.
+func tracingClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+
+	if trace.SpanContextFromContext(ctx).IsValid() {
+
+		md, _ := metadata.FromOutgoingContext(ctx)
+		md = md.Copy()
+		propagator.Inject(ctx, metadataCarrier(md))
+
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
@@ -0,0 +1,50 @@
+package raft
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * This test case checks that the trace context stored in a log entry continues
+ * the trace of the proposal when the entry is applied, and that work without a
+ * parent span (e.g. heartbeats) isn't traced.
+ */
+func TestTraceparentPropagation(t *testing.T) {
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	_, background := startChildSpan(context.Background(), "raft.heartbeat")
+	background.End()
+
+	if background.IsRecording() || len(recorder.Ended()) != 0 {
+		t.Fatalf("Span without a parent was recorded")
+	}
+
+	if tp := traceparent(context.Background()); tp != "" {
+		t.Errorf("Unexpected traceparent %q outside of a trace", tp)
+	}
+
+	ctx, propose := tracer.Start(context.Background(), "raft.propose")
+	stored := traceparent(ctx)
+	propose.End()
+
+	_, apply := startChildSpan(contextWithTraceparent(context.Background(), stored), "raft.apply")
+	apply.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %v", len(spans))
+	}
+
+	if spans[1].SpanContext().TraceID() != spans[0].SpanContext().TraceID() || spans[1].Parent().SpanID() != spans[0].SpanContext().SpanID() {
+		t.Errorf("raft.apply is not a child of raft.propose: %v, parent %v", spans[1].SpanContext(), spans[1].Parent())
+	}
+}
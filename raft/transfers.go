@@ -0,0 +1,319 @@
+package raft
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+Zone transfers (AXFR, RFC 5936, and IXFR, RFC 1995) to the secondary name servers, accepted by the
+listeners of the views with "transfers": true (see dns.go), over TCP only. Like the updates, the
+requests must be signed with TSIG (see tsig.go) on behalf of a user allowed to read every RRset of
+the zone by its permission or its roles, and the responses are signed with the same key. Requests
+that aren't signed are refused, those with an unknown key or an invalid signature answered with
+NOTAUTH, and the transfers of the other views refused altogether.
+
+A transfer holds the records of the zone as stored, between two copies of the SOA record of its apex
+(with the serial served, see serials.go): the records meant for each region (see geo.go) alike, and
+regardless of the response policies. The records of the subzones, delegated or with an SOA record of
+their own, are left out but for the NS and DS records of their apex and the glue of their name
+servers. An IXFR is answered with the SOA record alone when the secondary already holds the serial
+served, and with the whole zone otherwise, as the changes of the zones aren't kept. The records are
+sent in messages of up to transferMessageSize bytes, each signed (RFC 8945 section 5.3.1) so that
+the secondary can check the whole transfer.
+
+The transfers are counted in dns_transfers_total{view, outcome}, the outcome being transferred,
+uptodate (an IXFR of the serial served), refused or notauth.
+*/
+
+const transferMessageSize = 16 * 1024 // Size, in bytes, past which the records of a transfer are sent in another message
+
+// Whether the request is a zone transfer.
+func transfer(req *dns.Msg) bool {
+	return req.Opcode == dns.OpcodeQuery && len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR)
+}
+
+// Whether the raw message is a request for a zone transfer signed with an additional record, read
+// without unpacking the message.
+func rawTransfer(msg []byte) bool {
+
+	// The header is 12 bytes long, the opcode being in the third one and the counts of the question
+	// and additional records in the fifth and eleventh.
+	if len(msg) < 12 || msg[2]&0x80 != 0 || int(msg[2]>>3)&0xF != dns.OpcodeQuery || msg[4] != 0 || msg[5] != 1 || msg[10] == 0 && msg[11] == 0 {
+		return false
+	}
+
+	// The name of the question is made of labels after the header, ahead of its type.
+	i := 12
+	for i < len(msg) && msg[i] != 0 {
+		if msg[i]&0xC0 != 0 {
+			return false
+		}
+		i += int(msg[i]) + 1
+	}
+
+	if i+2 >= len(msg) {
+		return false
+	}
+
+	qtype := uint16(msg[i+1])<<8 | uint16(msg[i+2])
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+/*
+Handle a zone transfer request of the view: check its TSIG signature against the raw message, and
+send the records of the zone if the user it is signed by may read them all.
+*/
+func (node *RaftNode) serveTransfer(view DNSView, updates *rawUpdates, w dns.ResponseWriter, req *dns.Msg) {
+
+	raw, _ := updates.take(w.RemoteAddr(), req.Id)
+
+	outcome := func(o string) {
+		node.Meta.metrics.Add("dns_transfers_total", 1, "view", view.Name, "outcome", o)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+
+	tsig := req.IsTsig()
+	_, tcp := w.RemoteAddr().(*net.TCPAddr)
+
+	if tsig == nil || raw == nil || !tcp {
+		outcome("refused")
+		resp.SetRcode(req, dns.RcodeRefused)
+		w.WriteMsg(resp)
+		return
+	}
+
+	user, secret, ok := node.verifyTSIG(raw, tsig)
+	if !ok {
+		node.logger().Warn().Str("key", tsig.Hdr.Name).Str("client", w.RemoteAddr().String()).Msg("Zone transfer with an invalid TSIG signature")
+		outcome("notauth")
+		resp.SetRcode(req, dns.RcodeNotAuth)
+		w.WriteMsg(resp)
+		return
+	}
+
+	mac := tsig.MAC
+	timersOnly := false
+
+	// Sign and send a message, chaining its signature to that of the previous one.
+	send := func(m *dns.Msg) bool {
+
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+
+		signed, next, err := dns.TsigGenerate(m, secret, mac, timersOnly)
+		if err != nil {
+			node.logger().Error().Err(err).Msg("Unable to sign the response of a zone transfer")
+			return false
+		}
+
+		mac, timersOnly = next, true
+
+		if _, err := w.Write(signed); err != nil {
+			node.logger().Debug().Err(err).Str("client", w.RemoteAddr().String()).Msg("Zone transfer interrupted")
+			return false
+		}
+
+		return true
+	}
+
+	refuse := func(rcode int, o string) {
+		outcome(o)
+		resp.SetRcode(req, rcode)
+		send(resp)
+	}
+
+	apex := zone.CanonicalName(req.Question[0].Name)
+	if req.Question[0].Qclass != dns.ClassINET || !view.serves(apex) {
+		refuse(dns.RcodeRefused, "refused")
+		return
+	}
+
+	rrs, keys, err := node.zoneRecords(apex)
+	if err != nil {
+		node.logger().Error().Err(err).Str("zone", apex).Msg("Unable to read the records of a zone transfer")
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		send(resp)
+		return
+	}
+
+	if len(rrs) == 0 {
+		refuse(dns.RcodeNotAuth, "notauth")
+		return
+	}
+
+	for _, key := range keys {
+		if !node.Meta.roles.allows(user, key, PermissionRead) {
+			node.logger().Warn().Str("user", user.Name).Str("zone", apex).Str("key", key).Msg("Zone transfer of records the user may not read")
+			refuse(dns.RcodeRefused, "refused")
+			return
+		}
+	}
+
+	soa := rrs[0].(*dns.SOA)
+	resp.Authoritative = true
+
+	// A secondary holding the serial served only needs the SOA record.
+	if req.Question[0].Qtype == dns.TypeIXFR && len(req.Ns) == 1 {
+		if held, ok := req.Ns[0].(*dns.SOA); ok && !serialGreater(soa.Serial, held.Serial) {
+			resp.Answer = []dns.RR{soa}
+			if send(resp) {
+				outcome("uptodate")
+			}
+			return
+		}
+	}
+
+	resp.Compress = true
+
+	for _, rr := range append(rrs, dns.Copy(soa)) {
+
+		resp.Answer = append(resp.Answer, rr)
+
+		if resp.Len() > transferMessageSize && len(resp.Answer) > 1 {
+
+			last := resp.Answer[len(resp.Answer)-1]
+			resp.Answer = resp.Answer[:len(resp.Answer)-1]
+
+			if !send(resp) {
+				return
+			}
+
+			next := new(dns.Msg)
+			next.SetReply(req)
+			next.Authoritative, next.Compress = true, true
+			next.Answer = []dns.RR{last}
+			resp = next
+		}
+	}
+
+	if send(resp) {
+		outcome("transferred")
+		node.logger().Info().Str("zone", apex).Str("user", user.Name).Uint32("serial", soa.Serial).Str("client", w.RemoteAddr().String()).Msg("Zone transferred")
+	}
+}
+
+/*
+Return the records of the zone, which must be canonical, as a transfer holds them (the SOA record of
+its apex first, but not last), along with the keys of their RRsets. No records are returned if the
+apex holds no SOA record.
+*/
+func (node *RaftNode) zoneRecords(apex string) ([]dns.RR, []string, error) {
+
+	stored, err := node.readName(apex)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	soa := node.storedRRs(apex, "SOA", stored.records["SOA"])
+	if len(soa) != 1 {
+		return nil, nil, nil
+	}
+
+	rrs, keys := soa, []string{zone.RecordKey(apex, "SOA")}
+
+	kvs, err := node.shardOf(apex).scanLocalStore(zone.KeyPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The RRsets of the zone by name, in the order of their keys.
+	var names []string
+	records := make(map[string]map[string][]zone.Record)
+
+	for _, kv := range kvs {
+
+		name, rtype, ok := zone.ParseRecordKey(kv.Key)
+		if !ok || zone.IsPolicyKey(kv.Key) || !zone.InZone(name, apex) || name == apex && rtype == "SOA" {
+			continue
+		}
+
+		var rrset []zone.Record
+		if err := json.Unmarshal([]byte(kv.Value), &rrset); err != nil || len(rrset) == 0 {
+			continue
+		}
+
+		if records[name] == nil {
+			names = append(names, name)
+			records[name] = make(map[string][]zone.Record)
+		}
+
+		records[name][rtype] = rrset
+	}
+
+	// The subzones with an SOA record of their own, and the delegated ones along with the names of
+	// their name servers needing glue.
+	cut := func(name string) bool {
+		_, ns := records[name]["NS"]
+		_, soa := records[name]["SOA"]
+		return name != apex && (ns || soa)
+	}
+
+	glue := make(map[string]bool)
+	for _, name := range names {
+		if cut(name) {
+			for _, rr := range node.storedRRs(name, "NS", records[name]["NS"]) {
+				if target := zone.CanonicalName(rr.(*dns.NS).Ns); zone.InZone(target, name) {
+					glue[target] = true
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+
+		// The highest cut above the name, or at the name itself.
+		above := ""
+		for i := 0; ; {
+
+			ancestor := dns.Fqdn(name[i:])
+			if ancestor == apex {
+				break
+			}
+
+			if cut(ancestor) {
+				above = ancestor
+			}
+
+			var end bool
+			if i, end = dns.NextLabel(name, i); end {
+				break
+			}
+		}
+
+		for _, rtype := range sortedTypes(records[name]) {
+
+			switch {
+			case above == "":
+			case above == name && (rtype == "NS" || rtype == "DS"):
+			case above != name && (rtype == "A" || rtype == "AAAA") && glue[name]:
+			default:
+				continue
+			}
+
+			rrs = append(rrs, node.storedRRs(name, rtype, records[name][rtype])...)
+			keys = append(keys, zone.RecordKey(name, rtype))
+		}
+	}
+
+	return rrs, keys, nil
+}
+
+// Return the types of the RRsets, sorted.
+func sortedTypes(rrsets map[string][]zone.Record) []string {
+
+	types := make([]string, 0, len(rrsets))
+	for rtype := range rrsets {
+		types = append(types, rtype)
+	}
+
+	sort.Strings(types)
+
+	return types
+}
@@ -0,0 +1,187 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the zone transfers are only served when signed
+ * by a key of a user allowed to read the zone, that they hold the records of
+ * the zone between two SOA records, the delegations with their glue but not
+ * the records of the subzones, and that the previous secret of a rotated key
+ * is only accepted during its grace period.
+ */
+func TestTransfers(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "transfers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	put := func(name, rtype string, data ...string) {
+
+		var records []zone.Record
+		for _, d := range data {
+			records = append(records, zone.Record{Name: name, Type: rtype, TTL: 300, Data: d})
+		}
+
+		encoded, _ := json.Marshal(records)
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put("example.com.", "SOA", "ns1.example.com. admin.example.com. 7 7200 900 1209600 300")
+	put("example.com.", "NS", "ns1.example.com.")
+	put("ns1.example.com.", "A", "192.0.2.53")
+	put("www.example.com.", "A", "192.0.2.1", "192.0.2.2")
+	put("sub.example.com.", "NS", "ns.sub.example.com.")
+	put("ns.sub.example.com.", "A", "192.0.2.54")
+	put("host.sub.example.com.", "A", "192.0.2.55")
+	put("child.example.com.", "SOA", "ns1.example.com. admin.example.com. 1 7200 900 1209600 300")
+	put("www.child.example.com.", "A", "192.0.2.56")
+	put("www.example.org.", "A", "192.0.2.3")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), users: NewUsers(), roles: NewRoles(), tsig_keys: NewTSIGKeys(), Config: DefaultConfig()}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.Config.DNS = DNSConfig{
+		Views:     []DNSView{{Name: "secondaries", Zones: []string{"example.com."}, Transfers: true}, {Name: "external"}},
+		Listeners: []DNSListener{{Address: address, Protocol: "tcp", View: "secondaries"}},
+	}
+
+	reader := User{Name: "secondary-user", Permission: PermissionRead, TokenHash: hashToken("secondary-token")}
+	node.Meta.users.apply(reader.Name, &reader)
+
+	nobody := User{Name: "nobody", TokenHash: hashToken("nobody-token")}
+	node.Meta.users.apply(nobody.Name, &nobody)
+
+	secret, previous := "bmV3IHNlY3JldCBvZiB0aGUgc2Vjb25kYXJ5", "b2xkIHNlY3JldCBvZiB0aGUgc2Vjb25kYXJ5"
+	node.Meta.tsig_keys.apply("secondary", &TSIGKey{Name: "secondary", Algorithm: dns.HmacSHA256, Secret: secret, User: reader.Name, Previous: previous, PreviousUntil: time.Now().Add(time.Hour)})
+	node.Meta.tsig_keys.apply("nobody", &TSIGKey{Name: "nobody", Algorithm: dns.HmacSHA256, Secret: secret, User: nobody.Name})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.StartDNSListeners(ctx)
+
+	// Return the records transferred, or the error of the transfer.
+	transfer := func(key, secret string, qtype uint16, serial uint32) ([]dns.RR, error) {
+
+		req := new(dns.Msg)
+		if qtype == dns.TypeIXFR {
+			req.SetIxfr("example.com.", serial, "ns1.example.com.", "admin.example.com.")
+		} else {
+			req.SetAxfr("example.com.")
+		}
+		req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+
+		tr := &dns.Transfer{TsigSecret: map[string]string{key: secret}}
+
+		envelopes, err := tr.In(req, address)
+		if err != nil {
+			return nil, err
+		}
+
+		var rrs []dns.RR
+		for envelope := range envelopes {
+			if envelope.Error != nil {
+				return nil, envelope.Error
+			}
+			rrs = append(rrs, envelope.RR...)
+		}
+
+		return rrs, nil
+	}
+
+	rrs, err := transfer("secondary.", secret, dns.TypeAXFR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]int)
+	for _, rr := range rrs {
+		names[rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]]++
+	}
+
+	if len(rrs) != 8 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA || rrs[0].(*dns.SOA).Serial != 13 {
+		t.Errorf("Expected the records of the zone between two SOA records of the serial served, got %v", rrs)
+	}
+
+	for _, name := range []string{"www.example.com. A", "sub.example.com. NS", "ns.sub.example.com. A"} {
+		if names[name] == 0 {
+			t.Errorf("Expected %v to be transferred, got %v", name, rrs)
+		}
+	}
+
+	for _, name := range []string{"host.sub.example.com. A", "child.example.com. SOA", "www.child.example.com. A", "www.example.org. A"} {
+		if names[name] != 0 {
+			t.Errorf("Expected %v to be left out of the transfer, got %v", name, rrs)
+		}
+	}
+
+	if rrs, err := transfer("secondary.", secret, dns.TypeIXFR, 13); err != nil || len(rrs) != 1 {
+		t.Errorf("Expected an up to date IXFR to be answered with the SOA record alone, got %v (%v)", rrs, err)
+	}
+
+	if rrs, err := transfer("secondary.", previous, dns.TypeAXFR, 0); err != nil || len(rrs) != 8 {
+		t.Errorf("Expected the previous secret to be accepted during the grace period, got %v (%v)", rrs, err)
+	}
+
+	if _, err := transfer("nobody.", secret, dns.TypeAXFR, 0); err == nil || !strings.Contains(err.Error(), "5") {
+		t.Errorf("Expected the transfer of a user not allowed to read the zone to be refused, got %v", err)
+	}
+
+	node.Meta.tsig_keys.apply("secondary", &TSIGKey{Name: "secondary", Algorithm: dns.HmacSHA256, Secret: secret, User: reader.Name, Previous: previous, PreviousUntil: time.Now().Add(-time.Second)})
+
+	if _, err := transfer("secondary.", previous, dns.TypeAXFR, 0); err == nil {
+		t.Errorf("Expected the previous secret to be rejected after the grace period")
+	}
+
+	if got := node.Meta.metrics.Get("dns_tsig_verifications_total", "outcome", "previous"); got != 1 {
+		t.Errorf("Expected a single use of the previous secret, got %v", got)
+	}
+
+	// The unsigned transfers, and those of the other views, are refused.
+	req := new(dns.Msg)
+	req.SetAxfr("example.com.")
+
+	if resp, _, err := (&dns.Client{Net: "tcp"}).Exchange(req, address); err != nil || resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected an unsigned transfer to be refused, got %v (%v)", resp, err)
+	}
+
+	if resp := node.answerDNS(DNSView{Name: "external"}, req, nil); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected the transfers of a view not accepting them to be refused, got %v", resp)
+	}
+
+	if got := node.Meta.metrics.Get("dns_transfers_total", "view", "secondaries", "outcome", "transferred"); got != 2 {
+		t.Errorf("Expected 2 transfers, got %v", got)
+	}
+}
@@ -0,0 +1,302 @@
+package raft
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+The RPCs sent by a replica to a peer go through a Transport, so that the consensus code doesn't
+depend on the RPC layer: NewGRPCTransport wraps the gRPC client of the ConsensusService, and a
+MemoryNetwork (below) delivers the messages within the process. Another transport (e.g. TCP with
+its own framing, or QUIC) only needs to implement the interface, and to feed the messages it
+receives to the handlers in rpcs.go.
+
+A Transport fails like the gRPC client does: once the deadline of the context passes if the peer
+can't be reached, and with a status error (see google.golang.org/grpc/status) if the peer rejects
+the RPC.
+*/
+type Transport interface {
+	SendRequestVote(ctx context.Context, msg *protos.RequestVoteMessage) (*protos.RequestVoteResponse, error)
+	SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error)
+	SendTimeoutNow(ctx context.Context, msg *protos.TimeoutNowMessage) (*protos.TimeoutNowResponse, error)
+	SendInstallSnapshot(ctx context.Context, msg *protos.InstallSnapshotMessage) (*protos.InstallSnapshotResponse, error)
+}
+
+// The Transport sending the RPCs through the gRPC client of the ConsensusService of a peer.
+type grpcTransport struct {
+	client protos.ConsensusServiceClient
+}
+
+func NewGRPCTransport(client protos.ConsensusServiceClient) Transport {
+	return &grpcTransport{client: client}
+}
+
+func (t *grpcTransport) SendRequestVote(ctx context.Context, msg *protos.RequestVoteMessage) (*protos.RequestVoteResponse, error) {
+	return t.client.RequestVote(ctx, msg)
+}
+
+func (t *grpcTransport) SendAppendEntries(ctx context.Context, msg *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+	return t.client.AppendEntries(ctx, msg)
+}
+
+func (t *grpcTransport) SendTimeoutNow(ctx context.Context, msg *protos.TimeoutNowMessage) (*protos.TimeoutNowResponse, error) {
+	return t.client.TimeoutNow(ctx, msg)
+}
+
+func (t *grpcTransport) SendInstallSnapshot(ctx context.Context, msg *protos.InstallSnapshotMessage) (*protos.InstallSnapshotResponse, error) {
+	return t.client.InstallSnapshot(ctx, msg)
+}
+
+/*
+In-memory transport between replicas, so that a cluster can run in a single process without gRPC
+(e.g. in simulation tests). The replicas reach each other through the Transports of a
+MemoryNetwork, which call the RPC handlers of the target replica directly, on copies of the
+messages as a real transport would.
+
+The network injects faults drawn from seeded sources, one per direction of each link, so that the
+fate of a message doesn't depend on the order the replicas send on different links: each message
+(request or response) can be dropped, or delayed up to MaxDelay, which also reorders concurrent
+messages. Replicas can be split into partitions, between which no message is delivered. A dropped or
+partitioned message fails once the deadline of the RPC passes, like an unreachable peer with gRPC, or
+once it would have been delivered plus Timeout if set.
+
+The delays and timeouts run on Clock if set (e.g. the ManualClock driving the Raft timers of the
+replicas, see clock.go), and on the wall clock otherwise. On a Clock, every message waits for a timer
+of its own, however short its delay, so that firing the timers one at a time (see ManualClock.Fire)
+delivers the messages one at a time.
+*/
+type MemoryNetwork struct {
+	mu        sync.Mutex
+	seed      int64
+	links     map[[2]int32]*rand.Rand // Source of the faults of the messages sent from a replica to another
+	servers   map[int32]protos.ConsensusServiceServer
+	partition map[int32]int // Partition of each replica, all of them being in partition 0 by default
+
+	DropRate float64       // Probability of a message being dropped
+	MaxDelay time.Duration // Maximum delay of a message
+	Timeout  time.Duration // Time after which a lost message fails, if before the deadline of the RPC
+	Clock    TimerClock    // Clock of the delays and timeouts, the wall clock if nil
+
+	Delivered int // Number of messages delivered
+	Dropped   int // Number of messages dropped, including those between partitions
+}
+
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+
+	return &MemoryNetwork{
+		seed:      seed,
+		links:     make(map[[2]int32]*rand.Rand),
+		servers:   make(map[int32]protos.ConsensusServiceServer),
+		partition: make(map[int32]int),
+	}
+}
+
+// Register the replica handling the RPCs sent to the given ID.
+func (n *MemoryNetwork) Register(id int32, server protos.ConsensusServiceServer) {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.servers[id] = server
+}
+
+// Split the replicas into the given groups, which can't reach each other. Replicas not listed are
+// isolated. Calling it without groups heals the network.
+func (n *MemoryNetwork) Partition(groups ...[]int32) {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partition = make(map[int32]int)
+
+	if len(groups) == 0 {
+		return
+	}
+
+	for id := range n.servers {
+		n.partition[id] = -1 - int(id) // isolated
+	}
+
+	for i, group := range groups {
+		for _, id := range group {
+			n.partition[id] = i
+		}
+	}
+}
+
+// Return the transports used by the given replica to reach the others, indexed by replica ID.
+func (n *MemoryNetwork) Transports(from int32, size int) []Transport {
+
+	transports := make([]Transport, size)
+
+	for to := int32(0); to < int32(size); to++ {
+		if to != from {
+			transports[to] = &memoryTransport{network: n, from: from, to: to}
+		}
+	}
+
+	return transports
+}
+
+// Decide the fate of a message, returning whether it is delivered and after which delay.
+func (n *MemoryNetwork) route(from, to int32) (bool, time.Duration) {
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	link, ok := n.links[[2]int32{from, to}]
+	if !ok {
+		link = rand.New(rand.NewSource(n.seed + int64(from)<<32 + int64(to)<<16))
+		n.links[[2]int32{from, to}] = link
+	}
+
+	delivered := n.partition[from] == n.partition[to] && link.Float64() >= n.DropRate
+
+	delay := time.Duration(0)
+	if n.MaxDelay > 0 {
+		delay = time.Duration(link.Int63n(int64(n.MaxDelay)))
+	}
+
+	if n.Clock != nil {
+		delay++
+	}
+
+	if delivered {
+		n.Delivered++
+	} else {
+		n.Dropped++
+	}
+
+	return delivered, delay
+}
+
+// Wait for the message to be delivered, returning false if it is lost.
+func (n *MemoryNetwork) transmit(ctx context.Context, from, to int32) bool {
+
+	delivered, delay := n.route(from, to)
+
+	if !delivered && n.Timeout <= 0 {
+		<-ctx.Done()
+		return false
+	}
+
+	if !delivered {
+		delay += n.Timeout
+	}
+
+	if delay == 0 {
+		return ctx.Err() == nil
+	}
+
+	wait := time.After
+	if n.Clock != nil {
+		wait = n.Clock.After
+	}
+
+	select {
+	case <-wait(delay):
+		return delivered
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Deliver the request to the target replica and its response back, as copies.
+func (n *MemoryNetwork) call(ctx context.Context, from, to int32, request proto.Message, handle func(server protos.ConsensusServiceServer, request proto.Message) (proto.Message, error)) (proto.Message, error) {
+
+	n.mu.Lock()
+	server, ok := n.servers[to]
+	n.mu.Unlock()
+
+	if !ok {
+		return nil, status.Error(codes.Unavailable, "unknown replica")
+	}
+
+	if !n.transmit(ctx, from, to) {
+		return nil, n.lost(ctx)
+	}
+
+	response, err := handle(server, proto.Clone(request))
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.transmit(ctx, to, from) {
+		return nil, n.lost(ctx)
+	}
+
+	return proto.Clone(response), nil
+}
+
+// Return the error of an RPC whose request or response was lost.
+func (n *MemoryNetwork) lost(ctx context.Context) error {
+
+	if ctx.Err() == nil {
+		return status.Error(codes.DeadlineExceeded, "the message was lost")
+	}
+
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// The Transport of a replica to a peer on a MemoryNetwork.
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    int32
+	to      int32
+}
+
+func (c *memoryTransport) SendRequestVote(ctx context.Context, in *protos.RequestVoteMessage) (*protos.RequestVoteResponse, error) {
+
+	response, err := c.network.call(ctx, c.from, c.to, in, func(server protos.ConsensusServiceServer, request proto.Message) (proto.Message, error) {
+		return server.RequestVote(ctx, request.(*protos.RequestVoteMessage))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.RequestVoteResponse), nil
+}
+
+func (c *memoryTransport) SendAppendEntries(ctx context.Context, in *protos.AppendEntriesMessage) (*protos.AppendEntriesResponse, error) {
+
+	response, err := c.network.call(ctx, c.from, c.to, in, func(server protos.ConsensusServiceServer, request proto.Message) (proto.Message, error) {
+		return server.AppendEntries(ctx, request.(*protos.AppendEntriesMessage))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.AppendEntriesResponse), nil
+}
+
+func (c *memoryTransport) SendTimeoutNow(ctx context.Context, in *protos.TimeoutNowMessage) (*protos.TimeoutNowResponse, error) {
+
+	response, err := c.network.call(ctx, c.from, c.to, in, func(server protos.ConsensusServiceServer, request proto.Message) (proto.Message, error) {
+		return server.TimeoutNow(ctx, request.(*protos.TimeoutNowMessage))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.TimeoutNowResponse), nil
+}
+
+func (c *memoryTransport) SendInstallSnapshot(ctx context.Context, in *protos.InstallSnapshotMessage) (*protos.InstallSnapshotResponse, error) {
+
+	response, err := c.network.call(ctx, c.from, c.to, in, func(server protos.ConsensusServiceServer, request proto.Message) (proto.Message, error) {
+		return server.InstallSnapshot(ctx, request.(*protos.InstallSnapshotMessage))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.(*protos.InstallSnapshotResponse), nil
+}
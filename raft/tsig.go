@@ -0,0 +1,400 @@
+package raft
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"github.com/miekg/dns"
+)
+
+/*
+TSIG keys (RFC 8945) signing the DNS updates (see dns_update.go) and the zone transfers (see
+transfers.go) of the clients, such as DHCP servers, home routers and secondary name servers. A key
+has a name, an algorithm and a secret, and signs on behalf of a user of the client HTTP API, whose
+permission and roles decide the records it may change or transfer. The keys are stored under the reserved
+TSIGKeysPrefix, and are only changed through "TSIG" log entries, made by the endpoints:
+
+	GET    /admin/tsig-keys               lists the keys, without their secrets
+	PUT    /admin/tsig-keys/{name}        creates or replaces a key, given its user, algorithm
+	                                      (hmac-sha256 by default) and base64 secret (generated if
+	                                      left out) form values
+	POST   /admin/tsig-keys/{name}/rotate replaces the secret of a key (given, or generated), the
+	                                      previous one being accepted for the grace form value (a
+	                                      duration, tsigRotationGrace by default)
+	DELETE /admin/tsig-keys/{name}        revokes a key, at once
+
+Unlike the API tokens, the secrets can't be hashed, since they are needed to check the signatures:
+they are held as given by the log and the store, whose files must be kept private, and the keys are
+hidden from the client reads like the users. The responses of the PUT and rotation requests are the
+only ones holding the secrets. The uses of the keys are counted in dns_tsig_verifications_total{outcome},
+the outcome being valid, previous (a request signed with the secret replaced by a rotation), unknown
+or invalid.
+*/
+
+const (
+	TSIGKeysPrefix    = "_tsig:"  // Keys holding each TSIG key
+	tsigRotationGrace = time.Hour // Time the previous secret of a rotated key is accepted for, by default
+)
+
+// The algorithms of the TSIG keys.
+var tsigAlgorithms = map[string]bool{dns.HmacSHA1: true, dns.HmacSHA224: true, dns.HmacSHA256: true, dns.HmacSHA384: true, dns.HmacSHA512: true}
+
+// A TSIG key, as stored under TSIGKeysPrefix.
+type TSIGKey struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`        // e.g. "hmac-sha256."
+	Secret    string `json:"secret,omitempty"` // Base64 encoded, left out of the listings
+	User      string `json:"user"`             // User on behalf of whom the key signs
+
+	Previous      string    `json:"previous,omitempty"` // Secret replaced by the last rotation, left out of the listings
+	PreviousUntil time.Time `json:"previous_until"`     // Time until which the previous secret is accepted
+}
+
+// The TSIG keys known to a replica, safe for concurrent use.
+type TSIGKeys struct {
+	mu   sync.RWMutex
+	keys map[string]TSIGKey
+}
+
+func NewTSIGKeys() *TSIGKeys {
+	return &TSIGKeys{keys: make(map[string]TSIGKey)}
+}
+
+// Forget the TSIG keys, before they are loaded again from the store.
+func (k *TSIGKeys) reset() {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = make(map[string]TSIGKey)
+}
+
+// Return the name of the key in the form it is stored under, the TSIG names being case-insensitive.
+func tsigKeyName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Return the key with the given name, and whether it exists.
+func (k *TSIGKeys) Get(name string) (TSIGKey, bool) {
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[tsigKeyName(name)]
+	return key, ok
+}
+
+// Return the keys sorted by name, without their secrets.
+func (k *TSIGKeys) List() []TSIGKey {
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	list := make([]TSIGKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		key.Secret, key.Previous = "", ""
+		list = append(list, key)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Set the key with the given name, or remove it if key is nil.
+func (k *TSIGKeys) apply(name string, key *TSIGKey) {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key == nil {
+		delete(k.keys, name)
+	} else {
+		k.keys[name] = *key
+	}
+}
+
+// Return the operation of the log entry setting (or removing, if key is nil) a TSIG key.
+func tsigOperation(name string, key *TSIGKey) []string {
+
+	if key == nil {
+		return []string{"TSIG", name, "", "UNSET"}
+	}
+
+	record, _ := json.Marshal(key)
+	return []string{"TSIG", name, string(record), "SET"}
+}
+
+// Return the transaction applying the "TSIG" log entry to the key-value store, along with the name
+// and new record (nil if removed) of the key.
+func tsigTxn(entry *protos.LogEntry) (kv_store.Txn, string, *TSIGKey) {
+
+	name := entry.Operation[1]
+
+	if entry.Operation[3] == "UNSET" {
+		return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: TSIGKeysPrefix + name}}}, name, nil
+	}
+
+	var key TSIGKey
+	json.Unmarshal([]byte(entry.Operation[2]), &key)
+
+	return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: TSIGKeysPrefix + name, Value: entry.Operation[2]}}}, name, &key
+}
+
+// Load the TSIG keys persisted in the local key-value store.
+func (node *RaftNode) loadTSIGKeys() {
+
+	kvs, err := node.scanLocalStore(TSIGKeysPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the TSIG keys")
+		return
+	}
+
+	for _, kv := range kvs {
+
+		var key TSIGKey
+		if err := json.Unmarshal([]byte(kv.Value), &key); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid TSIG key record")
+			continue
+		}
+
+		node.Meta.tsig_keys.apply(key.Name, &key)
+	}
+
+	node.logger().Info().Int("count", len(kvs)).Msg("Loaded TSIG keys")
+}
+
+/*
+Check the TSIG signature of the raw message, returning the user on behalf of whom it is signed along
+with the secret it is signed with, to sign the response with, and whether it is valid. The previous
+secret of a rotated key is accepted until the end of its grace period.
+*/
+func (node *RaftNode) verifyTSIG(raw []byte, tsig *dns.TSIG) (User, string, bool) {
+
+	outcome := func(o string) {
+		node.Meta.metrics.Add("dns_tsig_verifications_total", 1, "outcome", o)
+	}
+
+	key, ok := node.Meta.tsig_keys.Get(tsig.Hdr.Name)
+	if !ok {
+		outcome("unknown")
+		return User{}, "", false
+	}
+
+	user, ok := node.Meta.users.Get(key.User)
+
+	// The verification strips the TSIG record from the message it is given.
+	verify := func(secret string) bool {
+		return dns.TsigVerify(append([]byte{}, raw...), secret, "", false) == nil
+	}
+
+	switch {
+
+	case !ok:
+		outcome("unknown")
+
+	case !strings.EqualFold(key.Algorithm, tsig.Algorithm):
+		outcome("invalid")
+
+	case verify(key.Secret):
+		outcome("valid")
+		return user, key.Secret, true
+
+	case key.Previous != "" && node.now().Before(key.PreviousUntil) && verify(key.Previous):
+		outcome("previous")
+		return user, key.Previous, true
+
+	default:
+		outcome("invalid")
+
+	}
+
+	return User{}, "", false
+}
+
+func (node *RaftNode) TSIGKeysHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.tsig_keys.List())
+}
+
+/*
+Handle requests creating or replacing (PUT) and revoking (DELETE) a TSIG key. A PUT request takes
+the user the key signs for, and its algorithm and secret, a random secret being generated if left
+out. A revoked key stops signing at once, even during the grace period of a rotation. The response,
+holding the secret, is sent once the change is applied on the leader.
+*/
+func (node *RaftNode) SetTSIGKeyHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("TSIG request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := tsigKeyName(mux.Vars(r)["name"])
+	if !userNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "Invalid TSIG key name: %q", name)
+		return
+	}
+
+	var key *TSIGKey
+
+	if r.Method == http.MethodDelete {
+
+		if _, ok := node.Meta.tsig_keys.Get(name); !ok {
+			writeError(w, http.StatusNotFound, "Error: TSIG key %v doesn't exist.", name)
+			return
+		}
+
+	} else {
+
+		key = &TSIGKey{Name: name, Algorithm: dns.Fqdn(strings.ToLower(r.FormValue("algorithm"))), Secret: r.FormValue("secret"), User: r.FormValue("user")}
+
+		if key.Algorithm == "." {
+			key.Algorithm = dns.HmacSHA256
+		}
+
+		if !tsigAlgorithms[key.Algorithm] {
+			writeError(w, http.StatusBadRequest, "Invalid algorithm %q, expected hmac-sha1, hmac-sha224, hmac-sha256, hmac-sha384 or hmac-sha512", key.Algorithm)
+			return
+		}
+
+		if _, ok := node.Meta.users.Get(key.User); !ok {
+			writeError(w, http.StatusBadRequest, "Error: User %q doesn't exist.", key.User)
+			return
+		}
+
+		if !node.tsigSecret(w, &key.Secret) {
+			return
+		}
+	}
+
+	index, ok := node.proposeTSIGKey(w, r, name, key)
+	if !ok {
+		return
+	}
+
+	if key == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "deleted": true, "index": index})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "algorithm": key.Algorithm, "secret": key.Secret, "user": key.User, "index": index})
+}
+
+/*
+Handle the requests rotating a TSIG key: its secret is replaced by the one given, or by a random
+one, the previous secret being accepted for the grace period given, so that the clients can be
+configured with the new secret in the meantime. The response, holding the new secret, is sent once
+the change is applied on the leader.
+*/
+func (node *RaftNode) RotateTSIGKeyHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("TSIG rotation request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := tsigKeyName(mux.Vars(r)["name"])
+
+	key, ok := node.Meta.tsig_keys.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "Error: TSIG key %v doesn't exist.", name)
+		return
+	}
+
+	grace := tsigRotationGrace
+	if value := r.FormValue("grace"); value != "" {
+
+		var err error
+		if grace, err = time.ParseDuration(value); err != nil || grace < 0 {
+			writeError(w, http.StatusBadRequest, "Invalid grace period %q, expected a duration such as 30m", value)
+			return
+		}
+	}
+
+	key.Previous, key.PreviousUntil, key.Secret = key.Secret, node.now().Add(grace).UTC(), r.FormValue("secret")
+
+	if !node.tsigSecret(w, &key.Secret) {
+		return
+	}
+
+	index, ok := node.proposeTSIGKey(w, r, name, &key)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "algorithm": key.Algorithm, "secret": key.Secret, "user": key.User, "previous_until": key.PreviousUntil, "index": index})
+}
+
+// Check the base64 encoded secret of a key, generating a random one if it is empty. The error is
+// written to w otherwise.
+func (node *RaftNode) tsigSecret(w http.ResponseWriter, secret *string) bool {
+
+	if *secret == "" {
+
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			writeError(w, http.StatusInternalServerError, "Error: %v", err)
+			return false
+		}
+
+		*secret = base64.StdEncoding.EncodeToString(random)
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(*secret); err != nil || len(decoded) == 0 {
+		writeError(w, http.StatusBadRequest, "Invalid secret, expected a base64 encoded value")
+		return false
+	}
+
+	return true
+}
+
+// Propose the change of a TSIG key (its removal if key is nil) on the leader, returning the index
+// of its log entry once applied. The error is written to w otherwise.
+func (node *RaftNode) proposeTSIGKey(w http.ResponseWriter, r *http.Request, name string, key *TSIGKey) (int32, bool) {
+
+	author := ""
+	if u, ok := requestUser(r.Context()); ok {
+		author = u.Name
+	}
+
+	node.GetRLock("Set TSIG Key Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Set TSIG Key Handler")
+		return 0, false
+	}
+
+	index, success, err := node.proposeCommand(r.Context(), tsigOperation(name, key), author) // releases the lock
+	if !success {
+		node.logger().Error().Err(err).Str("name", name).Msg("Error occured in TSIG request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in TSIG request: %v", err.Error())
+		return 0, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: TSIG key change committed but not applied yet: %v", err)
+		return 0, false
+	}
+
+	node.logger().Info().Str("name", name).Int32("index", index).Str("author", author).Msg("TSIG request completed successfully and committed")
+
+	return index, true
+}
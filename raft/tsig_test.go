@@ -0,0 +1,147 @@
+package raft
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the DNS updates signed with a TSIG key of the
+ * store are checked against its secret and algorithm, that the secrets are
+ * neither listed nor readable by the clients, and that the invalid keys are
+ * refused.
+ */
+func TestTSIGKeys(t *testing.T) {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.LocalAddr().String()
+	listener.Close()
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), users: NewUsers(), roles: NewRoles(), tsig_keys: NewTSIGKeys(), Config: DefaultConfig()}}
+	node.Meta.Config.DNS = DNSConfig{
+		Views:     []DNSView{{Name: "updates", Zones: []string{"example.com."}, Updates: true}},
+		Listeners: []DNSListener{{Address: address, Protocol: "udp", View: "updates"}},
+	}
+
+	dhcp := User{Name: "dhcp-user", Permission: PermissionWrite, TokenHash: hashToken("dhcp-token")}
+	node.Meta.users.apply(dhcp.Name, &dhcp)
+
+	secret := "c2VjcmV0IG9mIHRoZSBESENQIHNlcnZlcg=="
+	node.Meta.tsig_keys.apply("dhcp", &TSIGKey{Name: "dhcp", Algorithm: dns.HmacSHA512, Secret: secret, User: dhcp.Name})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node.StartDNSListeners(ctx)
+
+	update := func(key, algorithm, secret string) (*dns.Msg, error) {
+
+		req := new(dns.Msg)
+		req.SetUpdate("example.com.")
+		rr, _ := dns.NewRR("host.example.com. 60 IN A 192.0.2.7")
+		req.Insert([]dns.RR{rr})
+		req.SetTsig(key, algorithm, 300, 0)
+
+		client := &dns.Client{TsigSecret: map[string]string{key: secret}}
+
+		resp, _, err := client.Exchange(req, address)
+		return resp, err
+	}
+
+	// The signature is checked before the update is refused by the follower, the response being signed.
+	if resp, err := update("DHCP.", dns.HmacSHA512, secret); err != nil || resp.Rcode != dns.RcodeRefused || resp.IsTsig() == nil {
+		t.Errorf("Expected a signed refusal from a follower, got %v (%v)", resp, err)
+	}
+
+	if resp, err := update("dhcp.", dns.HmacSHA256, secret); err != nil && resp == nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected an update signed with another algorithm to be rejected, got %v (%v)", resp, err)
+	}
+
+	// The hash of the token, kept by the store and the backups, isn't a key of the user.
+	hash, _ := hex.DecodeString(dhcp.TokenHash)
+	if resp, err := update("dhcp-user.", dns.HmacSHA256, base64.StdEncoding.EncodeToString(hash)); err != nil && resp == nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected an update signed with the hash of the token of the user to be rejected, got %v (%v)", resp, err)
+	}
+
+	if keys := node.Meta.tsig_keys.List(); len(keys) != 1 || keys[0].Secret != "" || keys[0].User != dhcp.Name {
+		t.Errorf("Expected the key to be listed without its secret, got %+v", keys)
+	}
+
+	if contents := hideUsers(url.PathEscape(TSIGKeysPrefix+"dhcp"), "Value = {}\n"); contents != "Invalid key value pair\n" {
+		t.Errorf("Expected the key to be hidden from the client reads, got %q", contents)
+	}
+
+	if !reservedKey(TSIGKeysPrefix + "dhcp") {
+		t.Errorf("Expected the keys to be reserved")
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/tsig-keys/{name}", node.SetTSIGKeyHandler)
+
+	put := func(name string, form url.Values) int {
+
+		req := httptest.NewRequest(http.MethodPut, "/admin/tsig-keys/"+name, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, form := range []url.Values{
+		{"user": {"nobody"}},
+		{"user": {dhcp.Name}, "algorithm": {"hmac-md5"}},
+		{"user": {dhcp.Name}, "secret": {"not base64!"}},
+	} {
+		if code := put("laptop", form); code != http.StatusBadRequest {
+			t.Errorf("Expected the key %v to be refused, got %v", form, code)
+		}
+	}
+
+	if code := put("laptop", url.Values{"user": {dhcp.Name}}); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a follower to refuse a valid key, got %v", code)
+	}
+
+	r.HandleFunc("/admin/tsig-keys/{name}/rotate", node.RotateTSIGKeyHandler)
+
+	rotate := func(name string, form url.Values) int {
+
+		req := httptest.NewRequest(http.MethodPost, "/admin/tsig-keys/"+name+"/rotate", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, c := range []struct {
+		name string
+		form url.Values
+		code int
+	}{
+		{"laptop", url.Values{}, http.StatusNotFound},
+		{"dhcp", url.Values{"grace": {"an hour"}}, http.StatusBadRequest},
+		{"dhcp", url.Values{"secret": {"not base64!"}}, http.StatusBadRequest},
+		{"dhcp", url.Values{"grace": {"10m"}}, http.StatusServiceUnavailable},
+	} {
+		if code := rotate(c.name, c.form); code != c.code {
+			t.Errorf("Expected the rotation of %v with %v to be answered %v, got %v", c.name, c.form, c.code, code)
+		}
+	}
+
+	if key, _ := node.Meta.tsig_keys.Get("dhcp"); key.Secret != secret || key.Previous != "" {
+		t.Errorf("Expected the key to be left unchanged by the rotations refused, got %+v", key)
+	}
+}
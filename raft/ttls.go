@@ -0,0 +1,93 @@
+package raft
+
+import (
+	"fmt"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+TTL clamps of the zones of a view, bounding how long the resolvers, and the answer cache of the
+replica (see answercache.go), keep the answers of the names of a zone:
+
+	{"name": "external", "zones": ["example.com."], "ttls": [
+		{"zone": "example.com.", "min_ttl": 60, "max_ttl": 86400, "max_negative_ttl": 300},
+		{"zone": "dyn.example.com.", "max_ttl": 30}
+	]}
+
+The TTLs of the records of an answer are raised to min_ttl and lowered to max_ttl, 0 leaving them
+unbounded. The negative answers, NXDOMAIN and NODATA, are cached for the TTL of the SOA record of
+their authority section, the lesser of its own and of its minimum field (RFC 2308 section 5, see
+lookup.go): that TTL is clamped alike, and lowered to max_negative_ttl if set. The clamps of the
+closest enclosing zone of the name queried apply.
+*/
+
+// The TTL clamps of a zone of a view.
+type DNSTTLClamp struct {
+	Zone           string `json:"zone"`
+	MinTTL         uint32 `json:"min_ttl"`          // Lowest TTL answered, 0 for none
+	MaxTTL         uint32 `json:"max_ttl"`          // Highest TTL answered, 0 for none
+	MaxNegativeTTL uint32 `json:"max_negative_ttl"` // Highest TTL of the negative answers, 0 for none
+}
+
+func (c DNSTTLClamp) validate(view string) error {
+
+	if _, ok := dns.IsDomainName(c.Zone); !ok {
+		return fmt.Errorf("dns: view %v: invalid ttls zone %q", view, c.Zone)
+	}
+
+	if c.MaxTTL != 0 && c.MinTTL > c.MaxTTL {
+		return fmt.Errorf("dns: view %v: zone %v: expected min_ttl to be at most max_ttl", view, c.Zone)
+	}
+
+	return nil
+}
+
+// Return the TTL clamps of the closest enclosing zone of the name, which must be canonical.
+func (v DNSView) ttlClamp(name string) (DNSTTLClamp, bool) {
+
+	var clamp DNSTTLClamp
+	found := false
+
+	for _, c := range v.TTLs {
+		if z := zone.CanonicalName(c.Zone); zone.InZone(name, z) && (!found || len(z) > len(zone.CanonicalName(clamp.Zone))) {
+			clamp, found = c, true
+		}
+	}
+
+	return clamp, found
+}
+
+// Clamp the TTLs of the records of the answer of the name, which must be canonical.
+func (v DNSView) clampTTLs(name string, resp *dns.Msg) {
+
+	clamp, ok := v.ttlClamp(name)
+	if !ok {
+		return
+	}
+
+	negative := resp.Rcode == dns.RcodeNameError || resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0
+
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if h.Ttl < clamp.MinTTL {
+				h.Ttl = clamp.MinTTL
+			}
+
+			if clamp.MaxTTL != 0 && h.Ttl > clamp.MaxTTL {
+				h.Ttl = clamp.MaxTTL
+			}
+
+			if negative && h.Rrtype == dns.TypeSOA && clamp.MaxNegativeTTL != 0 && h.Ttl > clamp.MaxNegativeTTL {
+				h.Ttl = clamp.MaxNegativeTTL
+			}
+		}
+	}
+}
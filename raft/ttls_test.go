@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"github.com/miekg/dns"
+)
+
+/*
+ * This test case checks that the TTLs of the answers are raised and lowered
+ * to the clamps of the closest enclosing zone, that the negative answers are
+ * answered with the negative TTL of the SOA record, lowered to the maximum
+ * negative TTL, and cached for as long.
+ */
+func TestTTLClamps(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ttls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	put := func(name, rtype string, ttl uint32, data string) {
+		encoded, _ := json.Marshal([]zone.Record{{Name: name, Type: rtype, TTL: ttl, Data: data}})
+		txn, _ := json.Marshal(kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: zone.RecordKey(name, rtype), Value: string(encoded)}}})
+		kv.TxnHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/admin/txn", strings.NewReader(string(txn))))
+	}
+
+	put("example.com.", "SOA", 3600, "ns1.example.com. admin.example.com. 1 7200 900 1209600 900")
+	put("www.example.com.", "A", 5, "192.0.2.1")
+	put("static.example.com.", "A", 604800, "192.0.2.2")
+	put("host.dyn.example.com.", "A", 600, "192.0.2.3")
+
+	clock := NewManualClock(time.Unix(100, 0))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), Config: DefaultConfig(), clock: clock}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.Meta.Config.DNS.AnswerCache = DNSAnswerCache{Size: 10}
+
+	view := DNSView{Name: "external", TTLs: []DNSTTLClamp{
+		{Zone: "example.com.", MinTTL: 60, MaxTTL: 86400, MaxNegativeTTL: 300},
+		{Zone: "dyn.example.com", MaxTTL: 30},
+	}}
+
+	config := DNSConfig{Views: []DNSView{view}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		return node.answerDNS(view, req, nil)
+	}
+
+	for name, ttl := range map[string]uint32{"www.example.com.": 60, "static.example.com.": 86400, "host.dyn.example.com.": 30} {
+		if resp := query(name); len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != ttl {
+			t.Errorf("Expected %v to be answered with a TTL of %v, got %v", name, ttl, resp.Answer)
+		}
+	}
+
+	// The negative TTL is the minimum of the SOA record, 900 seconds, lowered to 300.
+	resp := query("missing.example.com.")
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl != 300 {
+		t.Errorf("Expected an NXDOMAIN answer with a negative TTL of 300, got %v", resp)
+	}
+
+	if resp := query("missing.dyn.example.com."); len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl != 30 {
+		t.Errorf("Expected the negative TTL to be clamped by the closest zone, got %v", resp)
+	}
+
+	put("missing.example.com.", "A", 60, "192.0.2.4")
+
+	clock.Advance(299 * time.Second)
+	if resp := query("missing.example.com."); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("Expected the NXDOMAIN answer to be cached for its negative TTL, got %v", resp)
+	}
+
+	clock.Advance(time.Second)
+	if resp := query("missing.example.com."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("Expected the NXDOMAIN answer to expire after its negative TTL, got %v", resp)
+	}
+
+	for _, clamp := range []DNSTTLClamp{{Zone: "example..com"}, {Zone: "example.com.", MinTTL: 60, MaxTTL: 30}} {
+		if err := clamp.validate("external"); err == nil {
+			t.Errorf("Expected the clamp %+v to be invalid", clamp)
+		}
+	}
+}
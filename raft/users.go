@@ -0,0 +1,486 @@
+package raft
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+Authentication of the client HTTP API, enabled by setting HTTPAdminToken. Every request (other than
+to /test) then has to authenticate, either with a bearer API token or with HTTP basic auth, and is
+only served if the user is allowed to make it:
+
+	read   GET requests on keys, ranges and prefixes, and the leader metadata (/admin/leader)
+	write  read, plus writes, compactions, barriers and the registration of client sessions
+	admin  everything, including the other /admin endpoints and the management of the users
+
+A user may also be granted access to some of the keys only, through its roles (see acl.go).
+
+The holder of HTTPAdminToken is an admin, and creates the other users through /admin/users. Users
+are stored in the key-value store under the reserved UsersPrefix, and are only changed through
+"USER" log entries, like the cluster settings (see settings.go). Passwords and API tokens are hashed
+by the leader before being proposed, so they never appear in the log or in the store, and the keys
+of the users are hidden from client reads.
+*/
+
+const UsersPrefix = "_users:" // Keys holding the record of each user
+
+const (
+	PermissionRead  = "read"
+	PermissionWrite = "write"
+	PermissionAdmin = "admin"
+)
+
+var permissionLevels = map[string]int{PermissionRead: 1, PermissionWrite: 2, PermissionAdmin: 3}
+
+var userNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+// A user of the client HTTP API, as stored under UsersPrefix.
+type User struct {
+	Name         string   `json:"name"`
+	Permission   string   `json:"permission"`              // May be empty if the user only has access through its roles
+	Roles        []string `json:"roles,omitempty"`         // Names of the roles of the user, see acl.go
+	PasswordHash string   `json:"password_hash,omitempty"` // bcrypt hash of the password, for basic auth
+	TokenHash    string   `json:"token_hash,omitempty"`    // Hex encoded SHA-256 hash of the API token
+}
+
+// Whether the user is allowed to make requests requiring the given permission.
+func (u User) allows(permission string) bool {
+	return permissionLevels[u.Permission] >= permissionLevels[permission]
+}
+
+// The users known to a replica, safe for concurrent use.
+type Users struct {
+	mu     sync.RWMutex
+	users  map[string]User
+	tokens map[string]string // Name of the user holding each API token, by hash of the token
+}
+
+func NewUsers() *Users {
+	return &Users{users: make(map[string]User), tokens: make(map[string]string)}
+}
+
+// Forget the users, before they are loaded again from the store.
+func (u *Users) reset() {
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.users = make(map[string]User)
+	u.tokens = make(map[string]string)
+}
+
+// Return the user with the given name, and whether it exists.
+func (u *Users) Get(name string) (User, bool) {
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	user, ok := u.users[name]
+	return user, ok
+}
+
+// Return the user holding the given API token.
+func (u *Users) byToken(token string) (User, bool) {
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	user, ok := u.users[u.tokens[hashToken(token)]]
+	return user, ok
+}
+
+// Return the users sorted by name, without their secrets.
+func (u *Users) List() []User {
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+
+	list := make([]User, 0, len(u.users))
+	for _, user := range u.users {
+		list = append(list, User{Name: user.Name, Permission: user.Permission, Roles: user.Roles})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Replace the record of the user with the given name, or remove it if user is nil.
+func (u *Users) apply(name string, user *User) {
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if old, ok := u.users[name]; ok {
+		delete(u.tokens, old.TokenHash)
+		delete(u.users, name)
+	}
+
+	if user != nil {
+
+		u.users[name] = *user
+
+		if user.TokenHash != "" {
+			u.tokens[user.TokenHash] = name
+		}
+	}
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Whether the key holds the record of a user, a TSIG key (see tsig.go) or a webhook (see webhooks.go),
+// which clients can't read.
+func hiddenKey(key string) bool {
+	return strings.HasPrefix(key, UsersPrefix) || strings.HasPrefix(key, TSIGKeysPrefix) || strings.HasPrefix(key, WebhooksPrefix)
+}
+
+/*
+Remove the records of the users from the response to a read of the given path of the local
+key-value store (see fetchFromStore): reads of a single user fail as if it didn't exist, and the
+users are left out of the pages of range and prefix queries.
+*/
+func hideUsers(path string, contents string) string {
+
+	endpoint := path
+	if i := strings.Index(path, "?"); i != -1 {
+		endpoint = path[:i]
+	}
+
+	if endpoint != "range" && !strings.HasPrefix(endpoint, "prefix/") {
+
+		if key, err := url.PathUnescape(endpoint); err == nil && hiddenKey(key) {
+			return "Invalid key value pair\n"
+		}
+
+		return contents
+	}
+
+	if !strings.Contains(contents, UsersPrefix) && !strings.Contains(contents, TSIGKeysPrefix) && !strings.Contains(contents, WebhooksPrefix) {
+		return contents
+	}
+
+	return filterPage(contents, func(key string) bool { return !hiddenKey(key) })
+}
+
+// Keep only the keys for which keep returns true in the JSON page of a range or prefix query.
+func filterPage(contents string, keep func(key string) bool) string {
+
+	var page kv_store.RangeResponse
+	if err := json.Unmarshal([]byte(contents), &page); err != nil {
+		return contents
+	}
+
+	kvs := page.Kvs[:0]
+	for _, kv := range page.Kvs {
+		if keep(kv.Key) {
+			kvs = append(kvs, kv)
+		}
+	}
+	page.Kvs = kvs
+
+	encoded, _ := json.Marshal(page)
+	return string(encoded) + "\n"
+}
+
+// Return the operation of the log entry setting (or removing, if user is nil) the record of a user.
+func userOperation(name string, user *User) []string {
+
+	if user == nil {
+		return []string{"USER", name, "", "UNSET"}
+	}
+
+	record, _ := json.Marshal(user)
+	return []string{"USER", name, string(record), "SET"}
+}
+
+// Return the transaction applying the "USER" log entry to the key-value store, along with the
+// name and new record (nil if removed) of the user.
+func userTxn(entry *protos.LogEntry) (kv_store.Txn, string, *User) {
+
+	name := entry.Operation[1]
+
+	if entry.Operation[3] == "UNSET" {
+		return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpDelete, Key: UsersPrefix + name}}}, name, nil
+	}
+
+	var user User
+	json.Unmarshal([]byte(entry.Operation[2]), &user)
+
+	return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: UsersPrefix + name, Value: entry.Operation[2]}}}, name, &user
+}
+
+// Load the users persisted in the local key-value store.
+func (node *RaftNode) loadUsers() {
+
+	kvs, err := node.scanLocalStore(UsersPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the users")
+		return
+	}
+
+	for _, kv := range kvs {
+
+		var user User
+		if err := json.Unmarshal([]byte(kv.Value), &user); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid user record")
+			continue
+		}
+
+		node.Meta.users.apply(user.Name, &user)
+	}
+
+	node.logger().Info().Int("count", len(kvs)).Msg("Loaded users")
+}
+
+// Return the permission required for the request, or "" if it can be made without authenticating.
+func requiredPermission(r *http.Request) string {
+
+	switch {
+
+	case r.URL.Path == "/test" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/openapi.json":
+		return ""
+
+	case r.URL.Path == "/admin/leader":
+		return PermissionRead
+
+	case r.URL.Path == "/admin/compact" || r.URL.Path == "/admin/sessions" || r.URL.Path == "/admin/barrier":
+		return PermissionWrite
+
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return PermissionAdmin
+
+	case r.Method == http.MethodGet, zoneValidation(r):
+		return PermissionRead
+
+	}
+
+	return PermissionWrite
+}
+
+var errUnauthenticated = errors.New("invalid credentials")
+
+// Return the user making the request, from its bearer token or basic auth credentials.
+func (node *RaftNode) authenticate(r *http.Request) (User, error) {
+
+	if name, password, ok := r.BasicAuth(); ok {
+
+		user, ok := node.Meta.users.Get(name)
+		if !ok || user.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+			return User{}, errUnauthenticated
+		}
+
+		return user, nil
+	}
+
+	return node.tokenUser(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// Return the user holding the given API token.
+func (node *RaftNode) tokenUser(token string) (User, error) {
+
+	if token == "" {
+		return User{}, errors.New("missing credentials")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(node.Meta.Config.HTTPAdminToken)) == 1 {
+		return User{Name: "admin", Permission: PermissionAdmin}, nil
+	}
+
+	if user, ok := node.Meta.users.byToken(token); ok {
+		return user, nil
+	}
+
+	return User{}, errUnauthenticated
+}
+
+type userContextKey struct{}
+
+// Return the user who made the request, if it was authenticated.
+func requestUser(ctx context.Context) (User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(User)
+	return user, ok
+}
+
+// Middleware rejecting the requests that aren't made by a user with the permission they require,
+// with 401 Unauthorized or 403 Forbidden.
+func (node *RaftNode) authMiddleware(next http.Handler) http.Handler {
+
+	if node.Meta.Config.HTTPAdminToken == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		required := requiredPermission(r)
+		if required == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := node.authenticate(r)
+		if err != nil {
+			node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", "unauthenticated")
+			if httpTrafficClass(r) == classWrite {
+				node.rejectRequest(rejectACL, r, err)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="distributed-dns"`)
+			writeError(w, http.StatusUnauthorized, "Error: %v.", err)
+			return
+		}
+
+		if !user.allows(required) && !node.allowedByRoles(r, user, required) {
+			node.Meta.metrics.Add("http_requests_rejected_total", 1, "reason", "forbidden")
+			if httpTrafficClass(r) == classWrite {
+				node.rejectRequest(rejectACL, r, fmt.Errorf("user %v doesn't have the %v permission", user.Name, required))
+			}
+			writeError(w, http.StatusForbidden, "Error: user %v doesn't have the %v permission.", user.Name, required)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// Handle requests listing the users, as applied by this replica.
+func (node *RaftNode) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.users.List())
+}
+
+/*
+Handle requests creating or updating (PUT) and removing (DELETE) a user. A PUT request takes the
+permission of the user, its comma-separated roles, and its password and/or API token: those left
+out are kept from the current record of the user. The response is sent once the change is applied on the leader.
+*/
+func (node *RaftNode) SetUserHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("USER request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !userNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "Invalid user name: %q", name)
+		return
+	}
+
+	current, exists := node.Meta.users.Get(name)
+
+	var user *User
+
+	if r.Method == http.MethodDelete {
+
+		if !exists {
+			writeError(w, http.StatusNotFound, "Error: User %v doesn't exist.", name)
+			return
+		}
+
+	} else {
+
+		user = &current
+		user.Name = name
+
+		if permission, ok := r.Form["permission"]; ok {
+			user.Permission = permission[0]
+		}
+
+		if roles, ok := r.Form["roles"]; ok {
+
+			user.Roles = nil
+
+			for _, role := range strings.Split(roles[0], ",") {
+
+				if role = strings.TrimSpace(role); role == "" {
+					continue
+				}
+
+				if _, ok := node.Meta.roles.Get(role); !ok {
+					writeError(w, http.StatusBadRequest, "Error: Role %v doesn't exist.", role)
+					return
+				}
+
+				user.Roles = append(user.Roles, role)
+			}
+		}
+
+		if _, ok := permissionLevels[user.Permission]; !ok && (user.Permission != "" || len(user.Roles) == 0) {
+			writeError(w, http.StatusBadRequest, "Invalid permission %q, expected %v, %v or %v (or none, with roles)", user.Permission, PermissionRead, PermissionWrite, PermissionAdmin)
+			return
+		}
+
+		if password := r.FormValue("password"); password != "" {
+
+			hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Invalid password: %v", err)
+				return
+			}
+
+			user.PasswordHash = string(hash)
+		}
+
+		if token := r.FormValue("token"); token != "" {
+			user.TokenHash = hashToken(token)
+		}
+
+		if user.PasswordHash == "" && user.TokenHash == "" {
+			writeError(w, http.StatusBadRequest, "Error: A password or an API token is required.")
+			return
+		}
+	}
+
+	author := ""
+	if u, ok := requestUser(r.Context()); ok {
+		author = u.Name
+	}
+
+	node.GetRLock("Set User Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Set User Handler")
+		return
+	}
+
+	index, success, err := node.proposeCommand(r.Context(), userOperation(name, user), author) // releases the lock
+	if !success {
+		node.logger().Error().Err(err).Str("name", name).Msg("Error occured in USER request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in USER request: %v", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: User change committed but not applied yet: %v", err)
+		return
+	}
+
+	node.logger().Info().Str("name", name).Int32("index", index).Str("author", author).Msg("USER request completed successfully and committed")
+
+	updated, _ := node.Meta.users.Get(name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "permission": updated.Permission, "roles": updated.Roles, "index": index})
+}
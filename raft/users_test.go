@@ -0,0 +1,109 @@
+package raft
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ * This test case checks that requests to the client HTTP API are only served
+ * if made with valid credentials of a user having the permission they require,
+ * and that the records of the users are hidden from client reads.
+ */
+func TestUserAuthentication(t *testing.T) {
+
+	node := &RaftNode{Meta: &NodeMetadata{metrics: NewMetrics(), users: NewUsers(), rejections: NewRejections(), Config: DefaultConfig()}}
+	node.Meta.Config.HTTPAdminToken = "root-token"
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	reader := User{Name: "reader", Permission: PermissionRead, TokenHash: hashToken("reader-token")}
+	writer := User{Name: "writer", Permission: PermissionWrite, PasswordHash: string(hash)}
+
+	for _, user := range []User{reader, writer} {
+		txn, name, record := userTxn(&protos.LogEntry{Operation: userOperation(user.Name, &user)})
+		if name != user.Name || !reflect.DeepEqual(*record, user) || txn.Success[0].Key != UsersPrefix+user.Name {
+			t.Fatalf("Unexpected transaction %v for user %v", txn, user.Name)
+		}
+		node.Meta.users.apply(name, record)
+	}
+
+	var served string
+	handler := node.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := requestUser(r.Context())
+		served = user.Name
+	}))
+
+	serve := func(method, path string, auth func(r *http.Request)) int {
+
+		served = ""
+
+		r := httptest.NewRequest(method, path, nil)
+		if auth != nil {
+			auth(r)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	basic := func(name, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(name, password) }
+	}
+
+	cases := []struct {
+		method, path string
+		auth         func(r *http.Request)
+		code         int
+		user         string
+	}{
+		{"GET", "/test", nil, http.StatusOK, ""},
+		{"GET", "/key", nil, http.StatusUnauthorized, ""},
+		{"GET", "/key", bearer("wrong-token"), http.StatusUnauthorized, ""},
+		{"GET", "/key", bearer("reader-token"), http.StatusOK, "reader"},
+		{"PUT", "/key", bearer("reader-token"), http.StatusForbidden, ""},
+		{"PUT", "/key", basic("writer", "secret"), http.StatusOK, "writer"},
+		{"PUT", "/key", basic("writer", "wrong"), http.StatusUnauthorized, ""},
+		{"POST", "/admin/compact", basic("writer", "secret"), http.StatusOK, "writer"},
+		{"GET", "/admin/status", basic("writer", "secret"), http.StatusForbidden, ""},
+		{"PUT", "/admin/users/reader", bearer("root-token"), http.StatusOK, "admin"},
+	}
+
+	for _, c := range cases {
+		if code := serve(c.method, c.path, c.auth); code != c.code || served != c.user {
+			t.Errorf("%v %v: expected status %v served for %q, got %v served for %q", c.method, c.path, c.code, c.user, code, served)
+		}
+	}
+
+	// Removing a user revokes its token.
+	node.Meta.users.apply("reader", nil)
+	if code := serve("GET", "/key", bearer("reader-token")); code != http.StatusUnauthorized {
+		t.Errorf("Expected the token of a removed user to be rejected, got %v", code)
+	}
+
+	if contents := hideUsers(url.PathEscape(UsersPrefix+"writer"), "Value = {}\n"); contents != "Invalid key value pair\n" {
+		t.Errorf("Expected the read of a user to fail, got %q", contents)
+	}
+
+	page := `{"kvs":[{"key":"_settings:a","value":"1"},{"key":"_users:writer","value":"{}"}],"next_token":"abc"}`
+	if contents := hideUsers("range?start=_", page); strings.Contains(contents, UsersPrefix) || !strings.Contains(contents, "_settings:a") || !strings.Contains(contents, "abc") {
+		t.Errorf("Expected the users to be left out of the range, got %q", contents)
+	}
+
+	if !reservedKey(UsersPrefix + "writer") {
+		t.Errorf("Expected the keys of the users to be reserved")
+	}
+}
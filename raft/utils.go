@@ -2,12 +2,14 @@ package raft
 
 import (
 	"context"
-	"log"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
 	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/logging"
+	"github.com/rs/zerolog"
 )
 
 // Reference for colourization: https://twinnation.org/articles/35/how-to-add-colors-to-your-console-terminal-output-in-go
@@ -40,9 +42,20 @@ func init() {
 func CheckErrorFatal(err error) {
 
 	if err != nil {
-		log.Fatalf(Red + "[Fatal Error]" + Reset + ": " + err.Error()) // The Fatalf functions call os.Exit(1) after writing the log message.
+		logging.Logger.Fatal().Err(err).Msg("Fatal error") // Fatal calls os.Exit(1) after writing the log message.
+	}
+
+}
+
+// The logger of the replica, carrying its ID. Falls back to the global logger for nodes not created
+// by InitializeNode (e.g. in the tests).
+func (node *RaftNode) logger() *zerolog.Logger {
+
+	if node.Meta == nil || node.Meta.logger == nil {
+		return &logging.Logger
 	}
 
+	return node.Meta.logger
 }
 
 func (node *RaftNode) GetLock(where string) {
@@ -75,30 +88,44 @@ func (node *RaftNode) ReleaseRLock(where string) {
 
 }
 
-// Listen for termination signal and call master cancel. Wait for spawned goroutines to exit.
+// Listen for termination signal (or a shutdown requested through /admin/shutdown, see decommission.go)
+// and call master cancel. Wait for spawned goroutines to exit, then delete the data if requested.
 func (node *RaftNode) ListenForShutdown(master_cancel context.CancelFunc) {
 
 	// We capture termination signals and ensure that the program shuts down properly.
 	os_sigs := make(chan os.Signal, 1)                      // Listen for OS signals, with buffer size 1
 	signal.Notify(os_sigs, syscall.SIGTERM, syscall.SIGINT) // SIGKILL and SIGSTOP cannot be caught by a program
 
-	rcvd_sig := <-os_sigs
+	reason, wipe := "", false
+
+	select {
+	case rcvd_sig := <-os_sigs:
+		node.logger().Info().Str("signal", rcvd_sig.String()).Msg("Termination signal received")
+		reason = rcvd_sig.String()
+	case wipe = <-node.Meta.shutdown_requests:
+		node.logger().Info().Bool("wipe", wipe).Msg("Shutdown requested")
+		reason = "requested"
+	}
 
-	log.Printf("\n\nTermination signal received: %v\n", rcvd_sig)
+	node.WriteDiagnosticsBundle("shutdown: "+reason, true)
 
 	signal.Stop(os_sigs) // Stop listening for signals
 	close(os_sigs)
 
 	master_cancel()
 
-	log.Println()
+	// The data is deleted once the modules are shut down, or given up on.
+	if wipe {
+		defer node.wipeData()
+	}
+
 	for i := 1; i <= 4; i++ {
 
 		select {
 		case str := <-node.Meta.shutdown_chan:
-			log.Printf("[%v/4] %v", i, str)
+			node.logger().Info().Msgf("[%v/4] %v", i, str)
 		case <-time.After(5 * time.Second):
-			log.Printf("\nTimeout expired, force shutdown invoked.\n")
+			node.logger().Warn().Msg("Timeout expired, force shutdown invoked")
 			return
 		}
 
@@ -0,0 +1,86 @@
+package raft
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/krithikvaidya/distributed-dns/zone"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Validation of the keys written by the clients, before their writes are proposed, by the HTTP API
+(raft_server.go and batch.go), the KVService and the Propose API (api.go) alike. A key must:
+
+  - be non-empty and hold no "/", so that the HTTP API can route it.
+  - be at most maxKeyLength bytes long.
+  - be valid UTF-8, without control characters.
+
+The keys written must also not be the path of a fixed route of the HTTP API (reservedKeys, e.g.
+"range"), which /{key} would never reach to read them back. The keys of the DNS records (under
+zone.KeyPrefix) written must be the canonical keys of RRsets of valid names, following the syntax of
+RFC 1035, and known types, or of their policies (see zone.ValidRecordKey), so that the records stored
+can be answered. The deletes aren't checked beyond the first rules, so that the keys stored before
+these checks can still be removed.
+
+The invalid keys are rejected with InvalidArgument, answered with 400 by the HTTP API, and journaled
+with the validation reason (see rejections.go).
+*/
+
+const maxKeyLength = 1024
+
+// The fixed routes of a single segment of the HTTP API of the replicas (see routes in initial_setup.go)
+// and of the key-value store (see kv_store.Router), registered before /{key}.
+var reservedKeys = map[string]bool{
+	"test":         true,
+	"healthz":      true,
+	"readyz":       true,
+	"openapi.json": true,
+	"range":        true,
+	"audit":        true,
+	"batch":        true,
+	"kvstore":      true,
+	"locks":        true,
+}
+
+// Return an InvalidArgument error if the key isn't valid, see above.
+func validateKey(key string) error {
+
+	switch {
+
+	case key == "" || strings.Contains(key, "/"):
+		return status.Errorf(codes.InvalidArgument, "invalid key %q", key)
+
+	case len(key) > maxKeyLength:
+		return status.Errorf(codes.InvalidArgument, "invalid key %.32q..., longer than %v bytes", key, maxKeyLength)
+
+	case !utf8.ValidString(key):
+		return status.Errorf(codes.InvalidArgument, "invalid key %q, not valid UTF-8", key)
+
+	case strings.IndexFunc(key, unicode.IsControl) != -1:
+		return status.Errorf(codes.InvalidArgument, "invalid key %q, holding control characters", key)
+
+	}
+
+	return nil
+}
+
+// Return an InvalidArgument error if a value can't be written under the key, see above.
+func validateWrittenKey(key string) error {
+
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	if reservedKeys[key] {
+		return status.Errorf(codes.InvalidArgument, "invalid key %q, the path of a route of the HTTP API", key)
+	}
+
+	if err := zone.ValidRecordKey(key); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package raft
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+const (
+	watchBufferSize = 128 // events buffered per watcher before it is considered too slow and dropped
+)
+
+// A client watching the changes made to a key (or to all keys with a given prefix).
+type watcher struct {
+	key    string
+	prefix bool
+	events chan *protos.WatchEvent // closed if the watcher falls behind or is cancelled
+}
+
+// WatchHub keeps track of the active watchers, and delivers the changes applied to the
+// local state machine to them.
+type WatchHub struct {
+	mu       sync.Mutex
+	next_id  int
+	watchers map[int]*watcher
+}
+
+// Initialise WatchHub object
+func NewWatchHub() *WatchHub {
+
+	return &WatchHub{
+		watchers: make(map[int]*watcher),
+	}
+
+}
+
+// Register a new watcher, returning its id along with the channel the events are delivered on.
+func (hub *WatchHub) Subscribe(key string, prefix bool) (int, <-chan *protos.WatchEvent) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	id := hub.next_id
+	hub.next_id++
+
+	w := &watcher{
+		key:    key,
+		prefix: prefix,
+		events: make(chan *protos.WatchEvent, watchBufferSize),
+	}
+
+	hub.watchers[id] = w
+
+	return id, w.events
+}
+
+// Remove a watcher, closing its channel.
+func (hub *WatchHub) Unsubscribe(id int) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if w, ok := hub.watchers[id]; ok {
+		close(w.events)
+		delete(hub.watchers, id)
+	}
+}
+
+// Deliver an event to all the watchers interested in its key. Publishing never blocks the
+// caller (the apply loop): watchers whose buffer is full are dropped instead.
+func (hub *WatchHub) Publish(event *protos.WatchEvent) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for id, w := range hub.watchers {
+
+		if w.key == event.Key || (w.prefix && strings.HasPrefix(event.Key, w.key)) {
+			hub.send(id, w, event)
+		}
+	}
+}
+
+// Deliver an event to all the watchers, whatever key they are watching. Like Publish, it never blocks.
+func (hub *WatchHub) Notify(event *protos.WatchEvent) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	for id, w := range hub.watchers {
+		hub.send(id, w, event)
+	}
+}
+
+// Deliver an event to a watcher, dropping the watcher if its buffer is full. Must be called with hub.mu held.
+func (hub *WatchHub) send(id int, w *watcher, event *protos.WatchEvent) {
+
+	select {
+	case w.events <- event:
+	default:
+		close(w.events)
+		delete(hub.watchers, id)
+	}
+}
@@ -0,0 +1,624 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+/*
+Webhooks exporting the changes applied to the store to external systems, e.g. a CMDB or a cache to
+purge. A webhook has a name, the URL the changes are POSTed to, and a filter: the keys with a prefix,
+or the records of a zone (its RRsets, the response policies aside), all the keys otherwise. The
+webhooks are stored under the reserved WebhooksPrefix, and are only changed through "WEBHOOK" log
+entries, made by the endpoints:
+
+	GET    /admin/webhooks         lists the webhooks, without their secrets, and the state of their
+	                               deliveries on the leader
+	PUT    /admin/webhooks/{name}  creates or replaces a webhook, given its url, and its prefix or
+	                               zone and secret form values
+	DELETE /admin/webhooks/{name}  removes a webhook
+
+Every webhookInterval, the leader delivers to each webhook the changes of its keys between the
+revision of the store it delivered last and the current one (see kv_store/mvcc.go), the keys of the
+reserved namespaces aside, as a JSON WebhookDelivery:
+
+	{"webhook": "cmdb", "from": 41, "to": 57, "changes": [{"key": "dns:www.example.com.:A", "before": "...", "after": "..."}]}
+
+A key changed several times between the revisions is delivered once, with its values at both. The
+body is signed with the secret of the webhook, if any, in the X-Webhook-Signature header
+("sha256=" and the hex encoded HMAC-SHA256 of the body). A 2xx response acknowledges the delivery,
+whose revision is then recorded under WebhookCursorsPrefix through the log (by the webhookClient
+client), so that the next leader resumes from it: the changes are delivered at least once, and again
+if the leader changes before recording the delivery. The failed deliveries are retried with an
+exponential backoff, up to webhookMaxBackoff. A new webhook starts from the revision of its first
+check. If the changes since the revision delivered last are no longer retained (the history being
+compacted), a delivery with reset set and no changes tells the receiver to read the keys again, and
+the next ones start from the current revision.
+
+The deliveries are counted in webhook_deliveries_total{webhook, outcome}, the outcome being
+delivered, failed or reset.
+*/
+
+const (
+	WebhooksPrefix       = "_webhooks:"        // Keys holding each webhook
+	WebhookCursorsPrefix = "_webhook_cursors:" // Keys holding the revision delivered last to each webhook
+
+	webhookInterval   = 5 * time.Second  // Interval of the deliveries, and first delay of their retries
+	webhookMaxBackoff = 5 * time.Minute  // Longest delay of the retries of a failed delivery
+	webhookTimeout    = 10 * time.Second // Time allowed for a delivery
+	webhookClient     = "webhooks"       // Client of the transactions recording the deliveries
+)
+
+var webhookHTTPClient = &http.Client{Timeout: webhookTimeout}
+
+// A webhook, as stored under WebhooksPrefix.
+type Webhook struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Prefix string `json:"prefix,omitempty"` // Keys whose changes are delivered
+	Zone   string `json:"zone,omitempty"`   // Zone whose records' changes are delivered, in place of a prefix
+	Secret string `json:"secret,omitempty"` // Key of the signatures of the deliveries, left out of the listings
+}
+
+// Whether the changes of the key are delivered to the webhook.
+func (h Webhook) matches(key string) bool {
+
+	if reservedKey(key) {
+		return false
+	}
+
+	if h.Zone != "" {
+		owner, _, ok := zone.ParseRecordKey(key)
+		return ok && zone.InZone(owner, h.Zone) && !zone.IsPolicyKey(key)
+	}
+
+	return strings.HasPrefix(key, h.Prefix)
+}
+
+// Return the prefix of the keys whose changes are read for the webhook.
+func (h Webhook) keyPrefix() string {
+
+	if h.Zone != "" {
+		return zone.KeyPrefix
+	}
+
+	return h.Prefix
+}
+
+// The changes delivered to a webhook.
+type WebhookDelivery struct {
+	Webhook string            `json:"webhook"`
+	From    int64             `json:"from"` // Revision of the store delivered last
+	To      int64             `json:"to"`   // Revision of the store delivered
+	Reset   bool              `json:"reset,omitempty"`
+	Changes []kv_store.Change `json:"changes"`
+}
+
+// A webhook, along with the state of its deliveries on the leader.
+type WebhookStatus struct {
+	Webhook
+	Revision    int64     `json:"revision"` // Revision of the store delivered or checked last by the leader
+	Failures    int       `json:"failures"` // Consecutive failed deliveries
+	LastError   string    `json:"last_error,omitempty"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+// The state of the deliveries to a webhook on the leader.
+type webhookState struct {
+	revision    int64 // Revision checked last, whose changes were delivered or didn't concern the webhook
+	failures    int
+	lastError   string
+	nextAttempt time.Time
+}
+
+// The webhooks known to a replica, safe for concurrent use.
+type Webhooks struct {
+	mu     sync.RWMutex
+	hooks  map[string]Webhook
+	states map[string]*webhookState // Deliveries made by the replica while it is the leader
+}
+
+func NewWebhooks() *Webhooks {
+	return &Webhooks{hooks: make(map[string]Webhook), states: make(map[string]*webhookState)}
+}
+
+// Forget the webhooks, before they are loaded again from the store. The deliveries made are kept.
+func (h *Webhooks) reset() {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.hooks = make(map[string]Webhook)
+}
+
+// Return the webhook with the given name, and whether it exists.
+func (h *Webhooks) Get(name string) (Webhook, bool) {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	hook, ok := h.hooks[name]
+	return hook, ok
+}
+
+// Return the webhooks sorted by name, without their secrets, along with the state of their
+// deliveries.
+func (h *Webhooks) List() []WebhookStatus {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	list := make([]WebhookStatus, 0, len(h.hooks))
+	for name, hook := range h.hooks {
+
+		hook.Secret = ""
+		status := WebhookStatus{Webhook: hook}
+
+		if state, ok := h.states[name]; ok {
+			status.Revision, status.Failures, status.LastError, status.NextAttempt = state.revision, state.failures, state.lastError, state.nextAttempt
+		}
+
+		list = append(list, status)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Set the webhook with the given name, or remove it if hook is nil.
+func (h *Webhooks) apply(name string, hook *Webhook) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hook == nil {
+		delete(h.hooks, name)
+		delete(h.states, name)
+	} else {
+		h.hooks[name] = *hook
+	}
+}
+
+// Return the webhooks sorted by name.
+func (h *Webhooks) all() []Webhook {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	list := make([]Webhook, 0, len(h.hooks))
+	for _, hook := range h.hooks {
+		list = append(list, hook)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// Return the state of the deliveries to the webhook, created if needed. Must be called with h.mu held.
+func (h *Webhooks) state(name string) *webhookState {
+
+	state, ok := h.states[name]
+	if !ok {
+		state = &webhookState{}
+		h.states[name] = state
+	}
+
+	return state
+}
+
+// Whether a delivery to the webhook is due at now.
+func (h *Webhooks) due(name string, now time.Time) bool {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return !now.Before(h.state(name).nextAttempt)
+}
+
+// Return the revision checked last for the webhook, 0 if none was.
+func (h *Webhooks) checked(name string) int64 {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.state(name).revision
+}
+
+// Record that the changes upto the revision don't concern the webhook, without recording it through
+// the log: the next leader checks them again.
+func (h *Webhooks) skipped(name string, revision int64) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if state := h.state(name); revision > state.revision {
+		state.revision = revision
+	}
+}
+
+// Record the outcome of a delivery to the webhook at now, scheduling its retry if it failed.
+func (h *Webhooks) delivered(name string, revision int64, err error, now time.Time) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	state := h.state(name)
+
+	if err == nil {
+		state.revision, state.failures, state.lastError, state.nextAttempt = revision, 0, "", time.Time{}
+		return
+	}
+
+	state.failures++
+	state.lastError = err.Error()
+
+	backoff := webhookInterval
+	for i := 1; i < state.failures && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+
+	state.nextAttempt = now.Add(backoff)
+}
+
+// Return the operation of the log entry setting (or removing, if hook is nil) a webhook.
+func webhookOperation(name string, hook *Webhook) []string {
+
+	if hook == nil {
+		return []string{"WEBHOOK", name, "", "UNSET"}
+	}
+
+	record, _ := json.Marshal(hook)
+	return []string{"WEBHOOK", name, string(record), "SET"}
+}
+
+// Return the transaction applying the "WEBHOOK" log entry to the key-value store, along with the
+// name and new record (nil if removed) of the webhook. The deliveries of a removed webhook are
+// forgotten along with it.
+func webhookTxn(entry *protos.LogEntry) (kv_store.Txn, string, *Webhook) {
+
+	name := entry.Operation[1]
+
+	if entry.Operation[3] == "UNSET" {
+		return kv_store.Txn{Success: []kv_store.Op{
+			{Type: kv_store.OpDelete, Key: WebhooksPrefix + name},
+			{Type: kv_store.OpDelete, Key: WebhookCursorsPrefix + name},
+		}}, name, nil
+	}
+
+	var hook Webhook
+	json.Unmarshal([]byte(entry.Operation[2]), &hook)
+
+	return kv_store.Txn{Success: []kv_store.Op{{Type: kv_store.OpPut, Key: WebhooksPrefix + name, Value: entry.Operation[2]}}}, name, &hook
+}
+
+// Load the webhooks persisted in the local key-value store.
+func (node *RaftNode) loadWebhooks() {
+
+	kvs, err := node.scanLocalStore(WebhooksPrefix)
+	if err != nil {
+		node.logger().Warn().Err(err).Msg("Unable to load the webhooks")
+		return
+	}
+
+	for _, kv := range kvs {
+
+		var hook Webhook
+		if err := json.Unmarshal([]byte(kv.Value), &hook); err != nil {
+			node.logger().Warn().Err(err).Str("key", kv.Key).Msg("Invalid webhook record")
+			continue
+		}
+
+		node.Meta.webhooks.apply(hook.Name, &hook)
+	}
+
+	node.logger().Info().Int("count", len(kvs)).Msg("Loaded webhooks")
+}
+
+// Handle requests listing the webhooks, as applied by this replica.
+func (node *RaftNode) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, node.Meta.webhooks.List())
+}
+
+/*
+Handle requests creating or replacing (PUT) and removing (DELETE) a webhook. A PUT request takes the
+URL of the webhook, and either the prefix of its keys or its zone, along with its secret. The response
+is sent once the change is applied on the leader.
+*/
+func (node *RaftNode) SetWebhookHandler(w http.ResponseWriter, r *http.Request) {
+
+	node.logger().Info().Msg("WEBHOOK request received")
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "ParseForm() err: %v", err)
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+	if !userNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "Invalid webhook name: %q", name)
+		return
+	}
+
+	var hook *Webhook
+
+	if r.Method == http.MethodDelete {
+
+		if _, ok := node.Meta.webhooks.Get(name); !ok {
+			writeError(w, http.StatusNotFound, "Error: Webhook %v doesn't exist.", name)
+			return
+		}
+
+	} else {
+
+		hook = &Webhook{Name: name, URL: r.FormValue("url"), Prefix: r.FormValue("prefix"), Secret: r.FormValue("secret")}
+
+		if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, http.StatusBadRequest, "Invalid url %q, expected an http or https URL", hook.URL)
+			return
+		}
+
+		if z := r.FormValue("zone"); z != "" {
+
+			if hook.Prefix != "" {
+				writeError(w, http.StatusBadRequest, "Error: Expected a prefix or a zone, not both")
+				return
+			}
+
+			hook.Zone = zone.CanonicalName(z)
+		}
+	}
+
+	author := ""
+	if u, ok := requestUser(r.Context()); ok {
+		author = u.Name
+	}
+
+	node.GetRLock("Set Webhook Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		node.ReleaseRLock("Set Webhook Handler")
+		return
+	}
+
+	index, success, err := node.proposeCommand(r.Context(), webhookOperation(name, hook), author) // releases the lock
+	if !success {
+		node.logger().Error().Err(err).Str("name", name).Msg("Error occured in WEBHOOK request")
+		writeError(w, http.StatusServiceUnavailable, "Error occured in WEBHOOK request: %v", err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), node.Meta.Config.WriteRouteTimeout)
+	defer cancel()
+
+	if err := node.waitApplied(ctx, index); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Error: Webhook change committed but not applied yet: %v", err)
+		return
+	}
+
+	node.logger().Info().Str("name", name).Int32("index", index).Str("author", author).Msg("WEBHOOK request completed successfully and committed")
+
+	if hook == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "deleted": true, "index": index})
+		return
+	}
+
+	hook.Secret = ""
+	writeJSON(w, http.StatusOK, map[string]interface{}{"webhook": hook, "index": index})
+}
+
+// A delivery prepared by the leader, and the revision it records once acknowledged.
+type pendingDelivery struct {
+	hook     Webhook
+	body     WebhookDelivery
+	deliver  bool // Whether the delivery is sent, rather than only recorded
+	recorded int64
+}
+
+/*
+Return the deliveries due at now, along with the changes of their keys since the revisions delivered
+last, read from the store. The webhooks without any change to deliver are left out. Must be called on
+the leader, with the read lock held.
+*/
+func (node *RaftNode) pendingDeliveries(now time.Time) ([]pendingDelivery, error) {
+
+	response, status, err := node.readFromStore("prefix/" + url.PathEscape(WebhookCursorsPrefix) + "?limit=1000")
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("status %v", status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var page kv_store.RangeResponse
+	if err := json.Unmarshal([]byte(response), &page); err != nil {
+		return nil, err
+	}
+
+	cursors := make(map[string]int64)
+	for _, kv := range page.Kvs {
+		if revision, err := strconv.ParseInt(kv.Value, 10, 64); err == nil {
+			cursors[strings.TrimPrefix(kv.Key, WebhookCursorsPrefix)] = revision
+		}
+	}
+
+	var pending []pendingDelivery
+
+	for _, hook := range node.Meta.webhooks.all() {
+
+		if !node.Meta.webhooks.due(hook.Name, now) {
+			continue
+		}
+
+		// The changes of the reserved keys, e.g. the cursors themselves, are skipped without being
+		// recorded, which would change the revision again.
+		from, ok := cursors[hook.Name]
+		if checked := node.Meta.webhooks.checked(hook.Name); ok && checked > from {
+			from = checked
+		}
+
+		body := WebhookDelivery{Webhook: hook.Name, From: from, To: page.Revision, Changes: make([]kv_store.Change, 0)}
+
+		// A new webhook starts from the current revision.
+		if !ok {
+			pending = append(pending, pendingDelivery{hook: hook, body: body, recorded: page.Revision})
+			continue
+		}
+
+		if from >= page.Revision {
+			continue
+		}
+
+		query := url.Values{"from": {strconv.FormatInt(from, 10)}, "to": {strconv.FormatInt(page.Revision, 10)}}
+
+		response, status, err := node.readFromStore("changes/" + url.PathEscape(hook.keyPrefix()) + "?" + query.Encode())
+		if err != nil {
+			return nil, err
+		}
+
+		// The changes since the revision delivered last are no longer retained.
+		if status == http.StatusBadRequest {
+			body.Reset = true
+			pending = append(pending, pendingDelivery{hook: hook, body: body, deliver: true, recorded: page.Revision})
+			continue
+		}
+
+		var changes kv_store.ChangesResponse
+		if status != http.StatusOK || json.Unmarshal([]byte(response), &changes) != nil {
+			return nil, fmt.Errorf("invalid changes of the webhook %v: %v", hook.Name, strings.TrimSpace(response))
+		}
+
+		for _, change := range changes.Changes {
+			if hook.matches(change.Key) {
+				body.Changes = append(body.Changes, change)
+			}
+		}
+
+		if len(body.Changes) == 0 {
+			node.Meta.webhooks.skipped(hook.Name, page.Revision)
+			continue
+		}
+
+		pending = append(pending, pendingDelivery{hook: hook, body: body, deliver: true, recorded: page.Revision})
+	}
+
+	return pending, nil
+}
+
+// POST the changes to the webhook, returning an error unless they are acknowledged.
+func deliverWebhook(ctx context.Context, hook Webhook, delivery WebhookDelivery) error {
+
+	body, _ := json.Marshal(delivery)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Job delivering the changes of the store to the webhooks, and recording their deliveries through
+// the log.
+func (node *RaftNode) webhooksJob() LeaderJob {
+
+	return LeaderJob{
+		Name:     "webhooks",
+		Interval: webhookInterval,
+		Run: func(ctx context.Context) error {
+
+			node.GetRLock("Webhooks Job")
+
+			if node.state != Leader {
+				node.ReleaseRLock("Webhooks Job")
+				return nil
+			}
+
+			pending, err := node.pendingDeliveries(node.now())
+			node.ReleaseRLock("Webhooks Job")
+
+			if err != nil {
+				return err
+			}
+
+			var ops []kv_store.Op
+
+			for _, p := range pending {
+
+				if p.deliver {
+
+					err := deliverWebhook(ctx, p.hook, p.body)
+					node.Meta.webhooks.delivered(p.hook.Name, p.recorded, err, node.now())
+
+					outcome := "delivered"
+					switch {
+					case err != nil:
+						outcome = "failed"
+					case p.body.Reset:
+						outcome = "reset"
+					}
+
+					node.Meta.metrics.Add("webhook_deliveries_total", 1, "webhook", p.hook.Name, "outcome", outcome)
+
+					if err != nil {
+						node.logger().Warn().Err(err).Str("webhook", p.hook.Name).Int64("from", p.body.From).Int64("to", p.body.To).Msg("Unable to deliver the changes to the webhook")
+						continue
+					}
+				}
+
+				ops = append(ops, kv_store.Op{Type: kv_store.OpPut, Key: WebhookCursorsPrefix + p.hook.Name, Value: strconv.FormatInt(p.recorded, 10)})
+			}
+
+			if len(ops) == 0 {
+				return nil
+			}
+
+			return node.proposeRecords(ctx, webhookClient, ops)
+		},
+	}
+}
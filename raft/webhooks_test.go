@@ -0,0 +1,204 @@
+package raft
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks that the webhooks are replicated through the log, that
+ * the leader finds the changes of their keys since the revision they were
+ * delivered last, the reserved keys aside, that the deliveries are signed and
+ * acknowledged by a 2xx response, and that the failed ones are retried with a
+ * backoff.
+ */
+func TestWebhooks(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := kv_store.InitializeStore(filepath.Join(dir, "store"))
+	for _, hook := range applyHooks {
+		kv.RegisterHook(hook)
+	}
+
+	store := httptest.NewServer(kv.Router())
+	defer store.Close()
+
+	clock := NewManualClock(time.Unix(1000, 0))
+
+	node := &RaftNode{Meta: &NodeMetadata{settings: NewSettings(), metrics: NewMetrics(), webhooks: NewWebhooks(), Config: DefaultConfig(), clock: clock}}
+	node.Meta.kvstore_addr = store.URL[strings.LastIndex(store.URL, ":"):]
+	node.Meta.state_machine = testStateMachine(kv)
+	node.watches = NewWatchHub()
+	node.reads = newReadCoalescer(func() bool { return true })
+	node.txn_results = make(map[int32]kv_store.TxnResult)
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"NO-OP"}}}
+
+	apply := func(operation ...string) {
+		node.log = append(node.log, protos.LogEntry{Term: 1, Operation: operation})
+		if !node.applyEntry(int32(len(node.log) - 1)) {
+			t.Fatalf("Unable to apply %v", operation)
+		}
+	}
+
+	// The deliveries due, read on the leader as the job does.
+	pending := func() []pendingDelivery {
+
+		node.GetRLock("Test")
+		defer node.ReleaseRLock("Test")
+
+		deliveries, err := node.pendingDeliveries(node.now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return deliveries
+	}
+
+	// The leader records the deliveries through the log, as the job does.
+	record := func(deliveries ...pendingDelivery) {
+
+		var ops []kv_store.Op
+		for _, p := range deliveries {
+			ops = append(ops, kv_store.Op{Type: kv_store.OpPut, Key: WebhookCursorsPrefix + p.hook.Name, Value: strconv.FormatInt(p.recorded, 10)})
+		}
+
+		encoded, _ := json.Marshal(kv_store.Txn{Success: ops})
+		apply("TXN", string(encoded))
+	}
+
+	received := make(chan WebhookDelivery, 10)
+	status := http.StatusOK
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		var delivery WebhookDelivery
+		json.Unmarshal(body, &delivery)
+
+		// Only the zone webhook has a secret.
+		signature := ""
+		if delivery.Webhook == "zone" {
+			mac := hmac.New(sha256.New, []byte("s3cr3t"))
+			mac.Write(body)
+			signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+
+		if r.Header.Get("X-Webhook-Signature") != signature {
+			t.Errorf("Unexpected signature %q of the %v webhook", r.Header.Get("X-Webhook-Signature"), delivery.Webhook)
+		}
+
+		received <- delivery
+
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	apply(webhookOperation("zone", &Webhook{Name: "zone", URL: receiver.URL, Zone: "example.com.", Secret: "s3cr3t"})...)
+	apply(webhookOperation("app", &Webhook{Name: "app", URL: receiver.URL, Prefix: "app."})...)
+
+	if list := node.Meta.webhooks.List(); len(list) != 2 || list[1].Name != "zone" || list[1].Secret != "" {
+		t.Fatalf("Expected the 2 webhooks without their secrets, got %+v", list)
+	}
+
+	node.state = Leader
+
+	// The new webhooks start from the current revision, without a delivery.
+	deliveries := pending()
+	if len(deliveries) != 2 || deliveries[0].deliver || deliveries[1].deliver {
+		t.Fatalf("Expected the 2 new webhooks to only be recorded, got %+v", deliveries)
+	}
+	record(deliveries...)
+
+	if deliveries := pending(); len(deliveries) != 0 {
+		t.Fatalf("Expected no changes to deliver, got %+v", deliveries)
+	}
+
+	apply("POST", "dns:www.example.com.:A", "v1")
+	apply("POST", "dns:www.example.org.:A", "o")
+	apply("PUT", "dns:www.example.com.:A", "v2")
+	apply("POST", "app.name", "x")
+
+	deliveries = pending()
+	if len(deliveries) != 2 || !deliveries[0].deliver || len(deliveries[0].body.Changes) != 1 || deliveries[0].body.Changes[0].Key != "app.name" {
+		t.Fatalf("Expected the change of the prefix of the app webhook, got %+v", deliveries)
+	}
+
+	delivery := deliveries[1].body
+	if len(delivery.Changes) != 1 || delivery.Changes[0].Before != nil || *delivery.Changes[0].After != "v2" || delivery.To <= delivery.From {
+		t.Fatalf("Expected the change of the record of the zone, got %+v", delivery)
+	}
+
+	if err := deliverWebhook(context.Background(), deliveries[1].hook, delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-received; got.Webhook != "zone" || got.To != delivery.To || len(got.Changes) != 1 {
+		t.Errorf("Unexpected delivery %+v", got)
+	}
+
+	node.Meta.webhooks.delivered("zone", deliveries[1].recorded, nil, node.now())
+	record(deliveries[1])
+
+	// The failed deliveries are retried after the backoff.
+	status = http.StatusInternalServerError
+
+	deliveries = pending()
+	if len(deliveries) != 1 || deliveries[0].hook.Name != "app" {
+		t.Fatalf("Expected only the app webhook to be due, got %+v", deliveries)
+	}
+
+	err = deliverWebhook(context.Background(), deliveries[0].hook, deliveries[0].body)
+	<-received
+	if err == nil {
+		t.Fatal("Expected the delivery to fail")
+	}
+
+	node.Meta.webhooks.delivered("app", deliveries[0].recorded, err, node.now())
+	node.Meta.webhooks.delivered("app", deliveries[0].recorded, err, node.now())
+
+	if list := node.Meta.webhooks.List(); list[0].Failures != 2 || !list[0].NextAttempt.Equal(node.now().Add(2*webhookInterval)) {
+		t.Errorf("Expected the retry of the app webhook to back off, got %+v", list[0])
+	}
+
+	if deliveries := pending(); len(deliveries) != 0 {
+		t.Errorf("Expected the app webhook to wait for its retry, got %+v", deliveries)
+	}
+
+	clock.Advance(2 * webhookInterval)
+
+	if deliveries := pending(); len(deliveries) != 1 || deliveries[0].body.From != delivery.From {
+		t.Errorf("Expected the app webhook to be retried from its cursor, got %+v", deliveries)
+	}
+
+	// Removing a webhook forgets its deliveries.
+	apply(webhookOperation("app", nil)...)
+
+	if _, ok := node.Meta.webhooks.Get("app"); ok {
+		t.Error("Expected the app webhook to be removed")
+	}
+
+	if deliveries := pending(); len(deliveries) != 0 {
+		t.Errorf("Expected no more deliveries, got %+v", deliveries)
+	}
+}
@@ -0,0 +1,78 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+Witness replicas, which break ties in two-datacenter deployments without holding a third copy of
+the data. A witness is a member of the configuration whose Witness flag is set: it receives the log
+and votes like any other member, so it counts towards the quorums of elections and commits, but it
+never starts an election (nor accepts a leadership transfer), and it skips the entries that change
+the keys when applying the log. Its key-value store only holds the replicated settings, users and
+roles, so it doesn't serve snapshots, digests or watches.
+
+A witness keeps the log, so that it only votes for a replica holding the committed entries. If the
+only data replica holding some of them is down, the cluster waits for it rather than losing them.
+At least one member of a configuration must not be a witness.
+*/
+
+var errWitness = errors.New("this replica is a witness, which holds no keys")
+
+/*
+ParseWitnesses parses the comma separated IDs of the initial members that are witnesses (e.g.
+"2"). An empty spec means that the cluster has no witness, in which case nil is returned.
+*/
+func ParseWitnesses(spec string, n_replicas int) ([]int32, error) {
+
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	var witnesses []int32
+	seen := make(map[int]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+
+		id, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil || id < 0 || id >= n_replicas {
+			return nil, fmt.Errorf("invalid witness %q, expected the ID of one of the %v replicas", entry, n_replicas)
+		}
+
+		if !seen[id] {
+			seen[id] = true
+			witnesses = append(witnesses, int32(id))
+		}
+	}
+
+	if len(witnesses) == n_replicas {
+		return nil, fmt.Errorf("at least one replica must not be a witness")
+	}
+
+	return witnesses, nil
+}
+
+// Whether this replica is a witness of its current configuration. Must be called with the (read) lock held.
+func (node *RaftNode) isWitness() bool {
+
+	m, ok := node.member(node.Meta.replica_id)
+	return ok && m.Witness
+}
+
+// Whether the entry changes the keys of the store, and is thus skipped by witnesses.
+func isDataEntry(entry *protos.LogEntry) bool {
+
+	switch entry.Operation[0] {
+
+	case "POST", "PUT", "DELETE", "TXN", "DELETE_PREFIX", "COMPACT":
+		return true
+
+	}
+
+	return false
+}
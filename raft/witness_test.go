@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"context"
+	"testing"
+
+	"github.com/krithikvaidya/distributed-dns/raft/protos"
+)
+
+/*
+ * This test case checks the parsing of the initial witnesses, that the
+ * witness flag of a member survives a configuration change, and that a
+ * witness refuses to take over the leadership.
+ */
+func TestWitness(t *testing.T) {
+
+	if witnesses, err := ParseWitnesses("2, 2", 3); err != nil || len(witnesses) != 1 || witnesses[0] != 2 {
+		t.Errorf("Expected replica 2 to be the only witness, got %v (%v)", witnesses, err)
+	}
+
+	for _, spec := range []string{"3", "x", "0,1,2"} {
+		if _, err := ParseWitnesses(spec, 3); err == nil {
+			t.Errorf("Expected the witnesses %q to be rejected", spec)
+		}
+	}
+
+	node := &RaftNode{
+		Meta: &NodeMetadata{
+			replica_id: 2,
+			Config:     DefaultConfig(),
+		},
+		state: Follower,
+	}
+
+	node.Meta.initial_members = []Member{defaultMember(0), defaultMember(1), defaultMember(2)}
+	node.Meta.peer_replica_clients = make([]Transport, 3)
+	node.nextIndex = make([]int32, 3)
+	node.matchIndex = make([]int32, 3)
+
+	node.refreshMembership()
+
+	if node.isWitness() {
+		t.Fatalf("Expected replica 2 not to be a witness of the initial configuration")
+	}
+
+	witness := defaultMember(2)
+	witness.Witness = true
+
+	members := []Member{defaultMember(0), defaultMember(1), witness}
+	node.log = []protos.LogEntry{{Term: 1, Operation: []string{"CONFIG", encodeMembers(members)}}}
+	node.refreshMembership()
+
+	if !node.isWitness() {
+		t.Fatalf("Expected replica 2 to be a witness, got %v", node.Meta.members)
+	}
+
+	if response, err := node.TimeoutNow(context.Background(), &protos.TimeoutNowMessage{Term: 0, LeaderId: 0}); err != nil || response.Success {
+		t.Errorf("Expected a witness to refuse the leadership, got %v (%v)", response, err)
+	}
+
+	if !isDataEntry(&protos.LogEntry{Operation: []string{"TXN", "{}"}}) || isDataEntry(&protos.LogEntry{Operation: []string{"USER", "a", "{}"}}) {
+		t.Errorf("Expected witnesses to skip the writes of keys only")
+	}
+}
@@ -0,0 +1,99 @@
+//go:build long
+// +build long
+
+package raft
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/krithikvaidya/distributed-dns/linearizability"
+)
+
+var (
+	workloadDuration = flag.Duration("workload.duration", 30*time.Second, "duration of the workload of TestLinearizability")
+	workloadSeed     = flag.Int64("workload.seed", 0, "seed of the workload of TestLinearizability, the current time if 0")
+	workloadKill     = flag.Duration("workload.kill", 5*time.Second, "time between two replicas killed by TestLinearizability, 0 to kill none")
+)
+
+const (
+	workloadReplicas = 3
+	workloadClients  = 5
+	workloadKeys     = 4
+)
+
+/*
+ * This test case runs concurrent clients against a cluster of real replica
+ * processes, creating, reading, overwriting and deleting a few keys, while a
+ * random replica is killed every -workload.kill (and restarted). The history
+ * of their operations is then checked for linearizability, see the
+ * linearizability package.
+ *
+ * Run it with go test -tags long ./raft -run TestLinearizability, and
+ * -workload.seed to replay the workload of a run (though not the scheduling).
+ */
+func TestLinearizability(t *testing.T) {
+
+	if testing.Short() {
+		t.Skip("runs a cluster of processes")
+	}
+
+	seed := *workloadSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	cluster := startProcessCluster(t, workloadReplicas, "", "", seed)
+	defer cluster.close()
+
+	// The nemesis, killing a replica at a time.
+	stop := make(chan struct{})
+	killed := make(chan struct{})
+
+	go func() {
+
+		defer close(killed)
+
+		if *workloadKill <= 0 {
+			return
+		}
+
+		random := rand.New(rand.NewSource(seed - 1))
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(*workloadKill):
+				cluster.kill(random.Intn(workloadReplicas))
+			}
+		}
+	}()
+
+	history := cluster.runWorkload(workloadClients, *workloadDuration, func(random *rand.Rand, client, n int) linearizability.KVInput {
+
+		in := linearizability.KVInput{Op: linearizability.KVGet, Key: fmt.Sprintf("key%v", random.Intn(workloadKeys))}
+
+		switch p := random.Intn(10); {
+		case p < 2:
+			in.Op, in.Value = linearizability.KVCreate, fmt.Sprintf("c%v-%v", client, n)
+		case p < 4:
+			in.Op, in.Value = linearizability.KVPut, fmt.Sprintf("c%v-%v", client, n)
+		case p < 5:
+			in.Op = linearizability.KVDelete
+		}
+
+		return in
+	})
+
+	close(stop)
+	<-killed
+	cluster.stop()
+
+	done := checkHistory(t, seed, history)
+
+	t.Logf("seed %v: %v operations completed, %v with an unknown outcome, %v replicas killed", seed, done, len(history)-done, cluster.restarts)
+}
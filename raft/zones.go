@@ -0,0 +1,172 @@
+package raft
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/krithikvaidya/distributed-dns/raft/kv_store"
+	"github.com/krithikvaidya/distributed-dns/zone"
+)
+
+// The outcome of the validation of a set of records.
+type ZoneValidation struct {
+	Zone        string            `json:"zone"`
+	Valid       bool              `json:"valid"` // Whether no error was found, warnings aside
+	Diagnostics []zone.Diagnostic `json:"diagnostics"`
+}
+
+/*
+Handle requests of the form /zones/{zone}/validate, checking the JSON array of records in the body
+as the content of the zone (see zone.Validate). Nothing is written, so any replica can answer.
+*/
+func (node *RaftNode) ValidateZoneHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := mux.Vars(r)["zone"]
+
+	node.logger().Info().Str("zone", name).Msg("VALIDATE request received")
+
+	if !validNames(w, name) {
+		return
+	}
+
+	var records []zone.Record
+	if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid records, expected a JSON array of records: %v", err)
+		return
+	}
+
+	diagnostics := zone.Validate(name, records)
+	if diagnostics == nil {
+		diagnostics = []zone.Diagnostic{}
+	}
+
+	writeJSON(w, http.StatusOK, ZoneValidation{
+		Zone:        zone.CanonicalName(name),
+		Valid:       !zone.HasErrors(diagnostics),
+		Diagnostics: diagnostics,
+	})
+}
+
+// The records of a zone added, removed and changed between two revisions of the store.
+type ZoneDiff struct {
+	Zone string `json:"zone"`
+	From int64  `json:"from"`
+	To   int64  `json:"to"`
+	zone.Diff
+}
+
+/*
+Handle requests of the form /zones/{zone}/diff?from=<rev>&to=<rev>, returning the records of the zone
+added, removed and changed between the two revisions of the store, from the history of its keys
+(see kv_store/mvcc.go). Without to, the changes upto the latest revision are returned, the revision
+being in the response. Both revisions must be newer than the last compaction.
+*/
+func (node *RaftNode) ZoneDiffHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := zone.CanonicalName(mux.Vars(r)["zone"])
+
+	node.logger().Info().Str("zone", name).Msg("ZONE DIFF request received")
+
+	if !validNames(w, name) {
+		return
+	}
+
+	query := url.Values{}
+	for _, param := range []string{"from", "to"} {
+
+		value := r.FormValue(param)
+		if value == "" && param == "to" {
+			continue
+		}
+
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid revision %v=%q", param, value)
+			return
+		}
+
+		query.Set(param, value)
+	}
+
+	node.GetRLock("Zone Diff Handler")
+	defer node.ReleaseRLock("Zone Diff Handler")
+
+	if node.state != Leader {
+		writeNotLeader(w, node.Meta.leaderAddress)
+		return
+	}
+
+	response, status, err := node.readFromStore("changes/" + url.PathEscape(zone.KeyPrefix) + "?" + query.Encode())
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "Read failed with error: %v", err)
+		return
+	}
+
+	if status != http.StatusOK {
+		writeError(w, status, "%v", strings.TrimSpace(response))
+		return
+	}
+
+	var changes kv_store.ChangesResponse
+	if err := json.Unmarshal([]byte(response), &changes); err != nil {
+		writeError(w, http.StatusInternalServerError, "Invalid changes from the key-value store: %v", err)
+		return
+	}
+
+	// Only the changed RRsets of the zone are compared.
+	var before, after []zone.Record
+
+	decode := func(key string, value *string) []zone.Record {
+
+		if value == nil {
+			return nil
+		}
+
+		var records []zone.Record
+		if err := json.Unmarshal([]byte(*value), &records); err != nil {
+			node.logger().Warn().Err(err).Str("key", key).Msg("Invalid RRset")
+		}
+
+		return records
+	}
+
+	for _, change := range changes.Changes {
+
+		owner, _, ok := zone.ParseRecordKey(change.Key)
+		if !ok || !zone.InZone(owner, name) || zone.IsPolicyKey(change.Key) {
+			continue
+		}
+
+		before = append(before, decode(change.Key, change.Before)...)
+		after = append(after, decode(change.Key, change.After)...)
+	}
+
+	writeJSON(w, http.StatusOK, ZoneDiff{
+		Zone: name,
+		From: changes.From,
+		To:   changes.To,
+		Diff: zone.DiffRecords(before, after),
+	})
+}
+
+// Check the names of a request, answering 400 if one of them isn't a valid DNS name (see
+// zone.ValidName). Return whether they all are.
+func validNames(w http.ResponseWriter, names ...string) bool {
+
+	for _, name := range names {
+		if err := zone.ValidName(name); err != nil {
+			writeError(w, http.StatusBadRequest, "Error: %v", err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// Whether the request validates the records of a zone, which only needs read access to the zone.
+func zoneValidation(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/zones/") && strings.HasSuffix(r.URL.Path, "/validate")
+}
@@ -0,0 +1,102 @@
+package zone
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+Differences between two versions of the records of a zone, e.g. as of two revisions of the store.
+A record is identified by its name, type and data: a record whose TTL alone differs is changed,
+any other difference is a removed record and an added one. An incremental zone transfer (RFC 1995)
+carries a changed record as removed, then added with its new TTL.
+*/
+
+// A record whose TTL differs between two versions of a zone.
+type RecordChange struct {
+	Before Record `json:"before"`
+	After  Record `json:"after"`
+}
+
+// The differences between two versions of the records of a zone.
+type Diff struct {
+	Added   []Record       `json:"added"`
+	Removed []Record       `json:"removed"`
+	Changed []RecordChange `json:"changed"`
+}
+
+// Whether the two versions have the same records.
+func (d Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Return the identity of a record: its canonical name, type and data. The data is in the
+// presentation format of the record if it can be parsed, so that e.g. "2001:DB8::1" and
+// "2001:db8::1" are the same AAAA record.
+func recordIdentity(r Record) string {
+
+	name, rtype := CanonicalName(r.Name), strings.ToUpper(r.Type)
+	data := strings.TrimSpace(r.Data)
+
+	if rr, err := dns.NewRR(fmt.Sprintf("%s 0 IN %s %s", name, rtype, data)); err == nil && rr != nil {
+		data = strings.TrimPrefix(rr.String(), rr.Header().String())
+	}
+
+	return name + " " + rtype + " " + data
+}
+
+// Return the canonical form of a record, with its name and type as used in the keys.
+func canonicalRecord(r Record) Record {
+	r.Name, r.Type = CanonicalName(r.Name), strings.ToUpper(r.Type)
+	return r
+}
+
+// Compute the differences between the records before and after, in the order of the records.
+func DiffRecords(before, after []Record) Diff {
+
+	diff := Diff{Added: []Record{}, Removed: []Record{}, Changed: []RecordChange{}}
+
+	// The records after, by identity. Identical records are matched one for one.
+	remaining := make(map[string][]Record)
+	for _, r := range after {
+		id := recordIdentity(r)
+		remaining[id] = append(remaining[id], r)
+	}
+
+	matched := make(map[string]int)
+
+	for _, r := range before {
+
+		id := recordIdentity(r)
+
+		candidates := remaining[id]
+		if len(candidates) == 0 {
+			diff.Removed = append(diff.Removed, canonicalRecord(r))
+			continue
+		}
+
+		if candidates[0].TTL != r.TTL {
+			diff.Changed = append(diff.Changed, RecordChange{Before: canonicalRecord(r), After: canonicalRecord(candidates[0])})
+		}
+
+		remaining[id] = candidates[1:]
+		matched[id]++
+	}
+
+	// The records after that weren't matched, in their order.
+	for _, r := range after {
+
+		id := recordIdentity(r)
+
+		if matched[id] > 0 {
+			matched[id]--
+			continue
+		}
+
+		diff.Added = append(diff.Added, canonicalRecord(r))
+	}
+
+	return diff
+}
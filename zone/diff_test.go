@@ -0,0 +1,64 @@
+package zone
+
+import (
+	"reflect"
+	"testing"
+)
+
+/*
+ * This test case checks that the records of two versions of a zone are matched
+ * by name, type and data regardless of their case and formatting, a change of
+ * TTL being reported as a changed record and any other change as a removed
+ * record and an added one.
+ */
+func TestDiffRecords(t *testing.T) {
+
+	before := []Record{
+		{Name: "www.example.com", Type: "A", TTL: 300, Data: "192.0.2.1"},
+		{Name: "www.example.com", Type: "A", TTL: 300, Data: "192.0.2.2"},
+		{Name: "example.com.", Type: "aaaa", TTL: 300, Data: "2001:DB8::1"},
+		{Name: "example.com", Type: "MX", TTL: 300, Data: "10 mail.example.com."},
+		{Name: "old.example.com", Type: "TXT", TTL: 60, Data: `"bye"`},
+	}
+
+	after := []Record{
+		{Name: "WWW.example.com", Type: "A", TTL: 600, Data: "192.0.2.1"},
+		{Name: "www.example.com", Type: "A", TTL: 300, Data: "192.0.2.3"},
+		{Name: "example.com", Type: "AAAA", TTL: 300, Data: "2001:db8:0::1"},
+		{Name: "example.com", Type: "MX", TTL: 300, Data: "20 mail.example.com."},
+		{Name: "new.example.com", Type: "TXT", TTL: 60, Data: `"hi"`},
+	}
+
+	diff := DiffRecords(before, after)
+
+	expected := Diff{
+		Added: []Record{
+			{Name: "www.example.com.", Type: "A", TTL: 300, Data: "192.0.2.3"},
+			{Name: "example.com.", Type: "MX", TTL: 300, Data: "20 mail.example.com."},
+			{Name: "new.example.com.", Type: "TXT", TTL: 60, Data: `"hi"`},
+		},
+		Removed: []Record{
+			{Name: "www.example.com.", Type: "A", TTL: 300, Data: "192.0.2.2"},
+			{Name: "example.com.", Type: "MX", TTL: 300, Data: "10 mail.example.com."},
+			{Name: "old.example.com.", Type: "TXT", TTL: 60, Data: `"bye"`},
+		},
+		Changed: []RecordChange{{
+			Before: Record{Name: "www.example.com.", Type: "A", TTL: 300, Data: "192.0.2.1"},
+			After:  Record{Name: "www.example.com.", Type: "A", TTL: 600, Data: "192.0.2.1"},
+		}},
+	}
+
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff:\n%+v\nexpected\n%+v", diff, expected)
+	}
+
+	if diff := DiffRecords(before, before); !diff.Empty() || diff.Added == nil {
+		t.Errorf("Expected an empty diff, got %+v", diff)
+	}
+
+	// Identical records are matched one for one.
+	twice := append([]Record{}, before[0], before[0])
+	if diff := DiffRecords(before[:1], twice); len(diff.Added) != 1 || len(diff.Removed) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("Expected a single added record, got %+v", diff)
+	}
+}
@@ -0,0 +1,117 @@
+package zone
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+Syntax of the names and keys written to the store. The names follow the preferred syntax of RFC 1035
+section 2.3.1: labels of at most 63 letters, digits and hyphens, neither starting nor ending with a
+hyphen, in a name of at most 253 characters (without the trailing dot). Two exceptions are common
+enough in the zones to be accepted:
+
+  - the labels may start with an underscore, as the service labels of RFC 2782 and RFC 8552 do
+    (e.g. "_sip._tcp.example.com.").
+  - the first label may be "*", the wildcard of RFC 4592.
+
+The root "." is a valid name.
+*/
+
+const (
+	maxNameLength  = 253
+	maxLabelLength = 63
+)
+
+// Return an error if the name isn't a valid domain name, see above. It may be relative or fully
+// qualified.
+func ValidName(name string) error {
+
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+
+	if name == "." {
+		return nil
+	}
+
+	trimmed := strings.TrimSuffix(name, ".")
+	if len(trimmed) > maxNameLength {
+		return fmt.Errorf("invalid name %q: longer than %v characters", name, maxNameLength)
+	}
+
+	for i, label := range strings.Split(trimmed, ".") {
+
+		if label == "*" && i == 0 {
+			continue
+		}
+
+		if err := validLabel(label); err != nil {
+			return fmt.Errorf("invalid name %q: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func validLabel(label string) error {
+
+	switch {
+
+	case label == "":
+		return fmt.Errorf("empty label")
+
+	case len(label) > maxLabelLength:
+		return fmt.Errorf("label %q longer than %v characters", label, maxLabelLength)
+
+	case label[0] == '-' || label[len(label)-1] == '-':
+		return fmt.Errorf("label %q starts or ends with a hyphen", label)
+
+	}
+
+	for i, c := range label {
+
+		letterOrDigit := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+
+		if !letterOrDigit && c != '-' && !(c == '_' && i == 0) {
+			return fmt.Errorf("label %q holds the invalid character %q", label, c)
+		}
+	}
+
+	return nil
+}
+
+// Return an error if the key, under KeyPrefix, isn't the canonical key of an RRset of a valid name
+// and a known type, or of its policy. The other keys aren't checked.
+func ValidRecordKey(key string) error {
+
+	if !strings.HasPrefix(key, KeyPrefix) {
+		return nil
+	}
+
+	name, rtype, ok := ParseRecordKey(key)
+	if !ok {
+		return fmt.Errorf("invalid record key %q, expected %v<name>:<TYPE>", key, KeyPrefix)
+	}
+
+	if err := ValidName(name); err != nil {
+		return err
+	}
+
+	if _, ok := dns.StringToType[rtype]; !ok {
+		return fmt.Errorf("unknown record type %q", rtype)
+	}
+
+	canonical := RecordKey(name, rtype)
+	if IsPolicyKey(key) {
+		canonical = PolicyKey(name, rtype)
+	}
+
+	if key != canonical {
+		return fmt.Errorf("record key %q isn't canonical, expected %q", key, canonical)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package zone
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+ * This test case checks that the names follow the syntax of RFC 1035, with
+ * the service labels and wildcards, and that only the canonical keys of the
+ * RRsets and their policies are valid record keys.
+ */
+func TestValidName(t *testing.T) {
+
+	for _, name := range []string{".", "example.com", "www.example.com.", "a-b.example.com.", "_sip._tcp.example.com.", "*.example.com.", "xn--bcher-kva.example.", "1.2.0.192.in-addr.arpa."} {
+		if err := ValidName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	long := strings.Repeat("a", 63) + "."
+	for _, name := range []string{"", "..", "www..example.com.", "-www.example.com.", "www-.example.com.", "w_w.example.com.", "www.*.example.com.", "www example.com.", "www.exämple.com.", strings.Repeat("a", 64) + ".com.", strings.Repeat(long, 4) + "com."} {
+		if err := ValidName(name); err == nil {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+
+	for key, valid := range map[string]bool{
+		"dns:www.example.com.:A":        true,
+		"dns:www.example.com.:A#POLICY": true,
+		"dns:_dmarc.example.com.:TXT":   true,
+		"app.config":                    true,
+		"dns:WWW.example.com.:A":        false,
+		"dns:www.example.com:A":         false,
+		"dns:www.example.com.:a":        false,
+		"dns:www.example.com.:BOGUS":    false,
+		"dns:www..example.com.:A":       false,
+		"dns:www.example.com.":          false,
+	} {
+		if err := ValidRecordKey(key); (err == nil) != valid {
+			t.Errorf("Expected the validity of %q to be %v, got %v", key, valid, err)
+		}
+	}
+}
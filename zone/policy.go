@@ -0,0 +1,81 @@
+package zone
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+Response policies of the RRsets. The policy of an RRset is stored next to it, as a JSON object under
+its key followed by PolicySuffix (e.g. "dns:www.example.com.:A#POLICY"), so that it belongs to the
+name of the RRset wherever the records do (federated zones, shards, ACLs), and is replicated and
+deleted along with them. ParseRecordKey returns the name and type of the RRset of a policy key, and
+IsPolicyKey tells the policies apart from the records.
+
+The policies are:
+
+	round_robin  the records are rotated at each answer
+	weighted     the records are chosen at random, in proportion to their weights
+	failover     the records are answered in their stored order, leaving out those that are down
+
+Each policy answers at most Answers records, all of them if 0, except weighted which answers a
+single record by default.
+*/
+
+const PolicySuffix = "#POLICY"
+
+const (
+	PolicyRoundRobin = "round_robin"
+	PolicyWeighted   = "weighted"
+	PolicyFailover   = "failover"
+)
+
+// The response policy of an RRset.
+type Policy struct {
+	Mode    string         `json:"mode"`
+	Answers int            `json:"answers,omitempty"` // Records answered at most, see above
+	Weights map[string]int `json:"weights,omitempty"` // Weights of the records by data with weighted, 1 if absent
+	Down    []string       `json:"down,omitempty"`    // Data of the records left out with failover
+}
+
+// Return the key under which the policy of the RRset of the given name and type is stored.
+func PolicyKey(name, rtype string) string {
+	return RecordKey(name, rtype) + PolicySuffix
+}
+
+// Whether the key holds the policy of an RRset rather than its records.
+func IsPolicyKey(key string) bool {
+	return strings.HasPrefix(key, KeyPrefix) && strings.HasSuffix(key, PolicySuffix)
+}
+
+func (p Policy) Validate() error {
+
+	switch p.Mode {
+
+	case PolicyRoundRobin, PolicyWeighted, PolicyFailover:
+
+	default:
+		return fmt.Errorf("unknown policy mode %q, expected %v, %v or %v", p.Mode, PolicyRoundRobin, PolicyWeighted, PolicyFailover)
+
+	}
+
+	if p.Answers < 0 {
+		return fmt.Errorf("the number of answers can't be negative")
+	}
+
+	if len(p.Weights) > 0 && p.Mode != PolicyWeighted {
+		return fmt.Errorf("only the weighted policy has weights")
+	}
+
+	for data, weight := range p.Weights {
+		if weight < 0 {
+			return fmt.Errorf("the weight of %q can't be negative", data)
+		}
+	}
+
+	if len(p.Down) > 0 && p.Mode != PolicyFailover {
+		return fmt.Errorf("only the failover policy has records down")
+	}
+
+	return nil
+}
@@ -0,0 +1,206 @@
+package zone
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+/*
+Validation of a set of records meant for a zone, reporting every problem found rather than stopping
+at the first one:
+
+	syntax          the name, type or data of a record can't be parsed
+	out_of_zone     the record doesn't belong to the zone
+	duplicate       the record is identical to another record of its RRset
+	ttl_mismatch    the records of an RRset have different TTLs (a warning, see RFC 2181 section 5.2)
+	cname_conflict  a name has several CNAME records, or a CNAME along with other data
+	missing_glue    an NS record points to a name inside the zone that has no A or AAAA record
+	regions         a record other than A or AAAA is meant for regions, or a region is empty
+
+Only the given records are considered, not those already stored.
+*/
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// A problem found in a set of records.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Record   int    `json:"record"` // Index of the record in the validated set
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Message  string `json:"message"`
+}
+
+// Whether any of the diagnostics is an error, rather than a warning.
+func HasErrors(diagnostics []Diagnostic) bool {
+
+	for _, d := range diagnostics {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A record that could be parsed, along with its index in the validated set.
+type parsedRecord struct {
+	index int
+	rr    dns.RR
+}
+
+// Types that may exist at a name along with a CNAME record (RFC 4035 section 2.5).
+var cnameCompatible = map[string]bool{"CNAME": true, "RRSIG": true, "NSEC": true}
+
+// Validate the records meant for the given zone, returning the problems found, in the order of the records.
+func Validate(zone string, records []Record) []Diagnostic {
+
+	var diagnostics []Diagnostic
+
+	report := func(severity, code string, index int, format string, args ...interface{}) {
+		r := records[index]
+		diagnostics = append(diagnostics, Diagnostic{
+			Severity: severity,
+			Code:     code,
+			Record:   index,
+			Name:     CanonicalName(r.Name),
+			Type:     strings.ToUpper(r.Type),
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	zone = CanonicalName(zone)
+
+	// RRsets by name and type, and the types found at each name.
+	rrsets := make(map[string][]parsedRecord)
+	types := make(map[string]map[string][]int)
+	var order []string
+
+	for i, r := range records {
+
+		name, rtype := CanonicalName(r.Name), strings.ToUpper(r.Type)
+
+		if ValidName(name) != nil || r.Name == "" {
+			report(SeverityError, "syntax", i, "invalid name %q", r.Name)
+			continue
+		}
+
+		if !InZone(name, zone) {
+			report(SeverityError, "out_of_zone", i, "%v isn't in the zone %v", name, zone)
+			continue
+		}
+
+		if _, ok := dns.StringToType[rtype]; !ok {
+			report(SeverityError, "syntax", i, "unknown record type %q", r.Type)
+			continue
+		}
+
+		// The data must hold a single record, without comments.
+		if strings.ContainsAny(r.Data, "\n;") || strings.TrimSpace(r.Data) == "" {
+			report(SeverityError, "syntax", i, "invalid %v data %q", rtype, r.Data)
+			continue
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, r.TTL, rtype, r.Data))
+		if err != nil || rr == nil {
+			report(SeverityError, "syntax", i, "invalid %v data %q: %v", rtype, r.Data, err)
+			continue
+		}
+
+		if len(r.Regions) > 0 && rtype != "A" && rtype != "AAAA" {
+			report(SeverityError, "regions", i, "only the A and AAAA records can be meant for regions")
+		}
+
+		for _, region := range r.Regions {
+			if strings.TrimSpace(region) == "" {
+				report(SeverityError, "regions", i, "empty region")
+				break
+			}
+		}
+
+		key := name + " " + rtype
+		if _, ok := rrsets[key]; !ok {
+			order = append(order, key)
+		}
+		rrsets[key] = append(rrsets[key], parsedRecord{index: i, rr: rr})
+
+		if types[name] == nil {
+			types[name] = make(map[string][]int)
+		}
+		types[name][rtype] = append(types[name][rtype], i)
+	}
+
+	for _, key := range order {
+
+		rrset := rrsets[key]
+
+		for j, r := range rrset {
+
+			for _, previous := range rrset[:j] {
+				if dns.IsDuplicate(previous.rr, r.rr) {
+					report(SeverityError, "duplicate", r.index, "duplicate of record %v", previous.index)
+					break
+				}
+			}
+
+			if ttl := rrset[0].rr.Header().Ttl; r.rr.Header().Ttl != ttl {
+				report(SeverityWarning, "ttl_mismatch", r.index, "TTL %v differs from the TTL %v of record %v in the same RRset", r.rr.Header().Ttl, ttl, rrset[0].index)
+			}
+		}
+	}
+
+	for _, key := range order {
+
+		name := strings.SplitN(key, " ", 2)[0]
+		cnames := types[name]["CNAME"]
+
+		if !strings.HasSuffix(key, " CNAME") || len(cnames) == 0 {
+			continue
+		}
+
+		if len(cnames) > 1 {
+			for _, i := range cnames[1:] {
+				report(SeverityError, "cname_conflict", i, "%v has several CNAME records", name)
+			}
+		}
+
+		var others []string
+		for rtype := range types[name] {
+			if !cnameCompatible[rtype] {
+				others = append(others, rtype)
+			}
+		}
+
+		if len(others) > 0 {
+			sort.Strings(others)
+			report(SeverityError, "cname_conflict", cnames[0], "%v has a CNAME record along with %v data", name, strings.Join(others, ", "))
+		}
+	}
+
+	for _, key := range order {
+
+		if !strings.HasSuffix(key, " NS") {
+			continue
+		}
+
+		for _, r := range rrsets[key] {
+
+			target := CanonicalName(r.rr.(*dns.NS).Ns)
+
+			if InZone(target, zone) && len(types[target]["A"]) == 0 && len(types[target]["AAAA"]) == 0 {
+				report(SeverityError, "missing_glue", r.index, "name server %v is inside the zone but has no A or AAAA record", target)
+			}
+		}
+	}
+
+	sort.SliceStable(diagnostics, func(i, j int) bool { return diagnostics[i].Record < diagnostics[j].Record })
+
+	return diagnostics
+}
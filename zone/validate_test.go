@@ -0,0 +1,62 @@
+package zone
+
+import (
+	"reflect"
+	"testing"
+)
+
+/*
+ * This test case checks that each kind of problem is reported against the
+ * offending record, and that a valid zone gets no diagnostics.
+ */
+func TestValidate(t *testing.T) {
+
+	valid := []Record{
+		{Name: "example.com", Type: "NS", TTL: 3600, Data: "ns1.example.com."},
+		{Name: "ns1.example.com", Type: "A", TTL: 3600, Data: "192.0.2.1"},
+		{Name: "www.example.com", Type: "cname", TTL: 300, Data: "example.net."},
+		{Name: "example.com", Type: "MX", TTL: 300, Data: "10 mail.example.net."},
+		{Name: "example.com", Type: "NS", TTL: 3600, Data: "ns.example.org."},
+	}
+
+	if diagnostics := Validate("example.com.", valid); len(diagnostics) != 0 {
+		t.Errorf("Expected a valid zone, got %v", diagnostics)
+	}
+
+	records := []Record{
+		{Name: "a.example.com", Type: "A", TTL: 300, Data: "192.0.2.300"},         // 0: syntax
+		{Name: "a.example.org", Type: "A", TTL: 300, Data: "192.0.2.1"},           // 1: out_of_zone
+		{Name: "b.example.com", Type: "A", TTL: 300, Data: "192.0.2.1"},           // 2
+		{Name: "B.example.com.", Type: "A", TTL: 300, Data: "192.0.2.1"},          // 3: duplicate of 2
+		{Name: "b.example.com", Type: "A", TTL: 60, Data: "192.0.2.2"},            // 4: ttl_mismatch
+		{Name: "c.example.com", Type: "CNAME", TTL: 300, Data: "example.net."},    // 5: cname_conflict
+		{Name: "c.example.com", Type: "TXT", TTL: 300, Data: `"hello"`},           // 6
+		{Name: "example.com", Type: "NS", TTL: 300, Data: "ns2.example.com."},     // 7: missing_glue
+		{Name: "d.example.com", Type: "BOGUS", TTL: 300, Data: "x"},               // 8: syntax
+		{Name: "e.example.com", Type: "A", TTL: 300, Data: "192.0.2.1 ; comment"}, // 9: syntax
+	}
+
+	diagnostics := Validate("example.com", records)
+
+	var got [][2]interface{}
+	for _, d := range diagnostics {
+		got = append(got, [2]interface{}{d.Record, d.Code})
+	}
+
+	expected := [][2]interface{}{
+		{0, "syntax"}, {1, "out_of_zone"}, {3, "duplicate"}, {4, "ttl_mismatch"},
+		{5, "cname_conflict"}, {7, "missing_glue"}, {8, "syntax"}, {9, "syntax"},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected the diagnostics %v, got %v", expected, got)
+	}
+
+	if diagnostics[3].Severity != SeverityWarning || diagnostics[3].Name != "b.example.com." {
+		t.Errorf("Expected a TTL mismatch to be a warning on b.example.com., got %+v", diagnostics[3])
+	}
+
+	if !HasErrors(diagnostics) || HasErrors(diagnostics[3:4]) {
+		t.Errorf("Expected only errors to make the records invalid")
+	}
+}
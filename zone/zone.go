@@ -0,0 +1,69 @@
+/*
+Package zone models the DNS resource records stored in the replicated key-value store. All the
+records of a name and type (an RRset) are stored together as a JSON array under the key
+
+	dns:<name>:<TYPE>
+
+where the name is lower-cased and fully qualified (with a trailing dot), e.g.
+"dns:www.example.com.:A". Keeping the RRset in a single key lets it be updated atomically.
+
+It is shared by the client package, which reads and writes the records, and by the replicas,
+which validate them (see validate.go).
+*/
+package zone
+
+import (
+	"strings"
+)
+
+const KeyPrefix = "dns:"
+
+// Record is a single DNS resource record.
+type Record struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"` // The record data in presentation format, e.g. "192.0.2.1" for an A record
+
+	Regions []string `json:"regions,omitempty"` // Regions an A or AAAA record is meant for, see raft/geo.go
+}
+
+// Return the name in the canonical form used in the keys.
+func CanonicalName(name string) string {
+
+	name = strings.ToLower(name)
+
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	return name
+}
+
+// Return the key under which the RRset of the given name and type is stored.
+func RecordKey(name, rtype string) string {
+	return KeyPrefix + CanonicalName(name) + ":" + strings.ToUpper(rtype)
+}
+
+// Whether the name is the zone itself or one of its subdomains. Both must be canonical.
+func InZone(name, zone string) bool {
+	return name == zone || zone == "." || strings.HasSuffix(name, "."+zone)
+}
+
+// Return the name and type of the RRset stored under the key, if it is the key of an RRset or of its
+// policy (see policy.go).
+func ParseRecordKey(key string) (name, rtype string, ok bool) {
+
+	if !strings.HasPrefix(key, KeyPrefix) {
+		return "", "", false
+	}
+
+	rest := strings.TrimSuffix(strings.TrimPrefix(key, KeyPrefix), PolicySuffix)
+
+	i := strings.LastIndex(rest, ":")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+
+	return rest[:i], rest[i+1:], true
+}